@@ -0,0 +1,149 @@
+//go:build eth || op || base
+// +build eth op base
+
+package gasfeesvc
+
+import (
+	"context"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// BlockFeeSample is the fee history of a single block.
+type BlockFeeSample struct {
+	BaseFee      *big.Int   // base fee of the block in wei
+	Rewards      []*big.Int // effective tips in wei at the 0..99 percentiles, Rewards[0] is the min included tip
+	GasUsedRatio float64
+}
+
+// BlockFeeSamplesFromFeeHistory converts the raw output of eth_feeHistory into per block samples,
+// the extra trailing base fee of the next block is dropped.
+func BlockFeeSamplesFromFeeHistory(rewards [][]*big.Int, baseFees []*big.Int, gasUsedRatios []float64) []BlockFeeSample {
+	samples := make([]BlockFeeSample, 0, len(gasUsedRatios))
+	for i, ratio := range gasUsedRatios {
+		sample := BlockFeeSample{GasUsedRatio: ratio}
+		if i < len(baseFees) {
+			sample.BaseFee = baseFees[i]
+		}
+		if i < len(rewards) {
+			sample.Rewards = rewards[i]
+		}
+		samples = append(samples, sample)
+	}
+	return samples
+}
+
+// LevelBacktest is the backtest result of a single suggestion level.
+type LevelBacktest struct {
+	InclusionRate   float64 // ratio of the windows whose suggestion would have been included
+	AvgOverpayment  float64 // average gwei the included max fee exceeded the cheapest inclusion price by
+	WorstMissStreak int     // the most consecutive windows whose suggestion wouldn't have been included
+}
+
+// BacktestReport is the result of Backtest.
+type BacktestReport struct {
+	Windows int // number of windows a suggestion was made for
+	Skipped int // number of windows the suggestion failed for, e.g. ErrNo1559Support
+	Levels  map[string]*LevelBacktest
+}
+
+// Backtest slides a window of the blocks cfg queries over history, suggests gas fees for each window the same way
+// SuggestGasFeesWithConfig does in production, and checks whether each level would have been included in
+// one of the following horizon blocks, i.e. its max fee covers the block's base fee plus its min included tip.
+func Backtest(cfg ChainGasConfig, history []BlockFeeSample, horizon int) BacktestReport {
+	if horizon < 1 {
+		horizon = 1
+	}
+	report := BacktestReport{Levels: make(map[string]*LevelBacktest, len(cfg.Levels))}
+	blocks := cfg.blockCount(nil)
+	var (
+		included    = make(map[string]int, len(cfg.Levels))
+		overpayment = make(map[string]float64, len(cfg.Levels))
+		missStreak  = make(map[string]int, len(cfg.Levels))
+	)
+	for _, level := range cfg.Levels {
+		report.Levels[level] = &LevelBacktest{}
+	}
+	// every window needs at least one block after it to be evaluated against
+	for last := blocks - 1; last < len(history)-1; last++ {
+		oldest := last - blocks + 1
+		window := history[oldest : last+1]
+		next := history[last+1].BaseFee
+		feeHistory := func(ctx context.Context, blocks uint64, lastBlock *rpc.BlockNumber, rewardPercentiles []float64) (*big.Int, [][]*big.Int, []*big.Int, []float64, error) {
+			var (
+				rewards       = make([][]*big.Int, 0, len(window))
+				baseFees      = make([]*big.Int, 0, len(window)+1)
+				gasUsedRatios = make([]float64, 0, len(window))
+			)
+			for _, sample := range window {
+				rewards = append(rewards, sampleRewards(sample.Rewards, rewardPercentiles))
+				baseFees = append(baseFees, sample.BaseFee)
+				gasUsedRatios = append(gasUsedRatios, sample.GasUsedRatio)
+			}
+			return big.NewInt(int64(oldest)), rewards, append(baseFees, next), gasUsedRatios, nil
+		}
+		suggested, err := SuggestGasFeesWithConfig(context.Background(), cfg, nil, feeHistory)
+		if err != nil {
+			report.Skipped++
+			continue
+		}
+		report.Windows++
+
+		future := history[last+1 : min(last+1+horizon, len(history))]
+		for _, level := range cfg.Levels {
+			result := report.Levels[level]
+			maxFee := suggested.EstimatedGasFees[level].MaxFeePerGas
+			if price, ok := inclusionPrice(maxFee, future); ok {
+				included[level]++
+				overpayment[level] += maxFee - price
+				missStreak[level] = 0
+			} else {
+				missStreak[level]++
+				result.WorstMissStreak = max(result.WorstMissStreak, missStreak[level])
+			}
+		}
+	}
+	for _, level := range cfg.Levels {
+		if report.Windows > 0 {
+			report.Levels[level].InclusionRate = float64(included[level]) / float64(report.Windows)
+		}
+		if included[level] > 0 {
+			report.Levels[level].AvgOverpayment = overpayment[level] / float64(included[level])
+		}
+	}
+	return report
+}
+
+// sampleRewards picks the rewards at the requested percentiles out of the rewards at the 0..99 percentiles,
+// like the oracle would return them
+func sampleRewards(rewards []*big.Int, percentiles []float64) []*big.Int {
+	if len(rewards) == 0 {
+		return rewards
+	}
+	sampled := make([]*big.Int, len(percentiles))
+	for i, percentile := range percentiles {
+		sampled[i] = rewards[min(int(percentile), len(rewards)-1)]
+	}
+	return sampled
+}
+
+// inclusionPrice returns the cheapest price in gwei, base fee plus min included tip, of the first block in
+// future the max fee would have been included in.
+func inclusionPrice(maxFee float64, future []BlockFeeSample) (float64, bool) {
+	for _, sample := range future {
+		if sample.BaseFee == nil {
+			continue
+		}
+		price := new(big.Int).Set(sample.BaseFee)
+		if len(sample.Rewards) > 0 && sample.Rewards[0] != nil && sample.Rewards[0].Sign() > 0 {
+			price.Add(price, sample.Rewards[0])
+		}
+		gwei, _ := new(big.Float).SetInt(price).Float64()
+		gwei /= 1_000_000_000
+		if maxFee >= gwei {
+			return gwei, true
+		}
+	}
+	return 0, false
+}
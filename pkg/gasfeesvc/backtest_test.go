@@ -0,0 +1,123 @@
+//go:build eth || op || base
+// +build eth op base
+
+package gasfeesvc
+
+import (
+	"encoding/json"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// loadFeeHistory loads an eth_feeHistory response of 200 mainnet shaped blocks.
+func loadFeeHistory(t *testing.T) []BlockFeeSample {
+	blob, err := os.ReadFile(filepath.Join("testdata", "fee_history_200.json"))
+	if err != nil {
+		t.Fatalf("failed to read fixture: %v", err)
+	}
+	var history struct {
+		BaseFee      []*hexutil.Big   `json:"baseFeePerGas"`
+		GasUsedRatio []float64        `json:"gasUsedRatio"`
+		Reward       [][]*hexutil.Big `json:"reward"`
+	}
+	if err := json.Unmarshal(blob, &history); err != nil {
+		t.Fatalf("failed to parse fixture: %v", err)
+	}
+	baseFees := make([]*big.Int, len(history.BaseFee))
+	for i, baseFee := range history.BaseFee {
+		baseFees[i] = baseFee.ToInt()
+	}
+	rewards := make([][]*big.Int, len(history.Reward))
+	for i, blockRewards := range history.Reward {
+		for _, reward := range blockRewards {
+			rewards[i] = append(rewards[i], reward.ToInt())
+		}
+	}
+	samples := BlockFeeSamplesFromFeeHistory(rewards, baseFees, history.GasUsedRatio)
+	if len(samples) != 200 {
+		t.Fatalf("sample count mismatch: have %d, want %d", len(samples), 200)
+	}
+	return samples
+}
+
+func TestBacktest(t *testing.T) {
+	cfg := ChainGasConfig{
+		Blocks:                 10,
+		StdDevThreshold:        1.0,
+		BaseFeeIncreaseRatio:   []float64{1.0, 1.45, 2.35},
+		TipFeePercentiles:      []float64{0.1, 0.5, 0.9},
+		LowActivityTipFeeRatio: []float64{0.0, 0.01, 0.05},
+		Levels:                 []string{"normal", "fast", "instant"},
+		RoundDecimals:          9,
+	}
+	history := loadFeeHistory(t)
+
+	tests := []struct {
+		horizon int
+		want    map[string]LevelBacktest
+	}{
+		{
+			horizon: 1,
+			want: map[string]LevelBacktest{
+				"normal":  {InclusionRate: 173.0 / 190, AvgOverpayment: 0.03618441524277413, WorstMissStreak: 4},
+				"fast":    {InclusionRate: 1, AvgOverpayment: 53.29299716947894},
+				"instant": {InclusionRate: 1, AvgOverpayment: 160.41308330216316},
+			},
+		},
+		{
+			horizon: 3,
+			want: map[string]LevelBacktest{
+				"normal":  {InclusionRate: 181.0 / 190, AvgOverpayment: 0.17513344859668498, WorstMissStreak: 2},
+				"fast":    {InclusionRate: 1, AvgOverpayment: 53.29299716947894},
+				"instant": {InclusionRate: 1, AvgOverpayment: 160.41308330216316},
+			},
+		},
+	}
+	for _, test := range tests {
+		report := Backtest(cfg, history, test.horizon)
+		if report.Windows != 190 || report.Skipped != 0 {
+			t.Fatalf("horizon %d: window count mismatch: have %d/%d skipped, want %d/%d", test.horizon, report.Windows, report.Skipped, 190, 0)
+		}
+		for level, want := range test.want {
+			have := report.Levels[level]
+			if have.InclusionRate != want.InclusionRate || have.WorstMissStreak != want.WorstMissStreak || math.Abs(have.AvgOverpayment-want.AvgOverpayment) > 1e-9 {
+				t.Errorf("horizon %d, level %s: report mismatch: have %+v, want %+v", test.horizon, level, *have, want)
+			}
+		}
+	}
+}
+
+func TestBacktestPreLondon(t *testing.T) {
+	history := make([]BlockFeeSample, 40)
+	report := Backtest(DefaultChainGasConfig(), history, 1)
+	if report.Windows != 0 || report.Skipped == 0 {
+		t.Fatalf("pre-London windows mismatch: have %d/%d skipped, want all skipped", report.Windows, report.Skipped)
+	}
+}
+
+func TestBacktestLiteRewardPercentiles(t *testing.T) {
+	cfg := DefaultChainGasConfig()
+	cfg.RewardPercentiles = LiteRewardPercentiles()
+	report := Backtest(cfg, loadFeeHistory(t), 1)
+	if report.Windows != 200-cfg.Blocks || report.Skipped != 0 {
+		t.Fatalf("window count mismatch: have %d/%d skipped, want %d/%d", report.Windows, report.Skipped, 200-cfg.Blocks, 0)
+	}
+	for _, level := range cfg.Levels {
+		if report.Levels[level].InclusionRate == 0 {
+			t.Errorf("level %s never included", level)
+		}
+	}
+
+	rewards := []*big.Int{big.NewInt(0), big.NewInt(1), big.NewInt(2)}
+	if sampled := sampleRewards(rewards, []float64{1, 2.5, 50}); len(sampled) != 3 || sampled[0].Int64() != 1 || sampled[1].Int64() != 2 || sampled[2].Int64() != 2 {
+		t.Fatalf("sampled rewards mismatch: %v", sampled)
+	}
+	if sampled := sampleRewards(nil, LiteRewardPercentiles()); sampled != nil {
+		t.Fatalf("empty rewards sampled: %v", sampled)
+	}
+}
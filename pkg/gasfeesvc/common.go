@@ -1,14 +1,33 @@
 package gasfeesvc
 
-import "math"
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"slices"
+	"sort"
+	"time"
+)
+
+// NoRounding disables rounding of the suggested fees.
+const NoRounding = -1
+
+// DefaultMaxBlocks caps the blocks queried when ChainGasConfig.MaxBlocks is unset, it's the most
+// blocks a geth node serves in a single eth_feeHistory call.
+const DefaultMaxBlocks = 1024
 
 type EstimatedGasFee struct {
 	MaxPriorityFeePerGas float64 `json:"maxPriorityFeePerGas"`
 	MaxFeePerGas         float64 `json:"maxFeePerGas"`
+	Capped               bool    `json:"capped,omitempty"` // the max fee was lowered to ChainGasConfig.MaxFeeGwei
 }
 
 type SuggestedGasFees struct {
 	BaseBlock                  int64                       `json:"baseBlock"`
+	Blocks                     int                         `json:"blocks"` // history blocks the suggestion is based on
 	NextBaseFee                float64                     `json:"nextBaseFee"`
 	GasUsedRatio               []float64                   `json:"gasUsedRatio"`
 	HistoricalBaseFees         []float64                   `json:"historicalBaseFees,omitempty"`
@@ -16,12 +35,417 @@ type SuggestedGasFees struct {
 	RegulatedHistoricalRewards []float64                   `json:"regulatedHistoricalRewards,omitempty"`
 	StdDevThreshold            float64                     `json:"stdDevThreshold,omitempty"`
 	PredictMode                string                      `json:"predictMode,omitempty"`
+	Trend                      string                      `json:"trend,omitempty"`           // trend of the historical base fees
+	Volatility                 float64                     `json:"volatility"`                // coefficient of variation of the historical base fees
+	SuggestedAction            string                      `json:"suggestedAction,omitempty"` // only with ChainGasConfig.SuggestAction
+	PoolTips                   []float64                   `json:"poolTips,omitempty"`        // regulated txpool tips blended in, see RequestOptions.TxPool
+	Warnings                   []string                    `json:"warnings,omitempty"`        // what the suggestion had to do without, e.g. a failing txpool
 	EstimatedGasFees           map[string]*EstimatedGasFee `json:"estimatedGasFees"`
+
+	levels []string // the levels of EstimatedGasFees in config order
+}
+
+// Capped reports whether the max fee of any level was lowered to ChainGasConfig.MaxFeeGwei, e.g. to warn
+// users that txs may be slow to be included while the base fee spikes.
+func (s *SuggestedGasFees) Capped() bool {
+	for _, fee := range s.EstimatedGasFees {
+		if fee != nil && fee.Capped {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultLevels is the order of the levels of the chain configs, cheapest first
+var defaultLevels = []string{"normal", "fast", "instant"}
+
+// Levels returns the levels of EstimatedGasFees from the cheapest to the fastest, i.e. in the order of
+// ChainGasConfig.Levels, to range over the fees in a deterministic order. Suggestions not made by this
+// package, e.g. decoded from json, order the normal, fast and instant levels first and others by name.
+func (s *SuggestedGasFees) Levels() []string {
+	if len(s.levels) == len(s.EstimatedGasFees) {
+		return append([]string{}, s.levels...)
+	}
+	levels := make([]string, 0, len(s.EstimatedGasFees))
+	for _, level := range defaultLevels {
+		if _, ok := s.EstimatedGasFees[level]; ok {
+			levels = append(levels, level)
+		}
+	}
+	others := make([]string, 0, len(s.EstimatedGasFees)-len(levels))
+	for level := range s.EstimatedGasFees {
+		if !slices.Contains(defaultLevels, level) {
+			others = append(others, level)
+		}
+	}
+	sort.Strings(others)
+	return append(levels, others...)
+}
+
+// MarshalJSON emits estimatedGasFees as an object keyed by level in the order of Levels rather than sorted by
+// name, so that identical suggestions marshal to identical bytes, cheapest level first.
+func (s SuggestedGasFees) MarshalJSON() ([]byte, error) {
+	type plain SuggestedGasFees
+	return json.Marshal(struct {
+		plain
+		EstimatedGasFees orderedGasFees `json:"estimatedGasFees"`
+	}{plain(s), orderedGasFees{levels: s.Levels(), fees: s.EstimatedGasFees}})
+}
+
+// orderedGasFees marshals the fees of the levels in the given order
+type orderedGasFees struct {
+	levels []string
+	fees   map[string]*EstimatedGasFee
+}
+
+// MarshalJSON implements json.Marshaler
+func (o orderedGasFees) MarshalJSON() ([]byte, error) {
+	if o.fees == nil {
+		return []byte("null"), nil
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, level := range o.levels {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(level)
+		if err != nil {
+			return nil, err
+		}
+		fee, err := json.Marshal(o.fees[level])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(fee)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Modes of SuggestedGasFees.PredictMode, suffixed with "+pool" when the txpool tips are blended in.
+const (
+	PredictModeHistorical  = "historicalStdDev" // the tips are percentiles of the regulated historical rewards
+	PredictModeLowActivity = "lowActivity"      // fewer rewards than blocks, the tips are ratios of the next base fee
+	PredictModeFewSamples  = "fewSamples"       // fewer txs sampled than ChainGasConfig.MinSamples, likewise
+)
+
+// ChainGasConfig holds the options of the gas fee suggestion for a chain.
+type ChainGasConfig struct {
+	Blocks                 int       // number of history blocks to query
+	StdDevThreshold        float64   // rewards deviate more than StdDevThreshold x stdDev from the mean are dropped
+	BaseFeeIncreaseRatio   []float64 // per level multiplier of the next base fee
+	TipFeePercentiles      []float64 // per level percentile of the regulated rewards
+	LowActivityTipFeeRatio []float64 // per level tip as ratio of the next base fee when the chain is idle
+	Levels                 []string
+	RoundDecimals          int // decimals of gwei kept in the suggestion, NoRounding to keep all
+
+	// WindowDuration queries the blocks produced in the window instead of Blocks, it needs ChainBlockTime,
+	// e.g. a 60s window of a chain with 250ms blocks queries 240 blocks.
+	WindowDuration time.Duration
+	ChainBlockTime time.Duration // average block time of the chain
+	MaxBlocks      int           // cap of the blocks queried, DefaultMaxBlocks when not positive
+
+	// RewardPercentiles are the percentiles of the rewards queried per block, DefaultRewardPercentiles when
+	// empty. They sample the rewards the tip fee percentiles are picked from, LiteRewardPercentiles trades a
+	// little accuracy for a much smaller fee history.
+	RewardPercentiles []float64
+
+	TrendThresholds TrendThresholds // unset thresholds take the DefaultTrendThresholds ones
+	SuggestAction   bool            // advise whether to wait in SuggestedGasFees.SuggestedAction
+
+	// MinTipGwei is the floor of the suggested tips of all levels, their max fees are raised along. Some
+	// builders are slow to include zero-tip txs, which quiet chains would otherwise be suggested.
+	MinTipGwei float64
+	// MaxFeeGwei caps the suggested max fees of all levels, their tips are lowered to the cap when above it.
+	// It protects against overpaying during brief base fee spikes at the risk of suggesting a max fee below the
+	// next base fee. The capped levels are flagged, 0 disables the cap.
+	MaxFeeGwei float64
+	// PoolWeight is the weight of the txpool tips blended into the suggested tips of requests sampling the txpool,
+	// DefaultPoolWeight when 0.
+	PoolWeight float64
+	// MinSamples is the fewest txs the rewards must sample for their percentiles to be trusted, the tips are
+	// then ratios of the next base fee like on an idle chain. The txs are counted as the distinct rewards of
+	// every block, e.g. 10 blocks of 2 txs are at most 20 samples whatever the reward percentiles. 0 disables it.
+	MinSamples int
+
+	// GasUsedRatioBlocks projects the next base fee from the mean gas used ratio of the last GasUsedRatioBlocks
+	// blocks rather than from the last block's only, so that a single anomalous block, e.g. an empty one after
+	// full ones, doesn't swing it on chains with bursty block fullness. 0 or 1 keeps the projection of the fee
+	// history oracle.
+	GasUsedRatioBlocks int
+	// BaseFeeChangeDenominator and ElasticityMultiplier are the EIP-1559 parameters of the chain the base fee is
+	// projected with, DefaultBaseFeeChangeDenominator and DefaultElasticityMultiplier when not positive.
+	BaseFeeChangeDenominator int
+	ElasticityMultiplier     int
+
+	// RewardNormalizer converts the rewards of the fee history to the effective tips the suggestion expects
+	// before anything else, for nodes whose eth_feeHistory rewards differ, e.g. GasPriceRewardNormalizer. The
+	// rewards are kept as is when nil.
+	RewardNormalizer RewardNormalizer
+}
+
+// RewardNormalizer returns the effective tip in wei of a reward of the fee history, baseFee is the one of the
+// block of the reward, nil if unknown. Neither may be modified, a nil result drops the reward.
+type RewardNormalizer func(reward *big.Int, baseFee *big.Int) *big.Int
+
+// GasPriceRewardNormalizer is a RewardNormalizer for nodes whose rewards are the effective gas prices of the txs,
+// base fee included, rather than their tips. Prices below the base fee are zero tips.
+func GasPriceRewardNormalizer(reward *big.Int, baseFee *big.Int) *big.Int {
+	if baseFee == nil {
+		return reward
+	}
+	tip := new(big.Int).Sub(reward, baseFee)
+	if tip.Sign() < 0 {
+		tip.SetInt64(0)
+	}
+	return tip
+}
+
+// Defaults of the EIP-1559 parameters of ChainGasConfig, the ones of ethereum mainnet.
+const (
+	DefaultBaseFeeChangeDenominator = 8
+	DefaultElasticityMultiplier     = 2
+)
+
+// Defaults of the txpool sampling of RequestOptions.TxPool.
+const (
+	DefaultPoolWeight = 0.3
+	DefaultPoolMaxTxs = 500
+)
+
+// TxPoolSampler samples the tips of the txs waiting in the txpool, the most valuable signal during congestion.
+type TxPoolSampler interface {
+	// SampleTips returns the tips in wei of up to maxTxs pending txs, effective ones at the next base fee
+	// ideally, see EffectiveTip.
+	SampleTips(ctx context.Context, maxTxs int) ([]*big.Int, error)
+}
+
+// RequestOptions overrides the chain config for a single suggestion, zero fields keep the config.
+type RequestOptions struct {
+	Blocks            int           // takes precedence over any window
+	WindowDuration    time.Duration // needs ChainBlockTime of the config
+	TipFeePercentiles []float64     // per level, must have as many entries as the levels
+	RewardPercentiles []float64     // ascending, in [0, 100]
+	MinTipGwei        float64       // not negative
+	MaxFeeGwei        float64       // not negative
+
+	// TxPool blends the tips of the txpool into the suggestion for the latest or pending block, the history only
+	// is used when it fails. The suggestions for past blocks ignore it, the txpool tells about now.
+	TxPool     TxPoolSampler
+	PoolWeight float64 // in (0, 1]
+	PoolMaxTxs int     // DefaultPoolMaxTxs when not positive
+}
+
+// DefaultRewardPercentiles returns every percentile from 0 to 99.
+func DefaultRewardPercentiles() []float64 {
+	return evenRewardPercentiles(0, 1)
+}
+
+// LiteRewardPercentiles returns every 4th percentile from 2 to 98. The 200 block fixture of mainnet shrinks
+// from 253KB to 68KB of json with them, while the suggested tips of its 10 block windows stay within 2%
+// (normal, fast) and 7% (instant) of the ones from all percentiles on average.
+func LiteRewardPercentiles() []float64 {
+	return evenRewardPercentiles(2, 4)
+}
+
+// evenRewardPercentiles returns the percentiles below 100 from first on in steps of step
+func evenRewardPercentiles(first, step int) []float64 {
+	var percentiles []float64
+	for p := first; p < 100; p += step {
+		percentiles = append(percentiles, float64(p))
+	}
+	return percentiles
+}
+
+// Validate checks the per level options have an entry for every level and the tip fee percentiles are in
+// [0, 1), the suggestion fails with ErrInvalidChainGasConfig otherwise.
+func (cfg ChainGasConfig) Validate() error {
+	for name, perLevel := range map[string][]float64{
+		"base fee increase ratios":    cfg.BaseFeeIncreaseRatio,
+		"tip fee percentiles":         cfg.TipFeePercentiles,
+		"low activity tip fee ratios": cfg.LowActivityTipFeeRatio,
+	} {
+		if len(perLevel) != len(cfg.Levels) {
+			return fmt.Errorf("%w: %d %s for %d levels", ErrInvalidChainGasConfig, len(perLevel), name, len(cfg.Levels))
+		}
+	}
+	for _, percentile := range cfg.TipFeePercentiles {
+		if !(percentile >= 0 && percentile < 1) {
+			return fmt.Errorf("%w: tip fee percentile %v out of [0, 1)", ErrInvalidChainGasConfig, percentile)
+		}
+	}
+	return nil
+}
+
+// blockCount returns the number of history blocks to query for a request with opts, which may be nil.
+func (cfg ChainGasConfig) blockCount(opts *RequestOptions) int {
+	blocks, window := cfg.Blocks, cfg.WindowDuration
+	if opts != nil && opts.WindowDuration > 0 {
+		window = opts.WindowDuration
+	}
+	if window > 0 && cfg.ChainBlockTime > 0 {
+		blocks = int((window + cfg.ChainBlockTime - 1) / cfg.ChainBlockTime)
+	}
+	if opts != nil && opts.Blocks > 0 {
+		blocks = opts.Blocks
+	}
+	maxBlocks := cfg.MaxBlocks
+	if maxBlocks <= 0 {
+		maxBlocks = DefaultMaxBlocks
+	}
+	return max(1, min(blocks, maxBlocks))
+}
+
+// tipFeePercentiles returns the per level percentiles for a request with opts, which may be nil.
+func (cfg ChainGasConfig) tipFeePercentiles(opts *RequestOptions) ([]float64, error) {
+	if opts == nil || opts.TipFeePercentiles == nil {
+		return cfg.TipFeePercentiles, nil
+	}
+	if len(opts.TipFeePercentiles) != len(cfg.Levels) {
+		return nil, fmt.Errorf("%w: %d tip fee percentiles for %d levels", ErrInvalidRequestOptions, len(opts.TipFeePercentiles), len(cfg.Levels))
+	}
+	for _, percentile := range opts.TipFeePercentiles {
+		if percentile < 0 || percentile >= 1 {
+			return nil, fmt.Errorf("%w: tip fee percentile %v out of [0, 1)", ErrInvalidRequestOptions, percentile)
+		}
+	}
+	return opts.TipFeePercentiles, nil
+}
+
+// minTip returns the floor of the suggested tips in gwei for a request with opts, which may be nil.
+func (cfg ChainGasConfig) minTip(opts *RequestOptions) (float64, error) {
+	minTip := cfg.MinTipGwei
+	if opts != nil && opts.MinTipGwei != 0 {
+		minTip = opts.MinTipGwei
+	}
+	if minTip < 0 || math.IsNaN(minTip) || math.IsInf(minTip, 0) {
+		return 0, fmt.Errorf("%w: min tip %v gwei", ErrInvalidRequestOptions, minTip)
+	}
+	return minTip, nil
 }
 
-// round rounds a float64 to the specified number of decimal places.
-func round9(val float64) float64 {
-	precision := 9
-	ratio := math.Pow(10, float64(precision))
+// maxFee returns the cap of the suggested max fees in gwei for a request with opts, which may be nil, 0 for
+// no cap.
+func (cfg ChainGasConfig) maxFee(opts *RequestOptions) (float64, error) {
+	maxFee := cfg.MaxFeeGwei
+	if opts != nil && opts.MaxFeeGwei != 0 {
+		maxFee = opts.MaxFeeGwei
+	}
+	if maxFee < 0 || math.IsNaN(maxFee) || math.IsInf(maxFee, 0) {
+		return 0, fmt.Errorf("%w: max fee %v gwei", ErrInvalidRequestOptions, maxFee)
+	}
+	return maxFee, nil
+}
+
+// poolWeight returns the weight of the txpool tips for a request with opts, which may be nil.
+func (cfg ChainGasConfig) poolWeight(opts *RequestOptions) (float64, error) {
+	weight := cfg.PoolWeight
+	if opts != nil && opts.PoolWeight != 0 {
+		weight = opts.PoolWeight
+	}
+	if weight == 0 {
+		weight = DefaultPoolWeight
+	}
+	if !(weight > 0 && weight <= 1) {
+		return 0, fmt.Errorf("%w: pool weight %v out of (0, 1]", ErrInvalidRequestOptions, weight)
+	}
+	return weight, nil
+}
+
+// rewardPercentiles returns the reward percentiles to query for a request with opts, which may be nil.
+func (cfg ChainGasConfig) rewardPercentiles(opts *RequestOptions) ([]float64, error) {
+	percentiles := cfg.RewardPercentiles
+	if opts != nil && opts.RewardPercentiles != nil {
+		percentiles = opts.RewardPercentiles
+	}
+	if len(percentiles) == 0 {
+		return DefaultRewardPercentiles(), nil
+	}
+	// eth_feeHistory rejects anything else
+	for i, percentile := range percentiles {
+		if percentile < 0 || percentile > 100 || (i > 0 && percentile <= percentiles[i-1]) {
+			return nil, fmt.Errorf("%w: reward percentiles %v not ascending in [0, 100]", ErrInvalidRequestOptions, percentiles)
+		}
+	}
+	return percentiles, nil
+}
+
+// normalizeRewards returns the rewards normalized by cfg.RewardNormalizer with the historical base fees of their
+// block, the rewards themselves when it's nil.
+func (cfg ChainGasConfig) normalizeRewards(rewards [][]*big.Int, baseFees []*big.Int) [][]*big.Int {
+	if cfg.RewardNormalizer == nil {
+		return rewards
+	}
+	normalized := make([][]*big.Int, len(rewards))
+	for i, row := range rewards {
+		var baseFee *big.Int
+		if i < len(baseFees) {
+			baseFee = baseFees[i]
+		}
+		normalized[i] = make([]*big.Int, len(row))
+		for j, reward := range row {
+			if reward != nil {
+				normalized[i][j] = cfg.RewardNormalizer(reward, baseFee)
+			}
+		}
+	}
+	return normalized
+}
+
+// projectBaseFee projects the base fee of the block following one with baseFee and the mean of gasUsedRatios
+// like EIP-1559 does with the gas used of a block, the result is in the unit of baseFee.
+func (cfg ChainGasConfig) projectBaseFee(baseFee float64, gasUsedRatios []float64) float64 {
+	denominator, elasticity := cfg.BaseFeeChangeDenominator, cfg.ElasticityMultiplier
+	if denominator <= 0 {
+		denominator = DefaultBaseFeeChangeDenominator
+	}
+	if elasticity <= 0 {
+		elasticity = DefaultElasticityMultiplier
+	}
+	var ratio float64
+	for _, r := range gasUsedRatios {
+		ratio += r / float64(len(gasUsedRatios))
+	}
+	// the gas used relative to the gas target is ratio x elasticity
+	return math.Max(0, baseFee*(1+(ratio*float64(elasticity)-1)/float64(denominator)))
+}
+
+// weiDecimals are the decimals of gwei down to a wei, intermediate values are rounded to them so they don't
+// depend on the order floats are accumulated in.
+const weiDecimals = 9
+
+// roundFee rounds a float64 to the specified number of decimal places.
+func roundFee(val float64, decimals int) float64 {
+	if decimals < 0 {
+		return val
+	}
+	ratio := math.Pow(10, float64(decimals))
 	return math.Round(val*ratio) / ratio
 }
+
+// roundFeeAbove rounds like roundFee but rounds up instead when rounding would drop the fee below floor.
+func roundFeeAbove(val, floor float64, decimals int) float64 {
+	rounded := roundFee(val, decimals)
+	if rounded < floor && decimals >= 0 {
+		ratio := math.Pow(10, float64(decimals))
+		rounded = math.Ceil(val*ratio) / ratio
+	}
+	return rounded
+}
+
+// EffectiveTip returns the tip a EIP-1559 tx actually pays to the miner in a block with the given base fee,
+// that is min(maxPriorityFee, maxFee - baseFee). A tx whose maxFee is below the base fee can't be included
+// and pays no tip, so the result is clamped at zero instead of going negative.
+func EffectiveTip(maxPriorityFee, maxFee, baseFee *big.Int) *big.Int {
+	tip := new(big.Int).Sub(maxFee, baseFee)
+	if tip.Cmp(maxPriorityFee) > 0 {
+		tip.Set(maxPriorityFee)
+	}
+	if tip.Sign() < 0 {
+		tip.SetInt64(0)
+	}
+	return tip
+}
@@ -0,0 +1,119 @@
+package gasfeesvc
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEffectiveTip(t *testing.T) {
+	tests := []struct {
+		maxPriorityFee, maxFee, baseFee, want int64
+	}{
+		{2, 100, 10, 2},  // capped by the priority fee
+		{20, 25, 10, 15}, // capped by the max fee headroom
+		{2, 5, 10, 0},    // max fee below the base fee pays no tip
+		{2, 10, 10, 0},
+	}
+	for i, test := range tests {
+		have := EffectiveTip(big.NewInt(test.maxPriorityFee), big.NewInt(test.maxFee), big.NewInt(test.baseFee))
+		if have.Int64() != test.want {
+			t.Errorf("test %d: effective tip mismatch: have %v, want %v", i, have, test.want)
+		}
+	}
+}
+
+func TestGasPriceRewardNormalizer(t *testing.T) {
+	tests := []struct {
+		reward  int64
+		baseFee *big.Int
+		want    int64
+	}{
+		{12, big.NewInt(10), 2},
+		{10, big.NewInt(10), 0},
+		{8, big.NewInt(10), 0}, // priced below the base fee pays no tip
+		{12, nil, 12},          // kept as is without base fee
+	}
+	for i, test := range tests {
+		reward := big.NewInt(test.reward)
+		if have := GasPriceRewardNormalizer(reward, test.baseFee); have.Int64() != test.want || reward.Int64() != test.reward {
+			t.Errorf("test %d: tip mismatch: have %v, want %v (reward now %v)", i, have, test.want, reward)
+		}
+	}
+}
+
+func TestChainGasConfigValidate(t *testing.T) {
+	valid := func() ChainGasConfig {
+		return ChainGasConfig{
+			BaseFeeIncreaseRatio:   []float64{1.0, 1.45, 2.35},
+			TipFeePercentiles:      []float64{0.1, 0.5, 0.9},
+			LowActivityTipFeeRatio: []float64{0.0, 0.01, 0.05},
+			Levels:                 []string{"normal", "fast", "instant"},
+		}
+	}
+	if err := valid().Validate(); err != nil {
+		t.Fatalf("valid config rejected: %v", err)
+	}
+	for name, configure := range map[string]func(cfg *ChainGasConfig){
+		"few levels":              func(cfg *ChainGasConfig) { cfg.Levels = cfg.Levels[:2] },
+		"few base fee ratios":     func(cfg *ChainGasConfig) { cfg.BaseFeeIncreaseRatio = cfg.BaseFeeIncreaseRatio[:2] },
+		"few tip fee percentiles": func(cfg *ChainGasConfig) { cfg.TipFeePercentiles = nil },
+		"few low activity ratios": func(cfg *ChainGasConfig) { cfg.LowActivityTipFeeRatio = append(cfg.LowActivityTipFeeRatio, 0.1) },
+		"percentile of 1":         func(cfg *ChainGasConfig) { cfg.TipFeePercentiles[2] = 1 },
+		"negative percentile":     func(cfg *ChainGasConfig) { cfg.TipFeePercentiles[0] = -0.1 },
+		"NaN percentile":          func(cfg *ChainGasConfig) { cfg.TipFeePercentiles[1] = math.NaN() },
+	} {
+		cfg := valid()
+		configure(&cfg)
+		if err := cfg.Validate(); !errors.Is(err, ErrInvalidChainGasConfig) {
+			t.Fatalf("%s: expected ErrInvalidChainGasConfig, have %v", name, err)
+		}
+	}
+}
+
+func TestSuggestedGasFeesLevels(t *testing.T) {
+	fees := map[string]*EstimatedGasFee{"instant": {}, "fast": {}, "normal": {}, "urgent": {}, "economy": {}}
+	suggested := &SuggestedGasFees{EstimatedGasFees: fees}
+	for i := 0; i < 10; i++ {
+		if levels := suggested.Levels(); !reflect.DeepEqual(levels, []string{"normal", "fast", "instant", "economy", "urgent"}) {
+			t.Fatalf("levels mismatch: %v", levels)
+		}
+	}
+
+	// the config order wins
+	suggested.levels = []string{"economy", "normal", "fast", "instant", "urgent"}
+	levels := suggested.Levels()
+	if !reflect.DeepEqual(levels, suggested.levels) {
+		t.Fatalf("config levels mismatch: %v", levels)
+	}
+	levels[0] = "changed"
+	if suggested.levels[0] != "economy" {
+		t.Fatalf("config levels aliased")
+	}
+}
+
+func TestSuggestedGasFeesMarshalJSON(t *testing.T) {
+	suggested := &SuggestedGasFees{
+		EstimatedGasFees: map[string]*EstimatedGasFee{
+			"instant": {MaxPriorityFeePerGas: 3, MaxFeePerGas: 4},
+			"fast":    {MaxPriorityFeePerGas: 2, MaxFeePerGas: 3},
+			"normal":  {MaxPriorityFeePerGas: 1, MaxFeePerGas: 2},
+		},
+		levels: []string{"normal", "fast", "instant"},
+	}
+	enc, err := json.Marshal(suggested)
+	if err != nil {
+		t.Fatalf("failed to encode suggestion: %v", err)
+	}
+	want := `"estimatedGasFees":{"normal":{"maxPriorityFeePerGas":1,"maxFeePerGas":2},"fast":{"maxPriorityFeePerGas":2,"maxFeePerGas":3},"instant":{"maxPriorityFeePerGas":3,"maxFeePerGas":4}}`
+	if !strings.Contains(string(enc), want) {
+		t.Fatalf("encoding mismatch: have %s, want %s", enc, want)
+	}
+	if enc, _ = json.Marshal(SuggestedGasFees{}); !strings.Contains(string(enc), `"estimatedGasFees":null`) {
+		t.Fatalf("nil fees encoding mismatch: %s", enc)
+	}
+}
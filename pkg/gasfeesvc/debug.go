@@ -0,0 +1,83 @@
+//go:build eth || op || base
+// +build eth op base
+
+package gasfeesvc
+
+import (
+	"context"
+	"math/big"
+	"sync"
+)
+
+// DebugSink is told the intermediate values of the suggestions made with a context carrying it, see
+// WithDebugSink. The slices are the suggestion's own and must not be modified.
+type DebugSink interface {
+	// OnFeeHistoryFetched is called with the oldest block and the number of blocks the suggestion is based on.
+	OnFeeHistoryFetched(oldest *big.Int, blocks int)
+	// OnRegulated is called with the historical rewards in gwei before and after the ones deviating too much
+	// from their mean were dropped, along with their mean and standard deviation.
+	OnRegulated(before, after []float64, mean, stddev float64)
+	// OnLevelComputed is called with the suggested tip and max fee in gwei of every level.
+	OnLevelComputed(level string, tip, maxFee float64)
+}
+
+// debugSinkKey is the context key of the DebugSink
+type debugSinkKey struct{}
+
+// WithDebugSink returns a copy of ctx whose suggestions report their intermediate values to sink, e.g. to debug a
+// single request flagged by a header without any global logging. A nil sink disables it.
+func WithDebugSink(ctx context.Context, sink DebugSink) context.Context {
+	return context.WithValue(ctx, debugSinkKey{}, sink)
+}
+
+// debugSinkFrom returns the DebugSink of ctx, nil when there is none
+func debugSinkFrom(ctx context.Context) DebugSink {
+	sink, _ := ctx.Value(debugSinkKey{}).(DebugSink)
+	return sink
+}
+
+// DebugLevel is a level computed by a suggestion, see DebugSink.OnLevelComputed.
+type DebugLevel struct {
+	Level  string  `json:"level"`
+	Tip    float64 `json:"tip"`
+	MaxFee float64 `json:"maxFee"`
+}
+
+// CollectingSink is a DebugSink recording everything it's told, to be embedded in a debug json response. The
+// slices are copied, it's safe for concurrent use.
+type CollectingSink struct {
+	mu sync.Mutex
+
+	OldestBlock *big.Int     `json:"oldestBlock,omitempty"`
+	Blocks      int          `json:"blocks"`
+	Rewards     []float64    `json:"rewards,omitempty"`
+	Regulated   []float64    `json:"regulated,omitempty"`
+	Mean        float64      `json:"mean"`
+	StdDev      float64      `json:"stdDev"`
+	Levels      []DebugLevel `json:"levels,omitempty"` // in the order of the levels of the config
+}
+
+// OnFeeHistoryFetched implements DebugSink.
+func (s *CollectingSink) OnFeeHistoryFetched(oldest *big.Int, blocks int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if oldest != nil {
+		s.OldestBlock = new(big.Int).Set(oldest)
+	}
+	s.Blocks = blocks
+}
+
+// OnRegulated implements DebugSink.
+func (s *CollectingSink) OnRegulated(before, after []float64, mean, stddev float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Rewards, s.Regulated = append([]float64{}, before...), append([]float64{}, after...)
+	s.Mean, s.StdDev = mean, stddev
+}
+
+// OnLevelComputed implements DebugSink.
+func (s *CollectingSink) OnLevelComputed(level string, tip, maxFee float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Levels = append(s.Levels, DebugLevel{Level: level, Tip: tip, MaxFee: maxFee})
+}
@@ -0,0 +1,94 @@
+//go:build eth || op || base
+// +build eth op base
+
+package gasfeesvc
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/gonum/stat"
+)
+
+// nopSink is a DebugSink ignoring everything
+type nopSink struct{}
+
+func (nopSink) OnFeeHistoryFetched(*big.Int, int)                 {}
+func (nopSink) OnRegulated(before, after []float64, _, _ float64) {}
+func (nopSink) OnLevelComputed(string, float64, float64)          {}
+
+func TestDebugSink(t *testing.T) {
+	cfg := DefaultChainGasConfig()
+	cfg.RoundDecimals = NoRounding
+	sink := new(CollectingSink)
+	suggested, err := SuggestGasFeesWithConfig(WithDebugSink(context.Background(), sink), cfg, nil, syntheticFeeHistory(false))
+	if err != nil {
+		t.Fatalf("failed to suggest gas fees: %v", err)
+	}
+
+	if sink.OldestBlock == nil || sink.OldestBlock.Int64() != 1 || sink.Blocks != cfg.Blocks {
+		t.Fatalf("fee history mismatch: oldest %v, %d blocks, want 1, %d blocks", sink.OldestBlock, sink.Blocks, cfg.Blocks)
+	}
+	if !reflect.DeepEqual(sink.Rewards, suggested.HistoricalRewards) || !reflect.DeepEqual(sink.Regulated, suggested.RegulatedHistoricalRewards) {
+		t.Fatalf("regulated rewards mismatch:\nhave %v -> %v\nwant %v -> %v", sink.Rewards, sink.Regulated, suggested.HistoricalRewards, suggested.RegulatedHistoricalRewards)
+	}
+	if len(sink.Regulated) == len(sink.Rewards) {
+		t.Fatalf("no reward regulated out of %d", len(sink.Rewards))
+	}
+	mean, stdDev := stat.MeanStdDev(suggested.RegulatedHistoricalRewards, nil)
+	if sink.Mean <= 0 || sink.StdDev <= 0 || sink.Mean >= mean+stdDev || sink.Mean <= mean-stdDev {
+		t.Fatalf("mean %v and std dev %v of the rewards off the regulated ones %v ± %v", sink.Mean, sink.StdDev, mean, stdDev)
+	}
+	for _, reward := range sink.Regulated {
+		if reward < sink.Mean-cfg.StdDevThreshold*sink.StdDev || reward > sink.Mean+cfg.StdDevThreshold*sink.StdDev {
+			t.Fatalf("regulated reward %v out of %v ± %v x %v", reward, sink.Mean, cfg.StdDevThreshold, sink.StdDev)
+		}
+	}
+	if len(sink.Levels) != len(cfg.Levels) {
+		t.Fatalf("%d levels computed, want %d", len(sink.Levels), len(cfg.Levels))
+	}
+	for i, level := range sink.Levels {
+		fee := suggested.EstimatedGasFees[cfg.Levels[i]]
+		if level.Level != cfg.Levels[i] || level.Tip != fee.MaxPriorityFeePerGas || level.MaxFee != fee.MaxFeePerGas {
+			t.Fatalf("level %d mismatch: have %+v, want %s %+v", i, level, cfg.Levels[i], fee)
+		}
+	}
+	// the sink keeps copies
+	suggested.RegulatedHistoricalRewards[0] = -1
+	if sink.Regulated[0] == -1 {
+		t.Fatalf("sink shares the regulated rewards of the suggestion")
+	}
+	if _, err := json.Marshal(sink); err != nil {
+		t.Fatalf("failed to marshal sink: %v", err)
+	}
+
+	// without a sink, or with a nil one, nothing is reported
+	if _, err := SuggestGasFeesWithConfig(WithDebugSink(context.Background(), nil), cfg, nil, syntheticFeeHistory(false)); err != nil {
+		t.Fatalf("failed to suggest gas fees with a nil sink: %v", err)
+	}
+}
+
+func TestDebugSinkAllocs(t *testing.T) {
+	ctx := context.WithValue(context.Background(), struct{ name string }{"other"}, 1)
+	if allocs := testing.AllocsPerRun(100, func() { _ = debugSinkFrom(ctx) }); allocs != 0 {
+		t.Fatalf("sink lookup allocates %v times", allocs)
+	}
+
+	cfg, feeHistory := DefaultChainGasConfig(), syntheticFeeHistory(false)
+	suggest := func(ctx context.Context) func() {
+		return func() {
+			if _, err := SuggestGasFeesWithConfig(ctx, cfg, nil, feeHistory); err != nil {
+				t.Fatalf("failed to suggest gas fees: %v", err)
+			}
+		}
+	}
+	// the callbacks of a sink ignoring them cost nothing, any extra allocation would be the sink plumbing's
+	without := testing.AllocsPerRun(100, suggest(ctx))
+	with := testing.AllocsPerRun(100, suggest(WithDebugSink(ctx, nopSink{})))
+	if without != with {
+		t.Fatalf("%v allocations without a sink, %v with one ignoring everything", without, with)
+	}
+}
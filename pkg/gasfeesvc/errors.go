@@ -0,0 +1,70 @@
+package gasfeesvc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// GasFeeError classifies the failures of the fee suggestion, for callers to tell whether to retry, fall back to
+// a cached suggestion or alert. The errors returned by SuggestGasFees and its variants match one of the sentinels
+// below with errors.Is, and a GasFeeError with errors.As.
+type GasFeeError interface {
+	error
+	Code() string    // stable identifier of the failure, e.g. for metrics
+	Retryable() bool // the same request may succeed later
+}
+
+// gasFeeError is a sentinel GasFeeError
+type gasFeeError struct {
+	code      string
+	msg       string
+	retryable bool
+}
+
+func (e *gasFeeError) Error() string   { return e.msg }
+func (e *gasFeeError) Code() string    { return e.code }
+func (e *gasFeeError) Retryable() bool { return e.retryable }
+
+var (
+	// ErrUpstream is matched by the failures of the fee history query, see UpstreamError.
+	ErrUpstream error = &gasFeeError{code: "upstream", msg: "fee history query failed", retryable: true}
+
+	// ErrInsufficientData is returned when the fee history has no block to suggest from, e.g. an oracle
+	// lagging behind, a later query may serve them.
+	ErrInsufficientData error = &gasFeeError{code: "insufficient_data", msg: "insufficient fee history data", retryable: true}
+
+	// ErrMalformedFeeHistory is returned when the fee history is inconsistent with the requested blocks and
+	// percentiles and can't be repaired, it's wrapped with the details of the inconsistency.
+	ErrMalformedFeeHistory error = &gasFeeError{code: "malformed_fee_history", msg: "malformed fee history"}
+
+	// ErrNo1559Support is returned when the queried blocks carry no base fee, e.g. blocks before
+	// the London fork, callers should fall back to legacy gas pricing.
+	ErrNo1559Support error = &gasFeeError{code: "no_1559_support", msg: "fee history has no base fee, EIP-1559 is not supported"}
+
+	// ErrInvalidRequestOptions is returned when the per request overrides don't fit the chain config.
+	ErrInvalidRequestOptions error = &gasFeeError{code: "invalid_request_options", msg: "invalid request options"}
+
+	// ErrInvalidChainGasConfig is returned when the chain config is inconsistent, see ChainGasConfig.Validate.
+	ErrInvalidChainGasConfig error = &gasFeeError{code: "invalid_chain_gas_config", msg: "invalid chain gas config"}
+)
+
+// UpstreamError wraps the error of the fee history query, it matches ErrUpstream and unwraps to the original
+// error. It's retryable unless the query was cancelled by the caller.
+type UpstreamError struct {
+	Err error
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrUpstream, e.Err)
+}
+
+func (e *UpstreamError) Unwrap() error { return e.Err }
+
+func (e *UpstreamError) Is(target error) bool { return target == ErrUpstream }
+
+func (e *UpstreamError) Code() string { return ErrUpstream.(GasFeeError).Code() }
+
+func (e *UpstreamError) Retryable() bool {
+	return !errors.Is(e.Err, context.Canceled)
+}
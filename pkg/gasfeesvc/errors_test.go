@@ -0,0 +1,75 @@
+//go:build eth || op || base
+// +build eth op base
+
+package gasfeesvc
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+func TestSuggestGasFeesErrors(t *testing.T) {
+	cfg := DefaultChainGasConfig()
+	refused := errors.New("connection refused")
+	failing := func(err error) FeeHistory {
+		return func(ctx context.Context, blocks uint64, lastBlock *rpc.BlockNumber, rewardPercentiles []float64) (*big.Int, [][]*big.Int, []*big.Int, []float64, error) {
+			return nil, nil, nil, nil, err
+		}
+	}
+	noOldest := func(ctx context.Context, blocks uint64, lastBlock *rpc.BlockNumber, rewardPercentiles []float64) (*big.Int, [][]*big.Int, []*big.Int, []float64, error) {
+		_, rewards, baseFees, ratios, err := feeHistoryOf(int(blocks)+1, len(rewardPercentiles))(ctx, blocks, lastBlock, rewardPercentiles)
+		return nil, rewards, baseFees, ratios, err
+	}
+	empty := func(ctx context.Context, blocks uint64, lastBlock *rpc.BlockNumber, rewardPercentiles []float64) (*big.Int, [][]*big.Int, []*big.Int, []float64, error) {
+		return big.NewInt(1), nil, nil, nil, nil
+	}
+	preLondon := func(ctx context.Context, blocks uint64, lastBlock *rpc.BlockNumber, rewardPercentiles []float64) (*big.Int, [][]*big.Int, []*big.Int, []float64, error) {
+		return big.NewInt(1), nil, []*big.Int{big.NewInt(0), big.NewInt(0)}, nil, nil
+	}
+
+	for _, test := range []struct {
+		name       string
+		feeHistory FeeHistory
+		opts       *RequestOptions
+		configure  func(cfg *ChainGasConfig)
+		sentinel   error
+		code       string
+		retryable  bool
+	}{
+		{"upstream", failing(refused), nil, nil, ErrUpstream, "upstream", true},
+		{"cancelled", failing(context.Canceled), nil, nil, ErrUpstream, "upstream", false},
+		{"no blocks", empty, nil, nil, ErrInsufficientData, "insufficient_data", true},
+		{"base fees count", feeHistoryOf(cfg.Blocks+2, 100), nil, nil, ErrMalformedFeeHistory, "malformed_fee_history", false},
+		{"no oldest block", noOldest, nil, nil, ErrMalformedFeeHistory, "malformed_fee_history", false},
+		{"pre-London", preLondon, nil, nil, ErrNo1559Support, "no_1559_support", false},
+		{"negative min tip", feeHistoryOf(cfg.Blocks+1, 100), &RequestOptions{MinTipGwei: -1}, nil, ErrInvalidRequestOptions, "invalid_request_options", false},
+		{"levels mismatch", feeHistoryOf(cfg.Blocks+1, 100), nil, func(cfg *ChainGasConfig) { cfg.Levels = cfg.Levels[:1] }, ErrInvalidChainGasConfig, "invalid_chain_gas_config", false},
+	} {
+		cfg := cfg
+		if test.configure != nil {
+			test.configure(&cfg)
+		}
+		_, err := SuggestGasFeesWithOptions(context.Background(), cfg, nil, test.feeHistory, test.opts)
+		if !errors.Is(err, test.sentinel) {
+			t.Fatalf("%s: expected %v, have %v", test.name, test.sentinel, err)
+		}
+		var classified GasFeeError
+		if !errors.As(err, &classified) {
+			t.Fatalf("%s: unclassified error %v", test.name, err)
+		}
+		if classified.Code() != test.code || classified.Retryable() != test.retryable {
+			t.Fatalf("%s: classified %s, retryable %v, want %s, retryable %v", test.name, classified.Code(), classified.Retryable(), test.code, test.retryable)
+		}
+	}
+
+	// the upstream error is kept as is
+	_, err := SuggestGasFeesWithRequestOptions(context.Background(), nil, failing(refused), nil)
+	var upstream *UpstreamError
+	if !errors.As(err, &upstream) || errors.Unwrap(err) != refused || !errors.Is(err, refused) {
+		t.Fatalf("upstream error not preserved: %v", err)
+	}
+}
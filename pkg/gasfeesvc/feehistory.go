@@ -0,0 +1,85 @@
+//go:build eth || op || base
+// +build eth op base
+
+package gasfeesvc
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// NewFeeHistoryFromRPC returns a FeeHistory calling eth_feeHistory on client. lastBlock is the latest block
+// when nil, block tags like pending are sent as such and block numbers as hex quantities. Providers which
+// omit the rewards, e.g. when there are no percentiles to report, get an empty rewards row per block.
+func NewFeeHistoryFromRPC(client *rpc.Client) FeeHistory {
+	return func(ctx context.Context, blocks uint64, lastBlock *rpc.BlockNumber, rewardPercentiles []float64) (*big.Int, [][]*big.Int, []*big.Int, []float64, error) {
+		block := rpc.LatestBlockNumber
+		if lastBlock != nil {
+			block = *lastBlock
+		}
+		var res feeHistoryResult
+		if err := client.CallContext(ctx, &res, "eth_feeHistory", hexutil.Uint64(blocks), block, decimalPercentiles(rewardPercentiles)); err != nil {
+			return nil, nil, nil, nil, err
+		}
+		return res.unpack()
+	}
+}
+
+// NewFeeHistoryFromEthClient returns a FeeHistory calling eth_feeHistory on the rpc client underlying client,
+// see NewFeeHistoryFromRPC.
+func NewFeeHistoryFromEthClient(client *ethclient.Client) FeeHistory {
+	return NewFeeHistoryFromRPC(client.Client())
+}
+
+// feeHistoryResult is the response of eth_feeHistory
+type feeHistoryResult struct {
+	OldestBlock  *hexutil.Big     `json:"oldestBlock"`
+	Reward       [][]*hexutil.Big `json:"reward,omitempty"`
+	BaseFee      []*hexutil.Big   `json:"baseFeePerGas,omitempty"`
+	GasUsedRatio []float64        `json:"gasUsedRatio"`
+}
+
+func (res *feeHistoryResult) unpack() (*big.Int, [][]*big.Int, []*big.Int, []float64, error) {
+	if res.OldestBlock == nil {
+		return nil, nil, nil, nil, fmt.Errorf("%w: missing oldest block", ErrMalformedFeeHistory)
+	}
+	if res.Reward != nil && len(res.Reward) != len(res.GasUsedRatio) {
+		return nil, nil, nil, nil, fmt.Errorf("%w: %d rewards rows for %d blocks", ErrMalformedFeeHistory, len(res.Reward), len(res.GasUsedRatio))
+	}
+	rewards := make([][]*big.Int, len(res.GasUsedRatio))
+	for i, row := range res.Reward {
+		rewards[i] = make([]*big.Int, len(row))
+		for j, reward := range row {
+			if reward == nil {
+				return nil, nil, nil, nil, fmt.Errorf("%w: missing reward %d of block %d", ErrMalformedFeeHistory, j, i)
+			}
+			rewards[i][j] = reward.ToInt()
+		}
+	}
+	baseFees := make([]*big.Int, len(res.BaseFee))
+	for i, baseFee := range res.BaseFee {
+		if baseFee == nil {
+			return nil, nil, nil, nil, fmt.Errorf("%w: missing base fee %d", ErrMalformedFeeHistory, i)
+		}
+		baseFees[i] = baseFee.ToInt()
+	}
+	return res.OldestBlock.ToInt(), rewards, baseFees, res.GasUsedRatio, nil
+}
+
+// decimalPercentiles marshals the reward percentiles as plain decimals, never in exponent notation
+type decimalPercentiles []float64
+
+func (p decimalPercentiles) MarshalJSON() ([]byte, error) {
+	enc := make([]string, len(p))
+	for i, percentile := range p {
+		enc[i] = strconv.FormatFloat(percentile, 'f', -1, 64)
+	}
+	return []byte("[" + strings.Join(enc, ",") + "]"), nil
+}
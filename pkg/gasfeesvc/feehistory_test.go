@@ -0,0 +1,137 @@
+//go:build eth || op || base
+// +build eth op base
+
+package gasfeesvc
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// feeHistoryServer serves a canned eth_feeHistory result and records the params of the last request
+func feeHistoryServer(t *testing.T, result string, params *[]json.RawMessage) *rpc.Client {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     json.RawMessage   `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Method != "eth_feeHistory" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		*params = req.Params
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":` + string(req.ID) + `,"result":` + result + `}`))
+	}))
+	t.Cleanup(server.Close)
+	client, err := rpc.Dial(server.URL)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(client.Close)
+	return client
+}
+
+func TestFeeHistoryFromRPC(t *testing.T) {
+	// a provider capping the history to 4 of the 10 requested blocks
+	const capped = `{
+		"oldestBlock": "0x11a49a0",
+		"reward": [["0x3b9aca00", "0x77359400", "0xb2d05e00"], ["0x3b9aca00", "0x77359400", "0xb2d05e00"], ["0x5f5e100", "0x3b9aca00", "0x77359400"], ["0x3b9aca00", "0x77359400", "0xee6b2800"]],
+		"baseFeePerGas": ["0x6fc23ac00", "0x6fc23ac00", "0x737be7600", "0x6fc23ac00", "0x72bd2b400"],
+		"gasUsedRatio": [0.5, 0.61, 0.42, 0.55]
+	}`
+	var params []json.RawMessage
+	client := feeHistoryServer(t, capped, &params)
+
+	cfg := DefaultChainGasConfig()
+	cfg.Blocks = 10
+	cfg.RewardPercentiles = []float64{10, 50, 90}
+	suggested, err := SuggestGasFeesWithConfig(context.Background(), cfg, nil, NewFeeHistoryFromRPC(client))
+	if err != nil {
+		t.Fatalf("failed to suggest gas fees: %v", err)
+	}
+	if suggested.Blocks != 4 {
+		t.Fatalf("block count mismatch: have %d, want 4", suggested.Blocks)
+	}
+	if len(params) != 3 || string(params[0]) != `"0xa"` || string(params[1]) != `"latest"` {
+		t.Fatalf("request params mismatch: %s", params)
+	}
+	var percentiles []float64
+	if err := json.Unmarshal(params[2], &percentiles); err != nil || len(percentiles) != 3 || percentiles[2] != 90 {
+		t.Fatalf("percentiles mismatch: %s", params[2])
+	}
+
+	feeHistory := NewFeeHistoryFromRPC(client)
+	oldest, rewards, baseFees, ratios, err := feeHistory(context.Background(), 10, nil, []float64{10, 50, 90})
+	if err != nil {
+		t.Fatalf("failed to get fee history: %v", err)
+	}
+	if oldest.Int64() != 18500000 || len(rewards) != 4 || rewards[2][0].Int64() != 100_000_000 || len(baseFees) != 5 ||
+		baseFees[4].Int64() != 30_800_000_000 || len(ratios) != 4 {
+		t.Fatalf("fee history mismatch: %v %v %v %v", oldest, rewards, baseFees, ratios)
+	}
+
+	// block tags and numbers, percentiles as plain decimals
+	for _, test := range []struct {
+		lastBlock rpc.BlockNumber
+		want      string
+	}{
+		{rpc.PendingBlockNumber, `"pending"`},
+		{rpc.LatestBlockNumber, `"latest"`},
+		{rpc.BlockNumber(18500003), `"0x11a49a3"`},
+	} {
+		lastBlock := test.lastBlock
+		if _, _, _, _, err := feeHistory(context.Background(), 4, &lastBlock, []float64{0.0000001, 99.5}); err != nil {
+			t.Fatalf("failed to get fee history: %v", err)
+		}
+		if string(params[1]) != test.want || string(params[2]) != "[0.0000001,99.5]" {
+			t.Fatalf("request params mismatch for %v: %s", test.lastBlock, params)
+		}
+	}
+
+	// the same over an ethclient
+	oldest, _, _, _, err = NewFeeHistoryFromEthClient(ethclient.NewClient(client))(context.Background(), 10, nil, []float64{10, 50, 90})
+	if err != nil || oldest.Cmp(big.NewInt(18500000)) != 0 {
+		t.Fatalf("ethclient fee history mismatch: %v, %v", oldest, err)
+	}
+}
+
+func TestFeeHistoryFromRPCWithoutRewards(t *testing.T) {
+	const noRewards = `{
+		"oldestBlock": "0x10",
+		"baseFeePerGas": ["0x3b9aca00", "0x3b9aca00", "0x3b9aca00"],
+		"gasUsedRatio": [0, 0]
+	}`
+	var params []json.RawMessage
+	feeHistory := NewFeeHistoryFromRPC(feeHistoryServer(t, noRewards, &params))
+	_, rewards, baseFees, _, err := feeHistory(context.Background(), 2, nil, []float64{10, 50, 90})
+	if err != nil {
+		t.Fatalf("failed to get fee history: %v", err)
+	}
+	if len(rewards) != 2 || len(rewards[0]) != 0 || len(rewards[1]) != 0 || len(baseFees) != 3 {
+		t.Fatalf("fee history mismatch: %v %v", rewards, baseFees)
+	}
+	cfg := DefaultChainGasConfig()
+	cfg.Blocks = 2
+	suggested, err := SuggestGasFeesWithConfig(context.Background(), cfg, nil, feeHistory)
+	if err != nil {
+		t.Fatalf("failed to suggest gas fees: %v", err)
+	}
+	if suggested.Blocks != 2 {
+		t.Fatalf("block count mismatch: have %d, want 2", suggested.Blocks)
+	}
+
+	// rewards for some blocks only are malformed
+	feeHistory = NewFeeHistoryFromRPC(feeHistoryServer(t, `{"oldestBlock": "0x10", "reward": [["0x1"]], "baseFeePerGas": ["0x1", "0x1", "0x1"], "gasUsedRatio": [0.1, 0.2]}`, &params))
+	if _, _, _, _, err := feeHistory(context.Background(), 2, nil, []float64{50}); err == nil {
+		t.Fatalf("partial rewards accepted")
+	}
+}
@@ -0,0 +1,96 @@
+//go:build op || base
+// +build op base
+
+package gasfeesvc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// ErrInvalidL1DataFee is returned when the L1 data fee estimate is missing or negative.
+var ErrInvalidL1DataFee = errors.New("invalid L1 data fee")
+
+// L1DataFee estimates the L1 data fee in wei an op-stack tx pays on top of its L2 execution fee, e.g. with
+// getL1Fee of the GasPriceOracle predeploy for the tx being priced.
+type L1DataFee func(ctx context.Context) (*big.Int, error)
+
+// FeeBreakdown is the total fee of an op-stack tx at a suggested level, split into the L2 execution fee and
+// the L1 data fee. The wei amounts are exact, the gwei ones are rounded to a wei for display.
+type FeeBreakdown struct {
+	Level             string   `json:"level"`
+	GasLimit          uint64   `json:"gasLimit"`
+	EffectiveGasPrice *big.Int `json:"effectiveGasPrice"` // wei per gas, the next base fee plus the effective tip
+	L2Fee             *big.Int `json:"l2Fee"`             // wei, the effective gas price times the gas limit
+	L1Fee             *big.Int `json:"l1Fee"`             // wei
+	TotalFee          *big.Int `json:"totalFee"`          // wei
+	L2FeeGwei         float64  `json:"l2FeeGwei"`
+	L1FeeGwei         float64  `json:"l1FeeGwei"`
+	TotalFeeGwei      float64  `json:"totalFeeGwei"`
+}
+
+// NewFeeBreakdowns breaks the fee of a tx using up to gasLimit gas down per level of the suggestion, in the
+// order of its Levels. The L2 fee is priced at the gas price the tx is expected to pay in the next block,
+// min(maxFee, nextBaseFee + maxPriorityFee), rather than at its max fee.
+func NewFeeBreakdowns(suggested *SuggestedGasFees, gasLimit uint64, l1DataFee *big.Int) ([]*FeeBreakdown, error) {
+	if l1DataFee == nil || l1DataFee.Sign() < 0 {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidL1DataFee, l1DataFee)
+	}
+	baseFee := gweiToWei(suggested.NextBaseFee)
+	gas := new(big.Int).SetUint64(gasLimit)
+	var breakdowns []*FeeBreakdown
+	for _, level := range suggested.Levels() {
+		fee := suggested.EstimatedGasFees[level]
+		if fee == nil {
+			continue
+		}
+		price := EffectiveTip(gweiToWei(fee.MaxPriorityFeePerGas), gweiToWei(fee.MaxFeePerGas), baseFee)
+		price.Add(price, baseFee)
+		l2Fee := new(big.Int).Mul(price, gas)
+		total := new(big.Int).Add(l2Fee, l1DataFee)
+		breakdowns = append(breakdowns, &FeeBreakdown{
+			Level:             level,
+			GasLimit:          gasLimit,
+			EffectiveGasPrice: price,
+			L2Fee:             l2Fee,
+			L1Fee:             new(big.Int).Set(l1DataFee),
+			TotalFee:          total,
+			L2FeeGwei:         weiToGwei(l2Fee),
+			L1FeeGwei:         weiToGwei(l1DataFee),
+			TotalFeeGwei:      weiToGwei(total),
+		})
+	}
+	return breakdowns, nil
+}
+
+// SuggestFeeBreakdowns suggests gas fees like SuggestGasFeesWithOptions and breaks the fee of a tx using up to
+// gasLimit gas down per level with the L1 data fee estimated by l1DataFee, see NewFeeBreakdowns.
+func SuggestFeeBreakdowns(ctx context.Context, cfg ChainGasConfig, lastBlock *rpc.BlockNumber, feeHistory FeeHistory, l1DataFee L1DataFee, gasLimit uint64, opts *RequestOptions) ([]*FeeBreakdown, error) {
+	suggested, err := SuggestGasFeesWithOptions(ctx, cfg, lastBlock, feeHistory, opts)
+	if err != nil {
+		return nil, err
+	}
+	l1Fee, err := l1DataFee(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to estimate L1 data fee: %w", err)
+	}
+	return NewFeeBreakdowns(suggested, gasLimit, l1Fee)
+}
+
+// gweiToWei converts a suggested fee in gwei to wei, rounded to the nearest wei
+func gweiToWei(gwei float64) *big.Int {
+	wei := new(big.Float).Mul(big.NewFloat(gwei), big.NewFloat(1_000_000_000))
+	wei.Add(wei, big.NewFloat(0.5))
+	rounded, _ := wei.Int(nil)
+	return rounded
+}
+
+// weiToGwei converts wei to gwei rounded to a wei
+func weiToGwei(wei *big.Int) float64 {
+	gwei, _ := new(big.Float).Quo(new(big.Float).SetInt(wei), big.NewFloat(1_000_000_000)).Float64()
+	return roundFee(gwei, weiDecimals)
+}
@@ -0,0 +1,72 @@
+//go:build op || base
+// +build op base
+
+package gasfeesvc
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+)
+
+func TestNewFeeBreakdowns(t *testing.T) {
+	suggested := &SuggestedGasFees{
+		NextBaseFee: 0.05,
+		EstimatedGasFees: map[string]*EstimatedGasFee{
+			"normal":  {MaxPriorityFeePerGas: 0.001, MaxFeePerGas: 0.101},
+			"instant": {MaxPriorityFeePerGas: 2, MaxFeePerGas: 1.05}, // capped by the max fee
+		},
+	}
+	breakdowns, err := NewFeeBreakdowns(suggested, 21_000, big.NewInt(3_000_000_000_000))
+	if err != nil {
+		t.Fatalf("failed to break fees down: %v", err)
+	}
+	if len(breakdowns) != 2 || breakdowns[0].Level != "normal" || breakdowns[1].Level != "instant" {
+		t.Fatalf("levels mismatch: %+v", breakdowns)
+	}
+	normal := breakdowns[0]
+	if normal.EffectiveGasPrice.Int64() != 51_000_000 || normal.L2Fee.Int64() != 1_071_000_000_000 ||
+		normal.L1Fee.Int64() != 3_000_000_000_000 || normal.TotalFee.Int64() != 4_071_000_000_000 {
+		t.Fatalf("normal wei mismatch: %+v", normal)
+	}
+	if normal.L2FeeGwei != 1071 || normal.L1FeeGwei != 3000 || normal.TotalFeeGwei != 4071 || normal.GasLimit != 21_000 {
+		t.Fatalf("normal gwei mismatch: %+v", normal)
+	}
+	if instant := breakdowns[1]; instant.EffectiveGasPrice.Int64() != 1_050_000_000 || instant.TotalFee.Int64() != 25_050_000_000_000 {
+		t.Fatalf("instant mismatch: %+v", instant)
+	}
+
+	for _, l1Fee := range []*big.Int{nil, big.NewInt(-1)} {
+		if _, err := NewFeeBreakdowns(suggested, 21_000, l1Fee); !errors.Is(err, ErrInvalidL1DataFee) {
+			t.Fatalf("L1 fee %v accepted: %v", l1Fee, err)
+		}
+	}
+}
+
+func TestSuggestFeeBreakdowns(t *testing.T) {
+	cfg := DefaultChainGasConfig()
+	l1Fee := func(ctx context.Context) (*big.Int, error) { return big.NewInt(1_000_000), nil }
+	breakdowns, err := SuggestFeeBreakdowns(context.Background(), cfg, nil, feeHistoryOf(cfg.Blocks+1, 100), l1Fee, 50_000, nil)
+	if err != nil {
+		t.Fatalf("failed to suggest fee breakdowns: %v", err)
+	}
+	if len(breakdowns) != len(cfg.Levels) {
+		t.Fatalf("level count mismatch: have %d, want %d", len(breakdowns), len(cfg.Levels))
+	}
+	for i, breakdown := range breakdowns {
+		if breakdown.Level != cfg.Levels[i] || new(big.Int).Add(breakdown.L2Fee, breakdown.L1Fee).Cmp(breakdown.TotalFee) != 0 {
+			t.Fatalf("breakdown %d mismatch: %+v", i, breakdown)
+		}
+		// the next base fee is 20 gwei
+		if breakdown.EffectiveGasPrice.Cmp(big.NewInt(20_000_000_000)) <= 0 {
+			t.Fatalf("breakdown %d prices below the base fee: %v", i, breakdown.EffectiveGasPrice)
+		}
+	}
+
+	failing := errors.New("oracle down")
+	l1Fee = func(ctx context.Context) (*big.Int, error) { return nil, failing }
+	if _, err := SuggestFeeBreakdowns(context.Background(), cfg, nil, feeHistoryOf(cfg.Blocks+1, 100), l1Fee, 50_000, nil); !errors.Is(err, failing) {
+		t.Fatalf("L1 fee error mismatch: %v", err)
+	}
+}
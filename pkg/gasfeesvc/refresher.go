@@ -0,0 +1,180 @@
+//go:build eth || op || base
+// +build eth op base
+
+package gasfeesvc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// subscriptionBuffer is the number of suggestions buffered per subscriber before the oldest is dropped.
+const subscriptionBuffer = 4
+
+// ErrNoSuggestion is returned by Refresher.Latest before the first successful refresh.
+var ErrNoSuggestion = errors.New("no gas fee suggestion available yet")
+
+// RefresherHealth reports the state of a Refresher.
+type RefresherHealth struct {
+	LastSuccess       time.Time     // zero if never succeeded
+	Age               time.Duration // age of the latest suggestion, zero if there is none
+	ConsecutiveErrors int
+	LastError         error
+}
+
+// Refresher keeps the latest gas fee suggestion up to date in the background.
+type Refresher struct {
+	cfg        ChainGasConfig
+	feeHistory FeeHistory
+	interval   time.Duration
+
+	mu          sync.RWMutex
+	latest      *SuggestedGasFees
+	lastSuccess time.Time
+	errCount    int
+	lastErr     error
+	subscribers map[chan *SuggestedGasFees]struct{}
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewRefresher creates a Refresher which queries feeHistory every interval.
+func NewRefresher(cfg ChainGasConfig, feeHistory FeeHistory, interval time.Duration) *Refresher {
+	return &Refresher{
+		cfg:         cfg,
+		feeHistory:  feeHistory,
+		interval:    interval,
+		subscribers: make(map[chan *SuggestedGasFees]struct{}),
+	}
+}
+
+// Start refreshes immediately and then every interval until ctx is done or Stop is called.
+func (r *Refresher) Start(ctx context.Context) {
+	r.mu.Lock()
+	if r.cancel != nil {
+		r.mu.Unlock()
+		return
+	}
+	ctx, r.cancel = context.WithCancel(ctx)
+	r.done = make(chan struct{})
+	done := r.done
+	r.mu.Unlock()
+
+	go r.loop(ctx, done)
+}
+
+// Stop stops the background refreshing and waits for it to exit.
+func (r *Refresher) Stop() {
+	r.mu.Lock()
+	cancel, done := r.cancel, r.done
+	r.cancel, r.done = nil, nil
+	r.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+func (r *Refresher) loop(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		r.refresh(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh queries a new suggestion, failures keep the last good one
+func (r *Refresher) refresh(ctx context.Context) {
+	suggested, err := SuggestGasFeesWithConfig(ctx, r.cfg, nil, r.feeHistory)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.errCount++
+		r.lastErr = err
+		log.Warn("Failed to refresh gas fee suggestion", "errors", r.errCount, "err", err)
+		return
+	}
+	r.latest = suggested
+	r.lastSuccess = time.Now()
+	r.errCount = 0
+	r.lastErr = nil
+	for ch := range r.subscribers {
+		publish(ch, suggested)
+	}
+}
+
+// publish sends suggested to ch without blocking, dropping the oldest buffered suggestion when full
+func publish(ch chan *SuggestedGasFees, suggested *SuggestedGasFees) {
+	for {
+		select {
+		case ch <- suggested:
+			return
+		default:
+		}
+		select {
+		case <-ch:
+		default:
+		}
+	}
+}
+
+// Latest returns the most recent successful suggestion, its age is reported by Health.
+func (r *Refresher) Latest() (*SuggestedGasFees, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.latest == nil {
+		if r.lastErr != nil {
+			return nil, r.lastErr
+		}
+		return nil, ErrNoSuggestion
+	}
+	return r.latest, nil
+}
+
+// Health reports the age of the latest suggestion and the consecutive refresh failures.
+func (r *Refresher) Health() RefresherHealth {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	health := RefresherHealth{
+		LastSuccess:       r.lastSuccess,
+		ConsecutiveErrors: r.errCount,
+		LastError:         r.lastErr,
+	}
+	if r.latest != nil {
+		health.Age = time.Since(r.lastSuccess)
+	}
+	return health
+}
+
+// Subscribe returns a channel receiving every new suggestion and a function to unsubscribe.
+// Slow subscribers never block the refresher, they lose the oldest buffered suggestions instead.
+func (r *Refresher) Subscribe() (<-chan *SuggestedGasFees, func()) {
+	ch := make(chan *SuggestedGasFees, subscriptionBuffer)
+	r.mu.Lock()
+	r.subscribers[ch] = struct{}{}
+	r.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			r.mu.Lock()
+			delete(r.subscribers, ch)
+			r.mu.Unlock()
+			close(ch)
+		})
+	}
+}
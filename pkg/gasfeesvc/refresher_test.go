@@ -0,0 +1,132 @@
+//go:build eth || op || base
+// +build eth op base
+
+package gasfeesvc
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// fakeFeeHistory serves a busy chain history and fails every other call when flaky is set
+type fakeFeeHistory struct {
+	calls int
+	flaky bool
+}
+
+func (f *fakeFeeHistory) FeeHistory(ctx context.Context, blocks uint64, lastBlock *rpc.BlockNumber, rewardPercentiles []float64) (*big.Int, [][]*big.Int, []*big.Int, []float64, error) {
+	f.calls++
+	if f.flaky && f.calls%2 == 0 {
+		return nil, nil, nil, nil, errors.New("upstream unavailable")
+	}
+	rewards := make([][]*big.Int, blocks)
+	for i := range rewards {
+		for j := range rewardPercentiles {
+			rewards[i] = append(rewards[i], big.NewInt(int64(1_000_000_000+j*1_000_000+f.calls)))
+		}
+	}
+	baseFees := make([]*big.Int, blocks+1)
+	for i := range baseFees {
+		baseFees[i] = big.NewInt(20_000_000_000)
+	}
+	gasUsedRatios := make([]float64, blocks)
+	for i := range gasUsedRatios {
+		gasUsedRatios[i] = 0.5
+	}
+	return big.NewInt(100), rewards, baseFees, gasUsedRatios, nil
+}
+
+func TestRefresherKeepsLastGood(t *testing.T) {
+	fake := &fakeFeeHistory{flaky: true}
+	r := NewRefresher(DefaultChainGasConfig(), fake.FeeHistory, time.Hour)
+	ctx := context.Background()
+
+	if _, err := r.Latest(); !errors.Is(err, ErrNoSuggestion) {
+		t.Fatalf("expected no suggestion before refresh, have %v", err)
+	}
+	r.refresh(ctx) // success
+	good, err := r.Latest()
+	if err != nil {
+		t.Fatalf("failed to get latest suggestion: %v", err)
+	}
+	r.refresh(ctx) // failure
+	latest, err := r.Latest()
+	if err != nil || latest != good {
+		t.Fatalf("expected last good suggestion after failure, have %v, %v", latest, err)
+	}
+	health := r.Health()
+	if health.ConsecutiveErrors != 1 || health.LastError == nil {
+		t.Fatalf("expected one recorded failure, have %+v", health)
+	}
+	if health.Age <= 0 || health.LastSuccess.IsZero() {
+		t.Fatalf("expected staleness to be reported, have %+v", health)
+	}
+
+	r.refresh(ctx) // success
+	if health := r.Health(); health.ConsecutiveErrors != 0 || health.LastError != nil {
+		t.Fatalf("expected failures to be cleared, have %+v", health)
+	}
+	if latest, _ := r.Latest(); latest == good {
+		t.Fatalf("expected a new suggestion")
+	}
+}
+
+func TestRefresherSlowSubscriber(t *testing.T) {
+	fake := &fakeFeeHistory{}
+	r := NewRefresher(DefaultChainGasConfig(), fake.FeeHistory, time.Hour)
+	ch, unsubscribe := r.Subscribe()
+
+	// nobody reads the channel, refreshing must not block
+	finished := make(chan struct{})
+	go func() {
+		for i := 0; i < 3*subscriptionBuffer; i++ {
+			r.refresh(context.Background())
+		}
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("refresh blocked on a slow subscriber")
+	}
+
+	// the buffer holds the newest suggestions
+	latest, _ := r.Latest()
+	var last *SuggestedGasFees
+	for i := 0; i < subscriptionBuffer; i++ {
+		last = <-ch
+	}
+	if last != latest {
+		t.Fatalf("expected the newest suggestion to be buffered last")
+	}
+	unsubscribe()
+	unsubscribe()
+	if _, ok := <-ch; ok {
+		t.Fatalf("expected channel to be closed after unsubscribe")
+	}
+	r.refresh(context.Background())
+}
+
+func TestRefresherStartStop(t *testing.T) {
+	fake := &fakeFeeHistory{}
+	r := NewRefresher(DefaultChainGasConfig(), fake.FeeHistory, time.Millisecond)
+	ch, unsubscribe := r.Subscribe()
+	defer unsubscribe()
+
+	r.Start(context.Background())
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no suggestion delivered")
+	}
+	r.Stop()
+	r.Stop()
+	if _, err := r.Latest(); err != nil {
+		t.Fatalf("failed to get latest suggestion: %v", err)
+	}
+}
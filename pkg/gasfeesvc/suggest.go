@@ -0,0 +1,333 @@
+//go:build eth || op || base
+// +build eth op base
+
+package gasfeesvc
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/gonum/stat"
+)
+
+type FeeHistory func(ctx context.Context, blocks uint64, lastBlock *rpc.BlockNumber, rewardPercentiles []float64) (*big.Int, [][]*big.Int, []*big.Int, []float64, error)
+
+// SuggestGasFees suggests gas fees with the default options of the chain being built. lastBlock is the latest
+// block when nil, a block number suggests what would have been suggested right after that block, e.g. to
+// backtest a fee strategy.
+func SuggestGasFees(ctx context.Context, lastBlock *rpc.BlockNumber, feeHistory FeeHistory) (*SuggestedGasFees, error) {
+	return SuggestGasFeesWithRequestOptions(ctx, lastBlock, feeHistory, nil)
+}
+
+// SuggestGasFeesWithRequestOptions suggests gas fees like SuggestGasFees, with the default options overridden
+// by opts unless it's nil.
+func SuggestGasFeesWithRequestOptions(ctx context.Context, lastBlock *rpc.BlockNumber, feeHistory FeeHistory, opts *RequestOptions) (*SuggestedGasFees, error) {
+	return SuggestGasFeesWithOptions(ctx, DefaultChainGasConfig(), lastBlock, feeHistory, opts)
+}
+
+// SuggestGasFeesWithConfig suggests gas fees with the given options.
+func SuggestGasFeesWithConfig(ctx context.Context, cfg ChainGasConfig, lastBlock *rpc.BlockNumber, feeHistory FeeHistory) (*SuggestedGasFees, error) {
+	return SuggestGasFeesWithOptions(ctx, cfg, lastBlock, feeHistory, nil)
+}
+
+// SuggestGasFeesWithOptions suggests gas fees with the given options overridden by opts unless it's nil.
+// Oracles capping the block count serve fewer blocks than requested, the suggestion is then based on the
+// blocks returned and SuggestedGasFees.Blocks tells how many. Its failures are classified, see GasFeeError.
+// The intermediate values are reported to the DebugSink of ctx if any, see WithDebugSink.
+func SuggestGasFeesWithOptions(ctx context.Context, cfg ChainGasConfig, lastBlock *rpc.BlockNumber, feeHistory FeeHistory, opts *RequestOptions) (*SuggestedGasFees, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	sink := debugSinkFrom(ctx)
+	blocks := cfg.blockCount(opts)
+	stdDevThreshold := cfg.StdDevThreshold
+	tipFeePercentiles, err := cfg.tipFeePercentiles(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// firstly we sample the rewards at the reward percentiles, we will do preprocessing on the returned data and pickup 3 percentiles as the normal, fast, instant levels
+	rewardPercentiles, err := cfg.rewardPercentiles(opts)
+	if err != nil {
+		return nil, err
+	}
+	minTip, err := cfg.minTip(opts)
+	if err != nil {
+		return nil, err
+	}
+	maxFee, err := cfg.maxFee(opts)
+	if err != nil {
+		return nil, err
+	}
+	poolWeight, err := cfg.poolWeight(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if lastBlock == nil {
+		lastBlock = new(rpc.BlockNumber)
+		*lastBlock = rpc.LatestBlockNumber
+	}
+	oldest, rewards, baseFees, gasUsedRatios, err := feeHistory(ctx, uint64(blocks), lastBlock, rewardPercentiles)
+	if err != nil {
+		return nil, &UpstreamError{Err: err}
+	}
+	if len(gasUsedRatios) == 0 && len(baseFees) == 0 {
+		return nil, fmt.Errorf("%w: no block served for %d blocks up to %v", ErrInsufficientData, blocks, lastBlock)
+	}
+	if oldest == nil {
+		return nil, fmt.Errorf("%w: missing oldest block", ErrMalformedFeeHistory)
+	}
+	// there's a gas used ratio per returned block, fewer blocks than requested means the oracle capped the count
+	if served := len(gasUsedRatios); served > 0 && served < blocks {
+		blocks = served
+	}
+	// a historical suggestion is about the blocks up to lastBlock, an oracle serving others, e.g. the latest ones
+	// of a node without the history, would suggest for the wrong time
+	if *lastBlock >= 0 && oldest.Int64()+int64(blocks)-1 != lastBlock.Int64() {
+		return nil, fmt.Errorf("%w: blocks from %v for %d blocks up to %d", ErrMalformedFeeHistory, oldest, blocks, lastBlock.Int64())
+	}
+	// pre-London blocks report no or zero base fees, any suggestion would be all zeros
+	if !hasBaseFee(baseFees) {
+		return nil, ErrNo1559Support
+	}
+	if sink != nil {
+		sink.OnFeeHistoryFetched(oldest, blocks)
+	}
+	historicalBaseFees, projectedBaseFee, err := splitBaseFees(baseFees, blocks)
+	if err != nil {
+		return nil, err
+	}
+	if rewards, err = checkRewards(rewards, blocks, len(rewardPercentiles)); err != nil {
+		return nil, err
+	}
+	rewards = cfg.normalizeRewards(rewards, historicalBaseFees)
+
+	// pre process the original data from the Oracle
+	// 1. convert the original data unit "wei" to "gwei"
+	// 2. remove the exceptional rewards that deviate too much from the mean
+	results := &SuggestedGasFees{
+		BaseBlock:        oldest.Int64() + int64(blocks) - 1,
+		Blocks:           blocks,
+		GasUsedRatio:     gasUsedRatios,
+		StdDevThreshold:  stdDevThreshold,
+		EstimatedGasFees: make(map[string]*EstimatedGasFee, len(cfg.Levels)),
+		levels:           append([]string{}, cfg.Levels...),
+		PredictMode:      PredictModeHistorical,
+	}
+	nextBaseFee := 0.0 // unrounded, the floor of all suggested max fees
+	for _, baseFee := range historicalBaseFees {
+		if baseFee == nil {
+			continue
+		}
+		if bf, accuracy := new(big.Float).SetInt(baseFee).Float64(); accuracy == 0 {
+			results.HistoricalBaseFees = append(results.HistoricalBaseFees, roundFee(bf/1_000_000_000, cfg.RoundDecimals))
+			nextBaseFee = bf / 1_000_000_000 // fallback when the next block's base fee isn't projected
+		}
+	}
+	lastBaseFee := nextBaseFee
+	// prefer the projected base fee of the next block over the last historical one
+	if projectedBaseFee != nil {
+		if bf, accuracy := new(big.Float).SetInt(projectedBaseFee).Float64(); accuracy == 0 && bf > 0 {
+			nextBaseFee = bf / 1_000_000_000
+		}
+	}
+	// the oracle projects from the gas used of the last block only, a mean over more blocks smooths it
+	if n := min(cfg.GasUsedRatioBlocks, len(gasUsedRatios)); n > 1 && lastBaseFee > 0 {
+		nextBaseFee = cfg.projectBaseFee(lastBaseFee, gasUsedRatios[len(gasUsedRatios)-n:])
+	}
+	if nextBaseFee <= 0 {
+		return nil, ErrNo1559Support
+	}
+	results.NextBaseFee = roundFeeAbove(nextBaseFee, nextBaseFee, cfg.RoundDecimals)
+	trend := cfg.TrendThresholds.Classify(results.HistoricalBaseFees, gasUsedRatios)
+	results.Trend, results.Volatility = trend.Trend, trend.Volatility
+	if cfg.SuggestAction {
+		results.SuggestedAction = trend.SuggestedAction()
+	}
+	for _, rewardsIn1Blk := range rewards {
+		for _, txReward := range rewardsIn1Blk {
+			if rwd, ok := tipGwei(txReward, cfg.RoundDecimals); ok {
+				results.HistoricalRewards = append(results.HistoricalRewards, rwd)
+			}
+		}
+	}
+
+	// remove the rewards that 1x from the Standard Deviation
+	regulated, mean, stdDev := regulateTips(results.HistoricalRewards, stdDevThreshold, cfg.RoundDecimals)
+	results.RegulatedHistoricalRewards = regulated
+	if sink != nil {
+		sink.OnRegulated(results.HistoricalRewards, regulated, mean, stdDev)
+	}
+
+	// In case there are too few transactions(less than 1 tx per block), there's no need to calculate the tips
+	// just give as small tips as we can since the network is quite well in capacity.
+	chainLowActivity := false
+	if len(regulated) < blocks {
+		chainLowActivity = true
+		results.PredictMode = PredictModeLowActivity
+	} else if cfg.MinSamples > 0 && distinctRewards(rewards) < cfg.MinSamples {
+		// the percentiles of a few txs are no better a guess
+		chainLowActivity = true
+		results.PredictMode = PredictModeFewSamples
+	}
+
+	// the tips waiting in the txpool are blended into the ones picked from the history, at the same percentiles
+	if opts != nil && opts.TxPool != nil && (*lastBlock == rpc.LatestBlockNumber || *lastBlock == rpc.PendingBlockNumber) {
+		maxTxs := opts.PoolMaxTxs
+		if maxTxs <= 0 {
+			maxTxs = DefaultPoolMaxTxs
+		}
+		if tips, err := opts.TxPool.SampleTips(ctx, maxTxs); err != nil {
+			results.Warnings = append(results.Warnings, fmt.Sprintf("txpool sampling failed, suggested from the history only: %v", err))
+		} else {
+			var poolTips []float64
+			for _, tip := range tips {
+				if gwei, ok := tipGwei(tip, cfg.RoundDecimals); ok {
+					poolTips = append(poolTips, gwei)
+				}
+			}
+			if poolTips, _, _ = regulateTips(poolTips, stdDevThreshold, cfg.RoundDecimals); len(poolTips) > 0 {
+				results.PoolTips = poolTips
+				results.PredictMode += "+pool"
+			}
+		}
+	}
+
+	for i, level := range cfg.Levels {
+		percentile := tipFeePercentiles[i]
+		baseFeeRatio := cfg.BaseFeeIncreaseRatio[i]
+
+		var tip float64
+		// low probability fall into this branch
+		if chainLowActivity {
+			tip = roundFee(results.NextBaseFee*cfg.LowActivityTipFeeRatio[i], cfg.RoundDecimals)
+		} else {
+			idx := int(percentile * float64(len(regulated)))
+			tip = regulated[idx]
+		}
+		if poolTips := results.PoolTips; len(poolTips) > 0 {
+			poolTip := poolTips[int(percentile*float64(len(poolTips)))]
+			tip = roundFee((1-poolWeight)*tip+poolWeight*poolTip, cfg.RoundDecimals)
+		}
+		// the max fee below is raised along with the tip
+		if tip < minTip {
+			tip = roundFeeAbove(minTip, minTip, cfg.RoundDecimals)
+		}
+
+		fee := &EstimatedGasFee{
+			MaxPriorityFeePerGas: tip,
+			MaxFeePerGas:         roundFeeAbove(results.NextBaseFee*baseFeeRatio+tip, nextBaseFee, cfg.RoundDecimals),
+		}
+		// the cap takes precedence over the tip floor and the next base fee, the tip never exceeds the max fee
+		if cappedFee := roundFee(maxFee, cfg.RoundDecimals); maxFee > 0 && fee.MaxFeePerGas > cappedFee {
+			fee.MaxFeePerGas = cappedFee
+			fee.MaxPriorityFeePerGas = math.Min(fee.MaxPriorityFeePerGas, cappedFee)
+			fee.Capped = true
+		}
+		results.EstimatedGasFees[level] = fee
+		if sink != nil {
+			sink.OnLevelComputed(level, fee.MaxPriorityFeePerGas, fee.MaxFeePerGas)
+		}
+	}
+	return results, nil
+}
+
+// tipGwei converts a tip in wei to gwei rounded to decimals, a negative tip to 0. The rewards are the effective
+// tips, min(maxPriorityFee, maxFee - baseFee), of the sampled txs, a tx whose maxFee fell below a spiking base fee
+// may be reported with a negative tip, clamped so it doesn't skew the estimate. Tips a float64 can't represent
+// exactly are dropped.
+func tipGwei(tip *big.Int, decimals int) (float64, bool) {
+	if tip == nil {
+		return 0, false
+	}
+	if tip.Sign() < 0 {
+		tip = new(big.Int)
+	}
+	wei, accuracy := new(big.Float).SetInt(tip).Float64()
+	if accuracy != 0 {
+		return 0, false
+	}
+	return roundFee(wei/1_000_000_000, decimals), true
+}
+
+// regulateTips drops the tips deviating more than threshold x stdDev from their mean and sorts the rest. They're
+// summed up in ascending order and rounded to a wei so the same tips give the same estimate whatever the order of
+// the blocks they come from. The mean and standard deviation they're regulated with are returned along.
+func regulateTips(tips []float64, threshold float64, decimals int) ([]float64, float64, float64) {
+	sorted := append([]float64{}, tips...)
+	sort.Float64s(sorted)
+	mean, stdDev := stat.MeanStdDev(sorted, nil)
+	mean, stdDev = roundFee(mean, weiDecimals), roundFee(stdDev, weiDecimals)
+	mean = roundFee(mean, decimals)
+	regulated := []float64{}
+	for _, num := range tips {
+		if math.Abs(num-mean) <= threshold*stdDev {
+			regulated = append(regulated, num)
+		}
+	}
+	sort.Float64s(regulated)
+	return regulated, mean, stdDev
+}
+
+// distinctRewards counts the distinct rewards of every block, every percentile of a block with few txs is the
+// tip of one of them, so it's a lower bound of the txs sampled
+func distinctRewards(rewards [][]*big.Int) int {
+	var count int
+	for _, row := range rewards {
+		seen := make(map[string]struct{}, len(row))
+		for _, reward := range row {
+			if reward != nil {
+				seen[reward.String()] = struct{}{}
+			}
+		}
+		count += len(seen)
+	}
+	return count
+}
+
+// hasBaseFee reports whether any block of the fee history has a positive base fee
+func hasBaseFee(baseFees []*big.Int) bool {
+	for _, baseFee := range baseFees {
+		if baseFee != nil && baseFee.Sign() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// splitBaseFees splits the base fees of the fee history into the historical ones and the projected base fee
+// of the next block, which is nil if the oracle didn't return it.
+func splitBaseFees(baseFees []*big.Int, blocks int) ([]*big.Int, *big.Int, error) {
+	switch len(baseFees) {
+	case blocks + 1:
+		return baseFees[:blocks], baseFees[blocks], nil
+	case blocks:
+		return baseFees, nil, nil
+	default:
+		return nil, nil, fmt.Errorf("%w: %d base fees for %d blocks", ErrMalformedFeeHistory, len(baseFees), blocks)
+	}
+}
+
+// checkRewards checks there is a rewards row per block, rows longer than the requested percentiles are trimmed
+// and empty rows of blocks without txs are tolerated.
+func checkRewards(rewards [][]*big.Int, blocks, percentiles int) ([][]*big.Int, error) {
+	if len(rewards) != blocks {
+		return nil, fmt.Errorf("%w: %d rewards rows for %d blocks", ErrMalformedFeeHistory, len(rewards), blocks)
+	}
+	checked := make([][]*big.Int, len(rewards))
+	for i, row := range rewards {
+		switch {
+		case len(row) > percentiles:
+			row = row[:percentiles]
+		case len(row) > 0 && len(row) < percentiles:
+			return nil, fmt.Errorf("%w: rewards row %d has %d of %d percentiles", ErrMalformedFeeHistory, i, len(row), percentiles)
+		}
+		checked[i] = row
+	}
+	return checked, nil
+}
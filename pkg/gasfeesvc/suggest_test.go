@@ -0,0 +1,787 @@
+//go:build eth || op || base
+// +build eth op base
+
+package gasfeesvc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+func TestSuggestGasFeesPreLondon(t *testing.T) {
+	for _, baseFees := range [][]*big.Int{{big.NewInt(0), big.NewInt(0)}, {nil}} {
+		feeHistory := func(ctx context.Context, blocks uint64, lastBlock *rpc.BlockNumber, rewardPercentiles []float64) (*big.Int, [][]*big.Int, []*big.Int, []float64, error) {
+			return big.NewInt(1), nil, baseFees, nil, nil
+		}
+		if _, err := SuggestGasFees(context.Background(), nil, feeHistory); !errors.Is(err, ErrNo1559Support) {
+			t.Fatalf("expected ErrNo1559Support for base fees %v, have %v", baseFees, err)
+		}
+	}
+}
+
+func TestSuggestGasFeesNegativeRewards(t *testing.T) {
+	gwei := func(n int64) *big.Int { return new(big.Int).Mul(big.NewInt(n), big.NewInt(1_000_000_000)) }
+	cfg := DefaultChainGasConfig()
+	feeHistory := func(ctx context.Context, blocks uint64, lastBlock *rpc.BlockNumber, rewardPercentiles []float64) (*big.Int, [][]*big.Int, []*big.Int, []float64, error) {
+		var (
+			rewards  [][]*big.Int
+			baseFees []*big.Int
+		)
+		for i := uint64(0); i < blocks; i++ {
+			row := []*big.Int{gwei(-5)}
+			for j := 1; j < len(rewardPercentiles); j++ {
+				row = append(row, gwei(int64(1+j%2)))
+			}
+			rewards = append(rewards, row)
+			baseFees = append(baseFees, gwei(30))
+		}
+		return big.NewInt(1), rewards, append(baseFees, gwei(30)), make([]float64, blocks), nil
+	}
+	suggested, err := SuggestGasFeesWithConfig(context.Background(), cfg, nil, feeHistory)
+	if err != nil {
+		t.Fatalf("failed to suggest gas fees: %v", err)
+	}
+	if len(suggested.HistoricalRewards) != 100*cfg.Blocks {
+		t.Fatalf("historical reward count mismatch: have %d, want %d", len(suggested.HistoricalRewards), 100*cfg.Blocks)
+	}
+	for _, reward := range suggested.HistoricalRewards {
+		if reward < 0 {
+			t.Fatalf("negative reward %v in historical rewards", reward)
+		}
+	}
+	for level, fee := range suggested.EstimatedGasFees {
+		if fee.MaxPriorityFeePerGas < 0 {
+			t.Fatalf("level %s: negative tip %v", level, fee.MaxPriorityFeePerGas)
+		}
+	}
+}
+
+// feeHistoryOf returns a fee history oracle returning the given number of base fees and rewards of the given width,
+// the historical base fees are 10 gwei and the projected one 20 gwei.
+func feeHistoryOf(baseFees, width int) FeeHistory {
+	return func(ctx context.Context, blocks uint64, lastBlock *rpc.BlockNumber, rewardPercentiles []float64) (*big.Int, [][]*big.Int, []*big.Int, []float64, error) {
+		var (
+			rewards [][]*big.Int
+			fees    []*big.Int
+		)
+		for i := 0; i < int(blocks); i++ {
+			row := make([]*big.Int, width)
+			for j := range row {
+				row[j] = big.NewInt(int64(j+1) * 1_000_000_000)
+			}
+			rewards = append(rewards, row)
+		}
+		for i := 0; i < baseFees; i++ {
+			if i == int(blocks) {
+				fees = append(fees, big.NewInt(20_000_000_000))
+			} else {
+				fees = append(fees, big.NewInt(10_000_000_000))
+			}
+		}
+		return big.NewInt(1), rewards, fees, make([]float64, blocks), nil
+	}
+}
+
+func TestSuggestGasFeesFeeHistoryLength(t *testing.T) {
+	cfg := DefaultChainGasConfig()
+
+	// the projected base fee of the next block is preferred over the last historical one
+	suggested, err := SuggestGasFeesWithConfig(context.Background(), cfg, nil, feeHistoryOf(cfg.Blocks+1, 100))
+	if err != nil {
+		t.Fatalf("failed to suggest gas fees: %v", err)
+	}
+	if suggested.NextBaseFee != 20 || len(suggested.HistoricalBaseFees) != cfg.Blocks {
+		t.Fatalf("blocks+1 base fees: have next %v and %d historical, want %v and %d", suggested.NextBaseFee, len(suggested.HistoricalBaseFees), 20, cfg.Blocks)
+	}
+	// without the projection the last historical base fee is used
+	suggested, err = SuggestGasFeesWithConfig(context.Background(), cfg, nil, feeHistoryOf(cfg.Blocks, 100))
+	if err != nil {
+		t.Fatalf("failed to suggest gas fees: %v", err)
+	}
+	if suggested.NextBaseFee != 10 || len(suggested.HistoricalBaseFees) != cfg.Blocks {
+		t.Fatalf("blocks base fees: have next %v and %d historical, want %v and %d", suggested.NextBaseFee, len(suggested.HistoricalBaseFees), 10, cfg.Blocks)
+	}
+	// rewards rows longer than the requested percentiles are trimmed
+	suggested, err = SuggestGasFeesWithConfig(context.Background(), cfg, nil, feeHistoryOf(cfg.Blocks+1, 120))
+	if err != nil {
+		t.Fatalf("failed to suggest gas fees: %v", err)
+	}
+	if len(suggested.HistoricalRewards) != 100*cfg.Blocks {
+		t.Fatalf("historical reward count mismatch: have %d, want %d", len(suggested.HistoricalRewards), 100*cfg.Blocks)
+	}
+
+	for _, malformed := range []FeeHistory{
+		feeHistoryOf(cfg.Blocks-1, 100),
+		feeHistoryOf(cfg.Blocks+2, 100),
+		feeHistoryOf(cfg.Blocks+1, 50),
+	} {
+		if _, err := SuggestGasFeesWithConfig(context.Background(), cfg, nil, malformed); !errors.Is(err, ErrMalformedFeeHistory) {
+			t.Fatalf("expected ErrMalformedFeeHistory, have %v", err)
+		}
+	}
+}
+
+func TestSuggestGasFeesSmoothedGasUsedRatio(t *testing.T) {
+	cfg := DefaultChainGasConfig()
+	cfg.BaseFeeChangeDenominator, cfg.ElasticityMultiplier = 8, 2
+	// full blocks up to an empty last one, the oracle projects 20 gwei off the historical 10 gwei
+	bursty := func(ctx context.Context, blocks uint64, lastBlock *rpc.BlockNumber, rewardPercentiles []float64) (*big.Int, [][]*big.Int, []*big.Int, []float64, error) {
+		oldest, rewards, baseFees, ratios, err := feeHistoryOf(int(blocks)+1, len(rewardPercentiles))(ctx, blocks, lastBlock, rewardPercentiles)
+		for i := range ratios {
+			ratios[i] = 1
+		}
+		ratios[len(ratios)-1] = 0
+		return oldest, rewards, baseFees, ratios, err
+	}
+	for _, test := range []struct {
+		ratioBlocks int
+		want        float64
+	}{
+		{0, 20},
+		{1, 20},
+		{2, 10}, // a mean ratio of 0.5 is the gas target
+		{4, roundFee(10*(1+(0.75*2-1)/8), cfg.RoundDecimals)}, // 3 full blocks and the empty one
+		{cfg.Blocks, roundFee(10*(1+(float64(cfg.Blocks-1)/float64(cfg.Blocks)*2-1)/8), cfg.RoundDecimals)},
+		{1000, roundFee(10*(1+(float64(cfg.Blocks-1)/float64(cfg.Blocks)*2-1)/8), cfg.RoundDecimals)}, // all the blocks
+	} {
+		cfg.GasUsedRatioBlocks = test.ratioBlocks
+		suggested, err := SuggestGasFeesWithConfig(context.Background(), cfg, nil, bursty)
+		if err != nil {
+			t.Fatalf("%d blocks: failed to suggest gas fees: %v", test.ratioBlocks, err)
+		}
+		if math.Abs(suggested.NextBaseFee-test.want) > 1e-9 {
+			t.Fatalf("%d blocks: next base fee %v, want %v", test.ratioBlocks, suggested.NextBaseFee, test.want)
+		}
+		if fee := suggested.EstimatedGasFees["normal"]; fee.MaxFeePerGas < suggested.NextBaseFee {
+			t.Fatalf("%d blocks: max fee %v below the next base fee %v", test.ratioBlocks, fee.MaxFeePerGas, suggested.NextBaseFee)
+		}
+	}
+}
+
+// cappedFeeHistory returns a fee history oracle serving at most limit blocks like feeHistoryOf does, the
+// block count of the last request is stored in requested.
+func cappedFeeHistory(limit int, requested *uint64) FeeHistory {
+	return func(ctx context.Context, blocks uint64, lastBlock *rpc.BlockNumber, rewardPercentiles []float64) (*big.Int, [][]*big.Int, []*big.Int, []float64, error) {
+		*requested = blocks
+		served := min(int(blocks), limit)
+		return feeHistoryOf(served+1, len(rewardPercentiles))(ctx, uint64(served), lastBlock, rewardPercentiles)
+	}
+}
+
+func TestSuggestGasFeesWindow(t *testing.T) {
+	cfg := DefaultChainGasConfig()
+	cfg.WindowDuration = time.Minute
+	cfg.ChainBlockTime = 250 * time.Millisecond
+
+	// the oracle serves only 128 of the 240 blocks of the window
+	var requested uint64
+	suggested, err := SuggestGasFeesWithConfig(context.Background(), cfg, nil, cappedFeeHistory(128, &requested))
+	if err != nil {
+		t.Fatalf("failed to suggest gas fees: %v", err)
+	}
+	if requested != 240 {
+		t.Fatalf("requested block count mismatch: have %d, want %d", requested, 240)
+	}
+	if suggested.Blocks != 128 || len(suggested.HistoricalBaseFees) != 128 || suggested.BaseBlock != 128 {
+		t.Fatalf("capped suggestion mismatch: have %d blocks, %d base fees, base block %d", suggested.Blocks, len(suggested.HistoricalBaseFees), suggested.BaseBlock)
+	}
+	if suggested.PredictMode != "historicalStdDev" {
+		t.Fatalf("predict mode mismatch: have %s", suggested.PredictMode)
+	}
+
+	tests := []struct {
+		maxBlocks int
+		opts      *RequestOptions
+		want      uint64
+	}{
+		{0, nil, 240},
+		{100, nil, 100},
+		{0, &RequestOptions{Blocks: 20}, 20},
+		{0, &RequestOptions{Blocks: 20, WindowDuration: time.Second}, 20},
+		{0, &RequestOptions{WindowDuration: 10 * time.Second}, 40},
+		{0, &RequestOptions{WindowDuration: time.Hour}, DefaultMaxBlocks},
+		{0, &RequestOptions{WindowDuration: time.Millisecond}, 1},
+	}
+	for i, test := range tests {
+		cfg := cfg
+		cfg.MaxBlocks = test.maxBlocks
+		suggested, err := SuggestGasFeesWithOptions(context.Background(), cfg, nil, cappedFeeHistory(DefaultMaxBlocks, &requested), test.opts)
+		if err != nil {
+			t.Fatalf("test %d: failed to suggest gas fees: %v", i, err)
+		}
+		if requested != test.want || suggested.Blocks != int(test.want) {
+			t.Errorf("test %d: block count mismatch: have %d requested and %d used, want %d", i, requested, suggested.Blocks, test.want)
+		}
+	}
+
+	// without a block time the window is ignored
+	cfg.ChainBlockTime = 0
+	if _, err := SuggestGasFeesWithConfig(context.Background(), cfg, nil, cappedFeeHistory(DefaultMaxBlocks, &requested)); err != nil || requested != uint64(cfg.Blocks) {
+		t.Fatalf("block count mismatch without block time: have %d, want %d (err %v)", requested, cfg.Blocks, err)
+	}
+}
+
+func TestSuggestGasFeesPercentileOverride(t *testing.T) {
+	cfg := DefaultChainGasConfig()
+	feeHistory := feeHistoryOf(cfg.Blocks+1, 100)
+	suggested, err := SuggestGasFeesWithRequestOptions(context.Background(), nil, feeHistory, &RequestOptions{TipFeePercentiles: []float64{0, 0.5, 0.99}})
+	if err != nil {
+		t.Fatalf("failed to suggest gas fees: %v", err)
+	}
+	regulated := suggested.RegulatedHistoricalRewards
+	if have, want := suggested.EstimatedGasFees[cfg.Levels[0]].MaxPriorityFeePerGas, regulated[0]; have != want {
+		t.Fatalf("overridden tip mismatch: have %v, want %v", have, want)
+	}
+	if have, want := suggested.EstimatedGasFees[cfg.Levels[2]].MaxPriorityFeePerGas, regulated[int(0.99*float64(len(regulated)))]; have != want {
+		t.Fatalf("overridden tip mismatch: have %v, want %v", have, want)
+	}
+
+	for _, percentiles := range [][]float64{{0.5}, {0.1, 0.5, 1}, {-0.1, 0.5, 0.9}} {
+		_, err := SuggestGasFeesWithOptions(context.Background(), cfg, nil, feeHistory, &RequestOptions{TipFeePercentiles: percentiles})
+		if !errors.Is(err, ErrInvalidRequestOptions) {
+			t.Fatalf("percentiles %v: expected ErrInvalidRequestOptions, have %v", percentiles, err)
+		}
+	}
+}
+
+func TestSuggestGasFeesMinSamples(t *testing.T) {
+	cfg := DefaultChainGasConfig()
+	// every block has 2 txs tipping 1 and 2 gwei, sampled at every reward percentile
+	sparse := func(ctx context.Context, blocks uint64, lastBlock *rpc.BlockNumber, rewardPercentiles []float64) (*big.Int, [][]*big.Int, []*big.Int, []float64, error) {
+		oldest, rewards, baseFees, ratios, err := feeHistoryOf(int(blocks)+1, len(rewardPercentiles))(ctx, blocks, lastBlock, rewardPercentiles)
+		for _, row := range rewards {
+			for j := range row {
+				row[j] = big.NewInt(int64(1+j%2) * 1_000_000_000)
+			}
+		}
+		return oldest, rewards, baseFees, ratios, err
+	}
+	samples := 2 * cfg.Blocks
+	for _, test := range []struct {
+		minSamples int
+		mode       string
+	}{
+		{0, PredictModeHistorical},
+		{samples, PredictModeHistorical},
+		{samples + 1, PredictModeFewSamples},
+	} {
+		cfg.MinSamples = test.minSamples
+		suggested, err := SuggestGasFeesWithConfig(context.Background(), cfg, nil, sparse)
+		if err != nil {
+			t.Fatalf("min samples %d: failed to suggest gas fees: %v", test.minSamples, err)
+		}
+		if suggested.PredictMode != test.mode || len(suggested.RegulatedHistoricalRewards) < cfg.Blocks {
+			t.Fatalf("min samples %d: predict mode %s, want %s", test.minSamples, suggested.PredictMode, test.mode)
+		}
+		for i, level := range cfg.Levels {
+			tip := suggested.EstimatedGasFees[level].MaxPriorityFeePerGas
+			if want := roundFee(suggested.NextBaseFee*cfg.LowActivityTipFeeRatio[i], cfg.RoundDecimals); test.mode == PredictModeFewSamples && tip != want {
+				t.Fatalf("min samples %d, level %s: tip %v, want the base fee ratio %v", test.minSamples, level, tip, want)
+			}
+		}
+	}
+
+	// an idle chain keeps its own mode
+	cfg.MinSamples = 1000
+	suggested, err := SuggestGasFeesWithConfig(context.Background(), cfg, nil, feeHistoryOf(cfg.Blocks+1, 0))
+	if err != nil || suggested.PredictMode != PredictModeLowActivity {
+		t.Fatalf("idle chain: predict mode mismatch: %+v, %v", suggested, err)
+	}
+}
+
+func TestSuggestGasFeesMinTip(t *testing.T) {
+	cfg := DefaultChainGasConfig()
+	cfg.LowActivityTipFeeRatio = []float64{0, 0.01, 0.05}
+	quiet := feeHistoryOf(cfg.Blocks+1, 0) // no txs, the tips are ratios of the next base fee of 20 gwei
+
+	for _, test := range []struct {
+		cfgMinTip float64
+		opts      *RequestOptions
+		want      []float64
+	}{
+		{0, nil, []float64{0, 0.2, 1}},
+		{0.5, nil, []float64{0.5, 0.5, 1}},
+		{0.5, &RequestOptions{MinTipGwei: 2}, []float64{2, 2, 2}},
+		{0, &RequestOptions{MinTipGwei: 0.0000000001}, []float64{0.000000001, 0.2, 1}}, // rounded up to a wei
+	} {
+		cfg.MinTipGwei = test.cfgMinTip
+		suggested, err := SuggestGasFeesWithOptions(context.Background(), cfg, nil, quiet, test.opts)
+		if err != nil {
+			t.Fatalf("min tip %v: failed to suggest gas fees: %v", test.cfgMinTip, err)
+		}
+		for i, level := range cfg.Levels {
+			fee := suggested.EstimatedGasFees[level]
+			if fee.MaxPriorityFeePerGas != test.want[i] {
+				t.Fatalf("min tip %v, %s: tip mismatch: have %v, want %v", test.cfgMinTip, level, fee.MaxPriorityFeePerGas, test.want[i])
+			}
+			if want := roundFee(20*cfg.BaseFeeIncreaseRatio[i]+test.want[i], cfg.RoundDecimals); fee.MaxFeePerGas != want {
+				t.Fatalf("min tip %v, %s: max fee mismatch: have %v, want %v", test.cfgMinTip, level, fee.MaxFeePerGas, want)
+			}
+		}
+	}
+
+	cfg.MinTipGwei = 0
+	if _, err := SuggestGasFeesWithOptions(context.Background(), cfg, nil, quiet, &RequestOptions{MinTipGwei: -1}); !errors.Is(err, ErrInvalidRequestOptions) {
+		t.Fatalf("expected ErrInvalidRequestOptions, have %v", err)
+	}
+}
+
+func TestSuggestGasFeesMaxFee(t *testing.T) {
+	cfg := DefaultChainGasConfig()
+	cfg.LowActivityTipFeeRatio = []float64{0, 0.01, 0.05}
+	quiet := feeHistoryOf(cfg.Blocks+1, 0) // no txs, the tips are ratios of the next base fee of 20 gwei
+
+	for _, test := range []struct {
+		cfgMaxFee float64
+		opts      *RequestOptions
+		tips      []float64 // before the cap
+	}{
+		{0, nil, []float64{0, 0.2, 1}},
+		{1000, nil, []float64{0, 0.2, 1}},
+		{25, nil, []float64{0, 0.2, 1}},
+		{1000, &RequestOptions{MaxFeeGwei: 15}, []float64{0, 0.2, 1}},         // below the next base fee
+		{25, &RequestOptions{MinTipGwei: 30}, []float64{30, 30, 30}},          // the tip is lowered below the floor
+		{0, &RequestOptions{MaxFeeGwei: 20.0000000001}, []float64{0, 0.2, 1}}, // rounded to a wei
+	} {
+		cfg.MaxFeeGwei = test.cfgMaxFee
+		maxFee := test.cfgMaxFee
+		if test.opts != nil && test.opts.MaxFeeGwei != 0 {
+			maxFee = roundFee(test.opts.MaxFeeGwei, cfg.RoundDecimals)
+		}
+		suggested, err := SuggestGasFeesWithOptions(context.Background(), cfg, nil, quiet, test.opts)
+		if err != nil {
+			t.Fatalf("max fee %v: failed to suggest gas fees: %v", maxFee, err)
+		}
+		capped := false
+		for i, level := range cfg.Levels {
+			fee := suggested.EstimatedGasFees[level]
+			tip, want := test.tips[i], roundFee(20*cfg.BaseFeeIncreaseRatio[i]+test.tips[i], cfg.RoundDecimals)
+			levelCapped := maxFee > 0 && want > maxFee
+			if levelCapped {
+				tip, want = math.Min(tip, maxFee), maxFee
+				capped = true
+			}
+			if fee.MaxPriorityFeePerGas != tip || fee.MaxFeePerGas != want || fee.Capped != levelCapped {
+				t.Fatalf("max fee %v, %s: fee mismatch: have %+v, want tip %v, max fee %v", maxFee, level, fee, tip, want)
+			}
+			if fee.MaxPriorityFeePerGas > fee.MaxFeePerGas {
+				t.Fatalf("max fee %v, %s: tip above the max fee: %+v", maxFee, level, fee)
+			}
+		}
+		if suggested.Capped() != capped {
+			t.Fatalf("max fee %v: capped mismatch: have %v, want %v", maxFee, suggested.Capped(), capped)
+		}
+	}
+
+	cfg.MaxFeeGwei = 0
+	for _, maxFee := range []float64{-1, math.NaN(), math.Inf(1)} {
+		if _, err := SuggestGasFeesWithOptions(context.Background(), cfg, nil, quiet, &RequestOptions{MaxFeeGwei: maxFee}); !errors.Is(err, ErrInvalidRequestOptions) {
+			t.Fatalf("max fee %v: expected ErrInvalidRequestOptions, have %v", maxFee, err)
+		}
+	}
+}
+
+// tipSampler is a txpool holding the given tips
+type tipSampler struct {
+	tips   []*big.Int
+	err    error
+	calls  int
+	maxTxs int // of the last call
+}
+
+func (s *tipSampler) SampleTips(ctx context.Context, maxTxs int) ([]*big.Int, error) {
+	s.calls++
+	s.maxTxs = maxTxs
+	return s.tips, s.err
+}
+
+func TestSuggestGasFeesTxPool(t *testing.T) {
+	ctx := context.Background()
+	cfg := DefaultChainGasConfig()
+	history := feeHistoryOf(cfg.Blocks+1, 100) // rewards of 1 to 100 gwei per block
+	base, err := SuggestGasFeesWithOptions(ctx, cfg, nil, history, nil)
+	if err != nil {
+		t.Fatalf("failed to suggest gas fees: %v", err)
+	}
+	// the pool holds the tips of the history, 50 gwei higher
+	var tips []*big.Int
+	for i := 0; i < cfg.Blocks; i++ {
+		for j := 1; j <= 100; j++ {
+			tips = append(tips, big.NewInt(int64(j+50)*1_000_000_000))
+		}
+	}
+
+	pending := rpc.PendingBlockNumber
+	for _, test := range []struct {
+		lastBlock *rpc.BlockNumber
+		opts      *RequestOptions
+		weight    float64
+		maxTxs    int
+	}{
+		{nil, &RequestOptions{}, DefaultPoolWeight, DefaultPoolMaxTxs},
+		{&pending, &RequestOptions{PoolWeight: 0.5, PoolMaxTxs: 100}, 0.5, 100},
+		{nil, &RequestOptions{PoolWeight: 1}, 1, DefaultPoolMaxTxs},
+	} {
+		pool := &tipSampler{tips: tips}
+		test.opts.TxPool = pool
+		suggested, err := SuggestGasFeesWithOptions(ctx, cfg, test.lastBlock, history, test.opts)
+		if err != nil {
+			t.Fatalf("weight %v: failed to suggest gas fees: %v", test.weight, err)
+		}
+		if suggested.PredictMode != "historicalStdDev+pool" || len(suggested.PoolTips) == 0 || len(suggested.Warnings) != 0 {
+			t.Fatalf("weight %v: suggestion mismatch: mode %s, %d pool tips, warnings %v", test.weight, suggested.PredictMode, len(suggested.PoolTips), suggested.Warnings)
+		}
+		if pool.calls != 1 || pool.maxTxs != test.maxTxs {
+			t.Fatalf("weight %v: sampling mismatch: %d calls of %d txs, want %d txs", test.weight, pool.calls, pool.maxTxs, test.maxTxs)
+		}
+		// the pool shifts the tips up by its share of the 50 gwei difference
+		for _, level := range cfg.Levels {
+			want := base.EstimatedGasFees[level].MaxPriorityFeePerGas + test.weight*50
+			if have := suggested.EstimatedGasFees[level].MaxPriorityFeePerGas; math.Abs(have-want) > 1e-9 {
+				t.Fatalf("weight %v, %s: tip mismatch: have %v, want %v", test.weight, level, have, want)
+			}
+		}
+	}
+
+	// a failing pool falls back to the history, a historical suggestion doesn't sample it
+	failing := &tipSampler{err: errors.New("txpool unavailable")}
+	suggested, err := SuggestGasFeesWithOptions(ctx, cfg, nil, history, &RequestOptions{TxPool: failing})
+	if err != nil {
+		t.Fatalf("failed to suggest gas fees: %v", err)
+	}
+	if suggested.PredictMode != base.PredictMode || len(suggested.Warnings) != 1 || !reflect.DeepEqual(suggested.EstimatedGasFees, base.EstimatedGasFees) {
+		t.Fatalf("fallback mismatch: mode %s, warnings %v", suggested.PredictMode, suggested.Warnings)
+	}
+	pool := &tipSampler{tips: tips}
+	lastBlock := rpc.BlockNumber(cfg.Blocks)
+	if suggested, err := SuggestGasFeesWithOptions(ctx, cfg, &lastBlock, history, &RequestOptions{TxPool: pool}); err != nil || pool.calls != 0 || suggested.PredictMode != base.PredictMode {
+		t.Fatalf("historical suggestion sampled the txpool: %v", err)
+	}
+	if _, err := SuggestGasFeesWithOptions(ctx, cfg, nil, history, &RequestOptions{TxPool: pool, PoolWeight: 1.5}); !errors.Is(err, ErrInvalidRequestOptions) {
+		t.Fatalf("expected ErrInvalidRequestOptions, have %v", err)
+	}
+}
+
+func TestSuggestGasFeesRewardPercentiles(t *testing.T) {
+	var requested []float64
+	feeHistory := func(ctx context.Context, blocks uint64, lastBlock *rpc.BlockNumber, rewardPercentiles []float64) (*big.Int, [][]*big.Int, []*big.Int, []float64, error) {
+		requested = rewardPercentiles
+		return feeHistoryOf(int(blocks)+1, len(rewardPercentiles))(ctx, blocks, lastBlock, rewardPercentiles)
+	}
+	cfg := DefaultChainGasConfig()
+	if _, err := SuggestGasFeesWithConfig(context.Background(), cfg, nil, feeHistory); err != nil {
+		t.Fatalf("failed to suggest gas fees: %v", err)
+	}
+	if len(requested) != 100 || requested[0] != 0 || requested[99] != 99 {
+		t.Fatalf("default reward percentiles mismatch: %v", requested)
+	}
+
+	cfg.RewardPercentiles = LiteRewardPercentiles()
+	suggested, err := SuggestGasFeesWithConfig(context.Background(), cfg, nil, feeHistory)
+	if err != nil {
+		t.Fatalf("failed to suggest gas fees: %v", err)
+	}
+	if len(requested) != 25 || requested[0] != 2 || requested[24] != 98 {
+		t.Fatalf("lite reward percentiles mismatch: %v", requested)
+	}
+	if len(suggested.HistoricalRewards) != 25*cfg.Blocks {
+		t.Fatalf("historical rewards mismatch: have %d, want %d", len(suggested.HistoricalRewards), 25*cfg.Blocks)
+	}
+
+	// per request overrides take precedence over the config
+	if _, err := SuggestGasFeesWithOptions(context.Background(), cfg, nil, feeHistory, &RequestOptions{RewardPercentiles: []float64{10, 50, 90}}); err != nil || len(requested) != 3 {
+		t.Fatalf("overridden reward percentiles mismatch: have %v (err %v)", requested, err)
+	}
+	for _, percentiles := range [][]float64{{50, 10}, {10, 10}, {-1, 50}, {50, 100.5}} {
+		_, err := SuggestGasFeesWithOptions(context.Background(), cfg, nil, feeHistory, &RequestOptions{RewardPercentiles: percentiles})
+		if !errors.Is(err, ErrInvalidRequestOptions) {
+			t.Fatalf("percentiles %v: expected ErrInvalidRequestOptions, have %v", percentiles, err)
+		}
+	}
+}
+
+// recordedFeeHistory returns an oracle serving the 200 recorded mainnet blocks from 18500000 on like eth_feeHistory,
+// the latest block is the last recorded one.
+func recordedFeeHistory(t *testing.T) FeeHistory {
+	blob, err := os.ReadFile(filepath.Join("testdata", "fee_history_200.json"))
+	if err != nil {
+		t.Fatalf("failed to read fixture: %v", err)
+	}
+	var history struct {
+		OldestBlock  hexutil.Uint64   `json:"oldestBlock"`
+		BaseFee      []*hexutil.Big   `json:"baseFeePerGas"`
+		GasUsedRatio []float64        `json:"gasUsedRatio"`
+		Reward       [][]*hexutil.Big `json:"reward"`
+	}
+	if err := json.Unmarshal(blob, &history); err != nil {
+		t.Fatalf("failed to parse fixture: %v", err)
+	}
+	return func(ctx context.Context, blocks uint64, lastBlock *rpc.BlockNumber, rewardPercentiles []float64) (*big.Int, [][]*big.Int, []*big.Int, []float64, error) {
+		last := len(history.GasUsedRatio) - 1
+		if *lastBlock >= 0 {
+			last = int(lastBlock.Int64()) - int(history.OldestBlock)
+		}
+		if last < 0 || last >= len(history.GasUsedRatio) {
+			return nil, nil, nil, nil, fmt.Errorf("block %d not recorded", lastBlock.Int64())
+		}
+		first := max(0, last-int(blocks)+1)
+		var (
+			rewards  [][]*big.Int
+			baseFees []*big.Int
+		)
+		for i := first; i <= last; i++ {
+			row := make([]*big.Int, len(history.Reward[i]))
+			for j, reward := range history.Reward[i] {
+				row[j] = reward.ToInt()
+			}
+			rewards = append(rewards, sampleRewards(row, rewardPercentiles))
+		}
+		for i := first; i <= last+1; i++ {
+			baseFees = append(baseFees, history.BaseFee[i].ToInt())
+		}
+		return big.NewInt(int64(history.OldestBlock) + int64(first)), rewards, baseFees, history.GasUsedRatio[first : last+1], nil
+	}
+}
+
+func TestSuggestGasFeesHistorical(t *testing.T) {
+	cfg := ChainGasConfig{
+		Blocks:                 10,
+		StdDevThreshold:        1.0,
+		BaseFeeIncreaseRatio:   []float64{1.0, 1.45, 2.35},
+		TipFeePercentiles:      []float64{0.1, 0.5, 0.9},
+		LowActivityTipFeeRatio: []float64{0.0, 0.01, 0.05},
+		Levels:                 []string{"normal", "fast", "instant"},
+		RoundDecimals:          9,
+	}
+	feeHistory := recordedFeeHistory(t)
+
+	tests := []struct {
+		lastBlock   rpc.BlockNumber
+		opts        *RequestOptions
+		blocks      int
+		nextBaseFee float64
+		predictMode string
+		want        map[string]EstimatedGasFee
+	}{
+		{
+			lastBlock: 18_500_120, blocks: 10, nextBaseFee: 192.574908946, predictMode: "historicalStdDev",
+			want: map[string]EstimatedGasFee{
+				"normal":  {MaxPriorityFeePerGas: 0.039303938, MaxFeePerGas: 192.614212884},
+				"fast":    {MaxPriorityFeePerGas: 0.149831658, MaxFeePerGas: 279.38344963},
+				"instant": {MaxPriorityFeePerGas: 0.523268886, MaxFeePerGas: 453.074304909},
+			},
+		},
+		// sampling only the median reward leaves fewer regulated rewards than blocks
+		{
+			lastBlock: 18_500_120, opts: &RequestOptions{RewardPercentiles: []float64{50}}, blocks: 10, nextBaseFee: 192.574908946, predictMode: "lowActivity",
+			want: map[string]EstimatedGasFee{
+				"normal":  {MaxPriorityFeePerGas: 0, MaxFeePerGas: 192.574908946},
+				"fast":    {MaxPriorityFeePerGas: 1.925749089, MaxFeePerGas: 281.159367061},
+				"instant": {MaxPriorityFeePerGas: 9.628745447, MaxFeePerGas: 462.17978147},
+			},
+		},
+		// the recorded history starts 6 blocks before
+		{
+			lastBlock: 18_500_005, blocks: 6, nextBaseFee: 22.684836206, predictMode: "historicalStdDev",
+			want: map[string]EstimatedGasFee{
+				"normal":  {MaxPriorityFeePerGas: 0.045612925, MaxFeePerGas: 22.730449131},
+				"fast":    {MaxPriorityFeePerGas: 0.191688928, MaxFeePerGas: 33.084701427},
+				"instant": {MaxPriorityFeePerGas: 2.072948489, MaxFeePerGas: 55.382313573},
+			},
+		},
+	}
+	for _, test := range tests {
+		lastBlock := test.lastBlock
+		suggested, err := SuggestGasFeesWithOptions(context.Background(), cfg, &lastBlock, feeHistory, test.opts)
+		if err != nil {
+			t.Fatalf("block %d: failed to suggest gas fees: %v", test.lastBlock, err)
+		}
+		if suggested.BaseBlock != test.lastBlock.Int64() || suggested.Blocks != test.blocks || suggested.PredictMode != test.predictMode {
+			t.Fatalf("block %d: suggestion mismatch: have base block %d of %d blocks in %s mode", test.lastBlock, suggested.BaseBlock, suggested.Blocks, suggested.PredictMode)
+		}
+		if math.Abs(suggested.NextBaseFee-test.nextBaseFee) > 1e-9 {
+			t.Fatalf("block %d: next base fee mismatch: have %v, want %v", test.lastBlock, suggested.NextBaseFee, test.nextBaseFee)
+		}
+		for level, want := range test.want {
+			have := suggested.EstimatedGasFees[level]
+			if math.Abs(have.MaxPriorityFeePerGas-want.MaxPriorityFeePerGas) > 1e-9 || math.Abs(have.MaxFeePerGas-want.MaxFeePerGas) > 1e-9 {
+				t.Errorf("block %d, level %s: fees mismatch: have %+v, want %+v", test.lastBlock, level, *have, want)
+			}
+		}
+	}
+
+	// an oracle serving the latest blocks instead of the historical ones is caught
+	latest := func(ctx context.Context, blocks uint64, lastBlock *rpc.BlockNumber, rewardPercentiles []float64) (*big.Int, [][]*big.Int, []*big.Int, []float64, error) {
+		head := rpc.LatestBlockNumber
+		return feeHistory(ctx, blocks, &head, rewardPercentiles)
+	}
+	lastBlock := rpc.BlockNumber(18_500_120)
+	if _, err := SuggestGasFeesWithConfig(context.Background(), cfg, &lastBlock, latest); !errors.Is(err, ErrMalformedFeeHistory) {
+		t.Fatalf("expected ErrMalformedFeeHistory, have %v", err)
+	}
+}
+
+func TestSuggestGasFeesTrend(t *testing.T) {
+	cfg := DefaultChainGasConfig()
+	feeHistory := recordedFeeHistory(t)
+	lastBlock := rpc.BlockNumber(18_500_100) // the base fee climbs from block 18500090 on with full blocks
+	suggested, err := SuggestGasFeesWithConfig(context.Background(), cfg, &lastBlock, feeHistory)
+	if err != nil {
+		t.Fatalf("failed to suggest gas fees: %v", err)
+	}
+	want := ClassifyBaseFeeTrend(suggested.HistoricalBaseFees, suggested.GasUsedRatio)
+	if suggested.Trend != TrendRising || suggested.Trend != want.Trend || suggested.Volatility != want.Volatility {
+		t.Fatalf("trend mismatch: have %s (%v), want %s (%v)", suggested.Trend, suggested.Volatility, TrendRising, want.Volatility)
+	}
+	if suggested.SuggestedAction != "" {
+		t.Fatalf("action suggested without SuggestAction: %s", suggested.SuggestedAction)
+	}
+	if levels := suggested.Levels(); !reflect.DeepEqual(levels, cfg.Levels) {
+		t.Fatalf("levels mismatch: have %v, want %v", levels, cfg.Levels)
+	}
+
+	cfg.SuggestAction = true
+	if suggested, err = SuggestGasFeesWithConfig(context.Background(), cfg, &lastBlock, feeHistory); err != nil || suggested.SuggestedAction != ActionSendNow {
+		t.Fatalf("suggested action mismatch: have %q (err %v), want %q", suggested.SuggestedAction, err, ActionSendNow)
+	}
+	cfg.TrendThresholds.Slope = 1
+	if suggested, err = SuggestGasFeesWithConfig(context.Background(), cfg, &lastBlock, feeHistory); err != nil || suggested.Trend != TrendStable {
+		t.Fatalf("trend with custom threshold mismatch: have %q (err %v), want %q", suggested.Trend, err, TrendStable)
+	}
+}
+
+// syntheticFeeHistory returns a fee history oracle serving rewards of odd wei amounts, with the blocks in reverse
+// order when reversed is set.
+func syntheticFeeHistory(reversed bool) FeeHistory {
+	return func(ctx context.Context, blocks uint64, lastBlock *rpc.BlockNumber, rewardPercentiles []float64) (*big.Int, [][]*big.Int, []*big.Int, []float64, error) {
+		var (
+			rewards  [][]*big.Int
+			baseFees []*big.Int
+		)
+		for i := 0; i < int(blocks); i++ {
+			row := make([]*big.Int, len(rewardPercentiles))
+			for j := range row {
+				row[j] = big.NewInt(int64(j+1)*123_456_789 + int64(i*j)*7_777_777 + int64(i)*1_000_000_007)
+			}
+			rewards = append(rewards, row)
+			baseFees = append(baseFees, big.NewInt(12_345_678_901))
+		}
+		if reversed {
+			for i, j := 0, len(rewards)-1; i < j; i, j = i+1, j-1 {
+				rewards[i], rewards[j] = rewards[j], rewards[i]
+			}
+		}
+		return big.NewInt(1), rewards, append(baseFees, big.NewInt(13_579_246_801)), make([]float64, blocks), nil
+	}
+}
+
+// gasPriceFeeHistory returns feeHistory with the base fee of their block added to the rewards, like nodes
+// reporting effective gas prices do
+func gasPriceFeeHistory(feeHistory FeeHistory) FeeHistory {
+	return func(ctx context.Context, blocks uint64, lastBlock *rpc.BlockNumber, rewardPercentiles []float64) (*big.Int, [][]*big.Int, []*big.Int, []float64, error) {
+		oldest, rewards, baseFees, gasUsedRatios, err := feeHistory(ctx, blocks, lastBlock, rewardPercentiles)
+		for i, row := range rewards {
+			for j := range row {
+				row[j] = new(big.Int).Add(row[j], baseFees[i])
+			}
+		}
+		return oldest, rewards, baseFees, gasUsedRatios, err
+	}
+}
+
+func TestSuggestGasFeesRewardNormalizer(t *testing.T) {
+	cfg := DefaultChainGasConfig()
+	want, err := SuggestGasFeesWithConfig(context.Background(), cfg, nil, syntheticFeeHistory(false))
+	if err != nil {
+		t.Fatalf("failed to suggest gas fees: %v", err)
+	}
+	// gas prices taken for tips overestimate them by the base fee
+	overestimated, err := SuggestGasFeesWithConfig(context.Background(), cfg, nil, gasPriceFeeHistory(syntheticFeeHistory(false)))
+	if err != nil {
+		t.Fatalf("failed to suggest gas fees from gas prices: %v", err)
+	}
+	if have, tip := overestimated.EstimatedGasFees["normal"].MaxPriorityFeePerGas, want.EstimatedGasFees["normal"].MaxPriorityFeePerGas; math.Abs(have-tip-12.345678901) > 1e-6 {
+		t.Fatalf("gas prices not taken for tips: have %v, want %v + 12.345678901", have, tip)
+	}
+
+	cfg.RewardNormalizer = GasPriceRewardNormalizer
+	suggested, err := SuggestGasFeesWithConfig(context.Background(), cfg, nil, gasPriceFeeHistory(syntheticFeeHistory(false)))
+	if err != nil {
+		t.Fatalf("failed to suggest normalized gas fees: %v", err)
+	}
+	if !reflect.DeepEqual(suggested, want) {
+		t.Fatalf("normalized suggestion mismatch:\nhave %+v\nwant %+v", suggested, want)
+	}
+
+	// the normalizer gets the rewards with the base fee of their block, nil results are dropped
+	var calls int
+	cfg.RewardNormalizer = func(reward, baseFee *big.Int) *big.Int {
+		if calls++; baseFee == nil || baseFee.Int64() != 12_345_678_901 {
+			t.Fatalf("reward %v normalized with base fee %v", reward, baseFee)
+		}
+		if reward.Int64() > 1_000_000_000 {
+			return nil
+		}
+		return reward
+	}
+	if suggested, err = SuggestGasFeesWithConfig(context.Background(), cfg, nil, syntheticFeeHistory(false)); err != nil {
+		t.Fatalf("failed to suggest gas fees with dropped rewards: %v", err)
+	}
+	if calls != 100*cfg.Blocks || len(suggested.HistoricalRewards) >= len(want.HistoricalRewards) {
+		t.Fatalf("normalizer called %d times for %d rewards, %d of %d kept", calls, 100*cfg.Blocks, len(suggested.HistoricalRewards), len(want.HistoricalRewards))
+	}
+}
+
+func TestSuggestGasFeesDeterministic(t *testing.T) {
+	cfg := DefaultChainGasConfig()
+	cfg.RoundDecimals = NoRounding
+
+	var first []byte
+	for i := 0; i < 100; i++ {
+		suggested, err := SuggestGasFeesWithConfig(context.Background(), cfg, nil, syntheticFeeHistory(false))
+		if err != nil {
+			t.Fatalf("run %d: failed to suggest gas fees: %v", i, err)
+		}
+		enc, err := json.Marshal(suggested)
+		if err != nil {
+			t.Fatalf("run %d: failed to encode suggestion: %v", i, err)
+		}
+		if first == nil {
+			first = enc
+		} else if !bytes.Equal(enc, first) {
+			t.Fatalf("run %d: encoding mismatch:\nhave %s\nwant %s", i, enc, first)
+		}
+	}
+	// the levels are keyed in config order
+	normal, fast, instant := bytes.Index(first, []byte(`"normal":`)), bytes.Index(first, []byte(`"fast":`)), bytes.Index(first, []byte(`"instant":`))
+	if normal < 0 || normal > fast || fast > instant {
+		t.Fatalf("levels out of order: %s", first)
+	}
+	var decoded SuggestedGasFees
+	if err := json.Unmarshal(first, &decoded); err != nil || len(decoded.EstimatedGasFees) != 3 {
+		t.Fatalf("failed to decode suggestion: %v", err)
+	}
+
+	// the estimate doesn't depend on the order of the blocks
+	want, _ := SuggestGasFeesWithConfig(context.Background(), cfg, nil, syntheticFeeHistory(false))
+	have, err := SuggestGasFeesWithConfig(context.Background(), cfg, nil, syntheticFeeHistory(true))
+	if err != nil {
+		t.Fatalf("failed to suggest gas fees: %v", err)
+	}
+	if !reflect.DeepEqual(have.EstimatedGasFees, want.EstimatedGasFees) || !reflect.DeepEqual(have.RegulatedHistoricalRewards, want.RegulatedHistoricalRewards) {
+		t.Fatalf("estimate of reordered blocks mismatch: have %+v, want %+v", have.EstimatedGasFees, want.EstimatedGasFees)
+	}
+}
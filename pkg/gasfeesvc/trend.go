@@ -0,0 +1,141 @@
+package gasfeesvc
+
+import "math"
+
+// Base fee trends of TrendResult.
+const (
+	TrendRising   = "rising"
+	TrendFalling  = "falling"
+	TrendStable   = "stable"
+	TrendVolatile = "volatile"
+)
+
+// Advice of SuggestedGasFees.SuggestedAction.
+const (
+	ActionSendNow         = "send_now"
+	ActionCanWait         = "can_wait"
+	ActionWaitRecommended = "wait_recommended"
+)
+
+// targetGasUsedRatio is the gas used ratio the base fee of the next block stays the same at (EIP-1559)
+const targetGasUsedRatio = 0.5
+
+// TrendThresholds holds the thresholds the base fee trend is classified with.
+type TrendThresholds struct {
+	// Slope is the relative base fee change per block, i.e. the regression slope normalized by the mean
+	// base fee, from which on the base fee is rising or falling.
+	Slope float64
+	// BlockChange is the standard deviation of the relative base fee change from block to block above which
+	// the base fee is volatile. It's measured between blocks so that a steady move isn't volatile.
+	BlockChange float64
+}
+
+// DefaultTrendThresholds returns thresholds fitting mainnet, where the base fee changes by up to 12.5% per
+// block: a trend of 1% per block and an erratic change from block to block of 8%.
+func DefaultTrendThresholds() TrendThresholds {
+	return TrendThresholds{Slope: 0.01, BlockChange: 0.08}
+}
+
+// withDefaults returns the thresholds with the unset ones taken from DefaultTrendThresholds
+func (th TrendThresholds) withDefaults() TrendThresholds {
+	defaults := DefaultTrendThresholds()
+	if th.Slope <= 0 {
+		th.Slope = defaults.Slope
+	}
+	if th.BlockChange <= 0 {
+		th.BlockChange = defaults.BlockChange
+	}
+	return th
+}
+
+// TrendResult is the classification of a base fee series.
+type TrendResult struct {
+	Trend        string  `json:"trend"`
+	Slope        float64 `json:"slope"`        // relative base fee change per block
+	Volatility   float64 `json:"volatility"`   // coefficient of variation of the base fees
+	BlockChange  float64 `json:"blockChange"`  // standard deviation of the relative change from block to block
+	GasUsedRatio float64 `json:"gasUsedRatio"` // mean gas used ratio, 0 if unknown
+}
+
+// ClassifyBaseFeeTrend classifies the trend of the base fees of consecutive blocks, oldest first, with the
+// DefaultTrendThresholds. gasUsedRatios are the ones of the same blocks and may be empty.
+func ClassifyBaseFeeTrend(baseFees []float64, gasUsedRatios []float64) TrendResult {
+	return DefaultTrendThresholds().Classify(baseFees, gasUsedRatios)
+}
+
+// Classify classifies the trend of the base fees of consecutive blocks like ClassifyBaseFeeTrend, unset
+// thresholds take the default ones. Series of less than 2 base fees are stable.
+func (th TrendThresholds) Classify(baseFees []float64, gasUsedRatios []float64) TrendResult {
+	th = th.withDefaults()
+	result := TrendResult{Trend: TrendStable}
+	for _, ratio := range gasUsedRatios {
+		result.GasUsedRatio += ratio / float64(len(gasUsedRatios))
+	}
+	n := float64(len(baseFees))
+	if len(baseFees) < 2 {
+		return result
+	}
+	var mean float64
+	for _, baseFee := range baseFees {
+		mean += baseFee / n
+	}
+	if mean <= 0 {
+		return result
+	}
+
+	// least squares slope over the block index, and the sample deviation from the mean
+	var sxx, sxy, ss float64
+	meanX := (n - 1) / 2
+	for i, baseFee := range baseFees {
+		dx, dy := float64(i)-meanX, baseFee-mean
+		sxx += dx * dx
+		sxy += dx * dy
+		ss += dy * dy
+	}
+	result.Slope = sxy / sxx / mean
+	result.Volatility = math.Sqrt(ss/(n-1)) / mean
+
+	var changes []float64
+	for i := 1; i < len(baseFees); i++ {
+		if baseFees[i-1] > 0 {
+			changes = append(changes, baseFees[i]/baseFees[i-1]-1)
+		}
+	}
+	if len(changes) > 0 {
+		var meanChange, ssChange float64
+		for _, change := range changes {
+			meanChange += change / float64(len(changes))
+		}
+		for _, change := range changes {
+			ssChange += (change - meanChange) * (change - meanChange)
+		}
+		result.BlockChange = math.Sqrt(ssChange / float64(len(changes)))
+	}
+
+	switch {
+	case result.BlockChange > th.BlockChange:
+		result.Trend = TrendVolatile
+	case result.Slope >= th.Slope:
+		result.Trend = TrendRising
+	case result.Slope <= -th.Slope:
+		result.Trend = TrendFalling
+	}
+	return result
+}
+
+// SuggestedAction advises whether to send a tx now: waiting doesn't pay off while the base fee is stable
+// or rising, it may while it's falling or volatile, and is recommended while it's falling with blocks below
+// the gas target, which keeps lowering it. An unknown gas used ratio counts as below the target.
+func (result TrendResult) SuggestedAction() string {
+	switch result.Trend {
+	case TrendFalling:
+		if result.GasUsedRatio < targetGasUsedRatio {
+			return ActionWaitRecommended
+		}
+		return ActionCanWait
+	case TrendVolatile:
+		return ActionCanWait
+	default:
+		return ActionSendNow
+	}
+}
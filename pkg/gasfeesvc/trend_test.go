@@ -0,0 +1,66 @@
+package gasfeesvc
+
+import (
+	"math"
+	"testing"
+)
+
+// geometricSeries returns n base fees from first on changing by ratio per block
+func geometricSeries(first, ratio float64, n int) []float64 {
+	series := make([]float64, n)
+	for i := range series {
+		series[i] = first * math.Pow(ratio, float64(i))
+	}
+	return series
+}
+
+func TestClassifyBaseFeeTrend(t *testing.T) {
+	tests := []struct {
+		name          string
+		baseFees      []float64
+		gasUsedRatios []float64
+		trend         string
+		action        string
+	}{
+		{"full blocks", geometricSeries(10, 1.125, 10), []float64{1, 1, 1}, TrendRising, ActionSendNow},
+		{"long rise", geometricSeries(10, 1.125, 40), nil, TrendRising, ActionSendNow},
+		{"slow rise", geometricSeries(10, 1.02, 10), []float64{0.66}, TrendRising, ActionSendNow},
+		{"empty blocks", geometricSeries(10, 0.875, 10), []float64{0, 0}, TrendFalling, ActionWaitRecommended},
+		{"falling but busy", geometricSeries(10, 0.98, 10), []float64{0.6, 0.7}, TrendFalling, ActionCanWait},
+		{"sawtooth", []float64{10, 11.25, 10, 11.25, 10, 11.25, 10, 11.25, 10, 11.25}, []float64{1, 0, 1, 0}, TrendVolatile, ActionCanWait},
+		{"flat", []float64{10, 10, 10, 10, 10}, []float64{0.5}, TrendStable, ActionSendNow},
+		{"flat with noise", []float64{10, 10.1, 9.9, 10, 10.05, 9.95, 10, 10.1, 9.9, 10}, nil, TrendStable, ActionSendNow},
+		{"single block", []float64{10}, nil, TrendStable, ActionSendNow},
+		{"no base fee", []float64{0, 0, 0}, nil, TrendStable, ActionSendNow},
+	}
+	for _, test := range tests {
+		result := ClassifyBaseFeeTrend(test.baseFees, test.gasUsedRatios)
+		if result.Trend != test.trend || result.SuggestedAction() != test.action {
+			t.Errorf("%s: classification mismatch: have %s/%s, want %s/%s (%+v)", test.name, result.Trend, result.SuggestedAction(), test.trend, test.action, result)
+		}
+	}
+
+	result := ClassifyBaseFeeTrend([]float64{10, 10, 10}, nil)
+	if result.Slope != 0 || result.Volatility != 0 || result.BlockChange != 0 {
+		t.Fatalf("flat series measures mismatch: %+v", result)
+	}
+	result = ClassifyBaseFeeTrend([]float64{1, 2, 3}, []float64{0.25, 0.75})
+	if math.Abs(result.Slope-0.5) > 1e-12 || math.Abs(result.Volatility-0.5) > 1e-12 || result.GasUsedRatio != 0.5 {
+		t.Fatalf("linear series measures mismatch: %+v", result)
+	}
+
+	// a steady rise isn't volatile, however high the volatility
+	rise := geometricSeries(10, 1.125, 40)
+	if result := ClassifyBaseFeeTrend(rise, nil); result.Volatility < 1 || result.BlockChange > 1e-9 {
+		t.Fatalf("steady rise measures mismatch: %+v", result)
+	}
+
+	// custom thresholds, unset ones keep the defaults
+	slow := geometricSeries(10, 1.02, 10)
+	if trend := (TrendThresholds{Slope: 0.05}).Classify(slow, nil).Trend; trend != TrendStable {
+		t.Fatalf("custom slope threshold trend mismatch: have %s, want %s", trend, TrendStable)
+	}
+	if trend := (TrendThresholds{BlockChange: 0.2}).Classify(tests[5].baseFees, nil).Trend; trend != TrendStable {
+		t.Fatalf("custom block change threshold trend mismatch: have %s, want %s", trend, TrendStable)
+	}
+}
@@ -0,0 +1,133 @@
+//go:build eth || op || base
+// +build eth op base
+
+package gasfeesvc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// DefaultBundlerTipMarkupPercent is the markup of the tips suggested for ERC-4337 user operations over the ones
+// of direct txs, their inclusion through a bundler then a builder needs a slightly higher tip.
+const DefaultBundlerTipMarkupPercent = 10
+
+// MaxPreVerificationGasFactor caps SuggestedUserOpFees.PreVerificationGasFactor.
+const MaxPreVerificationGasFactor = 2
+
+// UserOpOptions configures the fee suggestion for user operations, zero fields take the defaults.
+type UserOpOptions struct {
+	BundlerTipMarkupPercent float64         // DefaultBundlerTipMarkupPercent when 0, not negative
+	Request                 *RequestOptions // overrides the chain config like for SuggestGasFeesWithOptions
+}
+
+// SuggestedUserOpFees are the fees suggested for ERC-4337 user operations: the tips of the suggestion for direct
+// txs marked up, their max fees raised along.
+type SuggestedUserOpFees struct {
+	BaseBlock               int64   `json:"baseBlock"`
+	NextBaseFee             float64 `json:"nextBaseFee"`
+	BundlerTipMarkupPercent float64 `json:"bundlerTipMarkupPercent"`
+	// BaseFeeVolatility is the coefficient of variation of the historical base fees, for bundlers to size their
+	// own margins.
+	BaseFeeVolatility float64 `json:"baseFeeVolatility"`
+	// PreVerificationGasFactor is the suggested inflation of the preVerificationGas of the user operations, 1 but
+	// while the base fee is volatile, where it grows with the volatility up to MaxPreVerificationGasFactor.
+	PreVerificationGasFactor float64                     `json:"preVerificationGasFactor"`
+	EstimatedGasFees         map[string]*EstimatedGasFee `json:"estimatedGasFees"`
+	Suggested                *SuggestedGasFees           `json:"suggested"` // the suggestion for direct txs
+}
+
+// MarshalJSON emits estimatedGasFees in the order of the levels of the suggestion, see SuggestedGasFees.MarshalJSON.
+func (s SuggestedUserOpFees) MarshalJSON() ([]byte, error) {
+	type plain SuggestedUserOpFees
+	var levels []string
+	if s.Suggested != nil {
+		levels = s.Suggested.Levels()
+	} else {
+		levels = (&SuggestedGasFees{EstimatedGasFees: s.EstimatedGasFees}).Levels()
+	}
+	return json.Marshal(struct {
+		plain
+		EstimatedGasFees orderedGasFees `json:"estimatedGasFees"`
+	}{plain(s), orderedGasFees{levels: levels, fees: s.EstimatedGasFees}})
+}
+
+// SuggestUserOpGasFees suggests the fees of user operations with the default options of the chain being built,
+// see SuggestUserOpGasFeesWithConfig.
+func SuggestUserOpGasFees(ctx context.Context, lastBlock *rpc.BlockNumber, feeHistory FeeHistory, opts UserOpOptions) (*SuggestedUserOpFees, error) {
+	return SuggestUserOpGasFeesWithConfig(ctx, DefaultChainGasConfig(), lastBlock, feeHistory, opts)
+}
+
+// SuggestUserOpGasFeesWithConfig suggests gas fees like SuggestGasFeesWithOptions and marks them up for user
+// operations, see NewUserOpGasFees.
+func SuggestUserOpGasFeesWithConfig(ctx context.Context, cfg ChainGasConfig, lastBlock *rpc.BlockNumber, feeHistory FeeHistory, opts UserOpOptions) (*SuggestedUserOpFees, error) {
+	if _, err := opts.tipMarkup(); err != nil {
+		return nil, err
+	}
+	suggested, err := SuggestGasFeesWithOptions(ctx, cfg, lastBlock, feeHistory, opts.Request)
+	if err != nil {
+		return nil, err
+	}
+	return NewUserOpGasFees(cfg, suggested, opts)
+}
+
+// NewUserOpGasFees marks the suggestion for direct txs made with cfg up for user operations, e.g. the latest one
+// of a Refresher. The tips of all levels are raised by the markup, their max fees by as much, within the max fee
+// cap of the config.
+func NewUserOpGasFees(cfg ChainGasConfig, suggested *SuggestedGasFees, opts UserOpOptions) (*SuggestedUserOpFees, error) {
+	markup, err := opts.tipMarkup()
+	if err != nil {
+		return nil, err
+	}
+	maxFee, err := cfg.maxFee(opts.Request)
+	if err != nil {
+		return nil, err
+	}
+	fees := &SuggestedUserOpFees{
+		BaseBlock:                suggested.BaseBlock,
+		NextBaseFee:              suggested.NextBaseFee,
+		BundlerTipMarkupPercent:  markup,
+		BaseFeeVolatility:        suggested.Volatility,
+		PreVerificationGasFactor: 1,
+		EstimatedGasFees:         make(map[string]*EstimatedGasFee, len(suggested.EstimatedGasFees)),
+		Suggested:                suggested,
+	}
+	if suggested.Trend == TrendVolatile {
+		fees.PreVerificationGasFactor = math.Min(roundFeeAbove(1+suggested.Volatility, 1, 2), MaxPreVerificationGasFactor)
+	}
+	for _, level := range suggested.Levels() {
+		fee := suggested.EstimatedGasFees[level]
+		if fee == nil {
+			continue
+		}
+		tip := roundFeeAbove(fee.MaxPriorityFeePerGas*(1+markup/100), fee.MaxPriorityFeePerGas, cfg.RoundDecimals)
+		userOpFee := &EstimatedGasFee{
+			MaxPriorityFeePerGas: tip,
+			MaxFeePerGas:         roundFeeAbove(fee.MaxFeePerGas+tip-fee.MaxPriorityFeePerGas, fee.MaxFeePerGas, cfg.RoundDecimals),
+			Capped:               fee.Capped,
+		}
+		if cappedFee := roundFee(maxFee, cfg.RoundDecimals); maxFee > 0 && userOpFee.MaxFeePerGas > cappedFee {
+			userOpFee.MaxFeePerGas = cappedFee
+			userOpFee.MaxPriorityFeePerGas = math.Min(userOpFee.MaxPriorityFeePerGas, cappedFee)
+			userOpFee.Capped = true
+		}
+		fees.EstimatedGasFees[level] = userOpFee
+	}
+	return fees, nil
+}
+
+// tipMarkup returns the markup of the tips in percent
+func (opts UserOpOptions) tipMarkup() (float64, error) {
+	markup := opts.BundlerTipMarkupPercent
+	if markup == 0 {
+		markup = DefaultBundlerTipMarkupPercent
+	}
+	if markup < 0 || math.IsNaN(markup) || math.IsInf(markup, 0) {
+		return 0, fmt.Errorf("%w: bundler tip markup %v%%", ErrInvalidRequestOptions, markup)
+	}
+	return markup, nil
+}
@@ -0,0 +1,104 @@
+//go:build eth || op || base
+// +build eth op base
+
+package gasfeesvc
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// countedFeeHistory counts the calls of feeHistory in calls
+func countedFeeHistory(feeHistory FeeHistory, calls *int) FeeHistory {
+	return func(ctx context.Context, blocks uint64, lastBlock *rpc.BlockNumber, rewardPercentiles []float64) (*big.Int, [][]*big.Int, []*big.Int, []float64, error) {
+		*calls++
+		return feeHistory(ctx, blocks, lastBlock, rewardPercentiles)
+	}
+}
+
+func TestSuggestUserOpGasFees(t *testing.T) {
+	ctx := context.Background()
+	cfg := DefaultChainGasConfig()
+	history := feeHistoryOf(cfg.Blocks+1, 100)
+	base, err := SuggestGasFeesWithConfig(ctx, cfg, nil, history)
+	if err != nil {
+		t.Fatalf("failed to suggest gas fees: %v", err)
+	}
+
+	for _, test := range []struct {
+		opts   UserOpOptions
+		markup float64
+	}{
+		{UserOpOptions{}, DefaultBundlerTipMarkupPercent},
+		{UserOpOptions{BundlerTipMarkupPercent: 25}, 25},
+		{UserOpOptions{BundlerTipMarkupPercent: 0.5}, 0.5},
+	} {
+		var calls int
+		fees, err := SuggestUserOpGasFees(ctx, nil, countedFeeHistory(history, &calls), test.opts)
+		if err != nil {
+			t.Fatalf("markup %v: failed to suggest user op fees: %v", test.markup, err)
+		}
+		if calls != 1 {
+			t.Fatalf("markup %v: fee history queried %d times, want once", test.markup, calls)
+		}
+		if fees.BundlerTipMarkupPercent != test.markup || fees.NextBaseFee != base.NextBaseFee || fees.PreVerificationGasFactor != 1 {
+			t.Fatalf("markup %v: suggestion mismatch: %+v", test.markup, fees)
+		}
+		for _, level := range base.Levels() {
+			direct, userOp := base.EstimatedGasFees[level], fees.EstimatedGasFees[level]
+			wantTip := roundFee(direct.MaxPriorityFeePerGas*(1+test.markup/100), cfg.RoundDecimals)
+			if userOp.MaxPriorityFeePerGas != wantTip || userOp.MaxPriorityFeePerGas <= direct.MaxPriorityFeePerGas {
+				t.Fatalf("markup %v, level %s: tip %v marked up from %v, want %v", test.markup, level, userOp.MaxPriorityFeePerGas, direct.MaxPriorityFeePerGas, wantTip)
+			}
+			// the max fee is raised by as much as the tip
+			if raised, marked := userOp.MaxFeePerGas-direct.MaxFeePerGas, userOp.MaxPriorityFeePerGas-direct.MaxPriorityFeePerGas; math.Abs(raised-marked) > 1e-9 {
+				t.Fatalf("markup %v, level %s: max fee raised by %v, tip by %v", test.markup, level, raised, marked)
+			}
+		}
+	}
+
+	// the markup stays within the max fee cap
+	instant := base.EstimatedGasFees["instant"]
+	capped, err := SuggestUserOpGasFees(ctx, nil, history, UserOpOptions{Request: &RequestOptions{MaxFeeGwei: instant.MaxFeePerGas}})
+	if err != nil {
+		t.Fatalf("failed to suggest capped user op fees: %v", err)
+	}
+	if fee := capped.EstimatedGasFees["instant"]; !fee.Capped || fee.MaxFeePerGas != instant.MaxFeePerGas || fee.MaxPriorityFeePerGas > fee.MaxFeePerGas {
+		t.Fatalf("instant level not capped: %+v", fee)
+	}
+
+	for _, markup := range []float64{-1, math.NaN(), math.Inf(1)} {
+		var calls int
+		if _, err := SuggestUserOpGasFees(ctx, nil, countedFeeHistory(history, &calls), UserOpOptions{BundlerTipMarkupPercent: markup}); !errors.Is(err, ErrInvalidRequestOptions) || calls != 0 {
+			t.Fatalf("markup %v: expected ErrInvalidRequestOptions without querying, have %v after %d calls", markup, err, calls)
+		}
+	}
+}
+
+func TestSuggestUserOpGasFeesVolatile(t *testing.T) {
+	cfg := DefaultChainGasConfig()
+	// the base fee swings between 10 and 14 gwei from block to block
+	volatile := func(ctx context.Context, blocks uint64, lastBlock *rpc.BlockNumber, rewardPercentiles []float64) (*big.Int, [][]*big.Int, []*big.Int, []float64, error) {
+		oldest, rewards, baseFees, ratios, err := feeHistoryOf(int(blocks)+1, len(rewardPercentiles))(ctx, blocks, lastBlock, rewardPercentiles)
+		for i := 0; i < int(blocks); i += 2 {
+			baseFees[i] = big.NewInt(14_000_000_000)
+		}
+		return oldest, rewards, baseFees, ratios, err
+	}
+	fees, err := SuggestUserOpGasFeesWithConfig(context.Background(), cfg, nil, volatile, UserOpOptions{})
+	if err != nil {
+		t.Fatalf("failed to suggest user op fees: %v", err)
+	}
+	if fees.Suggested.Trend != TrendVolatile || fees.BaseFeeVolatility <= 0 {
+		t.Fatalf("base fee not volatile: trend %s, volatility %v", fees.Suggested.Trend, fees.BaseFeeVolatility)
+	}
+	want := math.Min(roundFeeAbove(1+fees.BaseFeeVolatility, 1, 2), MaxPreVerificationGasFactor)
+	if fees.PreVerificationGasFactor != want || want <= 1 {
+		t.Fatalf("preVerificationGas factor %v, want %v above 1", fees.PreVerificationGasFactor, want)
+	}
+}
@@ -0,0 +1,172 @@
+// Package tokendecode extracts token and native transfers from transaction traces.
+package tokendecode
+
+import (
+	"bytes"
+	"math/big"
+
+	"github.com/DeBankDeFi/etherlib/pkg/txtracev2"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	StandardNative = "native"
+	StandardERC20  = "erc20"
+	StandardERC721 = "erc721"
+)
+
+const (
+	selectorSize = 4
+	wordSize     = 32
+
+	traceTypeCall    = "call"
+	traceTypeCreate  = "create"
+	traceTypeSuicide = "suicide"
+)
+
+var (
+	transferSelector             = []byte{0xa9, 0x05, 0x9c, 0xbb} // transfer(address,uint256)
+	transferFromSelector         = []byte{0x23, 0xb8, 0x72, 0xdd} // transferFrom(address,address,uint256)
+	safeTransferFromSelector     = []byte{0x42, 0x84, 0x2e, 0x0e} // safeTransferFrom(address,address,uint256)
+	safeTransferFromDataSelector = []byte{0xb8, 0x8d, 0x4f, 0xde} // safeTransferFrom(address,address,uint256,bytes)
+)
+
+// TokenTransfer is a single movement of native coin, fungible tokens or an NFT.
+type TokenTransfer struct {
+	Token        *common.Address `json:"token"` // nil for native
+	From         common.Address  `json:"from"`
+	To           common.Address  `json:"to"`
+	AmountOrID   *big.Int        `json:"amountOrId"`
+	TraceAddress []uint32        `json:"traceAddress"`
+	Standard     string          `json:"standard"`
+}
+
+// DecodeTokenTransfers decodes the transfers of a tx from its flat trace list. Frames inside
+// failed sub-trees are skipped, see txtracev2.RevertedTraces. transferFrom is shared by ERC-20
+// and ERC-721 and is reported as ERC-20 since traces can't tell them apart.
+func DecodeTokenTransfers(traces []txtracev2.RpcActionTrace) []TokenTransfer {
+	frames := make(map[string]*txtracev2.RpcActionTrace, len(traces))
+	reverted := txtracev2.RevertedTraces(traces)
+	transfers := make([]TokenTransfer, 0)
+	for i := range traces {
+		trace := &traces[i]
+		frames[traceKey(trace.TraceAddress)] = trace
+		if reverted[i] {
+			continue
+		}
+		var parent *txtracev2.RpcActionTrace
+		if len(trace.TraceAddress) > 0 {
+			parent = frames[traceKey(trace.TraceAddress[:len(trace.TraceAddress)-1])]
+		}
+		if native := decodeNative(trace); native != nil {
+			transfers = append(transfers, *native)
+		}
+		if token := decodeToken(trace, parent); token != nil {
+			transfers = append(transfers, *token)
+		}
+	}
+	return transfers
+}
+
+// decodeNative decodes the value moved by a call, create or selfdestruct frame
+func decodeNative(trace *txtracev2.RpcActionTrace) *TokenTransfer {
+	action := trace.Action
+	transfer := &TokenTransfer{
+		TraceAddress: trace.TraceAddress,
+		Standard:     StandardNative,
+	}
+	switch trace.TraceType {
+	case traceTypeCall:
+		// delegatecall and staticcall move no value, callcode sends it from the caller to itself
+		if action.CallType != nil && (*action.CallType == txtracev2.DelegateCall || *action.CallType == txtracev2.StaticCall || *action.CallType == txtracev2.CallCode) {
+			return nil
+		}
+		if action.Value == nil || action.Value.ToInt().Sign() <= 0 || action.From == nil || action.To == nil {
+			return nil
+		}
+		transfer.From, transfer.To = *action.From, *action.To
+		transfer.AmountOrID = new(big.Int).Set(action.Value.ToInt())
+	case traceTypeCreate:
+		if action.Value == nil || action.Value.ToInt().Sign() <= 0 || action.From == nil || trace.Result == nil || trace.Result.Address == nil {
+			return nil
+		}
+		transfer.From, transfer.To = *action.From, *trace.Result.Address
+		transfer.AmountOrID = new(big.Int).Set(action.Value.ToInt())
+	case traceTypeSuicide:
+		if action.Balance == nil || action.Balance.ToInt().Sign() <= 0 || action.Address == nil || action.RefundAddress == nil {
+			return nil
+		}
+		transfer.From, transfer.To = *action.Address, *action.RefundAddress
+		transfer.AmountOrID = new(big.Int).Set(action.Balance.ToInt())
+	default:
+		return nil
+	}
+	return transfer
+}
+
+// decodeToken decodes a token transfer from the input of a call frame. A delegatecall runs in the
+// storage context of its caller, so the token is the parent's to and the sender is the parent's
+// sender; a delegatecall forwarding the parent's input is the same transfer and is skipped.
+func decodeToken(trace *txtracev2.RpcActionTrace, parent *txtracev2.RpcActionTrace) *TokenTransfer {
+	action := trace.Action
+	if trace.TraceType != traceTypeCall || action.Input == nil || action.From == nil || action.To == nil {
+		return nil
+	}
+	token, sender := *action.To, *action.From
+	if action.CallType != nil && *action.CallType == txtracev2.DelegateCall {
+		if parent == nil || parent.Action.To == nil || parent.Action.From == nil {
+			return nil
+		}
+		if parent.Action.Input != nil && bytes.Equal(*parent.Action.Input, *action.Input) {
+			return nil
+		}
+		token, sender = *parent.Action.To, *parent.Action.From
+	}
+
+	input := []byte(*action.Input)
+	if len(input) < selectorSize {
+		return nil
+	}
+	selector, args := input[:selectorSize], input[selectorSize:]
+	transfer := &TokenTransfer{
+		Token:        &token,
+		TraceAddress: trace.TraceAddress,
+	}
+	switch {
+	case bytes.Equal(selector, transferSelector) && len(args) >= 2*wordSize:
+		transfer.From, transfer.To = sender, wordAddress(args, 0)
+		transfer.AmountOrID = new(big.Int).SetBytes(word(args, 1))
+		transfer.Standard = StandardERC20
+	case bytes.Equal(selector, transferFromSelector) && len(args) >= 3*wordSize:
+		transfer.From, transfer.To = wordAddress(args, 0), wordAddress(args, 1)
+		transfer.AmountOrID = new(big.Int).SetBytes(word(args, 2))
+		transfer.Standard = StandardERC20
+	case bytes.Equal(selector, safeTransferFromSelector) && len(args) >= 3*wordSize,
+		bytes.Equal(selector, safeTransferFromDataSelector) && len(args) >= 4*wordSize:
+		transfer.From, transfer.To = wordAddress(args, 0), wordAddress(args, 1)
+		transfer.AmountOrID = new(big.Int).SetBytes(word(args, 2))
+		transfer.Standard = StandardERC721
+	default:
+		return nil
+	}
+	return transfer
+}
+
+// word returns the i-th abi word of args
+func word(args []byte, i int) []byte {
+	return args[i*wordSize : (i+1)*wordSize]
+}
+
+// wordAddress returns the i-th abi word of args as address
+func wordAddress(args []byte, i int) common.Address {
+	return common.BytesToAddress(word(args, i))
+}
+
+// traceKey returns a map key of the trace address
+func traceKey(traceAddress []uint32) string {
+	key := make([]byte, 0, 4*len(traceAddress))
+	for _, idx := range traceAddress {
+		key = append(key, byte(idx>>24), byte(idx>>16), byte(idx>>8), byte(idx))
+	}
+	return string(key)
+}
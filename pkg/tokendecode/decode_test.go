@@ -0,0 +1,103 @@
+package tokendecode
+
+import (
+	"encoding/json"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/DeBankDeFi/etherlib/pkg/txtracev2"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+)
+
+var (
+	user   = common.HexToAddress("0x1111111111111111111111111111111111111111")
+	router = common.HexToAddress("0x2222222222222222222222222222222222222222")
+	pair1  = common.HexToAddress("0x3333333333333333333333333333333333333333")
+	pair2  = common.HexToAddress("0x4444444444444444444444444444444444444444")
+	tokenA = common.HexToAddress("0xaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	tokenB = common.HexToAddress("0xbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb")
+	tokenC = common.HexToAddress("0xcccccccccccccccccccccccccccccccccccccccc")
+	implC  = common.HexToAddress("0xc0c0c0c0c0c0c0c0c0c0c0c0c0c0c0c0c0c0c0c0")
+	nft    = common.HexToAddress("0xdddddddddddddddddddddddddddddddddddddddd")
+	wallet = common.HexToAddress("0x5555555555555555555555555555555555555555")
+	lib    = common.HexToAddress("0x6666666666666666666666666666666666666666")
+)
+
+func calldata(selector []byte, args ...interface{}) *hexutil.Bytes {
+	data := append([]byte{}, selector...)
+	for _, arg := range args {
+		switch arg := arg.(type) {
+		case common.Address:
+			data = append(data, common.LeftPadBytes(arg.Bytes(), 32)...)
+		case int64:
+			data = append(data, math.U256Bytes(big.NewInt(arg))...)
+		}
+	}
+	input := hexutil.Bytes(data)
+	return &input
+}
+
+func callTrace(callType string, from, to common.Address, value int64, input *hexutil.Bytes, errMsg string, traceAddress ...uint32) txtracev2.RpcActionTrace {
+	ct := callType
+	trace := txtracev2.RpcActionTrace{
+		Action: txtracev2.Action{
+			CallType: &ct,
+			From:     &from,
+			To:       &to,
+			Value:    (*hexutil.Big)(big.NewInt(value)),
+			Input:    input,
+		},
+		Error:        errMsg,
+		TraceAddress: append([]uint32{}, traceAddress...),
+		TraceType:    "call",
+	}
+	if errMsg == "" {
+		trace.Result = &txtracev2.ActionResult{}
+	}
+	return trace
+}
+
+func TestDecodeTokenTransfers(t *testing.T) {
+	swap := calldata([]byte{0x02, 0x2c, 0x0d, 0x9f}, int64(1))
+	forwarded := calldata(transferSelector, router, int64(70))
+	traces := []txtracev2.RpcActionTrace{
+		callTrace(txtracev2.Call, user, router, 0, calldata([]byte{0x12, 0x34, 0x56, 0x78}), ""),
+		callTrace(txtracev2.Call, router, tokenA, 0, calldata(transferFromSelector, user, pair1, int64(100)), "", 0),
+		// the first leg reverts, its transfer must be dropped
+		callTrace(txtracev2.Call, router, pair1, 0, swap, "execution reverted", 1),
+		callTrace(txtracev2.Call, pair1, tokenB, 0, calldata(transferSelector, router, int64(50)), "", 1, 0),
+		// the second leg pays out through a proxied token
+		callTrace(txtracev2.Call, router, pair2, 0, swap, "", 2),
+		callTrace(txtracev2.Call, pair2, tokenC, 0, forwarded, "", 2, 0),
+		callTrace(txtracev2.DelegateCall, tokenC, implC, 0, forwarded, "", 2, 0, 0),
+		callTrace(txtracev2.Call, router, user, 1000, nil, "", 3),
+		callTrace(txtracev2.Call, router, nft, 0, calldata(safeTransferFromSelector, router, user, int64(7)), "", 4),
+		// a library transfer running in the storage of the wallet
+		callTrace(txtracev2.Call, router, wallet, 0, calldata([]byte{0xb6, 0x1d, 0x27, 0xf6}), "", 5),
+		callTrace(txtracev2.DelegateCall, wallet, lib, 0, calldata(transferSelector, user, int64(5)), "", 5, 0),
+		callTrace(txtracev2.StaticCall, router, tokenA, 0, calldata([]byte{0x70, 0xa0, 0x82, 0x31}, user), "", 6),
+		// the value of a callcode stays with the router, to is the code address
+		callTrace(txtracev2.CallCode, router, lib, 300, nil, "", 7),
+	}
+	// rolled back below a failed frame filtered out of the list
+	rolledBack := callTrace(txtracev2.Call, router, tokenB, 0, calldata(transferSelector, user, int64(9)), "", 8, 0)
+	rolledBack.RolledBack = true
+	traces = append(traces, rolledBack)
+
+	want := []TokenTransfer{
+		{Token: &tokenA, From: user, To: pair1, AmountOrID: big.NewInt(100), TraceAddress: []uint32{0}, Standard: StandardERC20},
+		{Token: &tokenC, From: pair2, To: router, AmountOrID: big.NewInt(70), TraceAddress: []uint32{2, 0}, Standard: StandardERC20},
+		{From: router, To: user, AmountOrID: big.NewInt(1000), TraceAddress: []uint32{3}, Standard: StandardNative},
+		{Token: &nft, From: router, To: user, AmountOrID: big.NewInt(7), TraceAddress: []uint32{4}, Standard: StandardERC721},
+		{Token: &wallet, From: router, To: user, AmountOrID: big.NewInt(5), TraceAddress: []uint32{5, 0}, Standard: StandardERC20},
+	}
+	have := DecodeTokenTransfers(traces)
+	if !reflect.DeepEqual(have, want) {
+		x, _ := json.Marshal(have)
+		y, _ := json.Marshal(want)
+		t.Fatalf("transfers mismatch: \nhave %s\nwant %s", x, y)
+	}
+}
@@ -0,0 +1,183 @@
+// Package traceenrich annotates the call frames of transaction traces with their decoded function
+// signature and, when the ABI of the callee is known, their decoded params.
+package traceenrich
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/DeBankDeFi/etherlib/pkg/txtracev2"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+const (
+	selectorSize  = 4
+	traceTypeCall = "call"
+)
+
+var addressType = reflect.TypeOf(common.Address{})
+
+// EnrichedTrace is a trace along with the decoded method of its calldata. Method and DecodedParams
+// are omitted when they couldn't be resolved.
+type EnrichedTrace struct {
+	txtracev2.RpcActionTrace
+	Method        string          `json:"method,omitempty"`
+	DecodedParams json.RawMessage `json:"decodedParams,omitempty"`
+}
+
+// enrichment holds the fields EnrichedTrace adds to the trace
+type enrichment struct {
+	Method        string          `json:"method,omitempty"`
+	DecodedParams json.RawMessage `json:"decodedParams,omitempty"`
+}
+
+// MarshalJSON appends method and decodedParams to the json of the trace, which would otherwise be
+// dropped by the promoted MarshalJSON of the embedded trace.
+func (t EnrichedTrace) MarshalJSON() ([]byte, error) {
+	trace, err := json.Marshal(t.RpcActionTrace)
+	if err != nil {
+		return nil, err
+	}
+	extra, err := json.Marshal(enrichment{Method: t.Method, DecodedParams: t.DecodedParams})
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(extra, []byte("{}")) {
+		return trace, nil
+	}
+	out := append(trace[:len(trace)-1:len(trace)-1], ',')
+	return append(out, extra[1:]...), nil
+}
+
+func (t *EnrichedTrace) UnmarshalJSON(input []byte) error {
+	var extra enrichment
+	if err := json.Unmarshal(input, &t.RpcActionTrace); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(input, &extra); err != nil {
+		return err
+	}
+	t.Method, t.DecodedParams = extra.Method, extra.DecodedParams
+	return nil
+}
+
+// EnrichTraces resolves the selector of every call frame with resolver. The params are decoded when
+// resolver is also an ABIResolver knowing the callee, the signature of its method then takes precedence.
+// Failed resolutions leave the frame unannotated, traces are left untouched.
+func EnrichTraces(ctx context.Context, traces []txtracev2.RpcActionTrace, resolver SignatureResolver) []EnrichedTrace {
+	enriched := make([]EnrichedTrace, len(traces))
+	selectors := make([][4]byte, 0, len(traces))
+	for i := range traces {
+		enriched[i].RpcActionTrace = traces[i]
+		if selector, ok := callSelector(&traces[i]); ok {
+			selectors = append(selectors, selector)
+		}
+	}
+	if len(selectors) == 0 || resolver == nil {
+		return enriched
+	}
+
+	sigs := resolveAll(ctx, resolver, selectors)
+	abiResolver, _ := resolver.(ABIResolver)
+	for i := range enriched {
+		trace := &enriched[i]
+		selector, ok := callSelector(&trace.RpcActionTrace)
+		if !ok {
+			continue
+		}
+		trace.Method = sigs[selector]
+		if abiResolver == nil || trace.Action.To == nil {
+			continue
+		}
+		method, err := abiResolver.ResolveMethod(ctx, *trace.Action.To, selector)
+		if err != nil || method == nil || !bytes.Equal(method.ID, selector[:]) {
+			continue
+		}
+		trace.Method = method.Sig
+		args, err := method.Inputs.Unpack((*trace.Action.Input)[selectorSize:])
+		if err != nil {
+			continue
+		}
+		params := make(map[string]interface{}, len(args))
+		for j, arg := range args {
+			name := method.Inputs[j].Name
+			if name == "" {
+				name = fmt.Sprintf("arg%d", j)
+			}
+			params[name] = jsonValue(reflect.ValueOf(arg))
+		}
+		if decoded, err := json.Marshal(params); err == nil {
+			trace.DecodedParams = decoded
+		}
+	}
+	return enriched
+}
+
+// callSelector returns the selector of the calldata of a call frame
+func callSelector(trace *txtracev2.RpcActionTrace) ([4]byte, bool) {
+	if trace.TraceType != traceTypeCall || trace.Action.Input == nil || len(*trace.Action.Input) < selectorSize {
+		return [4]byte{}, false
+	}
+	return [4]byte((*trace.Action.Input)[:selectorSize]), true
+}
+
+// resolveAll resolves the distinct selectors, in a single batch if the resolver supports it
+func resolveAll(ctx context.Context, resolver SignatureResolver, selectors [][4]byte) map[[4]byte]string {
+	if batch, ok := resolver.(BatchResolver); ok {
+		return batch.ResolveBatch(ctx, selectors)
+	}
+	sigs := make(map[[4]byte]string, len(selectors))
+	tried := make(map[[4]byte]bool, len(selectors))
+	for _, selector := range selectors {
+		if tried[selector] {
+			continue
+		}
+		tried[selector] = true
+		if sig, err := resolver.Resolve(ctx, selector); err == nil {
+			sigs[selector] = sig
+		}
+	}
+	return sigs
+}
+
+// jsonValue converts the byte slices and arrays of an unpacked abi value to hexutil.Bytes, which json
+// would otherwise encode as base64 and number arrays.
+func jsonValue(v reflect.Value) interface{} {
+	switch {
+	case !v.IsValid():
+		return nil
+	case v.Type() == addressType:
+		return v.Interface()
+	case (v.Kind() == reflect.Slice || v.Kind() == reflect.Array) && v.Type().Elem().Kind() == reflect.Uint8:
+		data := make(hexutil.Bytes, v.Len())
+		reflect.Copy(reflect.ValueOf(data), v)
+		return data
+	case v.Kind() == reflect.Slice || v.Kind() == reflect.Array:
+		items := make([]interface{}, v.Len())
+		for i := range items {
+			items[i] = jsonValue(v.Index(i))
+		}
+		return items
+	case v.Kind() == reflect.Struct:
+		// tuples are unpacked into structs tagged with the abi names of their components
+		fields := make(map[string]interface{}, v.NumField())
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name := field.Name
+			if tag := field.Tag.Get("json"); tag != "" {
+				name = tag
+			}
+			fields[name] = jsonValue(v.Field(i))
+		}
+		return fields
+	default:
+		return v.Interface()
+	}
+}
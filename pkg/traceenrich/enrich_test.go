@@ -0,0 +1,243 @@
+package traceenrich
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DeBankDeFi/etherlib/pkg/txtracev2"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+var (
+	user  = common.HexToAddress("0x1111111111111111111111111111111111111111")
+	token = common.HexToAddress("0xaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+
+	transferSelector = [4]byte{0xa9, 0x05, 0x9c, 0xbb}
+	unknownSelector  = [4]byte{0xde, 0xad, 0xbe, 0xef}
+)
+
+func callTrace(to common.Address, input []byte, traceAddress ...uint32) txtracev2.RpcActionTrace {
+	callType := "call"
+	data := hexutil.Bytes(input)
+	return txtracev2.RpcActionTrace{
+		Action: txtracev2.Action{
+			CallType: &callType,
+			From:     &user,
+			To:       &to,
+			Value:    (*hexutil.Big)(new(big.Int)),
+			Input:    &data,
+		},
+		BlockNumber:  big.NewInt(1),
+		TraceAddress: append([]uint32{}, traceAddress...),
+		TraceType:    "call",
+	}
+}
+
+func transferInput(to common.Address, amount int64) []byte {
+	input := append([]byte{}, transferSelector[:]...)
+	input = append(input, common.LeftPadBytes(to.Bytes(), 32)...)
+	return append(input, math.U256Bytes(big.NewInt(amount))...)
+}
+
+func TestDefaultStaticResolver(t *testing.T) {
+	resolver := DefaultStaticResolver()
+	if len(resolver) < 200 {
+		t.Fatalf("too few embedded signatures: %d", len(resolver))
+	}
+	for selector, sig := range resolver {
+		if want := crypto.Keccak256([]byte(sig))[:4]; string(want) != string(selector[:]) {
+			t.Errorf("selector mismatch for %s: have %x, want %x", sig, selector, want)
+		}
+	}
+	sig, err := resolver.Resolve(context.Background(), transferSelector)
+	if err != nil || sig != "transfer(address,uint256)" {
+		t.Fatalf("transfer resolution mismatch: have %q, %v", sig, err)
+	}
+	if _, err := resolver.Resolve(context.Background(), unknownSelector); !errors.Is(err, ErrUnknownSelector) {
+		t.Fatalf("unknown selector error mismatch: have %v, want %v", err, ErrUnknownSelector)
+	}
+}
+
+func TestCachedResolver(t *testing.T) {
+	var (
+		calls     = make(map[[4]byte]int)
+		transient = errors.New("rate limited")
+		failing   = true
+	)
+	resolver := NewCachedResolver(func(ctx context.Context, selector [4]byte) (string, error) {
+		calls[selector]++
+		switch selector {
+		case transferSelector:
+			return "transfer(address,uint256)", nil
+		case unknownSelector:
+			return "", ErrUnknownSelector
+		}
+		if failing {
+			return "", transient
+		}
+		return "balanceOf(address)", nil
+	}, 2, 1)
+
+	for i := 0; i < 3; i++ {
+		if sig, err := resolver.Resolve(context.Background(), transferSelector); err != nil || sig != "transfer(address,uint256)" {
+			t.Fatalf("transfer resolution mismatch: have %q, %v", sig, err)
+		}
+		if _, err := resolver.Resolve(context.Background(), unknownSelector); !errors.Is(err, ErrUnknownSelector) {
+			t.Fatalf("unknown selector error mismatch: have %v, want %v", err, ErrUnknownSelector)
+		}
+	}
+	if calls[transferSelector] != 1 || calls[unknownSelector] != 1 {
+		t.Fatalf("lookups not cached: %v", calls)
+	}
+
+	// transient errors are retried on the next resolution, evicting the least recently used selector
+	other := [4]byte{0x70, 0xa0, 0x82, 0x31}
+	if _, err := resolver.Resolve(context.Background(), other); !errors.Is(err, transient) {
+		t.Fatalf("transient error mismatch: have %v, want %v", err, transient)
+	}
+	failing = false
+	if sig, err := resolver.Resolve(context.Background(), other); err != nil || sig != "balanceOf(address)" {
+		t.Fatalf("retried resolution mismatch: have %q, %v", sig, err)
+	}
+	if calls[other] != 2 {
+		t.Fatalf("transient error cached: %d lookups", calls[other])
+	}
+	resolver.Resolve(context.Background(), transferSelector)
+	if calls[transferSelector] != 2 {
+		t.Fatalf("evicted selector still cached: %d lookups", calls[transferSelector])
+	}
+}
+
+func TestResolveBatchConcurrency(t *testing.T) {
+	var inflight, peak, calls int32
+	resolver := NewCachedResolver(func(ctx context.Context, selector [4]byte) (string, error) {
+		atomic.AddInt32(&calls, 1)
+		n := atomic.AddInt32(&inflight, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&inflight, -1)
+		if selector[0]%2 == 1 {
+			return "", ErrUnknownSelector
+		}
+		return hexutil.Encode(selector[:]), nil
+	}, 0, 3)
+
+	selectors := make([][4]byte, 0, 40)
+	for i := 0; i < 20; i++ {
+		selectors = append(selectors, [4]byte{byte(i)}, [4]byte{byte(i)})
+	}
+	sigs := resolver.ResolveBatch(context.Background(), selectors)
+	if calls != 20 {
+		t.Fatalf("duplicate selectors resolved: %d lookups", calls)
+	}
+	if peak > 3 {
+		t.Fatalf("concurrency limit exceeded: %d lookups in flight", peak)
+	}
+	if len(sigs) != 10 || sigs[[4]byte{2}] != "0x02000000" {
+		t.Fatalf("batch result mismatch: %v", sigs)
+	}
+}
+
+func TestEnrichTraces(t *testing.T) {
+	create := txtracev2.RpcActionTrace{TraceType: "create", BlockNumber: big.NewInt(1), TraceAddress: []uint32{2}}
+	traces := []txtracev2.RpcActionTrace{
+		callTrace(token, unknownSelector[:]),
+		callTrace(token, transferInput(user, 1000), 0),
+		callTrace(user, []byte{0xa9, 0x05}, 1),
+		create,
+	}
+	enriched := EnrichTraces(context.Background(), traces, DefaultStaticResolver())
+	if len(enriched) != len(traces) {
+		t.Fatalf("enriched trace count mismatch: have %d, want %d", len(enriched), len(traces))
+	}
+	for i, want := range []string{"", "transfer(address,uint256)", "", ""} {
+		if enriched[i].Method != want || enriched[i].DecodedParams != nil {
+			t.Errorf("trace %d enrichment mismatch: have %q %s, want %q", i, enriched[i].Method, enriched[i].DecodedParams, want)
+		}
+	}
+
+	blob, err := json.Marshal(enriched[1])
+	if err != nil {
+		t.Fatalf("failed to marshal enriched trace: %v", err)
+	}
+	if !strings.Contains(string(blob), `"blockNumber":1`) || !strings.HasSuffix(string(blob), `,"method":"transfer(address,uint256)"}`) {
+		t.Fatalf("enriched trace json mismatch: %s", blob)
+	}
+	var decoded EnrichedTrace
+	if err := json.Unmarshal(blob, &decoded); err != nil {
+		t.Fatalf("failed to unmarshal enriched trace: %v", err)
+	}
+	if decoded.Method != enriched[1].Method || decoded.TraceAddress[0] != 0 {
+		t.Fatalf("enriched trace json roundtrip mismatch: %+v", decoded)
+	}
+	blob, err = json.Marshal(enriched[0])
+	if err != nil {
+		t.Fatalf("failed to marshal enriched trace: %v", err)
+	}
+	if strings.Contains(string(blob), "method") || strings.Contains(string(blob), "decodedParams") {
+		t.Fatalf("unresolved trace json has enrichment: %s", blob)
+	}
+}
+
+// abiResolver knows the ABI of a single contract
+type abiResolver struct {
+	StaticResolver
+	contract common.Address
+	abi      abi.ABI
+}
+
+func (r *abiResolver) ResolveMethod(ctx context.Context, contract common.Address, selector [4]byte) (*abi.Method, error) {
+	if contract != r.contract {
+		return nil, nil
+	}
+	return r.abi.MethodById(selector[:])
+}
+
+func TestEnrichTracesABI(t *testing.T) {
+	erc20, err := abi.JSON(strings.NewReader(`[{"type":"function","name":"transfer","inputs":[{"name":"to","type":"address"},{"name":"amount","type":"uint256"}],"outputs":[{"name":"","type":"bool"}]}]`))
+	if err != nil {
+		t.Fatalf("failed to parse abi: %v", err)
+	}
+	resolver := &abiResolver{StaticResolver: DefaultStaticResolver(), contract: token, abi: erc20}
+	traces := []txtracev2.RpcActionTrace{
+		callTrace(token, transferInput(user, 1000)),
+		callTrace(user, transferInput(token, 5), 0),         // no abi, signature only
+		callTrace(token, transferInput(user, 1000)[:20], 1), // truncated params
+		callTrace(token, unknownSelector[:], 2),
+	}
+	enriched := EnrichTraces(context.Background(), traces, resolver)
+
+	if want := `{"amount":1000,"to":"0x1111111111111111111111111111111111111111"}`; string(enriched[0].DecodedParams) != want {
+		t.Fatalf("decoded params mismatch: have %s, want %s", enriched[0].DecodedParams, want)
+	}
+	for i, want := range []string{"transfer(address,uint256)", "transfer(address,uint256)", "transfer(address,uint256)", ""} {
+		if enriched[i].Method != want {
+			t.Errorf("trace %d method mismatch: have %q, want %q", i, enriched[i].Method, want)
+		}
+		if i > 0 && enriched[i].DecodedParams != nil {
+			t.Errorf("trace %d has decoded params: %s", i, enriched[i].DecodedParams)
+		}
+	}
+	blob, err := json.Marshal(enriched[0])
+	if err != nil {
+		t.Fatalf("failed to marshal enriched trace: %v", err)
+	}
+	if !strings.HasSuffix(string(blob), `,"method":"transfer(address,uint256)","decodedParams":{"amount":1000,"to":"0x1111111111111111111111111111111111111111"}}`) {
+		t.Fatalf("enriched trace json mismatch: %s", blob)
+	}
+}
@@ -0,0 +1,166 @@
+package traceenrich
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/lru"
+)
+
+// ErrUnknownSelector is returned by resolvers which have no signature for a selector.
+var ErrUnknownSelector = errors.New("unknown selector")
+
+// SignatureResolver maps a 4-byte function selector to its text signature, e.g. "transfer(address,uint256)".
+type SignatureResolver interface {
+	Resolve(ctx context.Context, selector [4]byte) (string, error)
+}
+
+// BatchResolver is implemented by resolvers which resolve many selectors at once more efficiently than
+// one by one. Selectors which failed to resolve are absent from the result.
+type BatchResolver interface {
+	ResolveBatch(ctx context.Context, selectors [][4]byte) map[[4]byte]string
+}
+
+// ABIResolver is optionally implemented by a SignatureResolver which knows the full ABI of contracts,
+// which lets EnrichTraces decode the call params. A nil method means the ABI is unknown.
+type ABIResolver interface {
+	ResolveMethod(ctx context.Context, contract common.Address, selector [4]byte) (*abi.Method, error)
+}
+
+//go:embed signatures.json
+var signaturesJSON []byte
+
+// StaticResolver resolves selectors from a fixed map.
+type StaticResolver map[[4]byte]string
+
+// NewStaticResolver creates a StaticResolver from a map of hex encoded selectors to signatures.
+func NewStaticResolver(signatures map[string]string) (StaticResolver, error) {
+	resolver := make(StaticResolver, len(signatures))
+	for hex, sig := range signatures {
+		selector, err := hexutil.Decode(hex)
+		if err != nil || len(selector) != 4 {
+			return nil, fmt.Errorf("invalid selector %q for %s", hex, sig)
+		}
+		resolver[[4]byte(selector)] = sig
+	}
+	return resolver, nil
+}
+
+var (
+	defaultStatic     StaticResolver
+	defaultStaticOnce sync.Once
+)
+
+// DefaultStaticResolver returns the resolver of the embedded signatures of well-known ERC standards,
+// dex routers, lending markets and bridges. It's shared, callers must not modify it.
+func DefaultStaticResolver() StaticResolver {
+	defaultStaticOnce.Do(func() {
+		var signatures map[string]string
+		if err := json.Unmarshal(signaturesJSON, &signatures); err != nil {
+			panic(fmt.Sprintf("invalid embedded signatures: %v", err))
+		}
+		resolver, err := NewStaticResolver(signatures)
+		if err != nil {
+			panic(fmt.Sprintf("invalid embedded signatures: %v", err))
+		}
+		defaultStatic = resolver
+	})
+	return defaultStatic
+}
+
+func (r StaticResolver) Resolve(_ context.Context, selector [4]byte) (string, error) {
+	if sig, ok := r[selector]; ok {
+		return sig, nil
+	}
+	return "", ErrUnknownSelector
+}
+
+// LookupFunc resolves a selector from an external source like 4byte.directory or a database. It returns
+// ErrUnknownSelector when the source has no signature, any other error is considered transient.
+type LookupFunc func(ctx context.Context, selector [4]byte) (string, error)
+
+// CachedResolver wraps a LookupFunc with an LRU cache of both known and unknown selectors, transient
+// errors aren't cached. At most concurrency lookups run at the same time.
+type CachedResolver struct {
+	lookup LookupFunc
+	cache  *lru.Cache[[4]byte, string] // "" for unknown selectors
+	sem    chan struct{}
+}
+
+// NewCachedResolver creates a CachedResolver caching size selectors, size and concurrency default to
+// 4096 and 8 when not positive.
+func NewCachedResolver(lookup LookupFunc, size int, concurrency int) *CachedResolver {
+	if size <= 0 {
+		size = 4096
+	}
+	if concurrency <= 0 {
+		concurrency = 8
+	}
+	return &CachedResolver{
+		lookup: lookup,
+		cache:  lru.NewCache[[4]byte, string](size),
+		sem:    make(chan struct{}, concurrency),
+	}
+}
+
+func (r *CachedResolver) Resolve(ctx context.Context, selector [4]byte) (string, error) {
+	if sig, ok := r.cache.Get(selector); ok {
+		if sig == "" {
+			return "", ErrUnknownSelector
+		}
+		return sig, nil
+	}
+	select {
+	case r.sem <- struct{}{}:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	sig, err := r.lookup(ctx, selector)
+	<-r.sem
+	switch {
+	case err == nil && sig != "":
+		r.cache.Add(selector, sig)
+		return sig, nil
+	case err == nil || errors.Is(err, ErrUnknownSelector):
+		r.cache.Add(selector, "")
+		return "", ErrUnknownSelector
+	default:
+		return "", err
+	}
+}
+
+// ResolveBatch resolves the distinct selectors concurrently, bounded by the concurrency of the resolver.
+func (r *CachedResolver) ResolveBatch(ctx context.Context, selectors [][4]byte) map[[4]byte]string {
+	var (
+		sigs = make(map[[4]byte]string, len(selectors))
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		seen = make(map[[4]byte]bool, len(selectors))
+	)
+	for _, selector := range selectors {
+		if seen[selector] {
+			continue
+		}
+		seen[selector] = true
+		wg.Add(1)
+		go func(selector [4]byte) {
+			defer wg.Done()
+			sig, err := r.Resolve(ctx, selector)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			sigs[selector] = sig
+			mu.Unlock()
+		}(selector)
+	}
+	wg.Wait()
+	return sigs
+}
@@ -0,0 +1,281 @@
+// Package tracerender renders the call graph of transaction traces as Graphviz DOT or Mermaid, e.g. for
+// incident write-ups.
+package tracerender
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/DeBankDeFi/etherlib/pkg/txtracev2"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+const (
+	traceTypeCall    = "call"
+	traceTypeCreate  = "create"
+	traceTypeSuicide = "suicide"
+)
+
+// ErrUnknownFormat is returned for graph formats RenderCallGraph doesn't support.
+var ErrUnknownFormat = errors.New("unknown graph format")
+
+// GraphFormat is the output format of RenderCallGraph.
+type GraphFormat int
+
+const (
+	GraphFormatDOT GraphFormat = iota
+	GraphFormatMermaid
+)
+
+func (f GraphFormat) String() string {
+	switch f {
+	case GraphFormatDOT:
+		return "dot"
+	case GraphFormatMermaid:
+		return "mermaid"
+	default:
+		return fmt.Sprintf("GraphFormat(%d)", int(f))
+	}
+}
+
+// RenderOptions configures RenderCallGraph, the zero value renders every frame but the precompile calls.
+type RenderOptions struct {
+	// Label names known contracts, the address is shown when it's nil or returns an empty name.
+	Label func(common.Address) string
+	// CollapseRepeated merges the identical edges between two nodes into one with their count.
+	CollapseRepeated bool
+	// MaxDepth leaves out the frames nested deeper than MaxDepth below the top-level one, 0 for no limit.
+	MaxDepth int
+	// IncludePrecompiles renders the calls to the precompiled contracts.
+	IncludePrecompiles bool
+}
+
+// precompiles are the addresses of the precompiled contracts up to Cancun
+var precompiles = func() map[common.Address]bool {
+	set := make(map[common.Address]bool, len(vm.PrecompiledAddressesCancun))
+	for _, addr := range vm.PrecompiledAddressesCancun {
+		set[addr] = true
+	}
+	return set
+}()
+
+// node is an account of the graph
+type node struct {
+	id    string
+	label string
+}
+
+// edge is a frame of the trace, or identical frames when collapsed
+type edge struct {
+	from, to *node
+	lines    []string // label lines
+	failed   bool
+	count    int
+}
+
+// key identifies identical edges
+func (e *edge) key() string {
+	return fmt.Sprintf("%s>%s|%s|%v", e.from.id, e.to.id, strings.Join(e.lines, "|"), e.failed)
+}
+
+// graph is the call graph in a deterministic order, nodes and edges by first appearance in trace order
+type graph struct {
+	nodes []*node
+	edges []*edge
+	byKey map[string]*node
+}
+
+// node returns the node keyed by key, adding it with the given label first
+func (g *graph) node(key, label string) *node {
+	if n, ok := g.byKey[key]; ok {
+		return n
+	}
+	n := &node{id: fmt.Sprintf("n%d", len(g.nodes)), label: label}
+	g.byKey[key] = n
+	g.nodes = append(g.nodes, n)
+	return n
+}
+
+// RenderCallGraph renders the call graph of the traces of a tx. Nodes are the accounts taking part and edges
+// the frames in trace order, labeled with the call type, or "deploys" for creates, the value in ether unless
+// zero and the gas used. Reverted frames, the failed ones and the ones below them, are drawn dashed and red.
+// The output only depends on the traces and the options, not on the order of the traces, so renderings of
+// the same tx diff cleanly.
+func RenderCallGraph(traces []txtracev2.RpcActionTrace, format GraphFormat, opts RenderOptions) ([]byte, error) {
+	if format != GraphFormatDOT && format != GraphFormatMermaid {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownFormat, format)
+	}
+	g := buildGraph(traces, opts)
+	if format == GraphFormatDOT {
+		return renderDOT(g), nil
+	}
+	return renderMermaid(g), nil
+}
+
+func buildGraph(traces []txtracev2.RpcActionTrace, opts RenderOptions) *graph {
+	sorted := make([]*txtracev2.RpcActionTrace, len(traces))
+	for i := range traces {
+		sorted[i] = &traces[i]
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return lessTraceAddress(sorted[i].TraceAddress, sorted[j].TraceAddress)
+	})
+
+	g := &graph{byKey: make(map[string]*node)}
+	account := func(addr common.Address) *node {
+		label := addr.Hex()
+		if opts.Label != nil {
+			if name := opts.Label(addr); name != "" {
+				label = name
+			}
+		}
+		return g.node(addr.Hex(), label)
+	}
+	collapsed := make(map[string]*edge)
+	reverted := make(map[string]bool) // by trace address, the frames failed themselves or below a failed one
+	for _, trace := range sorted {
+		failed := trace.Error != "" || trace.RolledBack
+		if n := len(trace.TraceAddress); n > 0 && reverted[fmt.Sprint(trace.TraceAddress[:n-1])] {
+			failed = true
+		}
+		reverted[fmt.Sprint(trace.TraceAddress)] = failed
+		if opts.MaxDepth > 0 && len(trace.TraceAddress) > opts.MaxDepth {
+			continue
+		}
+		action := &trace.Action
+		var (
+			from, to *node
+			kind     string
+			value    *big.Int
+		)
+		switch trace.TraceType {
+		case traceTypeCall:
+			if action.From == nil || action.To == nil || (!opts.IncludePrecompiles && precompiles[*action.To]) {
+				continue
+			}
+			from, to, kind = account(*action.From), account(*action.To), traceTypeCall
+			if action.CallType != nil {
+				kind = *action.CallType
+			}
+			value = action.Value.ToInt()
+		case traceTypeCreate:
+			if action.From == nil {
+				continue
+			}
+			from, kind, value = account(*action.From), "deploys", action.Value.ToInt()
+			if trace.Result != nil && trace.Result.Address != nil {
+				to = account(*trace.Result.Address)
+			} else {
+				// failed creates deploy nothing
+				to = g.node("create:"+fmt.Sprint(trace.TraceAddress), "failed create")
+			}
+		case traceTypeSuicide:
+			if action.Address == nil || action.RefundAddress == nil {
+				continue
+			}
+			from, to, kind, value = account(*action.Address), account(*action.RefundAddress), "selfdestruct", action.Balance.ToInt()
+		default:
+			continue
+		}
+		e := &edge{from: from, to: to, lines: []string{kind}, failed: failed, count: 1}
+		if value != nil && value.Sign() != 0 {
+			e.lines = append(e.lines, formatEther(value)+" ETH")
+		}
+		if trace.Result != nil {
+			e.lines = append(e.lines, fmt.Sprintf("gas %d", uint64(trace.Result.GasUsed)))
+		}
+		if opts.CollapseRepeated {
+			if same, ok := collapsed[e.key()]; ok {
+				same.count++
+				continue
+			}
+			collapsed[e.key()] = e
+		}
+		g.edges = append(g.edges, e)
+	}
+	return g
+}
+
+// lessTraceAddress orders trace addresses parents first, then siblings by index
+func lessTraceAddress(x, y []uint32) bool {
+	for i := 0; i < len(x) && i < len(y); i++ {
+		if x[i] != y[i] {
+			return x[i] < y[i]
+		}
+	}
+	return len(x) < len(y)
+}
+
+// formatEther formats wei as ether rounded to 4 decimals
+func formatEther(wei *big.Int) string {
+	ether := new(big.Float).SetPrec(256).SetInt(wei)
+	ether.Quo(ether, new(big.Float).SetPrec(256).SetInt64(params.Ether))
+	return ether.Text('f', 4)
+}
+
+// labelLines returns the label lines of the edge, along with the count of collapsed edges
+func (e *edge) labelLines() []string {
+	if e.count > 1 {
+		return append(append([]string{}, e.lines...), fmt.Sprintf("x%d", e.count))
+	}
+	return e.lines
+}
+
+func renderDOT(g *graph) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("digraph calls {\n")
+	buf.WriteString("  rankdir=LR;\n")
+	buf.WriteString("  node [shape=box, fontname=\"monospace\"];\n")
+	for _, n := range g.nodes {
+		fmt.Fprintf(&buf, "  %s [label=%s];\n", n.id, dotQuote(n.label))
+	}
+	for _, e := range g.edges {
+		fmt.Fprintf(&buf, "  %s -> %s [label=%s", e.from.id, e.to.id, dotQuote(strings.Join(e.labelLines(), "\n")))
+		if e.failed {
+			buf.WriteString(", style=dashed, color=red, fontcolor=red")
+		}
+		buf.WriteString("];\n")
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+// dotQuote quotes s as a DOT string, line breaks become centered DOT line breaks
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + strings.ReplaceAll(s, "\n", `\n`) + `"`
+}
+
+func renderMermaid(g *graph) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("flowchart LR\n")
+	for _, n := range g.nodes {
+		fmt.Fprintf(&buf, "  %s[%s]\n", n.id, mermaidQuote(n.label))
+	}
+	var failed []string
+	for i, e := range g.edges {
+		arrow := "-->"
+		if e.failed {
+			arrow = "-.->"
+			failed = append(failed, fmt.Sprint(i))
+		}
+		fmt.Fprintf(&buf, "  %s %s|%s| %s\n", e.from.id, arrow, mermaidQuote(strings.Join(e.labelLines(), "\n")), e.to.id)
+	}
+	if len(failed) > 0 {
+		fmt.Fprintf(&buf, "  linkStyle %s stroke:red,color:red\n", strings.Join(failed, ","))
+	}
+	return buf.Bytes()
+}
+
+// mermaidQuote quotes s as a Mermaid string, quotes are escaped as entities and line breaks become <br/>
+func mermaidQuote(s string) string {
+	s = strings.ReplaceAll(s, `"`, "#quot;")
+	return `"` + strings.ReplaceAll(s, "\n", "<br/>") + `"`
+}
@@ -0,0 +1,152 @@
+package tracerender
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"math/big"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DeBankDeFi/etherlib/pkg/txtracev2"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+var (
+	user      = common.HexToAddress("0x1111111111111111111111111111111111111111")
+	router    = common.HexToAddress("0x2222222222222222222222222222222222222222")
+	token     = common.HexToAddress("0x3333333333333333333333333333333333333333")
+	vault     = common.HexToAddress("0x4444444444444444444444444444444444444444")
+	deployed  = common.HexToAddress("0x5555555555555555555555555555555555555555")
+	ecrecover = common.BytesToAddress([]byte{0x1})
+)
+
+func callTrace(callType string, from, to common.Address, wei int64, gasUsed uint64, traceAddress ...uint32) txtracev2.RpcActionTrace {
+	return txtracev2.RpcActionTrace{
+		Action: txtracev2.Action{
+			CallType: &callType,
+			From:     &from,
+			To:       &to,
+			Value:    (*hexutil.Big)(big.NewInt(wei)),
+		},
+		Result:       &txtracev2.ActionResult{GasUsed: hexutil.Uint64(gasUsed)},
+		TraceAddress: append([]uint32{}, traceAddress...),
+		TraceType:    traceTypeCall,
+	}
+}
+
+func failed(trace txtracev2.RpcActionTrace) txtracev2.RpcActionTrace {
+	trace.Result, trace.Error = nil, "execution reverted"
+	return trace
+}
+
+// nestedTraces is a swap through a router deploying a helper, whose vault deposit reverts
+func nestedTraces() []txtracev2.RpcActionTrace {
+	oneAndHalf, _ := new(big.Int).SetString("1500000000000000000", 10)
+	root := callTrace("call", user, router, 0, 120_000)
+	root.Action.Value = (*hexutil.Big)(oneAndHalf)
+	create := txtracev2.RpcActionTrace{
+		Action:       txtracev2.Action{From: &router, Value: (*hexutil.Big)(big.NewInt(123_456_789_000_000)), CreateMethod: "create2"},
+		Result:       &txtracev2.ActionResult{GasUsed: 53_000, Address: &deployed},
+		TraceAddress: []uint32{1},
+		TraceType:    traceTypeCreate,
+	}
+	return []txtracev2.RpcActionTrace{
+		root,
+		callTrace("staticcall", router, token, 0, 2_300, 0),
+		create,
+		callTrace("call", deployed, token, 0, 30_000, 1, 0),
+		failed(callTrace("call", router, vault, 0, 0, 2)),
+		callTrace("call", vault, token, 0, 25_000, 2, 0),
+		callTrace("staticcall", router, ecrecover, 0, 3_000, 3),
+		callTrace("staticcall", router, token, 0, 2_300, 4),
+	}
+}
+
+func label(addr common.Address) string {
+	switch addr {
+	case router:
+		return "Router"
+	case token:
+		return `Token "USDC"`
+	}
+	return ""
+}
+
+func TestRenderCallGraphGolden(t *testing.T) {
+	for _, format := range []GraphFormat{GraphFormatDOT, GraphFormatMermaid} {
+		have, err := RenderCallGraph(nestedTraces(), format, RenderOptions{Label: label})
+		if err != nil {
+			t.Fatalf("%v: failed to render: %v", format, err)
+		}
+		golden := filepath.Join("testdata", "nested."+format.String())
+		if *update {
+			if err := os.WriteFile(golden, have, 0o644); err != nil {
+				t.Fatalf("%v: failed to update golden file: %v", format, err)
+			}
+		}
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatalf("%v: failed to read golden file: %v", format, err)
+		}
+		if !bytes.Equal(have, want) {
+			t.Fatalf("%v: rendering mismatch:\nhave\n%s\nwant\n%s", format, have, want)
+		}
+
+		// the order of the traces doesn't matter
+		shuffled := nestedTraces()
+		rand.New(rand.NewSource(1)).Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		if again, _ := RenderCallGraph(shuffled, format, RenderOptions{Label: label}); !bytes.Equal(again, have) {
+			t.Fatalf("%v: rendering depends on the trace order:\n%s", format, again)
+		}
+	}
+}
+
+func TestRenderCallGraphOptions(t *testing.T) {
+	render := func(opts RenderOptions) string {
+		out, err := RenderCallGraph(nestedTraces(), GraphFormatDOT, opts)
+		if err != nil {
+			t.Fatalf("failed to render: %v", err)
+		}
+		return string(out)
+	}
+	staticEdge := `[label="staticcall\ngas 2300"]`
+	if plain := render(RenderOptions{}); strings.Count(plain, staticEdge) != 2 || strings.Contains(plain, ecrecover.Hex()) || !strings.Contains(plain, token.Hex()) {
+		t.Fatalf("default rendering mismatch:\n%s", plain)
+	}
+	if collapsed := render(RenderOptions{CollapseRepeated: true}); strings.Count(collapsed, `[label="staticcall\ngas 2300\nx2"]`) != 1 || strings.Contains(collapsed, staticEdge) {
+		t.Fatalf("collapsed rendering mismatch:\n%s", collapsed)
+	}
+	if precompiles := render(RenderOptions{IncludePrecompiles: true}); !strings.Contains(precompiles, ecrecover.Hex()) {
+		t.Fatalf("precompile rendering mismatch:\n%s", precompiles)
+	}
+	// only the top-level call and its sub calls, the vault's token call and the deployed contract's are left out
+	shallow := render(RenderOptions{MaxDepth: 1})
+	if strings.Count(shallow, "->") != 5 || strings.Contains(shallow, "gas 30000") || strings.Contains(shallow, "gas 25000") {
+		t.Fatalf("depth limited rendering mismatch:\n%s", shallow)
+	}
+
+	if _, err := RenderCallGraph(nestedTraces(), GraphFormat(7), RenderOptions{}); !errors.Is(err, ErrUnknownFormat) {
+		t.Fatalf("unknown format error mismatch: %v", err)
+	}
+}
+
+func TestFormatEther(t *testing.T) {
+	for wei, want := range map[string]string{
+		"1":                     "0.0000",
+		"50000000000000":        "0.0001", // rounded
+		"1500000000000000000":   "1.5000",
+		"123456789000000000000": "123.4568",
+	} {
+		value, _ := new(big.Int).SetString(wei, 10)
+		if have := formatEther(value); have != want {
+			t.Errorf("%s wei: have %s, want %s", wei, have, want)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package txtrace
+
+import (
+	"math/big"
+
+	"github.com/DeBankDeFi/etherlib/pkg/txtracev1"
+	"github.com/DeBankDeFi/etherlib/pkg/txtracev2"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// FromV1Traces converts txtracev1 action traces to the shared jsonrpc form.
+func FromV1Traces(traces []txtracev1.ActionTrace) []txtracev2.RpcActionTrace {
+	rpcTraces := make([]txtracev2.RpcActionTrace, 0, len(traces))
+	for i := range traces {
+		rpcTraces = append(rpcTraces, FromV1Trace(&traces[i]))
+	}
+	txtracev2.MarkRolledBack(rpcTraces)
+	return rpcTraces
+}
+
+// FromV1Trace converts a single txtracev1 action trace, keeping the json shape of v1:
+// empty init/input/code are omitted and value is always present.
+func FromV1Trace(trace *txtracev1.ActionTrace) txtracev2.RpcActionTrace {
+	value := new(big.Int).Set(trace.Action.Value.ToInt())
+	rpcTrace := txtracev2.RpcActionTrace{
+		Action: txtracev2.Action{
+			CallType:      trace.Action.CallType,
+			From:          trace.Action.From,
+			To:            trace.Action.To,
+			Value:         (*hexutil.Big)(value),
+			Gas:           trace.Action.Gas,
+			Init:          nonEmptyBytes(trace.Action.Init),
+			Input:         nonEmptyBytes(trace.Action.Input),
+			Address:       trace.Action.Address,
+			RefundAddress: trace.Action.RefundAddress,
+			CreateMethod:  trace.Action.CreateMethod,
+			Destroyed:     trace.Action.Destroyed,
+		},
+		BlockHash:           trace.BlockHash,
+		BlockNumber:         new(big.Int).Set(&trace.BlockNumber),
+		Error:               trace.Error,
+		Subtraces:           uint32(trace.Subtraces),
+		TraceAddress:        trace.TraceAddress,
+		TransactionHash:     trace.TransactionHash,
+		TransactionPosition: trace.TransactionPosition,
+		TraceType:           trace.TraceType,
+	}
+	if trace.Action.Balance != nil {
+		balance := new(big.Int).Set(trace.Action.Balance.ToInt())
+		rpcTrace.Action.Balance = (*hexutil.Big)(balance)
+	}
+	if rpcTrace.TraceAddress == nil {
+		rpcTrace.TraceAddress = make([]uint32, 0)
+	}
+	if trace.Result != nil {
+		rpcTrace.Result = &txtracev2.ActionResult{
+			GasUsed: trace.Result.GasUsed,
+			Output:  trace.Result.Output,
+			Code:    nonEmptyBytes(trace.Result.Code),
+			Address: trace.Result.Address,
+		}
+	}
+	return rpcTrace
+}
+
+// nonEmptyBytes returns nil for empty data, matching the omitempty behaviour of v1
+func nonEmptyBytes(data hexutil.Bytes) *hexutil.Bytes {
+	if len(data) == 0 {
+		return nil
+	}
+	return &data
+}
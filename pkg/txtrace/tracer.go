@@ -0,0 +1,130 @@
+// Package txtrace provides a version-agnostic facade over the txtracev1 and
+// txtracev2 tracers, so callers can switch tracer generations at runtime.
+package txtrace
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/DeBankDeFi/etherlib/pkg/txtracev1"
+	"github.com/DeBankDeFi/etherlib/pkg/txtracev2"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+const (
+	V1 = "v1"
+	V2 = "v2"
+)
+
+// Store is satisfied by both txtracev1.Store and txtracev2.Store.
+type Store interface {
+	// ReadTxTrace retrieve tracing result from underlying database.
+	ReadTxTrace(ctx context.Context, txHash common.Hash) ([]byte, error)
+	// WriteTxTrace write tracing result to underlying database.
+	WriteTxTrace(ctx context.Context, txHash common.Hash, trace []byte) error
+}
+
+// Tracer is the common surface of all tracer generations.
+type Tracer interface {
+	vm.EVMLogger
+	// Prepare fills block and tx info into tracer, it must be called before the evm runs.
+	Prepare(blockHash common.Hash, blockNumber *big.Int, txHash common.Hash, txIndex uint, from common.Address, to *common.Address, value *big.Int)
+	// Traces returns traces in jsonrpc form after the evm runtime completed.
+	Traces() ([]txtracev2.RpcActionTrace, error)
+	// Persist saves traced tx result to underlying store.
+	Persist(ctx context.Context) error
+}
+
+// NewTracer creates a tracer of the given version backed by store. opts configure the txtracev2 tracers,
+// including the ones created by Prepare, txtracev1 has no such options and its tracers ignore them.
+func NewTracer(version string, store Store, opts ...txtracev2.Option) (Tracer, error) {
+	switch version {
+	case V1:
+		return newV1Tracer(store), nil
+	case V2:
+		return newV2Tracer(store, opts...), nil
+	default:
+		return nil, fmt.Errorf("unknown tracer version %q", version)
+	}
+}
+
+var (
+	_ Tracer = (*v1Tracer)(nil)
+	_ Tracer = (*v2Tracer)(nil)
+)
+
+// v1Tracer adapts txtracev1.OeTracer to Tracer
+type v1Tracer struct {
+	*txtracev1.OeTracer
+}
+
+func newV1Tracer(store Store) *v1Tracer {
+	var db txtracev1.Store
+	if store != nil {
+		db = store
+	}
+	return &v1Tracer{OeTracer: txtracev1.NewOeTracer(db)}
+}
+
+func (t *v1Tracer) Prepare(blockHash common.Hash, blockNumber *big.Int, txHash common.Hash, txIndex uint, from common.Address, to *common.Address, value *big.Int) {
+	if blockNumber == nil {
+		blockNumber = new(big.Int)
+	}
+	val := new(big.Int)
+	if value != nil {
+		val.Set(value)
+	}
+	t.SetMessage(blockNumber, blockHash, txHash, txIndex, from, to, *val)
+}
+
+func (t *v1Tracer) Traces() ([]txtracev2.RpcActionTrace, error) {
+	traces, err := t.FinalizedResult()
+	if err != nil {
+		return nil, err
+	}
+	return FromV1Traces(traces), nil
+}
+
+func (t *v1Tracer) Persist(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return t.PersistTraceWithRetry(ctx, 1, 0)
+}
+
+// v2Tracer adapts txtracev2.OeTracer to Tracer
+type v2Tracer struct {
+	*txtracev2.OeTracer
+	store txtracev2.Store
+	opts  []txtracev2.Option
+}
+
+func newV2Tracer(store Store, opts ...txtracev2.Option) *v2Tracer {
+	var db txtracev2.Store
+	if store != nil {
+		db = txtracev2.WithDefaultHas(store)
+	}
+	return &v2Tracer{
+		OeTracer: txtracev2.NewOeTracer(db, common.Hash{}, new(big.Int), common.Hash{}, 0, opts...),
+		store:    db,
+		opts:     opts,
+	}
+}
+
+// Prepare replaces the underlying tracer since txtracev2 takes tx info on construction.
+func (t *v2Tracer) Prepare(blockHash common.Hash, blockNumber *big.Int, txHash common.Hash, txIndex uint, _ common.Address, _ *common.Address, _ *big.Int) {
+	t.OeTracer = txtracev2.NewOeTracer(t.store, blockHash, blockNumber, txHash, uint64(txIndex), t.opts...)
+}
+
+func (t *v2Tracer) Traces() ([]txtracev2.RpcActionTrace, error) {
+	return t.GetTraces()
+}
+
+func (t *v2Tracer) Persist(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return t.PersistTraceWithRetry(ctx, 1, 0)
+}
@@ -0,0 +1,164 @@
+package txtrace
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode"
+
+	"github.com/DeBankDeFi/etherlib/pkg/txtracev1"
+	"github.com/DeBankDeFi/etherlib/pkg/txtracev2"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// fixtureDir holds the parity shaped call tracer fixtures.
+var fixtureDir = filepath.Join("..", "txtracev2", "testdata")
+
+func TestNewTracer(t *testing.T) {
+	for _, version := range []string{V1, V2} {
+		tracer, err := NewTracer(version, nil)
+		if err != nil {
+			t.Fatalf("failed to create %s tracer: %v", version, err)
+		}
+		// neither generation returns the traces of an execution which didn't complete
+		want := txtracev2.ErrTraceIncomplete
+		if version == V1 {
+			want = txtracev1.ErrTraceIncomplete
+		}
+		if traces, err := tracer.Traces(); !errors.Is(err, want) || traces != nil {
+			t.Fatalf("%s tracer: result mismatch before execution: have %v, %v, want %v", version, traces, err, want)
+		}
+	}
+	if _, err := NewTracer("v0", nil); err == nil {
+		t.Fatalf("expected error for unknown tracer version")
+	}
+}
+
+// The options given to NewTracer must survive Prepare, which replaces the txtracev2 tracer.
+func TestNewTracerOptions(t *testing.T) {
+	txHash := common.Hash{0x1}
+	for _, force := range []bool{false, true} {
+		var opts []txtracev2.Option
+		if force {
+			opts = append(opts, txtracev2.WithForce())
+		}
+		tracer, err := NewTracer(V2, nil, opts...)
+		if err != nil {
+			t.Fatalf("failed to create tracer: %v", err)
+		}
+		tracer.Prepare(common.Hash{}, big.NewInt(1), txHash, 0, common.Address{}, &common.Address{0x2}, nil)
+		tracer.CaptureStart(nil, common.Address{}, common.Address{0x2}, false, nil, 21000, new(big.Int))
+		traces, err := tracer.Traces()
+		if !force {
+			if !errors.Is(err, txtracev2.ErrTraceIncomplete) {
+				t.Fatalf("unforced tracer: error mismatch: have %v, want %v", err, txtracev2.ErrTraceIncomplete)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("forced tracer: failed to get traces: %v", err)
+		}
+		if len(traces) != 1 || traces[0].TransactionHash != txHash {
+			t.Fatalf("forced tracer: unexpected traces %+v", traces)
+		}
+	}
+}
+
+// Decodes every fixture result as v1 traces, converts them and compares the json
+// encoding of both sides.
+func TestFromV1Traces(t *testing.T) {
+	files, err := os.ReadDir(fixtureDir)
+	if err != nil {
+		t.Fatalf("failed to retrieve tracer test suite: %v", err)
+	}
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), "call_tracer_") {
+			continue
+		}
+		file := file // capture range variable
+		t.Run(camel(strings.TrimSuffix(strings.TrimPrefix(file.Name(), "call_tracer"), ".json")), func(t *testing.T) {
+			t.Parallel()
+
+			blob, err := os.ReadFile(filepath.Join(fixtureDir, file.Name()))
+			if err != nil {
+				t.Fatalf("failed to read testcase: %v", err)
+			}
+			raw := new(struct {
+				Result []interface{} `json:"result"`
+			})
+			if err := json.Unmarshal(blob, raw); err != nil {
+				t.Fatalf("failed to parse testcase: %v", err)
+			}
+			// v1 has no nullable value, drop the nulls emitted by v2 before decoding
+			blob, _ = json.Marshal(map[string]interface{}{"result": dropNulls(raw.Result)})
+			test := new(struct {
+				Result []txtracev1.ActionTrace `json:"result"`
+			})
+			if err := json.Unmarshal(blob, test); err != nil {
+				t.Fatalf("failed to parse testcase: %v", err)
+			}
+			if len(test.Result) == 0 {
+				t.Fatalf("testcase has no traces")
+			}
+			converted := FromV1Traces(test.Result)
+			if len(converted) != len(test.Result) {
+				t.Fatalf("trace count mismatch: have %d, want %d", len(converted), len(test.Result))
+			}
+			if !jsonEqual(converted, test.Result) {
+				x, _ := json.Marshal(converted)
+				y, _ := json.Marshal(test.Result)
+				t.Fatalf("trace mismatch: \nhave %s\nwant %s", x, y)
+			}
+		})
+	}
+}
+
+// dropNulls removes null members from decoded json objects recursively
+func dropNulls(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, member := range v {
+			if member == nil {
+				delete(v, key)
+			} else {
+				v[key] = dropNulls(member)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = dropNulls(v[i])
+		}
+	}
+	return v
+}
+
+// jsonEqual compares the generic json representation of x and y
+func jsonEqual(x, y interface{}) bool {
+	var xv, yv interface{}
+	xj, err := json.Marshal(x)
+	if err != nil {
+		return false
+	}
+	yj, err := json.Marshal(y)
+	if err != nil {
+		return false
+	}
+	if json.Unmarshal(xj, &xv) != nil || json.Unmarshal(yj, &yv) != nil {
+		return false
+	}
+	return reflect.DeepEqual(xv, yv)
+}
+
+// camel converts a snake cased input string into a camel cased output.
+func camel(str string) string {
+	pieces := strings.Split(str, "_")
+	for i := 1; i < len(pieces); i++ {
+		pieces[i] = string(unicode.ToUpper(rune(pieces[i][0]))) + pieces[i][1:]
+	}
+	return strings.Join(pieces, "")
+}
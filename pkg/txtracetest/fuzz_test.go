@@ -0,0 +1,53 @@
+package txtracetest
+
+import (
+	"testing"
+
+	"github.com/DeBankDeFi/etherlib/pkg/txtrace"
+)
+
+// seeds are programs around past divergences of the tracers, see GenerateProgram for the encoding:
+// per contract an op count followed by the ops and their arguments.
+var seeds = [][]byte{
+	{},                      // a plain call
+	{1, opCall, 1, 10, 0},   // a single inner call
+	{1, opCall, 1, 0xff, 0}, // inner call requesting more gas than available, capped to 63/64
+	{1, opCall, 1, 10, 1, 1, opCall, 2, 5, 0},     // nested calls transferring value, with the stipend
+	{1, opStaticCall, 1, 10, 1, opReturn},         // static call returning
+	{1, opCreate, 0},                              // create returning empty code
+	{1, opCall, 3, 0xff, 0, 0, 0, 1, opCreate, 0}, // create colliding with an existing account, see CollidingAddress
+}
+
+func FuzzTracers(f *testing.F) {
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		program := GenerateProgram(data)
+		v1, err := Run(txtrace.V1, program)
+		if err != nil {
+			t.Fatalf("v1: %v", err)
+		}
+		v2, err := Run(txtrace.V2, program)
+		if err != nil {
+			t.Fatalf("v2: %v", err)
+		}
+		if err := Diff(Normalize(v1), Normalize(v2)); err != nil {
+			t.Fatalf("%v\nprogram:\n%s", err, program)
+		}
+	})
+}
+
+func TestDiff(t *testing.T) {
+	frames := []Frame{{TraceAddress: "[]", Type: "call", CallType: "call"}, {TraceAddress: "[0]", Type: "create"}}
+	if err := Diff(frames, frames); err != nil {
+		t.Fatalf("identical frames diverge: %v", err)
+	}
+	failed := []Frame{frames[0], {TraceAddress: "[0]", Type: "create", Failed: true}}
+	if err := Diff(frames, failed); err == nil {
+		t.Fatalf("error presence divergence not reported")
+	}
+	if err := Diff(frames, frames[:1]); err == nil {
+		t.Fatalf("missing frame not reported")
+	}
+}
@@ -0,0 +1,178 @@
+// Package txtracetest generates small evm programs and runs them through every tracer
+// generation, so divergences between the tracers are found before users report them.
+package txtracetest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const (
+	numContracts    = 4 // contracts deployed by a program, the tx calls the first one
+	maxOpsPerCode   = 6 // structural ops generated per contract
+	contractBalance = 1_000
+)
+
+// structural ops a program is made of
+const (
+	opCall = iota
+	opCallCode
+	opDelegateCall
+	opStaticCall
+	opCreate
+	opRevert
+	opReturn
+	opSelfDestruct
+	numOps
+)
+
+// initCodes are the init codes used by generated creates
+var initCodes = [][]byte{
+	common.FromHex("0x60006000f3"), // PUSH1 0 PUSH1 0 RETURN
+	common.FromHex("0x60006000fd"), // PUSH1 0 PUSH1 0 REVERT
+	common.FromHex("0x00"),         // STOP
+}
+
+// ContractAddress returns the address the i-th contract of a program is deployed at.
+func ContractAddress(i int) common.Address {
+	return common.BigToAddress(big.NewInt(0xc0de00 + int64(i)))
+}
+
+// Program is a set of contracts calling, creating and destructing each other.
+type Program struct {
+	Codes [numContracts][]byte
+}
+
+// GenerateProgram decodes data into a structurally valid program, any input is accepted and missing
+// bytes read as zero. Calls are given bounded gas, 0xff requests more gas than available.
+func GenerateProgram(data []byte) *Program {
+	r := &byteReader{data: data}
+	p := new(Program)
+	for i := range p.Codes {
+		var code []byte
+		for n := int(r.next()) % maxOpsPerCode; n > 0; n-- {
+			op := r.next() % numOps
+			code = append(code, emitOp(op, r)...)
+			if op == opRevert || op == opReturn || op == opSelfDestruct {
+				break
+			}
+		}
+		p.Codes[i] = append(code, byte(vm.STOP))
+	}
+	return p
+}
+
+// emitOp returns the bytecode of a structural op, its arguments are read from r
+func emitOp(op byte, r *byteReader) []byte {
+	switch op {
+	case opCall, opCallCode:
+		target, gas, value := r.next(), callGas(r.next()), uint64(r.next()&1)
+		code := pushes(0, 0, 0, 0, value) // retSize, retOffset, inSize, inOffset, value
+		code = append(code, pushAddress(ContractAddress(int(target)%numContracts))...)
+		code = append(code, pushes(gas)...)
+		if op == opCall {
+			return append(code, byte(vm.CALL), byte(vm.POP))
+		}
+		return append(code, byte(vm.CALLCODE), byte(vm.POP))
+	case opDelegateCall, opStaticCall:
+		target, gas := r.next(), callGas(r.next())
+		code := pushes(0, 0, 0, 0) // retSize, retOffset, inSize, inOffset
+		code = append(code, pushAddress(ContractAddress(int(target)%numContracts))...)
+		code = append(code, pushes(gas)...)
+		if op == opDelegateCall {
+			return append(code, byte(vm.DELEGATECALL), byte(vm.POP))
+		}
+		return append(code, byte(vm.STATICCALL), byte(vm.POP))
+	case opCreate:
+		init := initCodes[int(r.next())%len(initCodes)]
+		// the init code is stored right aligned in the first memory word
+		code := append([]byte{byte(vm.PUSH1) + byte(len(init)) - 1}, init...)
+		code = append(code, pushes(0)...)
+		code = append(code, byte(vm.MSTORE))
+		code = append(code, pushes(uint64(len(init)), uint64(32-len(init)), 0)...) // size, offset, value
+		return append(code, byte(vm.CREATE), byte(vm.POP))
+	case opRevert:
+		return append(pushes(0, 0), byte(vm.REVERT))
+	case opReturn:
+		return append(pushes(0, 0), byte(vm.RETURN))
+	default:
+		return append(pushAddress(ContractAddress(int(r.next())%numContracts)), byte(vm.SELFDESTRUCT))
+	}
+}
+
+// callGas maps a byte to the gas requested by a call
+func callGas(b byte) uint64 {
+	if b == 0xff {
+		return 0xffffffff
+	}
+	return (uint64(b) + 1) * 1_000
+}
+
+// pushes pushes values in order, the last one ends on top of the stack
+func pushes(values ...uint64) []byte {
+	var code []byte
+	for _, value := range values {
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], value)
+		trimmed := common.TrimLeftZeroes(buf[:])
+		if len(trimmed) == 0 {
+			trimmed = []byte{0}
+		}
+		code = append(code, byte(vm.PUSH1)+byte(len(trimmed))-1)
+		code = append(code, trimmed...)
+	}
+	return code
+}
+
+func pushAddress(addr common.Address) []byte {
+	return append([]byte{byte(vm.PUSH20)}, addr.Bytes()...)
+}
+
+// CollidingAddress returns the address occupied ahead of the first create of the last contract of a program,
+// so the create collides.
+func CollidingAddress() common.Address {
+	return crypto.CreateAddress(ContractAddress(numContracts-1), 0)
+}
+
+// Alloc returns the genesis allocation deploying the program along with a funded sender.
+func (p *Program) Alloc(sender common.Address) types.GenesisAlloc {
+	alloc := types.GenesisAlloc{
+		sender:             {Balance: big.NewInt(1_000_000_000_000_000_000)},
+		CollidingAddress(): {Code: []byte{byte(vm.STOP)}, Nonce: 1},
+	}
+	for i, code := range p.Codes {
+		alloc[ContractAddress(i)] = types.Account{Code: code, Balance: big.NewInt(contractBalance)}
+	}
+	return alloc
+}
+
+// String returns the bytecode of every contract, for reproducing failures.
+func (p *Program) String() string {
+	var b strings.Builder
+	for i, code := range p.Codes {
+		fmt.Fprintf(&b, "%s: %#x\n", ContractAddress(i).Hex(), code)
+	}
+	return b.String()
+}
+
+// byteReader reads the fuzzer input, zeros once exhausted
+type byteReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *byteReader) next() byte {
+	if r.pos >= len(r.data) {
+		return 0
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b
+}
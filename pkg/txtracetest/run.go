@@ -0,0 +1,126 @@
+package txtracetest
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/DeBankDeFi/etherlib/pkg/txtrace"
+	"github.com/DeBankDeFi/etherlib/pkg/txtracev2"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/tests"
+)
+
+const txGasLimit = 3_000_000
+
+// Sender is the account sending the tx which runs a program.
+var Sender = common.HexToAddress("0x1000000000000000000000000000000000000001")
+
+// Run executes p in a fresh state with a tracer of the given version and returns its traces. A panic
+// of the tracer is returned as an error along with the program.
+func Run(version string, p *Program) (traces []txtracev2.RpcActionTrace, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s tracer panicked: %v\nprogram:\n%s", version, r, p)
+		}
+	}()
+	tracer, err := txtrace.NewTracer(version, nil)
+	if err != nil {
+		return nil, err
+	}
+	state := tests.MakePreState(rawdb.NewMemoryDatabase(), p.Alloc(Sender), false, rawdb.HashScheme)
+	defer state.Close()
+
+	to := ContractAddress(0)
+	msg := &core.Message{
+		From:      Sender,
+		To:        &to,
+		Value:     big.NewInt(0),
+		GasLimit:  txGasLimit,
+		GasPrice:  big.NewInt(0),
+		GasFeeCap: big.NewInt(0),
+		GasTipCap: big.NewInt(0),
+	}
+	blkContext := vm.BlockContext{
+		CanTransfer: core.CanTransfer,
+		Transfer:    core.Transfer,
+		GasLimit:    10 * txGasLimit,
+		BlockNumber: big.NewInt(1),
+		Difficulty:  big.NewInt(1),
+		BaseFee:     big.NewInt(0),
+	}
+	tracer.Prepare(common.Hash{}, blkContext.BlockNumber, common.Hash{0x1}, 0, msg.From, msg.To, msg.Value)
+	evm := vm.NewEVM(blkContext, core.NewEVMTxContext(msg), state.StateDB, params.AllEthashProtocolChanges, vm.Config{Tracer: tracer, NoBaseFee: true})
+	if _, err := core.ApplyMessage(evm, msg, new(core.GasPool).AddGas(msg.GasLimit)); err != nil {
+		return nil, fmt.Errorf("failed to execute program: %v", err)
+	}
+	return tracer.Traces()
+}
+
+// Frame is the structure of a trace every tracer generation must agree on. Gas and error messages
+// are known to differ and left out until they are aligned.
+type Frame struct {
+	TraceAddress string
+	Type         string
+	CallType     string
+	CreateMethod string
+	Failed       bool
+}
+
+// Normalize reduces traces to their frames ordered by trace address.
+func Normalize(traces []txtracev2.RpcActionTrace) []Frame {
+	frames := make([]Frame, 0, len(traces))
+	for _, trace := range traces {
+		frame := Frame{
+			TraceAddress: fmt.Sprint(trace.TraceAddress),
+			Type:         trace.TraceType,
+			CreateMethod: trace.Action.CreateMethod,
+			// a suicide has no result of its own, v1 reports the revert of an enclosing frame as its error
+			// while v2 only flags it rolled back
+			Failed: trace.Error != "" || (trace.TraceType == "suicide" && trace.RolledBack),
+		}
+		if trace.Action.CallType != nil {
+			frame.CallType = *trace.Action.CallType
+		}
+		frames = append(frames, frame)
+	}
+	sort.Slice(frames, func(i, j int) bool {
+		return frames[i].TraceAddress < frames[j].TraceAddress
+	})
+	return frames
+}
+
+// Diff describes the structural divergences between two normalized traces, nil if they agree.
+func Diff(x, y []Frame) error {
+	var diffs []string
+	if len(x) != len(y) {
+		diffs = append(diffs, fmt.Sprintf("frame count %d != %d", len(x), len(y)))
+	}
+	xFrames := make(map[string]Frame, len(x))
+	for _, frame := range x {
+		xFrames[frame.TraceAddress] = frame
+	}
+	yFrames := make(map[string]Frame, len(y))
+	for _, frame := range y {
+		yFrames[frame.TraceAddress] = frame
+		if xFrame, ok := xFrames[frame.TraceAddress]; !ok {
+			diffs = append(diffs, fmt.Sprintf("frame %s only in the second", frame.TraceAddress))
+		} else if xFrame != frame {
+			diffs = append(diffs, fmt.Sprintf("frame %s: %+v != %+v", frame.TraceAddress, xFrame, frame))
+		}
+	}
+	for _, frame := range x {
+		if _, ok := yFrames[frame.TraceAddress]; !ok {
+			diffs = append(diffs, fmt.Sprintf("frame %s only in the first", frame.TraceAddress))
+		}
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("traces diverge: %s", strings.Join(diffs, "; "))
+	}
+	return nil
+}
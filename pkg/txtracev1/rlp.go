@@ -17,8 +17,10 @@
 package txtracev1
 
 import (
+	"bytes"
 	"io"
 	"math/big"
+	"sync"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
@@ -51,20 +53,37 @@ type flatTrace struct {
 	BlockHash, TransactionHash []byte // RLP cannot encode common.Hash directly.
 	BlockNumber                big.Int
 	TransactionPosition        uint64
+	// Optional trailers, absent in traces stored by older versions
+	ActionCreateMethod    string          `rlp:"optional"`
+	ActionDestroyed       *bool           `rlp:"optional"`
+	ActionStorageAccesses []StorageAccess `rlp:"optional"`
 }
 
 type ActionTraces []ActionTrace
 
+// traceBufferPool holds the buffers the traces are encoded into before being written as byte strings
+var traceBufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// EncodeRLP writes the traces as a list of byte strings, each holding the encoded flatTrace of a trace. The
+// traces are encoded one by one into a pooled buffer and written straight to the output, rather than into
+// a byte slice per trace.
 func (traces *ActionTraces) EncodeRLP(w io.Writer) error {
-	cpy := make([][]byte, 0, len(*traces))
-	for _, t := range *traces {
-		bs, err := rlp.EncodeToBytes(&t)
-		if err != nil {
+	buf := traceBufferPool.Get().(*bytes.Buffer)
+	defer traceBufferPool.Put(buf)
+
+	enc := rlp.NewEncoderBuffer(w)
+	list := enc.List()
+	for i := range *traces {
+		buf.Reset()
+		if err := rlp.Encode(buf, &(*traces)[i]); err != nil {
 			return err
 		}
-		cpy = append(cpy, bs)
+		enc.WriteBytes(buf.Bytes())
 	}
-	return rlp.Encode(w, &cpy)
+	enc.ListEnd(list)
+	return enc.Flush()
 }
 
 func (traces *ActionTraces) DecodeRLP(s *rlp.Stream) error {
@@ -88,24 +107,27 @@ func (traces *ActionTraces) DecodeRLP(s *rlp.Stream) error {
 // EncodeRLP serializes ActionTrace into the Ethereum RLP flatTrace format.
 func (at *ActionTrace) EncodeRLP(w io.Writer) error {
 	ft := &flatTrace{
-		ActionCallType:      at.Action.CallType,
-		ActionFrom:          at.Action.From,
-		ActionTo:            at.Action.To,
-		ActionValue:         *at.Action.Value.ToInt(),
-		ActionGas:           uint64(at.Action.Gas),
-		ActionInit:          at.Action.Init,
-		ActionInput:         at.Action.Input,
-		ActionAddress:       at.Action.Address,
-		ActionRefundAddress: at.Action.RefundAddress,
-		ActionBalance:       at.Action.Balance.ToInt(),
-		Error:               at.Error,
-		Subtraces:           at.Subtraces,
-		TraceAddress:        at.TraceAddress,
-		TraceType:           at.TraceType,
-		BlockHash:           at.BlockHash.Bytes(),
-		BlockNumber:         at.BlockNumber,
-		TransactionHash:     at.TransactionHash.Bytes(),
-		TransactionPosition: at.TransactionPosition,
+		ActionCallType:        at.Action.CallType,
+		ActionFrom:            at.Action.From,
+		ActionTo:              at.Action.To,
+		ActionValue:           *at.Action.Value.ToInt(),
+		ActionGas:             uint64(at.Action.Gas),
+		ActionInit:            at.Action.Init,
+		ActionInput:           at.Action.Input,
+		ActionAddress:         at.Action.Address,
+		ActionRefundAddress:   at.Action.RefundAddress,
+		ActionBalance:         at.Action.Balance.ToInt(),
+		Error:                 at.Error,
+		Subtraces:             at.Subtraces,
+		TraceAddress:          at.TraceAddress,
+		TraceType:             at.TraceType,
+		BlockHash:             at.BlockHash.Bytes(),
+		BlockNumber:           at.BlockNumber,
+		TransactionHash:       at.TransactionHash.Bytes(),
+		TransactionPosition:   at.TransactionPosition,
+		ActionCreateMethod:    at.Action.CreateMethod,
+		ActionDestroyed:       at.Action.Destroyed,
+		ActionStorageAccesses: at.Action.StorageAccesses,
 	}
 	if at.Result != nil {
 		ft.ResultGasUsed = uint64(at.Result.GasUsed)
@@ -126,16 +148,19 @@ func (at *ActionTrace) DecodeRLP(s *rlp.Stream) error {
 	}
 
 	action := TAction{
-		CallType:      ft.ActionCallType,
-		From:          ft.ActionFrom,
-		To:            ft.ActionTo,
-		Value:         hexutil.Big(ft.ActionValue),
-		Gas:           hexutil.Uint64(ft.ActionGas),
-		Init:          ft.ActionInit,
-		Input:         ft.ActionInput,
-		Address:       ft.ActionAddress,
-		RefundAddress: ft.ActionRefundAddress,
-		Balance:       (*hexutil.Big)(ft.ActionBalance),
+		CallType:        ft.ActionCallType,
+		From:            ft.ActionFrom,
+		To:              ft.ActionTo,
+		Value:           hexutil.Big(ft.ActionValue),
+		Gas:             hexutil.Uint64(ft.ActionGas),
+		Init:            ft.ActionInit,
+		Input:           ft.ActionInput,
+		Address:         ft.ActionAddress,
+		RefundAddress:   ft.ActionRefundAddress,
+		Balance:         (*hexutil.Big)(ft.ActionBalance),
+		CreateMethod:    ft.ActionCreateMethod,
+		Destroyed:       ft.ActionDestroyed,
+		StorageAccesses: ft.ActionStorageAccesses,
 	}
 	result := &TResult{
 		GasUsed: hexutil.Uint64(ft.ResultGasUsed),
@@ -147,13 +172,14 @@ func (at *ActionTrace) DecodeRLP(s *rlp.Stream) error {
 		result.Output = &output
 	}
 
-	// Set unrelated filed to nil explicitly for json decode omit.
+	// Set unrelated filed to nil explicitly for json decode omit, Destroyed is decoded as false when
+	// followed by storage accesses.
 	switch ft.TraceType {
 	case CALL:
-		action.Balance = nil
+		action.Balance, action.Destroyed = nil, nil
 		result.Code = nil
 	case CREATE:
-		action.Balance = nil
+		action.Balance, action.Destroyed = nil, nil
 		result.Output = nil
 	case SELFDESTRUCT:
 		result = nil
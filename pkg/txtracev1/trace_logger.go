@@ -18,19 +18,38 @@ package txtracev1
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"math/big"
+	"slices"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/params"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/holiman/uint256"
 )
 
 var _ vm.EVMLogger = (*OeTracer)(nil)
 
+var (
+	// ErrTraceEncode is wrapped by the errors of PersistTraceContext when the traces can't be rlp encoded.
+	ErrTraceEncode = errors.New("failed to encode tx trace")
+	// ErrTraceWrite is wrapped by the errors of PersistTraceContext when the store failed to write the traces.
+	ErrTraceWrite = errors.New("failed to persist tx trace")
+)
+
+// ErrTraceIncomplete is returned by FinalizedResult when the execution didn't end, i.e. CaptureEnd
+// was never called.
+var ErrTraceIncomplete = errors.New("trace incomplete")
+
 const (
 	// This is the target size for the packs of transactions or announcements. A
 	// pack can get larger than this if a single transactions exceeds this size.
@@ -46,6 +65,15 @@ type AccountDiff map[common.Hash]Diff
 
 type StateDiff map[common.Address]AccountDiff
 
+// TransientAccess is a TLOAD or TSTORE of transient storage (EIP-1153), which is discarded at the end of the tx
+type TransientAccess struct {
+	TraceAddress []uint32       `json:"traceAddress"` // of the frame running the op
+	Op           string         `json:"op"`           // "TLOAD" or "TSTORE"
+	Address      common.Address `json:"address"`      // whose transient storage, the caller's for a delegatecall
+	Slot         common.Hash    `json:"slot"`
+	Value        common.Hash    `json:"value"` // the value read or written
+}
+
 // OeTracer OpenEthereum-style tracer
 type OeTracer struct {
 	store       Store
@@ -69,6 +97,21 @@ type OeTracer struct {
 	err          error
 	stateDiff    StateDiff
 	env          *vm.EVM
+	cancun       bool                 // SELFDESTRUCT only deletes accounts created in the tx (EIP-6780)
+	enterPending bool                 // the last call/create trace waits for CaptureEnter to fill the gas given to the callee
+	gasByOpcode  map[vm.OpCode]uint64 // nil unless enabled by SetGasByOpcode
+	transient    []TransientAccess    // of the tx, only recorded when enabled by SetTransientStorage
+	transientOn  bool                 // see SetTransientStorage
+	storageOn    bool                 // see SetStorageAccesses
+	ended        bool                 // CaptureEnd was called
+	finalized    bool                 // the trace tree is flattened into the result, see Finalize
+	writeTimeout time.Duration        // bounds the writes of a context without deadline, 0 means unbounded
+}
+
+// OpcodeGas is the gas cost aggregated for an opcode
+type OpcodeGas struct {
+	Op  vm.OpCode
+	Gas uint64
 }
 
 // NewOeTracer creates new instance of trace creator with underlying database.
@@ -90,24 +133,46 @@ func stackPeek(stackData []uint256.Int, pos int) *big.Int {
 	return new(big.Int).Set(stackData[len(stackData)-1-pos].ToBig())
 }
 
-func memorySlice(memory []byte, offset, size int64) []byte {
-	if size == 0 {
-		return []byte{}
+// forwardedGas returns the gas the evm gives to a callee, all but one 64th of the available gas at most (EIP-150)
+func forwardedGas(available, requested uint64) uint64 {
+	available -= available / 64
+	if requested > available {
+		return available
 	}
-	if offset+size < offset || offset < 0 {
+	return requested
+}
+
+// memoryCopy returns size bytes of memory from offset. CaptureState sees memory before the evm expands it for
+// the op, so the part of the region beyond the snapshot is zero padded like the expanded memory. The op failed
+// before it ran when err is set, e.g. unable to pay for the expansion, its operands may be anything the stack
+// holds and yield nil, so do the regions of maxTxPacketSize bytes or more and the ones beyond 64 bits.
+func memoryCopy(memory []byte, offset, size *big.Int, err error) []byte {
+	if size.Sign() == 0 || err != nil {
+		return nil
+	}
+	if !offset.IsUint64() || !size.IsUint64() || offset.Uint64()+size.Uint64() < offset.Uint64() {
 		log.Warn("Tracer accessed out of bound memory", "offset", offset, "size", size)
 		return nil
 	}
-	if len(memory) < int(offset+size) {
-		log.Warn("Tracer accessed out of bound memory", "available", len(memory), "offset", offset, "size", size)
+	if size.Uint64() >= maxTxPacketSize {
 		return nil
 	}
-	return memory[offset : offset+size]
+	data := make([]byte, size.Uint64())
+	if start := offset.Uint64(); start < uint64(len(memory)) {
+		copy(data, memory[start:])
+	}
+	return data
 }
 
 // CaptureStart implements the tracer interface to initialize the tracing operation.
 func (ot *OeTracer) CaptureStart(env *vm.EVM, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) {
+	// The previous tx was never persisted, drop what it left behind
+	if ot.traceHolder != nil {
+		log.Warn("OeTracer reused without reset, clearing stale state", "txHash", ot.tx.String())
+		ot.resetExecution()
+	}
 	ot.env = env
+	ot.cancun = env != nil && env.ChainConfig().Rules(env.Context.BlockNumber, env.Context.Random != nil, env.Context.Time).IsCancun
 	// Create main trace holder
 	tracesHolder := CallTrace{
 		Actions: make([]ActionTrace, 0),
@@ -124,15 +189,14 @@ func (ot *OeTracer) CaptureStart(env *vm.EVM, from common.Address, to common.Add
 
 	// Store input data
 	ot.inputData = input
-	if gas == 0 && ot.gasUsed != 0 {
-		gas = ot.gasUsed
-	}
 
-	// Make transaction trace root object
+	// Make transaction trace root object, its gas is what's left of the gas limit after the intrinsic gas
+	// like parity, which is legitimately 0 when the intrinsic gas took it all
 	rootTrace := NewActionTrace(ot.blockHash, ot.blockNumber, ot.tx, uint64(ot.txIndex), callType)
 	var txAction *TAction
 	if CREATE == callType {
 		txAction = NewTAction(ot.from, ot.to, gas, ot.inputData, hexutil.Big(ot.value), nil)
+		txAction.CreateMethod = CreateMethodCreate
 		if newAddress != nil {
 			rootTrace.Result.Address = newAddress
 			rootTrace.Result.Code = ot.output
@@ -156,11 +220,15 @@ func (ot *OeTracer) CaptureStart(env *vm.EVM, from common.Address, to common.Add
 
 // CaptureState implements creating of traces based on getting opCodes from evm during contract processing
 func (ot *OeTracer) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
+	if ot.gasByOpcode != nil {
+		ot.gasByOpcode[op] += cost
+	}
 	stack, memory, contract := scope.Stack, scope.Memory, scope.Contract
-	// When going back from inner call
-	if lastState(ot.state).level == depth {
+	// When going back from inner calls, possibly several at once when the depth jumps, e.g. frames entered by
+	// a precompile calling back into the evm end without running an op of their caller
+	for len(ot.state) > 1 && lastState(ot.state).level >= depth {
 		result := ot.traceHolder.Stack[len(ot.traceHolder.Stack)-1].Result
-		if lastState(ot.state).create && result != nil {
+		if lastState(ot.state).level == depth && lastState(ot.state).create && result != nil {
 			if len(stack.Data()) > 0 {
 				addr := common.BytesToAddress(stackPeek(stack.Data(), 0).Bytes())
 				result.Address = &addr
@@ -168,12 +236,13 @@ func (ot *OeTracer) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64, scop
 			}
 		}
 		ot.traceAddress = removeTraceAddressLevel(ot.traceAddress, depth)
+		ot.enterPending = false
 		ot.state = ot.state[:len(ot.state)-1]
 		ot.traceHolder.Stack = ot.traceHolder.Stack[:len(ot.traceHolder.Stack)-1]
 	}
 
 	// We only care about system opcodes, faster if we pre-check once.
-	if !(op&0xf0 == 0xf0) && op != 0x0 && op != vm.SSTORE {
+	if !(op&0xf0 == 0xf0) && op != 0x0 && op != vm.SSTORE && !(ot.storageOn && op == vm.SLOAD) && !(ot.transientOn && (op == vm.TLOAD || op == vm.TSTORE)) {
 		return
 	}
 
@@ -184,63 +253,75 @@ func (ot *OeTracer) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64, scop
 		fromTrace := ot.traceHolder.Stack[len(ot.traceHolder.Stack)-1]
 
 		// Get input data from memory
-		offset := stackPeek(stack.Data(), 1).Int64()
-		inputSize := stackPeek(stack.Data(), 2).Int64()
-		var input []byte
-		if inputSize > 0 {
-			input = make([]byte, inputSize)
-			copy(input, memorySlice(memory.Data(), offset, inputSize))
-		}
+		input := memoryCopy(memory.Data(), stackPeek(stack.Data(), 1), stackPeek(stack.Data(), 2), err)
 
-		// Create new trace
+		// Create new trace, the callee gets all but one 64th of the gas left after paying for the create
 		trace := NewActionTraceFromTrace(fromTrace, CREATE, ot.traceAddress)
+		ot.traceAddress = trace.TraceAddress
+		// the deployer is the storage context whose nonce increments, for delegated code it's the
+		// delegating account rather than the address of the code like parity
 		from := contract.Address()
-		traceAction := NewTAction(&from, nil, gas, input, fromTrace.Action.Value, nil)
+		var available uint64
+		if gas > cost {
+			available = gas - cost
+		}
+		traceAction := NewTAction(&from, nil, forwardedGas(available, available), input, fromTrace.Action.Value, nil)
+		traceAction.CreateMethod = CreateMethodCreate
+		if op == vm.CREATE2 {
+			traceAction.CreateMethod = CreateMethodCreate2
+		}
 		trace.Action = *traceAction
 		trace.Result.GasUsed = hexutil.Uint64(gas)
+		// a create colliding with an existing account fails without running its init code
+		if err == nil && ot.createCollides(op, stack.Data(), memory.Data(), from) {
+			trace.Result = nil
+			trace.Error = vm.ErrContractAddressCollision.Error()
+		}
 		fromTrace.childTraces = append(fromTrace.childTraces, trace)
 		ot.traceHolder.Stack = append(ot.traceHolder.Stack, trace)
 		ot.state = append(ot.state, depthState{depth, true})
+		ot.enterPending = true
 
 	case vm.CALL, vm.CALLCODE, vm.DELEGATECALL, vm.STATICCALL:
 		var (
-			inOffset, inSize   int64
+			inOffset, inSize   *big.Int
 			retOffset, retSize uint64
 			input              []byte
 			value              = big.NewInt(0)
 		)
 
 		if vm.DELEGATECALL == op || vm.STATICCALL == op {
-			inOffset = stackPeek(stack.Data(), 2).Int64()
-			inSize = stackPeek(stack.Data(), 3).Int64()
+			inOffset = stackPeek(stack.Data(), 2)
+			inSize = stackPeek(stack.Data(), 3)
 			retOffset = stackPeek(stack.Data(), 4).Uint64()
 			retSize = stackPeek(stack.Data(), 5).Uint64()
 		} else {
-			inOffset = stackPeek(stack.Data(), 3).Int64()
-			inSize = stackPeek(stack.Data(), 4).Int64()
+			inOffset = stackPeek(stack.Data(), 3)
+			inSize = stackPeek(stack.Data(), 4)
 			retOffset = stackPeek(stack.Data(), 5).Uint64()
 			retSize = stackPeek(stack.Data(), 6).Uint64()
 			// only CALL and CALLCODE need `value` field
 			value = stackPeek(stack.Data(), 2)
 		}
-		if inSize > 0 && inSize < maxTxPacketSize {
-			input = make([]byte, inSize)
-			copy(input, memorySlice(memory.Data(), inOffset, inSize))
+		if inSize.Cmp(big.NewInt(maxTxPacketSize)) < 0 {
+			input = memoryCopy(memory.Data(), inOffset, inSize, err)
 		}
 		ot.traceAddress = addTraceAddress(ot.traceAddress, depth)
 		fromTrace := ot.traceHolder.Stack[len(ot.traceHolder.Stack)-1]
 		// create new trace
 		trace := NewActionTraceFromTrace(fromTrace, CALL, ot.traceAddress)
+		ot.traceAddress = trace.TraceAddress
 		from := contract.Address()
 		addr := common.BytesToAddress(stackPeek(stack.Data(), 1).Bytes())
 		callType := strings.ToLower(op.String())
-		traceAction := NewTAction(&from, &addr, gas, input, hexutil.Big(*value), &callType)
+		traceAction := NewTAction(&from, &addr, callGas(stackPeek(stack.Data(), 0), value, gas, cost), input, hexutil.Big(*value), &callType)
 		trace.Action = *traceAction
 		fromTrace.childTraces = append(fromTrace.childTraces, trace)
 		trace.Result.RetOffset = retOffset
 		trace.Result.RetSize = retSize
 		ot.traceHolder.Stack = append(ot.traceHolder.Stack, trace)
 		ot.state = append(ot.state, depthState{depth, false})
+		ot.enterPending = true
 
 	case vm.RETURN, vm.STOP:
 		if ot.reverted {
@@ -251,12 +332,7 @@ func (ot *OeTracer) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64, scop
 			var data []byte
 
 			if vm.STOP != op {
-				offset := stackPeek(stack.Data(), 0).Int64()
-				size := stackPeek(stack.Data(), 1).Int64()
-				if size > 0 {
-					data = make([]byte, size)
-					copy(data, memorySlice(memory.Data(), offset, size))
-				}
+				data = memoryCopy(memory.Data(), stackPeek(stack.Data(), 0), stackPeek(stack.Data(), 1), err)
 			}
 
 			if lastState(ot.state).create {
@@ -273,24 +349,17 @@ func (ot *OeTracer) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64, scop
 		ot.traceHolder.Stack[len(ot.traceHolder.Stack)-1].Result = nil
 		ot.traceHolder.Stack[len(ot.traceHolder.Stack)-1].Error = "Reverted"
 
-	case vm.SELFDESTRUCT:
-		ot.traceAddress = addTraceAddress(ot.traceAddress, depth)
-		fromTrace := ot.traceHolder.Stack[len(ot.traceHolder.Stack)-1]
-		trace := NewActionTraceFromTrace(fromTrace, SELFDESTRUCT, ot.traceAddress)
-		action := fromTrace.Action
+	case vm.SLOAD:
+		if stackLen := len(stack.Data()); stackLen >= 1 {
+			ot.addStorageAccess(StorageAccess{Op: op.String(), Key: common.Hash(stack.Data()[stackLen-1].Bytes32())})
+		}
 
-		from := contract.Address()
-		traceAction := NewTAction(nil, nil, 0, nil, action.Value, nil)
-		traceAction.Address = &from
-		// set refund values
-		refundAddress := common.BytesToAddress(stackPeek(stack.Data(), 0).Bytes())
-		traceAction.RefundAddress = &refundAddress
-		// Add `balance` field for convenient usage, set to 0x0
-		traceAction.Balance = (*hexutil.Big)(big.NewInt(0))
-		trace.Action = *traceAction
-		fromTrace.childTraces = append(fromTrace.childTraces, trace)
 	case vm.SSTORE:
 		stackLen := len(stack.Data())
+		if stackLen >= 2 && ot.storageOn {
+			value := common.Hash(stack.Data()[stackLen-2].Bytes32())
+			ot.addStorageAccess(StorageAccess{Op: op.String(), Key: common.Hash(stack.Data()[stackLen-1].Bytes32()), Value: &value})
+		}
 		if stackLen >= 2 && ot.store == nil {
 			accountAddress := contract.Address()
 			if ot.stateDiff[accountAddress] == nil {
@@ -308,10 +377,106 @@ func (ot *OeTracer) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64, scop
 				diff.AfterValue = &afterValue
 			}
 		}
+
+	case vm.TLOAD, vm.TSTORE:
+		stackLen := len(stack.Data())
+		if stackLen < 1 || (op == vm.TSTORE && stackLen < 2) {
+			return
+		}
+		access := TransientAccess{
+			TraceAddress: slices.Clone(ot.traceHolder.Stack[len(ot.traceHolder.Stack)-1].TraceAddress),
+			Op:           op.String(),
+			Address:      contract.Address(),
+			Slot:         common.Hash(stack.Data()[stackLen-1].Bytes32()),
+		}
+		if op == vm.TSTORE {
+			access.Value = common.Hash(stack.Data()[stackLen-2].Bytes32())
+		} else {
+			access.Value = ot.env.StateDB.GetTransientState(access.Address, access.Slot)
+		}
+		ot.transient = append(ot.transient, access)
+	}
+}
+
+// createCollides tells whether the CREATE or CREATE2 about to run deploys to an address already holding a
+// contract, the evm fails such creates before entering them. The op must not have failed before it ran.
+func (ot *OeTracer) createCollides(op vm.OpCode, stackData []uint256.Int, memory []byte, caller common.Address) bool {
+	var addr common.Address
+	if op == vm.CREATE {
+		addr = crypto.CreateAddress(caller, ot.env.StateDB.GetNonce(caller))
+	} else {
+		initCode := memoryCopy(memory, stackPeek(stackData, 1), stackPeek(stackData, 2), nil)
+		if initCode == nil && stackPeek(stackData, 2).Sign() != 0 {
+			// beyond what the tracer copies, the init code is larger than any create is allowed
+			return false
+		}
+		addr = crypto.CreateAddress2(caller, common.BigToHash(stackPeek(stackData, 3)), crypto.Keccak256(initCode))
 	}
+	codeHash := ot.env.StateDB.GetCodeHash(addr)
+	return ot.env.StateDB.GetNonce(addr) != 0 || (codeHash != (common.Hash{}) && codeHash != types.EmptyCodeHash)
+}
+
+// addStorageAccess appends an SLOAD or SSTORE to the accesses of the frame running it
+func (ot *OeTracer) addStorageAccess(access StorageAccess) {
+	frame := ot.traceHolder.Stack[len(ot.traceHolder.Stack)-1]
+	frame.Action.StorageAccesses = append(frame.Action.StorageAccesses, access)
+}
+
+// callGas estimates the gas given to the callee of a CALL family op from the requested gas, the cost of
+// the op already includes the callee's gas. The estimate is only kept when the call fails before entering
+// the callee, otherwise CaptureEnter replaces it with the exact gas.
+func callGas(requested, value *big.Int, gas, cost uint64) uint64 {
+	var forwarded uint64
+	if req := requested.Uint64(); requested.IsUint64() && req <= cost && cost <= gas && forwardedGas(gas-(cost-req), req) == req {
+		forwarded = req
+	} else if gas > cost {
+		// capped, the op costs all but available/64 of the gas, so the callee gets 63 times the rest
+		forwarded = (gas - cost) * 63
+	}
+	if value.Sign() != 0 {
+		forwarded += params.CallStipend
+	}
+	return forwarded
 }
 
+// CaptureEnter fills the gas actually given to the callee, after the 63/64 cap and the value stipend, into
+// the call/create trace CaptureState just created. A SELFDESTRUCT is traced here, see selfDestructEnter.
 func (ot *OeTracer) CaptureEnter(typ vm.OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
+	if typ == vm.SELFDESTRUCT {
+		ot.selfDestructEnter(from, to, value)
+		return
+	}
+	if !ot.enterPending {
+		return
+	}
+	ot.enterPending = false
+	ot.traceHolder.Stack[len(ot.traceHolder.Stack)-1].Action.Gas = hexutil.Uint64(gas)
+}
+
+// selfDestructEnter adds the suicide trace of the current frame, the evm only enters SELFDESTRUCT once the op
+// ran, so a SELFDESTRUCT failing in a static context leaves no trace. The trace takes the next trace address
+// among its siblings like calls and creates, but no depth state is pushed as it has no sub traces.
+func (ot *OeTracer) selfDestructEnter(address, refundAddress common.Address, balance *big.Int) {
+	if len(ot.state) == 0 || len(ot.traceHolder.Stack) == 0 {
+		return
+	}
+	ot.traceAddress = addTraceAddress(ot.traceAddress, lastState(ot.state).level+1)
+	fromTrace := ot.traceHolder.Stack[len(ot.traceHolder.Stack)-1]
+	trace := NewActionTraceFromTrace(fromTrace, SELFDESTRUCT, ot.traceAddress)
+	ot.traceAddress = trace.TraceAddress
+	traceAction := NewTAction(nil, nil, 0, nil, fromTrace.Action.Value, nil)
+	traceAction.Address = &address
+	traceAction.RefundAddress = &refundAddress
+	// the balance the contract held before the op, sent to the refund address. That's the whole balance before
+	// and after Cancun, whether the account is deleted or only emptied
+	traceAction.Balance = (*hexutil.Big)(new(big.Int).Set(balance))
+	// since Cancun only the accounts created in the tx are deleted
+	if ot.cancun {
+		destroyed := ot.env.StateDB.HasSelfDestructed(address)
+		traceAction.Destroyed = &destroyed
+	}
+	trace.Action = *traceAction
+	fromTrace.childTraces = append(fromTrace.childTraces, trace)
 }
 
 func (ot *OeTracer) CaptureExit(output []byte, gasUsed uint64, err error) {}
@@ -323,11 +488,10 @@ func (ot *OeTracer) CaptureEnd(output []byte, gasUsed uint64, err error) {
 		if ot.traceHolder.Actions[0].Result != nil {
 			ot.traceHolder.Actions[0].Result.GasUsed = hexutil.Uint64(gasUsed)
 		}
-		ot.traceHolder.lastTrace().Action.Gas = hexutil.Uint64(gasUsed)
-
 		ot.gasUsed = gasUsed
 	}
 	ot.output = output
+	ot.ended = true
 }
 
 // CaptureFault implements the Tracer interface to trace an execution fault
@@ -343,13 +507,39 @@ func (ot *OeTracer) CaptureTxEnd(restGas uint64) {
 
 }
 
-// Reset function to be able to reuse logger
-func (ot *OeTracer) reset() {
+// Reset clears all per-tx state to be able to reuse logger
+func (ot *OeTracer) Reset() {
+	ot.resetExecution()
 	ot.to = nil
 	ot.from = nil
-	ot.inputData = nil
+	ot.newAddress = nil
+	ot.blockHash = common.Hash{}
+	ot.blockNumber = big.Int{}
+	ot.tx = common.Hash{}
+	ot.txIndex = 0
+	ot.value = big.Int{}
+}
+
+// resetExecution clears the state left by the evm run, the message fields are kept
+func (ot *OeTracer) resetExecution() {
+	ot.gasUsed = 0
 	ot.traceHolder = nil
+	ot.inputData = nil
+	ot.state = nil
+	ot.traceAddress = nil
+	ot.stack = make([]*big.Int, 30)
 	ot.reverted = false
+	ot.output = nil
+	ot.err = nil
+	ot.stateDiff = make(StateDiff)
+	ot.env = nil
+	ot.enterPending = false
+	ot.ended = false
+	ot.finalized = false
+	if ot.gasByOpcode != nil {
+		ot.gasByOpcode = make(map[vm.OpCode]uint64)
+	}
+	ot.transient = nil
 }
 
 // SetMessage basic setter that fill block and tx info into tracer.
@@ -363,6 +553,66 @@ func (ot *OeTracer) SetMessage(blockNr *big.Int, blockHash common.Hash, tx commo
 	ot.value = value
 }
 
+// SetWriteTimeout bounds how long PersistTrace and its variants wait for the store when the context they
+// are given has no deadline of its own, e.g. context.Background, 0 means unbounded. It survives Reset.
+func (ot *OeTracer) SetWriteTimeout(timeout time.Duration) {
+	ot.writeTimeout = timeout
+}
+
+// SetGasByOpcode enables or disables aggregating the gas cost of every executed opcode, it costs nothing
+// when disabled. The cost of CALL family ops includes the gas forwarded to the callee.
+func (ot *OeTracer) SetGasByOpcode(enabled bool) {
+	switch {
+	case !enabled:
+		ot.gasByOpcode = nil
+	case ot.gasByOpcode == nil:
+		ot.gasByOpcode = make(map[vm.OpCode]uint64)
+	}
+}
+
+// GasByOpcode returns the gas cost aggregated by opcode, nil if SetGasByOpcode wasn't enabled.
+func (ot *OeTracer) GasByOpcode() map[vm.OpCode]uint64 {
+	return ot.gasByOpcode
+}
+
+// SetStorageAccesses enables or disables recording the SLOAD and SSTORE ops of every frame in the
+// StorageAccesses of its action, e.g. to debug a contract without the state diff. Off by default, the
+// call traces are the same either way.
+func (ot *OeTracer) SetStorageAccesses(enabled bool) {
+	ot.storageOn = enabled
+}
+
+// SetTransientStorage enables or disables recording the TLOAD and TSTORE ops of the txs, e.g. to debug the
+// reentrancy locks relying on transient storage. They don't show in the state diff as transient storage is
+// discarded at the end of the tx, so are the accesses recorded when the tracer moves to the next tx.
+func (ot *OeTracer) SetTransientStorage(enabled bool) {
+	ot.transientOn = enabled
+}
+
+// TransientStorage returns the transient storage accesses of the tx in execution order, along with the trace
+// address of the frame making them. The writes of a frame are rolled back if it fails, they're still listed.
+func (ot *OeTracer) TransientStorage() []TransientAccess {
+	return ot.transient
+}
+
+// TopOpcodes returns the n opcodes costing the most gas in descending order, ties are ordered by opcode.
+func (ot *OeTracer) TopOpcodes(n int) []OpcodeGas {
+	top := make([]OpcodeGas, 0, len(ot.gasByOpcode))
+	for op, gas := range ot.gasByOpcode {
+		top = append(top, OpcodeGas{Op: op, Gas: gas})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Gas != top[j].Gas {
+			return top[i].Gas > top[j].Gas
+		}
+		return top[i].Op < top[j].Op
+	})
+	if n >= 0 && n < len(top) {
+		top = top[:n]
+	}
+	return top
+}
+
 // SetTx basic setter
 func (ot *OeTracer) SetTx(tx common.Hash) {
 	ot.tx = tx
@@ -408,23 +658,49 @@ func (ot *OeTracer) SetGasUsed(gasUsed uint64) {
 	ot.gasUsed = gasUsed
 }
 
-// Finalize finalizes trace process and stores result into key-value persistent store
+// Finalize sets the gas used of the top-level trace and flattens the trace tree into the result. It's
+// idempotent, called again it only updates the gas used, e.g. after SetGasUsed. GetResult, FinalizedResult
+// and PersistTrace finalize the traces of an ended execution themselves.
 func (ot *OeTracer) Finalize() {
-	if ot.traceHolder != nil {
-		ot.traceHolder.lastTrace().Action.Gas = hexutil.Uint64(ot.gasUsed)
-		if ot.traceHolder.lastTrace().Result != nil {
-			ot.traceHolder.lastTrace().Result.GasUsed = hexutil.Uint64(ot.gasUsed)
-		}
+	if ot.traceHolder == nil || len(ot.traceHolder.Actions) == 0 {
+		return
+	}
+	// the top-level trace comes first, its sub traces are appended by the flattening
+	if root := &ot.traceHolder.Actions[0]; root.Result != nil {
+		root.Result.GasUsed = hexutil.Uint64(ot.gasUsed)
+	}
+	if !ot.finalized {
 		ot.traceHolder.processLastTrace()
+		ot.finalized = true
 	}
 }
 
-// PersistTrace save traced tx result to underlying k-v store.
+// PersistTrace is PersistTraceContext with the background context, only bounded by SetWriteTimeout, its
+// error is logged and dropped.
+//
+// Deprecated: use PersistTraceContext.
 func (ot *OeTracer) PersistTrace() {
+	if err := ot.PersistTraceContext(context.Background()); err != nil {
+		log.Warn("Tx trace not persisted", "txHash", ot.tx.String(), "err", err)
+	}
+}
+
+// PersistTraceContext save traced tx result to underlying k-v store, the tracer is reset once it succeeded.
+// Errors wrap ErrTraceEncode or ErrTraceWrite, the write is given up once ctx is done.
+func (ot *OeTracer) PersistTraceContext(ctx context.Context) error {
+	return ot.PersistTraceWithRetry(ctx, 1, 0)
+}
+
+// PersistTraceWithRetry is PersistTraceContext retrying failed writes to the store, up to attempts writes
+// are made with backoff between them. It gives up waiting once ctx is done and returns its error.
+func (ot *OeTracer) PersistTraceWithRetry(ctx context.Context, attempts int, backoff time.Duration) error {
 	if ot.traceHolder == nil {
 		ot.traceHolder = &CallTrace{}
 		ot.traceHolder.AddTrace(GetErrorTrace(ot.blockHash, ot.blockNumber, ot.to, ot.tx, ot.gasUsed, ot.err))
-
+		ot.finalized = true
+	}
+	if ot.ended {
+		ot.Finalize()
 	}
 
 	if ot.store != nil {
@@ -432,24 +708,45 @@ func (ot *OeTracer) PersistTrace() {
 		var actions ActionTraces = ot.traceHolder.Actions
 		if len(actions) == 0 {
 			log.Warn("Empty tx trace found", "txHash", ot.tx.String())
-			return
+			return nil
 		}
 		tracesBytes, err := rlp.EncodeToBytes(&actions)
 		if err != nil {
 			log.Error("Failed to encode tx trace", "txHash", ot.tx.String(), "err", err.Error())
-			return
+			return fmt.Errorf("%w: %v", ErrTraceEncode, err)
 		}
-		if err := ot.store.WriteTxTrace(context.Background(), ot.tx, tracesBytes); err != nil {
-			log.Error("Failed to persist tx trace to database", "txHash", ot.tx.String(), "err", err.Error())
-			return
+		if _, ok := ctx.Deadline(); !ok && ot.writeTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, ot.writeTimeout)
+			defer cancel()
+		}
+		for attempt := 1; ; attempt++ {
+			err = ot.store.WriteTxTrace(ctx, ot.tx, tracesBytes)
+			if err == nil {
+				break
+			}
+			log.Error("Failed to persist tx trace to database", "txHash", ot.tx.String(), "attempt", attempt, "err", err.Error())
+			if attempt >= attempts {
+				return fmt.Errorf("%w: %w", ErrTraceWrite, err)
+			}
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("%w: %w", ErrTraceWrite, ctx.Err())
+			case <-time.After(backoff):
+			}
 		}
 		log.Debug("Persist tx trace to database", "txHash", ot.tx.String(), "bytes", len(tracesBytes))
 	}
-	ot.reset()
+	ot.Reset()
+	return nil
 }
 
-// GetResult returns action traces after recording evm process
+// GetResult returns action traces after recording evm process, the traces of an ended execution are
+// finalized first. Before the end, only the top-level trace is returned.
 func (ot *OeTracer) GetResult() *[]ActionTrace {
+	if ot.ended {
+		ot.Finalize()
+	}
 	if ot.traceHolder != nil {
 		return &ot.traceHolder.Actions
 	}
@@ -457,6 +754,15 @@ func (ot *OeTracer) GetResult() *[]ActionTrace {
 	return &empty
 }
 
+// FinalizedResult returns the finalized action traces like GetResult, or ErrTraceIncomplete if the
+// execution didn't end.
+func (ot *OeTracer) FinalizedResult() ([]ActionTrace, error) {
+	if !ot.ended {
+		return nil, fmt.Errorf("%w: tx %s", ErrTraceIncomplete, ot.tx.String())
+	}
+	return *ot.GetResult(), nil
+}
+
 func (ot *OeTracer) GetStateDiff() StateDiff {
 	return ot.stateDiff
 }
@@ -504,7 +810,9 @@ func NewActionTrace(bHash common.Hash, bNumber big.Int, tHash common.Hash, tPos
 }
 
 // NewActionTraceFromTrace creates new instance of type ActionTrace
-// based on another trace
+// based on another trace, its parent. The trace address must be the parent's one extended by the index
+// of the new trace among the parent's children, a corrupted one is logged and replaced by the right one,
+// builds with the tracedebug tag panic instead.
 func NewActionTraceFromTrace(actionTrace *ActionTrace, tType string, traceAddress []uint32) *ActionTrace {
 	trace := NewActionTrace(
 		actionTrace.BlockHash,
@@ -512,16 +820,36 @@ func NewActionTraceFromTrace(actionTrace *ActionTrace, tType string, traceAddres
 		actionTrace.TransactionHash,
 		actionTrace.TransactionPosition,
 		tType)
+	if want := childTraceAddress(actionTrace); !slices.Equal(traceAddress, want) {
+		if traceDebug {
+			panic(fmt.Sprintf("corrupted trace address %v of tx %s, want %v", traceAddress, actionTrace.TransactionHash.String(), want))
+		}
+		log.Error("Corrupted trace address", "txHash", actionTrace.TransactionHash.String(), "have", traceAddress, "want", want)
+		traceAddress = want
+	}
 	trace.TraceAddress = traceAddress
 	return trace
 }
 
+// childTraceAddress returns the trace address of the next child of the trace
+func childTraceAddress(parent *ActionTrace) []uint32 {
+	traceAddress := make([]uint32, len(parent.TraceAddress), len(parent.TraceAddress)+1)
+	copy(traceAddress, parent.TraceAddress)
+	return append(traceAddress, uint32(len(parent.childTraces)))
+}
+
 const (
 	CALL         = "call"
 	CREATE       = "create"
 	SELFDESTRUCT = "suicide"
 )
 
+// Opcodes a create action is made by, parity reports both as CREATE
+const (
+	CreateMethodCreate  = "create"
+	CreateMethodCreate2 = "create2"
+)
+
 // ActionTrace represents single interaction with blockchain
 type ActionTrace struct {
 	childTraces  []*ActionTrace
@@ -567,6 +895,18 @@ type TAction struct {
 	Address       *common.Address `json:"address,omitempty"`
 	RefundAddress *common.Address `json:"refundAddress,omitempty"`
 	Balance       *hexutil.Big    `json:"balance,omitempty"`
+	CreateMethod  string          `json:"createMethod,omitempty"` // CREATE only, "create" or "create2"
+	Destroyed     *bool           `json:"destroyed,omitempty"`    // SELFDESTRUCT since Cancun only, whether the account was deleted
+
+	StorageAccesses []StorageAccess `json:"storageAccesses,omitempty"` // only recorded when enabled by SetStorageAccesses
+}
+
+// StorageAccess is an SLOAD or SSTORE of the storage of the frame, in execution order. The writes of a frame
+// which fails are rolled back, they're still listed.
+type StorageAccess struct {
+	Op    string       `json:"op"` // "SLOAD" or "SSTORE"
+	Key   common.Hash  `json:"key"`
+	Value *common.Hash `json:"value,omitempty" rlp:"nil"` // written by SSTORE, nil for SLOAD
 }
 
 // TResult holds information related to result of the
@@ -620,11 +960,13 @@ func removeTraceAddressLevel(traceAddress []uint32, depth int) []uint32 {
 // across result traces
 func (callTrace *CallTrace) processLastTrace() {
 	trace := &callTrace.Actions[len(callTrace.Actions)-1]
-	callTrace.processTrace(trace)
+	callTrace.processTrace(trace, false)
 }
 
-// processTrace goes through all trace results and sets info
-func (callTrace *CallTrace) processTrace(trace *ActionTrace) {
+// processTrace goes through all trace results and sets info, rolledBack tells whether an ancestor of the
+// trace failed
+func (callTrace *CallTrace) processTrace(trace *ActionTrace, rolledBack bool) {
+	rolledBack = rolledBack || trace.Error != ""
 	trace.Subtraces = uint64(len(trace.childTraces))
 	for _, childTrace := range trace.childTraces {
 		// if CALL == trace.TraceType {
@@ -635,20 +977,18 @@ func (callTrace *CallTrace) processTrace(trace *ActionTrace) {
 		// 	}
 		// }
 
-		if childTrace.Result != nil {
-			if trace.Action.Gas > childTrace.Result.GasUsed {
-				childTrace.Action.Gas = trace.Action.Gas - childTrace.Result.GasUsed
-			} else {
-				childTrace.Action.Gas = childTrace.Result.GasUsed
-			}
-		}
+		// the gas of calls and creates is the gas forwarded to the callee, filled by CaptureEnter
 		if childTrace.TraceType == SELFDESTRUCT {
 			childTrace.Action.Gas = 0
 			childTrace.Action.From = nil
 			childTrace.Result = nil
+			// a suicide has no result of its own, the revert of the enclosing frames undid it
+			if rolledBack {
+				childTrace.Error = "Reverted"
+			}
 		}
 		callTrace.AddTrace(childTrace)
-		callTrace.processTrace(callTrace.lastTrace())
+		callTrace.processTrace(callTrace.lastTrace(), rolledBack)
 	}
 }
 
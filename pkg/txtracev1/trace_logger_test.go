@@ -1,7 +1,10 @@
 package txtracev1
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/big"
@@ -9,6 +12,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 	"unicode"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -17,8 +21,11 @@ import (
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/tests"
+	"github.com/holiman/uint256"
 )
 
 type callContext struct {
@@ -27,6 +34,34 @@ type callContext struct {
 	Time       math.HexOrDecimal64   `json:"timestamp"`
 	GasLimit   math.HexOrDecimal64   `json:"gasLimit"`
 	Miner      common.Address        `json:"miner"`
+	BaseFee    *math.HexOrDecimal256 `json:"baseFeePerGas"` // since London
+	Random     *common.Hash          `json:"random"`        // PREVRANDAO since the merge
+}
+
+// blockContext returns the block context of the fixture. The base fee defaults to the initial one of London
+// when it's active, the random value to zero once the merge happened, the evm needs both then.
+func (c *callContext) blockContext(config *params.ChainConfig) vm.BlockContext {
+	blkContext := vm.BlockContext{
+		CanTransfer: core.CanTransfer,
+		Transfer:    core.Transfer,
+		Coinbase:    c.Miner,
+		GasLimit:    uint64(c.GasLimit),
+		BlockNumber: new(big.Int).SetUint64(uint64(c.Number)),
+		Time:        uint64(c.Time),
+		Difficulty:  (*big.Int)(c.Difficulty),
+		BaseFee:     (*big.Int)(c.BaseFee),
+		Random:      c.Random,
+	}
+	if blkContext.BaseFee == nil && config.IsLondon(blkContext.BlockNumber) {
+		blkContext.BaseFee = big.NewInt(params.InitialBaseFee)
+	}
+	if blkContext.Random == nil && config.TerminalTotalDifficultyPassed {
+		blkContext.Random = &common.Hash{}
+	}
+	if blkContext.Difficulty == nil {
+		blkContext.Difficulty = new(big.Int)
+	}
+	return blkContext
 }
 
 // callTracerTest defines a single test to check the call tracer against.
@@ -66,46 +101,39 @@ func TestCallTracer(t *testing.T) {
 			if err := rlp.DecodeBytes(common.FromHex(test.Input), tx); err != nil {
 				t.Fatalf("failed to parse testcase input: %v", err)
 			}
-			signer := types.MakeSigner(test.Genesis.Config, new(big.Int).SetUint64(uint64(test.Context.Number)))
+			signer := types.MakeSigner(test.Genesis.Config, new(big.Int).SetUint64(uint64(test.Context.Number)), uint64(test.Context.Time))
 			origin, _ := signer.Sender(tx)
 
-			blkContext := vm.BlockContext{
-				CanTransfer: core.CanTransfer,
-				Transfer:    core.Transfer,
-				Coinbase:    test.Context.Miner,
-				GasLimit:    uint64(test.Context.GasLimit),
-				BlockNumber: new(big.Int).SetUint64(uint64(test.Context.Number)),
-				Time:        new(big.Int).SetUint64(uint64(test.Context.Time)),
-				Difficulty:  (*big.Int)(test.Context.Difficulty),
+			blkContext := test.Context.blockContext(test.Genesis.Config)
+			msg, err := core.TransactionToMessage(tx, signer, blkContext.BaseFee)
+			if err != nil {
+				t.Fatalf("failed to prepare transaction for tracing: %v", err)
 			}
 			txContext := vm.TxContext{
 				Origin:   origin,
-				GasPrice: tx.GasPrice(),
+				GasPrice: msg.GasPrice, // the effective gas price since London
 			}
 
-			_, statedb := tests.MakePreState(rawdb.NewMemoryDatabase(), test.Genesis.Alloc, false)
+			state := tests.MakePreState(rawdb.NewMemoryDatabase(), test.Genesis.Alloc, false, rawdb.HashScheme)
+			defer state.Close()
+			statedb := state.StateDB
 
 			// Create the tracer, the EVM environment and run it
 			tracer := NewOeTracer(nil)
 
-			evm := vm.NewEVM(blkContext, txContext, statedb, test.Genesis.Config, vm.Config{Debug: true, Tracer: tracer})
-
-			msg, err := tx.AsMessage(signer, nil)
-			if err != nil {
-				t.Fatalf("failed to prepare transaction for tracing: %v", err)
-			}
+			evm := vm.NewEVM(blkContext, txContext, statedb, test.Genesis.Config, vm.Config{Tracer: tracer})
 
 			tracer.SetMessage(
 				new(big.Int).SetUint64(uint64(test.Context.Number)), /* blockNumber */
 				common.Hash{}, /* blockHash */
 				tx.Hash(),
 				0, /* txIndex */
-				msg.From(),
-				msg.To(),
-				*msg.Value(),
+				msg.From,
+				msg.To,
+				*msg.Value,
 			)
 
-			fmt.Println(msg.From(), msg.To(), msg.Nonce(), msg.Value(), msg.GasPrice(), msg.Gas(), string(msg.Data()))
+			fmt.Println(msg.From, msg.To, msg.Nonce, msg.Value, msg.GasPrice, msg.GasLimit, string(msg.Data))
 			st := core.NewStateTransition(evm, msg, new(core.GasPool).AddGas(tx.Gas()))
 			if _, err = st.TransitionDb(); err != nil {
 				t.Fatalf("failed to execute transaction: %v", err)
@@ -128,6 +156,204 @@ func TestCallTracer(t *testing.T) {
 	}
 }
 
+var (
+	reuseSender   = common.HexToAddress("0x1000000000000000000000000000000000000001")
+	revertingAddr = common.HexToAddress("0x2000000000000000000000000000000000000002")
+	stoppingAddr  = common.HexToAddress("0x3000000000000000000000000000000000000003")
+)
+
+// traceMessage runs a plain call to `to` with the given tracer and returns the finalized traces
+func traceMessage(t *testing.T, tracer *OeTracer, statedb vm.StateDB, to common.Address, nonce uint64, txHash common.Hash, persist bool) []ActionTrace {
+	return traceMessageWithGas(t, tracer, statedb, to, nonce, 100_000, txHash, persist)
+}
+
+// traceMessageWithGas traces a call of to like traceMessage, with the given gas limit
+func traceMessageWithGas(t *testing.T, tracer *OeTracer, statedb vm.StateDB, to common.Address, nonce, gasLimit uint64, txHash common.Hash, persist bool) []ActionTrace {
+	blkContext := vm.BlockContext{
+		CanTransfer: core.CanTransfer,
+		Transfer:    core.Transfer,
+		GasLimit:    10_000_000,
+		BlockNumber: big.NewInt(1),
+		Difficulty:  big.NewInt(1),
+		BaseFee:     big.NewInt(0),
+	}
+	msg := &core.Message{
+		From:      reuseSender,
+		To:        &to,
+		Nonce:     nonce,
+		Value:     big.NewInt(0),
+		GasLimit:  gasLimit,
+		GasPrice:  big.NewInt(0),
+		GasFeeCap: big.NewInt(0),
+		GasTipCap: big.NewInt(0),
+	}
+	evm := vm.NewEVM(blkContext, core.NewEVMTxContext(msg), statedb, params.AllEthashProtocolChanges, vm.Config{Tracer: tracer, NoBaseFee: true})
+	tracer.SetMessage(big.NewInt(1), common.Hash{}, txHash, uint(nonce), msg.From, msg.To, *msg.Value)
+	if _, err := core.ApplyMessage(evm, msg, new(core.GasPool).AddGas(msg.GasLimit)); err != nil {
+		t.Fatalf("failed to execute transaction: %v", err)
+	}
+	tracer.Finalize()
+	res := append([]ActionTrace{}, *tracer.GetResult()...)
+	if persist {
+		tracer.PersistTrace()
+	}
+	return res
+}
+
+func TestReusedTracer(t *testing.T) {
+	for _, persist := range []bool{true, false} {
+		alloc := types.GenesisAlloc{
+			reuseSender:   {Balance: big.NewInt(1_000_000_000)},
+			revertingAddr: {Code: common.FromHex("0x60006000fd")}, // PUSH1 0 PUSH1 0 REVERT
+			stoppingAddr:  {Code: common.FromHex("0x00")},         // STOP
+		}
+		state := tests.MakePreState(rawdb.NewMemoryDatabase(), alloc, false, rawdb.HashScheme)
+		freshState := tests.MakePreState(rawdb.NewMemoryDatabase(), alloc, false, rawdb.HashScheme)
+
+		tracer := NewOeTracer(nil)
+		first := traceMessage(t, tracer, state.StateDB, revertingAddr, 0, common.HexToHash("0x01"), persist)
+		if first[0].Error != "Reverted" {
+			t.Fatalf("persist=%v: expected first tx to revert, have %q", persist, first[0].Error)
+		}
+		// a different gas limit, the gas of the first tx can't show through
+		second := traceMessageWithGas(t, tracer, state.StateDB, stoppingAddr, 1, 90_000, common.HexToHash("0x02"), persist)
+
+		// the same call traced by a fresh tracer is the reference
+		freshState.StateDB.SetNonce(reuseSender, 1)
+		want := traceMessageWithGas(t, NewOeTracer(nil), freshState.StateDB, stoppingAddr, 1, 90_000, common.HexToHash("0x02"), persist)
+
+		for _, trace := range second {
+			if trace.Error != "" || trace.Result == nil {
+				t.Fatalf("persist=%v: stale error in second tx trace: %q", persist, trace.Error)
+			}
+			if trace.Action.Gas == first[0].Action.Gas || trace.Result.GasUsed == first[0].Action.Gas {
+				t.Fatalf("persist=%v: stale gas in second tx trace: %d", persist, trace.Action.Gas)
+			}
+		}
+		if !jsonEqual(second, want) {
+			jsonDiff(t, second, want)
+		}
+		state.Close()
+		freshState.Close()
+	}
+}
+
+func TestGasByOpcode(t *testing.T) {
+	alloc := types.GenesisAlloc{
+		reuseSender:   {Balance: big.NewInt(1_000_000_000)},
+		revertingAddr: {Code: common.FromHex("0x60006000fd")}, // PUSH1 0 PUSH1 0 REVERT
+	}
+	state := tests.MakePreState(rawdb.NewMemoryDatabase(), alloc, false, rawdb.HashScheme)
+	defer state.Close()
+
+	tracer := NewOeTracer(nil)
+	traceMessage(t, tracer, state.StateDB, revertingAddr, 0, common.HexToHash("0x01"), false)
+	if tracer.GasByOpcode() != nil {
+		t.Fatalf("gas aggregated while disabled")
+	}
+
+	tracer.SetGasByOpcode(true)
+	traceMessage(t, tracer, state.StateDB, revertingAddr, 1, common.HexToHash("0x02"), false)
+	want := map[vm.OpCode]uint64{vm.PUSH1: 6, vm.REVERT: 0}
+	if have := tracer.GasByOpcode(); !reflect.DeepEqual(have, want) {
+		t.Fatalf("gas by opcode mismatch: have %v, want %v", have, want)
+	}
+	if have, want := tracer.TopOpcodes(1), []OpcodeGas{{Op: vm.PUSH1, Gas: 6}}; !reflect.DeepEqual(have, want) {
+		t.Fatalf("top opcodes mismatch: have %v, want %v", have, want)
+	}
+	if have := tracer.TopOpcodes(10); len(have) != 2 || have[1].Op != vm.REVERT {
+		t.Fatalf("top opcodes mismatch: have %v", have)
+	}
+}
+
+// enterRecorder records the gas the evm actually gives to every callee
+type enterRecorder struct {
+	*OeTracer
+	gas []uint64
+}
+
+func (r *enterRecorder) CaptureEnter(typ vm.OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
+	r.gas = append(r.gas, gas)
+	r.OeTracer.CaptureEnter(typ, from, to, input, gas, value)
+}
+
+func TestForwardedGas(t *testing.T) {
+	var (
+		caller = common.HexToAddress("0x4000000000000000000000000000000000000004")
+		callee = common.HexToAddress("0x5000000000000000000000000000000000000005")
+	)
+	code := "0x" +
+		"60006000600060006001" + "73" + callee.Hex()[2:] + "63ffffffff" + "f150" + // CALL with value and 0xffffffff gas, above the available gas
+		"6000600060006000" + "73" + callee.Hex()[2:] + "611000" + "fa50" + // STATICCALL with 0x1000 gas
+		"600060006000" + "f050" + // CREATE with empty init code
+		"00"
+	alloc := types.GenesisAlloc{
+		reuseSender: {Balance: big.NewInt(1_000_000_000)},
+		caller:      {Code: common.FromHex(code), Balance: big.NewInt(1)},
+		callee:      {Code: common.FromHex("0x00")},
+	}
+	state := tests.MakePreState(rawdb.NewMemoryDatabase(), alloc, false, rawdb.HashScheme)
+	defer state.Close()
+
+	recorder := &enterRecorder{OeTracer: NewOeTracer(nil)}
+	msg := &core.Message{
+		From:      reuseSender,
+		To:        &caller,
+		Value:     big.NewInt(0),
+		GasLimit:  100_000,
+		GasPrice:  big.NewInt(0),
+		GasFeeCap: big.NewInt(0),
+		GasTipCap: big.NewInt(0),
+	}
+	blkContext := vm.BlockContext{
+		CanTransfer: core.CanTransfer,
+		Transfer:    core.Transfer,
+		GasLimit:    10_000_000,
+		BlockNumber: big.NewInt(1),
+		Difficulty:  big.NewInt(1),
+		BaseFee:     big.NewInt(0),
+	}
+	evm := vm.NewEVM(blkContext, core.NewEVMTxContext(msg), state.StateDB, params.AllEthashProtocolChanges, vm.Config{Tracer: recorder, NoBaseFee: true})
+	recorder.SetMessage(big.NewInt(1), common.Hash{}, common.HexToHash("0x01"), 0, msg.From, msg.To, *msg.Value)
+	if _, err := core.ApplyMessage(evm, msg, new(core.GasPool).AddGas(msg.GasLimit)); err != nil {
+		t.Fatalf("failed to execute transaction: %v", err)
+	}
+	recorder.Finalize()
+	traces := *recorder.GetResult()
+
+	if len(traces) != 4 || len(recorder.gas) != 3 {
+		t.Fatalf("trace count mismatch: have %d traces and %d callees, want %d and %d", len(traces), len(recorder.gas), 4, 3)
+	}
+	for i, trace := range traces[1:] {
+		if uint64(trace.Action.Gas) != recorder.gas[i] {
+			t.Errorf("trace %v: gas mismatch: have %d, want %d", trace.TraceAddress, trace.Action.Gas, recorder.gas[i])
+		}
+	}
+	// the requested gas is capped to 63/64 of the available, plus the stipend of the value transfer
+	if gas := uint64(traces[1].Action.Gas); gas >= 0xffffffff || gas <= params.CallStipend || gas >= msg.GasLimit*63/64+params.CallStipend {
+		t.Errorf("capped call gas out of range: %d", gas)
+	}
+	if gas := uint64(traces[2].Action.Gas); gas != 0x1000 {
+		t.Errorf("static call gas mismatch: have %d, want %d", gas, 0x1000)
+	}
+}
+
+func TestCallGasEstimate(t *testing.T) {
+	tests := []struct {
+		requested, value *big.Int
+		gas, cost, want  uint64
+	}{
+		{big.NewInt(1000), big.NewInt(0), 10_000, 1100, 1000},                      // below the cap
+		{big.NewInt(1000), big.NewInt(1), 10_000, 1100, 1000 + params.CallStipend}, // value transfers add the stipend
+		{new(big.Int).Lsh(big.NewInt(1), 100), big.NewInt(0), 6500, 6400, 6300},    // 100 overhead, 6300 is 63/64 of the rest
+	}
+	for i, test := range tests {
+		if have := callGas(test.requested, test.value, test.gas, test.cost); have != test.want {
+			t.Errorf("test %d: call gas mismatch: have %d, want %d", i, have, test.want)
+		}
+	}
+}
+
 func jsonDiff(t *testing.T, x, y interface{}) {
 	xj, _ := json.Marshal(x)
 	yj, _ := json.Marshal(y)
@@ -365,3 +591,804 @@ func BenchmarkActionTraces_DecodeJSON(b *testing.B) {
 		}
 	}
 }
+
+func TestCreateMethod(t *testing.T) {
+	caller := common.HexToAddress("0x4000000000000000000000000000000000000004")
+	code := "0x" +
+		"600060006000" + "f050" + // CREATE with empty init code
+		"6000600060006000" + "f550" + // CREATE2 with empty init code and zero salt
+		"00"
+	alloc := types.GenesisAlloc{
+		reuseSender: {Balance: big.NewInt(1_000_000_000)},
+		caller:      {Code: common.FromHex(code)},
+	}
+	state := tests.MakePreState(rawdb.NewMemoryDatabase(), alloc, false, rawdb.HashScheme)
+	defer state.Close()
+
+	traces := traceMessage(t, NewOeTracer(nil), state.StateDB, caller, 0, common.HexToHash("0x01"), false)
+	want := []string{"", CreateMethodCreate, CreateMethodCreate2}
+	if len(traces) != len(want) {
+		t.Fatalf("trace count mismatch: have %d, want %d", len(traces), len(want))
+	}
+	for i, trace := range traces {
+		if trace.Action.CreateMethod != want[i] {
+			t.Errorf("trace %v: create method mismatch: have %q, want %q", trace.TraceAddress, trace.Action.CreateMethod, want[i])
+		}
+	}
+
+	// the create method survives the storage encoding
+	enc, err := rlp.EncodeToBytes(&traces[2])
+	if err != nil {
+		t.Fatalf("failed to encode trace: %v", err)
+	}
+	decoded := new(ActionTrace)
+	if err := rlp.DecodeBytes(enc, decoded); err != nil {
+		t.Fatalf("failed to decode trace: %v", err)
+	}
+	if decoded.Action.CreateMethod != CreateMethodCreate2 {
+		t.Fatalf("decoded create method mismatch: have %q, want %q", decoded.Action.CreateMethod, CreateMethodCreate2)
+	}
+}
+
+func TestCreateTxGas(t *testing.T) {
+	rules := params.AllEthashProtocolChanges.Rules(big.NewInt(1), false, 0)
+	cases := []struct {
+		name     string
+		init     []byte
+		gasLimit uint64 // 0 means the intrinsic gas exactly
+	}{
+		{"exhausted by intrinsic", nil, 0},
+		{"deploying", common.FromHex("0x60016000f3"), 100_000}, // returns one byte of zeroed memory as code
+	}
+	for _, test := range cases {
+		intrinsic, err := core.IntrinsicGas(test.init, nil, true, rules.IsHomestead, rules.IsIstanbul, rules.IsShanghai)
+		if err != nil {
+			t.Fatalf("%s: failed to compute intrinsic gas: %v", test.name, err)
+		}
+		gasLimit := test.gasLimit
+		if gasLimit == 0 {
+			gasLimit = intrinsic
+		}
+		state := tests.MakePreState(rawdb.NewMemoryDatabase(), types.GenesisAlloc{reuseSender: {Balance: big.NewInt(1_000_000_000)}}, false, rawdb.HashScheme)
+
+		tracer := NewOeTracer(nil)
+		msg := &core.Message{
+			From:      reuseSender,
+			Value:     big.NewInt(0),
+			GasLimit:  gasLimit,
+			GasPrice:  big.NewInt(0),
+			GasFeeCap: big.NewInt(0),
+			GasTipCap: big.NewInt(0),
+			Data:      test.init,
+		}
+		blkContext := vm.BlockContext{
+			CanTransfer: core.CanTransfer,
+			Transfer:    core.Transfer,
+			GasLimit:    10_000_000,
+			BlockNumber: big.NewInt(1),
+			Difficulty:  big.NewInt(1),
+			BaseFee:     big.NewInt(0),
+		}
+		evm := vm.NewEVM(blkContext, core.NewEVMTxContext(msg), state.StateDB, params.AllEthashProtocolChanges, vm.Config{Tracer: tracer, NoBaseFee: true})
+		// replays know the gas used of the receipt upfront
+		tracer.SetGasUsed(intrinsic)
+		tracer.SetMessage(big.NewInt(1), common.Hash{}, common.HexToHash("0x01"), 0, msg.From, nil, *msg.Value)
+		result, err := core.ApplyMessage(evm, msg, new(core.GasPool).AddGas(msg.GasLimit))
+		if err != nil {
+			t.Fatalf("%s: failed to execute transaction: %v", test.name, err)
+		}
+		state.Close()
+		if result.Failed() {
+			t.Fatalf("%s: create failed: %v", test.name, result.Err)
+		}
+		tracer.Finalize()
+		traces := *tracer.GetResult()
+		if len(traces) != 1 || traces[0].TraceType != CREATE {
+			t.Fatalf("%s: unexpected traces: %+v", test.name, traces)
+		}
+		if have, want := uint64(traces[0].Action.Gas), gasLimit-intrinsic; have != want {
+			t.Errorf("%s: root gas mismatch: have %d, want %d", test.name, have, want)
+		}
+	}
+}
+
+var errStoreUnavailable = errors.New("store temporarily unavailable")
+
+// flakyStore fails the first failures writes
+type flakyStore struct {
+	failures int
+	writes   int
+	data     map[common.Hash][]byte
+}
+
+func (s *flakyStore) ReadTxTrace(ctx context.Context, txHash common.Hash) ([]byte, error) {
+	return s.data[txHash], nil
+}
+
+func (s *flakyStore) WriteTxTrace(ctx context.Context, txHash common.Hash, trace []byte) error {
+	s.writes++
+	if s.writes <= s.failures {
+		return errStoreUnavailable
+	}
+	s.data[txHash] = trace
+	return nil
+}
+
+func TestPersistTraceRetry(t *testing.T) {
+	callee := common.HexToAddress("0x5000000000000000000000000000000000000005")
+	txHash := common.HexToHash("0x01")
+	// trace returns a tracer holding the traces of a call, which are yet to be persisted to store
+	trace := func(store Store) *OeTracer {
+		alloc := types.GenesisAlloc{
+			reuseSender: {Balance: big.NewInt(1_000_000_000)},
+			callee:      {Code: common.FromHex("0x00")},
+		}
+		state := tests.MakePreState(rawdb.NewMemoryDatabase(), alloc, false, rawdb.HashScheme)
+		defer state.Close()
+		tracer := NewOeTracer(store)
+		traceMessage(t, tracer, state.StateDB, callee, 0, txHash, false)
+		return tracer
+	}
+
+	// a single attempt reports the failure of the store
+	store := &flakyStore{failures: 1, data: make(map[common.Hash][]byte)}
+	tracer := trace(store)
+	err := tracer.PersistTraceContext(context.Background())
+	if !errors.Is(err, ErrTraceWrite) || !errors.Is(err, errStoreUnavailable) {
+		t.Fatalf("persist error mismatch: have %v, want %v wrapping %v", err, ErrTraceWrite, errStoreUnavailable)
+	}
+	if len(store.data) != 0 {
+		t.Fatalf("failed write stored traces")
+	}
+	// the traces are kept by a failed persist, so the caller can try again
+	if err := tracer.PersistTraceContext(context.Background()); err != nil {
+		t.Fatalf("failed to persist traces again: %v", err)
+	}
+	if len(store.data[txHash]) == 0 {
+		t.Fatalf("traces not stored by the second persist")
+	}
+
+	// the retry recovers on the second attempt
+	store = &flakyStore{failures: 1, data: make(map[common.Hash][]byte)}
+	if err := trace(store).PersistTraceWithRetry(context.Background(), 3, time.Millisecond); err != nil {
+		t.Fatalf("failed to persist traces with retry: %v", err)
+	}
+	if store.writes != 2 || len(store.data[txHash]) == 0 {
+		t.Fatalf("retry mismatch: have %d writes, stored %v", store.writes, len(store.data[txHash]) != 0)
+	}
+
+	// the retries give up after the last attempt
+	store = &flakyStore{failures: 5, data: make(map[common.Hash][]byte)}
+	if err := trace(store).PersistTraceWithRetry(context.Background(), 3, time.Millisecond); !errors.Is(err, ErrTraceWrite) || store.writes != 3 {
+		t.Fatalf("exhausted retry mismatch: have %v after %d writes, want %v after %d", err, store.writes, ErrTraceWrite, 3)
+	}
+
+	// and stop waiting once the context is done
+	store = &flakyStore{failures: 5, data: make(map[common.Hash][]byte)}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := trace(store).PersistTraceWithRetry(ctx, 3, time.Hour); !errors.Is(err, context.Canceled) || store.writes != 1 {
+		t.Fatalf("cancelled retry mismatch: have %v after %d writes, want %v after %d", err, store.writes, context.Canceled, 1)
+	}
+}
+
+// stalledStore blocks every write until the context is done
+type stalledStore struct {
+	flakyStore
+}
+
+func (s *stalledStore) WriteTxTrace(ctx context.Context, txHash common.Hash, trace []byte) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestPersistTraceContext(t *testing.T) {
+	callee := common.HexToAddress("0x5000000000000000000000000000000000000005")
+	txHash := common.HexToHash("0x01")
+	trace := func(store Store) *OeTracer {
+		alloc := types.GenesisAlloc{
+			reuseSender: {Balance: big.NewInt(1_000_000_000)},
+			callee:      {Code: common.FromHex("0x00")},
+		}
+		state := tests.MakePreState(rawdb.NewMemoryDatabase(), alloc, false, rawdb.HashScheme)
+		defer state.Close()
+		tracer := NewOeTracer(store)
+		traceMessage(t, tracer, state.StateDB, callee, 0, txHash, false)
+		return tracer
+	}
+	stalled := &stalledStore{flakyStore{data: make(map[common.Hash][]byte)}}
+
+	// the caller bounds the write
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := trace(stalled).PersistTraceContext(ctx); !errors.Is(err, ErrTraceWrite) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("bounded persist mismatch: %v", err)
+	}
+	// the write timeout bounds the deprecated wrapper, and survives the reset of a persisted tracer
+	tracer := trace(stalled)
+	tracer.SetWriteTimeout(10 * time.Millisecond)
+	if err := tracer.PersistTraceContext(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("write timeout mismatch: %v", err)
+	}
+	store := &flakyStore{data: make(map[common.Hash][]byte)}
+	tracer = trace(store)
+	tracer.SetWriteTimeout(time.Minute)
+	if err := tracer.PersistTraceContext(context.Background()); err != nil || len(store.data[txHash]) == 0 {
+		t.Fatalf("failed to persist traces: %v", err)
+	}
+	if tracer.writeTimeout != time.Minute {
+		t.Fatalf("write timeout reset")
+	}
+}
+
+func TestDelegatedCreateFrom(t *testing.T) {
+	var (
+		factory  = common.HexToAddress("0x4000000000000000000000000000000000000004")
+		deployer = common.HexToAddress("0x5000000000000000000000000000000000000005")
+	)
+	// the factory is an EIP-1167 minimal proxy delegating to the deployer, which creates an empty contract
+	proxyCode := "0x363d3d373d3d3d363d73" + deployer.Hex()[2:] + "5af43d82803e903d91602b57fd5bf3"
+	alloc := types.GenesisAlloc{
+		reuseSender: {Balance: big.NewInt(1_000_000_000)},
+		factory:     {Code: common.FromHex(proxyCode)},
+		deployer:    {Code: common.FromHex("0x600060006000f05000")},
+	}
+	state := tests.MakePreState(rawdb.NewMemoryDatabase(), alloc, false, rawdb.HashScheme)
+	defer state.Close()
+
+	traces := traceMessage(t, NewOeTracer(nil), state.StateDB, factory, 0, common.HexToHash("0x01"), false)
+	if len(traces) != 3 {
+		t.Fatalf("trace count mismatch: have %d, want %d", len(traces), 3)
+	}
+	create := traces[2]
+	if create.TraceType != CREATE || create.Action.From == nil || *create.Action.From != factory {
+		t.Fatalf("create from mismatch: have %s from %v, want %s from %v", create.TraceType, create.Action.From, CREATE, factory)
+	}
+	if create.Result == nil || create.Result.Address == nil || *create.Result.Address != crypto.CreateAddress(factory, 0) {
+		t.Fatalf("created address mismatch: have %+v, want %v", create.Result, crypto.CreateAddress(factory, 0))
+	}
+	// the nonce of the factory paid for the create, the one of the deployer code is untouched
+	if state.StateDB.GetNonce(factory) != 1 || state.StateDB.GetNonce(deployer) != 0 {
+		t.Fatalf("nonce mismatch: have factory %d deployer %d, want %d and %d", state.StateDB.GetNonce(factory), state.StateDB.GetNonce(deployer), 1, 0)
+	}
+}
+
+func TestMemoryFrontier(t *testing.T) {
+	var (
+		caller = common.HexToAddress("0x6000000000000000000000000000000000000006")
+		callee = common.HexToAddress("0x7000000000000000000000000000000000000007")
+		ones   = bytes.Repeat([]byte{0x11}, 32)
+		twos   = bytes.Repeat([]byte{0x22}, 32)
+		zeros  = make([]byte, 64)
+	)
+	// the caller stores 32 bytes at a fresh offset and calls with 64 bytes from there, then returns 96 bytes
+	// from the same offset, both regions reaching past the memory the evm has expanded so far
+	callerCode := "0x7f" + common.Bytes2Hex(ones) + "604052" + "6000600060406040600073" + callee.Hex()[2:] + "5af150" + "60606040f3"
+	// the callee returns 64 bytes of which it only stored 32
+	calleeCode := "0x7f" + common.Bytes2Hex(twos) + "600052" + "60406000f3"
+	alloc := types.GenesisAlloc{
+		reuseSender: {Balance: big.NewInt(1_000_000_000)},
+		caller:      {Code: common.FromHex(callerCode)},
+		callee:      {Code: common.FromHex(calleeCode)},
+	}
+	state := tests.MakePreState(rawdb.NewMemoryDatabase(), alloc, false, rawdb.HashScheme)
+	defer state.Close()
+
+	traces := traceMessage(t, NewOeTracer(nil), state.StateDB, caller, 0, common.HexToHash("0x01"), false)
+	if len(traces) != 2 {
+		t.Fatalf("trace count mismatch: have %d, want %d", len(traces), 2)
+	}
+	if have, want := []byte(traces[1].Action.Input), append(append([]byte{}, ones...), zeros[:32]...); !bytes.Equal(have, want) {
+		t.Errorf("call input mismatch: have %x, want %x", have, want)
+	}
+	for i, want := range [][]byte{append(append([]byte{}, ones...), zeros...), append(append([]byte{}, twos...), zeros[:32]...)} {
+		if traces[i].Result == nil || traces[i].Result.Output == nil || !bytes.Equal(*traces[i].Result.Output, want) {
+			t.Errorf("trace %d output mismatch: have %+v, want %x", i, traces[i].Result, want)
+		}
+	}
+}
+
+func TestMemoryCopy(t *testing.T) {
+	memory := []byte{1, 2, 3, 4}
+	tests := []struct {
+		offset, size *big.Int
+		err          error
+		want         []byte
+	}{
+		{big.NewInt(1), big.NewInt(2), nil, []byte{2, 3}},
+		{big.NewInt(2), big.NewInt(4), nil, []byte{3, 4, 0, 0}},
+		{big.NewInt(8), big.NewInt(2), nil, []byte{0, 0}},
+		{big.NewInt(8), big.NewInt(0), nil, nil},
+		{new(big.Int).Lsh(big.NewInt(1), 64), big.NewInt(1), nil, nil},
+		{new(big.Int).SetUint64(^uint64(0)), big.NewInt(2), nil, nil},
+		{big.NewInt(0), big.NewInt(maxTxPacketSize), nil, nil},
+		{big.NewInt(1), big.NewInt(2), vm.ErrOutOfGas, nil},
+	}
+	for i, test := range tests {
+		if have := memoryCopy(memory, test.offset, test.size, test.err); !bytes.Equal(have, test.want) || (have == nil) != (test.want == nil) {
+			t.Errorf("test %d: memory copy mismatch: have %x, want %x", i, have, test.want)
+		}
+	}
+}
+
+func TestHugeMemoryOperands(t *testing.T) {
+	huge := common.Address{0x10, 0x0e}
+	alloc := types.GenesisAlloc{
+		reuseSender: {Balance: big.NewInt(1_000_000_000)},
+		// PUSH8 0x00000fffffffffff PUSH1 0 RETURN, the expansion can't be paid for
+		huge: {Code: common.FromHex("0x6700000fffffffffff6000f3")},
+	}
+	state := tests.MakePreState(rawdb.NewMemoryDatabase(), alloc, false, rawdb.HashScheme)
+	defer state.Close()
+
+	traces := traceMessage(t, NewOeTracer(nil), state.StateDB, huge, 0, common.Hash{0x1}, false)
+	// the region of the failed RETURN isn't copied
+	if len(traces) != 1 || (traces[0].Result != nil && traces[0].Result.Output != nil && len(*traces[0].Result.Output) != 0) {
+		t.Fatalf("trace mismatch: %+v", traces)
+	}
+}
+
+// traceNestedCalls runs a tx calling a contract which makes a static call, the traces aren't finalized
+func traceNestedCalls(t *testing.T, tracer *OeTracer) {
+	var (
+		caller = common.HexToAddress("0x4000000000000000000000000000000000000004")
+		callee = common.HexToAddress("0x5000000000000000000000000000000000000005")
+	)
+	alloc := types.GenesisAlloc{
+		reuseSender:  {Balance: big.NewInt(1_000_000_000)},
+		caller:       {Code: common.FromHex("0x6000600060006000600073" + callee.Hex()[2:] + "61ffff" + "f15000")},
+		callee:       {Code: common.FromHex("0x6000600060006000" + "73" + stoppingAddr.Hex()[2:] + "611000" + "fa5000")},
+		stoppingAddr: {Code: common.FromHex("0x00")},
+	}
+	state := tests.MakePreState(rawdb.NewMemoryDatabase(), alloc, false, rawdb.HashScheme)
+	defer state.Close()
+
+	msg := &core.Message{
+		From:      reuseSender,
+		To:        &caller,
+		Value:     big.NewInt(0),
+		GasLimit:  200_000,
+		GasPrice:  big.NewInt(0),
+		GasFeeCap: big.NewInt(0),
+		GasTipCap: big.NewInt(0),
+	}
+	blkContext := vm.BlockContext{
+		CanTransfer: core.CanTransfer,
+		Transfer:    core.Transfer,
+		GasLimit:    10_000_000,
+		BlockNumber: big.NewInt(1),
+		Difficulty:  big.NewInt(1),
+		BaseFee:     big.NewInt(0),
+	}
+	evm := vm.NewEVM(blkContext, core.NewEVMTxContext(msg), state.StateDB, params.AllEthashProtocolChanges, vm.Config{Tracer: tracer, NoBaseFee: true})
+	tracer.SetMessage(big.NewInt(1), common.Hash{}, common.HexToHash("0x01"), 0, msg.From, msg.To, *msg.Value)
+	if _, err := core.ApplyMessage(evm, msg, new(core.GasPool).AddGas(msg.GasLimit)); err != nil {
+		t.Fatalf("failed to execute transaction: %v", err)
+	}
+}
+
+func TestFinalizeOrder(t *testing.T) {
+	reference := NewOeTracer(nil)
+	traceNestedCalls(t, reference)
+	reference.Finalize()
+	want := append([]ActionTrace{}, *reference.GetResult()...)
+	if len(want) != 3 || want[0].Subtraces != 1 || want[1].Subtraces != 1 {
+		t.Fatalf("unexpected reference traces: %+v", want)
+	}
+	var wantActions ActionTraces = want
+	wantBlob, err := rlp.EncodeToBytes(&wantActions)
+	if err != nil {
+		t.Fatalf("failed to encode traces: %v", err)
+	}
+
+	orders := map[string]func(tracer *OeTracer) []ActionTrace{
+		"without finalize": func(tracer *OeTracer) []ActionTrace {
+			return *tracer.GetResult()
+		},
+		"finalize twice": func(tracer *OeTracer) []ActionTrace {
+			tracer.Finalize()
+			tracer.Finalize()
+			return *tracer.GetResult()
+		},
+		"finalize after result": func(tracer *OeTracer) []ActionTrace {
+			tracer.GetResult()
+			tracer.Finalize()
+			tracer.GetResult()
+			return *tracer.GetResult()
+		},
+		"finalized result": func(tracer *OeTracer) []ActionTrace {
+			tracer.Finalize()
+			traces, err := tracer.FinalizedResult()
+			if err != nil {
+				t.Fatalf("failed to get finalized result: %v", err)
+			}
+			return traces
+		},
+	}
+	for name, order := range orders {
+		tracer := NewOeTracer(nil)
+		traceNestedCalls(t, tracer)
+		if have := order(tracer); !jsonEqual(have, want) {
+			t.Errorf("%s: traces mismatch", name)
+			jsonDiff(t, have, want)
+		}
+	}
+
+	// whatever was read before, the persisted traces are the finalized ones
+	for _, finalize := range []bool{false, true} {
+		store := &flakyStore{data: make(map[common.Hash][]byte)}
+		tracer := NewOeTracer(store)
+		traceNestedCalls(t, tracer)
+		tracer.GetResult()
+		if finalize {
+			tracer.Finalize()
+		}
+		if err := tracer.PersistTraceContext(context.Background()); err != nil {
+			t.Fatalf("failed to persist traces: %v", err)
+		}
+		if !bytes.Equal(store.data[common.HexToHash("0x01")], wantBlob) {
+			t.Fatalf("finalize=%v: persisted traces mismatch", finalize)
+		}
+	}
+
+	if _, err := NewOeTracer(nil).FinalizedResult(); !errors.Is(err, ErrTraceIncomplete) {
+		t.Fatalf("unended trace error mismatch: have %v, want %v", err, ErrTraceIncomplete)
+	}
+}
+
+func TestSelfDestructBalance(t *testing.T) {
+	var (
+		destructor  = common.HexToAddress("0x6000000000000000000000000000000000000006")
+		beneficiary = common.HexToAddress("0x7000000000000000000000000000000000000007")
+	)
+	cancun := *params.AllEthashProtocolChanges
+	cancun.TerminalTotalDifficultyPassed = true
+	cancun.ShanghaiTime, cancun.CancunTime = new(uint64), new(uint64)
+
+	for _, config := range []*params.ChainConfig{params.AllEthashProtocolChanges, &cancun} {
+		alloc := types.GenesisAlloc{
+			reuseSender: {Balance: big.NewInt(1_000_000_000)},
+			destructor:  {Code: common.FromHex("0x73" + beneficiary.Hex()[2:] + "ff"), Balance: big.NewInt(12345)},
+		}
+		state := tests.MakePreState(rawdb.NewMemoryDatabase(), alloc, false, rawdb.HashScheme)
+		msg := &core.Message{
+			From:      reuseSender,
+			To:        &destructor,
+			Value:     big.NewInt(0),
+			GasLimit:  100_000,
+			GasPrice:  big.NewInt(0),
+			GasFeeCap: big.NewInt(0),
+			GasTipCap: big.NewInt(0),
+		}
+		blkContext := vm.BlockContext{
+			CanTransfer: core.CanTransfer,
+			Transfer:    core.Transfer,
+			GasLimit:    10_000_000,
+			BlockNumber: big.NewInt(1),
+			Difficulty:  big.NewInt(0),
+			Random:      &common.Hash{}, // post-merge, Cancun needs it
+			BaseFee:     big.NewInt(0),
+		}
+		tracer := NewOeTracer(nil)
+		evm := vm.NewEVM(blkContext, core.NewEVMTxContext(msg), state.StateDB, config, vm.Config{Tracer: tracer, NoBaseFee: true})
+		tracer.SetMessage(big.NewInt(1), common.Hash{}, common.HexToHash("0x01"), 0, msg.From, msg.To, *msg.Value)
+		if _, err := core.ApplyMessage(evm, msg, new(core.GasPool).AddGas(msg.GasLimit)); err != nil {
+			t.Fatalf("cancun %v: failed to execute transaction: %v", config.CancunTime != nil, err)
+		}
+		// since Cancun only the balance moves, the contract wasn't created in the tx
+		if deleted := state.StateDB.HasSelfDestructed(destructor); deleted != (config.CancunTime == nil) {
+			t.Fatalf("cancun %v: self destructed mismatch: %v", config.CancunTime != nil, deleted)
+		}
+		state.Close()
+
+		traces, err := tracer.FinalizedResult()
+		if err != nil {
+			t.Fatalf("cancun %v: failed to get traces: %v", config.CancunTime != nil, err)
+		}
+		if len(traces) != 2 || traces[1].TraceType != SELFDESTRUCT {
+			t.Fatalf("cancun %v: traces mismatch: %+v", config.CancunTime != nil, traces)
+		}
+		action := traces[1].Action
+		if action.Balance == nil || action.Balance.ToInt().Int64() != 12345 || *action.Address != destructor || *action.RefundAddress != beneficiary {
+			t.Fatalf("cancun %v: suicide action mismatch: %+v", config.CancunTime != nil, action)
+		}
+		// only annotated since Cancun
+		if (config.CancunTime == nil && action.Destroyed != nil) || (config.CancunTime != nil && (action.Destroyed == nil || *action.Destroyed)) {
+			t.Fatalf("cancun %v: destroyed mismatch: %v", config.CancunTime != nil, action.Destroyed)
+		}
+		var decoded ActionTraces
+		if blob, err := rlp.EncodeToBytes((*ActionTraces)(&traces)); err != nil {
+			t.Fatalf("cancun %v: failed to encode traces: %v", config.CancunTime != nil, err)
+		} else if err := rlp.DecodeBytes(blob, &decoded); err != nil {
+			t.Fatalf("cancun %v: failed to decode traces: %v", config.CancunTime != nil, err)
+		}
+		if !reflect.DeepEqual(decoded[1].Action.Destroyed, action.Destroyed) {
+			t.Fatalf("cancun %v: decoded destroyed mismatch: have %v, want %v", config.CancunTime != nil, decoded[1].Action.Destroyed, action.Destroyed)
+		}
+	}
+}
+
+func TestStaticSelfDestruct(t *testing.T) {
+	var (
+		caller     = common.HexToAddress("0x8000000000000000000000000000000000000008")
+		destructor = common.HexToAddress("0x6000000000000000000000000000000000000006")
+	)
+	call := func(op vm.OpCode) []byte {
+		code := []byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0}
+		if op == vm.CALL {
+			code = append(code, byte(vm.PUSH1), 0)
+		}
+		code = append(code, byte(vm.PUSH20))
+		code = append(code, destructor.Bytes()...)
+		// 10k gas, the failing static call burns all it's given
+		return append(code, byte(vm.PUSH2), 0x27, 0x10, byte(op), byte(vm.POP))
+	}
+	// the static call fails with write protection before anything is destroyed, the plain call destroys
+	code := append(call(vm.STATICCALL), call(vm.CALL)...)
+	alloc := types.GenesisAlloc{
+		reuseSender: {Balance: big.NewInt(1_000_000_000)},
+		caller:      {Code: append(code, byte(vm.STOP))},
+		destructor:  {Code: common.FromHex("0x73" + caller.Hex()[2:] + "ff"), Balance: big.NewInt(7)},
+	}
+	state := tests.MakePreState(rawdb.NewMemoryDatabase(), alloc, false, rawdb.HashScheme)
+	defer state.Close()
+
+	traces := traceMessage(t, NewOeTracer(nil), state.StateDB, caller, 0, common.Hash{0x1}, false)
+	want := []struct {
+		typ          string
+		traceAddress []uint32
+		subtraces    uint64
+	}{
+		{CALL, []uint32{}, 2},
+		{CALL, []uint32{0}, 0},
+		{CALL, []uint32{1}, 1},
+		{SELFDESTRUCT, []uint32{1, 0}, 0},
+	}
+	if len(traces) != len(want) {
+		t.Fatalf("trace count mismatch: have %d, want %d", len(traces), len(want))
+	}
+	for i, w := range want {
+		if traces[i].TraceType != w.typ || !reflect.DeepEqual(traces[i].TraceAddress, w.traceAddress) || traces[i].Subtraces != w.subtraces {
+			t.Fatalf("trace %d mismatch: have %s %v %d, want %s %v %d", i, traces[i].TraceType, traces[i].TraceAddress, traces[i].Subtraces, w.typ, w.traceAddress, w.subtraces)
+		}
+	}
+	if suicide := traces[3]; suicide.Error != "" || suicide.Action.Balance.ToInt().Int64() != 7 || *suicide.Action.RefundAddress != caller {
+		t.Fatalf("suicide mismatch: %+v", suicide)
+	}
+}
+
+func TestActionTracesEncodeRLP(t *testing.T) {
+	tracer := NewOeTracer(nil)
+	traceNestedCalls(t, tracer)
+	traces, err := tracer.FinalizedResult()
+	if err != nil {
+		t.Fatalf("failed to get traces: %v", err)
+	}
+	failed := traces[2]
+	failed.Result, failed.Error = nil, "Reverted"
+	actions := append(ActionTraces{}, append(traces, failed)...)
+
+	// a list of byte strings, each holding an encoded trace
+	var legacy [][]byte
+	for i := range actions {
+		blob, err := rlp.EncodeToBytes(&actions[i])
+		if err != nil {
+			t.Fatalf("failed to encode trace %d: %v", i, err)
+		}
+		legacy = append(legacy, blob)
+	}
+	want, err := rlp.EncodeToBytes(legacy)
+	if err != nil {
+		t.Fatalf("failed to encode legacy traces: %v", err)
+	}
+	for i := 0; i < 3; i++ { // the pooled buffer is reused
+		have, err := rlp.EncodeToBytes(&actions)
+		if err != nil {
+			t.Fatalf("failed to encode traces: %v", err)
+		}
+		if !bytes.Equal(have, want) {
+			t.Fatalf("encoding mismatch:\nhave %x\nwant %x", have, want)
+		}
+	}
+
+	// nested in other values, and through a plain writer
+	nested, err := rlp.EncodeToBytes([]*ActionTraces{&actions, {}})
+	if err != nil {
+		t.Fatalf("failed to encode nested traces: %v", err)
+	}
+	var decoded []ActionTraces
+	if err := rlp.DecodeBytes(nested, &decoded); err != nil {
+		t.Fatalf("failed to decode nested traces: %v", err)
+	}
+	if len(decoded) != 2 || len(decoded[1]) != 0 || !jsonEqual(decoded[0], actions) {
+		t.Fatalf("nested traces mismatch")
+	}
+	var buf bytes.Buffer
+	if err := actions.EncodeRLP(&buf); err != nil || !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("writer encoding mismatch: %v", err)
+	}
+}
+
+func TestTraceAddressDepthJumps(t *testing.T) {
+	var (
+		caller = common.HexToAddress("0x4000000000000000000000000000000000000004")
+		callee = common.HexToAddress("0x5000000000000000000000000000000000000005")
+	)
+	tracer := NewOeTracer(nil)
+	tracer.SetMessage(big.NewInt(1), common.Hash{}, common.HexToHash("0x01"), 0, caller, &callee, big.Int{})
+	tracer.CaptureStart(nil, caller, callee, false, nil, 100_000, new(big.Int))
+	scope := &vm.ScopeContext{
+		Memory:   vm.NewMemory(),
+		Stack:    &vm.Stack{},
+		Contract: vm.NewContract(vm.AccountRef(caller), vm.AccountRef(callee), new(uint256.Int), 100_000),
+	}
+	step := func(op vm.OpCode, depth int) {
+		tracer.CaptureState(0, op, 100_000, 0, scope, nil, depth, nil)
+	}
+	if traceDebug {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("expected a panic on the corrupted trace address")
+			}
+		}()
+	}
+	// a precompile calling back into the evm, the frames it enters run two levels below its caller
+	step(vm.CALL, 1)
+	step(vm.CALL, 3)
+	step(vm.CALL, 3)
+	step(vm.STOP, 3)
+	// a frame ending along with its caller, without running another op of the caller
+	step(vm.CALL, 1)
+	step(vm.CALL, 2)
+	step(vm.CALL, 1)
+	step(vm.STOP, 1)
+	tracer.CaptureEnd(nil, 0, nil)
+
+	traces, err := tracer.FinalizedResult()
+	if err != nil {
+		t.Fatalf("failed to get traces: %v", err)
+	}
+	want := []struct {
+		traceAddress []uint32
+		subtraces    uint64
+	}{
+		{[]uint32{}, 3},
+		{[]uint32{0}, 2},
+		{[]uint32{0, 0}, 0},
+		{[]uint32{0, 1}, 0},
+		{[]uint32{1}, 1},
+		{[]uint32{1, 0}, 0},
+		{[]uint32{2}, 0},
+	}
+	if len(traces) != len(want) {
+		t.Fatalf("trace count mismatch: have %d, want %d", len(traces), len(want))
+	}
+	for i, w := range want {
+		if !reflect.DeepEqual(traces[i].TraceAddress, w.traceAddress) || traces[i].Subtraces != w.subtraces {
+			t.Errorf("trace %d mismatch: have %v %d, want %v %d", i, traces[i].TraceAddress, traces[i].Subtraces, w.traceAddress, w.subtraces)
+		}
+	}
+}
+
+func TestTransientStorage(t *testing.T) {
+	var (
+		locker = common.HexToAddress("0x8000000000000000000000000000000000000008")
+		callee = common.HexToAddress("0x9000000000000000000000000000000000000009")
+		slot   = common.BigToHash(big.NewInt(1))
+	)
+	cancun := *params.AllEthashProtocolChanges
+	cancun.TerminalTotalDifficultyPassed = true
+	cancun.ShanghaiTime, cancun.CancunTime = new(uint64), new(uint64)
+
+	for _, enabled := range []bool{true, false} {
+		alloc := types.GenesisAlloc{
+			reuseSender: {Balance: big.NewInt(1_000_000_000)},
+			// tstore(1, 0x2a), call(gas, callee, 0, 0, 0, 0, 0), tload(1)
+			locker: {Code: common.FromHex("0x602a60015d6000600060006000600073" + callee.Hex()[2:] + "5af1506001" + "5c5000")},
+			// tload(1) of its own transient storage
+			callee: {Code: common.FromHex("0x60015c5000")},
+		}
+		state := tests.MakePreState(rawdb.NewMemoryDatabase(), alloc, false, rawdb.HashScheme)
+		msg := &core.Message{
+			From:      reuseSender,
+			To:        &locker,
+			Value:     big.NewInt(0),
+			GasLimit:  100_000,
+			GasPrice:  big.NewInt(0),
+			GasFeeCap: big.NewInt(0),
+			GasTipCap: big.NewInt(0),
+		}
+		blkContext := vm.BlockContext{
+			CanTransfer: core.CanTransfer,
+			Transfer:    core.Transfer,
+			GasLimit:    10_000_000,
+			BlockNumber: big.NewInt(1),
+			Difficulty:  big.NewInt(0),
+			Random:      &common.Hash{},
+			BaseFee:     big.NewInt(0),
+		}
+		tracer := NewOeTracer(nil)
+		tracer.SetTransientStorage(enabled)
+		evm := vm.NewEVM(blkContext, core.NewEVMTxContext(msg), state.StateDB, &cancun, vm.Config{Tracer: tracer, NoBaseFee: true})
+		tracer.SetMessage(big.NewInt(1), common.Hash{}, common.HexToHash("0x01"), 0, msg.From, msg.To, *msg.Value)
+		if _, err := core.ApplyMessage(evm, msg, new(core.GasPool).AddGas(msg.GasLimit)); err != nil {
+			t.Fatalf("enabled %v: failed to execute transaction: %v", enabled, err)
+		}
+		state.Close()
+		if _, err := tracer.FinalizedResult(); err != nil {
+			t.Fatalf("enabled %v: failed to get traces: %v", enabled, err)
+		}
+
+		var want []TransientAccess
+		if enabled {
+			want = []TransientAccess{
+				{TraceAddress: []uint32{}, Op: "TSTORE", Address: locker, Slot: slot, Value: common.BigToHash(big.NewInt(0x2a))},
+				{TraceAddress: []uint32{0}, Op: "TLOAD", Address: callee, Slot: slot},
+				{TraceAddress: []uint32{}, Op: "TLOAD", Address: locker, Slot: slot, Value: common.BigToHash(big.NewInt(0x2a))},
+			}
+		}
+		if have := tracer.TransientStorage(); !reflect.DeepEqual(have, want) {
+			t.Fatalf("enabled %v: transient accesses mismatch:\nhave %+v\nwant %+v", enabled, have, want)
+		}
+		// they're dropped along with the traces of the tx
+		tracer.Reset()
+		if have := tracer.TransientStorage(); have != nil {
+			t.Fatalf("enabled %v: transient accesses kept after reset: %+v", enabled, have)
+		}
+	}
+}
+
+func TestStorageAccesses(t *testing.T) {
+	var (
+		writer = common.HexToAddress("0xa00000000000000000000000000000000000000a")
+		reader = common.HexToAddress("0xb00000000000000000000000000000000000000b")
+	)
+	alloc := types.GenesisAlloc{
+		reuseSender: {Balance: big.NewInt(1_000_000_000)},
+		// sstore(1, 0x2a), sload(1), call(gas, reader, 0, 0, 0, 0, 0)
+		writer: {Code: common.FromHex("0x602a600155600154506000600060006000600073" + reader.Hex()[2:] + "5af15000")},
+		// sload(2)
+		reader: {Code: common.FromHex("0x6002545000")},
+	}
+	trace := func(enabled bool) []ActionTrace {
+		state := tests.MakePreState(rawdb.NewMemoryDatabase(), alloc, false, rawdb.HashScheme)
+		defer state.Close()
+		tracer := NewOeTracer(nil)
+		tracer.SetStorageAccesses(enabled)
+		return traceMessage(t, tracer, state.StateDB, writer, 0, common.HexToHash("0x01"), false)
+	}
+	plain, traces := trace(false), trace(true)
+	if len(traces) != 2 {
+		t.Fatalf("traces mismatch: %+v", traces)
+	}
+	value := common.BigToHash(big.NewInt(0x2a))
+	want := [][]StorageAccess{
+		{{Op: "SSTORE", Key: common.BigToHash(big.NewInt(1)), Value: &value}, {Op: "SLOAD", Key: common.BigToHash(big.NewInt(1))}},
+		{{Op: "SLOAD", Key: common.BigToHash(big.NewInt(2))}},
+	}
+	for i := range traces {
+		if !reflect.DeepEqual(traces[i].Action.StorageAccesses, want[i]) {
+			t.Fatalf("trace %d: storage accesses mismatch: have %+v, want %+v", i, traces[i].Action.StorageAccesses, want[i])
+		}
+		if plain[i].Action.StorageAccesses != nil {
+			t.Fatalf("trace %d: storage accesses recorded while disabled: %+v", i, plain[i].Action.StorageAccesses)
+		}
+	}
+
+	// the call tree is the same without them, and they survive an encoding round
+	var decoded ActionTraces
+	if blob, err := rlp.EncodeToBytes((*ActionTraces)(&traces)); err != nil {
+		t.Fatalf("failed to encode traces: %v", err)
+	} else if err := rlp.DecodeBytes(blob, &decoded); err != nil {
+		t.Fatalf("failed to decode traces: %v", err)
+	}
+	if !jsonEqual([]ActionTrace(decoded), traces) {
+		jsonDiff(t, []ActionTrace(decoded), traces)
+	}
+	for i := range traces {
+		traces[i].Action.StorageAccesses = nil
+	}
+	if !jsonEqual(traces, plain) {
+		jsonDiff(t, traces, plain)
+	}
+}
@@ -0,0 +1,6 @@
+//go:build !tracedebug
+
+package txtracev1
+
+// traceDebug makes invariant violations of the traces panic instead of being logged and repaired
+const traceDebug = false
@@ -0,0 +1,91 @@
+package txtracev1
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// TraceNode is a trace along with its sub traces, in the order of their trace address.
+type TraceNode struct {
+	Trace    *ActionTrace `json:"trace"`
+	Children []*TraceNode `json:"children,omitempty"`
+}
+
+// BuildTree rebuilds the call tree of a tx from its flat traces by their trace address, whatever their order.
+// The traces must make a single tree: every parent is present and the trace addresses of its sub traces run
+// from 0 to its Subtraces. A nil trace address, e.g. of traces decoded from old blobs, is the top-level one.
+func BuildTree(traces []ActionTrace) (*TraceNode, error) {
+	var root *TraceNode
+	nodes := make(map[string]*TraceNode, len(traces))
+	for i := range traces {
+		key := traceAddressKey(traces[i].TraceAddress)
+		if _, ok := nodes[key]; ok {
+			return nil, fmt.Errorf("duplicated trace address %v", traces[i].TraceAddress)
+		}
+		nodes[key] = &TraceNode{Trace: &traces[i]}
+	}
+	for i := range traces {
+		traceAddress := traces[i].TraceAddress
+		node := nodes[traceAddressKey(traceAddress)]
+		if len(traceAddress) == 0 {
+			root = node
+			continue
+		}
+		parent, ok := nodes[traceAddressKey(traceAddress[:len(traceAddress)-1])]
+		if !ok {
+			return nil, fmt.Errorf("parent of trace %v not found", traceAddress)
+		}
+		parent.Children = append(parent.Children, node)
+	}
+	if root == nil {
+		return nil, errors.New("top-level trace not found")
+	}
+	for _, node := range nodes {
+		slices.SortFunc(node.Children, func(a, b *TraceNode) int {
+			return slices.Compare(a.Trace.TraceAddress, b.Trace.TraceAddress)
+		})
+		if uint64(len(node.Children)) != node.Trace.Subtraces {
+			return nil, fmt.Errorf("trace %v has %d subtraces, %d found", node.Trace.TraceAddress, node.Trace.Subtraces, len(node.Children))
+		}
+		for i, child := range node.Children {
+			if index := child.Trace.TraceAddress[len(child.Trace.TraceAddress)-1]; index != uint32(i) {
+				return nil, fmt.Errorf("trace %v is sub trace %d of its parent", child.Trace.TraceAddress, i)
+			}
+		}
+	}
+	return root, nil
+}
+
+// SortTraces sorts the traces of a tx in place into the depth-first order of the call tree, the order of
+// the traces of a tracer, e.g. after they were shuffled by a store.
+func SortTraces(traces []ActionTrace) {
+	slices.SortStableFunc(traces, func(a, b ActionTrace) int {
+		return slices.Compare(a.TraceAddress, b.TraceAddress)
+	})
+}
+
+// Flatten returns the traces of the tree in depth-first order, the inverse of BuildTree.
+func Flatten(root *TraceNode) []ActionTrace {
+	var traces []ActionTrace
+	var walk func(node *TraceNode)
+	walk = func(node *TraceNode) {
+		traces = append(traces, *node.Trace)
+		for _, child := range node.Children {
+			walk(child)
+		}
+	}
+	if root != nil {
+		walk(root)
+	}
+	return traces
+}
+
+// traceAddressKey returns a map key of the trace address
+func traceAddressKey(traceAddress []uint32) string {
+	key := make([]byte, 0, 4*len(traceAddress))
+	for _, idx := range traceAddress {
+		key = append(key, byte(idx>>24), byte(idx>>16), byte(idx>>8), byte(idx))
+	}
+	return string(key)
+}
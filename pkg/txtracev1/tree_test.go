@@ -0,0 +1,66 @@
+package txtracev1
+
+import (
+	"encoding/json"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildTree(t *testing.T) {
+	blob, err := os.ReadFile(filepath.Join("testdata", "trace_actions_decode_deep_calls.json"))
+	if err != nil {
+		t.Fatalf("failed to read testcase: %v", err)
+	}
+	test := new(traceActionsTest)
+	if err := json.Unmarshal(blob, test); err != nil {
+		t.Fatalf("failed to decode testcase: %v", err)
+	}
+	// traces decoded from old blobs have no trace address for the top-level one
+	traces := append([]ActionTrace{}, test.Origin...)
+	traces[0].TraceAddress = nil
+
+	root, err := BuildTree(traces)
+	if err != nil {
+		t.Fatalf("failed to build tree: %v", err)
+	}
+	if root.Trace != &traces[0] || uint64(len(root.Children)) != root.Trace.Subtraces {
+		t.Fatalf("root mismatch: %+v", root.Trace)
+	}
+	if flat := Flatten(root); !jsonEqual(flat, traces) {
+		jsonDiff(t, flat, traces)
+	}
+
+	// shuffled traces make the same tree and are sorted back
+	shuffled := append([]ActionTrace{}, traces...)
+	rand.New(rand.NewSource(1)).Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+	root, err = BuildTree(shuffled)
+	if err != nil {
+		t.Fatalf("failed to build tree of shuffled traces: %v", err)
+	}
+	if flat := Flatten(root); !jsonEqual(flat, traces) {
+		jsonDiff(t, flat, traces)
+	}
+	SortTraces(shuffled)
+	if !jsonEqual(shuffled, traces) {
+		jsonDiff(t, shuffled, traces)
+	}
+
+	// corrupted traces are refused
+	for name, corrupt := range map[string]func(traces []ActionTrace){
+		"subtraces":      func(traces []ActionTrace) { traces[0].Subtraces++ },
+		"missing parent": func(traces []ActionTrace) { traces[1].TraceAddress = []uint32{7, 0} },
+		"duplicated":     func(traces []ActionTrace) { traces[2].TraceAddress = traces[1].TraceAddress },
+		"no top-level":   func(traces []ActionTrace) { traces[0].TraceAddress = []uint32{9} },
+	} {
+		corrupted := append([]ActionTrace{}, traces...)
+		corrupt(corrupted)
+		if _, err := BuildTree(corrupted); err == nil {
+			t.Fatalf("%s: corrupted traces built", name)
+		}
+	}
+	if Flatten(nil) != nil {
+		t.Fatalf("empty tree flattened")
+	}
+}
@@ -0,0 +1,259 @@
+package txtracev2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// Defaults of AsyncOptions.
+const (
+	DefaultAsyncMaxEntries    = 256
+	DefaultAsyncMaxBytes      = 8 << 20
+	DefaultAsyncFlushInterval = 500 * time.Millisecond
+)
+
+// asyncBackpressure is how many times the limits of AsyncOptions the buffer may grow to while a flush is in
+// progress before the writes flush themselves, so a lagging store slows the writers rather than exhausting memory
+const asyncBackpressure = 4
+
+// ErrAsyncWriterClosed is returned by the writes of an AsyncWriter after Close.
+var ErrAsyncWriterClosed = errors.New("async trace writer closed")
+
+// AsyncOptions configures an AsyncWriter.
+type AsyncOptions struct {
+	MaxEntries    int           // buffered txs flushed at once, DefaultAsyncMaxEntries when not positive
+	MaxBytes      int           // buffered bytes of traces flushed at once, DefaultAsyncMaxBytes when not positive
+	FlushInterval time.Duration // period of the background flushes, DefaultAsyncFlushInterval when not positive
+
+	// OnError is called with the txs whose traces failed to be written, wrapping ErrTraceWrite, the writers have
+	// returned long before. Their traces are dropped from the buffer, nil logs the failures.
+	OnError func(txHashes []common.Hash, err error)
+}
+
+// AsyncWriter is a Store buffering the writes of tx traces to write them in batches, through WriteTxTraces if the
+// underlying store is a BatchStore, e.g. to trace live blocks of a busy chain where the cost of every write of the
+// store dominates. The buffer is flushed in the background when it reaches MaxEntries or MaxBytes and every
+// FlushInterval. The reads see the buffered traces first. It's safe for concurrent use, Close must be called to
+// write what's left.
+type AsyncWriter struct {
+	store Store
+	opts  AsyncOptions
+
+	mu       sync.Mutex
+	pending  map[common.Hash][]byte
+	order    []common.Hash          // the txs of pending in write order
+	size     int                    // bytes of the traces of pending
+	inflight map[common.Hash][]byte // the traces of the flush in progress
+	closed   bool
+
+	flushMu sync.Mutex // flushes write one after the other, in write order
+	kick    chan struct{}
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+// NewAsyncWriter returns an AsyncWriter buffering the writes to store and starts its background flushes.
+func NewAsyncWriter(store Store, opts AsyncOptions) *AsyncWriter {
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = DefaultAsyncMaxEntries
+	}
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = DefaultAsyncMaxBytes
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultAsyncFlushInterval
+	}
+	w := &AsyncWriter{
+		store:   store,
+		opts:    opts,
+		pending: make(map[common.Hash][]byte),
+		kick:    make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go w.loop()
+	return w
+}
+
+// loop flushes the buffer when kicked and every FlushInterval until Close
+func (w *AsyncWriter) loop() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.quit:
+			return
+		case <-w.kick:
+		case <-ticker.C:
+		}
+		// the failures are reported to OnError
+		_ = w.flush(context.Background())
+	}
+}
+
+// ReadTxTrace implements Store, the buffered traces are returned before they're written.
+func (w *AsyncWriter) ReadTxTrace(ctx context.Context, txHash common.Hash) ([]byte, error) {
+	if trace, ok := w.buffered(txHash); ok {
+		return trace, nil
+	}
+	return w.store.ReadTxTrace(ctx, txHash)
+}
+
+// Has implements Store, the buffered traces exist.
+func (w *AsyncWriter) Has(ctx context.Context, txHash common.Hash) (bool, error) {
+	if _, ok := w.buffered(txHash); ok {
+		return true, nil
+	}
+	return w.store.Has(ctx, txHash)
+}
+
+// WriteTxTrace implements Store, the trace is buffered and written by a later flush. It only fails once the
+// writer is closed, the failures of the flushes are reported to AsyncOptions.OnError. The trace mustn't be
+// modified afterwards.
+func (w *AsyncWriter) WriteTxTrace(ctx context.Context, txHash common.Hash, trace []byte) error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return fmt.Errorf("%w: %w", ErrTraceWrite, ErrAsyncWriterClosed)
+	}
+	if previous, ok := w.pending[txHash]; ok {
+		w.size -= len(previous)
+	} else {
+		w.order = append(w.order, txHash)
+	}
+	w.pending[txHash] = trace
+	w.size += len(trace)
+	full := len(w.order) >= w.opts.MaxEntries || w.size >= w.opts.MaxBytes
+	overflow := len(w.order) >= asyncBackpressure*w.opts.MaxEntries || w.size >= asyncBackpressure*w.opts.MaxBytes
+	w.mu.Unlock()
+
+	if overflow {
+		// the flush writes the traces of other writers too, ctx only bounds the wait for it. The failures are
+		// reported to OnError, the trace itself was accepted
+		flushed := make(chan struct{})
+		go func() {
+			defer close(flushed)
+			_ = w.flush(context.WithoutCancel(ctx))
+		}()
+		select {
+		case <-flushed:
+		case <-ctx.Done():
+		}
+	} else if full {
+		select {
+		case w.kick <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Pending returns the number of txs whose traces are buffered or being written.
+func (w *AsyncWriter) Pending() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.order) + len(w.inflight)
+}
+
+// Flush writes the traces buffered so far and waits for the flushes in progress, the failures are returned as well
+// as reported to AsyncOptions.OnError.
+func (w *AsyncWriter) Flush(ctx context.Context) error {
+	return w.flush(ctx)
+}
+
+// Close stops the background flushes and writes the buffered traces, later writes fail with ErrAsyncWriterClosed.
+func (w *AsyncWriter) Close(ctx context.Context) error {
+	w.mu.Lock()
+	closed := w.closed
+	w.closed = true
+	w.mu.Unlock()
+	if !closed {
+		close(w.quit)
+	}
+	select {
+	case <-w.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return w.flush(ctx)
+}
+
+// buffered returns the trace of the tx if it's buffered or being written
+func (w *AsyncWriter) buffered(txHash common.Hash) ([]byte, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if trace, ok := w.pending[txHash]; ok {
+		return trace, true
+	}
+	trace, ok := w.inflight[txHash]
+	return trace, ok
+}
+
+// flush writes the buffered traces, the ones of a failed write are reported to OnError and dropped
+func (w *AsyncWriter) flush(ctx context.Context) error {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+
+	w.mu.Lock()
+	if len(w.order) == 0 {
+		w.mu.Unlock()
+		return nil
+	}
+	txHashes := w.order
+	traces := make([][]byte, len(txHashes))
+	for i, txHash := range txHashes {
+		traces[i] = w.pending[txHash]
+	}
+	w.inflight = w.pending
+	w.pending, w.order, w.size = make(map[common.Hash][]byte, len(txHashes)), nil, 0
+	w.mu.Unlock()
+
+	failed, err := w.write(ctx, txHashes, traces)
+
+	w.mu.Lock()
+	w.inflight = nil
+	w.mu.Unlock()
+	if err == nil {
+		return nil
+	}
+	err = fmt.Errorf("%w: %w", ErrTraceWrite, err)
+	if w.opts.OnError != nil {
+		w.opts.OnError(failed, err)
+	} else {
+		log.Error("Failed to write buffered tx traces", "txs", len(failed), "err", err)
+	}
+	return err
+}
+
+// write writes the traces to the store, in a single batch if it's a BatchStore, and returns the txs which failed
+func (w *AsyncWriter) write(ctx context.Context, txHashes []common.Hash, traces [][]byte) ([]common.Hash, error) {
+	if batchStore, ok := w.store.(BatchStore); ok {
+		if err := batchStore.WriteTxTraces(ctx, txHashes, traces); err != nil {
+			return txHashes, err
+		}
+		return nil, nil
+	}
+	var (
+		failed   []common.Hash
+		firstErr error
+	)
+	for i, txHash := range txHashes {
+		if err := w.store.WriteTxTrace(ctx, txHash, traces[i]); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			failed = append(failed, txHash)
+		}
+	}
+	if firstErr != nil {
+		return failed, fmt.Errorf("%d of %d writes failed, first: %w", len(failed), len(txHashes), firstErr)
+	}
+	return nil, nil
+}
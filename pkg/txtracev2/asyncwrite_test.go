@@ -0,0 +1,368 @@
+package txtracev2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// syncStore is a MemoryStore safe for concurrent use, paying latency for every write round trip and failing the
+// writes of the txs in fail
+type syncStore struct {
+	mu      sync.Mutex
+	data    map[common.Hash][]byte
+	latency time.Duration
+	fail    map[common.Hash]bool
+	gate    chan struct{} // the writes wait for it when set
+	writes  int           // round trips of the writes
+}
+
+func newSyncStore(latency time.Duration) *syncStore {
+	return &syncStore{data: make(map[common.Hash][]byte), latency: latency, fail: make(map[common.Hash]bool)}
+}
+
+func (store *syncStore) ReadTxTrace(ctx context.Context, txHash common.Hash) ([]byte, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if raw, ok := store.data[txHash]; ok {
+		return raw, nil
+	}
+	return nil, ErrTxTraceNotFound
+}
+
+func (store *syncStore) Has(ctx context.Context, txHash common.Hash) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	_, ok := store.data[txHash]
+	return ok, nil
+}
+
+func (store *syncStore) WriteTxTrace(ctx context.Context, txHash common.Hash, trace []byte) error {
+	return store.write([]common.Hash{txHash}, [][]byte{trace})
+}
+
+func (store *syncStore) write(txHashes []common.Hash, traces [][]byte) error {
+	if store.gate != nil {
+		<-store.gate
+	}
+	time.Sleep(store.latency)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.writes++
+	for i, txHash := range txHashes {
+		if store.fail[txHash] {
+			return fmt.Errorf("write of %s refused", txHash.Hex())
+		}
+		store.data[txHash] = traces[i]
+	}
+	return nil
+}
+
+// syncBatchStore writes many traces in a single round trip
+type syncBatchStore struct {
+	*syncStore
+}
+
+func (store syncBatchStore) WriteTxTraces(ctx context.Context, txHashes []common.Hash, traces [][]byte) error {
+	return store.write(txHashes, traces)
+}
+
+// ctxStore is a syncStore refusing the writes whose context is done
+type ctxStore struct {
+	*syncStore
+}
+
+func (store ctxStore) WriteTxTrace(ctx context.Context, txHash common.Hash, trace []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return store.syncStore.WriteTxTrace(ctx, txHash, trace)
+}
+
+func TestAsyncWriterReadYourWrites(t *testing.T) {
+	ctx := context.Background()
+	store := newSyncStore(0)
+	store.gate = make(chan struct{})
+	w := NewAsyncWriter(syncBatchStore{store}, AsyncOptions{MaxEntries: 2, FlushInterval: time.Hour})
+
+	read := func(txHash common.Hash, want []byte) {
+		t.Helper()
+		if raw, err := w.ReadTxTrace(ctx, txHash); err != nil || string(raw) != string(want) {
+			t.Fatalf("tx %x: read %x, %v, want %x", txHash[:1], raw, err, want)
+		}
+		if has, err := w.Has(ctx, txHash); err != nil || !has {
+			t.Fatalf("tx %x: not found, %v", txHash[:1], err)
+		}
+	}
+	// buffered
+	if err := w.WriteTxTrace(ctx, common.Hash{0x1}, []byte{0xc1}); err != nil {
+		t.Fatalf("failed to write trace: %v", err)
+	}
+	read(common.Hash{0x1}, []byte{0xc1})
+	if w.Pending() != 1 {
+		t.Fatalf("pending %d, want 1", w.Pending())
+	}
+	// being written, the store waits on the gate
+	if err := w.WriteTxTrace(ctx, common.Hash{0x2}, []byte{0xc2}); err != nil {
+		t.Fatalf("failed to write trace: %v", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		w.mu.Lock()
+		inflight := len(w.inflight)
+		w.mu.Unlock()
+		if inflight == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("buffer not flushed at its max entries")
+		}
+	}
+	read(common.Hash{0x1}, []byte{0xc1})
+	read(common.Hash{0x2}, []byte{0xc2})
+	// overwritten while the previous trace is being written
+	if err := w.WriteTxTrace(ctx, common.Hash{0x1}, []byte{0xc3}); err != nil {
+		t.Fatalf("failed to write trace: %v", err)
+	}
+	read(common.Hash{0x1}, []byte{0xc3})
+	if w.Pending() != 3 {
+		t.Fatalf("pending %d, want 3", w.Pending())
+	}
+	if _, err := w.ReadTxTrace(ctx, common.Hash{0x9}); !errors.Is(err, ErrTxTraceNotFound) {
+		t.Fatalf("expected ErrTxTraceNotFound for an unknown tx, have %v", err)
+	}
+
+	close(store.gate)
+	if err := w.Flush(ctx); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	// persisted in write order, the latest trace wins
+	if w.Pending() != 0 || string(store.data[common.Hash{0x1}]) != string([]byte{0xc3}) || len(store.data) != 2 {
+		t.Fatalf("flushed store mismatch: %d pending, %x", w.Pending(), store.data)
+	}
+	read(common.Hash{0x1}, []byte{0xc3})
+	if err := w.Close(ctx); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+}
+
+func TestAsyncWriterCloseUnderLoad(t *testing.T) {
+	for _, batched := range []bool{false, true} {
+		var (
+			ctx          = context.Background()
+			store        = newSyncStore(10 * time.Microsecond)
+			target Store = store
+		)
+		if batched {
+			target = syncBatchStore{store}
+		}
+		w := NewAsyncWriter(target, AsyncOptions{MaxEntries: 16, MaxBytes: 1 << 10, FlushInterval: time.Millisecond})
+
+		var wg sync.WaitGroup
+		for writer := 0; writer < 8; writer++ {
+			wg.Add(1)
+			go func(writer int) {
+				defer wg.Done()
+				for i := 0; i < 250; i++ {
+					txHash := common.Hash{byte(writer), byte(i >> 8), byte(i)}
+					if err := w.WriteTxTrace(ctx, txHash, txHash[:3]); err != nil {
+						t.Errorf("writer %d: failed to write trace %d: %v", writer, i, err)
+						return
+					}
+					if raw, err := w.ReadTxTrace(ctx, txHash); err != nil || string(raw) != string(txHash[:3]) {
+						t.Errorf("writer %d: trace %d not read back: %x, %v", writer, i, raw, err)
+						return
+					}
+				}
+			}(writer)
+		}
+		wg.Wait()
+		if err := w.Close(ctx); err != nil {
+			t.Fatalf("batched %v: failed to close: %v", batched, err)
+		}
+		if w.Pending() != 0 || len(store.data) != 8*250 {
+			t.Fatalf("batched %v: %d traces persisted, %d pending, want %d", batched, len(store.data), w.Pending(), 8*250)
+		}
+		if batched && store.writes >= 8*250/2 {
+			t.Fatalf("%d batches written for %d traces", store.writes, 8*250)
+		}
+		if err := w.WriteTxTrace(ctx, common.Hash{0xff}, []byte{0xc0}); !errors.Is(err, ErrAsyncWriterClosed) || !errors.Is(err, ErrTraceWrite) {
+			t.Fatalf("batched %v: expected ErrAsyncWriterClosed after close, have %v", batched, err)
+		}
+		if err := w.Close(ctx); err != nil {
+			t.Fatalf("batched %v: failed to close twice: %v", batched, err)
+		}
+	}
+}
+
+func TestAsyncWriterErrors(t *testing.T) {
+	for _, batched := range []bool{false, true} {
+		var (
+			ctx          = context.Background()
+			store        = newSyncStore(0)
+			target Store = store
+			mu     sync.Mutex
+			failed []common.Hash
+			errs   []error
+		)
+		if batched {
+			target = syncBatchStore{store}
+		}
+		store.fail[common.Hash{0x2}] = true
+		w := NewAsyncWriter(target, AsyncOptions{MaxEntries: 3, FlushInterval: time.Hour, OnError: func(txHashes []common.Hash, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			failed, errs = append(failed, txHashes...), append(errs, err)
+		}})
+		for i := byte(1); i <= 3; i++ {
+			if err := w.WriteTxTrace(ctx, common.Hash{i}, []byte{0xc0 + i}); err != nil {
+				t.Fatalf("batched %v: failed to write trace %d: %v", batched, i, err)
+			}
+		}
+		// delivered by the background flush, the writers are long gone
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+			mu.Lock()
+			reported := len(errs)
+			mu.Unlock()
+			if reported > 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("batched %v: write error not reported", batched)
+			}
+		}
+		want := []common.Hash{{0x2}}
+		if batched {
+			want = []common.Hash{{0x1}, {0x2}, {0x3}} // the whole batch failed
+		}
+		mu.Lock()
+		if len(errs) != 1 || !errors.Is(errs[0], ErrTraceWrite) || fmt.Sprint(failed) != fmt.Sprint(want) {
+			t.Fatalf("batched %v: reported %v for %v, want %v", batched, errs, failed, want)
+		}
+		mu.Unlock()
+		// the failed traces are dropped, the others persisted
+		if has, _ := w.Has(ctx, common.Hash{0x2}); has || w.Pending() != 0 {
+			t.Fatalf("batched %v: failed trace still buffered, %d pending", batched, w.Pending())
+		}
+		if has, _ := w.Has(ctx, common.Hash{0x3}); has == batched {
+			t.Fatalf("batched %v: trace 3 persisted %v", batched, has)
+		}
+
+		if err := w.Close(ctx); err != nil {
+			t.Fatalf("batched %v: failed to close: %v", batched, err)
+		}
+
+		// and returned by explicit flushes
+		w = NewAsyncWriter(target, AsyncOptions{FlushInterval: time.Hour, OnError: func(txHashes []common.Hash, err error) {
+			failed, errs = txHashes, append(errs, err)
+		}})
+		if err := w.WriteTxTrace(ctx, common.Hash{0x2}, []byte{0xc2}); err != nil {
+			t.Fatalf("batched %v: failed to write trace: %v", batched, err)
+		}
+		if err := w.Close(ctx); !errors.Is(err, ErrTraceWrite) || len(errs) != 2 || fmt.Sprint(failed) != fmt.Sprint([]common.Hash{{0x2}}) {
+			t.Fatalf("batched %v: close error %v, reported %v for %v", batched, err, errs, failed)
+		}
+	}
+}
+
+// The writer whose write overflows the buffer waits for the flush as long as its context allows, the flush
+// itself writes the traces of every writer and isn't cancelled along.
+func TestAsyncWriterBackpressureContext(t *testing.T) {
+	var (
+		store = newSyncStore(0)
+		mu    sync.Mutex
+		errs  []error
+	)
+	store.gate = make(chan struct{})
+	w := NewAsyncWriter(ctxStore{store}, AsyncOptions{MaxEntries: 1, FlushInterval: time.Hour, OnError: func(txHashes []common.Hash, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		errs = append(errs, err)
+	}})
+	if err := w.WriteTxTrace(context.Background(), common.Hash{0x1}, []byte{0xc1}); err != nil {
+		t.Fatalf("failed to write trace: %v", err)
+	}
+	// the background flush of the first trace is stalled by the store
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		w.mu.Lock()
+		stalled := len(w.inflight) > 0
+		w.mu.Unlock()
+		if stalled {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("background flush not started")
+		}
+	}
+	for i := byte(2); i < 1+asyncBackpressure; i++ {
+		if err := w.WriteTxTrace(context.Background(), common.Hash{i}, []byte{0xc0 + i}); err != nil {
+			t.Fatalf("failed to write trace %d: %v", i, err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	written := make(chan error, 1)
+	go func() {
+		written <- w.WriteTxTrace(ctx, common.Hash{1 + asyncBackpressure}, []byte{0xc0 + 1 + asyncBackpressure})
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatalf("failed to write overflowing trace: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("overflowing write outlived its context")
+	}
+	close(store.gate)
+	if err := w.Close(context.Background()); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(errs) != 0 {
+		t.Fatalf("flush failures reported: %v", errs)
+	}
+	for i := byte(1); i <= 1+asyncBackpressure; i++ {
+		if has, _ := store.Has(context.Background(), common.Hash{i}); !has {
+			t.Fatalf("trace %d not persisted", i)
+		}
+	}
+}
+
+func BenchmarkAsyncWriter(b *testing.B) {
+	trace := make([]byte, 512)
+	for _, bench := range []struct {
+		name  string
+		write func(b *testing.B, store *syncStore)
+	}{
+		{"direct", func(b *testing.B, store *syncStore) {
+			for i := 0; i < b.N; i++ {
+				if err := store.WriteTxTrace(context.Background(), common.BigToHash(big.NewInt(int64(i))), trace); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}},
+		{"async", func(b *testing.B, store *syncStore) {
+			w := NewAsyncWriter(syncBatchStore{store}, AsyncOptions{})
+			for i := 0; i < b.N; i++ {
+				if err := w.WriteTxTrace(context.Background(), common.BigToHash(big.NewInt(int64(i))), trace); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := w.Close(context.Background()); err != nil {
+				b.Fatal(err)
+			}
+		}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			store := newSyncStore(50 * time.Microsecond) // a round trip to a nearby store
+			bench.write(b, store)
+			b.ReportMetric(float64(store.writes)/float64(b.N), "trips/op")
+		})
+	}
+}
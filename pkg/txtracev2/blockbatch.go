@@ -0,0 +1,180 @@
+package txtracev2
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// ErrCheckpointVersion is returned when restoring a checkpoint written by an incompatible version.
+var ErrCheckpointVersion = errors.New("incompatible checkpoint version")
+
+// blockBatchVersion is the version byte of the checkpoints and markers of BlockTraceBatch
+const blockBatchVersion = 1
+
+// BatchMarkerStore persists the markers of the block batches persisted in full, see BlockTraceBatch.Persist.
+type BatchMarkerStore interface {
+	WriteBatchMarker(ctx context.Context, blockHash common.Hash, marker []byte) error
+	// ReadBatchMarker returns the marker of the block, nil when none was written.
+	ReadBatchMarker(ctx context.Context, blockHash common.Hash) ([]byte, error)
+}
+
+// BlockTraceBatch collects the traces of the txs of a block to persist them all at once when the block is done,
+// e.g. for long running re-executions which checkpoint their progress within a block to resume after a crash.
+// It's not safe for concurrent use.
+type BlockTraceBatch struct {
+	store     Store
+	blockHash common.Hash
+	lists     []*InternalActionTraceList
+	next      uint64 // index of the next tx to execute
+}
+
+// batchCheckpoint is the rlp layout of a checkpoint, following the version byte
+type batchCheckpoint struct {
+	BlockHash common.Hash
+	Next      uint64
+	Lists     []*InternalActionTraceList
+}
+
+// NewBlockTraceBatch returns a batch of the traces of the txs of the block to persist to store.
+func NewBlockTraceBatch(store Store, blockHash common.Hash) *BlockTraceBatch {
+	return &BlockTraceBatch{store: store, blockHash: blockHash}
+}
+
+// Add adds the finalized traces of the next tx of the block, the txs are added in block order and the ones
+// left out, if any, are skipped.
+func (b *BlockTraceBatch) Add(list *InternalActionTraceList) error {
+	if list.BlockHash != b.blockHash {
+		return fmt.Errorf("%w: tx %s is in block %s, not %s", ErrMalformedTrace, list.TransactionHash.Hex(), list.BlockHash.Hex(), b.blockHash.Hex())
+	}
+	if list.TransactionPosition < b.next {
+		return fmt.Errorf("%w: tx %s at position %d, the next tx is at %d", ErrMalformedTrace, list.TransactionHash.Hex(), list.TransactionPosition, b.next)
+	}
+	if err := list.Validate(); err != nil {
+		return err
+	}
+	b.lists = append(b.lists, list)
+	b.next = list.TransactionPosition + 1
+	return nil
+}
+
+// AddTracer adds the traces of a tracer of the next tx of the block like Add, they are persisted in full
+// whatever the config of the tracer.
+func (b *BlockTraceBatch) AddTracer(ot *OeTracer) error {
+	if err := ot.finalize(); err != nil {
+		return err
+	}
+	return b.Add(ot.getInternalTraces())
+}
+
+// Next returns the index in the block of the tx to execute next, 0 for a new batch.
+func (b *BlockTraceBatch) Next() uint64 {
+	return b.next
+}
+
+// Checkpoint serializes the traces added so far along with the index of the next tx, for RestoreCheckpoint to
+// resume the block from there.
+func (b *BlockTraceBatch) Checkpoint() ([]byte, error) {
+	raw, err := rlp.EncodeToBytes(&batchCheckpoint{BlockHash: b.blockHash, Next: b.next, Lists: b.lists})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTraceEncode, err)
+	}
+	return append([]byte{blockBatchVersion}, raw...), nil
+}
+
+// RestoreCheckpoint replaces the traces of the batch with the ones of a checkpoint of the same block, the txs
+// are then resumed from Next. Checkpoints of another version are refused with ErrCheckpointVersion.
+func (b *BlockTraceBatch) RestoreCheckpoint(checkpoint []byte) error {
+	if len(checkpoint) == 0 || checkpoint[0] != blockBatchVersion {
+		return fmt.Errorf("%w: have %x, want %d", ErrCheckpointVersion, checkpoint[:min(len(checkpoint), 1)], blockBatchVersion)
+	}
+	var restored batchCheckpoint
+	if err := rlp.DecodeBytes(checkpoint[1:], &restored); err != nil {
+		return fmt.Errorf("%w: failed to decode checkpoint: %v", ErrMalformedTrace, err)
+	}
+	if restored.BlockHash != b.blockHash {
+		return fmt.Errorf("%w: checkpoint of block %s, not %s", ErrMalformedTrace, restored.BlockHash.Hex(), b.blockHash.Hex())
+	}
+	for _, list := range restored.Lists {
+		if list.BlockHash != b.blockHash || list.TransactionPosition >= restored.Next {
+			return fmt.Errorf("%w: checkpointed tx %s out of the block", ErrMalformedTrace, list.TransactionHash.Hex())
+		}
+		if err := list.Validate(); err != nil {
+			return err
+		}
+	}
+	b.lists, b.next = restored.Lists, restored.Next
+	return nil
+}
+
+// Persist writes the traces of the batch, through WriteTxTraces if the store is a BatchStore, then the block
+// index if it's a BlockIndexStore. A store which is also a BatchMarkerStore gets a marker of what was written
+// last, a batch identical to the marked one isn't written again, e.g. when a restored block is persisted twice,
+// while a different one, e.g. left half written by a crash, is overwritten in full.
+func (b *BlockTraceBatch) Persist(ctx context.Context) error {
+	txHashes := make([]common.Hash, len(b.lists))
+	traces := make([][]byte, len(b.lists))
+	for i, list := range b.lists {
+		raw, err := rlp.EncodeToBytes(list)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrTraceEncode, err)
+		}
+		txHashes[i], traces[i] = list.TransactionHash, raw
+	}
+	marker := batchMarker(txHashes, traces)
+	markers, marked := b.store.(BatchMarkerStore)
+	if marked {
+		persisted, err := markers.ReadBatchMarker(ctx, b.blockHash)
+		if err != nil {
+			return fmt.Errorf("failed to read batch marker of block %s: %w", b.blockHash.Hex(), err)
+		}
+		if bytes.Equal(persisted, marker) {
+			return nil
+		}
+	}
+
+	if batchStore, ok := b.store.(BatchStore); ok {
+		if err := batchStore.WriteTxTraces(ctx, txHashes, traces); err != nil {
+			return fmt.Errorf("%w: %w", ErrTraceWrite, err)
+		}
+	} else {
+		for i := range txHashes {
+			if err := b.store.WriteTxTrace(ctx, txHashes[i], traces[i]); err != nil {
+				return fmt.Errorf("%w: %w", ErrTraceWrite, err)
+			}
+		}
+	}
+	if index, ok := b.store.(BlockIndexStore); ok {
+		raw, err := rlp.EncodeToBytes(txHashes)
+		if err != nil {
+			return fmt.Errorf("failed to encode index of block %s: %w", b.blockHash.Hex(), err)
+		}
+		if err := index.WriteBlockIndex(ctx, b.blockHash, raw); err != nil {
+			return fmt.Errorf("failed to write index of block %s: %w", b.blockHash.Hex(), err)
+		}
+	}
+	if marked {
+		if err := markers.WriteBatchMarker(ctx, b.blockHash, marker); err != nil {
+			return fmt.Errorf("failed to write batch marker of block %s: %w", b.blockHash.Hex(), err)
+		}
+	}
+	return nil
+}
+
+// batchMarker returns the version byte followed by the hash of the txs of a batch and their encoded traces
+func batchMarker(txHashes []common.Hash, traces [][]byte) []byte {
+	hasher := crypto.NewKeccakState()
+	for i := range txHashes {
+		hasher.Write(txHashes[i][:])
+		hasher.Write(crypto.Keccak256(traces[i]))
+	}
+	marker := make([]byte, 1+common.HashLength)
+	marker[0] = blockBatchVersion
+	hasher.Read(marker[1:])
+	return marker
+}
@@ -0,0 +1,118 @@
+package txtracev2
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// markerMemoryStore is an indexMemoryStore which also persists batch markers and counts the trace writes
+type markerMemoryStore struct {
+	indexMemoryStore
+	markers map[common.Hash][]byte
+	writes  int
+}
+
+func newMarkerMemoryStore() *markerMemoryStore {
+	return &markerMemoryStore{
+		indexMemoryStore: indexMemoryStore{MemoryStore: MemoryStore{data: make(map[common.Hash][]byte)}, indexes: make(map[common.Hash][]byte)},
+		markers:          make(map[common.Hash][]byte),
+	}
+}
+
+func (store *markerMemoryStore) WriteTxTrace(ctx context.Context, txHash common.Hash, trace []byte) error {
+	store.writes++
+	return store.MemoryStore.WriteTxTrace(ctx, txHash, trace)
+}
+
+func (store *markerMemoryStore) WriteBatchMarker(ctx context.Context, blockHash common.Hash, marker []byte) error {
+	store.markers[blockHash] = marker
+	return nil
+}
+
+func (store *markerMemoryStore) ReadBatchMarker(ctx context.Context, blockHash common.Hash) ([]byte, error) {
+	return store.markers[blockHash], nil
+}
+
+func TestBlockTraceBatchCheckpoint(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		rnd   = rand.New(rand.NewSource(1))
+		block = common.Hash{0xb}
+		lists []*InternalActionTraceList
+	)
+	for i := 0; i < 6; i++ {
+		list := randomTraces(rnd)
+		list.BlockHash, list.TransactionHash, list.TransactionPosition = block, common.Hash{0x1, byte(i)}, uint64(i)
+		lists = append(lists, list)
+	}
+
+	// the uninterrupted run
+	uninterrupted := newMarkerMemoryStore()
+	batch := NewBlockTraceBatch(uninterrupted, block)
+	for _, list := range lists {
+		if err := batch.Add(list); err != nil {
+			t.Fatalf("tx %d: failed to add traces: %v", list.TransactionPosition, err)
+		}
+	}
+	if err := batch.Persist(ctx); err != nil {
+		t.Fatalf("failed to persist batch: %v", err)
+	}
+
+	// the run crashing after tx 3 while it was writing stale traces of tx 4
+	store := newMarkerMemoryStore()
+	batch = NewBlockTraceBatch(store, block)
+	for _, list := range lists[:3] {
+		if err := batch.Add(list); err != nil {
+			t.Fatalf("tx %d: failed to add traces: %v", list.TransactionPosition, err)
+		}
+	}
+	checkpoint, err := batch.Checkpoint()
+	if err != nil {
+		t.Fatalf("failed to checkpoint: %v", err)
+	}
+	store.data[lists[3].TransactionHash] = []byte{0xc0}
+	store.markers[block] = []byte{blockBatchVersion, 0x1}
+
+	// the restored run finishes the block
+	restored := NewBlockTraceBatch(store, block)
+	if err := restored.RestoreCheckpoint(checkpoint); err != nil {
+		t.Fatalf("failed to restore checkpoint: %v", err)
+	}
+	if restored.Next() != 3 {
+		t.Fatalf("next tx mismatch: have %d, want 3", restored.Next())
+	}
+	if err := restored.Add(lists[2]); !errors.Is(err, ErrMalformedTrace) {
+		t.Fatalf("expected a tx already done to be refused, have %v", err)
+	}
+	for _, list := range lists[3:] {
+		if err := restored.Add(list); err != nil {
+			t.Fatalf("tx %d: failed to add traces: %v", list.TransactionPosition, err)
+		}
+	}
+	if err := restored.Persist(ctx); err != nil {
+		t.Fatalf("failed to persist restored batch: %v", err)
+	}
+	if !reflect.DeepEqual(store.data, uninterrupted.data) || !reflect.DeepEqual(store.indexes, uninterrupted.indexes) || !reflect.DeepEqual(store.markers, uninterrupted.markers) {
+		t.Fatalf("store contents of the restored run differ from the uninterrupted one")
+	}
+	// persisting the same batch again writes nothing
+	writes := store.writes
+	if err := restored.Persist(ctx); err != nil || store.writes != writes || store.indexWrites != 1 {
+		t.Fatalf("batch written twice: %d writes, %d index writes, %v", store.writes-writes, store.indexWrites, err)
+	}
+
+	// checkpoints of another version or block are refused
+	for _, bad := range [][]byte{nil, append([]byte{blockBatchVersion + 1}, checkpoint[1:]...)} {
+		if err := NewBlockTraceBatch(store, block).RestoreCheckpoint(bad); !errors.Is(err, ErrCheckpointVersion) {
+			t.Fatalf("expected ErrCheckpointVersion, have %v", err)
+		}
+	}
+	if err := NewBlockTraceBatch(store, common.Hash{0xc}).RestoreCheckpoint(checkpoint); !errors.Is(err, ErrMalformedTrace) {
+		t.Fatalf("checkpoint of another block restored: %v", err)
+	}
+}
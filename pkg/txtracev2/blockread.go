@@ -0,0 +1,141 @@
+package txtracev2
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// DefaultReadParallelism is the number of concurrent reads of ReadRpcBlockTraces from stores without batch reads.
+const DefaultReadParallelism = 8
+
+// MultiReadStore is a Store which reads the tracing results of many txs in a single round trip,
+// ReadRpcBlockTraces uses it when available.
+type MultiReadStore interface {
+	Store
+	// ReadTxTraces returns the tracing result of txHashes[i] at index i, nil for the txs without one.
+	ReadTxTraces(ctx context.Context, txHashes []common.Hash) ([][]byte, error)
+}
+
+// BlockReadOption configures optional behaviours of ReadRpcBlockTraces.
+type BlockReadOption func(cfg *blockReadConfig)
+
+type blockReadConfig struct {
+	parallelism int
+	tracer      TracerConfig
+}
+
+// WithReadParallelism bounds the concurrent reads of stores without batch reads, DefaultReadParallelism
+// when not positive.
+func WithReadParallelism(parallelism int) BlockReadOption {
+	return func(cfg *blockReadConfig) {
+		cfg.parallelism = parallelism
+	}
+}
+
+// WithReadTracerConfig decodes the traces in the form configured by tracerCfg.
+func WithReadTracerConfig(tracerCfg TracerConfig) BlockReadOption {
+	return func(cfg *blockReadConfig) {
+		cfg.tracer = tracerCfg
+	}
+}
+
+// BlockReadError reports the txs ReadRpcBlockTraces couldn't read, their traces are nil.
+type BlockReadError struct {
+	Errors map[common.Hash]error // per tx, wrapping ErrTxTraceNotFound for the txs without tracing result
+}
+
+func (e *BlockReadError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for txHash, err := range e.Errors {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", txHash.Hex(), err))
+	}
+	sort.Strings(msgs)
+	return fmt.Sprintf("failed to read traces of %d txs: %s", len(e.Errors), strings.Join(msgs, "; "))
+}
+
+// ReadRpcBlockTraces reads the traces of the txs of a block, the traces of txHashes[i] at index i. A
+// MultiReadStore is read in a single round trip, other stores with concurrent reads. Txs which can't be
+// read, e.g. missing or corrupted ones, don't fail the others: their traces are nil and a *BlockReadError
+// is returned along with the traces read. Any other error fails the whole block.
+func ReadRpcBlockTraces(ctx context.Context, store Store, txHashes []common.Hash, opts ...BlockReadOption) ([]ActionTraceList, error) {
+	cfg := &blockReadConfig{parallelism: DefaultReadParallelism}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	if cfg.parallelism <= 0 {
+		cfg.parallelism = DefaultReadParallelism
+	}
+
+	traces := make([]ActionTraceList, len(txHashes))
+	errs := make([]error, len(txHashes))
+	if multi, ok := store.(MultiReadStore); ok {
+		raws, err := multi.ReadTxTraces(ctx, txHashes)
+		if err != nil {
+			return nil, err
+		}
+		if len(raws) != len(txHashes) {
+			return nil, fmt.Errorf("store returned %d traces for %d txs", len(raws), len(txHashes))
+		}
+		for i, raw := range raws {
+			traces[i], errs[i] = decodeBlockTxTraces(ctx, raw, txHashes[i], cfg.tracer)
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	} else {
+		var (
+			wg  sync.WaitGroup
+			sem = make(chan struct{}, cfg.parallelism)
+		)
+		for i := range txHashes {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				wg.Wait()
+				return nil, ctx.Err()
+			}
+			wg.Add(1)
+			go func(i int) {
+				defer func() { <-sem; wg.Done() }()
+				raw, err := store.ReadTxTrace(ctx, txHashes[i])
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				traces[i], errs[i] = decodeBlockTxTraces(ctx, raw, txHashes[i], cfg.tracer)
+			}(i)
+		}
+		wg.Wait()
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	var readErr *BlockReadError
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		if readErr == nil {
+			readErr = &BlockReadError{Errors: make(map[common.Hash]error)}
+		}
+		readErr.Errors[txHashes[i]] = err
+	}
+	if readErr != nil {
+		return traces, readErr
+	}
+	return traces, nil
+}
+
+// decodeBlockTxTraces decodes the tracing result of a tx of ReadRpcBlockTraces
+func decodeBlockTxTraces(ctx context.Context, raw []byte, txHash common.Hash, cfg TracerConfig) (ActionTraceList, error) {
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrTxTraceNotFound, txHash.Hex())
+	}
+	return decodeRpcTxTrace(ctx, raw, cfg)
+}
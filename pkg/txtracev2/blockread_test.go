@@ -0,0 +1,143 @@
+package txtracev2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// latencyStore is a networked store paying latency for every round trip
+type latencyStore struct {
+	MemoryStore
+	latency  time.Duration
+	trips    atomic.Int64
+	inFlight atomic.Int64
+	peak     atomic.Int64 // most concurrent reads
+}
+
+func (store *latencyStore) ReadTxTrace(ctx context.Context, txHash common.Hash) ([]byte, error) {
+	n := store.inFlight.Add(1)
+	defer store.inFlight.Add(-1)
+	for peak := store.peak.Load(); n > peak && !store.peak.CompareAndSwap(peak, n); peak = store.peak.Load() {
+	}
+	store.trips.Add(1)
+	time.Sleep(store.latency)
+	return store.MemoryStore.ReadTxTrace(ctx, txHash)
+}
+
+// multiLatencyStore reads many traces in a single round trip
+type multiLatencyStore struct {
+	*latencyStore
+}
+
+func (store multiLatencyStore) ReadTxTraces(ctx context.Context, txHashes []common.Hash) ([][]byte, error) {
+	store.trips.Add(1)
+	time.Sleep(store.latency)
+	raws := make([][]byte, len(txHashes))
+	for i, txHash := range txHashes {
+		raws[i] = store.data[txHash]
+	}
+	return raws, nil
+}
+
+// blockStore returns a store holding the traces of the given number of random txs, their hashes and rpc forms
+func blockStore(tb testing.TB, txs int, latency time.Duration) (*latencyStore, []common.Hash, []ActionTraceList) {
+	rnd := rand.New(rand.NewSource(1))
+	store := &latencyStore{MemoryStore: MemoryStore{data: make(map[common.Hash][]byte)}, latency: latency}
+	var (
+		txHashes []common.Hash
+		want     []ActionTraceList
+	)
+	for i := 0; i < txs; i++ {
+		traces := randomTraces(rnd)
+		raw, err := rlp.EncodeToBytes(traces)
+		if err != nil {
+			tb.Fatalf("failed to encode traces: %v", err)
+		}
+		txHash := common.Hash{0x1, byte(i >> 8), byte(i)}
+		store.data[txHash] = raw
+		txHashes = append(txHashes, txHash)
+		want = append(want, traces.ToTraces())
+	}
+	return store, txHashes, want
+}
+
+func TestReadRpcBlockTraces(t *testing.T) {
+	ctx := context.Background()
+	store, txHashes, want := blockStore(t, 20, 0)
+	missing, corrupted := common.Hash{0xff}, txHashes[7]
+	store.data[corrupted] = []byte{0xc1, 0x01, 0x02}
+	txHashes = append(txHashes[:3], append([]common.Hash{missing}, txHashes[3:]...)...)
+	want = append(want[:3], append([]ActionTraceList{nil}, want[3:]...)...)
+	want[8] = nil
+
+	for name, s := range map[string]Store{"concurrent": store, "batch": multiLatencyStore{store}} {
+		store.trips.Store(0)
+		traces, err := ReadRpcBlockTraces(ctx, s, txHashes, WithReadParallelism(4))
+		var readErr *BlockReadError
+		if !errors.As(err, &readErr) || len(readErr.Errors) != 2 {
+			t.Fatalf("%s: error mismatch: %v", name, err)
+		}
+		if !errors.Is(readErr.Errors[missing], ErrTxTraceNotFound) || readErr.Errors[corrupted] == nil {
+			t.Fatalf("%s: per tx errors mismatch: %v", name, readErr.Errors)
+		}
+		if len(traces) != len(txHashes) {
+			t.Fatalf("%s: trace count mismatch: have %d, want %d", name, len(traces), len(txHashes))
+		}
+		for i := range traces {
+			if (traces[i] == nil) != (want[i] == nil) || (traces[i] != nil && !jsonEqual(traces[i], want[i])) {
+				t.Fatalf("%s: traces of tx %d mismatch", name, i)
+			}
+		}
+		if trips := store.trips.Load(); (name == "batch") != (trips == 1) {
+			t.Fatalf("%s: round trips mismatch: %d", name, trips)
+		}
+	}
+	if peak := store.peak.Load(); peak > 4 {
+		t.Fatalf("concurrent reads beyond the parallelism: %d", peak)
+	}
+
+	// everything read, no error
+	traces, err := ReadRpcBlockTraces(ctx, store, txHashes[:3])
+	if err != nil || len(traces) != 3 || !jsonEqual(traces[2], want[2]) {
+		t.Fatalf("complete block mismatch: %v", err)
+	}
+	// store failures of single reads are isolated as well
+	failing := errors.New("backend down")
+	if _, err := ReadRpcBlockTraces(ctx, WithDefaultHas(failingStore{failing}), txHashes[:2]); !errors.As(err, new(*BlockReadError)) || !errors.Is(err.(*BlockReadError).Errors[txHashes[1]], failing) {
+		t.Fatalf("failing read mismatch: %v", err)
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := ReadRpcBlockTraces(cancelled, store, txHashes); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled read mismatch: %v", err)
+	}
+}
+
+func BenchmarkReadRpcBlockTraces(b *testing.B) {
+	store, txHashes, _ := blockStore(b, 300, 200*time.Microsecond)
+	for _, bench := range []struct {
+		name  string
+		store Store
+		opts  []BlockReadOption
+	}{
+		{"serial", store, []BlockReadOption{WithReadParallelism(1)}},
+		{"concurrent", store, nil},
+		{"batch", multiLatencyStore{store}, nil},
+	} {
+		b.Run(fmt.Sprintf("%s-%dtxs", bench.name, len(txHashes)), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := ReadRpcBlockTraces(context.Background(), bench.store, txHashes, bench.opts...); err != nil {
+					b.Fatalf("failed to read traces: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package txtracev2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// ErrBlockIndexNotFound should be wrapped by block index stores when no tx index of the block is persisted.
+var ErrBlockIndexNotFound = errors.New("block index not found")
+
+// BlockIndexStore persists the rlp encoded hashes of the traced txs of blocks, in block order.
+type BlockIndexStore interface {
+	WriteBlockIndex(ctx context.Context, blockHash common.Hash, index []byte) error
+	ReadBlockIndex(ctx context.Context, blockHash common.Hash) ([]byte, error)
+}
+
+// ReadBlockTxHashes reads the hashes of the traced txs of a block persisted by BlockTraceWriter, e.g. to read
+// their traces with ReadRpcBlockTraces.
+func ReadBlockTxHashes(ctx context.Context, store BlockIndexStore, blockHash common.Hash) ([]common.Hash, error) {
+	raw, err := store.ReadBlockIndex(ctx, blockHash)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrBlockIndexNotFound, blockHash.Hex())
+	}
+	var txHashes []common.Hash
+	if err := rlp.DecodeBytes(raw, &txHashes); err != nil {
+		return nil, fmt.Errorf("failed to decode index of block %s: %w", blockHash.Hex(), err)
+	}
+	return txHashes, nil
+}
+
+// BlockTraceWriter persists the traces of the txs of a block as soon as each of them is traced, only the tx
+// hashes are kept for the block index, so the memory doesn't grow with the traces of the block. The index is
+// committed by Flush when the store is also a BlockIndexStore. It's not safe for concurrent use.
+type BlockTraceWriter struct {
+	store     Store
+	blockHash common.Hash
+	txHashes  []common.Hash
+	indexed   map[common.Hash]bool
+	dirty     bool // txs were written since the last flush
+}
+
+// NewBlockTraceWriter returns a writer of the traces of the txs of the block to store.
+func NewBlockTraceWriter(store Store, blockHash common.Hash) *BlockTraceWriter {
+	return &BlockTraceWriter{
+		store:     store,
+		blockHash: blockHash,
+		indexed:   make(map[common.Hash]bool),
+	}
+}
+
+// Write persists the finalized traces of a tx of the block right away and adds the tx to the block index.
+// Txs written again, e.g. on retries, keep their place in the index.
+func (w *BlockTraceWriter) Write(ctx context.Context, list *InternalActionTraceList) error {
+	if err := w.checkBlock(list); err != nil {
+		return err
+	}
+	if err := list.Validate(); err != nil {
+		return err
+	}
+	raw, err := rlp.EncodeToBytes(list)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrTraceEncode, err)
+	}
+	return w.write(ctx, list.TransactionHash, raw)
+}
+
+// WriteTracer persists the traces of a tracer of a tx of the block like PersistTraceContext would, simple
+// transfers are skipped as configured, and adds the tx to the block index.
+func (w *BlockTraceWriter) WriteTracer(ctx context.Context, ot *OeTracer) error {
+	if err := ot.finalize(); err != nil {
+		return err
+	}
+	list := ot.getInternalTraces()
+	if err := w.checkBlock(list); err != nil {
+		return err
+	}
+	raw, err := ot.encodeTraces()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrTraceEncode, err)
+	}
+	return w.write(ctx, list.TransactionHash, raw)
+}
+
+// checkBlock checks the traces are the ones of a tx of the block
+func (w *BlockTraceWriter) checkBlock(list *InternalActionTraceList) error {
+	if list.BlockHash != w.blockHash {
+		return fmt.Errorf("%w: tx %s is in block %s, not %s", ErrMalformedTrace, list.TransactionHash.Hex(), list.BlockHash.Hex(), w.blockHash.Hex())
+	}
+	return nil
+}
+
+// write persists the raw traces of the tx, nothing for the omitted ones which are indexed all the same
+func (w *BlockTraceWriter) write(ctx context.Context, txHash common.Hash, raw []byte) error {
+	if len(raw) > 0 {
+		if err := w.store.WriteTxTrace(ctx, txHash, raw); err != nil {
+			return fmt.Errorf("%w: %w", ErrTraceWrite, err)
+		}
+	}
+	if !w.indexed[txHash] {
+		w.indexed[txHash] = true
+		w.txHashes = append(w.txHashes, txHash)
+		w.dirty = true
+	}
+	return nil
+}
+
+// TxHashes returns the hashes of the txs written so far, in the order they were written.
+func (w *BlockTraceWriter) TxHashes() []common.Hash {
+	return append([]common.Hash{}, w.txHashes...)
+}
+
+// Flush commits the block index of the txs written so far when the store is a BlockIndexStore, it may be
+// called again after more txs are written. Nothing is written when no tx was written since the last flush.
+func (w *BlockTraceWriter) Flush(ctx context.Context) error {
+	index, ok := w.store.(BlockIndexStore)
+	if !ok || !w.dirty {
+		return nil
+	}
+	raw, err := rlp.EncodeToBytes(w.txHashes)
+	if err != nil {
+		return fmt.Errorf("failed to encode index of block %s: %w", w.blockHash.Hex(), err)
+	}
+	if err := index.WriteBlockIndex(ctx, w.blockHash, raw); err != nil {
+		return fmt.Errorf("failed to write index of block %s: %w", w.blockHash.Hex(), err)
+	}
+	w.dirty = false
+	return nil
+}
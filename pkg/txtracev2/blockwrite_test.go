@@ -0,0 +1,107 @@
+package txtracev2
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// indexMemoryStore is a MemoryStore which also persists block indexes
+type indexMemoryStore struct {
+	MemoryStore
+	indexes     map[common.Hash][]byte
+	indexWrites int
+}
+
+func (store *indexMemoryStore) WriteBlockIndex(ctx context.Context, blockHash common.Hash, index []byte) error {
+	store.indexWrites++
+	store.indexes[blockHash] = index
+	return nil
+}
+
+func (store *indexMemoryStore) ReadBlockIndex(ctx context.Context, blockHash common.Hash) ([]byte, error) {
+	return store.indexes[blockHash], nil
+}
+
+func TestBlockTraceWriter(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		rnd   = rand.New(rand.NewSource(1))
+		block = common.Hash{0xb}
+		store = &indexMemoryStore{MemoryStore: MemoryStore{data: make(map[common.Hash][]byte)}, indexes: make(map[common.Hash][]byte)}
+	)
+	writer := NewBlockTraceWriter(store, block)
+	var (
+		txHashes []common.Hash
+		want     []ActionTraceList
+	)
+	for i := 0; i < 30; i++ {
+		list := randomTraces(rnd)
+		list.BlockHash, list.TransactionHash, list.TransactionPosition = block, common.Hash{0x1, byte(i)}, uint64(i)
+		if err := writer.Write(ctx, list); err != nil {
+			t.Fatalf("tx %d: failed to write traces: %v", i, err)
+		}
+		// persisted right away, the index waits for the flush
+		if len(store.data[list.TransactionHash]) == 0 || store.indexWrites != 0 {
+			t.Fatalf("tx %d: traces not written through", i)
+		}
+		txHashes = append(txHashes, list.TransactionHash)
+		want = append(want, list.ToTraces())
+	}
+	// the traces of a tracer are written the same, and a retried tx keeps its place
+	tracer := NewOeTracer(nil, block, big.NewInt(1), common.Hash{0x2}, 30)
+	tracer.CaptureStart(nil, common.Address{0x1}, common.Address{0x2}, false, []byte{0x1}, 100_000, big.NewInt(0))
+	tracer.CaptureEnd(nil, 100, nil)
+	for i := 0; i < 2; i++ {
+		if err := writer.WriteTracer(ctx, tracer); err != nil {
+			t.Fatalf("failed to write tracer: %v", err)
+		}
+	}
+	traces, _ := tracer.GetTraces()
+	txHashes, want = append(txHashes, common.Hash{0x2}), append(want, traces)
+
+	if _, err := ReadBlockTxHashes(ctx, store, block); !errors.Is(err, ErrBlockIndexNotFound) {
+		t.Fatalf("index read before the flush: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := writer.Flush(ctx); err != nil {
+			t.Fatalf("failed to flush: %v", err)
+		}
+	}
+	if store.indexWrites != 1 {
+		t.Fatalf("index writes mismatch: have %d, want 1", store.indexWrites)
+	}
+	indexed, err := ReadBlockTxHashes(ctx, store, block)
+	if err != nil || !reflect.DeepEqual(indexed, txHashes) || !reflect.DeepEqual(writer.TxHashes(), txHashes) {
+		t.Fatalf("block index mismatch: %v", err)
+	}
+	read, err := ReadRpcBlockTraces(ctx, store, indexed)
+	if err != nil {
+		t.Fatalf("failed to read block traces: %v", err)
+	}
+	for i := range read {
+		if !jsonEqual(read[i], want[i]) {
+			t.Fatalf("traces of tx %d mismatch", i)
+		}
+	}
+
+	// traces of another block are refused
+	other := randomTraces(rnd)
+	if err := writer.Write(ctx, other); !errors.Is(err, ErrMalformedTrace) {
+		t.Fatalf("foreign block mismatch: %v", err)
+	}
+	// stores without index only get the traces
+	plain := &MemoryStore{data: make(map[common.Hash][]byte)}
+	writer = NewBlockTraceWriter(plain, other.BlockHash)
+	if err := writer.Write(ctx, other); err != nil || len(plain.data[other.TransactionHash]) == 0 {
+		t.Fatalf("failed to write traces: %v", err)
+	}
+	if err := writer.Flush(ctx); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package txtracev2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// EVMFactory creates an evm running on the state shared by all txs of a bundle, traced by tracer.
+type EVMFactory func(tracer vm.EVMLogger) *vm.EVM
+
+// BundleTxError reports the tx of a bundle which failed.
+type BundleTxError struct {
+	Index  int
+	TxHash common.Hash
+	Err    error
+}
+
+func (e *BundleTxError) Error() string {
+	return fmt.Sprintf("bundle tx %d (%s) failed: %v", e.Index, e.TxHash.Hex(), e.Err)
+}
+
+func (e *BundleTxError) Unwrap() error {
+	return e.Err
+}
+
+// BundleOption configures optional behaviours of TraceBundle.
+type BundleOption func(cfg *bundleConfig)
+
+type bundleConfig struct {
+	continueOnRevert bool
+	summary          *BlockTraceSummary
+}
+
+// WithContinueOnRevert keeps tracing the txs after a reverted one, only invalid txs stop the bundle.
+func WithContinueOnRevert() BundleOption {
+	return func(cfg *bundleConfig) {
+		cfg.continueOnRevert = true
+	}
+}
+
+// WithSummary aggregates the traces of the traced txs into summary as a by-product of tracing, see
+// ComputeBlockSummary. It covers the txs whose traces are returned, including on failure.
+func WithSummary(summary *BlockTraceSummary) BundleOption {
+	return func(cfg *bundleConfig) {
+		*summary = BlockTraceSummary{InternalValue: new(big.Int)}
+		cfg.summary = summary
+	}
+}
+
+// TraceBundle is TraceBundleContext with the background context.
+func TraceBundle(store Store, evmFactory EVMFactory, txs []*types.Transaction, opts ...BundleOption) ([][]RpcActionTrace, error) {
+	return TraceBundleContext(context.Background(), store, evmFactory, txs, opts...)
+}
+
+// TraceBundleContext applies txs in sequence on the state of the evms created by evmFactory and traces each
+// of them with its own tracer, TransactionPosition being the index in the bundle. The traces are persisted
+// to store unless it's nil, the writes are given up once ctx is done. On failure a *BundleTxError is returned
+// along with the traces collected so far, which include the failed tx if it reverted, or its single
+// PreExecution trace if it failed before the evm ran it, see OeTracer.RecordPreExecutionFailure. A reverted tx
+// is a failure unless WithContinueOnRevert is given. The traces of a tx whose persist failed are returned
+// too, the persist error is reported by the *BundleTxError.
+func TraceBundleContext(ctx context.Context, store Store, evmFactory EVMFactory, txs []*types.Transaction, opts ...BundleOption) ([][]RpcActionTrace, error) {
+	cfg := new(bundleConfig)
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	var (
+		traces  = make([][]RpcActionTrace, 0, len(txs))
+		gasPool *core.GasPool
+	)
+	for i, tx := range txs {
+		fail := func(err error) ([][]RpcActionTrace, error) {
+			return traces, &BundleTxError{Index: i, TxHash: tx.Hash(), Err: err}
+		}
+		// the tracer needs the block of the evm, it's filled in once the evm exists
+		tracer := NewOeTracer(store, common.Hash{}, nil, tx.Hash(), uint64(i))
+		evm := evmFactory(tracer)
+		if evm.Context.BlockNumber != nil {
+			tracer.outPutTraces.BlockNumber = evm.Context.BlockNumber
+		}
+		tracer.outPutTraces.Timestamp = evm.Context.Time
+		if gasPool == nil {
+			gasPool = new(core.GasPool).AddGas(evm.Context.GasLimit)
+		}
+
+		signer := types.MakeSigner(evm.ChainConfig(), evm.Context.BlockNumber, evm.Context.Time)
+		msg, err := core.TransactionToMessage(tx, signer, evm.Context.BaseFee)
+		if err != nil {
+			return fail(err)
+		}
+		if statedb, ok := evm.StateDB.(interface{ SetTxContext(common.Hash, int) }); ok {
+			statedb.SetTxContext(tx.Hash(), i)
+		}
+		evm.Reset(core.NewEVMTxContext(msg), evm.StateDB)
+		result, err := core.ApplyMessage(evm, msg, gasPool)
+		if err != nil {
+			// the evm didn't run, the tx is recorded failed before it
+			tracer.RecordPreExecutionFailure(err, *msg)
+			txTraces, traceErr := tracer.GetTraces()
+			if traceErr != nil {
+				return fail(err)
+			}
+			traces = append(traces, txTraces)
+			if cfg.summary != nil {
+				cfg.summary.add(&tracer.outPutTraces)
+			}
+			if persistErr := tracer.PersistTraceContext(ctx); persistErr != nil {
+				return fail(errors.Join(err, persistErr))
+			}
+			return fail(err)
+		}
+		// later txs must see the state changes of this one
+		if statedb, ok := evm.StateDB.(interface{ Finalise(bool) }); ok {
+			statedb.Finalise(true)
+		}
+
+		txTraces, err := tracer.GetTraces()
+		if err != nil {
+			return fail(err)
+		}
+		traces = append(traces, txTraces)
+		if cfg.summary != nil {
+			cfg.summary.add(&tracer.outPutTraces)
+		}
+		if err := tracer.PersistTraceContext(ctx); err != nil {
+			return fail(err)
+		}
+		if result.Failed() && !cfg.continueOnRevert {
+			return fail(result.Err)
+		}
+	}
+	return traces, nil
+}
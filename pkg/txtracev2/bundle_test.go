@@ -0,0 +1,216 @@
+package txtracev2
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/tests"
+)
+
+func TestTraceBundle(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	var (
+		sender = crypto.PubkeyToAddress(key.PublicKey)
+		once   = common.HexToAddress("0x6000000000000000000000000000000000000006")
+		config = params.AllEthashProtocolChanges
+		signer = types.MakeSigner(config, big.NewInt(1), 0)
+	)
+	// stores 1 in slot 0 on the first call, reverts once the slot is set
+	code := common.FromHex("0x600054600c57600160005500" + "5b60006000fd")
+	bundle := func() []*types.Transaction {
+		var txs []*types.Transaction
+		for nonce := uint64(0); nonce < 3; nonce++ {
+			tx, err := types.SignNewTx(key, signer, &types.LegacyTx{Nonce: nonce, To: &once, Gas: 100_000, GasPrice: big.NewInt(0)})
+			if err != nil {
+				t.Fatalf("failed to sign tx: %v", err)
+			}
+			txs = append(txs, tx)
+		}
+		return txs
+	}
+	traceTo := func(store Store, txs []*types.Transaction, opts ...BundleOption) ([][]RpcActionTrace, error) {
+		alloc := types.GenesisAlloc{
+			sender: {Balance: big.NewInt(1_000_000_000)},
+			once:   {Code: code},
+		}
+		state := tests.MakePreState(rawdb.NewMemoryDatabase(), alloc, false, rawdb.HashScheme)
+		defer state.Close()
+		blkContext := vm.BlockContext{
+			CanTransfer: core.CanTransfer,
+			Transfer:    core.Transfer,
+			GasLimit:    10_000_000,
+			BlockNumber: big.NewInt(1),
+			Time:        1_700_000_000,
+			Difficulty:  big.NewInt(1),
+			BaseFee:     big.NewInt(0),
+		}
+		factory := func(tracer vm.EVMLogger) *vm.EVM {
+			return vm.NewEVM(blkContext, vm.TxContext{GasPrice: new(big.Int)}, state.StateDB, config, vm.Config{Tracer: tracer, NoBaseFee: true})
+		}
+		return TraceBundle(store, factory, txs, opts...)
+	}
+	trace := func(txs []*types.Transaction, opts ...BundleOption) (*MemoryStore, [][]RpcActionTrace, error) {
+		store := &MemoryStore{data: make(map[common.Hash][]byte)}
+		traces, err := traceTo(store, txs, opts...)
+		return store, traces, err
+	}
+
+	// the second tx sees the slot set by the first one and reverts
+	txs := bundle()
+	_, traces, err := trace(txs)
+	var bundleErr *BundleTxError
+	if !errors.As(err, &bundleErr) || bundleErr.Index != 1 || bundleErr.TxHash != txs[1].Hash() || !errors.Is(err, vm.ErrExecutionReverted) {
+		t.Fatalf("bundle error mismatch: have %v", err)
+	}
+	if len(traces) != 2 || traces[0][0].Error != "" || traces[1][0].Error == "" {
+		t.Fatalf("traces mismatch before the reverted tx: have %d txs", len(traces))
+	}
+
+	var summary BlockTraceSummary
+	store, traces, err := trace(txs, WithContinueOnRevert(), WithSummary(&summary))
+	if err != nil {
+		t.Fatalf("failed to trace bundle: %v", err)
+	}
+	if summary.Txs != 3 || summary.FailedFrames != 2 || summary.InternalCalls != 0 || summary.InternalValue.Sign() != 0 {
+		t.Fatalf("bundle summary mismatch: %+v", summary)
+	}
+	if len(traces) != 3 {
+		t.Fatalf("traced tx count mismatch: have %d, want %d", len(traces), 3)
+	}
+	for i, txTraces := range traces {
+		if txTraces[0].TransactionPosition != uint64(i) || txTraces[0].TransactionHash != txs[i].Hash() {
+			t.Fatalf("tx %d: position mismatch: have %d %x", i, txTraces[0].TransactionPosition, txTraces[0].TransactionHash)
+		}
+		if txTraces[0].BlockTimestamp != 1_700_000_000 {
+			t.Fatalf("tx %d: block timestamp mismatch: have %d", i, txTraces[0].BlockTimestamp)
+		}
+		if reverted := txTraces[0].Error != ""; reverted != (i > 0) {
+			t.Fatalf("tx %d: unexpected error %q", i, txTraces[0].Error)
+		}
+		if _, ok := store.data[txs[i].Hash()]; !ok {
+			t.Fatalf("tx %d: trace not persisted", i)
+		}
+	}
+
+	// an invalid tx stops the bundle even when reverts are tolerated, it's recorded failed before execution
+	replayed := txs[1]
+	txs[2] = replayed
+	store, traces, err = trace(txs, WithContinueOnRevert())
+	if !errors.As(err, &bundleErr) || bundleErr.Index != 2 || !errors.Is(err, core.ErrNonceTooLow) {
+		t.Fatalf("bundle error mismatch: have %v", err)
+	}
+	if len(traces) != 3 || len(traces[2]) != 1 || traces[2][0].Error != "Invalid transaction nonce" || traces[2][0].Result != nil {
+		t.Fatalf("traces of the invalid tx mismatch: %+v", traces)
+	}
+	persisted, err := ReadRpcTxTraceWithConfig(context.Background(), store, replayed.Hash(), TracerConfig{Verbose: true})
+	if err != nil || len(persisted) != 1 || !persisted[0].PreExecution || persisted[0].Error != "Invalid transaction nonce" || persisted[0].TransactionPosition != 2 {
+		t.Fatalf("persisted traces of the invalid tx mismatch: %+v, %v", persisted, err)
+	}
+	if action := persisted[0].Action; *action.From != sender || *action.To != once || uint64(action.Gas) != 100_000 {
+		t.Fatalf("action of the invalid tx mismatch: %+v", action)
+	}
+
+	// the traces of a tx whose persist failed are returned along with the error
+	skipped, err := types.SignNewTx(key, signer, &types.LegacyTx{Nonce: 5, To: &once, Gas: 100_000, GasPrice: big.NewInt(0)})
+	if err != nil {
+		t.Fatalf("failed to sign tx: %v", err)
+	}
+	txs = append(bundle()[:2], skipped)
+	failing := newSyncStore(0)
+	failing.fail[txs[0].Hash()], failing.fail[skipped.Hash()] = true, true
+	traces, err = traceTo(failing, txs, WithContinueOnRevert())
+	if !errors.As(err, &bundleErr) || bundleErr.Index != 0 || !errors.Is(err, ErrTraceWrite) || len(traces) != 1 {
+		t.Fatalf("bundle error mismatch on a failed persist: have %v, %d txs", err, len(traces))
+	}
+	delete(failing.fail, txs[0].Hash())
+	failing.data = make(map[common.Hash][]byte)
+	traces, err = traceTo(failing, txs, WithContinueOnRevert())
+	if !errors.As(err, &bundleErr) || bundleErr.Index != 2 || !errors.Is(err, core.ErrNonceTooHigh) || !errors.Is(err, ErrTraceWrite) {
+		t.Fatalf("bundle error mismatch on a failed persist of an invalid tx: have %v", err)
+	}
+	if len(traces) != 3 || len(traces[2]) != 1 || traces[2][0].Error != "Invalid transaction nonce" || traces[2][0].Result != nil {
+		t.Fatalf("traces of the invalid tx mismatch on a failed persist: %+v", traces)
+	}
+}
+
+func TestRecordPreExecutionFailure(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	var (
+		sender = crypto.PubkeyToAddress(key.PublicKey)
+		to     = common.HexToAddress("0x7000000000000000000000000000000000000007")
+		config = params.AllEthashProtocolChanges
+		signer = types.MakeSigner(config, big.NewInt(1), 0)
+	)
+	for _, test := range []struct {
+		name   string
+		tx     types.TxData
+		err    error
+		parity string
+	}{
+		{"insufficient funds", &types.LegacyTx{Nonce: 1, To: &to, Value: big.NewInt(2_000_000_000), Gas: 21_000, GasPrice: big.NewInt(1)}, core.ErrInsufficientFunds, "Insufficient balance for transaction"},
+		{"nonce too low", &types.LegacyTx{Nonce: 0, To: &to, Gas: 21_000, GasPrice: big.NewInt(1)}, core.ErrNonceTooLow, "Invalid transaction nonce"},
+		{"create", &types.LegacyTx{Nonce: 0, Data: []byte{0x60}, Gas: 100_000, GasPrice: big.NewInt(1)}, core.ErrNonceTooLow, "Invalid transaction nonce"},
+	} {
+		alloc := types.GenesisAlloc{sender: {Balance: big.NewInt(1_000_000_000), Nonce: 1}}
+		state := tests.MakePreState(rawdb.NewMemoryDatabase(), alloc, false, rawdb.HashScheme)
+		tx, err := types.SignNewTx(key, signer, test.tx)
+		if err != nil {
+			t.Fatalf("%s: failed to sign tx: %v", test.name, err)
+		}
+		msg, err := core.TransactionToMessage(tx, signer, nil)
+		if err != nil {
+			t.Fatalf("%s: failed to convert tx: %v", test.name, err)
+		}
+		store := &MemoryStore{data: make(map[common.Hash][]byte)}
+		tracer := NewOeTracer(store, common.Hash{0xb}, big.NewInt(1), tx.Hash(), 3)
+		blkContext := vm.BlockContext{CanTransfer: core.CanTransfer, Transfer: core.Transfer, GasLimit: 10_000_000, BlockNumber: big.NewInt(1), Difficulty: big.NewInt(1), BaseFee: big.NewInt(0)}
+		evm := vm.NewEVM(blkContext, core.NewEVMTxContext(msg), state.StateDB, config, vm.Config{Tracer: tracer})
+		_, err = core.ApplyMessage(evm, msg, new(core.GasPool).AddGas(msg.GasLimit))
+		state.Close()
+		if !errors.Is(err, test.err) {
+			t.Fatalf("%s: apply error mismatch: have %v, want %v", test.name, err, test.err)
+		}
+		if _, err := tracer.GetTraces(); !errors.Is(err, ErrTraceIncomplete) {
+			t.Fatalf("%s: expected nothing captured, have %v", test.name, err)
+		}
+
+		tracer.RecordPreExecutionFailure(err, *msg)
+		if err := tracer.PersistTraceContext(context.Background()); err != nil {
+			t.Fatalf("%s: failed to persist traces: %v", test.name, err)
+		}
+		list := new(InternalActionTraceList)
+		if err := rlp.DecodeBytes(store.data[tx.Hash()], list); err != nil {
+			t.Fatalf("%s: failed to decode stored traces: %v", test.name, err)
+		}
+		if len(list.Traces) != 1 || list.TransactionPosition != 3 {
+			t.Fatalf("%s: stored traces mismatch: %+v", test.name, list)
+		}
+		root := list.Traces[0]
+		if !root.PreExecution || root.Result != nil || root.Error != test.parity || *root.Action.From != sender || root.Action.Gas != tx.Gas() {
+			t.Fatalf("%s: stored trace mismatch: %+v", test.name, root)
+		}
+		if create := tx.To() == nil; create != (root.Action.CallType == CallTypeCreate) || (!create && *root.Action.To != to) {
+			t.Fatalf("%s: stored action mismatch: %+v", test.name, root.Action)
+		}
+		traces, err := ReadRpcTxTrace(context.Background(), store, tx.Hash())
+		if err != nil || len(traces) != 1 || traces[0].Error != test.parity || traces[0].Result != nil {
+			t.Fatalf("%s: rpc traces mismatch: %+v, %v", test.name, traces, err)
+		}
+
+		// a tracer which captured the tx keeps its traces
+		tracer.RecordPreExecutionFailure(core.ErrNonceTooHigh, *msg)
+		if got, _ := tracer.GetTraces(); len(got) != 1 || got[0].Error != test.parity {
+			t.Fatalf("%s: traces replaced: %+v", test.name, got)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package txtracev2
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+)
+
+// CanonicalJSONOptions configures MarshalCanonicalJSON.
+type CanonicalJSONOptions struct {
+	// ParityExact emits the traces exactly like OpenEthereum: the fields beyond the parity format are left out,
+	// the result of suicides is always emitted, null, and so is the output of successful calls, 0x when empty.
+	ParityExact bool
+}
+
+// parityFields are the fields of the traces in the parity format, and the ones of their actions by trace type
+var parityFields = map[string][]string{
+	"":        {"action", "blockHash", "blockNumber", "error", "result", "subtraces", "traceAddress", "transactionHash", "transactionPosition", "type"},
+	"call":    {"callType", "from", "gas", "input", "to", "value"},
+	"create":  {"from", "gas", "init", "value"},
+	"suicide": {"address", "balance", "refundAddress"},
+}
+
+// MarshalCanonicalJSON encodes the trace with its fields, and the ones of its action and result, in
+// alphabetical order, the order of OpenEthereum responses whose objects go through a sorted map. Traces of any
+// shape are ordered the same, e.g. for byte-for-byte comparisons with golden files or OpenEthereum itself.
+func (t ActionTrace) MarshalCanonicalJSON(opts CanonicalJSONOptions) ([]byte, error) {
+	raw, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	if opts.ParityExact {
+		keepFields(fields, parityFields[""])
+		if t.TraceType == "suicide" {
+			fields["result"] = json.RawMessage("null")
+		}
+	}
+	if fields["action"], err = sortedObject(fields["action"], opts, parityFields[t.TraceType], nil); err != nil {
+		return nil, err
+	}
+	if result, ok := fields["result"]; ok && t.Result != nil {
+		var missing map[string]json.RawMessage
+		if opts.ParityExact && t.TraceType == "call" && t.Result.Output == nil {
+			missing = map[string]json.RawMessage{"output": json.RawMessage(`"0x"`)}
+		}
+		if fields["result"], err = sortedObject(result, opts, nil, missing); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// MarshalCanonicalJSON encodes the traces like ActionTrace.MarshalCanonicalJSON, in a json array.
+func (traces ActionTraceList) MarshalCanonicalJSON(opts CanonicalJSONOptions) ([]byte, error) {
+	buf := bytes.NewBufferString("[")
+	for i := range traces {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		raw, err := traces[i].MarshalCanonicalJSON(opts)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(raw)
+	}
+	buf.WriteByte(']')
+	return buf.Bytes(), nil
+}
+
+// sortedObject re-encodes a json object with its keys sorted, when parity exact only with the parity fields,
+// all of them when nil, and the missing ones
+func sortedObject(raw json.RawMessage, opts CanonicalJSONOptions, parity []string, missing map[string]json.RawMessage) (json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	if opts.ParityExact {
+		if parity != nil {
+			keepFields(fields, parity)
+		}
+		for key, value := range missing {
+			fields[key] = value
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// keepFields deletes the fields of a json object but keys
+func keepFields(fields map[string]json.RawMessage, keys []string) {
+	for key := range fields {
+		if !slices.Contains(keys, key) {
+			delete(fields, key)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package txtracev2
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+func TestMarshalCanonicalJSON(t *testing.T) {
+	var (
+		from    = common.HexToAddress("0x1000000000000000000000000000000000000001")
+		to      = common.HexToAddress("0x2000000000000000000000000000000000000002")
+		created = common.HexToAddress("0x3000000000000000000000000000000000000003")
+		call    = "call"
+		empty   = hexutil.Bytes{}
+		code    = hexutil.Bytes{0x60, 0x00}
+		yes     = true
+	)
+	traces := ActionTraceList{
+		{
+			Action:         Action{CallType: &call, From: &from, To: &to, Value: (*hexutil.Big)(big.NewInt(1)), Gas: 0x5208, Input: &empty},
+			BlockHash:      common.Hash{0xb},
+			BlockNumber:    big.NewInt(100),
+			BlockTimestamp: 1_700_000_000,
+			Result:         &ActionResult{GasUsed: 0x10},
+			Subtraces:      2,
+			TraceAddress:   []uint32{},
+			TraceType:      "call",
+		},
+		{
+			Action:       Action{CallType: &call, From: &to, To: &from, Value: (*hexutil.Big)(big.NewInt(0)), Gas: 0x100, Input: &empty},
+			BlockHash:    common.Hash{0xb},
+			BlockNumber:  big.NewInt(100),
+			Error:        "Reverted",
+			TraceAddress: []uint32{0},
+			TraceType:    "call",
+		},
+		{
+			Action:       Action{From: &to, Value: (*hexutil.Big)(big.NewInt(0)), Gas: 0x200, Init: &code, CreateMethod: "create2"},
+			BlockHash:    common.Hash{0xb},
+			BlockNumber:  big.NewInt(100),
+			Result:       &ActionResult{GasUsed: 0x20, Code: &code, Address: &created},
+			Subtraces:    1,
+			TraceAddress: []uint32{1},
+			TraceType:    "create",
+		},
+		{
+			Action:       Action{Address: &created, RefundAddress: &from, Balance: (*hexutil.Big)(big.NewInt(0)), Destroyed: &yes},
+			BlockHash:    common.Hash{0xb},
+			BlockNumber:  big.NewInt(100),
+			TraceAddress: []uint32{1, 0},
+			TraceType:    "suicide",
+		},
+	}
+	const (
+		block = `"blockHash":"0x0b00000000000000000000000000000000000000000000000000000000000000","blockNumber":100`
+		tx    = `"transactionHash":"0x0000000000000000000000000000000000000000000000000000000000000000","transactionPosition":0`
+	)
+	for _, test := range []struct {
+		opts CanonicalJSONOptions
+		want string
+	}{
+		{CanonicalJSONOptions{}, `[` +
+			`{"action":{"callType":"call","from":"0x1000000000000000000000000000000000000001","gas":"0x5208","input":"0x","to":"0x2000000000000000000000000000000000000002","value":"0x1"},` + block + `,"blockTimestamp":1700000000,"result":{"gasUsed":"0x10"},"subtraces":2,"traceAddress":[],` + tx + `,"type":"call"},` +
+			`{"action":{"callType":"call","from":"0x2000000000000000000000000000000000000002","gas":"0x100","input":"0x","to":"0x1000000000000000000000000000000000000001","value":"0x0"},` + block + `,"error":"Reverted","subtraces":0,"traceAddress":[0],` + tx + `,"type":"call"},` +
+			`{"action":{"createMethod":"create2","from":"0x2000000000000000000000000000000000000002","gas":"0x200","init":"0x6000","value":"0x0"},` + block + `,"result":{"address":"0x3000000000000000000000000000000000000003","code":"0x6000","gasUsed":"0x20"},"subtraces":1,"traceAddress":[1],` + tx + `,"type":"create"},` +
+			`{"action":{"address":"0x3000000000000000000000000000000000000003","balance":"0x0","destroyed":true,"from":null,"gas":"0x0","refundAddress":"0x1000000000000000000000000000000000000001","value":null},` + block + `,"subtraces":0,"traceAddress":[1,0],` + tx + `,"type":"suicide"}` +
+			`]`},
+		{CanonicalJSONOptions{ParityExact: true}, `[` +
+			`{"action":{"callType":"call","from":"0x1000000000000000000000000000000000000001","gas":"0x5208","input":"0x","to":"0x2000000000000000000000000000000000000002","value":"0x1"},` + block + `,"result":{"gasUsed":"0x10","output":"0x"},"subtraces":2,"traceAddress":[],` + tx + `,"type":"call"},` +
+			`{"action":{"callType":"call","from":"0x2000000000000000000000000000000000000002","gas":"0x100","input":"0x","to":"0x1000000000000000000000000000000000000001","value":"0x0"},` + block + `,"error":"Reverted","subtraces":0,"traceAddress":[0],` + tx + `,"type":"call"},` +
+			`{"action":{"from":"0x2000000000000000000000000000000000000002","gas":"0x200","init":"0x6000","value":"0x0"},` + block + `,"result":{"address":"0x3000000000000000000000000000000000000003","code":"0x6000","gasUsed":"0x20"},"subtraces":1,"traceAddress":[1],` + tx + `,"type":"create"},` +
+			`{"action":{"address":"0x3000000000000000000000000000000000000003","balance":"0x0","refundAddress":"0x1000000000000000000000000000000000000001"},` + block + `,"result":null,"subtraces":0,"traceAddress":[1,0],` + tx + `,"type":"suicide"}` +
+			`]`},
+	} {
+		have, err := traces.MarshalCanonicalJSON(test.opts)
+		if err != nil {
+			t.Fatalf("parity exact %v: failed to marshal traces: %v", test.opts.ParityExact, err)
+		}
+		if string(have) != test.want {
+			t.Fatalf("parity exact %v: canonical json mismatch:\nhave %s\nwant %s", test.opts.ParityExact, have, test.want)
+		}
+		// the canonical form decodes to the same traces as the plain one, up to the fields left out
+		var decoded ActionTraceList
+		if err := json.Unmarshal(have, &decoded); err != nil || len(decoded) != len(traces) || decoded[2].Result.Address == nil || *decoded[2].Result.Address != created {
+			t.Fatalf("parity exact %v: failed to decode canonical json: %v", test.opts.ParityExact, err)
+		}
+	}
+	// the traces themselves are left as is
+	if traces[0].Result.Output != nil || traces[2].Action.CreateMethod != "create2" {
+		t.Fatalf("traces modified by the canonical encoding: %+v", traces)
+	}
+}
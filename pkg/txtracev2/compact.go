@@ -0,0 +1,269 @@
+package txtracev2
+
+import (
+	"fmt"
+	"math/big"
+	"slices"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// compactVersion is the version byte of the compact encoding
+const compactVersion = 1
+
+// flags of compactTrace
+const (
+	compactSubtracesTruncated = 1 << iota
+	compactImpersonated
+	compactEOAInput
+	compactPreExecution
+)
+
+// compactBlock is the rlp layout of EncodeCompact following the version byte: the block fields are stored
+// once, the addresses once in the order they're first met and the traces refer to them by index
+type compactBlock struct {
+	BlockHash   common.Hash
+	BlockNumber *big.Int `rlp:"nil"`
+	Timestamp   uint64
+	Addresses   []common.Address
+	Txs         []compactTx
+}
+
+type compactTx struct {
+	TransactionHash     common.Hash
+	TransactionPosition uint64
+	GasBreakdown        *TxGasBreakdown `rlp:"nil"`
+	Traces              []compactTrace
+}
+
+// compactTrace is an InternalActionTrace whose traceAddress is delta encoded: it's the one of the last trace
+// at depth-1 followed by the index after the last sibling, or 0, plus skipped. The addresses are 1-based
+// indexes in compactBlock.Addresses, 0 for nil.
+type compactTrace struct {
+	Depth          uint32
+	Skipped        uint32 // siblings not recorded before the frame, e.g. dropped by an address filter
+	Unrecorded     uint32 // Subtraces beyond the sub traces recorded
+	Flags          uint8
+	CallType       uint8
+	From           uint32
+	To             uint32
+	Address        uint32
+	RefundAddress  uint32
+	StorageAddress uint32
+	Value          *big.Int `rlp:"nil"`
+	Balance        *big.Int `rlp:"nil"`
+	Gas            uint64
+	Init           []byte
+	Input          []byte
+	CreateMethod   string
+	CallTypeName   string
+	Destroyed      uint8          // 0 for nil, 1 for false, 2 for true
+	Result         *compactResult `rlp:"nil"`
+	Error          string
+	Fault          *FaultInfo `rlp:"nil"`
+}
+
+type compactResult struct {
+	GasUsed uint64
+	Output  []byte
+	Code    []byte
+	Address uint32
+}
+
+// EncodeCompact encodes the traces of txs of the same block for cold storage, smaller than their rlp encoding:
+// the block fields are stored once, the traceAddresses are delta encoded and the addresses are deduplicated.
+// The traces of every tx must be in trace order, parents first, like the ones of OeTracer. The nil values and
+// balances of the traces are decoded as zero, their rpc form is the same.
+func EncodeCompact(lists []*InternalActionTraceList) ([]byte, error) {
+	block := new(compactBlock)
+	if len(lists) > 0 {
+		block.BlockHash, block.BlockNumber, block.Timestamp = lists[0].BlockHash, lists[0].BlockNumber, lists[0].Timestamp
+	}
+	indexes := make(map[common.Address]uint32)
+	ref := func(addr *common.Address) uint32 {
+		if addr == nil {
+			return 0
+		}
+		index, ok := indexes[*addr]
+		if !ok {
+			block.Addresses = append(block.Addresses, *addr)
+			index = uint32(len(block.Addresses))
+			indexes[*addr] = index
+		}
+		return index
+	}
+	for _, list := range lists {
+		if list.BlockHash != block.BlockHash || list.Timestamp != block.Timestamp || !equalBig(list.BlockNumber, block.BlockNumber) {
+			return nil, fmt.Errorf("%w: tx %s is in block %s, not %s", ErrMalformedTrace, list.TransactionHash.Hex(), list.BlockHash.Hex(), block.BlockHash.Hex())
+		}
+		tx := compactTx{
+			TransactionHash:     list.TransactionHash,
+			TransactionPosition: list.TransactionPosition,
+			GasBreakdown:        list.GasBreakdown,
+			Traces:              make([]compactTrace, len(list.Traces)),
+		}
+		var (
+			stack    []int    // index of the last trace at every depth
+			next     []uint32 // index of the next sub trace of the ones of stack
+			children = make([]uint32, len(list.Traces))
+		)
+		for i, trace := range list.Traces {
+			depth := len(trace.TraceAddress)
+			compact := &tx.Traces[i]
+			compact.Depth = uint32(depth)
+			if depth > 0 {
+				if depth > len(stack) || !slices.Equal(list.Traces[stack[depth-1]].TraceAddress, trace.TraceAddress[:depth-1]) || trace.TraceAddress[depth-1] < next[depth-1] {
+					return nil, fmt.Errorf("%w: tx %s: trace %v out of trace order", ErrMalformedTrace, list.TransactionHash.Hex(), trace.TraceAddress)
+				}
+				compact.Skipped = trace.TraceAddress[depth-1] - next[depth-1]
+				next[depth-1] = trace.TraceAddress[depth-1] + 1
+				children[stack[depth-1]]++
+			}
+			stack, next = append(stack[:depth], i), append(next[:depth], 0)
+
+			action := &trace.Action
+			compact.CallType = action.CallType
+			compact.From, compact.To, compact.Address = ref(action.From), ref(action.To), ref(action.Address)
+			compact.RefundAddress, compact.StorageAddress = ref(action.RefundAddress), ref(trace.StorageAddress)
+			compact.Value, compact.Balance, compact.Gas = action.Value, action.Balance, action.Gas
+			compact.Init, compact.Input = action.Init, action.Input
+			compact.CreateMethod, compact.CallTypeName = action.CreateMethod, action.CallTypeName
+			if action.Destroyed != nil {
+				compact.Destroyed = 1
+				if *action.Destroyed {
+					compact.Destroyed = 2
+				}
+			}
+			if result := trace.Result; result != nil {
+				compact.Result = &compactResult{GasUsed: result.GasUsed, Output: result.Output, Code: result.Code, Address: ref(result.Address)}
+			}
+			compact.Error, compact.Fault = trace.Error, trace.Fault
+			if trace.SubtracesTruncated {
+				compact.Flags |= compactSubtracesTruncated
+			}
+			if trace.Impersonated {
+				compact.Flags |= compactImpersonated
+			}
+			if trace.EOAInput {
+				compact.Flags |= compactEOAInput
+			}
+			if trace.PreExecution {
+				compact.Flags |= compactPreExecution
+			}
+		}
+		for i, trace := range list.Traces {
+			if trace.Subtraces < children[i] {
+				return nil, fmt.Errorf("%w: tx %s: trace %v has %d subtraces, %d recorded", ErrMalformedTrace, list.TransactionHash.Hex(), trace.TraceAddress, trace.Subtraces, children[i])
+			}
+			tx.Traces[i].Unrecorded = trace.Subtraces - children[i]
+		}
+		block.Txs = append(block.Txs, tx)
+	}
+	raw, err := rlp.EncodeToBytes(block)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTraceEncode, err)
+	}
+	return append([]byte{compactVersion}, raw...), nil
+}
+
+// DecodeCompact decodes the traces encoded by EncodeCompact, in the order they were encoded in.
+func DecodeCompact(raw []byte) ([]*InternalActionTraceList, error) {
+	if len(raw) == 0 || raw[0] != compactVersion {
+		return nil, fmt.Errorf("%w: unknown compact encoding version %x", ErrMalformedTrace, raw[:min(len(raw), 1)])
+	}
+	block := new(compactBlock)
+	if err := rlp.DecodeBytes(raw[1:], block); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedTrace, err)
+	}
+	addr := func(index uint32) (*common.Address, error) {
+		switch {
+		case index == 0:
+			return nil, nil
+		case int(index) > len(block.Addresses):
+			return nil, fmt.Errorf("%w: address %d of %d", ErrMalformedTrace, index, len(block.Addresses))
+		}
+		addr := block.Addresses[index-1]
+		return &addr, nil
+	}
+	lists := make([]*InternalActionTraceList, 0, len(block.Txs))
+	for _, tx := range block.Txs {
+		list := &InternalActionTraceList{
+			Traces:              make([]*InternalActionTrace, len(tx.Traces)),
+			BlockHash:           block.BlockHash,
+			BlockNumber:         block.BlockNumber,
+			TransactionHash:     tx.TransactionHash,
+			TransactionPosition: tx.TransactionPosition,
+			GasBreakdown:        tx.GasBreakdown,
+			Timestamp:           block.Timestamp,
+		}
+		var (
+			stack []*InternalActionTrace
+			next  []uint32
+		)
+		for i := range tx.Traces {
+			compact := &tx.Traces[i]
+			depth := int(compact.Depth)
+			if depth > len(stack) {
+				return nil, fmt.Errorf("%w: tx %s: trace %d at depth %d below %d", ErrMalformedTrace, tx.TransactionHash.Hex(), i, depth, len(stack))
+			}
+			trace := &InternalActionTrace{
+				Action: InternalAction{
+					CallType:     compact.CallType,
+					Value:        compact.Value,
+					Balance:      compact.Balance,
+					Gas:          compact.Gas,
+					Init:         compact.Init,
+					Input:        compact.Input,
+					CreateMethod: compact.CreateMethod,
+					CallTypeName: compact.CallTypeName,
+				},
+				Error:              compact.Error,
+				TraceAddress:       make([]uint32, 0, depth),
+				Subtraces:          compact.Unrecorded,
+				SubtracesTruncated: compact.Flags&compactSubtracesTruncated != 0,
+				Fault:              compact.Fault,
+				Impersonated:       compact.Flags&compactImpersonated != 0,
+				EOAInput:           compact.Flags&compactEOAInput != 0,
+				PreExecution:       compact.Flags&compactPreExecution != 0,
+			}
+			if depth > 0 {
+				parent := stack[depth-1]
+				trace.TraceAddress = append(append(trace.TraceAddress, parent.TraceAddress...), next[depth-1]+compact.Skipped)
+				next[depth-1] += compact.Skipped + 1
+				parent.Subtraces++
+			}
+			stack, next = append(stack[:depth], trace), append(next[:depth], 0)
+
+			var err error
+			action := &trace.Action
+			for _, field := range []struct {
+				addr  **common.Address
+				index uint32
+			}{
+				{&action.From, compact.From}, {&action.To, compact.To}, {&action.Address, compact.Address},
+				{&action.RefundAddress, compact.RefundAddress}, {&trace.StorageAddress, compact.StorageAddress},
+			} {
+				if *field.addr, err = addr(field.index); err != nil {
+					return nil, err
+				}
+			}
+			if compact.Destroyed > 0 {
+				destroyed := compact.Destroyed == 2
+				action.Destroyed = &destroyed
+			}
+			if result := compact.Result; result != nil {
+				trace.Result = &InternalTraceActionResult{GasUsed: result.GasUsed, Output: result.Output, Code: result.Code}
+				if trace.Result.Address, err = addr(result.Address); err != nil {
+					return nil, err
+				}
+			}
+			list.Traces[i] = trace
+		}
+		if err := list.Validate(); err != nil {
+			return nil, err
+		}
+		lists = append(lists, list)
+	}
+	return lists, nil
+}
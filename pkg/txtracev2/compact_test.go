@@ -0,0 +1,107 @@
+package txtracev2
+
+import (
+	"errors"
+	"math/big"
+	"math/rand"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+func TestCompactCodec(t *testing.T) {
+	var (
+		rnd       = rand.New(rand.NewSource(1))
+		blockHash = common.Hash{0xb}
+		number    = big.NewInt(18_000_000)
+		lists     []*InternalActionTraceList
+	)
+	for i := 0; i < 20; i++ {
+		list := randomTraces(rnd)
+		list.BlockHash, list.BlockNumber, list.Timestamp = blockHash, number, 1_700_000_000
+		list.TransactionHash, list.TransactionPosition = common.Hash{0x1, byte(i)}, uint64(i)
+		lists = append(lists, list)
+	}
+	// sub traces dropped by an address filter leave gaps in the traceAddresses of their siblings
+	tracer := NewOeTracer(nil, blockHash, number, common.Hash{0x2}, 20, WithBlockTimestamp(1_700_000_000), WithAddressFilter(common.Address{0xee}))
+	tracer.CaptureStart(nil, common.Address{0x1}, common.Address{0x2}, false, []byte{0x01}, 100_000, big.NewInt(0))
+	tracer.CaptureEnter(vm.CALL, common.Address{0x2}, common.Address{0xa}, nil, 90_000, big.NewInt(0))
+	tracer.CaptureExit(nil, 100, nil)
+	tracer.CaptureEnter(vm.CALL, common.Address{0x2}, common.Address{0xee}, nil, 80_000, big.NewInt(0))
+	tracer.CaptureEnter(vm.STATICCALL, common.Address{0xee}, common.Address{0xa}, nil, 70_000, nil)
+	tracer.CaptureExit(nil, 100, nil)
+	tracer.CaptureExit(nil, 200, nil)
+	tracer.CaptureEnd(nil, 1_000, nil)
+	lists = append(lists, tracer.getInternalTraces())
+
+	raw, err := EncodeCompact(lists)
+	if err != nil {
+		t.Fatalf("failed to encode traces: %v", err)
+	}
+	decoded, err := DecodeCompact(raw)
+	if err != nil {
+		t.Fatalf("failed to decode traces: %v", err)
+	}
+	if len(decoded) != len(lists) {
+		t.Fatalf("tx count mismatch: have %d, want %d", len(decoded), len(lists))
+	}
+	plain := 0
+	for i, list := range lists {
+		if have, want := rpcJSON(t, decoded[i]), rpcJSON(t, list); have != want {
+			t.Fatalf("tx %d: rpc form mismatch:\nhave %s\nwant %s", i, have, want)
+		}
+		blob, err := rlp.EncodeToBytes(list)
+		if err != nil {
+			t.Fatalf("failed to encode traces: %v", err)
+		}
+		plain += len(blob)
+	}
+	if len(raw) >= plain {
+		t.Fatalf("compact encoding of %d bytes not smaller than the %d bytes of rlp", len(raw), plain)
+	}
+
+	// the traces of a deep call tree lose most of their redundancy
+	deep := deepCallsTraces(t)
+	if raw, err = EncodeCompact([]*InternalActionTraceList{deep}); err != nil {
+		t.Fatalf("failed to encode deep traces: %v", err)
+	}
+	blob, err := rlp.EncodeToBytes(deep)
+	if err != nil {
+		t.Fatalf("failed to encode deep traces: %v", err)
+	}
+	if len(raw)*10 > len(blob)*8 {
+		t.Fatalf("compact encoding of %d bytes not 20%% smaller than the %d bytes of rlp", len(raw), len(blob))
+	}
+	if decoded, err = DecodeCompact(raw); err != nil || rpcJSON(t, decoded[0]) != rpcJSON(t, deep) {
+		t.Fatalf("deep traces round trip mismatch: %v", err)
+	}
+}
+
+func TestCompactCodecMalformed(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	a, b := randomTraces(rnd), randomTraces(rnd)
+	b.BlockHash = common.Hash{0xff}
+	if _, err := EncodeCompact([]*InternalActionTraceList{a, b}); !errors.Is(err, ErrMalformedTrace) {
+		t.Fatalf("expected ErrMalformedTrace for txs of different blocks, have %v", err)
+	}
+	unordered := &InternalActionTraceList{Traces: []*InternalActionTrace{
+		{TraceAddress: []uint32{}, Subtraces: 2, Error: "reverted"},
+		{TraceAddress: []uint32{1}, Error: "reverted"},
+		{TraceAddress: []uint32{0}, Error: "reverted"},
+	}}
+	if _, err := EncodeCompact([]*InternalActionTraceList{unordered}); !errors.Is(err, ErrMalformedTrace) {
+		t.Fatalf("expected ErrMalformedTrace for traces out of order, have %v", err)
+	}
+
+	raw, err := EncodeCompact([]*InternalActionTraceList{a})
+	if err != nil {
+		t.Fatalf("failed to encode traces: %v", err)
+	}
+	for _, bad := range [][]byte{nil, append([]byte{compactVersion + 1}, raw[1:]...), raw[:len(raw)/2]} {
+		if _, err := DecodeCompact(bad); !errors.Is(err, ErrMalformedTrace) {
+			t.Fatalf("expected ErrMalformedTrace, have %v", err)
+		}
+	}
+}
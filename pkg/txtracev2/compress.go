@@ -0,0 +1,144 @@
+package txtracev2
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionCodec is the compression of the persisted traces, identified by the header byte of the blob.
+//
+// Blobs without header are the legacy rlp encoded traces, readers tell them apart by their first byte: rlp
+// encoded traces are lists, whose prefix is 0xc0 or above, the simple transfer marker is the single byte 0x00
+// and the codecs are the bytes in between. Any other first byte is malformed rather than guessed.
+type CompressionCodec byte
+
+const (
+	// CompressionNone persists the rlp encoded traces without header, readable by every version.
+	CompressionNone CompressionCodec = 0x00
+	// CompressionSnappy persists the snappy block encoding of the rlp encoded traces, fast at a lower ratio.
+	CompressionSnappy CompressionCodec = 0x01
+	// CompressionZstd persists the zstd frame of the rlp encoded traces, at the level of WithCompression.
+	CompressionZstd CompressionCodec = 0x02
+)
+
+// DefaultZstdLevel is the zstd level of WithCompression when not positive.
+const DefaultZstdLevel = 5
+
+// zstdEncoders are the encoders of the levels used so far, by encoder level, they're safe for concurrent use
+var zstdEncoders sync.Map
+
+// zstdEncoder returns the encoder of a zstd level, levels are mapped to the nearest encoder level
+func zstdEncoder(level int) (*zstd.Encoder, error) {
+	encoderLevel := zstd.EncoderLevelFromZstd(level)
+	if encoder, ok := zstdEncoders.Load(encoderLevel); ok {
+		return encoder.(*zstd.Encoder), nil
+	}
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(encoderLevel))
+	if err != nil {
+		return nil, err
+	}
+	actual, _ := zstdEncoders.LoadOrStore(encoderLevel, encoder)
+	return actual.(*zstd.Encoder), nil
+}
+
+// newZstdReader returns a streaming decoder of a zstd frame decoding in the calling goroutine, Close must be
+// called once done
+func newZstdReader(r io.Reader) (*zstd.Decoder, error) {
+	return zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxDecompressedSize))
+}
+
+// maxDecompressedSize bounds the decompressed size of persisted traces, whatever the size claimed by a corrupted
+// header, so a few bytes can't exhaust the memory of the reader
+const maxDecompressedSize = 512 << 20
+
+func (c CompressionCodec) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionSnappy:
+		return "snappy"
+	case CompressionZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("codec(%#x)", byte(c))
+}
+
+// WithCompression compresses the traces persisted by PersistTrace and its variants, BlockTraceWriter.WriteTracer
+// included, with codec. The level only applies to zstd, DefaultZstdLevel when not positive. The simple transfer
+// marker is persisted as is. All the readers of the package decompress transparently, whatever the codec.
+func WithCompression(codec CompressionCodec, level int) Option {
+	return func(ot *OeTracer) {
+		ot.compression, ot.compressionLevel = codec, level
+	}
+}
+
+// compressTraces prepends the header byte of codec to the compressed rlp encoded traces, raw is returned as is
+// for CompressionNone
+func compressTraces(raw []byte, codec CompressionCodec, level int) ([]byte, error) {
+	switch codec {
+	case CompressionNone:
+		return raw, nil
+	case CompressionSnappy:
+		compressed := make([]byte, 1+snappy.MaxEncodedLen(len(raw)))
+		compressed[0] = byte(codec)
+		return compressed[:1+len(snappy.Encode(compressed[1:], raw))], nil
+	case CompressionZstd:
+		if level <= 0 {
+			level = DefaultZstdLevel
+		}
+		encoder, err := zstdEncoder(level)
+		if err != nil {
+			return nil, err
+		}
+		return encoder.EncodeAll(raw, []byte{byte(codec)}), nil
+	}
+	return nil, fmt.Errorf("unknown compression codec %s", codec)
+}
+
+// decompressTraces returns the rlp encoded traces of a persisted blob along with its codec, see CompressionCodec
+// for how legacy blobs are told apart. The simple transfer marker isn't traces and must be checked before.
+func decompressTraces(raw []byte) ([]byte, CompressionCodec, error) {
+	if len(raw) == 0 || raw[0] >= 0xc0 {
+		return raw, CompressionNone, nil
+	}
+	codec := CompressionCodec(raw[0])
+	var (
+		decompressed []byte
+		err          error
+	)
+	switch codec {
+	case CompressionSnappy:
+		var size int
+		if size, err = snappy.DecodedLen(raw[1:]); err == nil && size > maxDecompressedSize {
+			err = fmt.Errorf("decompressed size %d above %d", size, maxDecompressedSize)
+		}
+		if err == nil {
+			decompressed, err = snappy.Decode(nil, raw[1:])
+		}
+	case CompressionZstd:
+		// streamed, decoding at once allocates the size claimed by the frame header up front
+		var r *zstd.Decoder
+		if r, err = newZstdReader(bytes.NewReader(raw[1:])); err == nil {
+			decompressed, err = io.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+			r.Close()
+		}
+		if err == nil && len(decompressed) > maxDecompressedSize {
+			err = fmt.Errorf("decompressed size above %d", maxDecompressedSize)
+		}
+	default:
+		return nil, codec, fmt.Errorf("%w: unknown trace header byte %#x", ErrMalformedTrace, raw[0])
+	}
+	if err == nil && len(decompressed) == 0 {
+		err = errors.New("empty payload") // e.g. a truncated frame, traces never are
+	}
+	if err != nil {
+		return nil, codec, fmt.Errorf("%w: failed to decompress %s traces: %v", ErrMalformedTrace, codec, err)
+	}
+	return decompressed, codec, nil
+}
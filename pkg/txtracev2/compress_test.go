@@ -0,0 +1,171 @@
+package txtracev2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// deepCallsTraces returns the traces of the deep calls fixture
+func deepCallsTraces(tb testing.TB) *InternalActionTraceList {
+	blob, err := os.ReadFile(filepath.Join("testdata", "call_tracer_deep_calls.json"))
+	if err != nil {
+		tb.Fatalf("failed to read testcase: %v", err)
+	}
+	test := new(callTracerTest)
+	if err := json.Unmarshal(blob, test); err != nil {
+		tb.Fatalf("failed to parse testcase: %v", err)
+	}
+	deep := &InternalActionTraceList{BlockHash: test.Result[0].BlockHash, BlockNumber: test.Result[0].BlockNumber, TransactionHash: test.Result[0].TransactionHash}
+	for i := range test.Result {
+		trace, err := toInternalTrace(&test.Result[i])
+		if err != nil {
+			tb.Fatalf("failed to convert trace %d: %v", i, err)
+		}
+		deep.Traces = append(deep.Traces, trace)
+	}
+	return deep
+}
+
+func TestCompressedStore(t *testing.T) {
+	var (
+		ctx      = context.Background()
+		rnd      = rand.New(rand.NewSource(1))
+		store    = &latencyStore{MemoryStore: MemoryStore{data: make(map[common.Hash][]byte)}}
+		codecs   = []CompressionCodec{CompressionNone, CompressionSnappy, CompressionZstd}
+		txHashes []common.Hash
+		want     []*InternalActionTraceList
+	)
+	for i := 0; i < 9; i++ {
+		traces := randomTraces(rnd)
+		traces.TransactionHash = common.Hash{0x1, byte(i)}
+		raw, err := rlp.EncodeToBytes(traces)
+		if err != nil {
+			t.Fatalf("tx %d: failed to encode traces: %v", i, err)
+		}
+		codec := codecs[i%len(codecs)]
+		if raw, err = compressTraces(raw, codec, i); err != nil {
+			t.Fatalf("tx %d: failed to compress traces with %s: %v", i, codec, err)
+		}
+		if codec != CompressionNone && raw[0] != byte(codec) {
+			t.Fatalf("tx %d: header byte %#x, want %s", i, raw[0], codec)
+		}
+		store.data[traces.TransactionHash] = raw
+		txHashes, want = append(txHashes, traces.TransactionHash), append(want, traces)
+	}
+
+	for i, txHash := range txHashes {
+		traces, err := ReadRpcTxTraceWithConfig(ctx, store, txHash, TracerConfig{Verbose: true})
+		if err != nil {
+			t.Fatalf("tx %d: failed to read traces: %v", i, err)
+		}
+		if have, _ := json.Marshal(traces); string(have) != rpcJSON(t, want[i]) {
+			t.Fatalf("tx %d: traces mismatch:\nhave %s\nwant %s", i, have, rpcJSON(t, want[i]))
+		}
+	}
+	for _, read := range []Store{store, multiLatencyStore{store}} {
+		block, err := ReadRpcBlockTraces(ctx, read, txHashes, WithReadTracerConfig(TracerConfig{Verbose: true}))
+		if err != nil {
+			t.Fatalf("failed to read block traces: %v", err)
+		}
+		for i := range block {
+			if have, _ := json.Marshal(block[i]); string(have) != rpcJSON(t, want[i]) {
+				t.Fatalf("tx %d: block traces mismatch:\nhave %s\nwant %s", i, have, rpcJSON(t, want[i]))
+			}
+		}
+	}
+
+	// unknown header bytes and corrupted payloads are malformed, not decoded as something else
+	for _, raw := range [][]byte{{0x03, 0x1}, {0xbf}, {byte(CompressionSnappy), 0xff, 0xff}, {byte(CompressionZstd), 0x1, 0x2}} {
+		store.data[common.Hash{0xf}] = raw
+		if _, err := ReadRpcTxTrace(ctx, store, common.Hash{0xf}); !errors.Is(err, ErrMalformedTrace) {
+			t.Fatalf("blob %x: expected ErrMalformedTrace, have %v", raw, err)
+		}
+	}
+}
+
+func TestPersistCompressedTrace(t *testing.T) {
+	block := BlockRef{Hash: common.Hash{0xa}, Number: big.NewInt(10), Time: 1_000}
+	for _, codec := range []CompressionCodec{CompressionNone, CompressionSnappy, CompressionZstd} {
+		store := &MemoryStore{data: make(map[common.Hash][]byte)}
+		tracer := NewOeTracer(store, block.Hash, block.Number, common.Hash{0x1}, 0, WithCompression(codec, 0))
+		tracer.CaptureStart(nil, common.Address{0xa}, common.Address{0xb}, false, make([]byte, 512), 50_000, big.NewInt(1))
+		tracer.CaptureEnd(nil, 30_000, nil)
+		if err := tracer.PersistTraceContext(context.Background()); err != nil {
+			t.Fatalf("%s: failed to persist traces: %v", codec, err)
+		}
+		raw := store.data[common.Hash{0x1}]
+		if size, err := tracer.EncodedSize(); err != nil || size != len(raw) {
+			t.Fatalf("%s: encoded size %d, %d bytes persisted: %v", codec, size, len(raw), err)
+		}
+		if codec != CompressionNone && (raw[0] != byte(codec) || len(raw) > 256) {
+			t.Fatalf("%s: %d bytes persisted with header %#x", codec, len(raw), raw[0])
+		}
+		want := rpcJSON(t, tracer.getInternalTraces())
+		if traces, err := ReadRpcTxTraceWithConfig(context.Background(), store, common.Hash{0x1}, TracerConfig{Verbose: true}); err != nil {
+			t.Fatalf("%s: failed to read traces: %v", codec, err)
+		} else if have, _ := json.Marshal(traces); string(have) != want {
+			t.Fatalf("%s: traces mismatch:\nhave %s\nwant %s", codec, have, want)
+		}
+
+		// rebound traces keep their codec
+		moved := BlockRef{Hash: common.Hash{0xb}, Number: big.NewInt(11)}
+		if err := RebindTxTrace(context.Background(), store, common.Hash{0x1}, moved.Hash, moved.Number, 2); err != nil {
+			t.Fatalf("%s: failed to rebind traces: %v", codec, err)
+		}
+		if raw := store.data[common.Hash{0x1}]; codec != CompressionNone && raw[0] != byte(codec) {
+			t.Fatalf("%s: rebound traces with header %#x", codec, raw[0])
+		}
+		traces, err := ReadRpcTxTrace(context.Background(), store, common.Hash{0x1})
+		if err != nil || traces[0].BlockHash != moved.Hash || traces[0].TransactionPosition != 2 {
+			t.Fatalf("%s: rebound traces mismatch: %+v, %v", codec, traces, err)
+		}
+	}
+}
+
+func BenchmarkCompression(b *testing.B) {
+	raw, err := rlp.EncodeToBytes(deepCallsTraces(b))
+	if err != nil {
+		b.Fatalf("failed to encode traces: %v", err)
+	}
+	for _, bench := range []struct {
+		name  string
+		codec CompressionCodec
+		level int
+	}{
+		{"snappy", CompressionSnappy, 0},
+		{"zstd-1", CompressionZstd, 1},
+		{"zstd-default", CompressionZstd, DefaultZstdLevel},
+		{"zstd-19", CompressionZstd, 19},
+	} {
+		compressed, err := compressTraces(raw, bench.codec, bench.level)
+		if err != nil {
+			b.Fatalf("%s: failed to compress traces: %v", bench.name, err)
+		}
+		b.Run(bench.name+"/compress", func(b *testing.B) {
+			b.SetBytes(int64(len(raw)))
+			for i := 0; i < b.N; i++ {
+				if _, err := compressTraces(raw, bench.codec, bench.level); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(raw))/float64(len(compressed)), "ratio")
+		})
+		b.Run(bench.name+"/decompress", func(b *testing.B) {
+			b.SetBytes(int64(len(raw)))
+			for i := 0; i < b.N; i++ {
+				if _, _, err := decompressTraces(compressed); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
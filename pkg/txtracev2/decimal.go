@@ -0,0 +1,68 @@
+package txtracev2
+
+import (
+	"encoding/json"
+	"math/big"
+)
+
+// DecimalActionTrace marshals a trace like ActionTrace, but with gas and gasUsed as decimal numbers and value
+// and balance as decimal strings, for tooling which can't parse hex quantities. Values are strings as they may
+// not fit the precision of a json number. The default ActionTrace encoding stays hex like parity.
+type DecimalActionTrace ActionTrace
+
+// DecimalActionTraceList marshals a trace list with the encoding of DecimalActionTrace.
+type DecimalActionTraceList []ActionTrace
+
+// decimalBig marshals a big integer as a decimal string
+type decimalBig big.Int
+
+// MarshalText implements encoding.TextMarshaler
+func (b *decimalBig) MarshalText() ([]byte, error) {
+	return (*big.Int)(b).MarshalText()
+}
+
+type decimalAction struct {
+	Action
+	Value   *decimalBig `json:"value"`
+	Gas     uint64      `json:"gas"`
+	Balance *decimalBig `json:"balance,omitempty"`
+}
+
+type decimalResult struct {
+	ActionResult
+	GasUsed uint64 `json:"gasUsed"`
+}
+
+// MarshalJSON emits the trace with decimal gas and values, blockNumber is a plain decimal number as always.
+func (t DecimalActionTrace) MarshalJSON() ([]byte, error) {
+	type plain ActionTrace
+	number := t.BlockNumber
+	if number == nil {
+		number = new(big.Int)
+	}
+	action := decimalAction{
+		Action:  t.Action,
+		Value:   (*decimalBig)(t.Action.Value),
+		Gas:     uint64(t.Action.Gas),
+		Balance: (*decimalBig)(t.Action.Balance),
+	}
+	var result *decimalResult
+	if t.Result != nil {
+		result = &decimalResult{ActionResult: *t.Result, GasUsed: uint64(t.Result.GasUsed)}
+	}
+	return json.Marshal(struct {
+		plain
+		Action      decimalAction  `json:"action"`
+		BlockNumber *big.Int       `json:"blockNumber"`
+		Result      *decimalResult `json:"result,omitempty"`
+	}{plain(t), action, number, result})
+}
+
+// MarshalJSON emits every trace with the encoding of DecimalActionTrace.
+func (l DecimalActionTraceList) MarshalJSON() ([]byte, error) {
+	traces := make([]DecimalActionTrace, len(l))
+	for i := range l {
+		traces[i] = DecimalActionTrace(l[i])
+	}
+	return json.Marshal(traces)
+}
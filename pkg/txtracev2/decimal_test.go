@@ -0,0 +1,75 @@
+package txtracev2
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+func TestDecimalActionTrace(t *testing.T) {
+	from, to := common.Address{0x1}, common.Address{0x2}
+	value, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	traces := ActionTraceList{
+		{
+			Action:       Action{From: &from, To: &to, Value: (*hexutil.Big)(value), Gas: 100_000},
+			BlockNumber:  big.NewInt(16),
+			Result:       &ActionResult{GasUsed: 21_000},
+			TraceAddress: []uint32{},
+			TraceType:    "call",
+		},
+		{
+			Action:       Action{Address: &to, RefundAddress: &from, Balance: (*hexutil.Big)(big.NewInt(255))},
+			TraceAddress: []uint32{0},
+			TraceType:    "suicide",
+		},
+	}
+
+	enc, err := json.Marshal(DecimalActionTraceList(traces))
+	if err != nil {
+		t.Fatalf("failed to encode traces: %v", err)
+	}
+	var decoded []struct {
+		Action      map[string]interface{} `json:"action"`
+		BlockNumber json.RawMessage        `json:"blockNumber"`
+		Result      map[string]interface{} `json:"result"`
+		TraceType   string                 `json:"type"`
+	}
+	if err := json.Unmarshal(enc, &decoded); err != nil {
+		t.Fatalf("failed to decode traces: %v", err)
+	}
+	call, suicide := decoded[0], decoded[1]
+	if call.Action["value"] != "123456789012345678901234567890" || call.Action["gas"] != float64(100_000) ||
+		call.Result["gasUsed"] != float64(21_000) || string(call.BlockNumber) != "16" || call.TraceType != "call" {
+		t.Fatalf("call encoding mismatch: %s", enc)
+	}
+	if _, ok := call.Action["balance"]; ok {
+		t.Fatalf("call encoding has a balance: %s", enc)
+	}
+	if suicide.Action["balance"] != "255" || suicide.Action["value"] != nil || suicide.Result != nil || string(suicide.BlockNumber) != "0" {
+		t.Fatalf("suicide encoding mismatch: %s", enc)
+	}
+
+	// the default encoding stays hex
+	enc, err = json.Marshal(traces[0])
+	if err != nil {
+		t.Fatalf("failed to encode trace: %v", err)
+	}
+	var plain ActionTrace
+	if err := json.Unmarshal(enc, &plain); err != nil {
+		t.Fatalf("failed to decode trace: %v", err)
+	}
+	if !jsonEqual(ActionTraceList{plain}, traces[:1]) {
+		jsonDiff(t, plain, traces[0])
+	}
+	var hex struct {
+		Action struct {
+			Gas string `json:"gas"`
+		} `json:"action"`
+	}
+	if err := json.Unmarshal(enc, &hex); err != nil || hex.Action.Gas != "0x186a0" {
+		t.Fatalf("default gas encoding mismatch: %s", enc)
+	}
+}
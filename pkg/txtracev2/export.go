@@ -0,0 +1,392 @@
+package txtracev2
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// IterableStore is a Store whose tracing results can be enumerated, e.g. for bulk exports.
+type IterableStore interface {
+	Store
+	// IterateTxTraces calls fn with every persisted tracing result until fn returns an error, which is
+	// returned as is. The order must be stable across calls for exports to be resumable.
+	IterateTxTraces(ctx context.Context, fn func(txHash common.Hash, trace []byte) error) error
+}
+
+// BatchStore is a Store which writes the tracing results of many txs at once, ImportTraces uses it when available.
+type BatchStore interface {
+	Store
+	// WriteTxTraces writes traces[i] as the tracing result of txHashes[i].
+	WriteTxTraces(ctx context.Context, txHashes []common.Hash, traces [][]byte) error
+}
+
+// ErrBadCheckpoint is returned when ExportOptions.Offset doesn't fall between two records of the export.
+var ErrBadCheckpoint = errors.New("export checkpoint not at a record boundary")
+
+// exportRecord is a line of an export, traces are in the verbose rpc form
+type exportRecord struct {
+	TxHash       common.Hash     `json:"txHash"`
+	Traces       ActionTraceList `json:"traces"`
+	GasBreakdown *TxGasBreakdown `json:"gasBreakdown,omitempty"`
+}
+
+// ExportOptions configures ExportTraces.
+type ExportOptions struct {
+	Gzip bool // compress the output, a resumed export appends a new gzip member
+
+	Address   *common.Address // only export txs with a trace from, to or creating the address
+	FromBlock *big.Int        // only export txs in blocks >= FromBlock
+	ToBlock   *big.Int        // only export txs in blocks <= ToBlock
+
+	// Offset resumes an export, the records within the first Offset bytes of the uncompressed output
+	// were written by a previous run and are skipped.
+	Offset int64
+	// Progress is called after every written record with the number of records written by this run and
+	// the offset of the uncompressed output reached, which is the checkpoint to resume from.
+	Progress func(records int, offset int64)
+}
+
+// match checks whether the traces pass the filters of opts
+func (opts *ExportOptions) match(traces *InternalActionTraceList) bool {
+	if opts.FromBlock != nil || opts.ToBlock != nil {
+		number := traces.BlockNumber
+		if number == nil {
+			number = new(big.Int)
+		}
+		if (opts.FromBlock != nil && number.Cmp(opts.FromBlock) < 0) || (opts.ToBlock != nil && number.Cmp(opts.ToBlock) > 0) {
+			return false
+		}
+	}
+	if opts.Address == nil {
+		return true
+	}
+	for _, trace := range traces.Traces {
+		for _, addr := range []*common.Address{trace.Action.From, trace.Action.To, trace.Action.Address, trace.Action.RefundAddress} {
+			if addr != nil && *addr == *opts.Address {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ExportTraces writes the tracing results of store to w as line-delimited json, one
+// {"txHash":...,"traces":[...]} object per tx with traces in the verbose rpc form. The output is
+// deterministic, so an interrupted export can be resumed from the offset last reported by Progress.
+// A gzip output is always closed on return, resuming it from a crashed process isn't supported. The simple
+// transfers persisted as a marker have no traces to export and are skipped, see TracerConfig.SkipSimpleTransfers.
+func ExportTraces(ctx context.Context, store IterableStore, w io.Writer, opts ExportOptions) (err error) {
+	if opts.Gzip {
+		zw := gzip.NewWriter(w)
+		defer func() {
+			if closeErr := zw.Close(); err == nil {
+				err = closeErr
+			}
+		}()
+		w = zw
+	}
+	var (
+		offset  int64
+		records int
+	)
+	return store.IterateTxTraces(ctx, func(txHash common.Hash, raw []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if isSimpleTransferMarker(raw) {
+			return nil
+		}
+		raw, _, err := decompressTraces(raw)
+		if err != nil {
+			return fmt.Errorf("tx %s: %w", txHash.Hex(), err)
+		}
+		internalTraces := InternalActionTraceList{}
+		if err := rlp.DecodeBytes(raw, &internalTraces); err != nil {
+			return fmt.Errorf("failed to decode rlp traces of tx %s: %v", txHash.Hex(), err)
+		}
+		if !opts.match(&internalTraces) {
+			return nil
+		}
+		line, err := json.Marshal(&exportRecord{
+			TxHash:       txHash,
+			Traces:       append(ActionTraceList{}, internalTraces.ToTracesWithConfig(TracerConfig{Verbose: true})...),
+			GasBreakdown: internalTraces.GasBreakdown,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to encode traces of tx %s: %v", txHash.Hex(), err)
+		}
+		line = append(line, '\n')
+		start := offset
+		offset += int64(len(line))
+		if offset <= opts.Offset {
+			return nil // written by a previous run
+		}
+		if start < opts.Offset {
+			return fmt.Errorf("%w: offset %d is within the record of tx %s", ErrBadCheckpoint, opts.Offset, txHash.Hex())
+		}
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+		records++
+		if opts.Progress != nil {
+			opts.Progress(records, offset)
+		}
+		return nil
+	})
+}
+
+// ImportRecordError reports a record ImportTraces skipped.
+type ImportRecordError struct {
+	Line   int         // 1-based line of the record
+	TxHash common.Hash // zero if the record couldn't be decoded
+	Err    error
+}
+
+func (e *ImportRecordError) Error() string {
+	return fmt.Sprintf("record at line %d (%s) skipped: %v", e.Line, e.TxHash.Hex(), e.Err)
+}
+
+func (e *ImportRecordError) Unwrap() error {
+	return e.Err
+}
+
+// ImportOptions configures ImportTraces.
+type ImportOptions struct {
+	Gzip      bool                     // the input is gzip compressed
+	BatchSize int                      // records per write of a BatchStore, 0 means 100
+	OnSkip    func(*ImportRecordError) // called for every record failing validation, nil drops the reports
+}
+
+// ImportTraces reads line-delimited json written by ExportTraces from r and writes the traces to store,
+// through WriteTxTraces if it's a BatchStore. Records failing validation are skipped and reported to
+// opts.OnSkip, only failures of reading r or writing store abort the import. It returns the number of
+// records written. Fields the rpc form doesn't carry, e.g. the address of a failed create, stay empty.
+func ImportTraces(ctx context.Context, store Store, r io.Reader, opts ImportOptions) (int, error) {
+	if opts.Gzip {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return 0, fmt.Errorf("failed to open gzip input: %v", err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	batchStore, batched := store.(BatchStore)
+	var (
+		reader   = bufio.NewReader(r)
+		imported int
+		txHashes = make([]common.Hash, 0, batchSize)
+		traces   = make([][]byte, 0, batchSize)
+	)
+	flush := func() error {
+		if len(txHashes) == 0 {
+			return nil
+		}
+		if err := batchStore.WriteTxTraces(ctx, txHashes, traces); err != nil {
+			return err
+		}
+		imported += len(txHashes)
+		// the store may keep the slices, don't reuse them
+		txHashes, traces = make([]common.Hash, 0, batchSize), make([][]byte, 0, batchSize)
+		return nil
+	}
+	for lineNumber := 1; ; lineNumber++ {
+		if err := ctx.Err(); err != nil {
+			return imported, err
+		}
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return imported, err
+		}
+		if len(line) > 0 && !isBlank(line) {
+			txHash, raw, recordErr := decodeRecord(line)
+			if recordErr != nil {
+				if opts.OnSkip != nil {
+					opts.OnSkip(&ImportRecordError{Line: lineNumber, TxHash: txHash, Err: recordErr})
+				}
+			} else if batched {
+				txHashes, traces = append(txHashes, txHash), append(traces, raw)
+				if len(txHashes) >= batchSize {
+					if err := flush(); err != nil {
+						return imported, err
+					}
+				}
+			} else {
+				if err := store.WriteTxTrace(ctx, txHash, raw); err != nil {
+					return imported, err
+				}
+				imported++
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if batched {
+		if err := flush(); err != nil {
+			return imported, err
+		}
+	}
+	return imported, nil
+}
+
+func isBlank(line []byte) bool {
+	for _, c := range line {
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeRecord validates a line of an export and re-encodes its traces to the stored form
+func decodeRecord(line []byte) (common.Hash, []byte, error) {
+	var record exportRecord
+	if err := json.Unmarshal(line, &record); err != nil {
+		return common.Hash{}, nil, fmt.Errorf("failed to decode record: %v", err)
+	}
+	if record.TxHash == (common.Hash{}) {
+		return common.Hash{}, nil, errors.New("missing tx hash")
+	}
+	internalTraces, err := toInternalTraces(record.TxHash, record.Traces, record.GasBreakdown)
+	if err != nil {
+		return record.TxHash, nil, err
+	}
+	raw, err := rlp.EncodeToBytes(internalTraces)
+	if err != nil {
+		return record.TxHash, nil, fmt.Errorf("failed to encode rlp traces: %v", err)
+	}
+	return record.TxHash, raw, nil
+}
+
+// toInternalTraces converts the verbose rpc form of the traces of a tx back to the stored form
+func toInternalTraces(txHash common.Hash, traces ActionTraceList, gasBreakdown *TxGasBreakdown) (*InternalActionTraceList, error) {
+	internalTraces := &InternalActionTraceList{
+		Traces:          make([]*InternalActionTrace, 0, len(traces)),
+		TransactionHash: txHash,
+		GasBreakdown:    gasBreakdown,
+	}
+	for i := range traces {
+		trace := &traces[i]
+		if trace.TransactionHash != txHash {
+			return nil, fmt.Errorf("trace %v belongs to tx %s", trace.TraceAddress, trace.TransactionHash.Hex())
+		}
+		if i == 0 {
+			internalTraces.BlockHash, internalTraces.BlockNumber, internalTraces.TransactionPosition = trace.BlockHash, trace.BlockNumber, trace.TransactionPosition
+			internalTraces.Timestamp = trace.BlockTimestamp
+		} else if trace.BlockHash != internalTraces.BlockHash || !equalBig(trace.BlockNumber, internalTraces.BlockNumber) ||
+			trace.BlockTimestamp != internalTraces.Timestamp || trace.TransactionPosition != internalTraces.TransactionPosition {
+			return nil, fmt.Errorf("trace %v: block info differs from the first trace", trace.TraceAddress)
+		}
+		internalTrace, err := toInternalTrace(trace)
+		if err != nil {
+			return nil, fmt.Errorf("trace %v: %v", trace.TraceAddress, err)
+		}
+		internalTraces.Traces = append(internalTraces.Traces, internalTrace)
+	}
+	return internalTraces, nil
+}
+
+// toInternalTrace is the inverse of the conversion done by ToTracesWithConfig for a single trace
+func toInternalTrace(trace *ActionTrace) (*InternalActionTrace, error) {
+	action := &trace.Action
+	internalTrace := &InternalActionTrace{
+		Action: InternalAction{
+			From:  action.From,
+			To:    action.To,
+			Value: (*big.Int)(action.Value),
+			Gas:   uint64(action.Gas),
+		},
+		Error:              trace.Error,
+		TraceAddress:       trace.TraceAddress,
+		Subtraces:          trace.Subtraces,
+		SubtracesTruncated: trace.SubtracesTruncated,
+		StorageAddress:     trace.StorageAddress,
+		Fault:              trace.ErrorDetail,
+		Impersonated:       trace.Impersonated,
+		EOAInput:           trace.EOAInput || trace.InputStripped,
+		PreExecution:       trace.PreExecution,
+	}
+	if trace.TraceType != "suicide" && trace.Error == "" && trace.Result == nil {
+		return nil, errors.New("succeeded trace without result")
+	}
+	switch trace.TraceType {
+	case "create":
+		internalTrace.Action.CallType = CallTypeCreate
+		internalTrace.Action.Init = rawBytes(action.Init)
+		internalTrace.Action.CreateMethod = action.CreateMethod
+		if trace.Error == "" {
+			internalTrace.Action.Address = trace.Result.Address
+			internalTrace.Result = &InternalTraceActionResult{
+				GasUsed: uint64(trace.Result.GasUsed),
+				Code:    rawBytes(trace.Result.Code),
+				Address: trace.Result.Address,
+			}
+		}
+	case "call":
+		callType, ok := map[string]uint8{Call: CallTypeCall, CallCode: CallTypeCallCode, DelegateCall: CallTypeDelegateCall, StaticCall: CallTypeStaticCall}[derefString(action.CallType)]
+		if !ok {
+			// a call of an opcode unknown to the tracer, rendered with its opcode name
+			if derefString(action.CallType) == "" {
+				return nil, fmt.Errorf("unknown call type %q", derefString(action.CallType))
+			}
+			callType = CallTypeUnknown
+			internalTrace.Action.CallTypeName = derefString(action.CallType)
+		}
+		internalTrace.Action.CallType = callType
+		internalTrace.Action.Input = rawBytes(action.Input)
+		if trace.Error == "" {
+			internalTrace.Result = &InternalTraceActionResult{
+				GasUsed: uint64(trace.Result.GasUsed),
+				Output:  rawBytes(trace.Result.Output),
+			}
+		}
+	case "suicide":
+		internalTrace.Action.CallType = CallTypeSuicide
+		internalTrace.Action.Address = action.Address
+		internalTrace.Action.RefundAddress = action.RefundAddress
+		internalTrace.Action.Balance = (*big.Int)(action.Balance)
+		internalTrace.Action.Destroyed = action.Destroyed
+	default:
+		return nil, fmt.Errorf("unknown trace type %q", trace.TraceType)
+	}
+	return internalTrace, nil
+}
+
+func rawBytes(data *hexutil.Bytes) []byte {
+	if data == nil {
+		return nil
+	}
+	return *data
+}
+
+func derefString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// equalBig compares two numbers, nil being 0
+func equalBig(x, y *big.Int) bool {
+	if x == nil {
+		x = new(big.Int)
+	}
+	if y == nil {
+		y = new(big.Int)
+	}
+	return x.Cmp(y) == 0
+}
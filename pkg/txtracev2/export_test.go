@@ -0,0 +1,263 @@
+package txtracev2
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/big"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// iterableStore iterates a MemoryStore ordered by tx hash
+type iterableStore struct {
+	*MemoryStore
+}
+
+func (store iterableStore) IterateTxTraces(ctx context.Context, fn func(txHash common.Hash, trace []byte) error) error {
+	txHashes := make([]common.Hash, 0, len(store.data))
+	for txHash := range store.data {
+		txHashes = append(txHashes, txHash)
+	}
+	sort.Slice(txHashes, func(i, j int) bool {
+		return bytes.Compare(txHashes[i][:], txHashes[j][:]) < 0
+	})
+	for _, txHash := range txHashes {
+		if err := fn(txHash, store.data[txHash]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batchStore records the size of every batch written
+type batchStore struct {
+	*MemoryStore
+	batches []int
+}
+
+func (store *batchStore) WriteTxTraces(ctx context.Context, txHashes []common.Hash, traces [][]byte) error {
+	for i, txHash := range txHashes {
+		store.data[txHash] = traces[i]
+	}
+	store.batches = append(store.batches, len(txHashes))
+	return nil
+}
+
+// syntheticStore persists the traces of n txs with random call trees, tx i is in block 1000+i/4
+func syntheticStore(t *testing.T, n int) iterableStore {
+	var (
+		rnd   = rand.New(rand.NewSource(1))
+		store = &MemoryStore{data: make(map[common.Hash][]byte)}
+		addr  = func() common.Address { return common.Address{byte(rnd.Intn(16))} }
+	)
+	for i := 0; i < n; i++ {
+		txHash := common.BigToHash(big.NewInt(int64(i + 1)))
+		tracer := NewOeTracer(store, common.Hash{0xb}, big.NewInt(int64(1000+i/4)), txHash, uint64(i%4))
+		tracer.CaptureStart(nil, addr(), addr(), i%10 == 0, []byte{byte(i)}, 1_000_000, big.NewInt(int64(i)))
+		depth := 0
+		for j := rnd.Intn(8); j > 0; j-- {
+			if depth > 0 && rnd.Intn(3) == 0 {
+				var err error
+				if rnd.Intn(4) == 0 {
+					err = vm.ErrExecutionReverted
+				}
+				tracer.CaptureExit([]byte{byte(j)}, uint64(rnd.Intn(1000)), err)
+				depth--
+				continue
+			}
+			switch op := []vm.OpCode{vm.CALL, vm.STATICCALL, vm.DELEGATECALL, vm.CALLCODE, vm.CREATE, vm.CREATE2, vm.SELFDESTRUCT}[rnd.Intn(7)]; op {
+			case vm.SELFDESTRUCT:
+				tracer.CaptureEnter(op, addr(), addr(), nil, 0, big.NewInt(int64(rnd.Intn(100))))
+				tracer.CaptureExit(nil, 0, nil)
+			default:
+				tracer.CaptureEnter(op, addr(), addr(), []byte{byte(j), 0x1}, uint64(rnd.Intn(100_000)), big.NewInt(int64(rnd.Intn(3))))
+				depth++
+			}
+		}
+		for ; depth > 0; depth-- {
+			tracer.CaptureExit([]byte{0x2}, 10, nil)
+		}
+		tracer.CaptureEnd([]byte{0x3}, 20, nil)
+		if i%3 == 0 {
+			tracer.outPutTraces.GasBreakdown = &TxGasBreakdown{IntrinsicGas: 21000, ExecutionGas: uint64(i), EffectiveGasUsed: 21000 + uint64(i)}
+		}
+		if err := tracer.PersistTraceContext(context.Background()); err != nil {
+			t.Fatalf("failed to persist traces: %v", err)
+		}
+	}
+	return iterableStore{store}
+}
+
+func TestExportImportTraces(t *testing.T) {
+	src := syntheticStore(t, 300)
+	for _, compress := range []bool{false, true} {
+		var exported bytes.Buffer
+		if err := ExportTraces(context.Background(), src, &exported, ExportOptions{Gzip: compress}); err != nil {
+			t.Fatalf("gzip %v: failed to export traces: %v", compress, err)
+		}
+
+		dst := &batchStore{MemoryStore: &MemoryStore{data: make(map[common.Hash][]byte)}}
+		imported, err := ImportTraces(context.Background(), dst, bytes.NewReader(exported.Bytes()), ImportOptions{
+			Gzip:      compress,
+			BatchSize: 64,
+			OnSkip: func(err *ImportRecordError) {
+				t.Fatalf("gzip %v: record skipped: %v", compress, err)
+			},
+		})
+		if err != nil {
+			t.Fatalf("gzip %v: failed to import traces: %v", compress, err)
+		}
+		if imported != 300 || !reflect.DeepEqual(dst.batches, []int{64, 64, 64, 64, 44}) {
+			t.Fatalf("gzip %v: import mismatch: have %d records in batches %v", compress, imported, dst.batches)
+		}
+		for txHash := range src.data {
+			want, err := ReadRpcTxTraceWithMeta(context.Background(), src, txHash)
+			if err != nil {
+				t.Fatalf("failed to read source traces: %v", err)
+			}
+			have, err := ReadRpcTxTraceWithMeta(context.Background(), dst, txHash)
+			if err != nil {
+				t.Fatalf("failed to read imported traces: %v", err)
+			}
+			if !reflect.DeepEqual(have, want) {
+				t.Fatalf("gzip %v: tx %x: imported traces mismatch:\nhave %+v\nwant %+v", compress, txHash, have, want)
+			}
+		}
+
+		// exporting the imported store again yields the very same bytes
+		var reexported bytes.Buffer
+		if err := ExportTraces(context.Background(), iterableStore{dst.MemoryStore}, &reexported, ExportOptions{Gzip: compress}); err != nil {
+			t.Fatalf("gzip %v: failed to export imported traces: %v", compress, err)
+		}
+		if !bytes.Equal(reexported.Bytes(), exported.Bytes()) {
+			t.Fatalf("gzip %v: export of the imported store differs", compress)
+		}
+	}
+}
+
+func TestExportSkipsSimpleTransfers(t *testing.T) {
+	src := syntheticStore(t, 10)
+	var want bytes.Buffer
+	if err := ExportTraces(context.Background(), src, &want, ExportOptions{}); err != nil {
+		t.Fatalf("failed to export traces: %v", err)
+	}
+	src.data[common.Hash{0xff}] = []byte{simpleTransferMarker}
+	var have bytes.Buffer
+	if err := ExportTraces(context.Background(), src, &have, ExportOptions{}); err != nil {
+		t.Fatalf("failed to export traces with a simple transfer: %v", err)
+	}
+	if !bytes.Equal(have.Bytes(), want.Bytes()) {
+		t.Fatalf("export with a simple transfer differs")
+	}
+}
+
+func TestExportFilter(t *testing.T) {
+	src := syntheticStore(t, 300)
+	addr := common.Address{0x7}
+	var exported bytes.Buffer
+	opts := ExportOptions{Address: &addr, FromBlock: big.NewInt(1010), ToBlock: big.NewInt(1020)}
+	if err := ExportTraces(context.Background(), src, &exported, opts); err != nil {
+		t.Fatalf("failed to export traces: %v", err)
+	}
+	var want int
+	for _, raw := range src.data {
+		traces := new(InternalActionTraceList)
+		if err := rlp.DecodeBytes(raw, traces); err != nil {
+			t.Fatalf("failed to decode traces: %v", err)
+		}
+		if opts.match(traces) {
+			want++
+		}
+	}
+	lines := strings.Split(strings.TrimSuffix(exported.String(), "\n"), "\n")
+	if want == 0 || want == len(src.data) || len(lines) != want {
+		t.Fatalf("filtered record count mismatch: have %d, want %d of %d", len(lines), want, len(src.data))
+	}
+	dst := &MemoryStore{data: make(map[common.Hash][]byte)}
+	if _, err := ImportTraces(context.Background(), dst, &exported, ImportOptions{}); err != nil {
+		t.Fatalf("failed to import traces: %v", err)
+	}
+	for txHash := range dst.data {
+		traces, err := ReadRpcTxTrace(context.Background(), dst, txHash)
+		if err != nil {
+			t.Fatalf("failed to read imported traces: %v", err)
+		}
+		if number := traces[0].BlockNumber.Int64(); number < 1010 || number > 1020 {
+			t.Fatalf("tx %x of block %d exported", txHash, number)
+		}
+	}
+}
+
+func TestExportResume(t *testing.T) {
+	src := syntheticStore(t, 300)
+	var full bytes.Buffer
+	if err := ExportTraces(context.Background(), src, &full, ExportOptions{}); err != nil {
+		t.Fatalf("failed to export traces: %v", err)
+	}
+
+	// the first run is cancelled after 100 records
+	var (
+		resumed    bytes.Buffer
+		checkpoint int64
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	err := ExportTraces(ctx, src, &resumed, ExportOptions{Progress: func(records int, offset int64) {
+		checkpoint = offset
+		if records == 100 {
+			cancel()
+		}
+	}})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled export error mismatch: have %v, want %v", err, context.Canceled)
+	}
+	if int64(resumed.Len()) != checkpoint {
+		t.Fatalf("checkpoint mismatch: have %d, want %d", checkpoint, resumed.Len())
+	}
+	if err := ExportTraces(context.Background(), src, &resumed, ExportOptions{Offset: checkpoint}); err != nil {
+		t.Fatalf("failed to resume export: %v", err)
+	}
+	if !bytes.Equal(resumed.Bytes(), full.Bytes()) {
+		t.Fatalf("resumed export differs from the full export")
+	}
+
+	if err := ExportTraces(context.Background(), src, new(bytes.Buffer), ExportOptions{Offset: checkpoint + 1}); !errors.Is(err, ErrBadCheckpoint) {
+		t.Fatalf("misaligned checkpoint error mismatch: have %v, want %v", err, ErrBadCheckpoint)
+	}
+}
+
+func TestImportSkipsInvalidRecords(t *testing.T) {
+	src := syntheticStore(t, 2)
+	var exported bytes.Buffer
+	if err := ExportTraces(context.Background(), src, &exported, ExportOptions{}); err != nil {
+		t.Fatalf("failed to export traces: %v", err)
+	}
+	valid := strings.Split(strings.TrimSuffix(exported.String(), "\n"), "\n")
+	input := strings.Join([]string{
+		valid[0],
+		`{"txHash":`, // truncated
+		`{"txHash":"0x0000000000000000000000000000000000000000000000000000000000000000","traces":[]}`,
+		strings.Replace(valid[1], `"type":"call"`, `"type":"teleport"`, 1),
+		"",
+		valid[1],
+	}, "\n")
+
+	var skipped []int
+	dst := &MemoryStore{data: make(map[common.Hash][]byte)}
+	imported, err := ImportTraces(context.Background(), dst, strings.NewReader(input), ImportOptions{OnSkip: func(err *ImportRecordError) {
+		skipped = append(skipped, err.Line)
+	}})
+	if err != nil {
+		t.Fatalf("failed to import traces: %v", err)
+	}
+	if imported != 2 || len(dst.data) != 2 || !reflect.DeepEqual(skipped, []int{2, 3, 4}) {
+		t.Fatalf("import mismatch: have %d imported, skipped lines %v", imported, skipped)
+	}
+}
@@ -0,0 +1,164 @@
+package txtracev2
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// TxGasBreakdown splits the gas used by a tx into its components.
+type TxGasBreakdown struct {
+	IntrinsicGas     uint64 `json:"intrinsicGas"`     // 21000/53000 + calldata + access list + initcode
+	ExecutionGas     uint64 `json:"executionGas"`     // gas used by the evm, before refund
+	RefundedGas      uint64 `json:"refundedGas"`      // gas given back at the end of the tx
+	EffectiveGasUsed uint64 `json:"effectiveGasUsed"` // gas charged to the sender, same as the receipt
+}
+
+// ComputeGasBreakdown derives the gas breakdown of a tx from the data, access list and kind of its message, the
+// fork rules of its block, the top-level trace and the receipt's gasUsed. When the top-level trace failed its
+// execution gas is taken from the receipt since a failed frame carries no result, so is it for a call to an
+// account without code, whose gasUsed is its calldata cost, see InternalActionTrace.EOAInput.
+func ComputeGasBreakdown(data []byte, accessList types.AccessList, create bool, rules params.Rules, rootTrace *InternalActionTrace, receiptGasUsed uint64) (*TxGasBreakdown, error) {
+	intrinsic, err := intrinsicGas(data, accessList, create, rules.IsHomestead, rules.IsIstanbul, rules.IsShanghai)
+	if err != nil {
+		return nil, err
+	}
+	breakdown := &TxGasBreakdown{
+		IntrinsicGas:     intrinsic,
+		EffectiveGasUsed: receiptGasUsed,
+	}
+	if rootTrace != nil && rootTrace.Result != nil && !rootTrace.EOAInput {
+		breakdown.ExecutionGas = rootTrace.Result.GasUsed
+	} else if receiptGasUsed > intrinsic {
+		breakdown.ExecutionGas = receiptGasUsed - intrinsic
+	}
+	if total := intrinsic + breakdown.ExecutionGas; total > receiptGasUsed {
+		breakdown.RefundedGas = total - receiptGasUsed
+	}
+	return breakdown, nil
+}
+
+// intrinsicGas is core.IntrinsicGas, the package doesn't import core to keep the trace codec light, sums beyond
+// 64 bits are ErrValueOutOfRange
+func intrinsicGas(data []byte, accessList types.AccessList, isContractCreation, isHomestead, isEIP2028, isEIP3860 bool) (uint64, error) {
+	gas := params.TxGas
+	if isContractCreation && isHomestead {
+		gas = params.TxGasContractCreation
+	}
+	if len(data) > 0 {
+		var nz uint64
+		for _, b := range data {
+			if b != 0 {
+				nz++
+			}
+		}
+		nonZeroGas := params.TxDataNonZeroGasFrontier
+		if isEIP2028 {
+			nonZeroGas = params.TxDataNonZeroGasEIP2028
+		}
+		if (math.MaxUint64-gas)/nonZeroGas < nz {
+			return 0, fmt.Errorf("%w: intrinsic gas of %d non-zero bytes", ErrValueOutOfRange, nz)
+		}
+		gas += nz * nonZeroGas
+
+		z := uint64(len(data)) - nz
+		if (math.MaxUint64-gas)/params.TxDataZeroGas < z {
+			return 0, fmt.Errorf("%w: intrinsic gas of %d zero bytes", ErrValueOutOfRange, z)
+		}
+		gas += z * params.TxDataZeroGas
+
+		if isContractCreation && isEIP3860 {
+			// the length of a slice is far below the overflow of the rounding up
+			words := (uint64(len(data)) + 31) / 32
+			if (math.MaxUint64-gas)/params.InitCodeWordGas < words {
+				return 0, fmt.Errorf("%w: intrinsic gas of %d initcode words", ErrValueOutOfRange, words)
+			}
+			gas += words * params.InitCodeWordGas
+		}
+	}
+	gas += uint64(len(accessList)) * params.TxAccessListAddressGas
+	gas += uint64(accessList.StorageKeys()) * params.TxAccessListStorageKeyGas
+	return gas, nil
+}
+
+// GasMismatchError reports a divergence between a trace and its receipt.
+type GasMismatchError struct {
+	TraceGasUsed   uint64 // top-level result.gasUsed plus intrinsic gas
+	ReceiptGasUsed uint64
+	Discrepancy    int64 // TraceGasUsed - ReceiptGasUsed
+}
+
+func (e *GasMismatchError) Error() string {
+	return fmt.Sprintf("gas mismatch: trace %d, receipt %d, discrepancy %d", e.TraceGasUsed, e.ReceiptGasUsed, e.Discrepancy)
+}
+
+// ReconcileGas checks the gas used by the top-level trace plus the intrinsic gas of the tx against
+// the receipt's gasUsed. The receipt amount is net of refunds, a refunding tx shows the refund as
+// discrepancy unless receiptGasUsed is the gas before refund, e.g. the EffectiveGasUsed plus the
+// RefundedGas of TxGasBreakdown. A failed top-level trace has no result, see rootGasUsed. The gasUsed
+// of a call to an account without code is already its calldata cost, its intrinsic is the 21000 base
+// only, see EOATransferInputMode.
+func ReconcileGas(trace []RpcActionTrace, receiptGasUsed uint64, intrinsic uint64) error {
+	var root *RpcActionTrace
+	for i := range trace {
+		if len(trace[i].TraceAddress) == 0 {
+			root = &trace[i]
+			break
+		}
+	}
+	if root == nil {
+		return errors.New("top-level trace not found")
+	}
+	gasUsed, err := rootGasUsed(root)
+	if err != nil {
+		return err
+	}
+	traceGasUsed := gasUsed + intrinsic
+	if traceGasUsed < intrinsic {
+		return fmt.Errorf("%w: gas used %d plus intrinsic gas %d", ErrValueOutOfRange, gasUsed, intrinsic)
+	}
+	if traceGasUsed == receiptGasUsed {
+		return nil
+	}
+	// the discrepancy is signed, it must fit in an int64 either way
+	var discrepancy int64
+	if traceGasUsed > receiptGasUsed {
+		if traceGasUsed-receiptGasUsed > math.MaxInt64 {
+			return fmt.Errorf("%w: trace gas %d exceeds receipt gas %d", ErrValueOutOfRange, traceGasUsed, receiptGasUsed)
+		}
+		discrepancy = int64(traceGasUsed - receiptGasUsed)
+	} else {
+		if receiptGasUsed-traceGasUsed > math.MaxInt64 {
+			return fmt.Errorf("%w: receipt gas %d exceeds trace gas %d", ErrValueOutOfRange, receiptGasUsed, traceGasUsed)
+		}
+		discrepancy = -int64(receiptGasUsed - traceGasUsed)
+	}
+	return &GasMismatchError{
+		TraceGasUsed:   traceGasUsed,
+		ReceiptGasUsed: receiptGasUsed,
+		Discrepancy:    discrepancy,
+	}
+}
+
+// rootGasUsed returns the gas used by the top-level trace. A failed one has no result: failing other than by a
+// revert consumes the gas of its action, a revert leaves the gas of the error frame, see ActionTrace.ErrorDetail,
+// which verbose traces only carry when the top-level frame reverted itself rather than bubbling up a revert. The
+// gas left is the one before the REVERT, the memory it expands is counted as left.
+func rootGasUsed(root *RpcActionTrace) (uint64, error) {
+	if root.Result != nil {
+		return uint64(root.Result.GasUsed), nil
+	}
+	if root.Error == "" {
+		return 0, errors.New("top-level trace has no result")
+	}
+	if root.FailureKind() != FailureRevert {
+		return uint64(root.Action.Gas), nil
+	}
+	if root.ErrorDetail == nil || root.ErrorDetail.Gas > uint64(root.Action.Gas) {
+		return 0, errors.New("reverted top-level trace without the gas left at the revert")
+	}
+	return uint64(root.Action.Gas) - root.ErrorDetail.Gas, nil
+}
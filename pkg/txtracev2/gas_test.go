@@ -0,0 +1,180 @@
+package txtracev2
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+func TestReconcileGas(t *testing.T) {
+	traces := []RpcActionTrace{
+		{TraceAddress: []uint32{}, Result: &ActionResult{GasUsed: hexutil.Uint64(30000)}},
+		{TraceAddress: []uint32{0}, Result: &ActionResult{GasUsed: hexutil.Uint64(5000)}},
+	}
+	if err := ReconcileGas(traces, 51000, 21000); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err := ReconcileGas(traces, 50000, 21000)
+	var mismatch *GasMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("expected gas mismatch, have %v", err)
+	}
+	if mismatch.Discrepancy != 1000 {
+		t.Fatalf("discrepancy mismatch: have %d, want %d", mismatch.Discrepancy, 1000)
+	}
+	if err := ReconcileGas(traces, 52000, 21000); !errors.As(err, &mismatch) || mismatch.Discrepancy != -1000 {
+		t.Fatalf("expected negative discrepancy, have %v", err)
+	}
+
+	// sums and discrepancies beyond 64 bits are rejected instead of wrapping
+	if err := ReconcileGas(traces, 51000, math.MaxUint64); !errors.Is(err, ErrValueOutOfRange) {
+		t.Fatalf("expected ErrValueOutOfRange for overflowing gas used, have %v", err)
+	}
+	if err := ReconcileGas(traces, math.MaxUint64, 0); !errors.Is(err, ErrValueOutOfRange) {
+		t.Fatalf("expected ErrValueOutOfRange for overflowing discrepancy, have %v", err)
+	}
+
+	traces[0].Result = nil
+	if err := ReconcileGas(traces, 51000, 21000); err == nil {
+		t.Fatalf("expected error for top-level trace without result")
+	}
+	// a failed top-level trace consumed the gas of its action, but what a revert left
+	traces[0].Action.Gas, traces[0].Error = 30000, "out of gas"
+	if err := ReconcileGas(traces, 51000, 21000); err != nil {
+		t.Fatalf("unexpected error for top-level trace out of gas: %v", err)
+	}
+	traces[0].Error = "Reverted"
+	if err := ReconcileGas(traces, 41000, 21000); err == nil {
+		t.Fatalf("expected error for reverted top-level trace without error detail")
+	}
+	traces[0].ErrorDetail = &FaultInfo{Op: "REVERT", Gas: 10000}
+	if err := ReconcileGas(traces, 41000, 21000); err != nil {
+		t.Fatalf("unexpected error for reverted top-level trace: %v", err)
+	}
+	if err := ReconcileGas(nil, 51000, 21000); err == nil {
+		t.Fatalf("expected error for empty trace")
+	}
+}
+
+func TestComputeGasBreakdownCreate(t *testing.T) {
+	// 40KiB initcode, half of it zero bytes
+	initcode := bytes.Repeat([]byte{0x01, 0x00}, 20*1024)
+	rules := params.Rules{IsHomestead: true, IsIstanbul: true, IsShanghai: true}
+	root := &InternalActionTrace{Result: &InternalTraceActionResult{GasUsed: 100_000}}
+
+	words := uint64(len(initcode)+31) / 32
+	intrinsic := params.TxGasContractCreation + 20*1024*params.TxDataNonZeroGasEIP2028 + 20*1024*params.TxDataZeroGas + words*params.InitCodeWordGas
+	breakdown, err := ComputeGasBreakdown(initcode, nil, true, rules, root, intrinsic+100_000-20_000)
+	if err != nil {
+		t.Fatalf("failed to compute gas breakdown: %v", err)
+	}
+	want := &TxGasBreakdown{
+		IntrinsicGas:     intrinsic,
+		ExecutionGas:     100_000,
+		RefundedGas:      20_000,
+		EffectiveGasUsed: intrinsic + 80_000,
+	}
+	if !reflect.DeepEqual(breakdown, want) {
+		t.Fatalf("gas breakdown mismatch: have %+v, want %+v", breakdown, want)
+	}
+
+	// initcode word cost is only charged after shanghai
+	rules.IsShanghai = false
+	breakdown, err = ComputeGasBreakdown(initcode, nil, true, rules, root, intrinsic)
+	if err != nil {
+		t.Fatalf("failed to compute gas breakdown: %v", err)
+	}
+	if breakdown.IntrinsicGas != intrinsic-words*params.InitCodeWordGas {
+		t.Fatalf("pre-shanghai intrinsic gas mismatch: have %d, want %d", breakdown.IntrinsicGas, intrinsic-words*params.InitCodeWordGas)
+	}
+}
+
+func TestComputeGasBreakdownAccessList(t *testing.T) {
+	to := common.HexToAddress("0x1")
+	data := []byte{0xa9, 0x05, 0x9c, 0xbb, 0x00, 0x00}
+	accessList := types.AccessList{
+		{Address: to, StorageKeys: []common.Hash{{0x1}, {0x2}}},
+		{Address: common.HexToAddress("0x2")},
+	}
+	accessListGas := 2*params.TxAccessListAddressGas + 2*params.TxAccessListStorageKeyGas
+	cases := []struct {
+		rules     params.Rules
+		intrinsic uint64
+	}{
+		{params.Rules{IsHomestead: true, IsIstanbul: true, IsBerlin: true}, params.TxGas + 4*params.TxDataNonZeroGasEIP2028 + 2*params.TxDataZeroGas + accessListGas},
+		{params.Rules{IsHomestead: true}, params.TxGas + 4*params.TxDataNonZeroGasFrontier + 2*params.TxDataZeroGas + accessListGas},
+	}
+	for _, c := range cases {
+		// a failed top-level call takes its execution gas from the receipt
+		breakdown, err := ComputeGasBreakdown(data, accessList, false, c.rules, &InternalActionTrace{Error: "out of gas"}, c.intrinsic+5000)
+		if err != nil {
+			t.Fatalf("failed to compute gas breakdown: %v", err)
+		}
+		want := &TxGasBreakdown{IntrinsicGas: c.intrinsic, ExecutionGas: 5000, EffectiveGasUsed: c.intrinsic + 5000}
+		if !reflect.DeepEqual(breakdown, want) {
+			t.Fatalf("gas breakdown mismatch: have %+v, want %+v", breakdown, want)
+		}
+	}
+}
+
+func TestIntrinsicGas(t *testing.T) {
+	accessList := types.AccessList{{Address: common.Address{0x1}, StorageKeys: []common.Hash{{0x1}, {0x2}}}, {Address: common.Address{0x2}}}
+	for _, data := range [][]byte{nil, {0x00}, {0x01, 0x00, 0x02}, bytes.Repeat([]byte{0xff, 0x00, 0x00}, 1000)} {
+		for _, create := range []bool{false, true} {
+			for _, flags := range [][3]bool{{false, false, false}, {true, false, false}, {true, true, false}, {true, true, true}} {
+				for _, list := range []types.AccessList{nil, accessList} {
+					want, _ := core.IntrinsicGas(data, list, create, flags[0], flags[1], flags[2])
+					if have, err := intrinsicGas(data, list, create, flags[0], flags[1], flags[2]); err != nil || have != want {
+						t.Fatalf("intrinsic gas of %d bytes, create %v, forks %v, access list %v mismatch: have %d, %v, want %d", len(data), create, flags, list != nil, have, err, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestGasBreakdownTrailer(t *testing.T) {
+	// the layout of InternalActionTraceList before the gas breakdown trailer was added
+	type legacyTraceList struct {
+		Traces              []*InternalActionTrace
+		BlockHash           common.Hash
+		BlockNumber         *big.Int
+		TransactionHash     common.Hash
+		TransactionPosition uint64
+	}
+	legacy, err := rlp.EncodeToBytes(&legacyTraceList{BlockNumber: big.NewInt(1), TransactionPosition: 2})
+	if err != nil {
+		t.Fatalf("failed to encode legacy traces: %v", err)
+	}
+	decoded := new(InternalActionTraceList)
+	if err := rlp.DecodeBytes(legacy, decoded); err != nil {
+		t.Fatalf("failed to decode legacy traces: %v", err)
+	}
+	if decoded.GasBreakdown != nil || decoded.TransactionPosition != 2 {
+		t.Fatalf("legacy traces decoded wrongly: %+v", decoded)
+	}
+
+	decoded.GasBreakdown = &TxGasBreakdown{IntrinsicGas: 21000, ExecutionGas: 100, EffectiveGasUsed: 21100}
+	enc, err := rlp.EncodeToBytes(decoded)
+	if err != nil {
+		t.Fatalf("failed to encode traces: %v", err)
+	}
+	roundTrip := new(InternalActionTraceList)
+	if err := rlp.DecodeBytes(enc, roundTrip); err != nil {
+		t.Fatalf("failed to decode traces: %v", err)
+	}
+	if !reflect.DeepEqual(roundTrip.GasBreakdown, decoded.GasBreakdown) {
+		t.Fatalf("gas breakdown mismatch: have %+v, want %+v", roundTrip.GasBreakdown, decoded.GasBreakdown)
+	}
+}
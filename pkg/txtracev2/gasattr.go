@@ -0,0 +1,173 @@
+package txtracev2
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// GasAttribution is the gas consumed by the frames running the code of an account within a tx.
+type GasAttribution struct {
+	Address  common.Address `json:"address"`
+	SelfGas  uint64         `json:"selfGas"`  // gasUsed of the frames less the gasUsed of their sub frames
+	TotalGas uint64         `json:"totalGas"` // gasUsed of the frames, sub frames included, recursive frames counted once
+	Frames   int            `json:"frames"`
+	// sub frames of some frames reported more gas than them, as older v1 traces may, their self gas is floored at 0
+	Inconsistent bool `json:"inconsistent,omitempty"`
+	// some frames reported no gas used, the failed ones, what they consumed counts towards the self gas of the
+	// nearest frame above them reporting it
+	Unmetered bool `json:"unmetered,omitempty"`
+}
+
+// GasAttributions maps the accounts running code in a tx to the gas they consumed, see AttributeGas.
+type GasAttributions map[common.Address]GasAttribution
+
+// Sorted returns the attributions by self gas, total gas then address, for rendering.
+func (attrs GasAttributions) Sorted() []GasAttribution {
+	sorted := make([]GasAttribution, 0, len(attrs))
+	for _, attr := range attrs {
+		sorted = append(sorted, attr)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := &sorted[i], &sorted[j]
+		if a.SelfGas != b.SelfGas {
+			return a.SelfGas > b.SelfGas
+		}
+		if a.TotalGas != b.TotalGas {
+			return a.TotalGas > b.TotalGas
+		}
+		return bytes.Compare(a.Address[:], b.Address[:]) < 0
+	})
+	return sorted
+}
+
+// GasAttributionOption configures optional behaviours of AttributeGas.
+type GasAttributionOption func(cfg *gasAttributionConfig)
+
+type gasAttributionConfig struct {
+	proxy bool
+}
+
+// WithProxyAttribution attributes the delegatecall and callcode frames to the account whose storage they run
+// on, e.g. the proxy, instead of the account whose code they run, e.g. the implementation.
+func WithProxyAttribution() GasAttributionOption {
+	return func(cfg *gasAttributionConfig) {
+		cfg.proxy = true
+	}
+}
+
+// AttributeGas attributes the gas used by the frames of a tx to the accounts whose code they run. The call
+// tree is rebuilt from the traceAddress of the traces, a trace whose parent is missing is taken as a top-level
+// one. Failed creates don't report their address, they are attributed to the zero address. Inconsistent or
+// missing gas data is flagged on the attributions, see GasAttribution.
+func AttributeGas(traces []RpcActionTrace, opts ...GasAttributionOption) GasAttributions {
+	var cfg gasAttributionConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	a := &gasAttributor{
+		cfg:      cfg,
+		traces:   traces,
+		children: make(map[string][]int, len(traces)),
+		running:  make(map[common.Address]int),
+		attrs:    make(GasAttributions),
+	}
+	keys := make(map[string]bool, len(traces))
+	for i := range traces {
+		keys[traceAddressKey(traces[i].TraceAddress)] = true
+	}
+	var roots []int
+	for i := range traces {
+		traceAddress := traces[i].TraceAddress
+		if len(traceAddress) > 0 {
+			parentKey := traceAddressKey(traceAddress[:len(traceAddress)-1])
+			if keys[parentKey] {
+				a.children[parentKey] = append(a.children[parentKey], i)
+				continue
+			}
+		}
+		roots = append(roots, i)
+	}
+	for _, i := range roots {
+		a.visit(i)
+	}
+	return a.attrs
+}
+
+// gasAttributor walks the call tree of a tx aggregating the gas of its frames
+type gasAttributor struct {
+	cfg      gasAttributionConfig
+	traces   []RpcActionTrace
+	children map[string][]int // indexes of the sub traces by the key of the trace address of their parent
+	running  map[common.Address]int
+	attrs    GasAttributions
+}
+
+// visit attributes the gas of the frame of traces[i] and its descendants
+func (a *gasAttributor) visit(i int) {
+	trace := &a.traces[i]
+	if trace.TraceType == "suicide" {
+		// a selfdestruct runs no code, its gas is the one of its caller
+		return
+	}
+	addr := a.codeAddress(trace)
+	attr := a.attrs[addr]
+	attr.Address = addr
+	attr.Frames++
+	if trace.Result == nil {
+		attr.Unmetered = true
+	} else {
+		gasUsed := uint64(trace.Result.GasUsed)
+		childGas := a.meteredChildGas(i)
+		if childGas > gasUsed {
+			attr.Inconsistent = true
+		} else {
+			attr.SelfGas += gasUsed - childGas
+		}
+		if a.running[addr] == 0 {
+			attr.TotalGas += gasUsed
+		}
+	}
+	a.attrs[addr] = attr
+
+	a.running[addr]++
+	for _, child := range a.children[traceAddressKey(trace.TraceAddress)] {
+		a.visit(child)
+	}
+	a.running[addr]--
+}
+
+// meteredChildGas sums the gasUsed of the sub frames of traces[i], looking through the ones reporting none
+func (a *gasAttributor) meteredChildGas(i int) uint64 {
+	var sum uint64
+	for _, child := range a.children[traceAddressKey(a.traces[i].TraceAddress)] {
+		trace := &a.traces[child]
+		switch {
+		case trace.TraceType == "suicide":
+		case trace.Result != nil:
+			sum += uint64(trace.Result.GasUsed)
+		default:
+			sum += a.meteredChildGas(child)
+		}
+	}
+	return sum
+}
+
+// codeAddress returns the account the gas of the frame of trace is attributed to
+func (a *gasAttributor) codeAddress(trace *RpcActionTrace) common.Address {
+	action := &trace.Action
+	if trace.TraceType == "create" {
+		if trace.Result != nil && trace.Result.Address != nil {
+			return *trace.Result.Address
+		}
+		return common.Address{}
+	}
+	if a.cfg.proxy && action.CallType != nil && (*action.CallType == DelegateCall || *action.CallType == CallCode) && action.From != nil {
+		return *action.From
+	}
+	if action.To != nil {
+		return *action.To
+	}
+	return common.Address{}
+}
@@ -0,0 +1,107 @@
+package txtracev2
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// gasTrace returns a call frame at traceAddress, without result when it failed
+func gasTrace(callType string, from, to common.Address, gasUsed uint64, failed bool, traceAddress ...uint32) RpcActionTrace {
+	trace := RpcActionTrace{
+		TraceType:    "call",
+		TraceAddress: append([]uint32{}, traceAddress...),
+		Action:       Action{CallType: &callType, From: &from, To: &to},
+	}
+	if failed {
+		trace.Error = "Reverted"
+	} else {
+		trace.Result = &ActionResult{GasUsed: hexutil.Uint64(gasUsed)}
+	}
+	return trace
+}
+
+func TestAttributeGas(t *testing.T) {
+	var (
+		user, proxy, impl, token, other = common.Address{0x1}, common.Address{0x2}, common.Address{0x3}, common.Address{0x4}, common.Address{0x5}
+	)
+	// the proxy delegates to the implementation which calls the token, then calls itself back
+	proxied := []RpcActionTrace{
+		gasTrace(Call, user, proxy, 50_000, false),
+		gasTrace(DelegateCall, proxy, impl, 30_000, false, 0),
+		gasTrace(Call, proxy, token, 10_000, false, 0, 0),
+		gasTrace(Call, proxy, proxy, 4_000, false, 0, 1),
+	}
+	// the sub frames of legacy v1 traces may report more gas than their parent, the last frame lost its parent
+	legacy := []RpcActionTrace{
+		gasTrace(Call, user, proxy, 1_000, false),
+		gasTrace(Call, proxy, token, 800, false, 0),
+		gasTrace(Call, proxy, other, 700, false, 1),
+		gasTrace(Call, proxy, other, 300, false, 3, 0),
+	}
+	// the reverted frame reports no gas, the token call below it does, then a create fails and a selfdestruct
+	reverted := []RpcActionTrace{
+		gasTrace(Call, user, proxy, 60_000, false),
+		gasTrace(Call, proxy, impl, 0, true, 0),
+		gasTrace(Call, impl, token, 5_000, false, 0, 0),
+		{TraceType: "create", TraceAddress: []uint32{1}, Action: Action{From: &proxy}, Error: "out of gas"},
+		{TraceType: "suicide", TraceAddress: []uint32{2}, Action: Action{Address: &proxy, RefundAddress: &user}},
+	}
+	reverted[2].RolledBack = true
+
+	for i, test := range []struct {
+		traces []RpcActionTrace
+		opts   []GasAttributionOption
+		want   []GasAttribution
+	}{
+		{
+			traces: proxied,
+			want: []GasAttribution{
+				{Address: proxy, SelfGas: 24_000, TotalGas: 50_000, Frames: 2},
+				{Address: impl, SelfGas: 16_000, TotalGas: 30_000, Frames: 1},
+				{Address: token, SelfGas: 10_000, TotalGas: 10_000, Frames: 1},
+			},
+		},
+		{
+			traces: proxied,
+			opts:   []GasAttributionOption{WithProxyAttribution()},
+			want: []GasAttribution{
+				{Address: proxy, SelfGas: 40_000, TotalGas: 50_000, Frames: 3},
+				{Address: token, SelfGas: 10_000, TotalGas: 10_000, Frames: 1},
+			},
+		},
+		{
+			traces: legacy,
+			want: []GasAttribution{
+				{Address: other, SelfGas: 1_000, TotalGas: 1_000, Frames: 2},
+				{Address: token, SelfGas: 800, TotalGas: 800, Frames: 1},
+				{Address: proxy, SelfGas: 0, TotalGas: 1_000, Frames: 1, Inconsistent: true},
+			},
+		},
+		{
+			traces: reverted,
+			want: []GasAttribution{
+				{Address: proxy, SelfGas: 55_000, TotalGas: 60_000, Frames: 1},
+				{Address: token, SelfGas: 5_000, TotalGas: 5_000, Frames: 1},
+				{Address: common.Address{}, Frames: 1, Unmetered: true},
+				{Address: impl, Frames: 1, Unmetered: true},
+			},
+		},
+	} {
+		attrs := AttributeGas(test.traces, test.opts...)
+		if have := attrs.Sorted(); !reflect.DeepEqual(have, test.want) {
+			t.Fatalf("test %d: attributions mismatch\nhave %+v\nwant %+v", i, have, test.want)
+		}
+		for _, want := range test.want {
+			if attrs[want.Address] != want {
+				t.Fatalf("test %d: attribution of %s mismatch: have %+v", i, want.Address.Hex(), attrs[want.Address])
+			}
+		}
+	}
+
+	if attrs := AttributeGas(nil); len(attrs) != 0 || len(attrs.Sorted()) != 0 {
+		t.Fatalf("expected no attribution of no traces, have %+v", attrs)
+	}
+}
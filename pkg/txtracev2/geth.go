@@ -0,0 +1,132 @@
+package txtracev2
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// GethCallFrame is a frame of the nested trace produced by the geth callTracer.
+type GethCallFrame struct {
+	Type    string           `json:"type"`
+	From    common.Address   `json:"from"`
+	Gas     hexutil.Uint64   `json:"gas"`
+	GasUsed hexutil.Uint64   `json:"gasUsed"`
+	To      *common.Address  `json:"to,omitempty"`
+	Input   hexutil.Bytes    `json:"input"`
+	Output  hexutil.Bytes    `json:"output,omitempty"`
+	Error   string           `json:"error,omitempty"`
+	Calls   []*GethCallFrame `json:"calls,omitempty"`
+	Value   *hexutil.Big     `json:"value,omitempty"`
+}
+
+// ToGethCallFrame converts the flat traces to the nested form of the geth callTracer. Unlike geth, the
+// gasUsed of a failed frame is its whole gas and a reverted frame has no output, since neither is stored.
+// With a gas breakdown the top frame reports the tx gas limit and the receipt gasUsed like geth does,
+// otherwise the gas after intrinsic gas like the parity form.
+func (it *InternalActionTraceList) ToGethCallFrame() (*GethCallFrame, error) {
+	var root *GethCallFrame
+	frames := make(map[string]*GethCallFrame, len(it.Traces))
+	for _, interTrace := range it.Traces {
+		key := traceAddressKey(interTrace.TraceAddress)
+		if _, ok := frames[key]; ok {
+			return nil, fmt.Errorf("duplicated trace address %v", interTrace.TraceAddress)
+		}
+		frame := toGethCallFrame(interTrace)
+		frames[key] = frame
+		if len(interTrace.TraceAddress) == 0 {
+			root = frame
+			continue
+		}
+		parent, ok := frames[traceAddressKey(interTrace.TraceAddress[:len(interTrace.TraceAddress)-1])]
+		if !ok {
+			return nil, fmt.Errorf("parent of trace %v not found", interTrace.TraceAddress)
+		}
+		parent.Calls = append(parent.Calls, frame)
+	}
+	if root == nil {
+		return nil, errors.New("top-level trace not found")
+	}
+	if breakdown := it.GasBreakdown; breakdown != nil {
+		if uint64(root.Gas)+breakdown.IntrinsicGas < breakdown.IntrinsicGas {
+			return nil, fmt.Errorf("%w: gas %d plus intrinsic gas %d", ErrValueOutOfRange, root.Gas, breakdown.IntrinsicGas)
+		}
+		root.Gas += hexutil.Uint64(breakdown.IntrinsicGas)
+		root.GasUsed = hexutil.Uint64(breakdown.EffectiveGasUsed)
+	}
+	return root, nil
+}
+
+// toGethCallFrame converts a single trace, without its sub traces
+func toGethCallFrame(interTrace *InternalActionTrace) *GethCallFrame {
+	action := &interTrace.Action
+	frame := &GethCallFrame{
+		Gas:     hexutil.Uint64(action.Gas),
+		GasUsed: hexutil.Uint64(action.Gas),
+		Input:   hexutil.Bytes{},
+	}
+	if action.CallType != CallTypeSuicide {
+		frame.Error = traceError(interTrace)
+	}
+	if interTrace.Result != nil {
+		frame.GasUsed = hexutil.Uint64(interTrace.Result.GasUsed)
+	}
+	if action.Value != nil {
+		frame.Value = (*hexutil.Big)(copyBig(action.Value))
+	}
+	switch action.CallType {
+	case CallTypeCreate:
+		frame.Type = "CREATE"
+		if action.CreateMethod == CreateMethodCreate2 {
+			frame.Type = "CREATE2"
+		}
+		frame.From = derefAddress(action.From)
+		frame.Input = action.ownedBytes(action.Init)
+		if frame.Error == "" {
+			frame.To = copyAddress(action.Address)
+		}
+		if interTrace.Result != nil {
+			frame.Output = interTrace.Result.Code
+		}
+	case CallTypeSuicide:
+		frame.Type = "SELFDESTRUCT"
+		frame.From = derefAddress(action.Address)
+		frame.To = copyAddress(action.RefundAddress)
+		frame.Gas, frame.GasUsed = 0, 0
+		frame.Value = (*hexutil.Big)(copyBig(action.Balance))
+	default:
+		switch action.CallType {
+		case CallTypeCallCode:
+			frame.Type = "CALLCODE"
+		case CallTypeDelegateCall:
+			frame.Type = "DELEGATECALL"
+		case CallTypeStaticCall:
+			frame.Type = "STATICCALL"
+			frame.Value = nil
+		case CallTypeUnknown:
+			frame.Type = strings.ToUpper(action.CallTypeName)
+		default:
+			frame.Type = "CALL"
+		}
+		frame.From = derefAddress(action.From)
+		frame.To = copyAddress(action.To)
+		frame.Input = action.ownedBytes(action.Input)
+		if interTrace.Result != nil {
+			frame.Output = interTrace.Result.Output
+		}
+	}
+	if frame.Input == nil {
+		frame.Input = hexutil.Bytes{}
+	}
+	return frame
+}
+
+func derefAddress(addr *common.Address) common.Address {
+	if addr == nil {
+		return common.Address{}
+	}
+	return *addr
+}
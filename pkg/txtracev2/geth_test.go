@@ -0,0 +1,137 @@
+package txtracev2
+
+import (
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+func TestToGethCallFrame(t *testing.T) {
+	var (
+		sender  = common.Address{0xa}
+		proxy   = common.Address{0xb}
+		impl    = common.Address{0xc}
+		created = common.Address{0xd}
+		failed  = common.Address{0xe}
+	)
+	tracer := NewOeTracer(nil, common.Hash{}, big.NewInt(1), common.Hash{0x1}, 0)
+	tracer.CaptureStart(nil, sender, proxy, false, []byte{0x1, 0x2}, 100_000, big.NewInt(5))
+	tracer.CaptureEnter(vm.DELEGATECALL, proxy, impl, []byte{0x1, 0x2}, 90_000, big.NewInt(5))
+	tracer.CaptureEnter(vm.CREATE2, proxy, created, []byte{0x60}, 30_000, big.NewInt(0))
+	tracer.CaptureEnter(vm.SELFDESTRUCT, created, sender, nil, 0, big.NewInt(7))
+	tracer.CaptureExit(nil, 0, nil)
+	tracer.CaptureExit([]byte{0xfe}, 2_000, nil)
+	tracer.CaptureEnter(vm.STATICCALL, proxy, impl, []byte{0x3}, 1_000, nil)
+	tracer.CaptureExit([]byte{0x4}, 1_000, vm.ErrExecutionReverted)
+	tracer.CaptureEnter(vm.CREATE, proxy, failed, []byte{0x61}, 500, big.NewInt(1))
+	tracer.CaptureExit(nil, 500, vm.ErrOutOfGas)
+	tracer.CaptureExit([]byte{0x5}, 40_000, nil)
+	tracer.CaptureEnd([]byte{0x5}, 60_000, nil)
+
+	root, err := tracer.getInternalTraces().ToGethCallFrame()
+	if err != nil {
+		t.Fatalf("failed to convert traces: %v", err)
+	}
+	bytes := func(data ...byte) hexutil.Bytes { return data }
+	value := func(v int64) *hexutil.Big { return (*hexutil.Big)(big.NewInt(v)) }
+	want := &GethCallFrame{
+		Type: "CALL", From: sender, To: &proxy, Gas: 100_000, GasUsed: 60_000, Input: bytes(0x1, 0x2), Output: bytes(0x5), Value: value(5),
+		Calls: []*GethCallFrame{{
+			Type: "DELEGATECALL", From: proxy, To: &impl, Gas: 90_000, GasUsed: 40_000, Input: bytes(0x1, 0x2), Output: bytes(0x5), Value: value(5),
+			Calls: []*GethCallFrame{
+				{
+					Type: "CREATE2", From: proxy, To: &created, Gas: 30_000, GasUsed: 2_000, Input: bytes(0x60), Output: bytes(0xfe), Value: value(0),
+					Calls: []*GethCallFrame{{Type: "SELFDESTRUCT", From: created, To: &sender, Input: bytes(), Value: value(7)}},
+				},
+				{Type: "STATICCALL", From: proxy, To: &impl, Gas: 1_000, GasUsed: 1_000, Input: bytes(0x3), Error: "execution reverted"},
+				{Type: "CREATE", From: proxy, Gas: 500, GasUsed: 500, Input: bytes(0x61), Error: "out of gas", Value: value(1)},
+			},
+		}},
+	}
+	have, _ := json.Marshal(root)
+	wantJSON, _ := json.Marshal(want)
+	if string(have) != string(wantJSON) {
+		t.Fatalf("geth call frame mismatch:\nhave %s\nwant %s", have, wantJSON)
+	}
+	if !strings.HasPrefix(string(have), `{"type":"CALL","from":"0x0a00000000000000000000000000000000000000","gas":"0x186a0","gasUsed":"0xea60","to":`) {
+		t.Fatalf("geth call frame json layout mismatch: %s", have)
+	}
+
+	// with a gas breakdown the top frame carries the gas of the whole tx
+	tracer.outPutTraces.GasBreakdown = &TxGasBreakdown{IntrinsicGas: 21_000, ExecutionGas: 60_000, RefundedGas: 4_800, EffectiveGasUsed: 76_200}
+	root, err = tracer.getInternalTraces().ToGethCallFrame()
+	if err != nil {
+		t.Fatalf("failed to convert traces: %v", err)
+	}
+	if root.Gas != 121_000 || root.GasUsed != 76_200 || root.Calls[0].Gas != 90_000 {
+		t.Fatalf("top frame gas mismatch: have gas %d, gasUsed %d", root.Gas, root.GasUsed)
+	}
+
+	malformed := []*InternalActionTraceList{
+		{Traces: []*InternalActionTrace{{TraceAddress: []uint32{0}}}},
+		{Traces: []*InternalActionTrace{{TraceAddress: []uint32{}}, {TraceAddress: []uint32{1, 0}}}},
+		{Traces: []*InternalActionTrace{{TraceAddress: []uint32{}}, {TraceAddress: []uint32{}}}},
+	}
+	for _, traces := range malformed {
+		if _, err := traces.ToGethCallFrame(); err == nil {
+			t.Fatalf("expected error for malformed traces %v", traces.Traces)
+		}
+	}
+}
+
+func TestToGethCallFrameFixtures(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "call_tracer_*.json"))
+	if err != nil {
+		t.Fatalf("failed to retrieve tracer test suite: %v", err)
+	}
+	for _, file := range files {
+		blob, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("failed to read testcase: %v", err)
+		}
+		test := new(callTracerTest)
+		if err := json.Unmarshal(blob, test); err != nil {
+			t.Fatalf("failed to parse testcase: %v", err)
+		}
+		traces, err := toInternalTraces(test.Result[0].TransactionHash, test.Result, nil)
+		if err != nil {
+			t.Fatalf("%s: failed to convert rpc traces: %v", file, err)
+		}
+		root, err := traces.ToGethCallFrame()
+		if err != nil {
+			t.Fatalf("%s: failed to convert traces: %v", file, err)
+		}
+
+		// the frames in depth-first order match the flat traces
+		var walk func(frame *GethCallFrame)
+		i := 0
+		walk = func(frame *GethCallFrame) {
+			trace := test.Result[i]
+			i++
+			kind := trace.TraceType
+			if trace.Action.CallType != nil {
+				kind = *trace.Action.CallType
+			}
+			if kind == "suicide" {
+				kind = "selfdestruct"
+			}
+			if strings.ToLower(frame.Type) != kind || uint32(len(frame.Calls)) != trace.Subtraces {
+				t.Fatalf("%s: trace %v mismatch: have %s with %d calls, want %s with %d", file, trace.TraceAddress, frame.Type, len(frame.Calls), kind, trace.Subtraces)
+			}
+			for _, call := range frame.Calls {
+				walk(call)
+			}
+		}
+		walk(root)
+		if i != len(test.Result) {
+			t.Fatalf("%s: frame count mismatch: have %d, want %d", file, i, len(test.Result))
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package txtracev2
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/tests"
+	"github.com/holiman/uint256"
+)
+
+// proxyChain deploys depth proxies, each forwarding its full calldata to the next one by
+// DELEGATECALL, the last one stops.
+func proxyChain(depth int) (common.Address, types.GenesisAlloc) {
+	alloc := types.GenesisAlloc{}
+	next := common.BigToAddress(big.NewInt(int64(0x1000 + depth)))
+	alloc[next] = types.Account{Code: []byte{byte(vm.STOP)}}
+	for i := depth - 1; i > 0; i-- {
+		addr := common.BigToAddress(big.NewInt(int64(0x1000 + i)))
+		code := []byte{
+			byte(vm.CALLDATASIZE), byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.CALLDATACOPY),
+			byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.CALLDATASIZE), byte(vm.PUSH1), 0,
+			byte(vm.PUSH20),
+		}
+		code = append(code, next.Bytes()...)
+		code = append(code, byte(vm.GAS), byte(vm.DELEGATECALL), byte(vm.STOP))
+		alloc[addr] = types.Account{Code: code}
+		next = addr
+	}
+	return next, alloc
+}
+
+func traceProxyChain(tb testing.TB, statedb vm.StateDB, entry common.Address, calldata []byte, opts ...Option) *OeTracer {
+	tracer := NewOeTracer(nil, common.Hash{}, big.NewInt(1), common.Hash{}, 0, opts...)
+	blkContext := vm.BlockContext{
+		CanTransfer: core.CanTransfer,
+		Transfer:    core.Transfer,
+		GasLimit:    30_000_000,
+		BlockNumber: big.NewInt(1),
+		Difficulty:  big.NewInt(1),
+		BaseFee:     big.NewInt(0),
+	}
+	evm := vm.NewEVM(blkContext, vm.TxContext{GasPrice: big.NewInt(0)}, statedb, params.AllEthashProtocolChanges, vm.Config{Tracer: tracer})
+	if _, _, err := evm.Call(vm.AccountRef(common.Address{0x1}), entry, calldata, 10_000_000, new(uint256.Int)); err != nil {
+		tb.Fatalf("failed to execute proxy chain: %v", err)
+	}
+	return tracer
+}
+
+func TestInternedInputProxyChain(t *testing.T) {
+	entry, alloc := proxyChain(6)
+	state := tests.MakePreState(rawdb.NewMemoryDatabase(), alloc, false, rawdb.HashScheme)
+	defer state.Close()
+
+	calldata := bytes.Repeat([]byte{0xab, 0xcd}, 5*1024)
+	tracer := traceProxyChain(t, state.StateDB, entry, calldata)
+	internal := tracer.getInternalTraces().Traces
+	if len(internal) != 6 {
+		t.Fatalf("trace count mismatch: have %d, want %d", len(internal), 6)
+	}
+	for i, trace := range internal {
+		if !bytes.Equal(trace.Action.Input, calldata) {
+			t.Fatalf("trace %d: input mismatch", i)
+		}
+		if i > 0 && &trace.Action.Input[0] != &internal[0].Action.Input[0] {
+			t.Fatalf("trace %d: forwarded input is not shared with the top-level frame", i)
+		}
+	}
+	// rpc traces must not alias each other
+	traces, err := tracer.GetTraces()
+	if err != nil {
+		t.Fatalf("failed to get traces: %v", err)
+	}
+	(*traces[1].Action.Input)[0] = 0xff
+	if !bytes.Equal(*traces[2].Action.Input, calldata) || !bytes.Equal(internal[1].Action.Input, calldata) {
+		t.Fatalf("mutating an rpc trace input leaked into other traces")
+	}
+}
+
+func TestInternedInputMemoryMutation(t *testing.T) {
+	tracer := NewOeTracer(nil, common.Hash{}, big.NewInt(1), common.Hash{}, 0)
+	calldata := bytes.Repeat([]byte{0x01, 0x02, 0x03}, 1024)
+
+	// every frame reads its input from its own memory, which the evm reuses afterwards
+	parentMem := append([]byte{}, calldata...)
+	tracer.CaptureStart(nil, common.Address{0x1}, common.Address{0x2}, false, parentMem, 100_000, big.NewInt(0))
+	childMem := append([]byte{}, calldata...)
+	tracer.CaptureEnter(vm.DELEGATECALL, common.Address{0x2}, common.Address{0x3}, childMem, 90_000, nil)
+	grandChildMem := append([]byte{}, calldata[4:]...) // suffix forwarding
+	tracer.CaptureEnter(vm.CALL, common.Address{0x2}, common.Address{0x4}, grandChildMem, 80_000, big.NewInt(0))
+	for _, mem := range [][]byte{parentMem, childMem, grandChildMem} {
+		for i := range mem {
+			mem[i] = 0xff
+		}
+	}
+	tracer.CaptureExit(nil, 100, nil)
+	tracer.CaptureExit(nil, 200, nil)
+	tracer.CaptureEnd(nil, 300, nil)
+
+	want := [][]byte{calldata, calldata, calldata[4:]}
+	check := func(traces ActionTraceList) {
+		t.Helper()
+		if len(traces) != len(want) {
+			t.Fatalf("trace count mismatch: have %d, want %d", len(traces), len(want))
+		}
+		for i, trace := range traces {
+			if !bytes.Equal(*trace.Action.Input, want[i]) {
+				t.Fatalf("trace %d: input mismatch after memory mutation", i)
+			}
+		}
+	}
+	traces, err := tracer.GetTraces()
+	if err != nil {
+		t.Fatalf("failed to get traces: %v", err)
+	}
+	check(traces)
+
+	enc, err := rlp.EncodeToBytes(tracer.getInternalTraces())
+	if err != nil {
+		t.Fatalf("failed to encode traces: %v", err)
+	}
+	decoded := ActionTraceList{}
+	if err := rlp.DecodeBytes(enc, &decoded); err != nil {
+		t.Fatalf("failed to decode traces: %v", err)
+	}
+	check(decoded)
+}
+
+func BenchmarkProxyChainInput(b *testing.B) {
+	entry, alloc := proxyChain(6)
+	state := tests.MakePreState(rawdb.NewMemoryDatabase(), alloc, false, rawdb.HashScheme)
+	defer state.Close()
+	calldata := bytes.Repeat([]byte{0xab}, 10*1024)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		traceProxyChain(b, state.StateDB, entry, calldata)
+	}
+}
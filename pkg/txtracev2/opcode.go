@@ -0,0 +1,62 @@
+package txtracev2
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// callOpcode is how the frames of a registered call opcode are recorded
+type callOpcode struct {
+	callType uint8
+	name     string
+}
+
+var (
+	callOpcodesLock sync.RWMutex
+	callOpcodes     = make(map[vm.OpCode]callOpcode)
+)
+
+// RegisterCallOpcode registers a chain-specific opcode entering a call frame, recorded as a call of callType
+// rendered with name as callType, e.g. a call opcode of a L2 behaving like a STATICCALL. callType is one of
+// CallTypeCall, CallTypeCallCode, CallTypeDelegateCall, CallTypeStaticCall and CallTypeUnknown, name defaults
+// to the lowercase opcode name. Registering an opcode the tracer handles itself or another call type panics.
+// Opcodes which are not registered are traced as CallTypeUnknown.
+func RegisterCallOpcode(op vm.OpCode, callType uint8, name string) {
+	switch op {
+	case vm.CREATE, vm.CREATE2, vm.CALL, vm.CALLCODE, vm.DELEGATECALL, vm.STATICCALL, vm.SELFDESTRUCT:
+		panic(fmt.Sprintf("txtracev2: opcode %v can't be registered", op))
+	}
+	switch callType {
+	case CallTypeCall, CallTypeCallCode, CallTypeDelegateCall, CallTypeStaticCall, CallTypeUnknown:
+	default:
+		panic(fmt.Sprintf("txtracev2: call type %d of opcode %v isn't a call", callType, op))
+	}
+	if name == "" {
+		name = opcodeName(op)
+	}
+	callOpcodesLock.Lock()
+	defer callOpcodesLock.Unlock()
+	callOpcodes[op] = callOpcode{callType: callType, name: name}
+}
+
+// lookupCallOpcode returns the call type and name the frames of an opcode the tracer doesn't handle are
+// recorded with
+func lookupCallOpcode(op vm.OpCode) (uint8, string) {
+	callOpcodesLock.RLock()
+	defer callOpcodesLock.RUnlock()
+	if registered, ok := callOpcodes[op]; ok {
+		return registered.callType, registered.name
+	}
+	return CallTypeUnknown, opcodeName(op)
+}
+
+// opcodeName returns the lowercase name of op, or its hex value for opcodes unknown to the evm
+func opcodeName(op vm.OpCode) string {
+	if name := op.String(); !strings.HasPrefix(name, "opcode ") {
+		return strings.ToLower(name)
+	}
+	return fmt.Sprintf("%#x", int(op))
+}
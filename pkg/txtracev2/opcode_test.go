@@ -0,0 +1,110 @@
+package txtracev2
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+func TestUnknownCallOpcode(t *testing.T) {
+	const (
+		unknownOp    = vm.OpCode(0xf6)
+		registeredOp = vm.OpCode(0xf7)
+	)
+	RegisterCallOpcode(registeredOp, CallTypeStaticCall, "l2staticcall")
+
+	store := &MemoryStore{data: make(map[common.Hash][]byte)}
+	txHash := common.Hash{0x1}
+	tracer := NewOeTracer(store, common.Hash{0xa}, big.NewInt(10), txHash, 0)
+	tracer.CaptureStart(nil, common.Address{0xa}, common.Address{0xb}, false, nil, 100_000, big.NewInt(0))
+	tracer.CaptureEnter(unknownOp, common.Address{0xb}, common.Address{0xc}, []byte{0x1}, 50_000, big.NewInt(0))
+	tracer.CaptureEnter(vm.CALL, common.Address{0xc}, common.Address{0xd}, nil, 20_000, big.NewInt(0))
+	tracer.CaptureExit(nil, 1_000, nil)
+	tracer.CaptureExit([]byte{0x2}, 30_000, nil)
+	tracer.CaptureEnter(registeredOp, common.Address{0xb}, common.Address{0xe}, nil, 10_000, big.NewInt(0))
+	tracer.CaptureExit(nil, 10_000, vm.ErrOutOfGas)
+	tracer.CaptureEnd(nil, 60_000, nil)
+
+	traces, err := tracer.GetTraces()
+	if err != nil {
+		t.Fatalf("failed to get traces: %v", err)
+	}
+	want := []struct {
+		traceAddress string
+		callType     string
+		subtraces    uint32
+		failed       bool
+	}{
+		{"[]", Call, 2, false},
+		{"[0]", "0xf6", 1, false},
+		{"[0 0]", Call, 0, false},
+		{"[1]", "l2staticcall", 0, true},
+	}
+	if len(traces) != len(want) {
+		t.Fatalf("trace count mismatch: have %d, want %d", len(traces), len(want))
+	}
+	for i, trace := range traces {
+		if fmt.Sprint(trace.TraceAddress) != want[i].traceAddress || trace.TraceType != "call" || *trace.Action.CallType != want[i].callType ||
+			trace.Subtraces != want[i].subtraces || (trace.Error != "") != want[i].failed {
+			t.Fatalf("trace %d mismatch: have %v %s/%s %d subtraces, error %q", i, trace.TraceAddress, trace.TraceType, *trace.Action.CallType, trace.Subtraces, trace.Error)
+		}
+	}
+	if traces[1].Result == nil || traces[1].Result.GasUsed != 30_000 {
+		t.Fatalf("unknown opcode frame result mismatch: %+v", traces[1].Result)
+	}
+
+	// the opcode name survives the store and the geth form
+	if err := tracer.PersistTraceContext(context.Background()); err != nil {
+		t.Fatalf("failed to persist traces: %v", err)
+	}
+	stored, err := ReadRpcTxTrace(context.Background(), store, txHash)
+	if err != nil {
+		t.Fatalf("failed to read traces: %v", err)
+	}
+	if !jsonEqual(stored, traces) {
+		jsonDiff(t, stored, traces)
+	}
+	root, err := tracer.outPutTraces.ToGethCallFrame()
+	if err != nil {
+		t.Fatalf("failed to convert traces: %v", err)
+	}
+	if root.Calls[0].Type != "0XF6" || root.Calls[0].Calls[0].Type != "CALL" || root.Calls[1].Type != "STATICCALL" {
+		t.Fatalf("geth frame types mismatch: %s, %s, %s", root.Calls[0].Type, root.Calls[0].Calls[0].Type, root.Calls[1].Type)
+	}
+}
+
+func TestRegisterCallOpcode(t *testing.T) {
+	if callType, name := lookupCallOpcode(vm.OpCode(0xf8)); callType != CallTypeUnknown || name != "0xf8" {
+		t.Fatalf("unregistered opcode mismatch: have %d/%s", callType, name)
+	}
+	if callType, name := lookupCallOpcode(vm.SLOAD); callType != CallTypeUnknown || name != "sload" {
+		t.Fatalf("non-call opcode mismatch: have %d/%s", callType, name)
+	}
+	RegisterCallOpcode(vm.OpCode(0xf9), CallTypeDelegateCall, "")
+	if callType, name := lookupCallOpcode(vm.OpCode(0xf9)); callType != CallTypeDelegateCall || name != "0xf9" {
+		t.Fatalf("registered opcode mismatch: have %d/%s", callType, name)
+	}
+
+	for _, test := range []struct {
+		op       vm.OpCode
+		callType uint8
+	}{
+		{vm.CALL, CallTypeCall},
+		{vm.SELFDESTRUCT, CallTypeCall},
+		{vm.OpCode(0xfb), CallTypeCreate},
+		{vm.OpCode(0xfb), CallTypeSuicide},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("registering opcode %v as call type %d didn't panic", test.op, test.callType)
+				}
+			}()
+			RegisterCallOpcode(test.op, test.callType, "")
+		}()
+	}
+}
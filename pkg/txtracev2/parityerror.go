@@ -0,0 +1,83 @@
+package txtracev2
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// parityErrors maps the evm errors to the error strings of OpenEthereum's traces. OpenEthereum consumes all the
+// gas of a frame failing to deploy its code or overflowing its gas computation, such frames are out of gas.
+var parityErrors = []struct {
+	err    error
+	parity string
+}{
+	{vm.ErrOutOfGas, "Out of gas"},
+	{vm.ErrCodeStoreOutOfGas, "Out of gas"},
+	{vm.ErrGasUintOverflow, "Out of gas"},
+	{vm.ErrMaxCodeSizeExceeded, "Out of gas"},
+	{vm.ErrContractAddressCollision, "Out of gas"},
+	{vm.ErrExecutionReverted, "Reverted"},
+	{vm.ErrInvalidJump, "Bad jump destination"},
+	{vm.ErrWriteProtection, "Mutable Call In Static Context"},
+	{vm.ErrReturnDataOutOfBounds, "Out of bounds"},
+	// the txs failing before the evm ran, see OeTracer.RecordPreExecutionFailure
+	{core.ErrInsufficientFunds, "Insufficient balance for transaction"},
+	{core.ErrInsufficientFundsForTransfer, "Insufficient balance for transaction"},
+	{core.ErrNonceTooLow, "Invalid transaction nonce"},
+	{core.ErrNonceTooHigh, "Invalid transaction nonce"},
+	{core.ErrIntrinsicGas, "Not enough base gas"},
+}
+
+// ParityErrorString returns the error string OpenEthereum emits for the evm error err, "" for nil. It covers
+// the frames failing in the evm and the txs failing before the evm ran.
+//
+// The errors without an OpenEthereum counterpart keep their own string. OpenEthereum opens no frame for the
+// calls beyond the depth limit or lacking the balance to transfer, vm.ErrDepth and vm.ErrInsufficientBalance.
+// It never implemented the rules of later forks either, e.g. vm.ErrMaxInitCodeSizeExceeded.
+func ParityErrorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	for _, mapping := range parityErrors {
+		if errors.Is(err, mapping.err) {
+			return mapping.parity
+		}
+	}
+	var (
+		underflow *vm.ErrStackUnderflow
+		overflow  *vm.ErrStackOverflow
+		invalid   *vm.ErrInvalidOpCode
+	)
+	switch {
+	case errors.As(err, &underflow):
+		return "Stack underflow"
+	case errors.As(err, &overflow):
+		return "Out of stack"
+	case errors.As(err, &invalid):
+		return "Bad instruction"
+	}
+	return err.Error()
+}
+
+// parityErrorOf returns the OpenEthereum error string of a frame error recorded with the string of its evm
+// error, which the traces are rendered with. The strings of no evm error are returned as is, e.g. the ones of
+// the txs failing before the evm ran, which are recorded with their OpenEthereum string already.
+func parityErrorOf(msg string) string {
+	for _, mapping := range parityErrors {
+		if msg == mapping.err.Error() {
+			return mapping.parity
+		}
+	}
+	switch {
+	case strings.HasPrefix(msg, "stack underflow ("):
+		return "Stack underflow"
+	case strings.HasPrefix(msg, "stack limit reached "):
+		return "Out of stack"
+	case strings.HasPrefix(msg, "invalid opcode: "):
+		return "Bad instruction"
+	}
+	return msg
+}
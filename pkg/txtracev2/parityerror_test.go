@@ -0,0 +1,85 @@
+package txtracev2
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+func TestParityErrorString(t *testing.T) {
+	for _, test := range []struct {
+		err     error
+		want    string
+		failure string
+	}{
+		{nil, "", FailureNone},
+		{vm.ErrOutOfGas, "Out of gas", FailureOutOfGas},
+		{vm.ErrCodeStoreOutOfGas, "Out of gas", FailureOutOfGas},
+		{vm.ErrGasUintOverflow, "Out of gas", FailureOutOfGas},
+		{vm.ErrMaxCodeSizeExceeded, "Out of gas", FailureOutOfGas},
+		{vm.ErrContractAddressCollision, "Out of gas", FailureOutOfGas},
+		{vm.ErrExecutionReverted, "Reverted", FailureRevert},
+		{vm.ErrInvalidJump, "Bad jump destination", FailureInvalid},
+		{vm.ErrWriteProtection, "Mutable Call In Static Context", FailureInvalid},
+		{vm.ErrReturnDataOutOfBounds, "Out of bounds", FailureInvalid},
+		{&vm.ErrStackUnderflow{}, "Stack underflow", FailureInvalid},
+		{&vm.ErrStackOverflow{}, "Out of stack", FailureInvalid},
+		{&vm.ErrInvalidOpCode{}, "Bad instruction", FailureInvalid},
+		{fmt.Errorf("call frame: %w", vm.ErrOutOfGas), "Out of gas", FailureOutOfGas},
+		{fmt.Errorf("call frame: %w", &vm.ErrStackUnderflow{}), "Stack underflow", FailureInvalid},
+		// txs failing before the evm ran
+		{fmt.Errorf("%w: address 0x1", core.ErrInsufficientFunds), "Insufficient balance for transaction", FailureInvalid},
+		{core.ErrInsufficientFundsForTransfer, "Insufficient balance for transaction", FailureInvalid},
+		{fmt.Errorf("%w: address 0x1, tx: 0 state: 1", core.ErrNonceTooLow), "Invalid transaction nonce", FailureInvalid},
+		{core.ErrNonceTooHigh, "Invalid transaction nonce", FailureInvalid},
+		{core.ErrIntrinsicGas, "Not enough base gas", FailureInvalid},
+		// no OpenEthereum counterpart
+		{vm.ErrDepth, vm.ErrDepth.Error(), FailureInvalid},
+		{vm.ErrInsufficientBalance, vm.ErrInsufficientBalance.Error(), FailureInvalid},
+		{vm.ErrMaxInitCodeSizeExceeded, vm.ErrMaxInitCodeSizeExceeded.Error(), FailureInvalid},
+		{vm.ErrInvalidCode, vm.ErrInvalidCode.Error(), FailureInvalid},
+		{vm.ErrNonceUintOverflow, vm.ErrNonceUintOverflow.Error(), FailureInvalid},
+		{errors.New("precompile failed"), "precompile failed", FailureInvalid},
+	} {
+		have := ParityErrorString(test.err)
+		if have != test.want {
+			t.Fatalf("%v: have %q, want %q", test.err, have, test.want)
+		}
+		trace := ActionTrace{TraceType: "call", Error: have}
+		if test.err == nil {
+			trace.Result = &ActionResult{}
+		}
+		if kind := trace.FailureKind(); kind != test.failure {
+			t.Fatalf("%v: failure kind %q, want %q", test.err, kind, test.failure)
+		}
+	}
+}
+
+func TestParityErrorOf(t *testing.T) {
+	for _, test := range []struct {
+		msg  string
+		want string
+	}{
+		{vm.ErrOutOfGas.Error(), "Out of gas"},
+		{vm.ErrCodeStoreOutOfGas.Error(), "Out of gas"},
+		{vm.ErrExecutionReverted.Error(), "Reverted"},
+		{vm.ErrInvalidJump.Error(), "Bad jump destination"},
+		{(&vm.ErrStackUnderflow{}).Error(), "Stack underflow"},
+		{(&vm.ErrStackOverflow{}).Error(), "Out of stack"},
+		{(&vm.ErrInvalidOpCode{}).Error(), "Bad instruction"},
+		// already OpenEthereum's, e.g. the txs failing before the evm ran
+		{"Reverted", "Reverted"},
+		{"Invalid transaction nonce", "Invalid transaction nonce"},
+		// no OpenEthereum counterpart
+		{vm.ErrDepth.Error(), vm.ErrDepth.Error()},
+		{incompleteTraceError, incompleteTraceError},
+		{"precompile failed", "precompile failed"},
+	} {
+		if have := parityErrorOf(test.msg); have != test.want {
+			t.Fatalf("%q: have %q, want %q", test.msg, have, test.want)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package txtracev2
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// IntrinsicFailureTrace builds the single error trace of a tx which failed the checks before the evm ran it,
+// e.g. core.ErrIntrinsicGas or core.ErrInsufficientFunds, so neither tracer recorded anything. err is the
+// error the check failed with, signer recovers the sender of the tx. The action carries no gas, none was
+// given to the execution.
+func IntrinsicFailureTrace(tx *types.Transaction, signer types.Signer, blockHash common.Hash, blockNumber *big.Int, index uint64, err error) (ActionTraceList, error) {
+	if err == nil {
+		return nil, errors.New("intrinsic failure trace without error")
+	}
+	from, senderErr := types.Sender(signer, tx)
+	if senderErr != nil {
+		return nil, fmt.Errorf("failed to recover sender of tx %s: %w", tx.Hash().Hex(), senderErr)
+	}
+	if blockNumber == nil {
+		blockNumber = new(big.Int)
+	}
+	list := &InternalActionTraceList{
+		Traces: []*InternalActionTrace{{
+			Action:       preExecutionAction(from, tx.To(), tx.Value(), tx.Data()),
+			Error:        err.Error(),
+			TraceAddress: []uint32{},
+		}},
+		BlockHash:           blockHash,
+		BlockNumber:         blockNumber,
+		TransactionHash:     tx.Hash(),
+		TransactionPosition: index,
+	}
+	if err := list.Validate(); err != nil {
+		return nil, err
+	}
+	traces := append(ActionTraceList{}, list.ToTraces()...)
+	traces.normalize()
+	return traces, nil
+}
+
+// preExecutionAction returns the action of the top-level frame of a tx the evm didn't run, without gas
+func preExecutionAction(from common.Address, to *common.Address, value *big.Int, data []byte) InternalAction {
+	if to == nil {
+		return InternalAction{CallType: CallTypeCreate, From: &from, Value: value, Init: data, CreateMethod: CreateMethodCreate}
+	}
+	return InternalAction{CallType: CallTypeCall, From: &from, To: to, Value: value, Input: data}
+}
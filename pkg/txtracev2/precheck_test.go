@@ -0,0 +1,88 @@
+package txtracev2
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/tests"
+)
+
+func TestIntrinsicFailureTrace(t *testing.T) {
+	var (
+		sender = crypto.PubkeyToAddress(transferKey.PublicKey)
+		to     = common.Address{0x60, 0x01}
+	)
+	alloc := types.GenesisAlloc{sender: {Balance: big.NewInt(1_000_000)}}
+	state := tests.MakePreState(rawdb.NewMemoryDatabase(), alloc, false, rawdb.HashScheme)
+	defer state.Close()
+
+	for i, test := range []struct {
+		tx   types.TxData
+		want error
+	}{
+		{&types.LegacyTx{To: &to, Value: big.NewInt(7), Gas: 20_000}, core.ErrIntrinsicGas},
+		{&types.LegacyTx{To: &to, Gas: 21_000, Data: []byte{0x1}}, core.ErrIntrinsicGas},
+		{&types.LegacyTx{Gas: 50_000, Data: []byte{0x1}}, core.ErrIntrinsicGas},
+		{&types.LegacyTx{To: &to, Value: big.NewInt(2_000_000), Gas: 21_000}, core.ErrInsufficientFunds},
+		{&types.LegacyTx{To: &to, Gas: 21_000, GasPrice: big.NewInt(100)}, core.ErrInsufficientFunds},
+	} {
+		tx := types.MustSignNewTx(transferKey, transferSigner, test.tx)
+		msg, err := core.TransactionToMessage(tx, transferSigner, big.NewInt(0))
+		if err != nil {
+			t.Fatalf("tx %d: failed to prepare tx: %v", i, err)
+		}
+		tracer := NewOeTracer(nil, transferBlock, big.NewInt(1), tx.Hash(), uint64(i))
+		blkContext := vm.BlockContext{
+			CanTransfer: core.CanTransfer,
+			Transfer:    core.Transfer,
+			GasLimit:    30_000_000,
+			BlockNumber: big.NewInt(1),
+			Difficulty:  big.NewInt(1),
+			BaseFee:     big.NewInt(0),
+		}
+		evm := vm.NewEVM(blkContext, core.NewEVMTxContext(msg), state.StateDB.Copy(), params.AllEthashProtocolChanges, vm.Config{Tracer: tracer})
+		_, err = core.ApplyMessage(evm, msg, new(core.GasPool).AddGas(tx.Gas()))
+		if !errors.Is(err, test.want) {
+			t.Fatalf("tx %d: precheck error mismatch: have %v, want %v", i, err, test.want)
+		}
+		// the evm never ran the tx
+		if _, traceErr := tracer.GetTraces(); !errors.Is(traceErr, ErrTraceIncomplete) {
+			t.Fatalf("tx %d: traces recorded for a tx failing the precheck: %v", i, traceErr)
+		}
+
+		traces, err := IntrinsicFailureTrace(tx, transferSigner, transferBlock, big.NewInt(1), uint64(i), err)
+		if err != nil {
+			t.Fatalf("tx %d: failed to build the trace: %v", i, err)
+		}
+		if len(traces) != 1 {
+			t.Fatalf("tx %d: trace count mismatch: have %d, want 1", i, len(traces))
+		}
+		trace := traces[0]
+		if trace.Error == "" || trace.Result != nil || *trace.Action.From != sender || trace.Action.Value.ToInt().Cmp(tx.Value()) != 0 {
+			t.Fatalf("tx %d: trace mismatch: %+v", i, trace)
+		}
+		if trace.TransactionHash != tx.Hash() || trace.TransactionPosition != uint64(i) || trace.BlockHash != transferBlock || trace.BlockNumber.Uint64() != 1 {
+			t.Fatalf("tx %d: tx fields mismatch: %+v", i, trace)
+		}
+		if tx.To() == nil {
+			if trace.TraceType != "create" || trace.Action.Init == nil || len(*trace.Action.Init) != 1 {
+				t.Fatalf("tx %d: create trace mismatch: %+v", i, trace)
+			}
+		} else if trace.TraceType != "call" || *trace.Action.To != to || *trace.Action.CallType != Call || len(*trace.Action.Input) != len(tx.Data()) {
+			t.Fatalf("tx %d: call trace mismatch: %+v", i, trace)
+		}
+	}
+
+	tx := types.MustSignNewTx(transferKey, transferSigner, &types.LegacyTx{To: &to, Gas: 20_000})
+	if _, err := IntrinsicFailureTrace(tx, transferSigner, transferBlock, big.NewInt(1), 0, nil); err == nil {
+		t.Fatalf("trace built without an error")
+	}
+}
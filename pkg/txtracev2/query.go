@@ -0,0 +1,143 @@
+package txtracev2
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ErrTraceNotFound is returned when no trace matches the requested trace address.
+var ErrTraceNotFound = errors.New("trace not found")
+
+// GetTraceByAddress returns the trace whose traceAddress equals path, like parity's trace_get.
+func GetTraceByAddress(traces []RpcActionTrace, path []uint32) (*RpcActionTrace, error) {
+	for i := range traces {
+		if traceAddressEqual(traces[i].TraceAddress, path) {
+			return &traces[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%w at trace address %v", ErrTraceNotFound, path)
+}
+
+// traceAddressEqual reports whether a and b point to the same trace, nil equals empty
+func traceAddressEqual(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// FramePredicate selects the frames of a tx's traces, see FilterTraceFrames. The predicates built by this
+// package don't allocate when evaluated.
+type FramePredicate func(trace *RpcActionTrace) bool
+
+// FilterTraceFrames returns the traces matching pred, in order.
+func FilterTraceFrames(traces []RpcActionTrace, pred FramePredicate) []RpcActionTrace {
+	var matched []RpcActionTrace
+	for i := range traces {
+		if pred(&traces[i]) {
+			matched = append(matched, traces[i])
+		}
+	}
+	return matched
+}
+
+// SubtreeOf returns the trace at traceAddress and all its descendants, in order.
+func SubtreeOf(traces []RpcActionTrace, traceAddress []uint32) []RpcActionTrace {
+	return FilterTraceFrames(traces, func(trace *RpcActionTrace) bool {
+		return len(trace.TraceAddress) >= len(traceAddress) && traceAddressEqual(trace.TraceAddress[:len(traceAddress)], traceAddress)
+	})
+}
+
+// ByTo matches the call frames to addr.
+func ByTo(addr common.Address) FramePredicate {
+	return func(trace *RpcActionTrace) bool {
+		return trace.Action.To != nil && *trace.Action.To == addr
+	}
+}
+
+// ByFrom matches the call and create frames from addr.
+func ByFrom(addr common.Address) FramePredicate {
+	return func(trace *RpcActionTrace) bool {
+		return trace.Action.From != nil && *trace.Action.From == addr
+	}
+}
+
+// BySelector matches the call frames whose input starts with the function selector.
+func BySelector(selector [4]byte) FramePredicate {
+	return func(trace *RpcActionTrace) bool {
+		return trace.Action.Input != nil && len(*trace.Action.Input) >= 4 && bytes.Equal((*trace.Action.Input)[:4], selector[:])
+	}
+}
+
+// ByCallType matches the call frames of callType, e.g. "delegatecall". The frames without a call type match
+// their trace type, i.e. "create" or "suicide".
+func ByCallType(callType string) FramePredicate {
+	return func(trace *RpcActionTrace) bool {
+		if trace.Action.CallType != nil {
+			return *trace.Action.CallType == callType
+		}
+		return trace.TraceType == callType
+	}
+}
+
+// HasError matches the failed frames.
+func HasError() FramePredicate {
+	return func(trace *RpcActionTrace) bool {
+		return trace.Error != ""
+	}
+}
+
+// MinValue matches the call and create frames transferring at least min wei.
+func MinValue(min *big.Int) FramePredicate {
+	min = new(big.Int).Set(min)
+	return func(trace *RpcActionTrace) bool {
+		return trace.Action.Value != nil && trace.Action.Value.ToInt().Cmp(min) >= 0
+	}
+}
+
+// Depth matches the frames n calls below the top-level one, whose depth is 0.
+func Depth(n int) FramePredicate {
+	return func(trace *RpcActionTrace) bool {
+		return len(trace.TraceAddress) == n
+	}
+}
+
+// And matches the frames matching all preds.
+func And(preds ...FramePredicate) FramePredicate {
+	return func(trace *RpcActionTrace) bool {
+		for _, pred := range preds {
+			if !pred(trace) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Or matches the frames matching any of preds.
+func Or(preds ...FramePredicate) FramePredicate {
+	return func(trace *RpcActionTrace) bool {
+		for _, pred := range preds {
+			if pred(trace) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Not matches the frames not matching pred.
+func Not(pred FramePredicate) FramePredicate {
+	return func(trace *RpcActionTrace) bool {
+		return !pred(trace)
+	}
+}
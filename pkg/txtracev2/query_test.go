@@ -0,0 +1,142 @@
+package txtracev2
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+func TestGetTraceByAddress(t *testing.T) {
+	traces := []RpcActionTrace{
+		{TraceAddress: []uint32{}, Subtraces: 2},
+		{TraceAddress: []uint32{0}, Subtraces: 1},
+		{TraceAddress: []uint32{0, 0}},
+		{TraceAddress: []uint32{1}},
+	}
+	for i, trace := range traces {
+		found, err := GetTraceByAddress(traces, trace.TraceAddress)
+		if err != nil {
+			t.Fatalf("failed to get trace %v: %v", trace.TraceAddress, err)
+		}
+		if found != &traces[i] {
+			t.Fatalf("wrong trace for address %v: have %v", trace.TraceAddress, found.TraceAddress)
+		}
+	}
+	if found, err := GetTraceByAddress(traces, nil); err != nil || found != &traces[0] {
+		t.Fatalf("nil path should locate the top-level trace, have %v, %v", found, err)
+	}
+	for _, path := range [][]uint32{{2}, {0, 1}, {1, 0}} {
+		if _, err := GetTraceByAddress(traces, path); !errors.Is(err, ErrTraceNotFound) {
+			t.Fatalf("expected not found for %v, have %v", path, err)
+		}
+	}
+}
+
+// nestedTraces is a tx calling a proxy, which delegates to an implementation calling a token that
+// reverts, then creates a contract which selfdestructs
+func nestedTraces() []RpcActionTrace {
+	var (
+		user, proxy, impl, token, created = common.Address{0x1}, common.Address{0x2}, common.Address{0x3}, common.Address{0x4}, common.Address{0x5}
+		transfer, approve                 = hexutil.Bytes{0xa9, 0x05, 0x9c, 0xbb, 0x1}, hexutil.Bytes{0x09, 0x5e, 0xa7, 0xb3}
+	)
+	call := func(callType string, from, to common.Address, input hexutil.Bytes, value int64) Action {
+		return Action{CallType: &callType, From: &from, To: &to, Input: &input, Value: (*hexutil.Big)(big.NewInt(value))}
+	}
+	return []RpcActionTrace{
+		{TraceType: "call", TraceAddress: []uint32{}, Subtraces: 2, Action: call(Call, user, proxy, approve, 0)},
+		{TraceType: "call", TraceAddress: []uint32{0}, Subtraces: 1, Action: call(DelegateCall, proxy, impl, approve, 0)},
+		{TraceType: "call", TraceAddress: []uint32{0, 0}, Error: "Reverted", Action: call(Call, proxy, token, transfer, 5)},
+		{TraceType: "create", TraceAddress: []uint32{1}, Subtraces: 1, Action: Action{From: &proxy, Value: (*hexutil.Big)(big.NewInt(10))}},
+		{TraceType: "suicide", TraceAddress: []uint32{1, 0}, Action: Action{Address: &created, RefundAddress: &user}},
+	}
+}
+
+func TestFilterTraceFrames(t *testing.T) {
+	traces := nestedTraces()
+	tests := []struct {
+		name string
+		pred FramePredicate
+		want string // trace addresses of the matched traces
+	}{
+		{"to", ByTo(common.Address{0x4}), "[[0 0]]"},
+		{"to created", ByTo(common.Address{0x5}), "[]"},
+		{"from", ByFrom(common.Address{0x2}), "[[0] [0 0] [1]]"},
+		{"selector", BySelector([4]byte{0x09, 0x5e, 0xa7, 0xb3}), "[[] [0]]"},
+		{"short input", BySelector([4]byte{0xa9, 0x05, 0x9c, 0xbb}), "[[0 0]]"},
+		{"call type", ByCallType(DelegateCall), "[[0]]"},
+		{"trace type", ByCallType("suicide"), "[[1 0]]"},
+		{"error", HasError(), "[[0 0]]"},
+		{"min value", MinValue(big.NewInt(5)), "[[0 0] [1]]"},
+		{"zero min value", MinValue(new(big.Int)), "[[] [0] [0 0] [1]]"},
+		{"depth", Depth(1), "[[0] [1]]"},
+		{"top level", Depth(0), "[[]]"},
+		{"and", And(ByFrom(common.Address{0x2}), Depth(1)), "[[0] [1]]"},
+		{"or", Or(ByTo(common.Address{0x2}), HasError()), "[[] [0 0]]"},
+		{"not", Not(Depth(1)), "[[] [0 0] [1 0]]"},
+		{"empty and", And(), "[[] [0] [0 0] [1] [1 0]]"},
+		{"empty or", Or(), "[]"},
+		// the reverted transfer made through the proxy
+		{"composed", And(BySelector([4]byte{0xa9, 0x05, 0x9c, 0xbb}), Or(ByFrom(common.Address{0x2}), ByFrom(common.Address{0x3})), Not(ByCallType(StaticCall)), HasError()), "[[0 0]]"},
+	}
+	for _, test := range tests {
+		var have []string
+		for _, trace := range FilterTraceFrames(traces, test.pred) {
+			have = append(have, fmt.Sprint(trace.TraceAddress))
+		}
+		if fmt.Sprint(have) != test.want {
+			t.Errorf("%s: matched traces mismatch: have %v, want %s", test.name, have, test.want)
+		}
+	}
+}
+
+func TestSubtreeOf(t *testing.T) {
+	traces := nestedTraces()
+	tests := []struct {
+		traceAddress []uint32
+		want         string
+	}{
+		{nil, "[[] [0] [0 0] [1] [1 0]]"},
+		{[]uint32{0}, "[[0] [0 0]]"},
+		{[]uint32{1, 0}, "[[1 0]]"},
+		{[]uint32{2}, "[]"},
+	}
+	for _, test := range tests {
+		var have []string
+		for _, trace := range SubtreeOf(traces, test.traceAddress) {
+			have = append(have, fmt.Sprint(trace.TraceAddress))
+		}
+		if fmt.Sprint(have) != test.want {
+			t.Errorf("subtree of %v mismatch: have %v, want %s", test.traceAddress, have, test.want)
+		}
+	}
+}
+
+func TestFramePredicateAllocs(t *testing.T) {
+	traces := nestedTraces()
+	pred := And(Or(BySelector([4]byte{0xa9, 0x05, 0x9c, 0xbb}), ByTo(common.Address{0x4})), Not(HasError()), MinValue(big.NewInt(1)), Depth(2), ByCallType(Call))
+	allocs := testing.AllocsPerRun(100, func() {
+		for i := range traces {
+			pred(&traces[i])
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("predicate evaluation allocates: %v allocs per run", allocs)
+	}
+}
+
+func BenchmarkFilterTraceFrames(b *testing.B) {
+	var traces []RpcActionTrace
+	for len(traces) < 5000 {
+		traces = append(traces, nestedTraces()...)
+	}
+	pred := And(BySelector([4]byte{0xa9, 0x05, 0x9c, 0xbb}), Or(ByFrom(common.Address{0x2}), ByFrom(common.Address{0x3})), Not(ByCallType(StaticCall)), HasError())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		FilterTraceFrames(traces, pred)
+	}
+}
@@ -0,0 +1,141 @@
+package txtracev2
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// ErrTraceTruncated is returned by ReadTxTraceBestEffort for blobs cut short, e.g. by a crash mid-write.
+var ErrTraceTruncated = errors.New("truncated tx trace")
+
+// ReadTxTraceBestEffort reads the traces of a tx like the strict readers, but salvages what it can of a corrupted
+// blob for forensics rather than failing outright: the traces decoded in full before the corruption are returned
+// along with an error wrapping ErrTraceTruncated if the blob was cut short, ErrMalformedTrace otherwise. The block
+// and tx fields follow the traces in the blob and are left zero unless they made it as well. Zstd blobs are
+// salvaged up to the last complete block of their frame, blocks hold up to 128KB, snappy ones can't be partially.
+func ReadTxTraceBestEffort(ctx context.Context, store Store, txHash common.Hash) (*InternalActionTraceList, error) {
+	raw, err := store.ReadTxTrace(ctx, txHash)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrTxTraceNotFound, txHash.Hex())
+	}
+	if isSimpleTransferMarker(raw) {
+		return nil, ErrSimpleTransferTrace
+	}
+	internalTraces := new(InternalActionTraceList)
+	if err := decodeInternalTraces(ctx, raw, internalTraces); err == nil {
+		return internalTraces, nil
+	} else if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
+	return salvageInternalTraces(raw)
+}
+
+// salvageInternalTraces decodes the leading traces of a persisted blob the strict decoding failed on, with the
+// error telling why it stopped
+func salvageInternalTraces(raw []byte) (*InternalActionTraceList, error) {
+	raw, truncated := salvageDecompressed(raw)
+	internalTraces := new(InternalActionTraceList)
+	err := decodeLeadingTraces(raw, internalTraces)
+	if truncated && (err == nil || errors.Is(err, ErrMalformedTrace)) {
+		err = fmt.Errorf("%w: compressed frame cut short", ErrTraceTruncated)
+	}
+	if err == nil {
+		// the strict decoding failed on what follows the traces, e.g. trailing bytes
+		err = fmt.Errorf("%w: trailing data after the traces", ErrMalformedTrace)
+	}
+	return internalTraces, err
+}
+
+// salvageDecompressed returns what can be decompressed of a persisted blob, and whether the decompression failed
+func salvageDecompressed(raw []byte) ([]byte, bool) {
+	if len(raw) == 0 || raw[0] >= 0xc0 {
+		return raw, false
+	}
+	switch CompressionCodec(raw[0]) {
+	case CompressionZstd:
+		r, err := newZstdReader(bytes.NewReader(raw[1:]))
+		if err != nil {
+			return nil, true
+		}
+		defer r.Close()
+		decompressed, err := io.ReadAll(io.LimitReader(r, maxDecompressedSize))
+		return decompressed, err != nil
+	default:
+		if decompressed, _, err := decompressTraces(raw); err == nil {
+			return decompressed, false
+		}
+		return nil, true
+	}
+}
+
+// decodeLeadingTraces decodes the rlp encoded traces one by one into internalTraces, then the fields following
+// them, until the first error
+func decodeLeadingTraces(raw []byte, internalTraces *InternalActionTraceList) error {
+	// a plain reader, a bytes.Reader limits the stream to its length and refuses the lists cut short up front
+	stream := rlp.NewStream(struct{ io.Reader }{bytes.NewReader(raw)}, 0)
+	stopped := func(err error) error {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("%w: %d traces recovered: %v", ErrTraceTruncated, len(internalTraces.Traces), err)
+		}
+		return fmt.Errorf("%w: %d traces recovered: %v", ErrMalformedTrace, len(internalTraces.Traces), err)
+	}
+	// the sizes of the lists bound the values read within, but not the input
+	if size, err := stream.List(); err != nil {
+		return stopped(err)
+	} else if size > maxDecompressedSize {
+		return fmt.Errorf("%w: traces of %d bytes", ErrMalformedTrace, size)
+	}
+	if _, err := stream.List(); err != nil {
+		return stopped(err)
+	}
+	for {
+		trace := new(InternalActionTrace)
+		if err := stream.Decode(trace); errors.Is(err, rlp.EOL) {
+			break
+		} else if err != nil {
+			return stopped(err)
+		}
+		if err := (&InternalActionTraceList{Traces: []*InternalActionTrace{trace}}).Validate(); err != nil {
+			return fmt.Errorf("%w: %d traces recovered: %w", ErrMalformedTrace, len(internalTraces.Traces), err)
+		}
+		internalTraces.Traces = append(internalTraces.Traces, trace)
+	}
+	if err := stream.ListEnd(); err != nil {
+		return stopped(err)
+	}
+	// the fields following the traces are decoded by the type itself, behind an empty list of traces
+	fields := []rlp.RawValue{rlp.EmptyList}
+	for {
+		field, err := stream.Raw()
+		if errors.Is(err, rlp.EOL) {
+			break
+		}
+		if err != nil {
+			return stopped(err)
+		}
+		fields = append(fields, field)
+	}
+	if err := stream.ListEnd(); err != nil {
+		return stopped(err)
+	}
+	blob, err := rlp.EncodeToBytes(fields)
+	if err != nil {
+		return stopped(err)
+	}
+	var trailer InternalActionTraceList
+	if err := rlp.DecodeBytes(blob, &trailer); err != nil {
+		return stopped(err)
+	}
+	trailer.Traces = internalTraces.Traces
+	*internalTraces = trailer
+	return nil
+}
@@ -0,0 +1,126 @@
+package txtracev2
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// checkTracePrefix checks the recovered traces are the leading ones of want
+func checkTracePrefix(t *testing.T, recovered, want *InternalActionTraceList) {
+	t.Helper()
+	if len(recovered.Traces) > len(want.Traces) {
+		t.Fatalf("%d traces recovered out of %d", len(recovered.Traces), len(want.Traces))
+	}
+	for i, trace := range recovered.Traces {
+		have, _ := rlp.EncodeToBytes(trace)
+		if expected, _ := rlp.EncodeToBytes(want.Traces[i]); !bytes.Equal(have, expected) {
+			t.Fatalf("recovered trace %d mismatch:\nhave %x\nwant %x", i, have, expected)
+		}
+	}
+}
+
+func TestReadTxTraceBestEffort(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		rnd    = rand.New(rand.NewSource(1))
+		store  = &MemoryStore{data: make(map[common.Hash][]byte)}
+		txHash = common.Hash{0x1}
+	)
+	for n := 0; n < 8; n++ {
+		want := randomTraces(rnd)
+		if n%2 == 1 {
+			want.GasBreakdown = &TxGasBreakdown{IntrinsicGas: 21000, ExecutionGas: rnd.Uint64() >> 32, EffectiveGasUsed: 21000}
+		}
+		raw, err := rlp.EncodeToBytes(want)
+		if err != nil {
+			t.Fatalf("traces %d: failed to encode: %v", n, err)
+		}
+		// intact blobs are read in full
+		store.data[txHash] = raw
+		traces, err := ReadTxTraceBestEffort(ctx, store, txHash)
+		if err != nil {
+			t.Fatalf("traces %d: failed to read intact blob: %v", n, err)
+		}
+		if rpcJSON(t, traces) != rpcJSON(t, want) {
+			t.Fatalf("traces %d: intact blob mismatch", n)
+		}
+
+		// every cut salvages the traces written before it, more the later the cut
+		var recovered int
+		for cut := 0; cut < len(raw); cut++ {
+			store.data[txHash] = raw[:cut]
+			if _, err := ReadRpcTxTrace(ctx, store, txHash); err == nil && cut > 0 {
+				t.Fatalf("traces %d: blob cut at %d of %d read strictly", n, cut, len(raw))
+			}
+			traces, err := ReadTxTraceBestEffort(ctx, store, txHash)
+			if cut == 0 {
+				if !errors.Is(err, ErrTxTraceNotFound) {
+					t.Fatalf("traces %d: expected ErrTxTraceNotFound for an empty blob, have %v", n, err)
+				}
+				continue
+			}
+			if !errors.Is(err, ErrTraceTruncated) {
+				t.Fatalf("traces %d: expected ErrTraceTruncated for the blob cut at %d of %d, have %v", n, cut, len(raw), err)
+			}
+			checkTracePrefix(t, traces, want)
+			if len(traces.Traces) < recovered {
+				t.Fatalf("traces %d: %d traces recovered at %d, %d before", n, len(traces.Traces), cut, recovered)
+			}
+			recovered = len(traces.Traces)
+			// the fields following the traces are recovered once complete
+			if traces.TransactionHash != (common.Hash{}) && (len(traces.Traces) != len(want.Traces) || traces.BlockHash != want.BlockHash || traces.BlockNumber.Cmp(want.BlockNumber) != 0) {
+				t.Fatalf("traces %d: fields recovered at %d mismatch: %+v", n, cut, traces)
+			}
+		}
+		if recovered != len(want.Traces) {
+			t.Fatalf("traces %d: at most %d of %d traces recovered", n, recovered, len(want.Traces))
+		}
+
+		// corruption other than truncation is malformed, the traces before it are still salvaged
+		store.data[txHash] = append(append([]byte{}, raw...), 0x80)
+		if traces, err = ReadTxTraceBestEffort(ctx, store, txHash); !errors.Is(err, ErrMalformedTrace) || len(traces.Traces) != len(want.Traces) {
+			t.Fatalf("traces %d: trailing data read as %d traces, %v", n, len(traces.Traces), err)
+		}
+		if !reflect.DeepEqual(traces.GasBreakdown, want.GasBreakdown) || traces.Timestamp != want.Timestamp || traces.TransactionPosition != want.TransactionPosition {
+			t.Fatalf("traces %d: fields before trailing data mismatch: %+v, want %+v", n, traces, want)
+		}
+	}
+
+	// truncated zstd frames are salvaged up to their last complete block, traces of a few blocks are needed
+	want := randomTraces(rnd)
+	for len(want.Traces) < 5000 {
+		want.Traces = append(want.Traces, randomTraces(rnd).Traces...)
+	}
+	raw, err := rlp.EncodeToBytes(want)
+	if err != nil {
+		t.Fatalf("failed to encode traces: %v", err)
+	}
+	compressed, err := compressTraces(raw, CompressionZstd, 0)
+	if err != nil {
+		t.Fatalf("failed to compress traces: %v", err)
+	}
+	store.data[txHash] = compressed[:len(compressed)*3/4]
+	traces, err := ReadTxTraceBestEffort(ctx, store, txHash)
+	if !errors.Is(err, ErrTraceTruncated) {
+		t.Fatalf("expected ErrTraceTruncated for a cut zstd frame, have %v", err)
+	}
+	checkTracePrefix(t, traces, want)
+	if len(traces.Traces) == 0 {
+		t.Fatalf("no trace recovered out of %d from a cut zstd frame", len(want.Traces))
+	}
+
+	store.data[txHash] = []byte{simpleTransferMarker}
+	if _, err := ReadTxTraceBestEffort(ctx, store, txHash); !errors.Is(err, ErrSimpleTransferTrace) {
+		t.Fatalf("expected ErrSimpleTransferTrace for the marker, have %v", err)
+	}
+	if _, err := ReadTxTraceBestEffort(ctx, store, common.Hash{0x2}); !errors.Is(err, ErrTxTraceNotFound) {
+		t.Fatalf("expected ErrTxTraceNotFound for a missing tx, have %v", err)
+	}
+}
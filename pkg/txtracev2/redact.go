@@ -0,0 +1,162 @@
+package txtracev2
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// RedactAction is how RedactTraces treats a byte field of the traces.
+type RedactAction string
+
+const (
+	RedactDrop     RedactAction = "drop"     // remove the field, also the behaviour of an unset action
+	RedactKeep     RedactAction = "keep"     // keep the original bytes
+	RedactHash     RedactAction = "hash"     // replace with the keccak256 of the original bytes
+	RedactSelector RedactAction = "selector" // keep the first 4 bytes only, inputs only
+)
+
+// RedactionPolicy configures RedactTraces per field, the structure of the traces, addresses, values
+// and gas are always kept.
+type RedactionPolicy struct {
+	Input  RedactAction `json:"input"`  // calldata of calls
+	Output RedactAction `json:"output"` // return data of calls
+	Init   RedactAction `json:"init"`   // init code of creates
+	Code   RedactAction `json:"code"`   // deployed code in the results of creates
+}
+
+// PolicyFromJSON loads a RedactionPolicy, unknown fields and actions are rejected.
+func PolicyFromJSON(data []byte) (RedactionPolicy, error) {
+	var policy RedactionPolicy
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields() // a typo must not silently turn into the drop default
+	if err := dec.Decode(&policy); err != nil {
+		return RedactionPolicy{}, fmt.Errorf("failed to decode redaction policy: %v", err)
+	}
+	if err := policy.validate(); err != nil {
+		return RedactionPolicy{}, err
+	}
+	return policy, nil
+}
+
+// validate checks every action is known and selectors are only applied to inputs
+func (p RedactionPolicy) validate() error {
+	for field, action := range map[string]RedactAction{"input": p.Input, "output": p.Output, "init": p.Init, "code": p.Code} {
+		switch action {
+		case "", RedactDrop, RedactKeep, RedactHash:
+		case RedactSelector:
+			if field != "input" {
+				return fmt.Errorf("redaction action %q is only supported for input, not %s", action, field)
+			}
+		default:
+			return fmt.Errorf("unknown redaction action %q for %s", action, field)
+		}
+	}
+	return nil
+}
+
+// RedactTraces returns a deep copy of traces with the byte fields redacted by policy, traces are left
+// untouched. An invalid policy drops every byte field.
+func RedactTraces(traces []RpcActionTrace, policy RedactionPolicy) []RpcActionTrace {
+	if err := policy.validate(); err != nil {
+		policy = RedactionPolicy{}
+	}
+	redacted := make([]RpcActionTrace, len(traces))
+	for i := range traces {
+		trace := copyTrace(&traces[i])
+		trace.Action.Input = redactBytes(trace.Action.Input, policy.Input)
+		trace.Action.Init = redactBytes(trace.Action.Init, policy.Init)
+		if trace.Result != nil {
+			trace.Result.Output = redactBytes(trace.Result.Output, policy.Output)
+			trace.Result.Code = redactBytes(trace.Result.Code, policy.Code)
+		}
+		redacted[i] = trace
+	}
+	return redacted
+}
+
+// redactBytes applies action to data, which must be owned by the caller
+func redactBytes(data *hexutil.Bytes, action RedactAction) *hexutil.Bytes {
+	if data == nil {
+		return nil
+	}
+	switch action {
+	case RedactKeep:
+		return data
+	case RedactHash:
+		hash := hexutil.Bytes(crypto.Keccak256(*data))
+		return &hash
+	case RedactSelector:
+		if len(*data) > 4 {
+			selector := (*data)[:4:4]
+			return &selector
+		}
+		return data
+	default:
+		return nil
+	}
+}
+
+// copyTrace deep copies trace so the copy shares no memory with it
+func copyTrace(trace *RpcActionTrace) RpcActionTrace {
+	cpy := *trace
+	cpy.BlockNumber = copyBig(trace.BlockNumber)
+	cpy.TraceAddress = append(make([]uint32, 0, len(trace.TraceAddress)), trace.TraceAddress...)
+	cpy.StorageAddress = copyAddress(trace.StorageAddress)
+	if trace.ErrorDetail != nil {
+		detail := *trace.ErrorDetail
+		cpy.ErrorDetail = &detail
+	}
+
+	action := &cpy.Action
+	if trace.Action.CallType != nil {
+		callType := *trace.Action.CallType
+		action.CallType = &callType
+	}
+	action.From = copyAddress(trace.Action.From)
+	action.To = copyAddress(trace.Action.To)
+	action.Address = copyAddress(trace.Action.Address)
+	action.RefundAddress = copyAddress(trace.Action.RefundAddress)
+	action.Value = (*hexutil.Big)(copyBig((*big.Int)(trace.Action.Value)))
+	action.Balance = (*hexutil.Big)(copyBig((*big.Int)(trace.Action.Balance)))
+	action.Init = copyBytes(trace.Action.Init)
+	action.Input = copyBytes(trace.Action.Input)
+
+	if trace.Result != nil {
+		result := *trace.Result
+		result.Output = copyBytes(trace.Result.Output)
+		result.Code = copyBytes(trace.Result.Code)
+		result.Address = copyAddress(trace.Result.Address)
+		cpy.Result = &result
+	}
+	return cpy
+}
+
+func copyAddress(addr *common.Address) *common.Address {
+	if addr == nil {
+		return nil
+	}
+	cpy := *addr
+	return &cpy
+}
+
+func copyBig(n *big.Int) *big.Int {
+	if n == nil {
+		return nil
+	}
+	return new(big.Int).Set(n)
+}
+
+func copyBytes(data *hexutil.Bytes) *hexutil.Bytes {
+	if data == nil {
+		return nil
+	}
+	cpy := make(hexutil.Bytes, len(*data))
+	copy(cpy, *data)
+	return &cpy
+}
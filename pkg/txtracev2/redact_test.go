@@ -0,0 +1,133 @@
+package txtracev2
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// redactFixture returns a create followed by two calls forwarding the same calldata
+func redactFixture() []RpcActionTrace {
+	bytesOf := func(b []byte) *hexutil.Bytes {
+		cpy := hexutil.Bytes(common.CopyBytes(b))
+		return &cpy
+	}
+	var (
+		callType = "call"
+		from     = common.Address{0x1}
+		to       = common.Address{0x2}
+		created  = common.Address{0x3}
+		input    = append([]byte{0xa9, 0x05, 0x9c, 0xbb}, bytes.Repeat([]byte{0x5e, 0xc2}, 32)...)
+		output   = bytes.Repeat([]byte{0x0b, 0xad}, 16)
+		init     = bytes.Repeat([]byte{0x1c, 0x0d}, 20)
+		code     = bytes.Repeat([]byte{0xc0, 0xde}, 12)
+	)
+	return []RpcActionTrace{
+		{
+			Action:       Action{From: &from, Value: (*hexutil.Big)(big.NewInt(1)), Gas: 100, Init: bytesOf(init)},
+			Result:       &ActionResult{GasUsed: 50, Code: bytesOf(code), Address: &created},
+			BlockNumber:  big.NewInt(1),
+			Subtraces:    2,
+			TraceAddress: []uint32{},
+			TraceType:    "create",
+		},
+		{
+			Action:       Action{CallType: &callType, From: &created, To: &to, Value: (*hexutil.Big)(big.NewInt(0)), Gas: 40, Input: bytesOf(input)},
+			Result:       &ActionResult{GasUsed: 20, Output: bytesOf(output)},
+			BlockNumber:  big.NewInt(1),
+			TraceAddress: []uint32{0},
+			TraceType:    "call",
+		},
+		{
+			Action:       Action{CallType: &callType, From: &created, To: &to, Value: (*hexutil.Big)(big.NewInt(0)), Gas: 10, Input: bytesOf(input)},
+			Error:        "execution reverted",
+			BlockNumber:  big.NewInt(1),
+			TraceAddress: []uint32{1},
+			TraceType:    "call",
+		},
+	}
+}
+
+func TestRedactTraces(t *testing.T) {
+	original := redactFixture()
+	secrets := []string{"5ec25ec25ec2", "0bad0bad0bad", "1c0d1c0d1c0d", "c0dec0dec0de"}
+
+	for _, policy := range []RedactionPolicy{
+		{},
+		{Input: RedactHash, Output: RedactHash, Init: RedactHash, Code: RedactHash},
+		{Input: RedactSelector, Output: RedactDrop, Init: RedactHash, Code: RedactDrop},
+	} {
+		redacted := RedactTraces(original, policy)
+		blob, err := json.Marshal(redacted)
+		if err != nil {
+			t.Fatalf("failed to encode redacted traces: %v", err)
+		}
+		for _, secret := range secrets {
+			if strings.Contains(string(blob), secret) {
+				t.Fatalf("policy %+v: original bytes %s survived redaction", policy, secret)
+			}
+		}
+		for i := range redacted {
+			if !reflect.DeepEqual(redacted[i].TraceAddress, original[i].TraceAddress) || redacted[i].Subtraces != original[i].Subtraces {
+				t.Fatalf("policy %+v: trace %d structure changed", policy, i)
+			}
+			if *redacted[i].Action.From != *original[i].Action.From || redacted[i].Action.Gas != original[i].Action.Gas {
+				t.Fatalf("policy %+v: trace %d action changed", policy, i)
+			}
+		}
+	}
+	if !reflect.DeepEqual(original, redactFixture()) {
+		t.Fatalf("redaction modified the original traces")
+	}
+
+	// hashes are deterministic and equal inputs stay visibly equal
+	policy := RedactionPolicy{Input: RedactHash, Output: RedactKeep, Init: RedactDrop, Code: RedactKeep}
+	first, second := RedactTraces(original, policy), RedactTraces(original, policy)
+	if want := crypto.Keccak256(*original[1].Action.Input); !bytes.Equal(*first[1].Action.Input, want) {
+		t.Fatalf("input hash mismatch: have %x, want %x", *first[1].Action.Input, want)
+	}
+	if !reflect.DeepEqual(first, second) || !bytes.Equal(*first[1].Action.Input, *first[2].Action.Input) {
+		t.Fatalf("input hashes are not deterministic")
+	}
+	if first[0].Action.Init != nil || !bytes.Equal(*first[0].Result.Code, *original[0].Result.Code) {
+		t.Fatalf("init and code not redacted by policy")
+	}
+
+	// the kept bytes are copies
+	(*first[1].Result.Output)[0] = 0xff
+	if (*original[1].Result.Output)[0] == 0xff {
+		t.Fatalf("mutating redacted output leaked into the original traces")
+	}
+
+	selected := RedactTraces(original, RedactionPolicy{Input: RedactSelector})
+	if have := *selected[1].Action.Input; !bytes.Equal(have, []byte{0xa9, 0x05, 0x9c, 0xbb}) {
+		t.Fatalf("selector mismatch: have %x", have)
+	}
+}
+
+func TestPolicyFromJSON(t *testing.T) {
+	policy, err := PolicyFromJSON([]byte(`{"input":"selector","output":"hash","init":"keep"}`))
+	if err != nil {
+		t.Fatalf("failed to load policy: %v", err)
+	}
+	if want := (RedactionPolicy{Input: RedactSelector, Output: RedactHash, Init: RedactKeep}); policy != want {
+		t.Fatalf("policy mismatch: have %+v, want %+v", policy, want)
+	}
+	for _, invalid := range []string{
+		`{"input":"encrypt"}`,
+		`{"output":"selector"}`,
+		`{"inputs":"keep"}`,
+		`[]`,
+	} {
+		if _, err := PolicyFromJSON([]byte(invalid)); err == nil {
+			t.Errorf("expected policy %s to be rejected", invalid)
+		}
+	}
+}
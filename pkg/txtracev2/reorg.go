@@ -0,0 +1,161 @@
+package txtracev2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// TraceDeleter is a store which can delete tracing results.
+type TraceDeleter interface {
+	// DeleteTxTrace deletes the tracing result of the tx, deleting a missing one isn't an error.
+	DeleteTxTrace(ctx context.Context, txHash common.Hash) error
+}
+
+// ReorgStore is a store the traces of a reorg can be rebound and purged in.
+type ReorgStore interface {
+	TraceReadWriter
+	TraceDeleter
+}
+
+// BlockRef identifies a block of a chain.
+type BlockRef struct {
+	Hash   common.Hash
+	Number *big.Int
+	Time   uint64 // timestamp of the block, zero if unknown
+}
+
+// positions of the block fields in the rlp list of InternalActionTraceList
+const (
+	blockHashField           = 1
+	blockNumberField         = 2
+	transactionPositionField = 4
+	gasBreakdownField        = 5
+	timestampField           = 6
+)
+
+// RebindTxTrace moves the persisted traces of the tx to another block without re-execution, e.g. when the tx
+// survives a reorg. Only the block hash, number and tx position are rewritten, along with the block timestamp
+// which becomes unknown, every other byte of the stored traces is kept. The simple transfers persisted as a
+// marker have no block fields and are left as they are, see TracerConfig.SkipSimpleTransfers.
+func RebindTxTrace(ctx context.Context, store Store, txHash common.Hash, newBlockHash common.Hash, newBlockNumber *big.Int, newPosition uint64) error {
+	return rebindTxTrace(ctx, store, txHash, BlockRef{Hash: newBlockHash, Number: newBlockNumber}, newPosition)
+}
+
+// rebindTxTrace is RebindTxTrace also setting the block timestamp when known
+func rebindTxTrace(ctx context.Context, store TraceReadWriter, txHash common.Hash, block BlockRef, position uint64) error {
+	if block.Number == nil || !block.Number.IsUint64() {
+		return fmt.Errorf("%w: block number %v", ErrValueOutOfRange, block.Number)
+	}
+	raw, err := store.ReadTxTrace(ctx, txHash)
+	if err != nil {
+		return err
+	}
+	if len(raw) == 0 {
+		return fmt.Errorf("%w: %s", ErrTxTraceNotFound, txHash.Hex())
+	}
+	if isSimpleTransferMarker(raw) {
+		return nil
+	}
+	rebound, err := rebindTraces(raw, block, position)
+	if err != nil {
+		return fmt.Errorf("failed to rebind trace of tx %s: %w", txHash.Hex(), err)
+	}
+	return store.WriteTxTrace(ctx, txHash, rebound)
+}
+
+// rebindTraces replaces the block fields of persisted traces, the other fields are copied verbatim. Compressed
+// traces are compressed again with the same codec, zstd at DefaultZstdLevel.
+func rebindTraces(raw []byte, block BlockRef, position uint64) ([]byte, error) {
+	raw, codec, err := decompressTraces(raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := rlp.DecodeBytes(raw, new(InternalActionTraceList)); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedTrace, err)
+	}
+	content, _, err := rlp.SplitList(raw)
+	if err != nil {
+		return nil, err
+	}
+	var fields []rlp.RawValue
+	for len(content) > 0 {
+		_, _, rest, err := rlp.Split(content)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, content[:len(content)-len(rest)])
+		content = rest
+	}
+	if len(fields) <= transactionPositionField {
+		return nil, fmt.Errorf("%w: %d fields", ErrMalformedTrace, len(fields))
+	}
+	encode := func(val interface{}) rlp.RawValue {
+		enc, _ := rlp.EncodeToBytes(val)
+		return enc
+	}
+	fields[blockHashField] = encode(block.Hash)
+	fields[blockNumberField] = encode(block.Number)
+	fields[transactionPositionField] = encode(position)
+	switch {
+	case len(fields) > timestampField && block.Time == 0:
+		fields = fields[:timestampField]
+	case len(fields) > timestampField:
+		fields[timestampField] = encode(block.Time)
+	case block.Time != 0:
+		if len(fields) == gasBreakdownField {
+			fields = append(fields, encode((*TxGasBreakdown)(nil)))
+		}
+		fields = append(fields, encode(block.Time))
+	}
+	rebound, err := rlp.EncodeToBytes(fields)
+	if err != nil {
+		return nil, err
+	}
+	return compressTraces(rebound, codec, DefaultZstdLevel)
+}
+
+// PurgeTxTraces deletes the persisted traces of the txs, e.g. the ones dropped by a reorg.
+func PurgeTxTraces(ctx context.Context, store TraceDeleter, txHashes []common.Hash) error {
+	for _, txHash := range txHashes {
+		if err := store.DeleteTxTrace(ctx, txHash); err != nil && !errors.Is(err, ErrTxTraceNotFound) {
+			return fmt.Errorf("failed to purge trace of tx %s: %w", txHash.Hex(), err)
+		}
+	}
+	return nil
+}
+
+// HandleReorg updates the persisted traces of the txs of the removed blocks to the added blocks of a reorg. The
+// traces of txs included again are rebound to their new block and position, the ones of dropped txs are purged.
+// txHashesFor returns the txs of a block in order. Every step is idempotent, a failed reorg can be handled again.
+func HandleReorg(ctx context.Context, store ReorgStore, removedBlocks, addedBlocks []BlockRef, txHashesFor func(BlockRef) []common.Hash) error {
+	type inclusion struct {
+		block    BlockRef
+		position uint64
+	}
+	included := make(map[common.Hash]inclusion)
+	for _, block := range addedBlocks {
+		for i, txHash := range txHashesFor(block) {
+			included[txHash] = inclusion{block, uint64(i)}
+		}
+	}
+	var dropped []common.Hash
+	for _, block := range removedBlocks {
+		for _, txHash := range txHashesFor(block) {
+			inc, ok := included[txHash]
+			if !ok {
+				dropped = append(dropped, txHash)
+				continue
+			}
+			// a tx of the removed blocks may not have been traced yet
+			if err := rebindTxTrace(ctx, store, txHash, inc.block, inc.position); err != nil && !errors.Is(err, ErrTxTraceNotFound) {
+				return err
+			}
+		}
+	}
+	return PurgeTxTraces(ctx, store, dropped)
+}
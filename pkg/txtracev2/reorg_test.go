@@ -0,0 +1,140 @@
+package txtracev2
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// persistTrace persists the traces of a tx making a call with a sub call in block at position
+func persistTrace(t *testing.T, store Store, block BlockRef, txHash common.Hash, position uint64, breakdown *TxGasBreakdown) {
+	tracer := NewOeTracer(store, block.Hash, block.Number, txHash, position, WithBlockTimestamp(block.Time))
+	tracer.CaptureStart(nil, common.Address{0xa}, common.Address{0xb}, false, []byte{0x1}, 50_000, big.NewInt(1))
+	tracer.CaptureEnter(vm.CALL, common.Address{0xb}, common.Address{0xc}, []byte{0x2}, 20_000, big.NewInt(0))
+	tracer.CaptureExit([]byte{0x3}, 5_000, nil)
+	tracer.CaptureEnd([]byte{0x4}, 30_000, nil)
+	tracer.outPutTraces.GasBreakdown = breakdown
+	if err := tracer.PersistTraceContext(context.Background()); err != nil {
+		t.Fatalf("failed to persist traces: %v", err)
+	}
+}
+
+func TestHandleReorg(t *testing.T) {
+	var (
+		store = &MemoryStore{data: make(map[common.Hash][]byte)}
+		old10 = BlockRef{Hash: common.Hash{0xa, 0x10}, Number: big.NewInt(10), Time: 1_000}
+		old11 = BlockRef{Hash: common.Hash{0xa, 0x11}, Number: big.NewInt(11), Time: 1_012}
+		new10 = BlockRef{Hash: common.Hash{0xb, 0x10}, Number: big.NewInt(10), Time: 1_001}
+		new11 = BlockRef{Hash: common.Hash{0xb, 0x11}, Number: big.NewInt(11), Time: 1_013}
+
+		dropped   = common.Hash{0x1}
+		survivor  = common.Hash{0x2}
+		reorged   = common.Hash{0x3}
+		untraced  = common.Hash{0x4}
+		unrelated = common.Hash{0x5}
+		transfer  = common.Hash{0x6} // a simple transfer persisted as a marker
+		txs       = map[common.Hash][]common.Hash{
+			old10.Hash: {dropped, survivor, transfer},
+			old11.Hash: {reorged, untraced},
+			new10.Hash: {untraced, transfer},
+			new11.Hash: {unrelated, survivor},
+		}
+	)
+	persistTrace(t, store, old10, dropped, 0, nil)
+	persistTrace(t, store, old10, survivor, 1, &TxGasBreakdown{IntrinsicGas: 21_000, ExecutionGas: 30_000, EffectiveGasUsed: 51_000})
+	persistTrace(t, store, old11, reorged, 0, nil)
+	persistTrace(t, store, new11, unrelated, 0, nil)
+	store.data[transfer] = []byte{simpleTransferMarker}
+	before := map[common.Hash][]byte{survivor: store.data[survivor], unrelated: store.data[unrelated]}
+
+	txHashesFor := func(block BlockRef) []common.Hash { return txs[block.Hash] }
+	for i := 0; i < 2; i++ { // handling the reorg again changes nothing
+		if err := HandleReorg(context.Background(), store, []BlockRef{old10, old11}, []BlockRef{new10, new11}, txHashesFor); err != nil {
+			t.Fatalf("failed to handle reorg: %v", err)
+		}
+		for _, txHash := range []common.Hash{dropped, reorged, untraced} {
+			if _, ok := store.data[txHash]; ok {
+				t.Fatalf("trace of tx %x not purged", txHash)
+			}
+		}
+		if !bytes.Equal(store.data[unrelated], before[unrelated]) {
+			t.Fatalf("trace of unrelated tx changed")
+		}
+		if !isSimpleTransferMarker(store.data[transfer]) {
+			t.Fatalf("simple transfer marker changed: %x", store.data[transfer])
+		}
+
+		// the survivor moved to the second tx of the new block 11 with everything else kept
+		traces := new(InternalActionTraceList)
+		if err := rlp.DecodeBytes(store.data[survivor], traces); err != nil {
+			t.Fatalf("failed to decode rebound traces: %v", err)
+		}
+		if traces.BlockHash != new11.Hash || traces.BlockNumber.Cmp(new11.Number) != 0 || traces.TransactionPosition != 1 || traces.Timestamp != new11.Time {
+			t.Fatalf("rebound block fields mismatch: %x %v %d %d", traces.BlockHash, traces.BlockNumber, traces.TransactionPosition, traces.Timestamp)
+		}
+		want := new(InternalActionTraceList)
+		if err := rlp.DecodeBytes(before[survivor], want); err != nil {
+			t.Fatalf("failed to decode original traces: %v", err)
+		}
+		want.BlockHash, want.BlockNumber, want.TransactionPosition, want.Timestamp = new11.Hash, new11.Number, 1, new11.Time
+		if blob, _ := rlp.EncodeToBytes(want); !bytes.Equal(blob, store.data[survivor]) {
+			t.Fatalf("rebound traces mismatch:\nhave %x\nwant %x", store.data[survivor], blob)
+		}
+		have, _ := rlp.EncodeToBytes(traces.Traces)
+		if wantTraces, _ := rlp.EncodeToBytes(want.Traces); !bytes.Equal(have, wantTraces) || traces.GasBreakdown.EffectiveGasUsed != 51_000 {
+			t.Fatalf("rebound trace content changed")
+		}
+	}
+}
+
+func TestRebindTxTrace(t *testing.T) {
+	store := &MemoryStore{data: make(map[common.Hash][]byte)}
+	txHash := common.Hash{0x1}
+	persistTrace(t, store, BlockRef{Hash: common.Hash{0xa}, Number: big.NewInt(10), Time: 1_000}, txHash, 3, nil)
+
+	// the timestamp of the new block is unknown
+	if err := RebindTxTrace(context.Background(), store, txHash, common.Hash{0xb}, big.NewInt(12), 0); err != nil {
+		t.Fatalf("failed to rebind traces: %v", err)
+	}
+	traces, err := ReadRpcTxTrace(context.Background(), store, txHash)
+	if err != nil {
+		t.Fatalf("failed to read rebound traces: %v", err)
+	}
+	for _, trace := range traces {
+		if trace.BlockHash != (common.Hash{0xb}) || trace.BlockNumber.Int64() != 12 || trace.TransactionPosition != 0 || trace.BlockTimestamp != 0 {
+			t.Fatalf("rebound trace %v mismatch: %x %v %d %d", trace.TraceAddress, trace.BlockHash, trace.BlockNumber, trace.TransactionPosition, trace.BlockTimestamp)
+		}
+	}
+
+	// traces stored without the trailer get it only for a known timestamp
+	legacy, _ := rlp.EncodeToBytes([]interface{}{[]*InternalActionTrace{}, common.Hash{}, big.NewInt(1), txHash, uint64(0)})
+	rebound, err := rebindTraces(legacy, BlockRef{Hash: common.Hash{0xc}, Number: big.NewInt(2)}, 1)
+	if err != nil {
+		t.Fatalf("failed to rebind legacy traces: %v", err)
+	}
+	if want, _ := rlp.EncodeToBytes([]interface{}{[]*InternalActionTrace{}, common.Hash{0xc}, big.NewInt(2), txHash, uint64(1)}); !bytes.Equal(rebound, want) {
+		t.Fatalf("rebound legacy traces mismatch: have %x, want %x", rebound, want)
+	}
+	rebound, err = rebindTraces(legacy, BlockRef{Hash: common.Hash{0xc}, Number: big.NewInt(2), Time: 7}, 1)
+	if err != nil {
+		t.Fatalf("failed to rebind legacy traces: %v", err)
+	}
+	decoded := new(InternalActionTraceList)
+	if err := rlp.DecodeBytes(rebound, decoded); err != nil || decoded.Timestamp != 7 || decoded.GasBreakdown != nil {
+		t.Fatalf("rebound legacy trailer mismatch: %+v (err %v)", decoded, err)
+	}
+
+	if err := RebindTxTrace(context.Background(), store, common.Hash{0x2}, common.Hash{0xb}, big.NewInt(12), 0); !errors.Is(err, ErrTxTraceNotFound) {
+		t.Fatalf("missing trace error mismatch: have %v, want %v", err, ErrTxTraceNotFound)
+	}
+	store.data[txHash] = []byte{0xc1, 0x80}
+	if err := RebindTxTrace(context.Background(), store, txHash, common.Hash{0xb}, big.NewInt(12), 0); !errors.Is(err, ErrMalformedTrace) {
+		t.Fatalf("malformed trace error mismatch: have %v, want %v", err, ErrMalformedTrace)
+	}
+}
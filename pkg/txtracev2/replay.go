@@ -0,0 +1,128 @@
+package txtracev2
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/holiman/uint256"
+)
+
+// AccountOverride replaces parts of the prestate of an account before a replay, like the state overrides of
+// debug_traceCall whose json form it shares, e.g. to trace a tx against the patched bytecode of a proxy
+// implementation. Nil fields are left as they are.
+type AccountOverride struct {
+	Code      *hexutil.Bytes              `json:"code,omitempty"` // an empty code removes it
+	Balance   *hexutil.Big                `json:"balance,omitempty"`
+	Nonce     *hexutil.Uint64             `json:"nonce,omitempty"`
+	StateDiff map[common.Hash]common.Hash `json:"stateDiff,omitempty"` // the slots set, the other ones are kept
+}
+
+// StateOverride is the set of account overrides of a replay, see ReplayTxWithOverrides.
+type StateOverride map[common.Address]AccountOverride
+
+// Apply overrides the accounts in statedb, ErrValueOutOfRange if a balance doesn't fit in 256 bits.
+func (o StateOverride) Apply(statedb *state.StateDB) error {
+	for addr, account := range o {
+		if account.Balance != nil {
+			balance, overflow := uint256.FromBig(account.Balance.ToInt())
+			if overflow || account.Balance.ToInt().Sign() < 0 {
+				return fmt.Errorf("%w: balance %v of account %s", ErrValueOutOfRange, account.Balance, addr.Hex())
+			}
+			statedb.SetBalance(addr, balance)
+		}
+		if account.Nonce != nil {
+			statedb.SetNonce(addr, uint64(*account.Nonce))
+		}
+		if account.Code != nil {
+			statedb.SetCode(addr, *account.Code)
+		}
+		for key, value := range account.StateDiff {
+			statedb.SetState(addr, key, value)
+		}
+	}
+	return nil
+}
+
+// ReplayTx re-derives the traces of rawTx, in its canonical binary encoding, executed on top of the prestate
+// alloc in the block described by blkCtx, e.g. to reproduce a historical trace offline. blkCtx.BaseFee must be
+// set for blocks after London, CanTransfer and Transfer default to the ones of core. The block timestamp is
+// taken from blkCtx.Time, the block hash and the tx position aren't known from the arguments and are left zero, nothing is persisted.
+// A tx the evm refused to run, e.g. with a nonce off the prestate, is returned with its single PreExecution trace
+// along with the error, see OeTracer.RecordPreExecutionFailure.
+func ReplayTx(cfg *params.ChainConfig, blkCtx vm.BlockContext, alloc types.GenesisAlloc, rawTx []byte) ([]RpcActionTrace, error) {
+	return ReplayTxWithOverrides(cfg, blkCtx, alloc, rawTx, nil)
+}
+
+// ReplayTxWithOverrides re-derives the traces of rawTx like ReplayTx, with the prestate alloc overridden by
+// overrides, e.g. for "what-if" debugging of a proxy upgrade.
+func ReplayTxWithOverrides(cfg *params.ChainConfig, blkCtx vm.BlockContext, alloc types.GenesisAlloc, rawTx []byte, overrides StateOverride) ([]RpcActionTrace, error) {
+	tx := new(types.Transaction)
+	if err := tx.UnmarshalBinary(rawTx); err != nil {
+		return nil, fmt.Errorf("failed to decode tx: %v", err)
+	}
+	if blkCtx.CanTransfer == nil {
+		blkCtx.CanTransfer = core.CanTransfer
+	}
+	if blkCtx.Transfer == nil {
+		blkCtx.Transfer = core.Transfer
+	}
+	signer := types.MakeSigner(cfg, blkCtx.BlockNumber, blkCtx.Time)
+	msg, err := core.TransactionToMessage(tx, signer, blkCtx.BaseFee)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare tx for tracing: %v", err)
+	}
+
+	statedb, err := newPreState(alloc)
+	if err != nil {
+		return nil, err
+	}
+	if err := overrides.Apply(statedb); err != nil {
+		return nil, err
+	}
+
+	tracer := NewOeTracer(nil, common.Hash{}, blkCtx.BlockNumber, tx.Hash(), 0, WithBlockTimestamp(blkCtx.Time))
+	evm := vm.NewEVM(blkCtx, core.NewEVMTxContext(msg), statedb, cfg, vm.Config{Tracer: tracer})
+	if _, err := core.ApplyMessage(evm, msg, new(core.GasPool).AddGas(tx.Gas())); err != nil {
+		// the evm didn't run, the tx is recorded failed before it
+		tracer.RecordPreExecutionFailure(err, *msg)
+		traces, _ := tracer.GetTraces() // nil if not recorded, the error tells why anyway
+		return traces, fmt.Errorf("failed to execute tx: %w", err)
+	}
+	return tracer.GetTraces()
+}
+
+// newPreState returns an in-memory state holding alloc, committed so the evm sees the storage of alloc as the
+// original values of the slots, ErrValueOutOfRange if a balance doesn't fit in 256 bits
+func newPreState(alloc types.GenesisAlloc) (*state.StateDB, error) {
+	db := state.NewDatabase(rawdb.NewMemoryDatabase())
+	statedb, err := state.New(types.EmptyRootHash, db, nil)
+	if err != nil {
+		return nil, err
+	}
+	for addr, account := range alloc {
+		if account.Balance != nil {
+			balance, overflow := uint256.FromBig(account.Balance)
+			if overflow || account.Balance.Sign() < 0 {
+				return nil, fmt.Errorf("%w: balance %v of account %s", ErrValueOutOfRange, account.Balance, addr.Hex())
+			}
+			statedb.SetBalance(addr, balance)
+		}
+		statedb.SetNonce(addr, account.Nonce)
+		statedb.SetCode(addr, account.Code)
+		for key, value := range account.Storage {
+			statedb.SetState(addr, key, value)
+		}
+	}
+	root, err := statedb.Commit(0, false)
+	if err != nil {
+		return nil, err
+	}
+	return state.New(root, db, nil)
+}
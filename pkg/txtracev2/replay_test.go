@@ -0,0 +1,124 @@
+package txtracev2
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+func TestReplayTx(t *testing.T) {
+	files, err := os.ReadDir("testdata")
+	if err != nil {
+		t.Fatalf("failed to retrieve tracer test suite: %v", err)
+	}
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), "call_tracer_") {
+			continue
+		}
+		file := file // capture range variable
+		t.Run(camel(strings.TrimSuffix(strings.TrimPrefix(file.Name(), "call_tracer"), ".json")), func(t *testing.T) {
+			t.Parallel()
+
+			blob, err := os.ReadFile(filepath.Join("testdata", file.Name()))
+			if err != nil {
+				t.Fatalf("failed to read testcase: %v", err)
+			}
+			test := new(callTracerTest)
+			if err := json.Unmarshal(blob, test); err != nil {
+				t.Fatalf("failed to parse testcase: %v", err)
+			}
+			blkContext := vm.BlockContext{
+				Coinbase:    test.Context.Miner,
+				GasLimit:    uint64(test.Context.GasLimit),
+				BlockNumber: new(big.Int).SetUint64(uint64(test.Context.Number)),
+				Time:        uint64(test.Context.Time),
+				Difficulty:  (*big.Int)(test.Context.Difficulty),
+			}
+			res, err := ReplayTx(test.Genesis.Config, blkContext, test.Genesis.Alloc, common.FromHex(test.Input))
+			if err != nil {
+				t.Fatalf("failed to replay tx: %v", err)
+			}
+			// the fixtures were traced without the block timestamp
+			for i := range test.Result {
+				test.Result[i].BlockTimestamp = uint64(test.Context.Time)
+			}
+			if !jsonEqual(res, test.Result) {
+				jsonDiff(t, res, test.Result)
+			}
+		})
+	}
+}
+
+func TestReplayTxInvalid(t *testing.T) {
+	blkContext := vm.BlockContext{BlockNumber: big.NewInt(1), Difficulty: big.NewInt(1)}
+	if _, err := ReplayTx(params.AllEthashProtocolChanges, blkContext, types.GenesisAlloc{}, []byte{0x01, 0x02}); err == nil {
+		t.Fatalf("malformed tx replayed")
+	}
+}
+
+func TestReplayTxWithOverrides(t *testing.T) {
+	var (
+		cfg      = params.AllEthashProtocolChanges
+		key, _   = crypto.GenerateKey()
+		sender   = crypto.PubkeyToAddress(key.PublicKey)
+		proxy    = common.Address{0x70}
+		slot     = common.BigToHash(big.NewInt(1))
+		patched  = common.Hash{0x77}
+		blkCtx   = vm.BlockContext{BlockNumber: big.NewInt(1), Difficulty: big.NewInt(1), GasLimit: 30_000_000, BaseFee: big.NewInt(0)}
+		original = []byte{0x60, 0x2a, 0x60, 0x00, 0x52, 0x60, 0x20, 0x60, 0x00, 0xf3}       // returns 42
+		upgraded = []byte{0x60, 0x01, 0x54, 0x60, 0x00, 0x52, 0x60, 0x20, 0x60, 0x00, 0xf3} // returns slot 1
+	)
+	// the sender can't pay for the tx nor is it at its nonce without the overrides
+	alloc := types.GenesisAlloc{proxy: {Code: original}}
+	tx, err := types.SignTx(types.NewTx(&types.LegacyTx{Nonce: 5, To: &proxy, Gas: 100_000, GasPrice: big.NewInt(1)}), types.LatestSignerForChainID(cfg.ChainID), key)
+	if err != nil {
+		t.Fatalf("failed to sign tx: %v", err)
+	}
+	rawTx, err := tx.MarshalBinary()
+	if err != nil {
+		t.Fatalf("failed to encode tx: %v", err)
+	}
+	// the tx refused by the evm is traced failed before execution
+	traces, err := ReplayTx(cfg, blkCtx, alloc, rawTx)
+	if !errors.Is(err, core.ErrNonceTooHigh) {
+		t.Fatalf("expected ErrNonceTooHigh without the overrides, have %v", err)
+	}
+	if len(traces) != 1 || traces[0].Error != "Invalid transaction nonce" || traces[0].Result != nil || *traces[0].Action.From != sender {
+		t.Fatalf("traces of the refused tx mismatch: %+v", traces)
+	}
+
+	code, nonce := hexutil.Bytes(upgraded), hexutil.Uint64(5)
+	overrides := StateOverride{
+		sender: {Balance: (*hexutil.Big)(big.NewInt(params.Ether)), Nonce: &nonce},
+		proxy:  {Code: &code, StateDiff: map[common.Hash]common.Hash{slot: patched}},
+	}
+	traces, err = ReplayTxWithOverrides(cfg, blkCtx, alloc, rawTx, overrides)
+	if err != nil {
+		t.Fatalf("failed to replay tx: %v", err)
+	}
+	if len(traces) != 1 || traces[0].Result == nil || common.BytesToHash(*traces[0].Result.Output) != patched {
+		t.Fatalf("the upgraded code didn't run: %+v", traces)
+	}
+	// the alloc itself is left as is
+	if !bytes.Equal(alloc[proxy].Code, original) {
+		t.Fatalf("alloc overridden")
+	}
+
+	overrides[sender] = AccountOverride{Balance: (*hexutil.Big)(new(big.Int).Lsh(big.NewInt(1), 256))}
+	if _, err := ReplayTxWithOverrides(cfg, blkCtx, alloc, rawTx, overrides); !errors.Is(err, ErrValueOutOfRange) {
+		t.Fatalf("expected ErrValueOutOfRange, have %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package txtracev2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// simpleTransferMarker is persisted instead of the traces of a simple transfer, rlp encoded traces are lists
+// and never a single byte below 0xc0
+const simpleTransferMarker byte = 0x00
+
+// ErrSimpleTransferTrace is returned when the traces of a simple transfer skipped by TracerConfig.SkipSimpleTransfers
+// are read without the tx they're rebuilt from, see ReadRpcTxTraceWithTx.
+var ErrSimpleTransferTrace = errors.New("simple transfer trace not persisted")
+
+// isSimpleTransferMarker reports whether raw is the marker persisted instead of the traces of a simple transfer
+func isSimpleTransferMarker(raw []byte) bool {
+	return len(raw) == 1 && raw[0] == simpleTransferMarker
+}
+
+// IsSimpleTransfer reports whether the traces are the ones of a plain value transfer, which SimpleTransferTraces
+// rebuilds from the tx alone: a single successful call frame without input in which no code ran. The top-level
+// gasUsed is the execution gas, 0 for them, the base tx gas is intrinsic. Traces carrying a block timestamp, a gas
+// breakdown beyond the intrinsic gas or an impersonated sender aren't, the tx doesn't tell them.
+func IsSimpleTransfer(list *InternalActionTraceList) bool {
+	if len(list.Traces) != 1 || list.Timestamp != 0 {
+		return false
+	}
+	if breakdown := list.GasBreakdown; breakdown != nil && (breakdown.ExecutionGas != 0 || breakdown.RefundedGas != 0 || breakdown.EffectiveGasUsed != breakdown.IntrinsicGas) {
+		return false
+	}
+	root := list.Traces[0]
+	action := &root.Action
+	return action.CallType == CallTypeCall && action.CallTypeName == "" && action.From != nil && action.To != nil &&
+		len(action.Input) == 0 && len(root.TraceAddress) == 0 && root.Subtraces == 0 && !root.SubtracesTruncated && !root.Impersonated &&
+		root.Error == "" && root.Result != nil && root.Result.GasUsed == 0 && len(root.Result.Output) == 0
+}
+
+// SimpleTransferTraces rebuilds the rpc traces OeTracer records for a simple transfer from the tx, signer
+// recovers its sender. The tx must be a call without data.
+func SimpleTransferTraces(tx *types.Transaction, signer types.Signer, blockHash common.Hash, blockNumber *big.Int, index uint64) (ActionTraceList, error) {
+	if tx.To() == nil || len(tx.Data()) > 0 {
+		return nil, fmt.Errorf("%w: tx %s is not a simple transfer", ErrMalformedTrace, tx.Hash().Hex())
+	}
+	from, err := types.Sender(signer, tx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to recover sender of tx %s: %w", tx.Hash().Hex(), err)
+	}
+	// without data the intrinsic gas only depends on the access list, not on the forks
+	intrinsic, err := intrinsicGas(nil, tx.AccessList(), false, true, true, true)
+	if err != nil {
+		return nil, err
+	}
+	if tx.Gas() < intrinsic {
+		return nil, fmt.Errorf("%w: tx %s gas %d below intrinsic gas %d", ErrMalformedTrace, tx.Hash().Hex(), tx.Gas(), intrinsic)
+	}
+	if blockNumber == nil {
+		blockNumber = new(big.Int)
+	}
+	to := *tx.To()
+	list := &InternalActionTraceList{
+		Traces: []*InternalActionTrace{{
+			Action: InternalAction{
+				CallType: CallTypeCall,
+				From:     &from,
+				To:       &to,
+				Value:    tx.Value(),
+				Gas:      tx.Gas() - intrinsic,
+				Input:    []byte{},
+			},
+			Result:       &InternalTraceActionResult{Output: []byte{}},
+			TraceAddress: []uint32{},
+		}},
+		BlockHash:           blockHash,
+		BlockNumber:         blockNumber,
+		TransactionHash:     tx.Hash(),
+		TransactionPosition: index,
+	}
+	if err := list.Validate(); err != nil {
+		return nil, err
+	}
+	traces := append(ActionTraceList{}, list.ToTraces()...)
+	traces.normalize()
+	return traces, nil
+}
+
+// ReadRpcTxTraceWithTx is ReadRpcTxTrace falling back to SimpleTransferTraces for the simple transfers persisted
+// as a marker by TracerConfig.SkipSimpleTransfers, tx is the traced one at index in the block.
+func ReadRpcTxTraceWithTx(ctx context.Context, store Store, tx *types.Transaction, signer types.Signer, blockHash common.Hash, blockNumber *big.Int, index uint64) (ActionTraceList, error) {
+	raw, err := store.ReadTxTrace(ctx, tx.Hash())
+	if err != nil {
+		return nil, err
+	}
+	if isSimpleTransferMarker(raw) {
+		return SimpleTransferTraces(tx, signer, blockHash, blockNumber, index)
+	}
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("trace result of tx {%#v} not found in tracedb", tx.Hash())
+	}
+	return decodeRpcTxTrace(ctx, raw, TracerConfig{})
+}
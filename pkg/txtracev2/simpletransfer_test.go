@@ -0,0 +1,149 @@
+package txtracev2
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/tests"
+)
+
+var (
+	transferKey, _ = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+	transferSigner = types.LatestSigner(params.AllEthashProtocolChanges)
+	transferBlock  = common.Hash{0xb1}
+)
+
+// traceSignedTx runs the signed tx in block 1 with a tracer persisting into store
+func traceSignedTx(t *testing.T, statedb vm.StateDB, store Store, tx *types.Transaction, index uint64, cfg TracerConfig) *OeTracer {
+	t.Helper()
+	tracer := NewOeTracer(store, transferBlock, big.NewInt(1), tx.Hash(), index, WithTracerConfig(cfg))
+	blkContext := vm.BlockContext{
+		CanTransfer: core.CanTransfer,
+		Transfer:    core.Transfer,
+		GasLimit:    30_000_000,
+		BlockNumber: big.NewInt(1),
+		Difficulty:  big.NewInt(1),
+		BaseFee:     big.NewInt(0),
+	}
+	msg, err := core.TransactionToMessage(tx, transferSigner, blkContext.BaseFee)
+	if err != nil {
+		t.Fatalf("failed to prepare tx: %v", err)
+	}
+	evm := vm.NewEVM(blkContext, core.NewEVMTxContext(msg), statedb, params.AllEthashProtocolChanges, vm.Config{Tracer: tracer})
+	if _, err := core.NewStateTransition(evm, msg, new(core.GasPool).AddGas(tx.Gas())).TransitionDb(); err != nil {
+		t.Fatalf("failed to execute tx: %v", err)
+	}
+	if err := tracer.PersistTraceContext(context.Background()); err != nil {
+		t.Fatalf("failed to persist traces: %v", err)
+	}
+	return tracer
+}
+
+func TestSkipSimpleTransfers(t *testing.T) {
+	var (
+		ctx      = context.Background()
+		sender   = crypto.PubkeyToAddress(transferKey.PublicKey)
+		eoa      = common.Address{0x50, 0x01}
+		stopper  = common.Address{0x50, 0x02}
+		reverter = common.Address{0x50, 0x03}
+	)
+	alloc := types.GenesisAlloc{
+		sender:   {Balance: big.NewInt(params.Ether)},
+		stopper:  {Code: []byte{byte(vm.STOP)}},
+		reverter: {Code: []byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.REVERT)}},
+	}
+	state := tests.MakePreState(rawdb.NewMemoryDatabase(), alloc, false, rawdb.HashScheme)
+	defer state.Close()
+
+	accessList := types.AccessList{{Address: eoa, StorageKeys: []common.Hash{{0x1}}}}
+	for i, test := range []struct {
+		tx     types.TxData
+		simple bool
+	}{
+		{&types.LegacyTx{To: &eoa, Value: big.NewInt(7), Gas: 21_000}, true},
+		{&types.LegacyTx{To: &eoa, Gas: 50_000}, true},
+		{&types.AccessListTx{ChainID: params.AllEthashProtocolChanges.ChainID, To: &eoa, Value: big.NewInt(7), Gas: 60_000, AccessList: accessList}, true},
+		{&types.DynamicFeeTx{ChainID: params.AllEthashProtocolChanges.ChainID, To: &stopper, Value: big.NewInt(7), Gas: 30_000}, true}, // no code ran
+		{&types.LegacyTx{To: &eoa, Value: big.NewInt(7), Gas: 30_000, Data: []byte{0x1}}, false},
+		{&types.LegacyTx{To: &reverter, Value: big.NewInt(7), Gas: 30_000}, false},
+		{&types.LegacyTx{Value: big.NewInt(7), Gas: 60_000}, false},
+	} {
+		tx := types.MustSignNewTx(transferKey, transferSigner, test.tx)
+		for _, cfg := range []TracerConfig{{SkipSimpleTransfers: true}, {SkipSimpleTransfers: true, OmitSimpleTransfers: true}} {
+			store := &MemoryStore{data: make(map[common.Hash][]byte)}
+			tracer := traceSignedTx(t, state.StateDB.Copy(), store, tx, uint64(i), cfg)
+			want, err := tracer.GetTraces()
+			if err != nil {
+				t.Fatalf("tx %d: failed to get traces: %v", i, err)
+			}
+			raw, persisted := store.data[tx.Hash()]
+			switch {
+			case !test.simple && isSimpleTransferMarker(raw):
+				t.Fatalf("tx %d: traces of a non simple transfer skipped", i)
+			case test.simple && cfg.OmitSimpleTransfers && persisted:
+				t.Fatalf("tx %d: omitted simple transfer persisted: %x", i, raw)
+			case test.simple && !cfg.OmitSimpleTransfers && !isSimpleTransferMarker(raw):
+				t.Fatalf("tx %d: simple transfer not skipped: %d bytes", i, len(raw))
+			}
+
+			if !test.simple || !cfg.OmitSimpleTransfers {
+				have, err := ReadRpcTxTraceWithTx(ctx, store, tx, transferSigner, transferBlock, big.NewInt(1), uint64(i))
+				if err != nil {
+					t.Fatalf("tx %d: failed to read traces: %v", i, err)
+				}
+				if !jsonEqual(have, want) {
+					jsonDiff(t, have, want)
+				}
+			}
+			if test.simple {
+				rebuilt, err := SimpleTransferTraces(tx, transferSigner, transferBlock, big.NewInt(1), uint64(i))
+				if err != nil || !jsonEqual(rebuilt, want) {
+					t.Fatalf("tx %d: rebuilt traces mismatch: %v", i, err)
+				}
+			}
+			if test.simple && !cfg.OmitSimpleTransfers {
+				if _, err := ReadRpcTxTrace(ctx, store, tx.Hash()); !errors.Is(err, ErrSimpleTransferTrace) {
+					t.Fatalf("tx %d: expected ErrSimpleTransferTrace, have %v", i, err)
+				}
+			}
+		}
+	}
+}
+
+func TestSkipSimpleTransfersStorage(t *testing.T) {
+	sender := crypto.PubkeyToAddress(transferKey.PublicKey)
+	alloc := types.GenesisAlloc{sender: {Balance: big.NewInt(params.Ether)}}
+	state := tests.MakePreState(rawdb.NewMemoryDatabase(), alloc, false, rawdb.HashScheme)
+	defer state.Close()
+
+	store := &MemoryStore{data: make(map[common.Hash][]byte)}
+	var skipped, full int
+	for i := 0; i < 1000; i++ {
+		to := common.BigToAddress(big.NewInt(int64(0x10000 + i)))
+		tx := types.MustSignNewTx(transferKey, transferSigner, &types.LegacyTx{Nonce: uint64(i), To: &to, Value: big.NewInt(int64(i + 1)), Gas: 21_000})
+		tracer := traceSignedTx(t, state.StateDB, store, tx, uint64(i), TracerConfig{SkipSimpleTransfers: true})
+		raw, err := rlp.EncodeToBytes(tracer.getInternalTraces())
+		if err != nil {
+			t.Fatalf("failed to encode traces: %v", err)
+		}
+		skipped += len(store.data[tx.Hash()])
+		full += len(raw)
+	}
+	if skipped != 1000 {
+		t.Fatalf("skipped simple transfers take %d bytes, want 1000", skipped)
+	}
+	t.Logf("1000 simple transfers: %d bytes skipped, %d bytes in full, %.1fx smaller", skipped, full, float64(full)/float64(skipped))
+	if full < 100*skipped {
+		t.Fatalf("storage savings too small: %d bytes skipped, %d bytes in full", skipped, full)
+	}
+}
@@ -3,22 +3,72 @@ package txtracev2
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/rlp"
 )
 
+// ErrTxTraceNotFound should be wrapped by stores when no tracing result of the tx is persisted.
+var ErrTxTraceNotFound = errors.New("tx trace not found")
+
 // Store contains all the methods for tx-trace to interact with the underlying database.
 type Store interface {
 	// ReadTxTrace retrieve tracing result from underlying database.
 	ReadTxTrace(ctx context.Context, txHash common.Hash) ([]byte, error)
 	// WriteTxTrace write tracing result to underlying database.
 	WriteTxTrace(ctx context.Context, txHash common.Hash, trace []byte) error
+	// Has checks whether tracing result exists in underlying database without reading it,
+	// stores which can't do it cheaply may implement it with HasTxTrace.
+	Has(ctx context.Context, txHash common.Hash) (bool, error)
+}
+
+// TraceReadWriter is a store which can't check the existence of tracing result cheaply.
+type TraceReadWriter interface {
+	ReadTxTrace(ctx context.Context, txHash common.Hash) ([]byte, error)
+	WriteTxTrace(ctx context.Context, txHash common.Hash, trace []byte) error
+}
+
+// HasTxTrace is the default Store.Has built on ReadTxTrace, an empty result or ErrTxTraceNotFound means
+// the tracing result doesn't exist.
+func HasTxTrace(ctx context.Context, store TraceReadWriter, txHash common.Hash) (bool, error) {
+	raw, err := store.ReadTxTrace(ctx, txHash)
+	if errors.Is(err, ErrTxTraceNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return len(raw) > 0, nil
+}
+
+// WithDefaultHas wraps a TraceReadWriter into a Store whose Has is HasTxTrace, a store which already is a Store
+// is returned as is.
+func WithDefaultHas(store TraceReadWriter) Store {
+	if s, ok := store.(Store); ok {
+		return s
+	}
+	return readHasStore{store}
+}
+
+// readHasStore implements Store.Has with HasTxTrace
+type readHasStore struct {
+	TraceReadWriter
+}
+
+func (s readHasStore) Has(ctx context.Context, txHash common.Hash) (bool, error) {
+	return HasTxTrace(ctx, s.TraceReadWriter, txHash)
 }
 
 // ReadRpcTxTrace reads internal tx-trace from underlying database and decodes it to rpc-tx-trace.
 func ReadRpcTxTrace(ctx context.Context, store Store, txHash common.Hash) (ActionTraceList, error) {
+	return ReadRpcTxTraceWithConfig(ctx, store, txHash, TracerConfig{})
+}
+
+// ReadRpcTxTraceWithConfig reads internal tx-trace from underlying database and decodes it to rpc-tx-trace
+// in the form configured by cfg.
+func ReadRpcTxTraceWithConfig(ctx context.Context, store Store, txHash common.Hash, cfg TracerConfig) (ActionTraceList, error) {
 	raw, err := store.ReadTxTrace(ctx, txHash)
 	if err != nil {
 		return nil, err
@@ -26,10 +76,61 @@ func ReadRpcTxTrace(ctx context.Context, store Store, txHash common.Hash) (Actio
 	if bytes.Equal(raw, []byte{}) { // empty response
 		return nil, fmt.Errorf("trace result of tx {%#v} not found in tracedb", txHash)
 	}
-	txs := ActionTraceList{}
-	err = rlp.DecodeBytes(raw, &txs)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode rlp traces: %v", err)
+	return decodeRpcTxTrace(ctx, raw, cfg)
+}
+
+// decodeRpcTxTrace decodes a persisted internal tx-trace to rpc-tx-trace in the form configured by cfg
+func decodeRpcTxTrace(ctx context.Context, raw []byte, cfg TracerConfig) (ActionTraceList, error) {
+	if isSimpleTransferMarker(raw) {
+		return nil, ErrSimpleTransferTrace
+	}
+	internalTraces := InternalActionTraceList{}
+	if err := decodeInternalTraces(ctx, raw, &internalTraces); err != nil {
+		return nil, err
 	}
+	txs := append(ActionTraceList{}, internalTraces.ToTracesWithConfig(cfg)...)
+	txs.normalize()
 	return txs, nil
 }
+
+// ReadRpcTxTraceWithMeta reads internal tx-trace from underlying database and decodes it to rpc-tx-trace
+// along with tx level metadata.
+func ReadRpcTxTraceWithMeta(ctx context.Context, store Store, txHash common.Hash) (*TracesWithMeta, error) {
+	raw, err := store.ReadTxTrace(ctx, txHash)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(raw, []byte{}) { // empty response
+		return nil, fmt.Errorf("trace result of tx {%#v} not found in tracedb", txHash)
+	}
+	if isSimpleTransferMarker(raw) {
+		return nil, ErrSimpleTransferTrace
+	}
+	internalTraces := InternalActionTraceList{}
+	if err := decodeInternalTraces(ctx, raw, &internalTraces); err != nil {
+		return nil, err
+	}
+	tracesWithMeta := internalTraces.ToTracesWithMeta()
+	tracesWithMeta.Traces.normalize()
+	return tracesWithMeta, nil
+}
+
+// decodeInternalTraces decompresses, decodes and validates a persisted internal tx-trace. The rlp decoder can't be stopped
+// halfway, large blobs aren't decoded once ctx is done after the read, nor converted once it's done after
+// the decode.
+func decodeInternalTraces(ctx context.Context, raw []byte, internalTraces *InternalActionTraceList) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	raw, _, err := decompressTraces(raw)
+	if err != nil {
+		return err
+	}
+	if err := rlp.DecodeBytes(raw, internalTraces); err != nil {
+		return fmt.Errorf("failed to decode rlp traces: %v", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return internalTraces.Validate()
+}
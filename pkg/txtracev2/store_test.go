@@ -0,0 +1,59 @@
+package txtracev2
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// readWriteStore can't check existence cheaply and reports missing traces as empty blobs
+type readWriteStore map[common.Hash][]byte
+
+func (store readWriteStore) ReadTxTrace(ctx context.Context, txHash common.Hash) ([]byte, error) {
+	return store[txHash], nil
+}
+
+func (store readWriteStore) WriteTxTrace(ctx context.Context, txHash common.Hash, trace []byte) error {
+	store[txHash] = trace
+	return nil
+}
+
+func TestHasTxTrace(t *testing.T) {
+	ctx := context.Background()
+	stores := map[string]Store{
+		"empty blob": WithDefaultHas(readWriteStore{}),
+		"not found":  readHasStore{&MemoryStore{data: make(map[common.Hash][]byte)}},
+	}
+	for name, store := range stores {
+		if err := store.WriteTxTrace(ctx, common.Hash{0x1}, []byte{0xc0}); err != nil {
+			t.Fatalf("%s: failed to write trace: %v", name, err)
+		}
+		for txHash, want := range map[common.Hash]bool{{0x1}: true, {0x2}: false} {
+			have, err := store.Has(ctx, txHash)
+			if err != nil {
+				t.Fatalf("%s: failed to check trace %x: %v", name, txHash, err)
+			}
+			if have != want {
+				t.Errorf("%s: trace %x existence mismatch: have %v, want %v", name, txHash, have, want)
+			}
+		}
+	}
+
+	failing := errors.New("backend down")
+	store := WithDefaultHas(failingStore{failing})
+	if _, err := store.Has(ctx, common.Hash{0x1}); !errors.Is(err, failing) {
+		t.Fatalf("error mismatch: have %v, want %v", err, failing)
+	}
+}
+
+type failingStore struct{ err error }
+
+func (store failingStore) ReadTxTrace(ctx context.Context, txHash common.Hash) ([]byte, error) {
+	return nil, store.err
+}
+
+func (store failingStore) WriteTxTrace(ctx context.Context, txHash common.Hash, trace []byte) error {
+	return store.err
+}
@@ -0,0 +1,150 @@
+package txtracev2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// ErrBlockSummaryNotFound should be wrapped by summary stores when no summary of the block is persisted.
+var ErrBlockSummaryNotFound = errors.New("block summary not found")
+
+// SummaryStore persists the rlp encoded trace summaries of blocks.
+type SummaryStore interface {
+	WriteBlockSummary(ctx context.Context, blockHash common.Hash, summary []byte) error
+	ReadBlockSummary(ctx context.Context, blockHash common.Hash) ([]byte, error)
+}
+
+// BlockTraceSummary aggregates the traces of the txs of a block. Frames are counted whether they succeeded
+// or not, the value only counts where it was actually moved, i.e. outside reverted subtrees.
+type BlockTraceSummary struct {
+	Txs           uint64
+	InternalCalls uint64   // call frames below the top-level ones
+	InternalValue *big.Int // wei moved by internal calls, creates and suicides
+	Creates       uint64   // including the top-level ones of contract creation txs
+	Suicides      uint64
+	FailedFrames  uint64 // frames with an error, the frames below them which succeeded aren't counted
+}
+
+// ComputeBlockSummary aggregates the traces of the txs of a block.
+func ComputeBlockSummary(traceLists []InternalActionTraceList) BlockTraceSummary {
+	summary := BlockTraceSummary{InternalValue: new(big.Int)}
+	for i := range traceLists {
+		summary.add(&traceLists[i])
+	}
+	return summary
+}
+
+// add aggregates the traces of a tx into the summary
+func (summary *BlockTraceSummary) add(list *InternalActionTraceList) {
+	if summary.InternalValue == nil {
+		summary.InternalValue = new(big.Int)
+	}
+	summary.Txs++
+	reverted := make(revertedFrames)
+	for _, interTrace := range list.Traces {
+		action := &interTrace.Action
+		internal := len(interTrace.TraceAddress) > 0
+		if interTrace.Error != "" {
+			summary.FailedFrames++
+		}
+		failed := reverted.visit(interTrace)
+
+		var moved *big.Int
+		switch action.CallType {
+		case CallTypeCreate:
+			summary.Creates++
+			moved = action.Value
+		case CallTypeSuicide:
+			summary.Suicides++
+			moved = action.Balance
+		case CallTypeCallCode, CallTypeDelegateCall, CallTypeStaticCall:
+			// the value stays with the caller, or is the one of the parent frame
+			if internal {
+				summary.InternalCalls++
+			}
+		default:
+			if internal {
+				summary.InternalCalls++
+			}
+			moved = action.Value
+		}
+		if internal && !failed && moved != nil {
+			summary.InternalValue.Add(summary.InternalValue, moved)
+		}
+	}
+}
+
+// WriteBlockSummary persists the summary of a block to store.
+func WriteBlockSummary(ctx context.Context, store SummaryStore, blockHash common.Hash, summary *BlockTraceSummary) error {
+	raw, err := rlp.EncodeToBytes(summary)
+	if err != nil {
+		return fmt.Errorf("failed to encode summary of block %s: %w", blockHash.Hex(), err)
+	}
+	return store.WriteBlockSummary(ctx, blockHash, raw)
+}
+
+// ReadBlockSummary reads the persisted summary of a block from store.
+func ReadBlockSummary(ctx context.Context, store SummaryStore, blockHash common.Hash) (*BlockTraceSummary, error) {
+	raw, err := store.ReadBlockSummary(ctx, blockHash)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrBlockSummaryNotFound, blockHash.Hex())
+	}
+	summary := new(BlockTraceSummary)
+	if err := rlp.DecodeBytes(raw, summary); err != nil {
+		return nil, fmt.Errorf("failed to decode summary of block %s: %w", blockHash.Hex(), err)
+	}
+	return summary, nil
+}
+
+// RecomputeBlockSummary computes the summary of a block from the persisted traces of its txs, e.g. to backfill
+// the summaries of blocks traced before they were produced. The summary is persisted when store is also a
+// SummaryStore, under the block hash of the traces. The simple transfers persisted as a marker count as txs
+// without internal frames, they carry no block hash: a summary of them only isn't persisted.
+func RecomputeBlockSummary(ctx context.Context, store Store, txHashes []common.Hash) (*BlockTraceSummary, error) {
+	summary := &BlockTraceSummary{InternalValue: new(big.Int)}
+	var (
+		blockHash common.Hash
+		bound     bool // whether blockHash is the one of traces read so far
+	)
+	for _, txHash := range txHashes {
+		raw, err := store.ReadTxTrace(ctx, txHash)
+		if err != nil {
+			return nil, err
+		}
+		if len(raw) == 0 {
+			return nil, fmt.Errorf("%w: %s", ErrTxTraceNotFound, txHash.Hex())
+		}
+		if isSimpleTransferMarker(raw) {
+			summary.Txs++
+			continue
+		}
+		raw, _, err = decompressTraces(raw)
+		if err != nil {
+			return nil, fmt.Errorf("tx %s: %w", txHash.Hex(), err)
+		}
+		list := new(InternalActionTraceList)
+		if err := rlp.DecodeBytes(raw, list); err != nil {
+			return nil, fmt.Errorf("%w: tx %s: %v", ErrMalformedTrace, txHash.Hex(), err)
+		}
+		if !bound {
+			blockHash, bound = list.BlockHash, true
+		} else if list.BlockHash != blockHash {
+			return nil, fmt.Errorf("%w: tx %s is in block %s, not %s", ErrMalformedTrace, txHash.Hex(), list.BlockHash.Hex(), blockHash.Hex())
+		}
+		summary.add(list)
+	}
+	if summaries, ok := store.(SummaryStore); ok && bound {
+		if err := WriteBlockSummary(ctx, summaries, blockHash, summary); err != nil {
+			return nil, err
+		}
+	}
+	return summary, nil
+}
@@ -0,0 +1,158 @@
+package txtracev2
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// summaryMemoryStore is a MemoryStore which also persists block summaries
+type summaryMemoryStore struct {
+	MemoryStore
+	summaries map[common.Hash][]byte
+}
+
+func (store *summaryMemoryStore) WriteBlockSummary(ctx context.Context, blockHash common.Hash, summary []byte) error {
+	store.summaries[blockHash] = summary
+	return nil
+}
+
+func (store *summaryMemoryStore) ReadBlockSummary(ctx context.Context, blockHash common.Hash) ([]byte, error) {
+	return store.summaries[blockHash], nil
+}
+
+// summaryBlock is a block of a tx with successful calls, a create, a suicide and a reverted branch, a
+// contract creation tx, and a reverted tx
+func summaryBlock() []InternalActionTraceList {
+	frame := func(callType uint8, value int64, traceAddress ...uint32) *InternalActionTrace {
+		return &InternalActionTrace{
+			Action:       InternalAction{CallType: callType, Value: big.NewInt(value)},
+			Result:       &InternalTraceActionResult{},
+			TraceAddress: traceAddress,
+		}
+	}
+	failed := func(trace *InternalActionTrace) *InternalActionTrace {
+		trace.Result, trace.Error = nil, "execution reverted"
+		return trace
+	}
+	suicide := &InternalActionTrace{Action: InternalAction{CallType: CallTypeSuicide, Balance: big.NewInt(50)}, TraceAddress: []uint32{1, 0}}
+	block := common.Hash{0xb}
+	return []InternalActionTraceList{
+		{BlockHash: block, TransactionHash: common.Hash{0x1}, Traces: []*InternalActionTrace{
+			frame(CallTypeCall, 1),
+			frame(CallTypeCall, 100, 0),
+			frame(CallTypeDelegateCall, 100, 0, 0), // the value of the parent frame
+			frame(CallTypeCreate, 50, 1),
+			suicide,
+			failed(frame(CallTypeCall, 7, 2)),
+			frame(CallTypeCall, 3, 2, 0),
+			frame(CallTypeCreate, 2, 2, 0, 0),
+		}},
+		{BlockHash: block, TransactionHash: common.Hash{0x2}, TransactionPosition: 1, Traces: []*InternalActionTrace{
+			frame(CallTypeCreate, 9),
+			frame(CallTypeStaticCall, 0, 0),
+		}},
+		{BlockHash: block, TransactionHash: common.Hash{0x3}, TransactionPosition: 2, Traces: []*InternalActionTrace{
+			failed(frame(CallTypeCall, 0)),
+			frame(CallTypeCall, 11, 0),
+		}},
+	}
+}
+
+func TestComputeBlockSummary(t *testing.T) {
+	want := BlockTraceSummary{
+		Txs:           3,
+		InternalCalls: 6,
+		InternalValue: big.NewInt(200), // the call, the create and the suicide of the first tx
+		Creates:       3,
+		Suicides:      1,
+		FailedFrames:  2,
+	}
+	if have := ComputeBlockSummary(summaryBlock()); !reflect.DeepEqual(have, want) {
+		t.Fatalf("summary mismatch:\nhave %+v\nwant %+v", have, want)
+	}
+	if have := ComputeBlockSummary(nil); have.Txs != 0 || have.InternalValue.Sign() != 0 {
+		t.Fatalf("empty block summary mismatch: %+v", have)
+	}
+
+	// values beyond 64 bits don't overflow
+	huge := new(big.Int).Lsh(big.NewInt(1), 200)
+	lists := []InternalActionTraceList{{Traces: []*InternalActionTrace{
+		{Action: InternalAction{CallType: CallTypeCall}},
+		{Action: InternalAction{CallType: CallTypeCall, Value: huge}, TraceAddress: []uint32{0}},
+		{Action: InternalAction{CallType: CallTypeCall, Value: huge}, TraceAddress: []uint32{1}},
+	}}}
+	if have := ComputeBlockSummary(lists).InternalValue; have.Cmp(new(big.Int).Lsh(huge, 1)) != 0 {
+		t.Fatalf("huge value sum mismatch: have %v", have)
+	}
+}
+
+func TestRecomputeBlockSummary(t *testing.T) {
+	store := &summaryMemoryStore{MemoryStore{data: make(map[common.Hash][]byte)}, make(map[common.Hash][]byte)}
+	var txHashes []common.Hash
+	for _, list := range summaryBlock() {
+		raw, err := rlp.EncodeToBytes(&list)
+		if err != nil {
+			t.Fatalf("failed to encode traces: %v", err)
+		}
+		store.data[list.TransactionHash] = raw
+		txHashes = append(txHashes, list.TransactionHash)
+	}
+	want := ComputeBlockSummary(summaryBlock())
+	have, err := RecomputeBlockSummary(context.Background(), store, txHashes)
+	if err != nil {
+		t.Fatalf("failed to recompute summary: %v", err)
+	}
+	if !reflect.DeepEqual(*have, want) {
+		t.Fatalf("recomputed summary mismatch:\nhave %+v\nwant %+v", *have, want)
+	}
+	stored, err := ReadBlockSummary(context.Background(), store, common.Hash{0xb})
+	if err != nil {
+		t.Fatalf("failed to read summary: %v", err)
+	}
+	if !reflect.DeepEqual(*stored, want) {
+		t.Fatalf("stored summary mismatch:\nhave %+v\nwant %+v", *stored, want)
+	}
+	if _, err := ReadBlockSummary(context.Background(), store, common.Hash{0xc}); !errors.Is(err, ErrBlockSummaryNotFound) {
+		t.Fatalf("missing summary error mismatch: have %v, want %v", err, ErrBlockSummaryNotFound)
+	}
+
+	// the simple transfers persisted as a marker count as txs, a summary of them only has no block to be stored under
+	store.data[common.Hash{0x9}] = []byte{simpleTransferMarker}
+	withTransfer, err := RecomputeBlockSummary(context.Background(), store, append([]common.Hash{{0x9}}, txHashes...))
+	if err != nil {
+		t.Fatalf("failed to recompute summary with a simple transfer: %v", err)
+	}
+	if want := want.Txs + 1; withTransfer.Txs != want || withTransfer.InternalCalls != have.InternalCalls || withTransfer.InternalValue.Cmp(have.InternalValue) != 0 {
+		t.Fatalf("summary with a simple transfer mismatch: %+v", *withTransfer)
+	}
+	stored, err = ReadBlockSummary(context.Background(), store, common.Hash{0xb})
+	if err != nil || !reflect.DeepEqual(*stored, *withTransfer) {
+		t.Fatalf("stored summary with a simple transfer mismatch: %+v, %v", stored, err)
+	}
+	transfers, err := RecomputeBlockSummary(context.Background(), store, []common.Hash{{0x9}})
+	if err != nil || transfers.Txs != 1 {
+		t.Fatalf("summary of a simple transfer mismatch: %+v, %v", transfers, err)
+	}
+	if _, err := ReadBlockSummary(context.Background(), store, common.Hash{}); !errors.Is(err, ErrBlockSummaryNotFound) {
+		t.Fatalf("summary of a simple transfer stored: %v", err)
+	}
+
+	// a plain trace store only computes the summary
+	if _, err := RecomputeBlockSummary(context.Background(), &store.MemoryStore, txHashes); err != nil {
+		t.Fatalf("failed to recompute summary: %v", err)
+	}
+	if _, err := RecomputeBlockSummary(context.Background(), store, []common.Hash{{0x1}, {0x4}}); !errors.Is(err, ErrTxTraceNotFound) {
+		t.Fatalf("missing trace error mismatch: have %v, want %v", err, ErrTxTraceNotFound)
+	}
+	other, _ := rlp.EncodeToBytes(&InternalActionTraceList{BlockHash: common.Hash{0xc}, BlockNumber: new(big.Int)})
+	store.data[common.Hash{0x4}] = other
+	if _, err := RecomputeBlockSummary(context.Background(), store, []common.Hash{{0x1}, {0x4}}); !errors.Is(err, ErrMalformedTrace) {
+		t.Fatalf("block mismatch error mismatch: have %v, want %v", err, ErrMalformedTrace)
+	}
+}
@@ -0,0 +1,207 @@
+// Package testutil replays callTracer fixtures against the tracer, so that external test suites can
+// validate tracer changes against their own fixtures.
+package testutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"reflect"
+
+	"github.com/DeBankDeFi/etherlib/pkg/txtracev2"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/tests"
+)
+
+// ErrInvalidFixture is returned for fixtures which can't be decoded or miss a required field.
+var ErrInvalidFixture = errors.New("invalid fixture")
+
+// ErrResultMismatch is returned when the traces of a replayed fixture differ from its expected result.
+var ErrResultMismatch = errors.New("result mismatch")
+
+// Fixture is a callTracer test: a tx run on top of the genesis state in the given block context, along
+// with its expected traces.
+type Fixture struct {
+	Genesis *core.Genesis             `json:"genesis"`
+	Context *FixtureContext           `json:"context"`
+	Input   string                    `json:"input"` // rlp encoded tx
+	Result  txtracev2.ActionTraceList `json:"result"`
+}
+
+// FixtureContext is the block context the tx of a fixture runs in.
+type FixtureContext struct {
+	Number     math.HexOrDecimal64   `json:"number"`
+	Difficulty *math.HexOrDecimal256 `json:"difficulty"`
+	Time       math.HexOrDecimal64   `json:"timestamp"`
+	GasLimit   math.HexOrDecimal64   `json:"gasLimit"`
+	Miner      common.Address        `json:"miner"`
+}
+
+// LoadFixture reads and decodes the fixture at path. Unknown fields are rejected to catch misspelled ones.
+func LoadFixture(path string) (*Fixture, error) {
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeFixture(blob)
+}
+
+// DecodeFixture decodes a JSON fixture, see LoadFixture.
+func DecodeFixture(blob []byte) (*Fixture, error) {
+	dec := json.NewDecoder(bytes.NewReader(blob))
+	dec.DisallowUnknownFields()
+	fixture := new(Fixture)
+	if err := dec.Decode(fixture); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidFixture, err)
+	}
+	switch {
+	case fixture.Genesis == nil || fixture.Genesis.Config == nil:
+		return nil, fmt.Errorf("%w: missing genesis config", ErrInvalidFixture)
+	case fixture.Context == nil:
+		return nil, fmt.Errorf("%w: missing context", ErrInvalidFixture)
+	case fixture.Input == "":
+		return nil, fmt.Errorf("%w: missing input", ErrInvalidFixture)
+	case fixture.Result == nil:
+		return nil, fmt.Errorf("%w: missing result", ErrInvalidFixture)
+	}
+	return fixture, nil
+}
+
+// RunFixture replays the fixture at path and compares its traces, both the ones of the tracer and the
+// ones read back from the store, to the expected result. A mismatch is reported with ErrResultMismatch.
+func RunFixture(path string) error {
+	fixture, err := LoadFixture(path)
+	if err != nil {
+		return err
+	}
+	return fixture.Check()
+}
+
+// Check replays the fixture and compares its traces to the expected result, see RunFixture.
+func (f *Fixture) Check() error {
+	traces, stored, err := f.replay()
+	if err != nil {
+		return err
+	}
+	if err := compareTraces(traces, f.Result); err != nil {
+		return err
+	}
+	if err := compareTraces(stored, f.Result); err != nil {
+		return fmt.Errorf("stored traces: %w", err)
+	}
+	return nil
+}
+
+// Replay runs the tx of the fixture and returns its traces.
+func (f *Fixture) Replay() (txtracev2.ActionTraceList, error) {
+	traces, _, err := f.replay()
+	return traces, err
+}
+
+// replay runs the tx of the fixture, returning the traces of the tracer and the ones it persisted
+func (f *Fixture) replay() (txtracev2.ActionTraceList, txtracev2.ActionTraceList, error) {
+	tx := new(types.Transaction)
+	if err := rlp.DecodeBytes(common.FromHex(f.Input), tx); err != nil {
+		return nil, nil, fmt.Errorf("%w: failed to decode input: %v", ErrInvalidFixture, err)
+	}
+	blockNumber := new(big.Int).SetUint64(uint64(f.Context.Number))
+	signer := types.MakeSigner(f.Genesis.Config, blockNumber, uint64(f.Context.Time))
+	origin, err := signer.Sender(tx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: failed to recover sender: %v", ErrInvalidFixture, err)
+	}
+	blkContext := vm.BlockContext{
+		CanTransfer: core.CanTransfer,
+		Transfer:    core.Transfer,
+		Coinbase:    f.Context.Miner,
+		GasLimit:    uint64(f.Context.GasLimit),
+		BlockNumber: blockNumber,
+		Time:        uint64(f.Context.Time),
+		Difficulty:  (*big.Int)(f.Context.Difficulty),
+	}
+	txContext := vm.TxContext{
+		Origin:   origin,
+		GasPrice: tx.GasPrice(),
+	}
+
+	state := tests.MakePreState(rawdb.NewMemoryDatabase(), f.Genesis.Alloc, false, rawdb.HashScheme)
+	defer state.Close()
+
+	store := &memoryStore{data: make(map[common.Hash][]byte)}
+	tracer := txtracev2.NewOeTracer(store, common.Hash{}, blockNumber, tx.Hash(), 0)
+	evm := vm.NewEVM(blkContext, txContext, state.StateDB, f.Genesis.Config, vm.Config{Tracer: tracer})
+	msg, err := core.TransactionToMessage(tx, signer, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare tx: %w", err)
+	}
+	if _, err := core.NewStateTransition(evm, msg, new(core.GasPool).AddGas(tx.Gas())).TransitionDb(); err != nil {
+		return nil, nil, fmt.Errorf("failed to execute tx: %w", err)
+	}
+	traces, err := tracer.GetTraces()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get traces: %w", err)
+	}
+	if err := tracer.PersistTraceContext(context.Background()); err != nil {
+		return nil, nil, fmt.Errorf("failed to persist traces: %w", err)
+	}
+	stored, err := txtracev2.ReadRpcTxTrace(context.Background(), store, tx.Hash())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read traces: %w", err)
+	}
+	return traces, stored, nil
+}
+
+// compareTraces compares the traces by their JSON form, which is what fixtures record
+func compareTraces(have, want txtracev2.ActionTraceList) error {
+	haveJSON, err := json.Marshal(have)
+	if err != nil {
+		return err
+	}
+	wantJSON, err := json.Marshal(want)
+	if err != nil {
+		return err
+	}
+	var haveTraces, wantTraces txtracev2.ActionTraceList
+	if err := json.Unmarshal(haveJSON, &haveTraces); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(wantJSON, &wantTraces); err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(haveTraces, wantTraces) {
+		return fmt.Errorf("%w:\nhave %s\nwant %s", ErrResultMismatch, haveJSON, wantJSON)
+	}
+	return nil
+}
+
+// memoryStore keeps the traces of the replayed tx
+type memoryStore struct {
+	data map[common.Hash][]byte
+}
+
+func (store *memoryStore) ReadTxTrace(ctx context.Context, txHash common.Hash) ([]byte, error) {
+	if raw, ok := store.data[txHash]; ok {
+		return raw, nil
+	}
+	return nil, txtracev2.ErrTxTraceNotFound
+}
+
+func (store *memoryStore) Has(ctx context.Context, txHash common.Hash) (bool, error) {
+	_, ok := store.data[txHash]
+	return ok, nil
+}
+
+func (store *memoryStore) WriteTxTrace(ctx context.Context, txHash common.Hash, trace []byte) error {
+	store.data[txHash] = trace
+	return nil
+}
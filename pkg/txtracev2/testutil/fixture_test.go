@@ -0,0 +1,52 @@
+package testutil
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunFixture(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("..", "testdata", "call_tracer_*.json"))
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("failed to find fixtures: %v", err)
+	}
+	for _, path := range paths {
+		path := path
+		t.Run(strings.TrimSuffix(filepath.Base(path), ".json"), func(t *testing.T) {
+			t.Parallel()
+			if err := RunFixture(path); err != nil {
+				t.Fatalf("fixture failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestFixtureMismatch(t *testing.T) {
+	fixture, err := LoadFixture(filepath.Join("..", "testdata", "call_tracer_create.json"))
+	if err != nil {
+		t.Fatalf("failed to load fixture: %v", err)
+	}
+	fixture.Result[0].Result.GasUsed++
+	if err := fixture.Check(); !errors.Is(err, ErrResultMismatch) {
+		t.Fatalf("mismatch not reported: %v", err)
+	}
+}
+
+func TestDecodeFixture(t *testing.T) {
+	for name, blob := range map[string]string{
+		"malformed":     "{",
+		"unknown field": `{"genesis": {"config": {}}, "context": {}, "input": "0x00", "result": [], "output": "0x"}`,
+		"no genesis":    `{"context": {}, "input": "0x00", "result": []}`,
+		"no result":     `{"genesis": {"config": {}}, "context": {}, "input": "0x00"}`,
+	} {
+		if _, err := DecodeFixture([]byte(blob)); !errors.Is(err, ErrInvalidFixture) {
+			t.Errorf("%s: error mismatch: %v", name, err)
+		}
+	}
+	if err := RunFixture("missing.json"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("missing fixture error mismatch: %v", err)
+	}
+}
@@ -1,10 +1,17 @@
 package txtracev2
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"math/big"
+	"slices"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/log"
@@ -55,16 +62,181 @@ func memorySlice(memory []byte, offset, size uint64) []byte {
 	return memory[offset : offset+size]
 }
 
+// memoryInput copies the input of a call or create whose pre-processing failed out of memory, inputs larger
+// than maxTxPacketSize are dropped. The stack operands are 256-bit, they're checked before the uint64 conversion.
+func memoryInput(memory []byte, offset, size *uint256.Int) []byte {
+	if size.IsZero() {
+		return nil
+	}
+	if !offset.IsUint64() || !size.IsUint64() {
+		log.Warn("Tracer accessed out of bound memory", "offset", offset, "size", size)
+		return nil
+	}
+	if size.Uint64() >= maxTxPacketSize {
+		return nil
+	}
+	input := make([]byte, size.Uint64())
+	copy(input, memorySlice(memory, offset.Uint64(), size.Uint64()))
+	return input
+}
+
 type OeTracer struct {
 	store        Store
 	traceStack   []*InternalActionTrace
 	outPutTraces InternalActionTraceList
 	env          *vm.EVM
 	stateDiff    StateDiff
+	diffJournal  [][]diffChange // per frame the evm is in, the state diff changes undone if it fails
+
+	maxDepth     int // 0 means unlimited
+	skippedDepth int // number of nested frames entered below maxDepth or into an excluded precompile
+
+	addressFilter map[common.Address]struct{} // only the frames involving them and their ancestors are kept
+	filterStack   []filterFrame               // per frame in traceStack when filtering
+
+	excludePrecompiles bool
+	precompiles        map[common.Address]struct{} // active precompiles, only known when they're excluded
+	cancun             bool                        // SELFDESTRUCT only deletes accounts created in the tx (EIP-6780)
+
+	state tracerState
+	force bool // finalize dangling frames instead of failing with ErrTraceIncomplete
+
+	persistHook  PersistHook
+	config       TracerConfig
+	writeTimeout time.Duration // bounds the writes of a context without deadline, 0 means unbounded
+
+	compression      CompressionCodec // of the persisted traces, see WithCompression
+	compressionLevel int
+
+	senderOverride *common.Address // from of the top-level frame, see SetSenderOverride
+	impersonated   bool
+	txGasLimit     uint64 // gas available to the tx, the gasUsed of its receipt is known from the gas left at its end
+
+	done        <-chan struct{} // recording stops once closed, nil means never
+	ctx         context.Context
+	interrupted error // the context error recording stopped with
+}
+
+// filterFrame tracks whether a frame being recorded involves a filtered address, itself or in its sub traces
+type filterFrame struct {
+	index   int // of the frame in the recorded traces
+	matched bool
+}
+
+// tracerState is the lifecycle of OeTracer: created -> capturing -> finalized
+type tracerState uint8
+
+const (
+	stateCreated tracerState = iota
+	stateCapturing
+	stateFinalized
+)
+
+// ErrTraceIncomplete is returned when traces are read or persisted before the execution completed,
+// e.g. the evm panicked between CaptureEnter and CaptureExit.
+var ErrTraceIncomplete = errors.New("trace incomplete")
+
+// ErrTraceNotStarted is set on the top-level trace of a tx the evm ended without starting it, e.g. when it
+// failed a precheck, unless the evm reported an error of its own.
+var ErrTraceNotStarted = errors.New("trace ended before it started")
+
+// ErrTraceInterrupted is set on the frames cut short by the cancellation of the tracer's context.
+var ErrTraceInterrupted = errors.New("trace interrupted")
+
+var (
+	// ErrTraceEncode is wrapped by the errors of PersistTraceContext when the traces can't be rlp encoded.
+	ErrTraceEncode = errors.New("failed to encode tx trace")
+	// ErrTraceWrite is wrapped by the errors of PersistTraceContext when the store failed to write the traces.
+	ErrTraceWrite = errors.New("failed to persist tx trace")
+)
+
+// Option configures optional behaviours of OeTracer.
+type Option func(ot *OeTracer)
+
+// WithMaxDepth stops recording sub traces whose traceAddress is longer than depth, their recorded
+// parent is marked SubtracesTruncated. Like every frame not recorded, they don't count in its Subtraces.
+func WithMaxDepth(depth int) Option {
+	return func(ot *OeTracer) {
+		ot.maxDepth = depth
+	}
+}
+
+// WithIncludePrecompiles sets whether the calls to the precompiled contracts active in the block are
+// recorded, they are by default. Excluded calls don't count in the Subtraces of their parent.
+func WithIncludePrecompiles(include bool) Option {
+	return func(ot *OeTracer) {
+		ot.excludePrecompiles = !include
+	}
+}
+
+// WithForce makes GetTraces and PersistTrace finalize a tracer whose execution didn't complete,
+// the frames left open are marked with the error "trace incomplete" instead of failing.
+func WithForce() Option {
+	return func(ot *OeTracer) {
+		ot.force = true
+	}
+}
+
+// PersistHook is called after the traces of a tx are written to the store, e.g. to export metrics.
+type PersistHook func(txHash common.Hash, encodedBytes int, traceCount int)
+
+// WithPersistHook sets the hook called by PersistTrace after every successful write.
+func WithPersistHook(hook PersistHook) Option {
+	return func(ot *OeTracer) {
+		ot.persistHook = hook
+	}
 }
 
-func NewOeTracer(db Store, blockHash common.Hash, blockNumber *big.Int, transactionHash common.Hash, transactionPosition uint64) *OeTracer {
-	return &OeTracer{
+// WithWriteTimeout bounds how long PersistTrace and its variants wait for the store when the context they
+// are given has no deadline of its own, e.g. context.Background, so a stalled store can't hang a shutdown.
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(ot *OeTracer) {
+		ot.writeTimeout = timeout
+	}
+}
+
+// WithTracerConfig sets the form of the traces returned by GetTraces and GetTracesWithMeta, what is
+// persisted only depends on whether simple transfers are skipped.
+func WithTracerConfig(cfg TracerConfig) Option {
+	return func(ot *OeTracer) {
+		ot.config = cfg
+	}
+}
+
+// WithBlockTimestamp sets the timestamp of the block the traced tx is in.
+func WithBlockTimestamp(timestamp uint64) Option {
+	return func(ot *OeTracer) {
+		ot.outPutTraces.Timestamp = timestamp
+	}
+}
+
+// WithAddressFilter only keeps the frames from, to or at one of addrs, e.g. the contracts of a monitored
+// protocol, along with their ancestors, the top-level frame is always kept. Other frames are dropped as soon
+// as they exit, the parents of dropped frames are marked SubtracesTruncated while their Subtraces still count
+// them: the kept frames have the traceAddress they have in the full traces.
+func WithAddressFilter(addrs ...common.Address) Option {
+	return func(ot *OeTracer) {
+		ot.addressFilter = make(map[common.Address]struct{}, len(addrs))
+		for _, addr := range addrs {
+			ot.addressFilter[addr] = struct{}{}
+		}
+	}
+}
+
+// WithContext stops recording once ctx is cancelled or its deadline exceeded, the frames open at that
+// moment are marked with ErrTraceInterrupted. Cancelling the evm run itself is up to the caller.
+func WithContext(ctx context.Context) Option {
+	return func(ot *OeTracer) {
+		ot.ctx = ctx
+		ot.done = ctx.Done()
+	}
+}
+
+func NewOeTracer(db Store, blockHash common.Hash, blockNumber *big.Int, transactionHash common.Hash, transactionPosition uint64, opts ...Option) *OeTracer {
+	if blockNumber == nil {
+		blockNumber = new(big.Int)
+	}
+	ot := &OeTracer{
 		store: db,
 		outPutTraces: InternalActionTraceList{
 			BlockHash:           blockHash,
@@ -74,20 +246,135 @@ func NewOeTracer(db Store, blockHash common.Hash, blockNumber *big.Int, transact
 		},
 		stateDiff: make(StateDiff),
 	}
+	for _, opt := range opts {
+		opt(ot)
+	}
+	return ot
+}
+
+// checkInterrupted reports whether recording stopped because the context is done, the frames open when
+// it's first noticed are marked interrupted and left to be closed by their exits.
+func (ot *OeTracer) checkInterrupted() bool {
+	if ot.interrupted != nil {
+		return true
+	}
+	select {
+	case <-ot.done:
+	default:
+		return false
+	}
+	ot.interrupted = ot.ctx.Err()
+	log.Warn("Tx trace interrupted", "txHash", ot.outPutTraces.TransactionHash.String(), "open", len(ot.traceStack), "err", ot.interrupted)
+	for _, internalTrace := range ot.traceStack {
+		internalTrace.Error = fmt.Sprintf("%v: %v", ErrTraceInterrupted, ot.interrupted)
+		internalTrace.Result = nil
+	}
+	return true
+}
+
+// skipEnter reports whether the frame being entered is below maxDepth, a call to an excluded precompile,
+// or the trace was interrupted, and must not be recorded. Frames not recorded aren't counted as subtraces.
+func (ot *OeTracer) skipEnter(typ vm.OpCode, to common.Address) bool {
+	if ot.skippedDepth > 0 || ot.checkInterrupted() {
+		ot.skippedDepth++
+		return true
+	}
+	// excluded precompile calls aren't truncated sub traces
+	if _, ok := ot.precompiles[to]; ok && typ != vm.CREATE && typ != vm.CREATE2 && typ != vm.SELFDESTRUCT {
+		ot.skippedDepth = 1
+		return true
+	}
+	if ot.maxDepth > 0 && len(ot.traceStack) > ot.maxDepth {
+		ot.traceStack[len(ot.traceStack)-1].SubtracesTruncated = true
+		ot.skippedDepth = 1
+		return true
+	}
+	return false
+}
+
+// skipExit reports whether the frame being exited was not recorded
+func (ot *OeTracer) skipExit() bool {
+	if ot.skippedDepth > 0 {
+		ot.skippedDepth--
+		return true
+	}
+	return false
+}
+
+// internInput returns a copy of input owned by the tracer. Frames forwarding the whole or a suffix of
+// the parent frame's input (e.g. proxies delegating calldata) share the parent's copy instead, such
+// inputs are copied again only when converted to rpc traces.
+func (ot *OeTracer) internInput(input []byte) ([]byte, bool) {
+	if len(input) > 0 && len(ot.traceStack) > 0 {
+		parent := &ot.traceStack[len(ot.traceStack)-1].Action
+		parentInput := parent.Input
+		if parent.CallType == CallTypeCreate {
+			parentInput = parent.Init
+		}
+		if offset := len(parentInput) - len(input); offset >= 0 && bytes.Equal(parentInput[offset:], input) {
+			return parentInput[offset:len(parentInput):len(parentInput)], true
+		}
+	}
+	owned := make([]byte, len(input))
+	copy(owned, input)
+	return owned, false
+}
+
+// pushTrace records the frame entered
+func (ot *OeTracer) pushTrace(internalTrace *InternalActionTrace) {
+	if ot.addressFilter != nil {
+		ot.filterStack = append(ot.filterStack, filterFrame{index: len(ot.outPutTraces.Traces), matched: ot.filtered(&internalTrace.Action)})
+	}
+	ot.outPutTraces.Traces = append(ot.outPutTraces.Traces, internalTrace)
+	ot.traceStack = append(ot.traceStack, internalTrace)
+}
+
+// filtered reports whether the action is from, to or at an address of the filter
+func (ot *OeTracer) filtered(action *InternalAction) bool {
+	for _, addr := range []*common.Address{action.From, action.To, action.Address} {
+		if addr == nil {
+			continue
+		}
+		if _, ok := ot.addressFilter[*addr]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// filterExit drops the frame exited along with its sub traces unless one of them involves a filtered address,
+// a kept frame keeps its parent in turn
+func (ot *OeTracer) filterExit() {
+	if len(ot.filterStack) == 0 {
+		return
+	}
+	frame := ot.filterStack[len(ot.filterStack)-1]
+	ot.filterStack = ot.filterStack[:len(ot.filterStack)-1]
+	if len(ot.filterStack) == 0 {
+		return
+	}
+	parent := &ot.filterStack[len(ot.filterStack)-1]
+	if frame.matched {
+		parent.matched = true
+		return
+	}
+	ot.outPutTraces.Traces[parent.index].SubtracesTruncated = true
+	clear(ot.outPutTraces.Traces[frame.index:])
+	ot.outPutTraces.Traces = ot.outPutTraces.Traces[:frame.index]
 }
 
 // createEnter handles CREATE/CREATE2 op start
-func (ot *OeTracer) createEnter(from common.Address, address common.Address, input []byte, gas uint64, value *big.Int) {
+func (ot *OeTracer) createEnter(method string, from common.Address, address common.Address, input []byte, gas uint64, value *big.Int) {
 	action := InternalAction{
-		CallType: CallTypeCreate,
-		From:     &from,
-		To:       nil,
-		Value:    value,
-		Gas:      gas,
-		Init:     make([]byte, len(input)),
-		Address:  &address,
-	}
-	copy(action.Init, input)
+		CallType:     CallTypeCreate,
+		From:         &from,
+		To:           nil,
+		Value:        value,
+		Gas:          gas,
+		Address:      &address,
+		CreateMethod: method,
+	}
+	action.Init, action.interned = ot.internInput(input)
 	internalTrace := &InternalActionTrace{
 		Action:       action,
 		TraceAddress: make([]uint32, 0),
@@ -98,8 +385,7 @@ func (ot *OeTracer) createEnter(from common.Address, address common.Address, inp
 		internalTrace.TraceAddress = append(internalTrace.TraceAddress, ot.traceStack[len(ot.traceStack)-1].Subtraces)
 		ot.traceStack[len(ot.traceStack)-1].Subtraces++
 	}
-	ot.outPutTraces.Traces = append(ot.outPutTraces.Traces, internalTrace)
-	ot.traceStack = append(ot.traceStack, internalTrace)
+	ot.pushTrace(internalTrace)
 }
 
 // captureExit handles CREATE/CREATE2 op exit
@@ -119,32 +405,38 @@ func (ot *OeTracer) createExit(internalTrace *InternalActionTrace, output []byte
 	}
 }
 
-// callEnter handles CALL, CALL_CODE, DELEGATE_CALL, STATIC_CALL op start
-func (ot *OeTracer) callEnter(callType uint8, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
+// callEnter handles CALL, CALL_CODE, DELEGATE_CALL, STATIC_CALL op start, along with the calls of
+// registered and unknown opcodes, which are rendered with callTypeName
+func (ot *OeTracer) callEnter(callType uint8, callTypeName string, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
 	action := InternalAction{
-		CallType: callType,
-		From:     &from,
-		To:       &to,
-		Value:    value,
-		Gas:      gas,
-		Input:    make([]byte, len(input)),
-	}
-	copy(action.Input, input)
+		CallType:     callType,
+		From:         &from,
+		To:           &to,
+		Value:        value,
+		Gas:          gas,
+		CallTypeName: callTypeName,
+	}
+	action.Input, action.interned = ot.internInput(input)
 	internalTrace := &InternalActionTrace{
 		Action:       action,
 		TraceAddress: make([]uint32, 0),
 	}
+	if len(ot.traceStack) > 0 && (callType == CallTypeDelegateCall || callType == CallTypeCallCode) {
+		if storage := ot.traceStack[len(ot.traceStack)-1].storageContext(); storage != nil {
+			storageAddress := *storage
+			internalTrace.StorageAddress = &storageAddress
+		}
+	}
 	if len(ot.traceStack) > 0 {
 		internalTrace.TraceAddress = make([]uint32, len(ot.traceStack[len(ot.traceStack)-1].TraceAddress))
 		copy(internalTrace.TraceAddress, ot.traceStack[len(ot.traceStack)-1].TraceAddress)
 		internalTrace.TraceAddress = append(internalTrace.TraceAddress, ot.traceStack[len(ot.traceStack)-1].Subtraces)
 		ot.traceStack[len(ot.traceStack)-1].Subtraces++
 	}
-	ot.outPutTraces.Traces = append(ot.outPutTraces.Traces, internalTrace)
-	ot.traceStack = append(ot.traceStack, internalTrace)
+	ot.pushTrace(internalTrace)
 }
 
-// callExit handles CALL, CALL_CODE, DELEGATE_CALL, STATIC_CALL op exit
+// callExit handles CALL, CALL_CODE, DELEGATE_CALL, STATIC_CALL op exit, and the ones of other call opcodes
 func (ot *OeTracer) callExit(internalTrace *InternalActionTrace, output []byte, gasUsed uint64, err error) {
 	if internalTrace.Error != "" {
 		internalTrace.Result = nil
@@ -168,6 +460,11 @@ func (ot *OeTracer) suicideEnter(address common.Address, refundAddress common.Ad
 		RefundAddress: &refundAddress,
 		Balance:       Balance,
 	}
+	if ot.cancun {
+		// the evm already ran the op, the account is only marked when it was created in the tx
+		destroyed := ot.env.StateDB.HasSelfDestructed(address)
+		action.Destroyed = &destroyed
+	}
 	internalTrace := &InternalActionTrace{
 		Action:       action,
 		TraceAddress: make([]uint32, 0),
@@ -178,8 +475,7 @@ func (ot *OeTracer) suicideEnter(address common.Address, refundAddress common.Ad
 		internalTrace.TraceAddress = append(internalTrace.TraceAddress, ot.traceStack[len(ot.traceStack)-1].Subtraces)
 		ot.traceStack[len(ot.traceStack)-1].Subtraces++
 	}
-	ot.outPutTraces.Traces = append(ot.outPutTraces.Traces, internalTrace)
-	ot.traceStack = append(ot.traceStack, internalTrace)
+	ot.pushTrace(internalTrace)
 }
 
 // suicideExit handles SELFDESTRUCT op exit
@@ -192,18 +488,58 @@ func (ot *OeTracer) suicideExit(internalTrace *InternalActionTrace, output []byt
 	}
 }
 
+// SetSenderOverride sets the from of the top-level frame to addr instead of the sender the evm executes the
+// message with, e.g. to display the original sender of a tx whose signature can't be recovered. impersonated
+// flags the frame as run by an impersonated sender in the verbose traces. It must be called before the
+// execution starts, the traces of a tx with an overridden sender are never skipped as a simple transfer.
+func (ot *OeTracer) SetSenderOverride(addr common.Address, impersonated bool) {
+	ot.senderOverride = &addr
+	ot.impersonated = impersonated
+}
+
+// SetBlockHash sets the hash of the block the traced tx is in, e.g. for pending blocks whose hash is only known
+// once all their txs executed. It must be called before the traces are read or persisted.
+func (ot *OeTracer) SetBlockHash(blockHash common.Hash) {
+	ot.outPutTraces.BlockHash = blockHash
+}
+
 // CaptureStart handles top call/create start
 func (ot *OeTracer) CaptureStart(env *vm.EVM, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) {
+	if ot.senderOverride != nil {
+		from = *ot.senderOverride
+	}
 	if create {
-		ot.createEnter(from, to, input, gas, value)
+		ot.createEnter(CreateMethodCreate, from, to, input, gas, value)
 	} else {
-		ot.callEnter(CallTypeCall, from, to, input, gas, value)
+		ot.callEnter(CallTypeCall, "", from, to, input, gas, value)
 	}
+	ot.traceStack[len(ot.traceStack)-1].Impersonated = ot.impersonated
 	ot.env = env
+	ot.state = stateCapturing
+	ot.enterDiffFrame()
+	ot.cancun = false
+	if env != nil {
+		rules := env.ChainConfig().Rules(env.Context.BlockNumber, env.Context.Random != nil, env.Context.Time)
+		ot.cancun = rules.IsCancun
+		if ot.excludePrecompiles {
+			ot.precompiles = make(map[common.Address]struct{})
+			for _, addr := range vm.ActivePrecompiles(rules) {
+				ot.precompiles[addr] = struct{}{}
+			}
+		}
+		if !create && len(input) > 0 && env.StateDB.GetCodeSize(to) == 0 && !slices.Contains(vm.ActivePrecompiles(rules), to) {
+			ot.traceStack[len(ot.traceStack)-1].EOAInput = true
+		}
+	}
 }
 
 // CaptureEnd handles top call/create end
 func (ot *OeTracer) CaptureEnd(output []byte, gasUsed uint64, err error) {
+	ot.exitDiffFrame(err)
+	if len(ot.traceStack) == 0 {
+		ot.endWithoutStart(err)
+		return
+	}
 	internalTrace := ot.traceStack[len(ot.traceStack)-1]
 	ot.traceStack = ot.traceStack[:len(ot.traceStack)-1]
 	if internalTrace.Action.CallType == CallTypeCreate {
@@ -211,42 +547,126 @@ func (ot *OeTracer) CaptureEnd(output []byte, gasUsed uint64, err error) {
 	} else {
 		ot.callExit(internalTrace, output, gasUsed, err)
 	}
+	ot.filterExit()
+	if len(ot.traceStack) == 0 {
+		ot.state = stateFinalized
+	}
+}
+
+// endWithoutStart records an error-only top-level trace for a tx the evm ended without starting it, a
+// repeated end of a trace is ignored
+func (ot *OeTracer) endWithoutStart(err error) {
+	if len(ot.outPutTraces.Traces) > 0 {
+		log.Error("Tx trace ended twice", "txHash", ot.outPutTraces.TransactionHash.String())
+		return
+	}
+	if err == nil {
+		err = ErrTraceNotStarted
+	}
+	log.Warn("Tx trace ended before it started", "txHash", ot.outPutTraces.TransactionHash.String(), "err", err)
+	ot.outPutTraces.Traces = append(ot.outPutTraces.Traces, &InternalActionTrace{
+		Action:       InternalAction{CallType: CallTypeCall, From: ot.senderOverride},
+		Error:        err.Error(),
+		TraceAddress: make([]uint32, 0),
+		Impersonated: ot.impersonated,
+	})
+	ot.state = stateFinalized
+}
+
+// RecordPreExecutionFailure records the only trace of a tx which failed before the evm ran, e.g. applying msg
+// failed with core.ErrInsufficientFunds or core.ErrNonceTooLow while re-tracing on a slightly off state: the
+// top-level frame of msg marked PreExecution, without result and failed with the OpenEthereum string of err.
+// Readers can then tell such txs from untraced ones. A tracer which already captured the tx is left as is.
+func (ot *OeTracer) RecordPreExecutionFailure(err error, msg core.Message) {
+	if ot.state != stateCreated || len(ot.outPutTraces.Traces) > 0 {
+		log.Error("Pre-execution failure of a traced tx", "txHash", ot.outPutTraces.TransactionHash.String(), "err", err)
+		return
+	}
+	from := msg.From
+	if ot.senderOverride != nil {
+		from = *ot.senderOverride
+	}
+	action := preExecutionAction(from, msg.To, msg.Value, msg.Data)
+	action.Gas = msg.GasLimit
+	if err == nil {
+		err = ErrTraceNotStarted
+	}
+	ot.outPutTraces.Traces = append(ot.outPutTraces.Traces, &InternalActionTrace{
+		Action:       action,
+		Error:        ParityErrorString(err),
+		TraceAddress: make([]uint32, 0),
+		Impersonated: ot.impersonated,
+		PreExecution: true,
+	})
+	ot.state = stateFinalized
 }
 
 // CaptureEnter handles sub call/create/suide start
 func (ot *OeTracer) CaptureEnter(typ vm.OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
+	// the storage changes of frames which are not recorded matter as well
+	ot.enterDiffFrame()
+	if ot.skipEnter(typ, to) {
+		return
+	}
 	switch typ {
-	case vm.CREATE, vm.CREATE2:
-		ot.createEnter(from, to, input, gas, value)
+	case vm.CREATE:
+		ot.createEnter(CreateMethodCreate, from, to, input, gas, value)
+	case vm.CREATE2:
+		ot.createEnter(CreateMethodCreate2, from, to, input, gas, value)
 	case vm.CALL:
-		ot.callEnter(CallTypeCall, from, to, input, gas, value)
+		ot.callEnter(CallTypeCall, "", from, to, input, gas, value)
 	case vm.CALLCODE:
-		ot.callEnter(CallTypeCallCode, from, to, input, gas, value)
+		ot.callEnter(CallTypeCallCode, "", from, to, input, gas, value)
 	case vm.DELEGATECALL:
-		ot.callEnter(CallTypeDelegateCall, from, to, input, gas, value)
+		ot.callEnter(CallTypeDelegateCall, "", from, to, input, gas, value)
 	case vm.STATICCALL:
-		ot.callEnter(CallTypeStaticCall, from, to, input, gas, value)
+		ot.callEnter(CallTypeStaticCall, "", from, to, input, gas, value)
 	case vm.SELFDESTRUCT:
 		ot.suicideEnter(from, to, input, gas, value)
+	default:
+		// every frame entered must be pushed, the exit pops one regardless of the opcode
+		callType, name := lookupCallOpcode(typ)
+		ot.callEnter(callType, name, from, to, input, gas, value)
 	}
 }
 
 // CaptureExit handles sub call/create/suide end
 func (ot *OeTracer) CaptureExit(output []byte, gasUsed uint64, err error) {
+	ot.exitDiffFrame(err)
+	if ot.skipExit() {
+		return
+	}
+	if len(ot.traceStack) == 0 {
+		log.Error("Tx trace exited a frame it didn't enter", "txHash", ot.outPutTraces.TransactionHash.String())
+		return
+	}
 	internalTrace := ot.traceStack[len(ot.traceStack)-1]
 	ot.traceStack = ot.traceStack[:len(ot.traceStack)-1]
 	switch internalTrace.Action.CallType {
 	case CallTypeCreate:
 		ot.createExit(internalTrace, output, gasUsed, err)
-	case CallTypeCall, CallTypeCallCode, CallTypeDelegateCall, CallTypeStaticCall:
-		ot.callExit(internalTrace, output, gasUsed, err)
 	case CallTypeSuicide:
 		ot.suicideExit(internalTrace, output, gasUsed, err)
+	default:
+		ot.callExit(internalTrace, output, gasUsed, err)
 	}
+	ot.filterExit()
 }
 
 // CaptureState handles some pre-processing errors, CaptureEnter and CaptureExit will not be called on this case
 func (ot *OeTracer) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
+	if ot.checkInterrupted() {
+		return
+	}
+	// frames below maxDepth are not recorded, only their storage changes matter
+	if ot.skippedDepth > 0 && op != vm.SSTORE {
+		return
+	}
+	// the op failed before it was executed, e.g. an invalid opcode or out of gas, the evm doesn't call
+	// CaptureFault then
+	if err != nil {
+		ot.recordFault(pc, op, gas, depth)
+	}
 	switch op {
 	case vm.CREATE, vm.CREATE2:
 		value := stackPeek(scope.Stack, 0)
@@ -270,7 +690,7 @@ func (ot *OeTracer) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64, scop
 			ot.createPreProcessFailed(op, scope, gas, bigVal, err)
 			return
 		}
-		if err = ot.checkContractNotExist(scope.Contract.Address()); err != nil {
+		if err = ot.checkContractNotExist(ot.createdAddress(op, scope)); err != nil {
 			ot.createPreProcessFailed(op, scope, gas, bigVal, err)
 			return
 		}
@@ -302,36 +722,83 @@ func (ot *OeTracer) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64, scop
 			return
 		}
 	case vm.REVERT:
-		ot.traceStack[len(ot.traceStack)-1].Error = "execution reverted"
+		if len(ot.traceStack) > 0 {
+			ot.traceStack[len(ot.traceStack)-1].Error = "execution reverted"
+		}
 	case vm.SSTORE:
 		stackLen := len(scope.Stack.Data())
 		if stackLen >= 2 && ot.store == nil {
-			accountAddress := scope.Contract.Address()
-			if ot.stateDiff[accountAddress] == nil {
-				ot.stateDiff[accountAddress] = make(AccountDiff)
-			}
 			afterValue := common.Hash(scope.Stack.Data()[stackLen-2].Bytes32())
 			indexAddress := common.Hash(scope.Stack.Data()[stackLen-1].Bytes32())
-			if diff, ok := ot.stateDiff[accountAddress][indexAddress]; !ok {
-				beforeValue := ot.env.StateDB.GetState(accountAddress, indexAddress)
-				ot.stateDiff[accountAddress][indexAddress] = Diff{
-					BeforeValue: &beforeValue,
-					AfterValue:  &afterValue,
-				}
-			} else {
-				diff.AfterValue = &afterValue
-			}
+			ot.recordStorage(scope.Contract.Address(), indexAddress, afterValue)
+		}
+	}
+}
+
+// diffChange is a change of the state diff, along with the diff of the slot it replaced
+type diffChange struct {
+	address common.Address
+	slot    common.Hash
+	prev    *Diff // nil if the slot had no diff
+}
+
+// recordStorage records a storage write in the state diff, journaled to be undone if the frame fails
+func (ot *OeTracer) recordStorage(address common.Address, slot common.Hash, value common.Hash) {
+	if ot.stateDiff[address] == nil {
+		ot.stateDiff[address] = make(AccountDiff)
+	}
+	change := diffChange{address: address, slot: slot}
+	diff, ok := ot.stateDiff[address][slot]
+	if ok {
+		prev := diff
+		change.prev = &prev
+	} else {
+		beforeValue := ot.env.StateDB.GetState(address, slot)
+		diff.BeforeValue = &beforeValue
+	}
+	diff.AfterValue = &value
+	ot.stateDiff[address][slot] = diff
+	if len(ot.diffJournal) > 0 {
+		ot.diffJournal[len(ot.diffJournal)-1] = append(ot.diffJournal[len(ot.diffJournal)-1], change)
+	}
+}
+
+// enterDiffFrame opens the journal of a frame the evm enters
+func (ot *OeTracer) enterDiffFrame() {
+	ot.diffJournal = append(ot.diffJournal, nil)
+}
+
+// exitDiffFrame closes the journal of the frame the evm exits. The evm reverts the state changes of a
+// failed frame, including the ones of its sub frames, so are they undone in the state diff. The changes
+// of a successful frame are kept, they're undone only if the parent frame fails.
+func (ot *OeTracer) exitDiffFrame(err error) {
+	if len(ot.diffJournal) == 0 {
+		return
+	}
+	changes := ot.diffJournal[len(ot.diffJournal)-1]
+	ot.diffJournal = ot.diffJournal[:len(ot.diffJournal)-1]
+	if err == nil {
+		if len(ot.diffJournal) > 0 {
+			ot.diffJournal[len(ot.diffJournal)-1] = append(ot.diffJournal[len(ot.diffJournal)-1], changes...)
+		}
+		return
+	}
+	for i := len(changes) - 1; i >= 0; i-- {
+		change := changes[i]
+		if change.prev != nil {
+			ot.stateDiff[change.address][change.slot] = *change.prev
+			continue
+		}
+		delete(ot.stateDiff[change.address], change.slot)
+		if len(ot.stateDiff[change.address]) == 0 {
+			delete(ot.stateDiff, change.address)
 		}
 	}
 }
 
 func (ot *OeTracer) createPreProcessFailed(op vm.OpCode, scope *vm.ScopeContext, gas uint64, value *big.Int, err error) {
 	offset, size := stackPeek(scope.Stack, 1), stackPeek(scope.Stack, 2)
-	var input []byte
-	if size.Uint64() > 0 && size.Uint64() < maxTxPacketSize {
-		input = make([]byte, size.Uint64())
-		copy(input, memorySlice(scope.Memory.Data(), offset.Uint64(), size.Uint64()))
-	}
+	input := memoryInput(scope.Memory.Data(), offset, size)
 	ot.CaptureEnter(op, scope.Contract.Address(), common.Address{}, input, gas, value)
 	ot.CaptureExit(nil, 0, err)
 }
@@ -341,17 +808,10 @@ func (ot *OeTracer) callPreProcessFailed(op vm.OpCode, scope *vm.ScopeContext, g
 	addr := stackPeek(scope.Stack, 1)
 	if op == vm.CALL || op == vm.CALLCODE {
 		offset, size := stackPeek(scope.Stack, 3), stackPeek(scope.Stack, 4)
-		if size.Uint64() > 0 && size.Uint64() < maxTxPacketSize {
-			input = make([]byte, size.Uint64())
-			copy(input, memorySlice(scope.Memory.Data(), offset.Uint64(), size.Uint64()))
-		}
-
+		input = memoryInput(scope.Memory.Data(), offset, size)
 	} else {
 		offset, size := stackPeek(scope.Stack, 2), stackPeek(scope.Stack, 3)
-		if size.Uint64() > 0 && size.Uint64() < maxTxPacketSize {
-			input = make([]byte, size.Uint64())
-			copy(input, memorySlice(scope.Memory.Data(), offset.Uint64(), size.Uint64()))
-		}
+		input = memoryInput(scope.Memory.Data(), offset, size)
 	}
 	ot.CaptureEnter(op, scope.Contract.Address(), common.Address(addr.Bytes20()), input, gas, value)
 	ot.CaptureExit(nil, 0, err)
@@ -382,6 +842,17 @@ func (ot *OeTracer) checkNonceMatch(addr common.Address) error {
 	return nil
 }
 
+// createdAddress returns the address the CREATE or CREATE2 about to run in scope deploys to
+func (ot *OeTracer) createdAddress(op vm.OpCode, scope *vm.ScopeContext) common.Address {
+	caller := scope.Contract.Address()
+	if op == vm.CREATE {
+		return crypto.CreateAddress(caller, ot.env.StateDB.GetNonce(caller))
+	}
+	offset, size, salt := stackPeek(scope.Stack, 1), stackPeek(scope.Stack, 2), stackPeek(scope.Stack, 3)
+	initCode := memoryInput(scope.Memory.Data(), offset, size)
+	return crypto.CreateAddress2(caller, salt.Bytes32(), crypto.Keccak256(initCode))
+}
+
 // checkContractNotExist check if the contract is exist at the designated address
 func (ot *OeTracer) checkContractNotExist(addr common.Address) error {
 	contractHash := ot.env.StateDB.GetCodeHash(addr)
@@ -391,16 +862,72 @@ func (ot *OeTracer) checkContractNotExist(addr common.Address) error {
 	return nil
 }
 
-// CaptureFault do nothing
+// CaptureFault records where the frame failed during the execution of an op, see FaultInfo
 func (ot *OeTracer) CaptureFault(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, depth int, err error) {
+	ot.recordFault(pc, op, gas, depth)
 }
 
-func (ot *OeTracer) CaptureTxStart(gasLimit uint64) {
+// recordFault attaches where it failed to the innermost open frame, unless one of its sub frames failed
+// before and carries it already. The frames not recorded are left out.
+func (ot *OeTracer) recordFault(pc uint64, op vm.OpCode, gas uint64, depth int) {
+	if ot.skippedDepth > 0 || ot.interrupted != nil || len(ot.traceStack) == 0 {
+		return
+	}
+	frame := ot.traceStack[len(ot.traceStack)-1]
+	// the traces recorded after the innermost open frame are its sub traces
+	for i := len(ot.outPutTraces.Traces) - 1; i >= 0 && ot.outPutTraces.Traces[i] != frame; i-- {
+		if ot.outPutTraces.Traces[i].Fault != nil {
+			return
+		}
+	}
+	frame.Fault = &FaultInfo{PC: pc, Op: op.String(), Gas: gas, Depth: uint64(depth)}
+}
 
+func (ot *OeTracer) CaptureTxStart(gasLimit uint64) {
+	ot.txGasLimit = gasLimit
 }
 
+// CaptureTxEnd sets the gasUsed of a top-level call sending an input to an account without code, which runs
+// nothing, to the cost of its calldata: the gasUsed of the receipt beyond the 21000 base, see EOAInput.
 func (ot *OeTracer) CaptureTxEnd(restGas uint64) {
+	if len(ot.outPutTraces.Traces) == 0 || restGas > ot.txGasLimit {
+		return
+	}
+	root := ot.outPutTraces.Traces[0]
+	if used := ot.txGasLimit - restGas; root.EOAInput && root.Result != nil && used > params.TxGas {
+		root.Result.GasUsed = used - params.TxGas
+	}
+}
+
+// Interrupted returns the context error recording stopped with, nil if it wasn't interrupted.
+func (ot *OeTracer) Interrupted() error {
+	return ot.interrupted
+}
 
+// Finalized reports whether the top call/create has ended, or the tracer was forced to finalize.
+func (ot *OeTracer) Finalized() bool {
+	return ot.state == stateFinalized
+}
+
+// finalize checks the execution completed before the traces are read, a forced tracer closes the
+// frames left open by marking them incomplete.
+func (ot *OeTracer) finalize() error {
+	switch {
+	case ot.state == stateFinalized:
+		return nil
+	case !ot.force || ot.state == stateCreated:
+		return ErrTraceIncomplete
+	}
+	log.Warn("Finalizing incomplete tx trace", "txHash", ot.outPutTraces.TransactionHash.String(), "open", len(ot.traceStack))
+	for _, internalTrace := range ot.traceStack {
+		internalTrace.Error = ErrTraceIncomplete.Error()
+		internalTrace.Result = nil
+	}
+	ot.traceStack = nil
+	ot.filterStack = nil
+	ot.skippedDepth = 0
+	ot.state = stateFinalized
+	return nil
 }
 
 // getInternalTraces return Inter ActionTraces after evm runtime completed, then PersistTrace will store it to db
@@ -409,9 +936,42 @@ func (ot *OeTracer) getInternalTraces() *InternalActionTraceList {
 	return &ot.outPutTraces
 }
 
-// GetTraces return ActionTraceList for jsonrpc call
-func (ot *OeTracer) GetTraces() ActionTraceList {
-	return ot.outPutTraces.ToTraces()
+// GetTraces return ActionTraceList for jsonrpc call, ErrTraceIncomplete if the execution didn't complete
+func (ot *OeTracer) GetTraces() (ActionTraceList, error) {
+	if err := ot.finalize(); err != nil {
+		return nil, err
+	}
+	if err := ot.outPutTraces.Validate(); err != nil {
+		return nil, err
+	}
+	return ot.outPutTraces.ToTracesWithConfig(ot.config), nil
+}
+
+// GetTracesWithMeta return ActionTraceList along with tx level metadata for jsonrpc call,
+// ErrTraceIncomplete if the execution didn't complete
+func (ot *OeTracer) GetTracesWithMeta() (*TracesWithMeta, error) {
+	if err := ot.finalize(); err != nil {
+		return nil, err
+	}
+	if err := ot.outPutTraces.Validate(); err != nil {
+		return nil, err
+	}
+	return ot.outPutTraces.toTracesWithMeta(ot.config), nil
+}
+
+// SetGasBreakdown computes the gas breakdown of the traced tx, see ComputeGasBreakdown, and keeps it for
+// persisting, it must be called after evm runtime completed and before PersistTrace.
+func (ot *OeTracer) SetGasBreakdown(data []byte, accessList types.AccessList, create bool, rules params.Rules, receiptGasUsed uint64) (*TxGasBreakdown, error) {
+	var rootTrace *InternalActionTrace
+	if len(ot.outPutTraces.Traces) > 0 {
+		rootTrace = ot.outPutTraces.Traces[0]
+	}
+	breakdown, err := ComputeGasBreakdown(data, accessList, create, rules, rootTrace, receiptGasUsed)
+	if err != nil {
+		return nil, err
+	}
+	ot.outPutTraces.GasBreakdown = breakdown
+	return breakdown, nil
 }
 
 // GetStateDiff return state diff for jsonrpc call
@@ -419,17 +979,99 @@ func (ot *OeTracer) GetStateDiff() StateDiff {
 	return ot.stateDiff
 }
 
-// PersistTrace save traced tx result to underlying k-v store.
+// PersistTrace is PersistTraceContext with the background context, only bounded by WithWriteTimeout, its
+// error is logged and dropped.
+//
+// Deprecated: use PersistTraceContext.
 func (ot *OeTracer) PersistTrace() {
+	if err := ot.PersistTraceContext(context.Background()); err != nil {
+		log.Warn("Tx trace not persisted", "txHash", ot.outPutTraces.TransactionHash.String(), "err", err)
+	}
+}
+
+// PersistTraceContext save traced tx result to underlying k-v store, nothing is written if the execution
+// didn't complete and ErrTraceIncomplete is returned. Other errors wrap ErrTraceEncode or ErrTraceWrite,
+// the write is given up once ctx is done.
+func (ot *OeTracer) PersistTraceContext(ctx context.Context) error {
+	return ot.PersistTraceWithRetry(ctx, 1, 0)
+}
+
+// PersistTraceWithRetry is PersistTraceContext retrying failed writes to the store, up to attempts writes
+// are made with backoff between them. It gives up waiting once ctx is done and returns its error.
+func (ot *OeTracer) PersistTraceWithRetry(ctx context.Context, attempts int, backoff time.Duration) error {
+	if err := ot.finalize(); err != nil {
+		log.Error("Refused to persist incomplete tx trace", "txHash", ot.outPutTraces.TransactionHash.String())
+		return err
+	}
 	if ot.store != nil {
-		tracesBytes, err := rlp.EncodeToBytes(ot.getInternalTraces())
+		if _, ok := ctx.Deadline(); !ok && ot.writeTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, ot.writeTimeout)
+			defer cancel()
+		}
+		tracesBytes, err := ot.encodeTraces()
 		if err != nil {
 			log.Error("Failed to encode tx trace", "txHash", ot.outPutTraces.TransactionHash.String(), "err", err.Error())
-			return
+			return fmt.Errorf("%w: %v", ErrTraceEncode, err)
 		}
-		if err := ot.store.WriteTxTrace(context.Background(), ot.outPutTraces.TransactionHash, tracesBytes); err != nil {
-			log.Error("Failed to persist tx trace to database", "txHash", ot.outPutTraces.TransactionHash.String(), "err", err.Error())
-			return
+		for attempt := 1; len(tracesBytes) > 0; attempt++ {
+			err = ot.store.WriteTxTrace(ctx, ot.outPutTraces.TransactionHash, tracesBytes)
+			if err == nil {
+				break
+			}
+			log.Error("Failed to persist tx trace to database", "txHash", ot.outPutTraces.TransactionHash.String(), "attempt", attempt, "err", err.Error())
+			if attempt >= attempts {
+				return fmt.Errorf("%w: %w", ErrTraceWrite, err)
+			}
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("%w: %w", ErrTraceWrite, ctx.Err())
+			case <-time.After(backoff):
+			}
+		}
+		if ot.persistHook != nil {
+			ot.persistHook(ot.outPutTraces.TransactionHash, len(tracesBytes), len(ot.outPutTraces.Traces))
 		}
 	}
+	return nil
+}
+
+// EncodedSize returns the number of bytes PersistTrace writes for the traces, e.g. to enforce a storage budget
+// per tx before persisting. Like PersistTrace, it fails with ErrTraceIncomplete if the execution didn't complete.
+func (ot *OeTracer) EncodedSize() (int, error) {
+	if err := ot.finalize(); err != nil {
+		return 0, err
+	}
+	if marker, ok := ot.simpleTransferBlob(); ok {
+		return len(marker), nil
+	}
+	if ot.compression != CompressionNone {
+		raw, err := ot.encodeTraces()
+		return len(raw), err
+	}
+	return ot.outPutTraces.EncodedSize()
+}
+
+// encodeTraces returns what PersistTrace writes, nothing for the simple transfers omitted by the config
+func (ot *OeTracer) encodeTraces() ([]byte, error) {
+	if marker, ok := ot.simpleTransferBlob(); ok {
+		return marker, nil
+	}
+	raw, err := rlp.EncodeToBytes(ot.getInternalTraces())
+	if err != nil {
+		return nil, err
+	}
+	return compressTraces(raw, ot.compression, ot.compressionLevel)
+}
+
+// simpleTransferBlob returns what is persisted instead of the traces of a simple transfer skipped by the
+// config, nil when it's omitted, and false when the traces are persisted
+func (ot *OeTracer) simpleTransferBlob() ([]byte, bool) {
+	if !ot.config.SkipSimpleTransfers || ot.senderOverride != nil || !IsSimpleTransfer(ot.getInternalTraces()) {
+		return nil, false
+	}
+	if ot.config.OmitSimpleTransfers {
+		return nil, true
+	}
+	return []byte{simpleTransferMarker}, true
 }
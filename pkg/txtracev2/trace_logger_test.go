@@ -1,25 +1,32 @@
 package txtracev2
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"math/big"
+	"math/rand"
 	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 	"unicode"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/common/math"
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/params"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/tests"
+	"github.com/holiman/uint256"
 )
 
 type callContext struct {
@@ -46,7 +53,12 @@ func (store *MemoryStore) ReadTxTrace(ctx context.Context, txHash common.Hash) (
 	if raw, isExist := store.data[txHash]; isExist {
 		return raw, nil
 	}
-	return nil, errors.New("tx not found")
+	return nil, ErrTxTraceNotFound
+}
+
+func (store *MemoryStore) Has(ctx context.Context, txHash common.Hash) (bool, error) {
+	_, isExist := store.data[txHash]
+	return isExist, nil
 }
 
 func (store *MemoryStore) WriteTxTrace(ctx context.Context, txHash common.Hash, trace []byte) error {
@@ -54,6 +66,11 @@ func (store *MemoryStore) WriteTxTrace(ctx context.Context, txHash common.Hash,
 	return nil
 }
 
+func (store *MemoryStore) DeleteTxTrace(ctx context.Context, txHash common.Hash) error {
+	delete(store.data, txHash)
+	return nil
+}
+
 // Iterates over all the input-output datasets in the tracer test harness and
 // runs the JavaScript tracers against them.
 func TestCallTracer(t *testing.T) {
@@ -83,7 +100,7 @@ func TestCallTracer(t *testing.T) {
 			if err := rlp.DecodeBytes(common.FromHex(test.Input), tx); err != nil {
 				t.Fatalf("failed to parse testcase input: %v", err)
 			}
-			signer := types.MakeSigner(test.Genesis.Config, new(big.Int).SetUint64(uint64(test.Context.Number)))
+			signer := types.MakeSigner(test.Genesis.Config, new(big.Int).SetUint64(uint64(test.Context.Number)), uint64(test.Context.Time))
 			origin, _ := signer.Sender(tx)
 
 			blkContext := vm.BlockContext{
@@ -92,7 +109,7 @@ func TestCallTracer(t *testing.T) {
 				Coinbase:    test.Context.Miner,
 				GasLimit:    uint64(test.Context.GasLimit),
 				BlockNumber: new(big.Int).SetUint64(uint64(test.Context.Number)),
-				Time:        new(big.Int).SetUint64(uint64(test.Context.Time)),
+				Time:        uint64(test.Context.Time),
 				Difficulty:  (*big.Int)(test.Context.Difficulty),
 			}
 			txContext := vm.TxContext{
@@ -100,7 +117,9 @@ func TestCallTracer(t *testing.T) {
 				GasPrice: tx.GasPrice(),
 			}
 
-			_, statedb := tests.MakePreState(rawdb.NewMemoryDatabase(), test.Genesis.Alloc, false)
+			state := tests.MakePreState(rawdb.NewMemoryDatabase(), test.Genesis.Alloc, false, rawdb.HashScheme)
+			defer state.Close()
+			statedb := state.StateDB
 
 			memoryStore := &MemoryStore{
 				data: make(map[common.Hash][]byte),
@@ -109,9 +128,9 @@ func TestCallTracer(t *testing.T) {
 			// Create the tracer, the EVM environment and run it
 			tracer := NewOeTracer(memoryStore, common.Hash{}, new(big.Int).SetUint64(uint64(test.Context.Number)), tx.Hash(), 0)
 
-			evm := vm.NewEVM(blkContext, txContext, statedb, test.Genesis.Config, vm.Config{Debug: true, Tracer: tracer})
+			evm := vm.NewEVM(blkContext, txContext, statedb, test.Genesis.Config, vm.Config{Tracer: tracer})
 
-			msg, err := tx.AsMessage(signer, nil)
+			msg, err := core.TransactionToMessage(tx, signer, nil)
 			if err != nil {
 				t.Fatalf("failed to prepare transaction for tracing: %v", err)
 			}
@@ -120,12 +139,17 @@ func TestCallTracer(t *testing.T) {
 			if _, err = st.TransitionDb(); err != nil {
 				t.Fatalf("failed to execute transaction: %v", err)
 			}
-			res := tracer.GetTraces()
+			res, err := tracer.GetTraces()
+			if err != nil {
+				t.Fatalf("failed to get traces: %v", err)
+			}
 			if !jsonEqual(res, test.Result) {
 				jsonDiff(t, res, test.Result)
 			}
 
-			tracer.PersistTrace()
+			if err := tracer.PersistTraceContext(context.Background()); err != nil {
+				t.Fatalf("failed to persist traces: %v", err)
+			}
 
 			storeRes, err := ReadRpcTxTrace(context.Background(), memoryStore, tx.Hash())
 			if err != nil {
@@ -139,6 +163,324 @@ func TestCallTracer(t *testing.T) {
 	}
 }
 
+func TestMaxDepth(t *testing.T) {
+	entry, alloc := proxyChain(6)
+	state := tests.MakePreState(rawdb.NewMemoryDatabase(), alloc, false, rawdb.HashScheme)
+	defer state.Close()
+
+	traces, err := traceProxyChain(t, state.StateDB, entry, []byte{0x01}, WithMaxDepth(2)).GetTraces()
+	if err != nil {
+		t.Fatalf("failed to get traces: %v", err)
+	}
+	if len(traces) != 3 {
+		t.Fatalf("trace count mismatch: have %d, want %d", len(traces), 3)
+	}
+	for i, trace := range traces {
+		if len(trace.TraceAddress) != i {
+			t.Fatalf("trace %d: unexpected trace address %v", i, trace.TraceAddress)
+		}
+		if truncated := i == 2; trace.SubtracesTruncated != truncated {
+			t.Fatalf("trace %d: truncated mismatch: have %v, want %v", i, trace.SubtracesTruncated, truncated)
+		}
+		if trace.Error != "" {
+			t.Fatalf("trace %d: unexpected error %q", i, trace.Error)
+		}
+	}
+	checkSubtraces(t, traces)
+
+	// the whole chain is recorded without max depth
+	traces, err = traceProxyChain(t, state.StateDB, entry, []byte{0x01}).GetTraces()
+	if err != nil {
+		t.Fatalf("failed to get traces: %v", err)
+	}
+	if len(traces) != 6 {
+		t.Fatalf("trace count mismatch: have %d, want %d", len(traces), 6)
+	}
+	for _, trace := range traces {
+		if trace.SubtracesTruncated {
+			t.Fatalf("unexpected truncated trace %v", trace.TraceAddress)
+		}
+	}
+}
+
+func TestAddressFilter(t *testing.T) {
+	var (
+		user    = common.Address{0x1}
+		router  = common.Address{0x2}
+		dexA    = common.Address{0xa}
+		dexB    = common.Address{0xb}
+		token   = common.Address{0x7}
+		watched = common.Address{0xee}
+	)
+	trace := func(filter common.Address) (ActionTraceList, error) {
+		tracer := NewOeTracer(nil, common.Hash{}, big.NewInt(1), common.Hash{0x1}, 0, WithAddressFilter(filter))
+		tracer.CaptureStart(nil, user, router, false, []byte{0x01}, 100_000, big.NewInt(0))
+		// router -> dexA -> token, none of them watched
+		tracer.CaptureEnter(vm.CALL, router, dexA, nil, 90_000, big.NewInt(0))
+		tracer.CaptureEnter(vm.CALL, dexA, token, nil, 80_000, big.NewInt(0))
+		tracer.CaptureExit(nil, 100, nil)
+		tracer.CaptureExit(nil, 200, nil)
+		// router -> dexB -> token -> watched
+		tracer.CaptureEnter(vm.CALL, router, dexB, nil, 90_000, big.NewInt(0))
+		tracer.CaptureEnter(vm.CALL, dexB, token, nil, 80_000, big.NewInt(0))
+		tracer.CaptureEnter(vm.STATICCALL, token, watched, nil, 70_000, nil)
+		tracer.CaptureExit(nil, 100, nil)
+		tracer.CaptureExit(nil, 200, nil)
+		tracer.CaptureEnter(vm.CALL, dexB, dexA, nil, 60_000, big.NewInt(0))
+		tracer.CaptureExit(nil, 100, nil)
+		tracer.CaptureExit(nil, 400, nil)
+		// router -> watched -> dexA
+		tracer.CaptureEnter(vm.CALL, router, watched, nil, 50_000, big.NewInt(0))
+		tracer.CaptureEnter(vm.CALL, watched, dexA, nil, 40_000, big.NewInt(0))
+		tracer.CaptureExit(nil, 100, nil)
+		tracer.CaptureExit(nil, 200, nil)
+		tracer.CaptureEnd(nil, 1_000, nil)
+		return tracer.GetTraces()
+	}
+
+	traces, err := trace(watched)
+	if err != nil {
+		t.Fatalf("failed to get traces: %v", err)
+	}
+	want := []struct {
+		address   []uint32
+		subtraces uint32
+		truncated bool
+	}{
+		{nil, 3, true},
+		{[]uint32{1}, 2, true},
+		{[]uint32{1, 0}, 1, false},
+		{[]uint32{1, 0, 0}, 0, false},
+		{[]uint32{2}, 1, false},
+		{[]uint32{2, 0}, 0, false},
+	}
+	if len(traces) != len(want) {
+		t.Fatalf("trace count mismatch: have %d, want %d", len(traces), len(want))
+	}
+	for i, trace := range traces {
+		if fmt.Sprint(trace.TraceAddress) != fmt.Sprint(want[i].address) || trace.Subtraces != want[i].subtraces || trace.SubtracesTruncated != want[i].truncated {
+			t.Fatalf("trace %d: have %v with %d subtraces, truncated %v, want %v with %d, truncated %v", i,
+				trace.TraceAddress, trace.Subtraces, trace.SubtracesTruncated, want[i].address, want[i].subtraces, want[i].truncated)
+		}
+	}
+
+	// only the top-level frame is kept without a match
+	traces, err = trace(common.Address{0xff})
+	if err != nil {
+		t.Fatalf("failed to get traces: %v", err)
+	}
+	if len(traces) != 1 || traces[0].Subtraces != 3 || !traces[0].SubtracesTruncated {
+		t.Fatalf("unmatched traces mismatch: %+v", traces)
+	}
+}
+
+// checkSubtraces checks the subtraces of every trace are the traces recorded right below it
+func checkSubtraces(t *testing.T, traces []RpcActionTrace) {
+	t.Helper()
+	children := make(map[string]uint32)
+	for _, trace := range traces {
+		if len(trace.TraceAddress) > 0 {
+			children[fmt.Sprint(trace.TraceAddress[:len(trace.TraceAddress)-1])]++
+		}
+	}
+	for _, trace := range traces {
+		if have := children[fmt.Sprint(trace.TraceAddress)]; trace.Subtraces != have {
+			t.Fatalf("trace %v: have %d subtraces, %d children", trace.TraceAddress, trace.Subtraces, have)
+		}
+	}
+}
+
+func TestIncludePrecompiles(t *testing.T) {
+	// the entry calls the identity precompile and a contract hashing with the sha256 precompile
+	var (
+		entry  = common.HexToAddress("0x2000")
+		hasher = common.HexToAddress("0x2001")
+	)
+	precompileCall := func(precompile byte) []byte {
+		return []byte{
+			byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0,
+			byte(vm.PUSH1), precompile, byte(vm.GAS), byte(vm.STATICCALL), byte(vm.POP),
+		}
+	}
+	code := precompileCall(0x04)
+	code = append(code, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH20))
+	code = append(code, hasher.Bytes()...)
+	code = append(code, byte(vm.GAS), byte(vm.CALL), byte(vm.POP), byte(vm.STOP))
+	alloc := types.GenesisAlloc{
+		entry:  {Code: code},
+		hasher: {Code: append(precompileCall(0x02), byte(vm.STOP))},
+	}
+	state := tests.MakePreState(rawdb.NewMemoryDatabase(), alloc, false, rawdb.HashScheme)
+	defer state.Close()
+
+	tests := []struct {
+		opts      []Option
+		calls     []string // the callee of every trace
+		truncated bool     // whether the hasher trace is truncated
+	}{
+		{nil, []string{"2000", "4", "2001", "2"}, false},
+		{[]Option{WithIncludePrecompiles(true)}, []string{"2000", "4", "2001", "2"}, false},
+		{[]Option{WithIncludePrecompiles(false)}, []string{"2000", "2001"}, false},
+		{[]Option{WithMaxDepth(1)}, []string{"2000", "4", "2001"}, true},
+		{[]Option{WithIncludePrecompiles(false), WithMaxDepth(1)}, []string{"2000", "2001"}, false},
+	}
+	for i, test := range tests {
+		traces, err := traceProxyChain(t, state.StateDB, entry, nil, test.opts...).GetTraces()
+		if err != nil {
+			t.Fatalf("test %d: failed to get traces: %v", i, err)
+		}
+		var calls []string
+		for _, trace := range traces {
+			calls = append(calls, trace.Action.To.Big().Text(16))
+			if *trace.Action.To == hasher && trace.SubtracesTruncated != test.truncated {
+				t.Fatalf("test %d: truncated mismatch: have %v, want %v", i, trace.SubtracesTruncated, test.truncated)
+			}
+		}
+		if fmt.Sprint(calls) != fmt.Sprint(test.calls) {
+			t.Fatalf("test %d: calls mismatch: have %v, want %v", i, calls, test.calls)
+		}
+		checkSubtraces(t, traces)
+	}
+}
+
+func TestRevertedStateDiff(t *testing.T) {
+	var (
+		entry    = common.Address{0x30, 0x00}
+		reverter = common.Address{0x30, 0x01}
+		caller   = common.Address{0x30, 0x02}
+		callee   = common.Address{0x30, 0x03}
+	)
+	sstore := func(slot, value byte) []byte {
+		return []byte{byte(vm.PUSH1), value, byte(vm.PUSH1), slot, byte(vm.SSTORE)}
+	}
+	call := func(op vm.OpCode, to common.Address) []byte {
+		code := []byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0}
+		if op == vm.CALL {
+			code = append(code, byte(vm.PUSH1), 0)
+		}
+		code = append(code, byte(vm.PUSH20))
+		code = append(code, to.Bytes()...)
+		return append(code, byte(vm.GAS), byte(op), byte(vm.POP))
+	}
+	revert := []byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.REVERT)}
+
+	var code []byte
+	code = append(code, sstore(0, 1)...)
+	code = append(code, call(vm.DELEGATECALL, reverter)...) // writes the storage of entry, then reverts
+	code = append(code, call(vm.CALL, caller)...)           // reverts after its callee succeeded
+	code = append(code, sstore(1, 3)...)
+	code = append(code, sstore(0, 4)...)
+	code = append(code, byte(vm.STOP))
+	alloc := types.GenesisAlloc{
+		entry:    {Code: code},
+		reverter: {Code: append(sstore(0, 2), revert...)},
+		caller:   {Code: append(append(sstore(0, 7), call(vm.CALL, callee)...), revert...)},
+		callee:   {Code: append(sstore(0, 9), byte(vm.STOP))},
+	}
+	state := tests.MakePreState(rawdb.NewMemoryDatabase(), alloc, false, rawdb.HashScheme)
+	defer state.Close()
+	state.StateDB.AddAddressToAccessList(entry) // warmed by the tx otherwise
+
+	diff := traceProxyChain(t, state.StateDB, entry, nil).GetStateDiff()
+	hash := func(b byte) *common.Hash {
+		h := common.BytesToHash([]byte{b})
+		return &h
+	}
+	want := StateDiff{
+		entry: AccountDiff{
+			common.Hash{}:                 Diff{BeforeValue: hash(0), AfterValue: hash(4)},
+			common.BytesToHash([]byte{1}): Diff{BeforeValue: hash(0), AfterValue: hash(3)},
+		},
+	}
+	if !reflect.DeepEqual(diff, want) {
+		have, _ := json.Marshal(diff)
+		wanted, _ := json.Marshal(want)
+		t.Fatalf("state diff mismatch: \nhave %s\nwant %s", have, wanted)
+	}
+}
+
+func TestSelfDestructDestroyed(t *testing.T) {
+	var (
+		entry       = common.Address{0x50, 0x00}
+		destructor  = common.Address{0x50, 0x01}
+		beneficiary = common.Address{0x50, 0x02}
+	)
+	selfDestruct := append(append([]byte{byte(vm.PUSH20)}, beneficiary.Bytes()...), byte(vm.SELFDESTRUCT))
+	// creates a contract destructing itself in its init code, then calls the existing destructor
+	code := append([]byte{byte(vm.PUSH22)}, selfDestruct...)
+	code = append(code, byte(vm.PUSH1), 0, byte(vm.MSTORE), byte(vm.PUSH1), 22, byte(vm.PUSH1), 10, byte(vm.PUSH1), 0, byte(vm.CREATE), byte(vm.POP))
+	code = append(code, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH20))
+	code = append(code, destructor.Bytes()...)
+	code = append(code, byte(vm.GAS), byte(vm.CALL), byte(vm.POP), byte(vm.STOP))
+	alloc := types.GenesisAlloc{
+		entry:      {Code: code},
+		destructor: {Code: selfDestruct, Balance: big.NewInt(10)},
+	}
+
+	cancun := *params.AllEthashProtocolChanges
+	cancun.TerminalTotalDifficultyPassed = true
+	cancun.ShanghaiTime, cancun.CancunTime = new(uint64), new(uint64)
+	truth := func(b bool) *bool { return &b }
+	forks := []struct {
+		config    *params.ChainConfig
+		destroyed []*bool // of the created and the existing contract
+	}{
+		{params.AllEthashProtocolChanges, []*bool{nil, nil}},
+		{&cancun, []*bool{truth(true), truth(false)}},
+	}
+	for i, test := range forks {
+		state := tests.MakePreState(rawdb.NewMemoryDatabase(), alloc, false, rawdb.HashScheme)
+		state.StateDB.AddAddressToAccessList(entry)
+		tracer := NewOeTracer(nil, common.Hash{}, big.NewInt(1), common.Hash{}, 0)
+		blkContext := vm.BlockContext{
+			CanTransfer: core.CanTransfer,
+			Transfer:    core.Transfer,
+			GasLimit:    30_000_000,
+			BlockNumber: big.NewInt(1),
+			Difficulty:  big.NewInt(0),
+			Random:      &common.Hash{}, // post-merge, Cancun needs it
+			BaseFee:     big.NewInt(0),
+		}
+		evm := vm.NewEVM(blkContext, vm.TxContext{GasPrice: big.NewInt(0)}, state.StateDB, test.config, vm.Config{Tracer: tracer})
+		if _, _, err := evm.Call(vm.AccountRef(common.Address{0x1}), entry, nil, 10_000_000, new(uint256.Int)); err != nil {
+			t.Fatalf("test %d: failed to execute: %v", i, err)
+		}
+		state.Close()
+
+		traces, err := tracer.GetTraces()
+		if err != nil {
+			t.Fatalf("test %d: failed to get traces: %v", i, err)
+		}
+		var suicides []RpcActionTrace
+		for _, trace := range traces {
+			if trace.TraceType == "suicide" {
+				suicides = append(suicides, trace)
+			}
+		}
+		if len(suicides) != 2 {
+			t.Fatalf("test %d: suicide count mismatch: have %d, want 2", i, len(suicides))
+		}
+		for j, suicide := range suicides {
+			if !reflect.DeepEqual(suicide.Action.Destroyed, test.destroyed[j]) {
+				t.Fatalf("test %d: suicide %d destroyed mismatch: have %v, want %v", i, j, suicide.Action.Destroyed, test.destroyed[j])
+			}
+		}
+		if suicides[1].Action.Balance.ToInt().Int64() != 10 {
+			t.Fatalf("test %d: balance mismatch: have %v, want 10", i, suicides[1].Action.Balance)
+		}
+		// the annotation survives the store
+		decoded := new(InternalActionTraceList)
+		if blob, err := rlp.EncodeToBytes(tracer.getInternalTraces()); err != nil {
+			t.Fatalf("test %d: failed to encode traces: %v", i, err)
+		} else if err := rlp.DecodeBytes(blob, decoded); err != nil {
+			t.Fatalf("test %d: failed to decode traces: %v", i, err)
+		}
+		if !jsonEqual(decoded.ToTraces(), traces) {
+			jsonDiff(t, decoded.ToTraces(), traces)
+		}
+	}
+}
+
 func jsonDiff(t *testing.T, x, y interface{}) {
 	xj, _ := json.Marshal(x)
 	yj, _ := json.Marshal(y)
@@ -171,3 +513,838 @@ func camel(str string) string {
 	}
 	return strings.Join(pieces, "")
 }
+
+func TestIncompleteTrace(t *testing.T) {
+	// trace runs an execution which panics in a sub call, the caller recovers before any exit is captured
+	trace := func(opts ...Option) (*OeTracer, *MemoryStore) {
+		store := &MemoryStore{data: make(map[common.Hash][]byte)}
+		tracer := NewOeTracer(store, common.Hash{}, big.NewInt(1), common.Hash{0x1}, 0, opts...)
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("expected the execution to panic")
+				}
+			}()
+			tracer.CaptureStart(nil, common.Address{0x1}, common.Address{0x2}, false, []byte{0x01}, 100_000, big.NewInt(0))
+			tracer.CaptureEnter(vm.CALL, common.Address{0x2}, common.Address{0x3}, nil, 90_000, big.NewInt(0))
+			tracer.CaptureExit(nil, 100, nil)
+			tracer.CaptureEnter(vm.DELEGATECALL, common.Address{0x2}, common.Address{0x4}, nil, 80_000, nil)
+			panic("evm panic")
+		}()
+		if tracer.Finalized() {
+			t.Fatalf("tracer finalized after a panicking execution")
+		}
+		return tracer, store
+	}
+
+	tracer, store := trace()
+	if _, err := tracer.GetTraces(); !errors.Is(err, ErrTraceIncomplete) {
+		t.Fatalf("GetTraces error mismatch: have %v, want %v", err, ErrTraceIncomplete)
+	}
+	if err := tracer.PersistTraceContext(context.Background()); !errors.Is(err, ErrTraceIncomplete) {
+		t.Fatalf("PersistTrace error mismatch: have %v, want %v", err, ErrTraceIncomplete)
+	}
+	if len(store.data) != 0 {
+		t.Fatalf("incomplete trace written to the store")
+	}
+
+	// a forced tracer persists the open frames marked incomplete
+	tracer, store = trace(WithForce())
+	if err := tracer.PersistTraceContext(context.Background()); err != nil {
+		t.Fatalf("failed to persist forced traces: %v", err)
+	}
+	if !tracer.Finalized() {
+		t.Fatalf("forced tracer not finalized")
+	}
+	traces, err := ReadRpcTxTrace(context.Background(), store, common.Hash{0x1})
+	if err != nil {
+		t.Fatalf("failed to read trace: %v", err)
+	}
+	if len(traces) != 3 {
+		t.Fatalf("trace count mismatch: have %d, want %d", len(traces), 3)
+	}
+	for i, trace := range traces {
+		incomplete := trace.Error == ErrTraceIncomplete.Error() && trace.Result == nil
+		if completed := i == 1; incomplete == completed {
+			t.Fatalf("trace %v: unexpected error %q", trace.TraceAddress, trace.Error)
+		}
+	}
+}
+
+func TestCaptureEndWithoutStart(t *testing.T) {
+	store := &MemoryStore{data: make(map[common.Hash][]byte)}
+	tracer := NewOeTracer(store, common.Hash{}, big.NewInt(1), common.Hash{0x1}, 0)
+	// none of them must panic on the empty trace stack
+	tracer.CaptureState(0, vm.REVERT, 0, 0, nil, nil, 1, nil)
+	tracer.CaptureExit(nil, 0, nil)
+	tracer.CaptureEnd(nil, 0, core.ErrIntrinsicGas)
+	tracer.CaptureEnd(nil, 0, nil)
+
+	if err := tracer.PersistTraceContext(context.Background()); err != nil {
+		t.Fatalf("failed to persist traces: %v", err)
+	}
+	traces, err := ReadRpcTxTrace(context.Background(), store, common.Hash{0x1})
+	if err != nil {
+		t.Fatalf("failed to read trace: %v", err)
+	}
+	if len(traces) != 1 || traces[0].Error != ParityErrorString(core.ErrIntrinsicGas) || traces[0].Result != nil || len(traces[0].TraceAddress) != 0 {
+		t.Fatalf("error-only trace mismatch: %+v", traces)
+	}
+
+	// without an error of the evm the trace tells it never started
+	tracer = NewOeTracer(store, common.Hash{}, big.NewInt(1), common.Hash{0x2}, 0)
+	tracer.CaptureEnd(nil, 0, nil)
+	if traces, err := tracer.GetTraces(); err != nil || len(traces) != 1 || traces[0].Error != ErrTraceNotStarted.Error() {
+		t.Fatalf("not started trace mismatch: %v %+v", err, traces)
+	}
+}
+
+func TestInterruptedTrace(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	tracer := NewOeTracer(nil, common.Hash{}, big.NewInt(1), common.Hash{0x1}, 0, WithContext(ctx))
+	tracer.CaptureStart(nil, common.Address{0x1}, common.Address{0x2}, false, []byte{0x01}, 100_000, big.NewInt(0))
+	tracer.CaptureEnter(vm.CALL, common.Address{0x2}, common.Address{0x3}, nil, 90_000, big.NewInt(0))
+	tracer.CaptureExit(nil, 100, nil)
+	tracer.CaptureEnter(vm.CALL, common.Address{0x2}, common.Address{0x4}, nil, 80_000, big.NewInt(0))
+
+	// the spinning frame is cancelled, nothing is recorded afterwards and the stack unwinds without panic
+	cancel()
+	tracer.CaptureState(0, vm.JUMP, 70_000, 8, nil, nil, 2, nil)
+	tracer.CaptureEnter(vm.CALL, common.Address{0x4}, common.Address{0x5}, nil, 60_000, big.NewInt(0))
+	tracer.CaptureEnter(vm.STATICCALL, common.Address{0x5}, common.Address{0x6}, nil, 50_000, nil)
+	tracer.CaptureExit(nil, 0, nil)
+	tracer.CaptureExit(nil, 0, nil)
+	tracer.CaptureExit(nil, 0, nil)
+	tracer.CaptureEnd(nil, 0, nil)
+
+	if !errors.Is(tracer.Interrupted(), context.Canceled) {
+		t.Fatalf("interrupted error mismatch: have %v, want %v", tracer.Interrupted(), context.Canceled)
+	}
+	traces, err := tracer.GetTraces()
+	if err != nil {
+		t.Fatalf("failed to get traces: %v", err)
+	}
+	if len(traces) != 3 {
+		t.Fatalf("trace count mismatch: have %d, want %d", len(traces), 3)
+	}
+	want := fmt.Sprintf("%v: %v", ErrTraceInterrupted, context.Canceled)
+	for i, trace := range traces {
+		if completed := i == 1; completed != (trace.Error == "") {
+			t.Fatalf("trace %v: unexpected error %q", trace.TraceAddress, trace.Error)
+		}
+		if i != 1 && (trace.Error != want || trace.Result != nil) {
+			t.Fatalf("trace %v: interrupted error mismatch: have %q, want %q", trace.TraceAddress, trace.Error, want)
+		}
+	}
+	if traces[0].Subtraces != 2 || traces[2].Subtraces != 0 {
+		t.Fatalf("subtraces mismatch: have %d/%d, want %d/%d", traces[0].Subtraces, traces[2].Subtraces, 2, 0)
+	}
+}
+
+func TestPersistHook(t *testing.T) {
+	var (
+		calls       int
+		hookTxHash  common.Hash
+		hookBytes   int
+		hookTraces  int
+		store       = &MemoryStore{data: make(map[common.Hash][]byte)}
+		txHash      = common.Hash{0x1}
+		persistHook = func(txHash common.Hash, encodedBytes int, traceCount int) {
+			calls++
+			hookTxHash, hookBytes, hookTraces = txHash, encodedBytes, traceCount
+		}
+	)
+	tracer := NewOeTracer(store, common.Hash{}, big.NewInt(1), txHash, 0, WithPersistHook(persistHook))
+	tracer.CaptureStart(nil, common.Address{0x1}, common.Address{0x2}, false, nil, 100_000, big.NewInt(0))
+	tracer.CaptureEnter(vm.CALL, common.Address{0x2}, common.Address{0x3}, nil, 90_000, big.NewInt(0))
+	tracer.CaptureExit(nil, 100, nil)
+
+	// nothing is written before the execution completed
+	if err := tracer.PersistTraceContext(context.Background()); err == nil || calls != 0 {
+		t.Fatalf("persist hook called for an incomplete trace")
+	}
+	tracer.CaptureEnd(nil, 200, nil)
+	if err := tracer.PersistTraceContext(context.Background()); err != nil {
+		t.Fatalf("failed to persist traces: %v", err)
+	}
+	if calls != 1 || hookTxHash != txHash || hookBytes != len(store.data[txHash]) || hookTraces != 2 {
+		t.Fatalf("persist hook mismatch: have %d calls with %x %d bytes %d traces", calls, hookTxHash, hookBytes, hookTraces)
+	}
+}
+
+func TestEncodedSize(t *testing.T) {
+	store := &MemoryStore{data: make(map[common.Hash][]byte)}
+	tracer := NewOeTracer(store, common.Hash{}, big.NewInt(1), common.Hash{0x1}, 0)
+	tracer.CaptureStart(nil, common.Address{0x1}, common.Address{0x2}, false, []byte{0x1, 0x2}, 100_000, big.NewInt(0))
+	tracer.CaptureEnter(vm.CALL, common.Address{0x2}, common.Address{0x3}, nil, 90_000, big.NewInt(0))
+	if _, err := tracer.EncodedSize(); !errors.Is(err, ErrTraceIncomplete) {
+		t.Fatalf("expected ErrTraceIncomplete, have %v", err)
+	}
+	tracer.CaptureExit(nil, 100, nil)
+	tracer.CaptureEnd(nil, 200, nil)
+	size, err := tracer.EncodedSize()
+	if err != nil {
+		t.Fatalf("failed to get encoded size: %v", err)
+	}
+	if err := tracer.PersistTraceContext(context.Background()); err != nil {
+		t.Fatalf("failed to persist traces: %v", err)
+	}
+	if have := len(store.data[common.Hash{0x1}]); size != have {
+		t.Fatalf("encoded size mismatch: have %d, persisted %d", size, have)
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 50; i++ {
+		traces := randomTraces(rnd)
+		raw, err := rlp.EncodeToBytes(traces)
+		if err != nil {
+			t.Fatalf("failed to encode traces: %v", err)
+		}
+		if size, err := traces.EncodedSize(); err != nil || size != len(raw) {
+			t.Fatalf("traces %d: encoded size mismatch: have %d (%v), want %d", i, size, err, len(raw))
+		}
+	}
+
+	// skipped simple transfers occupy the marker, or nothing at all
+	for _, cfg := range []TracerConfig{{SkipSimpleTransfers: true}, {SkipSimpleTransfers: true, OmitSimpleTransfers: true}} {
+		tracer := NewOeTracer(store, common.Hash{}, big.NewInt(1), common.Hash{0x2}, 0, WithTracerConfig(cfg))
+		tracer.CaptureStart(nil, common.Address{0x1}, common.Address{0x2}, false, nil, 100_000, big.NewInt(1))
+		tracer.CaptureEnd(nil, 0, nil)
+		want := 1
+		if cfg.OmitSimpleTransfers {
+			want = 0
+		}
+		if size, err := tracer.EncodedSize(); err != nil || size != want {
+			t.Fatalf("simple transfer size mismatch: have %d (%v), want %d", size, err, want)
+		}
+	}
+}
+
+func TestCreateMethod(t *testing.T) {
+	store := &MemoryStore{data: make(map[common.Hash][]byte)}
+	tracer := NewOeTracer(store, common.Hash{}, big.NewInt(1), common.Hash{0x1}, 0)
+	tracer.CaptureStart(nil, common.Address{0x1}, common.Address{0x2}, true, []byte{0x00}, 100_000, big.NewInt(0))
+	tracer.CaptureEnter(vm.CREATE, common.Address{0x2}, common.Address{0x3}, []byte{0x00}, 90_000, big.NewInt(0))
+	tracer.CaptureExit(nil, 100, nil)
+	tracer.CaptureEnter(vm.CREATE2, common.Address{0x2}, common.Address{0x4}, []byte{0x00}, 80_000, big.NewInt(0))
+	tracer.CaptureExit(nil, 100, nil)
+	tracer.CaptureEnter(vm.CALL, common.Address{0x2}, common.Address{0x3}, nil, 70_000, big.NewInt(0))
+	tracer.CaptureExit(nil, 100, nil)
+	tracer.CaptureEnd(nil, 200, nil)
+	if err := tracer.PersistTraceContext(context.Background()); err != nil {
+		t.Fatalf("failed to persist traces: %v", err)
+	}
+	traces, err := ReadRpcTxTrace(context.Background(), store, common.Hash{0x1})
+	if err != nil {
+		t.Fatalf("failed to read trace: %v", err)
+	}
+	want := []string{CreateMethodCreate, CreateMethodCreate, CreateMethodCreate2, ""}
+	if len(traces) != len(want) {
+		t.Fatalf("trace count mismatch: have %d, want %d", len(traces), len(want))
+	}
+	for i, trace := range traces {
+		if trace.Action.CreateMethod != want[i] {
+			t.Errorf("trace %v: create method mismatch: have %q, want %q", trace.TraceAddress, trace.Action.CreateMethod, want[i])
+		}
+	}
+	// calls don't carry the field at all
+	blob, err := json.Marshal(traces[3].Action)
+	if err != nil {
+		t.Fatalf("failed to encode action: %v", err)
+	}
+	if strings.Contains(string(blob), "createMethod") {
+		t.Fatalf("create method emitted for a call: %s", blob)
+	}
+}
+
+func TestCreateMethodTrailer(t *testing.T) {
+	// the layout of InternalAction before the create method trailer was added
+	type legacyAction struct {
+		CallType      uint8
+		From          *common.Address `rlp:"nil"`
+		To            *common.Address `rlp:"nil"`
+		Value         *big.Int        `rlp:"nil"`
+		Gas           uint64
+		Init          []byte
+		Input         []byte
+		Address       *common.Address `rlp:"nil"`
+		RefundAddress *common.Address `rlp:"nil"`
+		Balance       *big.Int        `rlp:"nil"`
+	}
+	legacy, err := rlp.EncodeToBytes(&legacyAction{CallType: CallTypeCreate, Gas: 100, Init: []byte{0x00}})
+	if err != nil {
+		t.Fatalf("failed to encode legacy action: %v", err)
+	}
+	decoded := new(InternalAction)
+	if err := rlp.DecodeBytes(legacy, decoded); err != nil {
+		t.Fatalf("failed to decode legacy action: %v", err)
+	}
+	if decoded.CreateMethod != "" || decoded.Gas != 100 {
+		t.Fatalf("legacy action decoded wrongly: %+v", decoded)
+	}
+}
+
+func TestStorageAddress(t *testing.T) {
+	var (
+		sender         = common.Address{0x1}
+		proxy          = common.Address{0x2} // EIP-1967 beacon proxy
+		beacon         = common.Address{0x3}
+		implementation = common.Address{0x4}
+		token          = common.Address{0x5}
+		library        = common.Address{0x6}
+		store          = &MemoryStore{data: make(map[common.Hash][]byte)}
+	)
+	tracer := NewOeTracer(store, common.Hash{}, big.NewInt(1), common.Hash{0x1}, 0, WithTracerConfig(TracerConfig{Verbose: true}))
+	tracer.CaptureStart(nil, sender, proxy, false, nil, 100_000, big.NewInt(0))
+	// the proxy asks the beacon for the implementation, then delegates to the beacon's upgrade logic
+	tracer.CaptureEnter(vm.STATICCALL, proxy, beacon, nil, 90_000, nil)
+	tracer.CaptureExit(nil, 100, nil)
+	tracer.CaptureEnter(vm.DELEGATECALL, proxy, beacon, nil, 80_000, nil)
+	tracer.CaptureEnter(vm.DELEGATECALL, proxy, implementation, nil, 70_000, nil)
+	// a plain call switches the storage context, a library linked by callcode keeps the new one
+	tracer.CaptureEnter(vm.CALL, proxy, token, nil, 60_000, big.NewInt(0))
+	tracer.CaptureEnter(vm.CALLCODE, token, library, nil, 50_000, big.NewInt(0))
+	tracer.CaptureExit(nil, 100, nil)
+	tracer.CaptureExit(nil, 200, nil)
+	tracer.CaptureExit(nil, 300, nil)
+	tracer.CaptureExit(nil, 400, nil)
+	tracer.CaptureEnd(nil, 500, nil)
+
+	want := []*common.Address{nil, nil, &proxy, &proxy, nil, &token}
+	check := func(name string, traces ActionTraceList, want []*common.Address) {
+		if len(traces) != len(want) {
+			t.Fatalf("%s: trace count mismatch: have %d, want %d", name, len(traces), len(want))
+		}
+		for i, trace := range traces {
+			if !reflect.DeepEqual(trace.StorageAddress, want[i]) {
+				t.Errorf("%s: trace %v: storage address mismatch: have %v, want %v", name, trace.TraceAddress, trace.StorageAddress, want[i])
+			}
+		}
+	}
+	traces, err := tracer.GetTraces()
+	if err != nil {
+		t.Fatalf("failed to get traces: %v", err)
+	}
+	check("traced", traces, want)
+	// the root and both delegatecall frames run on the storage of the proxy
+	if *traces[0].Action.To != proxy {
+		t.Fatalf("root recipient mismatch: have %v, want %v", traces[0].Action.To, proxy)
+	}
+
+	if err := tracer.PersistTraceContext(context.Background()); err != nil {
+		t.Fatalf("failed to persist traces: %v", err)
+	}
+	stored, err := ReadRpcTxTraceWithConfig(context.Background(), store, common.Hash{0x1}, TracerConfig{Verbose: true})
+	if err != nil {
+		t.Fatalf("failed to read trace: %v", err)
+	}
+	check("stored", stored, want)
+
+	// the default parity compatible form omits the field
+	stored, err = ReadRpcTxTrace(context.Background(), store, common.Hash{0x1})
+	if err != nil {
+		t.Fatalf("failed to read trace: %v", err)
+	}
+	check("default", stored, make([]*common.Address, len(want)))
+	blob, err := json.Marshal(stored)
+	if err != nil {
+		t.Fatalf("failed to encode traces: %v", err)
+	}
+	if strings.Contains(string(blob), "storageAddress") {
+		t.Fatalf("storage address emitted in the default form: %s", blob)
+	}
+}
+
+func TestStorageAddressTrailer(t *testing.T) {
+	// the layout of InternalActionTrace before the storage address trailer was added
+	type legacyTrace struct {
+		Action             InternalAction
+		Result             *InternalTraceActionResult `rlp:"nil"`
+		Error              string
+		TraceAddress       []uint32
+		Subtraces          uint32
+		SubtracesTruncated bool `rlp:"optional"`
+	}
+	legacy, err := rlp.EncodeToBytes(&legacyTrace{Action: InternalAction{CallType: CallTypeDelegateCall}, Subtraces: 1})
+	if err != nil {
+		t.Fatalf("failed to encode legacy trace: %v", err)
+	}
+	decoded := new(InternalActionTrace)
+	if err := rlp.DecodeBytes(legacy, decoded); err != nil {
+		t.Fatalf("failed to decode legacy trace: %v", err)
+	}
+	if decoded.StorageAddress != nil || decoded.Subtraces != 1 {
+		t.Fatalf("legacy trace decoded wrongly: %+v", decoded)
+	}
+}
+
+func TestFaultDetail(t *testing.T) {
+	var (
+		entry   = common.Address{0x40, 0x00}
+		invalid = common.Address{0x40, 0x01}
+		relay   = common.Address{0x40, 0x02}
+		looper  = common.Address{0x40, 0x03}
+	)
+	call := func(to common.Address, gas []byte) []byte {
+		code := []byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH20)}
+		code = append(code, to.Bytes()...)
+		return append(append(code, gas...), byte(vm.CALL), byte(vm.POP))
+	}
+	loop := []byte{byte(vm.JUMPDEST), byte(vm.PUSH1), 0, byte(vm.JUMP)}
+	alloc := types.GenesisAlloc{
+		entry:   {Code: append(append(call(invalid, []byte{byte(vm.GAS)}), call(relay, []byte{byte(vm.GAS)})...), byte(vm.STOP))},
+		invalid: {Code: []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 2, byte(vm.INVALID)}},
+		// the relay reverts after the looper ran out of gas
+		relay:  {Code: append(call(looper, []byte{byte(vm.PUSH2), 0x10, 0x00}), byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.REVERT))},
+		looper: {Code: loop},
+	}
+	state := tests.MakePreState(rawdb.NewMemoryDatabase(), alloc, false, rawdb.HashScheme)
+	defer state.Close()
+
+	tracer := traceProxyChain(t, state.StateDB, entry, nil, WithTracerConfig(TracerConfig{Verbose: true}))
+	internal := tracer.getInternalTraces()
+	raw, err := rlp.EncodeToBytes(internal)
+	if err != nil {
+		t.Fatalf("failed to encode traces: %v", err)
+	}
+	stored := new(InternalActionTraceList)
+	if err := rlp.DecodeBytes(raw, stored); err != nil {
+		t.Fatalf("failed to decode traces: %v", err)
+	}
+	for name, traces := range map[string]ActionTraceList{"traced": internal.ToTracesWithConfig(TracerConfig{Verbose: true}), "stored": stored.ToTracesWithConfig(TracerConfig{Verbose: true})} {
+		if len(traces) != 4 {
+			t.Fatalf("%s: trace count mismatch: have %d, want %d", name, len(traces), 4)
+		}
+		want := &FaultInfo{PC: 4, Op: "INVALID", Gas: traces[1].ErrorDetail.Gas, Depth: 2}
+		if !reflect.DeepEqual(traces[1].ErrorDetail, want) || traces[1].Error == "" {
+			t.Fatalf("%s: invalid opcode detail mismatch: have %+v, want %+v", name, traces[1].ErrorDetail, want)
+		}
+		// only the innermost fault carries the detail, not the relay reverting after it
+		if traces[2].Error == "" || traces[2].ErrorDetail != nil {
+			t.Fatalf("%s: relay detail mismatch: %q %+v", name, traces[2].Error, traces[2].ErrorDetail)
+		}
+		detail := traces[3].ErrorDetail
+		if traces[3].Error != ParityErrorString(vm.ErrOutOfGas) || detail == nil || detail.Depth != 3 || detail.Gas > 0x1000 ||
+			detail.PC >= uint64(len(loop)) || vm.OpCode(loop[detail.PC]).String() != detail.Op {
+			t.Fatalf("%s: out of gas detail mismatch: %q %+v", name, traces[3].Error, detail)
+		}
+		if traces[0].ErrorDetail != nil {
+			t.Fatalf("%s: detail of a succeeded frame: %+v", name, traces[0].ErrorDetail)
+		}
+	}
+	// the evm errors are stored, only the parity form renders them with their OpenEthereum strings
+	if internal.Traces[2].Error != vm.ErrExecutionReverted.Error() || internal.Traces[3].Error != vm.ErrOutOfGas.Error() {
+		t.Fatalf("stored errors mismatch: %q, %q", internal.Traces[2].Error, internal.Traces[3].Error)
+	}
+	frame, err := stored.ToGethCallFrame()
+	if err != nil {
+		t.Fatalf("failed to convert traces: %v", err)
+	}
+	if relay := frame.Calls[1]; relay.Error != vm.ErrExecutionReverted.Error() || relay.Calls[0].Error != vm.ErrOutOfGas.Error() {
+		t.Fatalf("geth errors mismatch: %q, %q", relay.Error, relay.Calls[0].Error)
+	}
+
+	// the default parity compatible form omits the detail
+	blob, err := json.Marshal(stored.ToTraces())
+	if err != nil {
+		t.Fatalf("failed to encode traces: %v", err)
+	}
+	if strings.Contains(string(blob), "errorDetail") {
+		t.Fatalf("error detail emitted in the default form: %s", blob)
+	}
+}
+
+func TestBlockTimestamp(t *testing.T) {
+	store := &MemoryStore{data: make(map[common.Hash][]byte)}
+	tracer := NewOeTracer(store, common.Hash{0xb}, big.NewInt(1), common.Hash{0x1}, 0, WithBlockTimestamp(1_700_000_000))
+	tracer.CaptureStart(nil, common.Address{0x1}, common.Address{0x2}, false, nil, 100_000, big.NewInt(0))
+	tracer.CaptureEnter(vm.CALL, common.Address{0x2}, common.Address{0x3}, nil, 50_000, big.NewInt(0))
+	tracer.CaptureExit(nil, 100, nil)
+	tracer.CaptureEnd(nil, 200, nil)
+	// no gas breakdown precedes the timestamp
+	if err := tracer.PersistTraceContext(context.Background()); err != nil {
+		t.Fatalf("failed to persist traces: %v", err)
+	}
+
+	traces, err := ReadRpcTxTrace(context.Background(), store, common.Hash{0x1})
+	if err != nil {
+		t.Fatalf("failed to read traces: %v", err)
+	}
+	for _, trace := range traces {
+		if trace.BlockTimestamp != 1_700_000_000 {
+			t.Fatalf("trace %v: block timestamp mismatch: have %d", trace.TraceAddress, trace.BlockTimestamp)
+		}
+	}
+	meta, err := ReadRpcTxTraceWithMeta(context.Background(), store, common.Hash{0x1})
+	if err != nil || meta.GasBreakdown != nil || meta.Traces[0].BlockTimestamp != 1_700_000_000 {
+		t.Fatalf("traces with meta mismatch: %+v, %v", meta, err)
+	}
+	blob, err := json.Marshal(traces[0])
+	if err != nil {
+		t.Fatalf("failed to encode trace: %v", err)
+	}
+	if !strings.Contains(string(blob), `"blockTimestamp":1700000000`) {
+		t.Fatalf("block timestamp missing from json: %s", blob)
+	}
+}
+
+func TestBlockTimestampTrailer(t *testing.T) {
+	// the layout of InternalActionTraceList before the timestamp trailer was added
+	type legacyTraceList struct {
+		Traces              []*InternalActionTrace
+		BlockHash           common.Hash
+		BlockNumber         *big.Int
+		TransactionHash     common.Hash
+		TransactionPosition uint64
+		GasBreakdown        *TxGasBreakdown `rlp:"optional"`
+	}
+	from, to := common.Address{0x1}, common.Address{0x2}
+	root := &InternalActionTrace{
+		Action:       InternalAction{CallType: CallTypeCall, From: &from, To: &to, Value: big.NewInt(0)},
+		Result:       &InternalTraceActionResult{GasUsed: 100},
+		TraceAddress: []uint32{},
+	}
+	for _, breakdown := range []*TxGasBreakdown{nil, {IntrinsicGas: 21000, EffectiveGasUsed: 21100}} {
+		legacy, err := rlp.EncodeToBytes(&legacyTraceList{Traces: []*InternalActionTrace{root}, BlockNumber: big.NewInt(1), TransactionHash: common.Hash{0x1}, GasBreakdown: breakdown})
+		if err != nil {
+			t.Fatalf("failed to encode legacy traces: %v", err)
+		}
+		store := &MemoryStore{data: map[common.Hash][]byte{{0x1}: legacy}}
+		meta, err := ReadRpcTxTraceWithMeta(context.Background(), store, common.Hash{0x1})
+		if err != nil {
+			t.Fatalf("failed to read legacy traces: %v", err)
+		}
+		if meta.Traces[0].BlockTimestamp != 0 || !reflect.DeepEqual(meta.GasBreakdown, breakdown) {
+			t.Fatalf("legacy traces decoded wrongly: %+v", meta)
+		}
+		blob, err := json.Marshal(meta.Traces)
+		if err != nil {
+			t.Fatalf("failed to encode traces: %v", err)
+		}
+		if strings.Contains(string(blob), "blockTimestamp") {
+			t.Fatalf("unknown block timestamp emitted: %s", blob)
+		}
+	}
+}
+
+func TestSenderOverride(t *testing.T) {
+	var (
+		ctx       = context.Background()
+		system    = common.Address{0xff, 0xfe} // the sender the message is executed with
+		original  = common.Address{0x5e}       // the sender whose signature can't be recovered
+		eoa       = common.Address{0x50, 0x01}
+		txHash    = common.Hash{0x1}
+		blockHash = common.Hash{0xb1}
+	)
+	alloc := types.GenesisAlloc{system: {Balance: big.NewInt(params.Ether)}}
+	state := tests.MakePreState(rawdb.NewMemoryDatabase(), alloc, false, rawdb.HashScheme)
+	defer state.Close()
+
+	for _, impersonated := range []bool{true, false} {
+		store := &MemoryStore{data: make(map[common.Hash][]byte)}
+		// the hash of the pending block is only known once its txs executed, simple transfers are skipped
+		tracer := NewOeTracer(store, common.Hash{}, big.NewInt(1), txHash, 0, WithTracerConfig(TracerConfig{SkipSimpleTransfers: true}))
+		tracer.SetSenderOverride(original, impersonated)
+		blkContext := vm.BlockContext{
+			CanTransfer: core.CanTransfer,
+			Transfer:    core.Transfer,
+			GasLimit:    30_000_000,
+			BlockNumber: big.NewInt(1),
+			Difficulty:  big.NewInt(1),
+			BaseFee:     big.NewInt(0),
+		}
+		msg := &core.Message{
+			From:              system,
+			To:                &eoa,
+			Value:             big.NewInt(7),
+			GasLimit:          21_000,
+			GasPrice:          big.NewInt(0),
+			GasFeeCap:         big.NewInt(0),
+			GasTipCap:         big.NewInt(0),
+			SkipAccountChecks: true,
+		}
+		evm := vm.NewEVM(blkContext, core.NewEVMTxContext(msg), state.StateDB.Copy(), params.AllEthashProtocolChanges, vm.Config{Tracer: tracer})
+		if _, err := core.ApplyMessage(evm, msg, new(core.GasPool).AddGas(msg.GasLimit)); err != nil {
+			t.Fatalf("impersonated %v: failed to execute message: %v", impersonated, err)
+		}
+		tracer.SetBlockHash(blockHash)
+		if err := tracer.PersistTraceContext(ctx); err != nil {
+			t.Fatalf("impersonated %v: failed to persist traces: %v", impersonated, err)
+		}
+
+		// the overridden sender isn't the one a simple transfer would be rebuilt with, the traces are kept
+		verbose, err := ReadRpcTxTraceWithConfig(ctx, store, txHash, TracerConfig{Verbose: true})
+		if err != nil {
+			t.Fatalf("impersonated %v: failed to read traces: %v", impersonated, err)
+		}
+		if len(verbose) != 1 || *verbose[0].Action.From != original || verbose[0].Impersonated != impersonated || verbose[0].BlockHash != blockHash {
+			t.Fatalf("impersonated %v: verbose trace mismatch: %+v", impersonated, verbose)
+		}
+		traces, err := ReadRpcTxTrace(ctx, store, txHash)
+		if err != nil {
+			t.Fatalf("impersonated %v: failed to read traces: %v", impersonated, err)
+		}
+		blob, err := json.Marshal(traces)
+		if err != nil {
+			t.Fatalf("failed to encode traces: %v", err)
+		}
+		if *traces[0].Action.From != original || traces[0].BlockHash != blockHash || strings.Contains(string(blob), "impersonated") {
+			t.Fatalf("impersonated %v: default trace mismatch: %s", impersonated, blob)
+		}
+	}
+}
+
+func TestEOATransferInput(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		sender = common.Address{0x5e}
+		eoa    = common.Address{0x50, 0x01}
+		txHash = common.Hash{0x1}
+		memo   = bytes.Repeat([]byte{0x01}, 100)
+	)
+	alloc := types.GenesisAlloc{sender: {Balance: big.NewInt(params.Ether)}}
+	state := tests.MakePreState(rawdb.NewMemoryDatabase(), alloc, false, rawdb.HashScheme)
+	defer state.Close()
+
+	store := &MemoryStore{data: make(map[common.Hash][]byte)}
+	tracer := NewOeTracer(store, common.Hash{0xb1}, big.NewInt(1), txHash, 0)
+	blkContext := vm.BlockContext{
+		CanTransfer: core.CanTransfer,
+		Transfer:    core.Transfer,
+		GasLimit:    30_000_000,
+		BlockNumber: big.NewInt(1),
+		Difficulty:  big.NewInt(1),
+		BaseFee:     big.NewInt(0),
+	}
+	msg := &core.Message{
+		From:              sender,
+		To:                &eoa,
+		Value:             big.NewInt(7),
+		Data:              memo,
+		GasLimit:          50_000,
+		GasPrice:          big.NewInt(0),
+		GasFeeCap:         big.NewInt(0),
+		GasTipCap:         big.NewInt(0),
+		SkipAccountChecks: true,
+	}
+	evm := vm.NewEVM(blkContext, core.NewEVMTxContext(msg), state.StateDB.Copy(), params.AllEthashProtocolChanges, vm.Config{Tracer: tracer})
+	receipt, err := core.ApplyMessage(evm, msg, new(core.GasPool).AddGas(msg.GasLimit))
+	if err != nil {
+		t.Fatalf("failed to execute message: %v", err)
+	}
+	if err := tracer.PersistTraceContext(ctx); err != nil {
+		t.Fatalf("failed to persist traces: %v", err)
+	}
+
+	// the gas of the calldata sums up with the 21000 base to the one of the receipt
+	calldataGas := uint64(len(memo)) * params.TxDataNonZeroGasEIP2028
+	if receipt.UsedGas != params.TxGas+calldataGas {
+		t.Fatalf("receipt gas mismatch: have %d, want %d", receipt.UsedGas, params.TxGas+calldataGas)
+	}
+	root := tracer.getInternalTraces().Traces[0]
+	if !root.EOAInput || root.Result.GasUsed != calldataGas {
+		t.Fatalf("root trace mismatch: eoa input %v, gas used %d, want %d", root.EOAInput, root.Result.GasUsed, calldataGas)
+	}
+	rules := params.AllEthashProtocolChanges.Rules(blkContext.BlockNumber, false, 0)
+	breakdown, err := ComputeGasBreakdown(msg.Data, msg.AccessList, msg.To == nil, rules, root, receipt.UsedGas)
+	if err != nil {
+		t.Fatalf("failed to compute gas breakdown: %v", err)
+	}
+	if want := (TxGasBreakdown{IntrinsicGas: receipt.UsedGas, EffectiveGasUsed: receipt.UsedGas}); *breakdown != want {
+		t.Fatalf("gas breakdown mismatch: have %+v, want %+v", *breakdown, want)
+	}
+
+	input := hexutil.Encode(memo)
+	for _, test := range []struct {
+		mode EOATransferInputMode
+		want string
+	}{
+		{"", input},
+		{EOATransferInputKeep, input},
+		{EOATransferInputStrip, "0x"},
+		{EOATransferInputStripAndFlag, "0x"},
+	} {
+		traces, err := ReadRpcTxTraceWithConfig(ctx, store, txHash, TracerConfig{EOATransferInputMode: test.mode})
+		if err != nil {
+			t.Fatalf("mode %q: failed to read traces: %v", test.mode, err)
+		}
+		if err := ReconcileGas(traces, receipt.UsedGas, params.TxGas); err != nil {
+			t.Fatalf("mode %q: %v", test.mode, err)
+		}
+		if gas := AttributeGas(traces)[eoa]; gas.SelfGas != calldataGas {
+			t.Fatalf("mode %q: gas attributed to the recipient %d, want %d", test.mode, gas.SelfGas, calldataGas)
+		}
+		blob, err := json.Marshal(traces)
+		if err != nil {
+			t.Fatalf("mode %q: failed to encode traces: %v", test.mode, err)
+		}
+		flag := ""
+		if test.mode == EOATransferInputStripAndFlag {
+			flag = `"inputStripped":true,`
+		}
+		want := `[{"action":{"callType":"call","from":"0x5e00000000000000000000000000000000000000","to":"0x5001000000000000000000000000000000000000",` +
+			`"value":"0x7","gas":"0x6b08","input":"` + test.want + `"},"blockHash":"0xb100000000000000000000000000000000000000000000000000000000000000",` +
+			`"result":{"gasUsed":"0x640","output":"0x"},"subtraces":0,` + flag + `"traceAddress":[],` +
+			`"transactionHash":"0x0100000000000000000000000000000000000000000000000000000000000000","transactionPosition":0,"type":"call","blockNumber":1}]`
+		if string(blob) != want {
+			t.Fatalf("mode %q: json mismatch:\nhave %s\nwant %s", test.mode, blob, want)
+		}
+	}
+}
+
+func TestImpersonatedTrailer(t *testing.T) {
+	// the layout of InternalActionTrace before the impersonated trailer was added
+	type legacyTrace struct {
+		Action             InternalAction
+		Result             *InternalTraceActionResult `rlp:"nil"`
+		Error              string
+		TraceAddress       []uint32
+		Subtraces          uint32
+		SubtracesTruncated bool            `rlp:"optional"`
+		StorageAddress     *common.Address `rlp:"optional,nil"`
+		Fault              *FaultInfo      `rlp:"optional,nil"`
+	}
+	from := common.Address{0x1}
+	trace := &InternalActionTrace{Action: InternalAction{CallType: CallTypeCall, From: &from}, Error: "Reverted", TraceAddress: []uint32{}}
+	legacy, err := rlp.EncodeToBytes(&legacyTrace{Action: trace.Action, Error: trace.Error, TraceAddress: trace.TraceAddress})
+	if err != nil {
+		t.Fatalf("failed to encode legacy trace: %v", err)
+	}
+	// the traces without an impersonated sender keep their encoding
+	if current, err := rlp.EncodeToBytes(trace); err != nil || !bytes.Equal(current, legacy) {
+		t.Fatalf("encoding changed: have %x, want %x, %v", current, legacy, err)
+	}
+	trace.Impersonated = true
+	blob, err := rlp.EncodeToBytes(trace)
+	if err != nil {
+		t.Fatalf("failed to encode trace: %v", err)
+	}
+	decoded := new(InternalActionTrace)
+	if err := rlp.DecodeBytes(blob, decoded); err != nil || !decoded.Impersonated || decoded.StorageAddress != nil || decoded.Fault != nil {
+		t.Fatalf("impersonated trace decoded wrongly: %+v, %v", decoded, err)
+	}
+}
+
+var errStoreUnavailable = errors.New("store temporarily unavailable")
+
+// flakyStore fails the first failures writes
+type flakyStore struct {
+	MemoryStore
+	failures int
+	writes   int
+}
+
+func (store *flakyStore) WriteTxTrace(ctx context.Context, txHash common.Hash, trace []byte) error {
+	store.writes++
+	if store.writes <= store.failures {
+		return errStoreUnavailable
+	}
+	return store.MemoryStore.WriteTxTrace(ctx, txHash, trace)
+}
+
+func TestPersistTraceRetry(t *testing.T) {
+	trace := func(store Store) *OeTracer {
+		tracer := NewOeTracer(store, common.Hash{}, big.NewInt(1), common.Hash{0x1}, 0)
+		tracer.CaptureStart(nil, common.Address{0x1}, common.Address{0x2}, false, nil, 100_000, big.NewInt(0))
+		tracer.CaptureEnd(nil, 100, nil)
+		return tracer
+	}
+
+	store := &flakyStore{MemoryStore: MemoryStore{data: make(map[common.Hash][]byte)}, failures: 1}
+	err := trace(store).PersistTraceContext(context.Background())
+	if !errors.Is(err, ErrTraceWrite) || !errors.Is(err, errStoreUnavailable) {
+		t.Fatalf("persist error mismatch: have %v, want %v wrapping %v", err, ErrTraceWrite, errStoreUnavailable)
+	}
+
+	store = &flakyStore{MemoryStore: MemoryStore{data: make(map[common.Hash][]byte)}, failures: 1}
+	if err := trace(store).PersistTraceWithRetry(context.Background(), 3, time.Millisecond); err != nil {
+		t.Fatalf("failed to persist traces with retry: %v", err)
+	}
+	if store.writes != 2 || len(store.data[common.Hash{0x1}]) == 0 {
+		t.Fatalf("retry mismatch: have %d writes, stored %v", store.writes, len(store.data[common.Hash{0x1}]) != 0)
+	}
+
+	store = &flakyStore{MemoryStore: MemoryStore{data: make(map[common.Hash][]byte)}, failures: 5}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := trace(store).PersistTraceWithRetry(ctx, 3, time.Hour); !errors.Is(err, context.Canceled) || store.writes != 1 {
+		t.Fatalf("cancelled retry mismatch: have %v after %d writes, want %v after %d", err, store.writes, context.Canceled, 1)
+	}
+
+	// incomplete traces aren't retried
+	store = &flakyStore{MemoryStore: MemoryStore{data: make(map[common.Hash][]byte)}}
+	tracer := NewOeTracer(store, common.Hash{}, big.NewInt(1), common.Hash{0x1}, 0)
+	tracer.CaptureStart(nil, common.Address{0x1}, common.Address{0x2}, false, nil, 100_000, big.NewInt(0))
+	if err := tracer.PersistTraceWithRetry(context.Background(), 3, time.Millisecond); !errors.Is(err, ErrTraceIncomplete) || store.writes != 0 {
+		t.Fatalf("incomplete persist mismatch: have %v after %d writes", err, store.writes)
+	}
+}
+
+// stalledStore blocks every read and write until the context is done
+type stalledStore struct {
+	MemoryStore
+}
+
+func (store *stalledStore) ReadTxTrace(ctx context.Context, txHash common.Hash) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (store *stalledStore) WriteTxTrace(ctx context.Context, txHash common.Hash, trace []byte) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestPersistTraceContext(t *testing.T) {
+	trace := func(store Store, opts ...Option) *OeTracer {
+		tracer := NewOeTracer(store, common.Hash{}, big.NewInt(1), common.Hash{0x1}, 0, opts...)
+		tracer.CaptureStart(nil, common.Address{0x1}, common.Address{0x2}, false, nil, 100_000, big.NewInt(0))
+		tracer.CaptureEnd(nil, 100, nil)
+		return tracer
+	}
+	stalled := &stalledStore{MemoryStore{data: make(map[common.Hash][]byte)}}
+
+	// the caller bounds the write
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := trace(stalled).PersistTraceContext(ctx); !errors.Is(err, ErrTraceWrite) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("bounded persist mismatch: %v", err)
+	}
+	// the write timeout bounds the deprecated wrapper and the contexts without deadline
+	if err := trace(stalled, WithWriteTimeout(10*time.Millisecond)).PersistTraceContext(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("write timeout mismatch: %v", err)
+	}
+	cancellable, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := trace(stalled, WithWriteTimeout(10*time.Millisecond)).PersistTraceContext(cancellable); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("write timeout mismatch: %v", err)
+	}
+	// but doesn't extend the deadline of the caller
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := trace(stalled, WithWriteTimeout(time.Hour)).PersistTraceContext(ctx); !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > time.Minute {
+		t.Fatalf("caller deadline mismatch: %v", err)
+	}
+
+	// the deprecated wrapper still persists
+	store := &MemoryStore{data: make(map[common.Hash][]byte)}
+	if err := trace(store, WithWriteTimeout(time.Minute)).PersistTraceContext(context.Background()); err != nil || len(store.data[common.Hash{0x1}]) == 0 {
+		t.Fatalf("failed to persist traces: %v", err)
+	}
+
+	// reads give up with the context too, nothing is decoded once it's done
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := ReadRpcTxTrace(ctx, stalled, common.Hash{0x1}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("stalled read mismatch: %v", err)
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ReadRpcTxTrace(cancelled, store, common.Hash{0x1}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled read mismatch: %v", err)
+	}
+	if _, err := ReadRpcTxTraceWithMeta(cancelled, store, common.Hash{0x1}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled read mismatch: %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package txtracev2
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ValueTransfer is wei moved by a frame of a tx.
+type ValueTransfer struct {
+	From         common.Address
+	To           common.Address
+	Value        *big.Int
+	CallType     uint8
+	TraceAddress []uint32
+}
+
+// SelfTransfer reports whether the value stays with the sender, e.g. the value of a CALLCODE frame, which
+// runs the code of the callee on the balance and storage of the caller.
+func (t *ValueTransfer) SelfTransfer() bool {
+	return t.From == t.To
+}
+
+// ExtractValueTransfers returns the non-zero value transfers of the traces of a tx in trace order, including
+// the top-level one. Frames in reverted subtrees, the failed and the RolledBack ones of the rpc form, moved
+// nothing and are skipped, so are delegate and static calls, which carry no value of their own. The value of
+// a CALLCODE frame is sent by the caller to itself, the action reports the code address as to, like parity,
+// but the transfer is a self transfer.
+func ExtractValueTransfers(list *InternalActionTraceList) []ValueTransfer {
+	var transfers []ValueTransfer
+	reverted := make(revertedFrames)
+	for _, interTrace := range list.Traces {
+		if reverted.visit(interTrace) {
+			continue
+		}
+		action := &interTrace.Action
+		var from, to *common.Address
+		value := action.Value
+		switch action.CallType {
+		case CallTypeCreate:
+			from, to = action.From, action.Address
+			if interTrace.Result != nil && interTrace.Result.Address != nil {
+				to = interTrace.Result.Address
+			}
+		case CallTypeSuicide:
+			from, to, value = action.Address, action.RefundAddress, action.Balance
+		case CallTypeCallCode:
+			from, to = action.From, action.From
+		case CallTypeDelegateCall, CallTypeStaticCall:
+			continue
+		default:
+			from, to = action.From, action.To
+		}
+		if from == nil || to == nil || value == nil || value.Sign() == 0 {
+			continue
+		}
+		transfers = append(transfers, ValueTransfer{
+			From:         *from,
+			To:           *to,
+			Value:        new(big.Int).Set(value),
+			CallType:     action.CallType,
+			TraceAddress: append([]uint32{}, interTrace.TraceAddress...),
+		})
+	}
+	return transfers
+}
+
+// NetFlows sums the transfers up per account, what it received minus what it sent. Self transfers don't
+// move any value and are left out, accounts only involved in them have no entry.
+func NetFlows(transfers []ValueTransfer) map[common.Address]*big.Int {
+	flows := make(map[common.Address]*big.Int)
+	flow := func(account common.Address) *big.Int {
+		if flows[account] == nil {
+			flows[account] = new(big.Int)
+		}
+		return flows[account]
+	}
+	for i := range transfers {
+		if transfers[i].SelfTransfer() {
+			continue
+		}
+		flow(transfers[i].From).Sub(flow(transfers[i].From), transfers[i].Value)
+		flow(transfers[i].To).Add(flow(transfers[i].To), transfers[i].Value)
+	}
+	return flows
+}
+
+// revertedFrames tracks the frames whose effects were reverted as they or one of their ancestors failed, the
+// latter being the RolledBack ones of the rpc form
+type revertedFrames map[string]bool
+
+// visit reports whether the frame was reverted, the traces must be visited parents first
+func (r revertedFrames) visit(interTrace *InternalActionTrace) bool {
+	return r.mark(interTrace.TraceAddress, interTrace.Error != "")
+}
+
+// visitRpc reports whether the rpc frame was reverted, the traces must be visited parents first
+func (r revertedFrames) visitRpc(trace *RpcActionTrace) bool {
+	return r.mark(trace.TraceAddress, trace.Error != "" || trace.RolledBack)
+}
+
+// mark records the frame as reverted if it failed or its parent was, and reports whether it was
+func (r revertedFrames) mark(traceAddress []uint32, failed bool) bool {
+	if n := len(traceAddress); n > 0 && r[traceAddressKey(traceAddress[:n-1])] {
+		failed = true
+	}
+	if failed {
+		r[traceAddressKey(traceAddress)] = true
+	}
+	return failed
+}
+
+// RevertedTraces reports for each of the rpc traces of a tx whether its effects were reverted, as it or one of its
+// ancestors failed or it's RolledBack, e.g. below a failed frame filtered out of the list. Unlike MarkRolledBack,
+// the traces are left untouched. The traces must be in trace order, parents first.
+func RevertedTraces(traces []RpcActionTrace) []bool {
+	reverted := make([]bool, len(traces))
+	frames := make(revertedFrames)
+	for i := range traces {
+		reverted[i] = frames.visitRpc(&traces[i])
+	}
+	return reverted
+}
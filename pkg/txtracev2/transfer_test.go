@@ -0,0 +1,101 @@
+package txtracev2
+
+import (
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/tests"
+)
+
+func TestCallCodeValueTransfers(t *testing.T) {
+	var (
+		wallet    = common.Address{0x40, 0x00} // a legacy contract running library code with callcode
+		library   = common.Address{0x40, 0x01}
+		recipient = common.Address{0x40, 0x02}
+		reverter  = common.Address{0x40, 0x03}
+	)
+	call := func(op vm.OpCode, to common.Address, value byte) []byte {
+		code := []byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), value, byte(vm.PUSH20)}
+		code = append(code, to.Bytes()...)
+		return append(code, byte(vm.GAS), byte(op), byte(vm.POP))
+	}
+	var code []byte
+	code = append(code, call(vm.CALLCODE, library, 5)...)
+	code = append(code, call(vm.CALL, recipient, 7)...)
+	code = append(code, call(vm.CALL, reverter, 9)...)
+	code = append(code, byte(vm.STOP))
+	alloc := types.GenesisAlloc{
+		wallet:   {Code: code, Balance: big.NewInt(100)},
+		library:  {Code: []byte{byte(vm.STOP)}},
+		reverter: {Code: []byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.REVERT)}},
+	}
+	state := tests.MakePreState(rawdb.NewMemoryDatabase(), alloc, false, rawdb.HashScheme)
+	defer state.Close()
+
+	tracer := traceProxyChain(t, state.StateDB, wallet, nil, WithTracerConfig(TracerConfig{Verbose: true}))
+	traces, err := tracer.GetTraces()
+	if err != nil {
+		t.Fatalf("failed to get traces: %v", err)
+	}
+	if len(traces) != 4 {
+		t.Fatalf("trace count mismatch: have %d, want 4", len(traces))
+	}
+	// like parity, to is the code address and the value the explicit one, the storage is the wallet's
+	callcode := traces[1]
+	if *callcode.Action.CallType != CallCode || *callcode.Action.From != wallet || *callcode.Action.To != library ||
+		callcode.Action.Value.ToInt().Int64() != 5 || callcode.StorageAddress == nil || *callcode.StorageAddress != wallet {
+		t.Fatalf("callcode trace mismatch: %+v", callcode)
+	}
+
+	transfers := ExtractValueTransfers(tracer.getInternalTraces())
+	want := []ValueTransfer{
+		{From: wallet, To: wallet, Value: big.NewInt(5), CallType: CallTypeCallCode, TraceAddress: []uint32{0}},
+		{From: wallet, To: recipient, Value: big.NewInt(7), CallType: CallTypeCall, TraceAddress: []uint32{1}},
+	}
+	if len(transfers) != len(want) {
+		t.Fatalf("transfer count mismatch: have %+v, want %+v", transfers, want)
+	}
+	for i := range want {
+		have := transfers[i]
+		if have.From != want[i].From || have.To != want[i].To || have.Value.Cmp(want[i].Value) != 0 || have.CallType != want[i].CallType ||
+			traceAddressKey(have.TraceAddress) != traceAddressKey(want[i].TraceAddress) {
+			t.Fatalf("transfer %d mismatch: have %+v, want %+v", i, have, want[i])
+		}
+	}
+	if !transfers[0].SelfTransfer() || transfers[1].SelfTransfer() {
+		t.Fatalf("self transfer mismatch")
+	}
+
+	flows := NetFlows(transfers)
+	if len(flows) != 2 || flows[wallet].Int64() != -7 || flows[recipient].Int64() != 7 {
+		t.Fatalf("net flows mismatch: %v", flows)
+	}
+	// the balances agree, the callcode value never left the wallet
+	if balance := state.StateDB.GetBalance(wallet); balance.Uint64() != 93 {
+		t.Fatalf("wallet balance mismatch: have %v, want 93", balance)
+	}
+}
+
+func TestRevertedTraces(t *testing.T) {
+	traces := []RpcActionTrace{
+		{TraceAddress: []uint32{}},
+		{TraceAddress: []uint32{0}, Error: "execution reverted"},
+		{TraceAddress: []uint32{0, 0}},
+		{TraceAddress: []uint32{1}},
+		// below a failed frame filtered out of the list
+		{TraceAddress: []uint32{2, 0}, RolledBack: true},
+		{TraceAddress: []uint32{2, 0, 0}},
+	}
+	reverted := RevertedTraces(traces)
+	if want := []bool{false, true, true, false, true, true}; !reflect.DeepEqual(reverted, want) {
+		t.Fatalf("reverted traces mismatch: have %v, want %v", reverted, want)
+	}
+	if traces[2].RolledBack || traces[5].RolledBack {
+		t.Fatalf("traces modified")
+	}
+}
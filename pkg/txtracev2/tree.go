@@ -0,0 +1,61 @@
+package txtracev2
+
+import (
+	"errors"
+	"fmt"
+)
+
+// TraceNode is a trace along with its sub traces.
+type TraceNode struct {
+	Trace    *RpcActionTrace `json:"trace"`
+	Children []*TraceNode    `json:"children,omitempty"`
+}
+
+// BuildTraceTree rebuilds the call tree of a tx from its flat trace list by the traceAddress prefixes.
+// Children keep the order of the flat list, a trace whose parent can't be located is an error.
+func BuildTraceTree(traces []RpcActionTrace) (*TraceNode, error) {
+	var root *TraceNode
+	nodes := make(map[string]*TraceNode, len(traces))
+	for i := range traces {
+		trace := &traces[i]
+		key := traceAddressKey(trace.TraceAddress)
+		if _, ok := nodes[key]; ok {
+			return nil, fmt.Errorf("duplicated trace address %v", trace.TraceAddress)
+		}
+		node := &TraceNode{Trace: trace}
+		nodes[key] = node
+		if len(trace.TraceAddress) == 0 {
+			root = node
+			continue
+		}
+		parent, ok := nodes[traceAddressKey(trace.TraceAddress[:len(trace.TraceAddress)-1])]
+		if !ok {
+			return nil, fmt.Errorf("parent of trace %v not found", trace.TraceAddress)
+		}
+		parent.Children = append(parent.Children, node)
+	}
+	if root == nil {
+		return nil, errors.New("top-level trace not found")
+	}
+	return root, nil
+}
+
+// Walk visits the node and its descendants depth-first in the order of the flat trace list,
+// returning false from fn skips the children of the visited node.
+func (node *TraceNode) Walk(fn func(node *TraceNode) bool) {
+	if !fn(node) {
+		return
+	}
+	for _, child := range node.Children {
+		child.Walk(fn)
+	}
+}
+
+// traceAddressKey returns a map key of the trace address
+func traceAddressKey(traceAddress []uint32) string {
+	key := make([]byte, 0, 4*len(traceAddress))
+	for _, idx := range traceAddress {
+		key = append(key, byte(idx>>24), byte(idx>>16), byte(idx>>8), byte(idx))
+	}
+	return string(key)
+}
@@ -0,0 +1,48 @@
+package txtracev2
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBuildTraceTree(t *testing.T) {
+	blob, err := os.ReadFile(filepath.Join("testdata", "call_tracer_deep_calls.json"))
+	if err != nil {
+		t.Fatalf("failed to read testcase: %v", err)
+	}
+	test := new(callTracerTest)
+	if err := json.Unmarshal(blob, test); err != nil {
+		t.Fatalf("failed to parse testcase: %v", err)
+	}
+	root, err := BuildTraceTree(test.Result)
+	if err != nil {
+		t.Fatalf("failed to build trace tree: %v", err)
+	}
+
+	// walking the tree yields the flat list back, every node holds its subtraces
+	var flat []RpcActionTrace
+	root.Walk(func(node *TraceNode) bool {
+		if uint32(len(node.Children)) != node.Trace.Subtraces {
+			t.Fatalf("trace %v: have %d children, want %d", node.Trace.TraceAddress, len(node.Children), node.Trace.Subtraces)
+		}
+		flat = append(flat, *node.Trace)
+		return true
+	})
+	if !reflect.DeepEqual(flat, test.Result) {
+		t.Fatalf("flattened tree mismatch")
+	}
+
+	malformed := [][]RpcActionTrace{
+		{{TraceAddress: []uint32{0}}},
+		{{TraceAddress: []uint32{}}, {TraceAddress: []uint32{1, 0}}},
+		{{TraceAddress: []uint32{}}, {TraceAddress: []uint32{0}}, {TraceAddress: []uint32{0}}},
+	}
+	for _, traces := range malformed {
+		if _, err := BuildTraceTree(traces); err == nil {
+			t.Fatalf("expected error for malformed traces %v", traces)
+		}
+	}
+}
@@ -1,10 +1,16 @@
 package txtracev2
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"math/big"
+	"strings"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/rlp"
 )
 
@@ -15,6 +21,7 @@ const (
 	CallTypeDelegateCall
 	CallTypeStaticCall
 	CallTypeSuicide
+	CallTypeUnknown // a call made by an opcode the tracer doesn't know, e.g. a chain-specific one
 )
 
 var (
@@ -24,6 +31,24 @@ var (
 	StaticCall   string = "staticcall"
 )
 
+// ErrValueOutOfRange is returned for traces carrying a number the rpc form can't represent, e.g. a value
+// beyond 256 bits read from a corrupted store.
+var ErrValueOutOfRange = errors.New("value out of range")
+
+// ErrMalformedTrace is returned for traces whose structure is inconsistent, e.g. a corrupted store entry
+// of a call frame with neither a result nor an error.
+var ErrMalformedTrace = errors.New("malformed trace")
+
+// incompleteTraceError is reported for a frame with neither a result nor an error, e.g. a truncated
+// historical record, rather than presenting it as a successful frame.
+const incompleteTraceError = "incomplete trace"
+
+// Opcodes a create action is made by, parity reports both as CREATE
+const (
+	CreateMethodCreate  = "create"
+	CreateMethodCreate2 = "create2"
+)
+
 type InternalAction struct {
 	CallType      uint8
 	From          *common.Address `rlp:"nil"` // for SELFDESTRUCT nil is possible
@@ -35,6 +60,22 @@ type InternalAction struct {
 	Address       *common.Address `rlp:"nil"` // for SELFDESTRUCT, CREATE(internal)
 	RefundAddress *common.Address `rlp:"nil"` // for SELFDESTRUCT
 	Balance       *big.Int        `rlp:"nil"` // for SELFDESTRUCT
+
+	CreateMethod string `rlp:"optional"` // for CREATE, absent in traces stored by older versions
+	CallTypeName string `rlp:"optional"` // for CallTypeUnknown and registered opcodes, the rendered callType
+	Destroyed    *bool  `rlp:"optional"` // for SELFDESTRUCT since Cancun, whether the account was deleted, see Action.Destroyed
+
+	interned bool // Init/Input shares the buffer of the parent frame, see OeTracer.internInput
+}
+
+// ownedBytes returns data itself, or a copy of it when it is shared with other frames
+func (action *InternalAction) ownedBytes(data []byte) []byte {
+	if !action.interned {
+		return data
+	}
+	cpy := make([]byte, len(data))
+	copy(cpy, data)
+	return cpy
 }
 
 type InternalTraceActionResult struct {
@@ -50,6 +91,45 @@ type InternalActionTrace struct {
 	Error        string
 	TraceAddress []uint32
 	Subtraces    uint32
+
+	SubtracesTruncated bool `rlp:"optional"` // sub traces are dropped, below the max depth of the tracer or out of its address filter
+
+	// for DELEGATE_CALL, CALL_CODE, the address whose storage the code runs on, nested frames resolve
+	// through to the original storage context. A nil address followed by other optional fields is
+	// encoded empty, older versions only stored it last.
+	StorageAddress *common.Address `rlp:"optional,nil"`
+	Fault          *FaultInfo      `rlp:"optional,nil"` // for failed frames, where they failed
+
+	// for the top-level frame, its from is an impersonated sender set with OeTracer.SetSenderOverride
+	Impersonated bool `rlp:"optional"`
+	// for the top-level call of a tx sending an input to an account without code, its gasUsed is the gasUsed of
+	// the receipt beyond the 21000 base, i.e. the cost of the calldata, see TracerConfig.EOATransferInputMode
+	EOAInput bool `rlp:"optional"`
+	// for the only trace of a tx failing before the evm ran, e.g. lacking the funds for its gas or with a nonce
+	// too low, which has no result, see OeTracer.RecordPreExecutionFailure
+	PreExecution bool `rlp:"optional"`
+}
+
+// FaultInfo locates where a frame failed: the program counter and the opcode executed, the gas left before
+// it and the evm depth of the frame, 1 for the top-level one. Only the innermost failed frame carries it,
+// the ancestors of a frame carrying it don't, e.g. when they revert after it.
+type FaultInfo struct {
+	PC    uint64 `json:"pc"`
+	Op    string `json:"op"`
+	Gas   uint64 `json:"gas"`
+	Depth uint64 `json:"depth"`
+}
+
+// storageContext returns the address whose storage the code of the frame runs on
+func (trace *InternalActionTrace) storageContext() *common.Address {
+	switch trace.Action.CallType {
+	case CallTypeDelegateCall, CallTypeCallCode:
+		return trace.StorageAddress
+	case CallTypeCreate:
+		return trace.Action.Address
+	default:
+		return trace.Action.To
+	}
 }
 
 // InternalActions uses for store, simplifies structure to save space while compares with ActionTraceList
@@ -59,10 +139,92 @@ type InternalActionTraceList struct {
 	BlockNumber         *big.Int
 	TransactionHash     common.Hash
 	TransactionPosition uint64
+	GasBreakdown        *TxGasBreakdown `rlp:"optional,nil"` // trailer, absent in traces stored by older versions
+	Timestamp           uint64          `rlp:"optional"`     // block timestamp, zero if unknown or stored by older versions
 }
 
-// ToTraces convert InternalActionTraceLList to ActionTraceList
-func (it *InternalActionTraceList) ToTraces() (traces ActionTraceList) {
+// Validate checks the numbers of the traces fit their rpc form: values and balances are 256-bit unsigned
+// integers, the block number and the gas breakdown total fit in a uint64. Call and create frames must have
+// either a result or an error.
+func (it *InternalActionTraceList) Validate() error {
+	if it.BlockNumber != nil && (it.BlockNumber.Sign() < 0 || !it.BlockNumber.IsUint64()) {
+		return fmt.Errorf("%w: block number %v", ErrValueOutOfRange, it.BlockNumber)
+	}
+	for _, interTrace := range it.Traces {
+		if interTrace.Action.CallType != CallTypeSuicide && interTrace.Result == nil && interTrace.Error == "" {
+			return fmt.Errorf("%w: trace %v has neither result nor error", ErrMalformedTrace, interTrace.TraceAddress)
+		}
+		if !isUint256(interTrace.Action.Value) {
+			return fmt.Errorf("%w: trace %v value %v", ErrValueOutOfRange, interTrace.TraceAddress, interTrace.Action.Value)
+		}
+		if !isUint256(interTrace.Action.Balance) {
+			return fmt.Errorf("%w: trace %v balance %v", ErrValueOutOfRange, interTrace.TraceAddress, interTrace.Action.Balance)
+		}
+	}
+	if breakdown := it.GasBreakdown; breakdown != nil && breakdown.IntrinsicGas+breakdown.ExecutionGas < breakdown.IntrinsicGas {
+		return fmt.Errorf("%w: intrinsic gas %d plus execution gas %d", ErrValueOutOfRange, breakdown.IntrinsicGas, breakdown.ExecutionGas)
+	}
+	return nil
+}
+
+// EncodedSize returns the length of the rlp encoding of the traces, what they occupy in the store, without
+// keeping the encoding.
+func (it *InternalActionTraceList) EncodedSize() (int, error) {
+	var counter byteCounter
+	if err := rlp.Encode(&counter, it); err != nil {
+		return 0, err
+	}
+	return int(counter), nil
+}
+
+// byteCounter is a writer counting the bytes written to it
+type byteCounter int
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// isUint256 reports whether n is nil or fits in an unsigned 256-bit integer
+func isUint256(n *big.Int) bool {
+	return n == nil || (n.Sign() >= 0 && n.BitLen() <= 256)
+}
+
+// TracerConfig configures the rpc form of the traces, and what OeTracer persists for simple transfers.
+type TracerConfig struct {
+	// Verbose adds the fields beyond the parity format, e.g. storageAddress of delegatecall frames.
+	Verbose bool
+	// SkipSimpleTransfers persists a 1-byte marker instead of the traces of plain value transfers, which are
+	// derivable from the tx itself, see IsSimpleTransfer. They're read back with ReadRpcTxTraceWithTx.
+	SkipSimpleTransfers bool
+	// OmitSimpleTransfers persists nothing at all instead of the marker when SkipSimpleTransfers is set. Stores
+	// can't tell such txs from untraced ones, readers must know them and rebuild them with SimpleTransferTraces.
+	OmitSimpleTransfers bool
+	// EOATransferInputMode sets how the input of a tx to an account without code is emitted, e.g. the memo of
+	// a payment, the input is kept by default.
+	EOATransferInputMode EOATransferInputMode
+}
+
+// EOATransferInputMode is how the input of the top-level call of a tx to an account without code is emitted.
+// The parity versions disagree on it, some strip it while others keep it. Whatever the mode, the gasUsed of
+// the call is the cost of its calldata so that the gas of the traces sums up to the one of the receipt.
+type EOATransferInputMode string
+
+const (
+	EOATransferInputKeep         EOATransferInputMode = "keep"           // the input is emitted as is, same as "" or unknown modes
+	EOATransferInputStrip        EOATransferInputMode = "strip"          // the input is emitted empty
+	EOATransferInputStripAndFlag EOATransferInputMode = "strip-and-flag" // the input is emitted empty, inputStripped set
+)
+
+// ToTraces convert InternalActionTraceLList to ActionTraceList in the parity compatible form
+func (it *InternalActionTraceList) ToTraces() ActionTraceList {
+	return it.ToTracesWithConfig(TracerConfig{})
+}
+
+// ToTracesWithConfig convert InternalActionTraceLList to ActionTraceList in the form configured by cfg,
+// the traces must be checked by Validate first, out of range values are emitted as is. The stored evm errors
+// are emitted with their OpenEthereum strings, see ParityErrorString.
+func (it *InternalActionTraceList) ToTracesWithConfig(cfg TracerConfig) (traces ActionTraceList) {
 	for _, interTrace := range it.Traces {
 		value := big.NewInt(0)
 		if interTrace.Action.Value != nil {
@@ -75,14 +237,23 @@ func (it *InternalActionTraceList) ToTraces() (traces ActionTraceList) {
 			},
 			BlockHash:           it.BlockHash,
 			BlockNumber:         it.BlockNumber,
+			BlockTimestamp:      it.Timestamp,
 			Subtraces:           interTrace.Subtraces,
+			SubtracesTruncated:  interTrace.SubtracesTruncated,
 			TraceAddress:        interTrace.TraceAddress,
 			TransactionHash:     it.TransactionHash,
 			TransactionPosition: it.TransactionPosition,
+			EOAInput:            interTrace.EOAInput,
 		}
 		if rpcTrace.TraceAddress == nil {
 			rpcTrace.TraceAddress = make([]uint32, 0)
 		}
+		if cfg.Verbose {
+			rpcTrace.StorageAddress = interTrace.StorageAddress
+			rpcTrace.ErrorDetail = interTrace.Fault
+			rpcTrace.Impersonated = interTrace.Impersonated
+			rpcTrace.PreExecution = interTrace.PreExecution
+		}
 		switch interTrace.Action.CallType {
 		case CallTypeCreate:
 			rpcTrace.TraceType = "create"
@@ -93,20 +264,43 @@ func (it *InternalActionTraceList) ToTraces() (traces ActionTraceList) {
 		default:
 			rpcTrace.TraceType = "call"
 			toTraceCall(interTrace, rpcTrace)
+			if mode := cfg.EOATransferInputMode; interTrace.EOAInput && (mode == EOATransferInputStrip || mode == EOATransferInputStripAndFlag) {
+				rpcTrace.Action.Input = &hexutil.Bytes{}
+				rpcTrace.InputStripped = cfg.EOATransferInputMode == EOATransferInputStripAndFlag
+			}
 		}
 		traces = append(traces, *rpcTrace)
 	}
+	MarkRolledBack(traces)
 	return
 }
 
+// MarkRolledBack sets RolledBack of the traces of a tx below a failed frame, whose effects were rolled back
+// even if they succeeded themselves, e.g. for traces converted from other sources. The traces must be in
+// trace order, parents first.
+func MarkRolledBack(traces []RpcActionTrace) {
+	failed := make(map[string]bool)
+	for i := range traces {
+		trace := &traces[i]
+		trace.RolledBack = false
+		if n := len(trace.TraceAddress); n > 0 {
+			trace.RolledBack = failed[traceAddressKey(trace.TraceAddress[:n-1])]
+		}
+		if trace.RolledBack || trace.Error != "" {
+			failed[traceAddressKey(trace.TraceAddress)] = true
+		}
+	}
+}
+
 // toTraceCreate handles crate sub action
 func toTraceCreate(interTrace *InternalActionTrace, rpcTrace *ActionTrace) {
-	init := hexutil.Bytes(interTrace.Action.Init)
+	init := hexutil.Bytes(interTrace.Action.ownedBytes(interTrace.Action.Init))
 	rpcTrace.Action.Init = &init
 	rpcTrace.Action.Input = nil
 	rpcTrace.Action.From = interTrace.Action.From
-	if interTrace.Error != "" {
-		rpcTrace.Error = interTrace.Error
+	rpcTrace.Action.CreateMethod = interTrace.Action.CreateMethod
+	if interTrace.Error != "" || interTrace.Result == nil {
+		rpcTrace.Error = parityErrorOf(traceError(interTrace))
 		return
 	}
 	code := hexutil.Bytes(interTrace.Result.Code)
@@ -119,7 +313,7 @@ func toTraceCreate(interTrace *InternalActionTrace, rpcTrace *ActionTrace) {
 
 // toTraceCall handles call sub action
 func toTraceCall(interTrace *InternalActionTrace, rpcTrace *ActionTrace) {
-	input := hexutil.Bytes(interTrace.Action.Input)
+	input := hexutil.Bytes(interTrace.Action.ownedBytes(interTrace.Action.Input))
 	rpcTrace.Action.Input = &input
 	rpcTrace.Action.Init = nil
 	switch interTrace.Action.CallType {
@@ -134,10 +328,13 @@ func toTraceCall(interTrace *InternalActionTrace, rpcTrace *ActionTrace) {
 	default:
 		rpcTrace.Action.CallType = &Call
 	}
+	if name := interTrace.Action.CallTypeName; name != "" {
+		rpcTrace.Action.CallType = &name
+	}
 	rpcTrace.Action.From = interTrace.Action.From
 	rpcTrace.Action.To = interTrace.Action.To
-	if interTrace.Error != "" {
-		rpcTrace.Error = interTrace.Error
+	if interTrace.Error != "" || interTrace.Result == nil {
+		rpcTrace.Error = parityErrorOf(traceError(interTrace))
 		return
 	}
 	output := hexutil.Bytes(interTrace.Result.Output)
@@ -147,6 +344,14 @@ func toTraceCall(interTrace *InternalActionTrace, rpcTrace *ActionTrace) {
 	}
 }
 
+// traceError is the error of a failed or incomplete frame
+func traceError(interTrace *InternalActionTrace) string {
+	if interTrace.Error == "" && interTrace.Result == nil {
+		return incompleteTraceError
+	}
+	return interTrace.Error
+}
+
 // toTraceSuicide handles selfdestruct sub action
 func toTraceSuicide(interTrace *InternalActionTrace, rpcTrace *ActionTrace) {
 	// suicide has no init/input
@@ -160,6 +365,10 @@ func toTraceSuicide(interTrace *InternalActionTrace, rpcTrace *ActionTrace) {
 		balance.Set(interTrace.Action.Balance)
 	}
 	rpcTrace.Action.Balance = (*hexutil.Big)(balance)
+	if interTrace.Action.Destroyed != nil {
+		destroyed := *interTrace.Action.Destroyed
+		rpcTrace.Action.Destroyed = &destroyed
+	}
 }
 
 type Action struct {
@@ -173,6 +382,10 @@ type Action struct {
 	Address       *common.Address `json:"address,omitempty"`       // for SELFDESTRUCT
 	RefundAddress *common.Address `json:"refundAddress,omitempty"` // for SELFDESTRUCT
 	Balance       *hexutil.Big    `json:"balance,omitempty"`       // for SELFDESTRUCT
+	CreateMethod  string          `json:"createMethod,omitempty"`  // for CREATE, "create" or "create2"
+	// for SELFDESTRUCT since Cancun, where EIP-6780 only deletes accounts created in the same tx and otherwise
+	// just sends the balance. Absent before Cancun, where the account is always deleted.
+	Destroyed *bool `json:"destroyed,omitempty"`
 }
 
 type ActionResult struct {
@@ -184,25 +397,149 @@ type ActionResult struct {
 
 // ActionTrace use for jsonrpc
 type ActionTrace struct {
-	Action              Action        `json:"action"`
-	BlockHash           common.Hash   `json:"blockHash"`
-	BlockNumber         *big.Int      `json:"blockNumber"`
-	Result              *ActionResult `json:"result,omitempty"`
-	Error               string        `json:"error,omitempty"`
-	Subtraces           uint32        `json:"subtraces"`
-	TraceAddress        []uint32      `json:"traceAddress"`
-	TransactionHash     common.Hash   `json:"transactionHash"`
-	TransactionPosition uint64        `json:"transactionPosition"`
-	TraceType           string        `json:"type"`
+	Action              Action          `json:"action"`
+	BlockHash           common.Hash     `json:"blockHash"`
+	BlockNumber         *big.Int        `json:"blockNumber"`
+	BlockTimestamp      uint64          `json:"blockTimestamp,omitempty"` // zero if unknown
+	Result              *ActionResult   `json:"result,omitempty"`
+	Error               string          `json:"error,omitempty"`
+	RolledBack          bool            `json:"rolledBack,omitempty"` // an ancestor failed, see MarkRolledBack
+	Subtraces           uint32          `json:"subtraces"`
+	SubtracesTruncated  bool            `json:"subtracesTruncated,omitempty"`
+	StorageAddress      *common.Address `json:"storageAddress,omitempty"` // TracerConfig.Verbose only
+	ErrorDetail         *FaultInfo      `json:"errorDetail,omitempty"`    // TracerConfig.Verbose only
+	Impersonated        bool            `json:"impersonated,omitempty"`   // TracerConfig.Verbose only
+	InputStripped       bool            `json:"inputStripped,omitempty"`  // see EOATransferInputStripAndFlag
+	PreExecution        bool            `json:"preExecution,omitempty"`   // TracerConfig.Verbose only
+	EOAInput            bool            `json:"-"`                        // see InternalActionTrace.EOAInput, for ValidateTrace
+	TraceAddress        []uint32        `json:"traceAddress"`
+	TransactionHash     common.Hash     `json:"transactionHash"`
+	TransactionPosition uint64          `json:"transactionPosition"`
+	TraceType           string          `json:"type"`
+}
+
+// MarshalJSON emits blockNumber as a plain decimal number like parity, a nil block number as 0.
+func (t ActionTrace) MarshalJSON() ([]byte, error) {
+	type plain ActionTrace
+	number := t.BlockNumber
+	if number == nil {
+		number = new(big.Int)
+	}
+	return json.Marshal(struct {
+		plain
+		BlockNumber *big.Int `json:"blockNumber"`
+	}{plain(t), number})
+}
+
+// UnmarshalJSON accepts blockNumber as a decimal number, a hex quantity string or null, which is read as 0.
+func (t *ActionTrace) UnmarshalJSON(input []byte) error {
+	type plain ActionTrace
+	dec := struct {
+		*plain
+		BlockNumber json.RawMessage `json:"blockNumber"`
+	}{plain: (*plain)(t)}
+	if err := json.Unmarshal(input, &dec); err != nil {
+		return err
+	}
+	number, err := decodeBlockNumber(dec.BlockNumber)
+	if err != nil {
+		return err
+	}
+	t.BlockNumber = number
+	return nil
+}
+
+// decodeBlockNumber decodes a decimal number, a hex quantity string or null
+func decodeBlockNumber(raw json.RawMessage) (*big.Int, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return new(big.Int), nil
+	}
+	if raw[0] == '"' {
+		var quantity hexutil.Big
+		if err := json.Unmarshal(raw, &quantity); err != nil {
+			return nil, fmt.Errorf("invalid blockNumber %s: %v", raw, err)
+		}
+		return quantity.ToInt(), nil
+	}
+	number, ok := new(big.Int).SetString(string(raw), 10)
+	if !ok || number.Sign() < 0 {
+		return nil, fmt.Errorf("invalid blockNumber %s", raw)
+	}
+	return number, nil
 }
 
+// Kinds of failure of FailureKind
+const (
+	FailureNone     = "none"
+	FailureRevert   = "revert"
+	FailureOutOfGas = "outofgas"
+	FailureInvalid  = "invalid"
+)
+
+// FailureKind classifies how the frame failed: a revert bubbling its revert data, running out of gas, any
+// other failure, e.g. an invalid jump or opcode, which includes incomplete frames, or none. The error
+// strings of every tracer generation are recognized, e.g. "Reverted" and "execution reverted".
+func (t *ActionTrace) FailureKind() string {
+	if t.Error == "" {
+		if t.Result == nil && t.TraceType != "suicide" {
+			return FailureInvalid
+		}
+		return FailureNone
+	}
+	switch msg := strings.ToLower(t.Error); {
+	case msg == "reverted" || msg == vm.ErrExecutionReverted.Error():
+		return FailureRevert
+	case strings.Contains(msg, vm.ErrOutOfGas.Error()) || msg == vm.ErrGasUintOverflow.Error():
+		return FailureOutOfGas
+	default:
+		return FailureInvalid
+	}
+}
+
+// normalize fills the fields legacy writers may have left unset
+func (rl ActionTraceList) normalize() {
+	for i := range rl {
+		if rl[i].BlockNumber == nil {
+			rl[i].BlockNumber = new(big.Int)
+		}
+		if rl[i].TraceAddress == nil {
+			rl[i].TraceAddress = make([]uint32, 0)
+		}
+	}
+}
+
+// RpcActionTrace is the jsonrpc trace shape shared by all tracer generations.
+type RpcActionTrace = ActionTrace
+
 type ActionTraceList []ActionTrace
 
+// TracesWithMeta carries the rpc traces of a tx along with tx level metadata
+type TracesWithMeta struct {
+	Traces       ActionTraceList `json:"traces"`
+	GasBreakdown *TxGasBreakdown `json:"gasBreakdown,omitempty"`
+}
+
+// ToTracesWithMeta convert InternalActionTraceList to TracesWithMeta
+func (it *InternalActionTraceList) ToTracesWithMeta() *TracesWithMeta {
+	return it.toTracesWithMeta(TracerConfig{})
+}
+
+func (it *InternalActionTraceList) toTracesWithMeta(cfg TracerConfig) *TracesWithMeta {
+	return &TracesWithMeta{
+		Traces:       it.ToTracesWithConfig(cfg),
+		GasBreakdown: it.GasBreakdown,
+	}
+}
+
 func (rl *ActionTraceList) DecodeRLP(s *rlp.Stream) error {
 	internalActionTraces := InternalActionTraceList{}
 	if err := s.Decode(&internalActionTraces); err != nil {
 		return err
 	}
+	if err := internalActionTraces.Validate(); err != nil {
+		return err
+	}
 	*rl = append(*rl, internalActionTraces.ToTraces()...)
 	return nil
 }
@@ -0,0 +1,420 @@
+package txtracev2
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/big"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+func TestActionTraceBlockNumberJSON(t *testing.T) {
+	tests := []struct {
+		input string
+		want  int64
+	}{
+		{`12345678`, 12345678}, // decimal number, like parity
+		{`"0xbc614e"`, 12345678},
+		{`null`, 0},
+	}
+	for _, test := range tests {
+		var trace ActionTrace
+		blob := `{"action":{"from":null,"value":"0x0","gas":"0x0"},"blockNumber":` + test.input + `,"subtraces":0,"traceAddress":[],"type":"call"}`
+		if err := json.Unmarshal([]byte(blob), &trace); err != nil {
+			t.Fatalf("blockNumber %s: failed to decode trace: %v", test.input, err)
+		}
+		if trace.BlockNumber == nil || trace.BlockNumber.Int64() != test.want {
+			t.Fatalf("blockNumber %s: decoded mismatch: have %v, want %d", test.input, trace.BlockNumber, test.want)
+		}
+		// round trip to a plain decimal number
+		enc, err := json.Marshal(trace)
+		if err != nil {
+			t.Fatalf("blockNumber %s: failed to encode trace: %v", test.input, err)
+		}
+		if want := `"blockNumber":` + big.NewInt(test.want).String(); !strings.Contains(string(enc), want) {
+			t.Fatalf("blockNumber %s: encoded mismatch: have %s, want %s", test.input, enc, want)
+		}
+		var again ActionTrace
+		if err := json.Unmarshal(enc, &again); err != nil {
+			t.Fatalf("blockNumber %s: failed to decode round trip: %v", test.input, err)
+		}
+		if again.BlockNumber.Cmp(trace.BlockNumber) != 0 {
+			t.Fatalf("blockNumber %s: round trip mismatch: have %v, want %v", test.input, again.BlockNumber, trace.BlockNumber)
+		}
+	}
+
+	// nil block numbers are emitted as 0 instead of null
+	enc, err := json.Marshal(ActionTraceList{{TraceAddress: []uint32{}}})
+	if err != nil {
+		t.Fatalf("failed to encode trace: %v", err)
+	}
+	if !strings.Contains(string(enc), `"blockNumber":0`) {
+		t.Fatalf("nil blockNumber encoded as %s", enc)
+	}
+
+	for _, invalid := range []string{`"12"`, `-1`, `1.5`, `true`} {
+		var trace ActionTrace
+		if err := json.Unmarshal([]byte(`{"blockNumber":`+invalid+`}`), &trace); err == nil {
+			t.Errorf("expected blockNumber %s to be rejected", invalid)
+		}
+	}
+}
+
+// FuzzTraceNumbers feeds extreme numbers through rlp encoding, decoding and the rpc conversion, they must
+// either come out unchanged or be rejected with ErrValueOutOfRange.
+func FuzzTraceNumbers(f *testing.F) {
+	huge := bytes.Repeat([]byte{0xff}, 33)
+	f.Add(uint64(0), uint64(0), []byte{}, []byte{}, []byte{}, uint64(0), uint64(0))
+	f.Add(uint64(math.MaxUint64), uint64(math.MaxUint64), bytes.Repeat([]byte{0xff}, 32), bytes.Repeat([]byte{0xff}, 32), bytes.Repeat([]byte{0xff}, 8), uint64(math.MaxUint64), uint64(0))
+	f.Add(uint64(21000), uint64(1), huge, []byte{1}, []byte{1}, uint64(1), uint64(1))
+	f.Add(uint64(21000), uint64(1), []byte{1}, huge, []byte{1}, uint64(1), uint64(1))
+	f.Add(uint64(21000), uint64(1), []byte{1}, []byte{1}, bytes.Repeat([]byte{0x1}, 9), uint64(1), uint64(1))
+	f.Add(uint64(21000), uint64(1), []byte{1}, []byte{1}, []byte{1}, uint64(math.MaxUint64), uint64(1))
+	f.Fuzz(func(t *testing.T, gas, gasUsed uint64, value, balance, number []byte, intrinsic, execution uint64) {
+		var (
+			txHash = common.Hash{0x1}
+			from   = common.Address{0x2}
+			to     = common.Address{0x3}
+			list   = &InternalActionTraceList{
+				Traces: []*InternalActionTrace{
+					{
+						Action:       InternalAction{CallType: CallTypeCall, From: &from, To: &to, Value: new(big.Int).SetBytes(value), Gas: gas},
+						Result:       &InternalTraceActionResult{GasUsed: gasUsed},
+						TraceAddress: []uint32{},
+						Subtraces:    1,
+					},
+					{
+						Action:       InternalAction{CallType: CallTypeSuicide, Address: &to, RefundAddress: &from, Balance: new(big.Int).SetBytes(balance)},
+						TraceAddress: []uint32{0},
+					},
+				},
+				BlockNumber:     new(big.Int).SetBytes(number),
+				TransactionHash: txHash,
+				GasBreakdown:    &TxGasBreakdown{IntrinsicGas: intrinsic, ExecutionGas: execution},
+			}
+		)
+		raw, err := rlp.EncodeToBytes(list)
+		if err != nil {
+			t.Fatalf("failed to encode traces: %v", err)
+		}
+		store := &MemoryStore{data: map[common.Hash][]byte{txHash: raw}}
+		traces, err := ReadRpcTxTrace(context.Background(), store, txHash)
+
+		outOfRange := list.BlockNumber.BitLen() > 64 || list.Traces[0].Action.Value.BitLen() > 256 ||
+			list.Traces[1].Action.Balance.BitLen() > 256 || intrinsic+execution < intrinsic
+		if outOfRange {
+			if !errors.Is(err, ErrValueOutOfRange) {
+				t.Fatalf("out of range numbers not rejected: %v", err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("failed to read traces: %v", err)
+		}
+		blob, err := json.Marshal(traces)
+		if err != nil {
+			t.Fatalf("failed to marshal traces: %v", err)
+		}
+		var decoded ActionTraceList
+		if err := json.Unmarshal(blob, &decoded); err != nil {
+			t.Fatalf("failed to unmarshal traces: %v\n%s", err, blob)
+		}
+		call, suicide := decoded[0], decoded[1]
+		switch {
+		case uint64(call.Action.Gas) != gas || call.Result == nil || uint64(call.Result.GasUsed) != gasUsed:
+			t.Fatalf("gas mismatch: have %d/%v, want %d/%d", call.Action.Gas, call.Result, gas, gasUsed)
+		case call.Action.Value.ToInt().Cmp(list.Traces[0].Action.Value) != 0:
+			t.Fatalf("value mismatch: have %v, want %v", call.Action.Value, list.Traces[0].Action.Value)
+		case suicide.Action.Balance.ToInt().Cmp(list.Traces[1].Action.Balance) != 0:
+			t.Fatalf("balance mismatch: have %v, want %v", suicide.Action.Balance, list.Traces[1].Action.Balance)
+		case call.BlockNumber.Cmp(list.BlockNumber) != 0:
+			t.Fatalf("block number mismatch: have %v, want %v", call.BlockNumber, list.BlockNumber)
+		}
+	})
+}
+
+func TestValidate(t *testing.T) {
+	result := new(InternalTraceActionResult)
+	tests := []struct {
+		list *InternalActionTraceList
+		ok   bool
+	}{
+		{&InternalActionTraceList{BlockNumber: big.NewInt(1), Traces: []*InternalActionTrace{{Result: result, Action: InternalAction{Value: new(big.Int).Lsh(big.NewInt(1), 255)}}}}, true},
+		{&InternalActionTraceList{BlockNumber: big.NewInt(-1)}, false},
+		{&InternalActionTraceList{Traces: []*InternalActionTrace{{Result: result, Action: InternalAction{Value: big.NewInt(-1)}}}}, false},
+		{&InternalActionTraceList{Traces: []*InternalActionTrace{{Result: result, Action: InternalAction{Value: new(big.Int).Lsh(big.NewInt(1), 256)}}}}, false},
+		{&InternalActionTraceList{Traces: []*InternalActionTrace{{Result: result, Action: InternalAction{Balance: big.NewInt(-1)}}}}, false},
+	}
+	for i, test := range tests {
+		if err := test.list.Validate(); (err == nil) != test.ok || (err != nil && !errors.Is(err, ErrValueOutOfRange)) {
+			t.Errorf("test %d: validation mismatch: have %v, want ok %v", i, err, test.ok)
+		}
+	}
+}
+
+// randomTraces traces a random call tree with random numbers up to their full range
+func randomTraces(rnd *rand.Rand) *InternalActionTraceList {
+	var (
+		addr  = func() common.Address { return common.Address{byte(rnd.Intn(8))} }
+		value = func() *big.Int {
+			return new(big.Int).Rand(rnd, new(big.Int).Lsh(big.NewInt(1), uint(rnd.Intn(257))))
+		}
+		data = func() []byte {
+			buf := make([]byte, rnd.Intn(40))
+			rnd.Read(buf)
+			return buf
+		}
+	)
+	tracer := NewOeTracer(nil, common.Hash{byte(rnd.Intn(256))}, new(big.Int).SetUint64(rnd.Uint64()), common.Hash{0x1}, rnd.Uint64(), WithBlockTimestamp(rnd.Uint64()))
+	tracer.CaptureStart(nil, addr(), addr(), rnd.Intn(5) == 0, data(), rnd.Uint64(), value())
+	depth := 0
+	for i := rnd.Intn(12); i > 0; i-- {
+		if depth > 0 && rnd.Intn(3) == 0 {
+			var err error
+			if rnd.Intn(3) == 0 {
+				err = vm.ErrExecutionReverted
+			}
+			tracer.CaptureExit(data(), rnd.Uint64(), err)
+			depth--
+			continue
+		}
+		switch op := []vm.OpCode{vm.CALL, vm.STATICCALL, vm.DELEGATECALL, vm.CALLCODE, vm.CREATE, vm.CREATE2, vm.SELFDESTRUCT}[rnd.Intn(7)]; op {
+		case vm.SELFDESTRUCT:
+			tracer.CaptureEnter(op, addr(), addr(), nil, 0, value())
+			tracer.CaptureExit(nil, 0, nil)
+		default:
+			tracer.CaptureEnter(op, addr(), addr(), data(), rnd.Uint64(), value())
+			depth++
+		}
+	}
+	for ; depth > 0; depth-- {
+		tracer.CaptureExit(data(), rnd.Uint64(), nil)
+	}
+	tracer.CaptureEnd(data(), rnd.Uint64(), nil)
+	if rnd.Intn(2) == 0 {
+		tracer.outPutTraces.GasBreakdown = &TxGasBreakdown{IntrinsicGas: rnd.Uint64() >> 1, ExecutionGas: rnd.Uint64() >> 1, EffectiveGasUsed: rnd.Uint64()}
+	}
+	return tracer.getInternalTraces()
+}
+
+// rpcJSON returns the json of the rpc form of traces
+func rpcJSON(t *testing.T, traces *InternalActionTraceList) string {
+	blob, err := json.Marshal(traces.ToTracesWithConfig(TracerConfig{Verbose: true}))
+	if err != nil {
+		t.Fatalf("failed to marshal traces: %v", err)
+	}
+	return string(blob)
+}
+
+// FuzzInternalActionTracesDecode feeds arbitrary bytes to the read path of stored traces, which must never
+// panic. Whatever decodes must convert to the same rpc form after another encoding round.
+func FuzzInternalActionTracesDecode(f *testing.F) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 8; i++ {
+		blob, err := rlp.EncodeToBytes(randomTraces(rnd))
+		if err != nil {
+			f.Fatalf("failed to encode traces: %v", err)
+		}
+		f.Add(blob)
+	}
+	// a call frame with neither a result nor an error
+	malformed, _ := rlp.EncodeToBytes(&InternalActionTraceList{Traces: []*InternalActionTrace{{Action: InternalAction{CallType: CallTypeCall}}}, BlockNumber: new(big.Int)})
+	f.Add(malformed)
+	f.Add([]byte{})
+	f.Add([]byte{0xc0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decoded := new(InternalActionTraceList)
+		if err := rlp.DecodeBytes(data, decoded); err != nil {
+			return
+		}
+		if err := decoded.Validate(); err != nil {
+			if !errors.Is(err, ErrValueOutOfRange) && !errors.Is(err, ErrMalformedTrace) {
+				t.Fatalf("unexpected validation error: %v", err)
+			}
+		}
+		decoded.ToTraces()
+		decoded.ToTracesWithMeta()
+		if _, err := decoded.ToGethCallFrame(); err != nil {
+			t.Logf("not a call tree: %v", err)
+		}
+
+		reencoded, err := rlp.EncodeToBytes(decoded)
+		if err != nil {
+			t.Fatalf("failed to re-encode decoded traces: %v", err)
+		}
+		again := new(InternalActionTraceList)
+		if err := rlp.DecodeBytes(reencoded, again); err != nil {
+			t.Fatalf("failed to decode re-encoded traces: %v", err)
+		}
+		if decoded.Validate() == nil && rpcJSON(t, again) != rpcJSON(t, decoded) {
+			t.Fatalf("rpc form changed by an encoding round")
+		}
+	})
+}
+
+// FuzzInternalActionTracesRoundTrip encodes random valid traces, the decoded traces must have the same
+// rpc form as the original ones.
+func FuzzInternalActionTracesRoundTrip(f *testing.F) {
+	for seed := int64(0); seed < 16; seed++ {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, seed int64) {
+		traces := randomTraces(rand.New(rand.NewSource(seed)))
+		if err := traces.Validate(); err != nil {
+			t.Fatalf("random traces invalid: %v", err)
+		}
+		blob, err := rlp.EncodeToBytes(traces)
+		if err != nil {
+			t.Fatalf("failed to encode traces: %v", err)
+		}
+		decoded := new(InternalActionTraceList)
+		if err := rlp.DecodeBytes(blob, decoded); err != nil {
+			t.Fatalf("failed to decode traces: %v", err)
+		}
+		if err := decoded.Validate(); err != nil {
+			t.Fatalf("decoded traces invalid: %v", err)
+		}
+		if have, want := rpcJSON(t, decoded), rpcJSON(t, traces); have != want {
+			t.Fatalf("rpc form mismatch:\nhave %s\nwant %s", have, want)
+		}
+	})
+}
+
+func TestToTracesWithoutResult(t *testing.T) {
+	from := common.Address{0x1}
+	traces := &InternalActionTraceList{
+		Traces: []*InternalActionTrace{
+			{Action: InternalAction{CallType: CallTypeCall, From: &from}, TraceAddress: []uint32{}, Subtraces: 1},
+			{Action: InternalAction{CallType: CallTypeCreate, From: &from}, TraceAddress: []uint32{0}},
+		},
+		BlockNumber: big.NewInt(1),
+	}
+	if err := traces.Validate(); !errors.Is(err, ErrMalformedTrace) {
+		t.Fatalf("validation error mismatch: have %v, want %v", err, ErrMalformedTrace)
+	}
+	for _, trace := range traces.ToTraces() {
+		if trace.Result != nil {
+			t.Fatalf("trace %v: result made up: %+v", trace.TraceAddress, trace.Result)
+		}
+		if trace.Error != incompleteTraceError {
+			t.Fatalf("trace %v: error mismatch: have %q, want %q", trace.TraceAddress, trace.Error, incompleteTraceError)
+		}
+	}
+	root, err := traces.ToGethCallFrame()
+	if err != nil {
+		t.Fatalf("failed to convert traces: %v", err)
+	}
+	if root.Error != incompleteTraceError || root.Calls[0].Error != incompleteTraceError || root.Calls[0].To != nil {
+		t.Fatalf("geth call frame mismatch: %+v", root)
+	}
+
+	blob, err := rlp.EncodeToBytes(traces)
+	if err != nil {
+		t.Fatalf("failed to encode traces: %v", err)
+	}
+	store := &MemoryStore{data: map[common.Hash][]byte{{}: blob}}
+	if _, err := ReadRpcTxTrace(context.Background(), store, common.Hash{}); !errors.Is(err, ErrMalformedTrace) {
+		t.Fatalf("read error mismatch: have %v, want %v", err, ErrMalformedTrace)
+	}
+}
+
+func TestFailureKind(t *testing.T) {
+	result := &ActionResult{}
+	tests := []struct {
+		trace ActionTrace
+		want  string
+	}{
+		{ActionTrace{TraceType: "call", Result: result}, FailureNone},
+		{ActionTrace{TraceType: "suicide"}, FailureNone},
+		{ActionTrace{TraceType: "call", Error: "Reverted"}, FailureRevert}, // v1
+		{ActionTrace{TraceType: "call", Error: vm.ErrExecutionReverted.Error()}, FailureRevert},
+		{ActionTrace{TraceType: "call", Error: "Out of gas"}, FailureOutOfGas},
+		{ActionTrace{TraceType: "call", Error: vm.ErrOutOfGas.Error()}, FailureOutOfGas},
+		{ActionTrace{TraceType: "create", Error: vm.ErrCodeStoreOutOfGas.Error()}, FailureOutOfGas},
+		{ActionTrace{TraceType: "call", Error: vm.ErrGasUintOverflow.Error()}, FailureOutOfGas},
+		{ActionTrace{TraceType: "call", Error: vm.ErrInvalidJump.Error()}, FailureInvalid},
+		{ActionTrace{TraceType: "call", Error: (&vm.ErrInvalidOpCode{}).Error()}, FailureInvalid},
+		{ActionTrace{TraceType: "call", Error: vm.ErrDepth.Error()}, FailureInvalid},
+		{ActionTrace{TraceType: "call", Error: incompleteTraceError}, FailureInvalid},
+		{ActionTrace{TraceType: "call"}, FailureInvalid}, // neither result nor error
+	}
+	for i, test := range tests {
+		if have := test.trace.FailureKind(); have != test.want {
+			t.Errorf("test %d (%q): failure kind mismatch: have %s, want %s", i, test.trace.Error, have, test.want)
+		}
+	}
+}
+
+func TestRolledBack(t *testing.T) {
+	var (
+		entry   = common.Address{0x1}
+		factory = common.Address{0x2}
+		created = common.Address{0x3}
+		callee  = common.Address{0x4}
+	)
+	tests := []struct {
+		name       string
+		innerErr   error // of the call below the create
+		outerErr   error // of the call the create is made by
+		rolledBack []bool
+		transfers  int // of value, all frames send 1 wei
+	}{
+		// try/catch: the inner call reverts, the create and the call making it succeed
+		{"caught", vm.ErrExecutionReverted, nil, []bool{false, false, false, false}, 3},
+		// the create and the call below it succeed, but the call making the create reverts
+		{"reverted", nil, vm.ErrExecutionReverted, []bool{false, false, true, true}, 1},
+	}
+	for _, test := range tests {
+		tracer := NewOeTracer(nil, common.Hash{}, big.NewInt(1), common.Hash{}, 0)
+		tracer.CaptureStart(nil, common.Address{}, entry, false, nil, 1_000_000, big.NewInt(1))
+		tracer.CaptureEnter(vm.CALL, entry, factory, nil, 900_000, big.NewInt(1))
+		tracer.CaptureEnter(vm.CREATE, factory, created, nil, 800_000, big.NewInt(1))
+		tracer.CaptureEnter(vm.CALL, created, callee, nil, 700_000, big.NewInt(1))
+		tracer.CaptureExit(nil, 1_000, test.innerErr)
+		tracer.CaptureExit([]byte{0x60}, 2_000, nil)
+		tracer.CaptureExit(nil, 3_000, test.outerErr)
+		tracer.CaptureEnd(nil, 4_000, nil)
+
+		traces := tracer.getInternalTraces().ToTraces()
+		if len(traces) != len(test.rolledBack) {
+			t.Fatalf("%s: trace count mismatch: have %d, want %d", test.name, len(traces), len(test.rolledBack))
+		}
+		for i, trace := range traces {
+			if trace.RolledBack != test.rolledBack[i] {
+				t.Fatalf("%s: trace %v rolled back mismatch: have %v, want %v", test.name, trace.TraceAddress, trace.RolledBack, test.rolledBack[i])
+			}
+		}
+		// the flag is computed, it's not stored and recomputed for traces from other sources
+		blob, err := json.Marshal(traces)
+		if err != nil {
+			t.Fatalf("%s: failed to encode traces: %v", test.name, err)
+		}
+		if want := test.outerErr != nil; strings.Contains(string(blob), `"rolledBack":true`) != want {
+			t.Fatalf("%s: rolledBack encoding mismatch: %s", test.name, blob)
+		}
+		var decoded ActionTraceList
+		if err := json.Unmarshal(blob, &decoded); err != nil {
+			t.Fatalf("%s: failed to decode traces: %v", test.name, err)
+		}
+		for i := range decoded {
+			decoded[i].RolledBack = !decoded[i].RolledBack
+		}
+		MarkRolledBack(decoded)
+		if !jsonEqual(decoded, traces) {
+			jsonDiff(t, decoded, traces)
+		}
+
+		if transfers := ExtractValueTransfers(tracer.getInternalTraces()); len(transfers) != test.transfers {
+			t.Fatalf("%s: value transfer count mismatch: have %d, want %d", test.name, len(transfers), test.transfers)
+		}
+	}
+}
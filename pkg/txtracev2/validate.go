@@ -0,0 +1,184 @@
+package txtracev2
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// IssueCode identifies the kind of a ValidationIssue.
+type IssueCode string
+
+const (
+	IssueMissingRoot         IssueCode = "missing_root"          // no top-level trace
+	IssueMalformedTree       IssueCode = "malformed_tree"        // duplicated trace address or trace without parent
+	IssueSubtracesMismatch   IssueCode = "subtraces_mismatch"    // subtraces differs from the number of children
+	IssueSenderMismatch      IssueCode = "sender_mismatch"       // root from isn't the sender of the tx
+	IssueRecipientMismatch   IssueCode = "recipient_mismatch"    // root to isn't the recipient of the tx, or a create for a call
+	IssueInputMismatch       IssueCode = "input_mismatch"        // root input or init isn't the data of the tx
+	IssueValueMismatch       IssueCode = "value_mismatch"        // root value isn't the value of the tx
+	IssueTxHashMismatch      IssueCode = "tx_hash_mismatch"      // transactionHash isn't the hash of the tx or receipt
+	IssueTxPositionMismatch  IssueCode = "tx_position_mismatch"  // transactionPosition isn't the index of the receipt
+	IssueBlockHashMismatch   IssueCode = "block_hash_mismatch"   // blockHash isn't the hash of the header, e.g. after a reorg
+	IssueBlockNumberMismatch IssueCode = "block_number_mismatch" // blockNumber isn't the number of the header
+	IssueTimestampMismatch   IssueCode = "timestamp_mismatch"    // blockTimestamp, when known, isn't the time of the header
+	IssueGasMismatch         IssueCode = "gas_mismatch"          // root gasUsed can't add up to the receipt gasUsed
+	IssueStatusMismatch      IssueCode = "status_mismatch"       // root error presence disagrees with the receipt status
+)
+
+// ValidationIssue is an inconsistency of a trace with its tx, receipt or block.
+type ValidationIssue struct {
+	Code         IssueCode `json:"code"`
+	TraceAddress []uint32  `json:"traceAddress,omitempty"` // the first trace with the issue, nil for tx level issues
+	Message      string    `json:"message"`
+}
+
+func (issue ValidationIssue) String() string {
+	if issue.TraceAddress != nil {
+		return fmt.Sprintf("%s at %v: %s", issue.Code, issue.TraceAddress, issue.Message)
+	}
+	return fmt.Sprintf("%s: %s", issue.Code, issue.Message)
+}
+
+// ValidateTrace checks the traces of tx against its receipt and the header of its block, an empty result means
+// they're consistent. The root gasUsed plus the intrinsic gas of the tx, under Istanbul rules, must cover the
+// receipt gasUsed at most up to the refund cap of the block, i.e. a fifth of it after London and half before.
+// Field mismatches shared by all traces are reported once, at the first trace having them.
+func ValidateTrace(traces []RpcActionTrace, receipt *types.Receipt, header *types.Header, tx *types.Transaction, signer types.Signer) []ValidationIssue {
+	var (
+		issues   []ValidationIssue
+		reported = make(map[IssueCode]bool)
+		report   = func(code IssueCode, trace *RpcActionTrace, format string, args ...interface{}) {
+			if reported[code] {
+				return
+			}
+			reported[code] = true
+			issue := ValidationIssue{Code: code, Message: fmt.Sprintf(format, args...)}
+			if trace != nil {
+				issue.TraceAddress = append([]uint32{}, trace.TraceAddress...)
+			}
+			issues = append(issues, issue)
+		}
+		root     *RpcActionTrace
+		children = make(map[string]uint32, len(traces))
+		seen     = make(map[string]bool, len(traces))
+	)
+	for i := range traces {
+		trace := &traces[i]
+		key := traceAddressKey(trace.TraceAddress)
+		if seen[key] {
+			report(IssueMalformedTree, trace, "duplicated trace address")
+		}
+		seen[key] = true
+		if len(trace.TraceAddress) == 0 {
+			root = trace
+		} else if parent := traceAddressKey(trace.TraceAddress[:len(trace.TraceAddress)-1]); !seen[parent] {
+			report(IssueMalformedTree, trace, "parent trace not found")
+		} else {
+			children[parent]++
+		}
+
+		if trace.TransactionHash != tx.Hash() || trace.TransactionHash != receipt.TxHash {
+			report(IssueTxHashMismatch, trace, "have %s, want %s", trace.TransactionHash.Hex(), tx.Hash().Hex())
+		}
+		if trace.TransactionPosition != uint64(receipt.TransactionIndex) {
+			report(IssueTxPositionMismatch, trace, "have %d, want %d", trace.TransactionPosition, receipt.TransactionIndex)
+		}
+		if trace.BlockHash != header.Hash() {
+			report(IssueBlockHashMismatch, trace, "have %s, want %s", trace.BlockHash.Hex(), header.Hash().Hex())
+		}
+		if trace.BlockNumber == nil || trace.BlockNumber.Cmp(header.Number) != 0 {
+			report(IssueBlockNumberMismatch, trace, "have %v, want %v", trace.BlockNumber, header.Number)
+		}
+		if trace.BlockTimestamp != 0 && trace.BlockTimestamp != header.Time {
+			report(IssueTimestampMismatch, trace, "have %d, want %d", trace.BlockTimestamp, header.Time)
+		}
+	}
+	for i := range traces {
+		trace := &traces[i]
+		have := children[traceAddressKey(trace.TraceAddress)]
+		// traces stored by older versions counted the truncated sub traces they didn't record
+		if have != trace.Subtraces && !(trace.SubtracesTruncated && have < trace.Subtraces) {
+			report(IssueSubtracesMismatch, trace, "%d subtraces, %d children", trace.Subtraces, have)
+		}
+	}
+	if root == nil {
+		report(IssueMissingRoot, nil, "top-level trace not found")
+		return issues
+	}
+
+	validateRootAction(root, tx, signer, report)
+	if failed := root.Error != ""; failed != (receipt.Status == types.ReceiptStatusFailed) {
+		report(IssueStatusMismatch, root, "trace error %q, receipt status %d", root.Error, receipt.Status)
+	}
+	if root.Result != nil {
+		validateRootGas(root, receipt, header, tx, report)
+	}
+	return issues
+}
+
+type reportFunc func(code IssueCode, trace *RpcActionTrace, format string, args ...interface{})
+
+// validateRootAction checks the top-level action is the one of tx
+func validateRootAction(root *RpcActionTrace, tx *types.Transaction, signer types.Signer, report reportFunc) {
+	action := &root.Action
+	if sender, err := types.Sender(signer, tx); err != nil {
+		report(IssueSenderMismatch, root, "failed to recover the sender: %v", err)
+	} else if action.From == nil || *action.From != sender {
+		report(IssueSenderMismatch, root, "have %v, want %s", action.From, sender.Hex())
+	}
+	if tx.To() == nil {
+		if root.TraceType != "create" {
+			report(IssueRecipientMismatch, root, "%s trace for a contract creation", root.TraceType)
+		} else if action.Init == nil || !bytes.Equal(*action.Init, tx.Data()) {
+			report(IssueInputMismatch, root, "init differs from the tx data")
+		}
+	} else {
+		if root.TraceType != "call" || action.To == nil || *action.To != *tx.To() {
+			report(IssueRecipientMismatch, root, "have %s to %v, want call to %s", root.TraceType, action.To, tx.To().Hex())
+		} else if action.Input == nil || !bytes.Equal(*action.Input, tx.Data()) {
+			report(IssueInputMismatch, root, "input differs from the tx data")
+		}
+	}
+	if action.Value == nil || action.Value.ToInt().Cmp(tx.Value()) != 0 {
+		report(IssueValueMismatch, root, "have %v, want %v", action.Value, tx.Value())
+	}
+}
+
+// validateRootGas checks the root gasUsed adds up to the receipt gasUsed within the refund cap
+func validateRootGas(root *RpcActionTrace, receipt *types.Receipt, header *types.Header, tx *types.Transaction, report reportFunc) {
+	// the gasUsed of a call sending an input to an account without code already counts the calldata
+	intrinsic := params.TxGas
+	if !root.EOAInput {
+		isShanghai := header.WithdrawalsHash != nil
+		var err error
+		if intrinsic, err = intrinsicGas(tx.Data(), tx.AccessList(), tx.To() == nil, true, true, isShanghai); err != nil {
+			report(IssueGasMismatch, root, "failed to compute the intrinsic gas: %v", err)
+			return
+		}
+	}
+	total := uint64(root.Result.GasUsed) + intrinsic
+	if total < intrinsic {
+		report(IssueGasMismatch, root, "gas used %d overflows with intrinsic gas %d", root.Result.GasUsed, intrinsic)
+		return
+	}
+	quotient := params.RefundQuotient
+	if header.BaseFee != nil {
+		quotient = params.RefundQuotientEIP3529
+	}
+	if receipt.GasUsed > total || receipt.GasUsed < total-total/quotient {
+		report(IssueGasMismatch, root, "trace gas %d (%d used plus %d intrinsic), receipt gas %d", total, root.Result.GasUsed, intrinsic, receipt.GasUsed)
+	}
+}
+
+// ValidateStoredTrace reads the traces of tx from store and validates them with ValidateTrace.
+func ValidateStoredTrace(ctx context.Context, store Store, receipt *types.Receipt, header *types.Header, tx *types.Transaction, signer types.Signer) ([]ValidationIssue, error) {
+	traces, err := ReadRpcTxTrace(ctx, store, tx.Hash())
+	if err != nil {
+		return nil, err
+	}
+	return ValidateTrace(traces, receipt, header, tx, signer), nil
+}
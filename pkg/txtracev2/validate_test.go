@@ -0,0 +1,184 @@
+package txtracev2
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+func TestValidateTrace(t *testing.T) {
+	var (
+		key, _   = crypto.GenerateKey()
+		sender   = crypto.PubkeyToAddress(key.PublicKey)
+		contract = common.Address{0xc}
+		token    = common.Address{0xd}
+		signer   = types.LatestSignerForChainID(big.NewInt(1))
+		header   = &types.Header{Number: big.NewInt(100), Time: 1_700_000_000, BaseFee: big.NewInt(1), Difficulty: big.NewInt(0)}
+	)
+	tx, err := types.SignNewTx(key, signer, &types.DynamicFeeTx{ChainID: big.NewInt(1), To: &contract, Gas: 100_000, GasFeeCap: big.NewInt(1), Value: big.NewInt(5), Data: []byte{0x1, 0x2}})
+	if err != nil {
+		t.Fatalf("failed to sign tx: %v", err)
+	}
+	// 21032 intrinsic gas for the 2 bytes of data, 40000 execution gas with a 5000 refund
+	receipt := &types.Receipt{Status: types.ReceiptStatusSuccessful, GasUsed: 56_032, TxHash: tx.Hash(), TransactionIndex: 3, BlockNumber: header.Number}
+
+	// stored returns the traces of tx, the internal call of the contract reverts
+	stored := func() *InternalActionTraceList {
+		tracer := NewOeTracer(nil, header.Hash(), header.Number, tx.Hash(), 3, WithBlockTimestamp(header.Time))
+		tracer.CaptureStart(nil, sender, contract, false, tx.Data(), 78_968, tx.Value())
+		tracer.CaptureEnter(vm.CALL, contract, token, []byte{0x3}, 30_000, big.NewInt(0))
+		tracer.CaptureExit(nil, 1_000, vm.ErrExecutionReverted)
+		tracer.CaptureEnd(nil, 40_000, nil)
+		return tracer.getInternalTraces()
+	}
+	traces := stored().ToTraces()
+	if issues := ValidateTrace(traces, receipt, header, tx, signer); len(issues) != 0 {
+		t.Fatalf("consistent traces reported: %v", issues)
+	}
+
+	codes := func(issues []ValidationIssue) []IssueCode {
+		var codes []IssueCode
+		for _, issue := range issues {
+			codes = append(codes, issue.Code)
+		}
+		return codes
+	}
+	tests := []struct {
+		name   string
+		modify func(traces ActionTraceList, receipt *types.Receipt, header *types.Header)
+		want   []IssueCode
+	}{
+		{
+			name: "sender",
+			modify: func(traces ActionTraceList, receipt *types.Receipt, header *types.Header) {
+				other := common.Address{0x1}
+				traces[0].Action.From = &other
+			},
+			want: []IssueCode{IssueSenderMismatch},
+		},
+		{
+			name: "reorg",
+			modify: func(traces ActionTraceList, receipt *types.Receipt, header *types.Header) {
+				header.Extra = []byte("canonical")
+			},
+			want: []IssueCode{IssueBlockHashMismatch},
+		},
+		{
+			name: "stale block number",
+			modify: func(traces ActionTraceList, receipt *types.Receipt, header *types.Header) {
+				header.Number = big.NewInt(101)
+			},
+			want: []IssueCode{IssueBlockHashMismatch, IssueBlockNumberMismatch},
+		},
+		{
+			name: "status",
+			modify: func(traces ActionTraceList, receipt *types.Receipt, header *types.Header) {
+				receipt.Status = types.ReceiptStatusFailed
+			},
+			want: []IssueCode{IssueStatusMismatch},
+		},
+		{
+			name: "wrong tx",
+			modify: func(traces ActionTraceList, receipt *types.Receipt, header *types.Header) {
+				receipt.TxHash = common.Hash{0x1}
+				receipt.TransactionIndex = 4
+			},
+			want: []IssueCode{IssueTxHashMismatch, IssueTxPositionMismatch},
+		},
+		{
+			name: "gas",
+			modify: func(traces ActionTraceList, receipt *types.Receipt, header *types.Header) {
+				receipt.GasUsed = 70_000
+			},
+			want: []IssueCode{IssueGasMismatch},
+		},
+		{
+			name: "refund beyond the cap",
+			modify: func(traces ActionTraceList, receipt *types.Receipt, header *types.Header) {
+				receipt.GasUsed = 40_000
+			},
+			want: []IssueCode{IssueGasMismatch},
+		},
+		{
+			name: "input and subtraces",
+			modify: func(traces ActionTraceList, receipt *types.Receipt, header *types.Header) {
+				input := hexutil.Bytes{0x9}
+				traces[0].Action.Input = &input
+				traces[0].Subtraces = 2
+			},
+			want: []IssueCode{IssueSubtracesMismatch, IssueInputMismatch},
+		},
+	}
+	for _, test := range tests {
+		traces := stored().ToTraces()
+		receipt, header := *receipt, types.CopyHeader(header)
+		test.modify(traces, &receipt, header)
+		issues := ValidateTrace(traces, &receipt, header, tx, signer)
+		if have := codes(issues); !reflect.DeepEqual(have, test.want) {
+			t.Errorf("%s: issues mismatch: have %v, want %v", test.name, issues, test.want)
+		}
+	}
+
+	// the stored traces are validated the same way
+	store := &MemoryStore{data: make(map[common.Hash][]byte)}
+	blob, err := rlp.EncodeToBytes(stored())
+	if err != nil {
+		t.Fatalf("failed to encode traces: %v", err)
+	}
+	store.data[tx.Hash()] = blob
+	reorged := types.CopyHeader(header)
+	reorged.Extra = []byte("canonical")
+	issues, err := ValidateStoredTrace(context.Background(), store, receipt, reorged, tx, signer)
+	if err != nil {
+		t.Fatalf("failed to validate stored traces: %v", err)
+	}
+	if have := codes(issues); !reflect.DeepEqual(have, []IssueCode{IssueBlockHashMismatch}) || len(issues[0].TraceAddress) != 0 {
+		t.Fatalf("stored traces issues mismatch: %v", issues)
+	}
+	if _, err := ValidateStoredTrace(context.Background(), store, receipt, header, types.NewTx(&types.LegacyTx{Nonce: 1}), signer); err == nil {
+		t.Fatalf("missing traces validated")
+	}
+}
+
+func TestValidateTraceEOAInput(t *testing.T) {
+	var (
+		key, _    = crypto.GenerateKey()
+		sender    = crypto.PubkeyToAddress(key.PublicKey)
+		recipient = common.Address{0xe}
+		signer    = types.LatestSignerForChainID(big.NewInt(1))
+		header    = &types.Header{Number: big.NewInt(100), Time: 1_700_000_000, BaseFee: big.NewInt(1), Difficulty: big.NewInt(0)}
+		data      = bytes.Repeat([]byte{0x1}, 1000)
+	)
+	tx, err := types.SignNewTx(key, signer, &types.DynamicFeeTx{ChainID: big.NewInt(1), To: &recipient, Gas: 100_000, GasFeeCap: big.NewInt(1), Data: data})
+	if err != nil {
+		t.Fatalf("failed to sign tx: %v", err)
+	}
+	// 16000 gas for the 1000 bytes of calldata on top of the 21000 base, the root gasUsed of the trace
+	receipt := &types.Receipt{Status: types.ReceiptStatusSuccessful, GasUsed: 37_000, TxHash: tx.Hash(), TransactionIndex: 3, BlockNumber: header.Number}
+
+	tracer := NewOeTracer(nil, header.Hash(), header.Number, tx.Hash(), 3, WithBlockTimestamp(header.Time))
+	tracer.CaptureStart(nil, sender, recipient, false, data, 63_000, big.NewInt(0))
+	tracer.CaptureEnd(nil, 0, nil)
+	internalTraces := tracer.getInternalTraces()
+	internalTraces.Traces[0].EOAInput = true
+	internalTraces.Traces[0].Result.GasUsed = 16_000
+
+	// the root gasUsed adds up to the receipt gasUsed with the 21000 base only
+	if issues := ValidateTrace(internalTraces.ToTraces(), receipt, header, tx, signer); len(issues) != 0 {
+		t.Fatalf("consistent traces reported: %v", issues)
+	}
+	// nor does a receipt counting the calldata twice
+	receipt.GasUsed = 53_000
+	if issues := ValidateTrace(internalTraces.ToTraces(), receipt, header, tx, signer); len(issues) != 1 || issues[0].Code != IssueGasMismatch {
+		t.Fatalf("calldata counted twice validated: %v", issues)
+	}
+}